@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetryAfter 请求被拒绝时建议客户端等待的默认时间
+const defaultRetryAfter = time.Second
+
+// errOverloaded 正在处理的执行类请求数已达 max_queue_depth
+var errOverloaded = errors.New("server is overloaded, try again later")
+
+// Admission 限制整个服务同时处理的执行类请求数, 包括在途、排队和未完成的异步任务
+// 达到上限时新请求在做任何 shell 操作之前立即被拒绝, 避免请求无限堆积后全部超时
+type Admission struct {
+	// limit 上限, 0 表示不限制
+	limit int64
+	// retryAfter 拒绝时 Retry-After 响应头建议的等待时间
+	retryAfter time.Duration
+
+	depth atomic.Int64
+	shed  atomic.Int64
+}
+
+func NewAdmission(limit int, retryAfter time.Duration) *Admission {
+	return &Admission{limit: int64(limit), retryAfter: retryAfter}
+}
+
+// Enter 占用一个名额, 已达上限时返回 false, 成功后调用方需调用 Exit
+func (a *Admission) Enter() bool {
+	if depth := a.depth.Add(1); a.limit > 0 && depth > a.limit {
+		a.depth.Add(-1)
+		a.shed.Add(1)
+		return false
+	}
+	return true
+}
+
+// Exit 归还名额
+func (a *Admission) Exit() {
+	a.depth.Add(-1)
+}
+
+// Depth 正在处理的执行类请求数
+func (a *Admission) Depth() int64 {
+	return a.depth.Load()
+}
+
+// Shed 因达到上限被拒绝的请求总数
+func (a *Admission) Shed() int64 {
+	return a.shed.Load()
+}
+
+// retryAfterSeconds Retry-After 响应头的秒数, 不足一秒按一秒计
+func (a *Admission) retryAfterSeconds() string {
+	seconds := int64((a.retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// overloadedError 返回拒绝请求的错误, 由 writeErrorResult 设置 Retry-After
+func overloadedError() error {
+	return newAPIErrorCode(http.StatusServiceUnavailable, codeOverloaded, "%v", errOverloaded)
+}
+
+// admit 执行类接口的准入控制, 达到上限时直接返回 503
+func admit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !admission.Enter() {
+			log.Printf("✗ Request shed | Path: %s | Depth: %d", r.URL.Path, admission.Depth())
+			writeError(w, overloadedError())
+			return
+		}
+		defer admission.Exit()
+		next(w, r)
+	}
+}
+
+var admission = NewAdmission(0, defaultRetryAfter)
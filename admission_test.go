@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(2, 1500*time.Millisecond)
+	if !a.Enter() || !a.Enter() {
+		t.Fatal("requests under the limit shed")
+	}
+	if a.Enter() {
+		t.Fatal("request over the limit admitted")
+	}
+	if a.Depth() != 2 || a.Shed() != 1 {
+		t.Fatalf("depth %d, shed %d", a.Depth(), a.Shed())
+	}
+	a.Exit()
+	if !a.Enter() {
+		t.Fatal("request after exit shed")
+	}
+	// 不足一秒的部分按一秒计
+	if got := a.retryAfterSeconds(); got != "2" {
+		t.Fatalf("Retry-After = %q", got)
+	}
+	if got := NewAdmission(1, 10*time.Millisecond).retryAfterSeconds(); got != "1" {
+		t.Fatalf("short Retry-After = %q", got)
+	}
+
+	// 0 表示不限制
+	unlimited := NewAdmission(0, time.Second)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Enter() {
+			t.Fatal("unlimited admission shed a request")
+		}
+	}
+}
+
+func TestAdmissionConcurrent(t *testing.T) {
+	const limit = 5
+	a := NewAdmission(limit, time.Second)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if a.Enter() {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != limit || a.Depth() != limit || a.Shed() != 50-limit {
+		t.Fatalf("admitted %d, depth %d, shed %d", admitted, a.Depth(), a.Shed())
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxQueueDepth = 2
+		cfg.RetryAfter = Duration(3 * time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{"Slow-Job": {Output: "done", DelayMs: 500}}
+	})
+	first, second, third := ts.startSession(aliceToken, nil), ts.startSession(aliceToken, nil), ts.startSession(bobToken, nil)
+
+	// 一个同步请求和一个异步任务占满名额
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.run(aliceToken, first, "Slow-Job", nil)
+	}()
+	if resp, data := ts.post(aliceToken, "/run-command-async", map[string]any{"session_id": second, "command": "Slow-Job"}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("async = %d %s", resp.StatusCode, data)
+	}
+	waitFor(t, func() bool { return admission.Depth() == 2 })
+
+	// 新的执行请求立即被拒绝, 不等待 shell
+	start := time.Now()
+	resp, data := ts.run(bobToken, third, "echo hi", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeOverloaded || resp.Header.Get("Retry-After") != "3" {
+		t.Fatalf("run over max_queue_depth = %d %s Retry-After %q", resp.StatusCode, data, resp.Header.Get("Retry-After"))
+	}
+	if resp, _ = ts.post(bobToken, "/start-session", map[string]any{}); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("start-session over max_queue_depth = %d", resp.StatusCode)
+	}
+	if resp, _ = ts.post(bobToken, "/run-command-async", map[string]any{"session_id": third, "command": "echo hi"}); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("async over max_queue_depth = %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("shedding took %s", elapsed)
+	}
+	// 不执行命令的接口不受影响
+	if resp, _ = ts.do(http.MethodGet, bobToken, "/sessions", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sessions while overloaded = %d", resp.StatusCode)
+	}
+	_, data = ts.do(http.MethodGet, adminToken, "/metrics", nil)
+	if !strings.Contains(string(data), "rce_queue_depth 2\n") || !strings.Contains(string(data), "rce_requests_shed_total 3\n") {
+		t.Fatalf("metrics:\n%s", data)
+	}
+
+	// 异步任务完成后归还名额
+	<-done
+	waitFor(t, func() bool { return admission.Depth() == 0 })
+	if resp, data = ts.run(bobToken, third, "echo hi", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+		t.Fatalf("run after load drops = %d %q", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// instanceHeader 处理请求的实例标识, 每个响应都带有; 客户端在之后的请求中带上创建会话时的值, 负载均衡器据此路由
+const instanceHeader = "X-RCE-Instance"
+
+// ownerInstanceHeader 421 响应中会话所在的实例
+const ownerInstanceHeader = "X-RCE-Owner-Instance"
+
+// codeMisdirected 会话不在本实例中, 请求应发往其他实例
+const codeMisdirected = "misdirected"
+
+// instanceID 本实例的标识, 为空时不启用会话亲和
+var instanceID string
+
+// validInstanceID 与请求 ID 相同, 只接受字母、数字和 -_.
+func validInstanceID(id string) bool {
+	return validRequestID(id)
+}
+
+// misdirectedError 请求应由 owner 实例处理, 响应头 X-RCE-Owner-Instance 为 owner
+func misdirectedError(owner string) *apiError {
+	return &apiError{
+		Status:   http.StatusMisdirectedRequest,
+		Code:     codeMisdirected,
+		Message:  fmt.Sprintf("%v: request belongs to instance %s, this is instance %s", errMisdirected, owner, instanceID),
+		Instance: owner,
+	}
+}
+
+// withAffinity 在响应中标明本实例, 请求头 X-RCE-Instance 指向其他实例时返回 421, 不做任何处理
+// 负载均衡器没有按该请求头路由(如配置遗漏或实例已替换)时, 客户端得到明确的错误而不是 404
+func withAffinity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(instanceHeader, instanceID)
+		if want := r.Header.Get(instanceHeader); want != "" && want != instanceID {
+			log.Printf("✗ Misdirected request | Path: %s | Instance: %s | Wanted: %s", r.URL.Path, instanceID, want)
+			writeError(w, misdirectedError(want))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errMisdirected 请求的会话属于其他实例
+var errMisdirected = errors.New("misdirected request")
+
+// owningInstance 在 Store 中查找会话所在的实例, 不在 Store 中或属于本实例时返回空
+// 只在本进程中找不到会话时调用, 使用共享 Store 的多实例部署中可据此指出正确的实例
+func (sm *SessionManager) owningInstance(sessionID string, identity *Identity) string {
+	if instanceID == "" {
+		return ""
+	}
+	records, err := sm.Store.ListSessions()
+	if err != nil {
+		return ""
+	}
+	for _, rec := range records {
+		if rec.ID == sessionID {
+			// 其他租户的会话同样按不存在处理, 不透露其位置
+			if rec.Instance == instanceID || !identity.CanAccess(rec.Owner) {
+				return ""
+			}
+			return rec.Instance
+		}
+	}
+	return ""
+}
+
+// sessionNotFound 返回会话不存在的错误, 会话在其他实例中时为 421 并指出所在实例
+func sessionNotFound(sessionID string, identity *Identity) error {
+	if owner := sessionManager.owningInstance(sessionID, identity); owner != "" {
+		log.Printf("✗ Session on another instance | SessionID: %s | Instance: %s", sessionID, owner)
+		return misdirectedError(owner)
+	}
+	log.Printf("✗ Session not found | SessionID: %s", sessionID)
+	return newAPIErrorCode(http.StatusNotFound, codeSessionNotFound, "Session not found")
+}
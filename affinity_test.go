@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWithAffinity(t *testing.T) {
+	setGlobal(&instanceID, "rce-a")
+	t.Cleanup(func() { instanceID = "" })
+	handler := withAffinity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tt := range []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusNoContent},
+		{"rce-a", http.StatusNoContent},
+		{"rce-b", http.StatusMisdirectedRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/run-command", nil)
+		if tt.header != "" {
+			req.Header.Set(instanceHeader, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status || rec.Header().Get(instanceHeader) != "rce-a" {
+			t.Errorf("wanted instance %q = %d, instance header %q", tt.header, rec.Code, rec.Header().Get(instanceHeader))
+		}
+		// 421 指出请求要找的实例, 不执行处理器
+		if tt.status == http.StatusMisdirectedRequest {
+			if rec.Header().Get(ownerInstanceHeader) != tt.header || errorCodeOf(t, rec.Body.Bytes()) != codeMisdirected {
+				t.Errorf("misdirected response = %s %v", rec.Body, rec.Header())
+			}
+		}
+	}
+}
+
+func TestSessionOnAnotherInstance(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.InstanceID = "rce-a" })
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{})
+	var started struct {
+		SessionID string `json:"session_id"`
+		Instance  string `json:"instance"`
+	}
+	decodeJSON(t, data, &started)
+	if resp.StatusCode != http.StatusOK || started.Instance != "rce-a" {
+		t.Fatalf("start = %d %s", resp.StatusCode, data)
+	}
+	record := func() *SessionRecord {
+		records, _ := sessionManager.Store.ListSessions()
+		for _, rec := range records {
+			if rec.ID == started.SessionID {
+				return &rec
+			}
+		}
+		return nil
+	}
+	if rec := record(); rec == nil || rec.Instance != "rce-a" {
+		t.Fatalf("stored record = %+v", rec)
+	}
+
+	// 共享 Store 中属于其他实例的会话返回 421 和所在实例
+	elsewhere := uuid.New().String()
+	sessionManager.Store.PutSession(SessionRecord{ID: elsewhere, Owner: "alice", Instance: "rce-b", CreatedAt: time.Now()})
+	resp, data = ts.run(aliceToken, elsewhere, "echo hi", nil)
+	if resp.StatusCode != http.StatusMisdirectedRequest || resp.Header.Get(ownerInstanceHeader) != "rce-b" || errorCodeOf(t, data) != codeMisdirected {
+		t.Fatalf("session on rce-b = %d %s", resp.StatusCode, data)
+	}
+	// 其他租户的会话不透露所在实例
+	if resp, data = ts.run(bobToken, elsewhere, "echo hi", nil); resp.StatusCode != http.StatusNotFound || resp.Header.Get(ownerInstanceHeader) != "" {
+		t.Fatalf("other tenant = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, uuid.New().String(), "echo hi", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown session = %d %s", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// psPlainTextRendering 让 PowerShell 7.2+ 的格式化输出不带颜色, 旧版本没有 $PSStyle 时跳过
+const psPlainTextRendering = "if ($PSStyle) { $PSStyle.OutputRendering = 'PlainText' }"
+
+// ansiState 转义序列解析状态
+type ansiState int
+
+const (
+	ansiText ansiState = iota
+	// ansiEscape 读到 ESC
+	ansiEscape
+	// ansiCSI 控制序列 ESC [ ... 终止字节
+	ansiCSI
+	// ansiString OSC/DCS 等字符串序列, 以 BEL 或 ESC \ 结束
+	ansiString
+	// ansiStringEscape 字符串序列中读到 ESC
+	ansiStringEscape
+	// ansiCharset 字符集选择 ESC ( 等, 之后还有一个字节
+	ansiCharset
+)
+
+// ansiFilter 去除输出中的 ANSI/VT 转义序列
+// 状态跨多次调用保留, 被拆分到两个数据块中的序列也能正确去除
+// 只识别以 ESC(0x1B) 开头的 7 位序列, 该字节不会出现在 UTF-8 多字节字符中, 相邻的中文等字符不受影响
+type ansiFilter struct {
+	state ansiState
+}
+
+// filter 返回去除转义序列后的内容
+func (f *ansiFilter) filter(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, c := range b {
+		switch f.state {
+		case ansiText:
+			if c == 0x1b {
+				f.state = ansiEscape
+				continue
+			}
+			out = append(out, c)
+		case ansiEscape:
+			switch {
+			case c == '[':
+				f.state = ansiCSI
+			case c == ']' || c == 'P' || c == 'X' || c == '^' || c == '_':
+				f.state = ansiString
+			case c >= 0x20 && c <= 0x2f:
+				f.state = ansiCharset
+			default:
+				// 其他两字节序列, 如 ESC 7、ESC =
+				f.state = ansiText
+			}
+		case ansiCSI:
+			// 参数和中间字节在 0x20-0x3F, 终止字节在 0x40-0x7E
+			if c >= 0x40 && c <= 0x7e {
+				f.state = ansiText
+			}
+		case ansiString:
+			switch c {
+			case 0x07:
+				f.state = ansiText
+			case 0x1b:
+				f.state = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if c == '\\' {
+				f.state = ansiText
+			} else {
+				f.state = ansiString
+			}
+		case ansiCharset:
+			f.state = ansiText
+		}
+	}
+	return out
+}
+
+// flush 转义序列的字节直接丢弃, 没有暂存的内容
+func (f *ansiFilter) flush() []byte {
+	return nil
+}
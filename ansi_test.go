@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestANSIFilter(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"\x1b[31mred\x1b[0m", "red"},
+		{"\x1b[1;38;5;208mbold orange\x1b[m", "bold orange"},
+		{"\x1b]0;window title\x07prompt", "prompt"},
+		{"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"\x1b(Bcharset", "charset"},
+		{"\x1b7saved\x1b8", "saved"},
+		{"中文\x1b[32m输出\x1b[0m", "中文输出"},
+		{"\x1b[2K\x1b[1Gprogress 100%\n", "progress 100%\n"},
+	}
+	for _, tt := range tests {
+		var f ansiFilter
+		if got := string(f.filter([]byte(tt.in))); got != tt.want {
+			t.Errorf("filter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+
+		// 在任意位置拆分为两个数据块结果相同
+		for i := 1; i < len(tt.in); i++ {
+			var f ansiFilter
+			got := string(f.filter([]byte(tt.in[:i]))) + string(f.filter([]byte(tt.in[i:])))
+			if got != tt.want {
+				t.Errorf("filter(%q) split at %d = %q, want %q", tt.in, i, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestStripANSIPerCommand(t *testing.T) {
+	colored := "\x1b[32mgreen\x1b[0m"
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"colored": {Output: colored}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	if _, data := ts.run(aliceToken, id, "colored", nil); string(data) != colored {
+		t.Fatalf("default output = %q", data)
+	}
+	if _, data := ts.run(aliceToken, id, "colored", map[string]any{"strip_ansi": true}); string(data) != "green" {
+		t.Fatalf("strip_ansi output = %q", data)
+	}
+}
+
+func TestStripANSIServerDefault(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StripANSI = true
+		cfg.FakeOutputs = map[string]FakeOutput{"colored": {Output: "\x1b[1mbold\x1b[0m"}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "colored", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "bold" {
+		t.Fatalf("output = %d %q", resp.StatusCode, data)
+	}
+	// 单条命令可以关闭服务端的默认值
+	if _, data := ts.run(aliceToken, id, "colored", map[string]any{"strip_ansi": false}); string(data) != "\x1b[1mbold\x1b[0m" {
+		t.Fatalf("strip_ansi false output = %q", data)
+	}
+}
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 错误响应中的错误码, 取值保持稳定, 客户端据此判断错误类型
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeTooManyRequests  = "too_many_requests"
+	codeInternal         = "internal_error"
+	codeUnavailable      = "unavailable"
+	codeTimeout          = "timeout"
+
+	codeSessionNotFound   = "session_not_found"
+	codeJobNotFound       = "job_not_found"
+	codeSubShellNotFound  = "subshell_not_found"
+	codeInvalidCommand    = "invalid_command"
+	codeCommandTimeout    = "command_timeout"
+	codeIdleTimeout       = "idle_timeout"
+	codeServerBusy        = "server_busy"
+	codeShellUnresponsive = "shell_unresponsive"
+	codeSessionQuota      = "session_quota_exceeded"
+	codeScriptNotFound    = "script_not_found"
+	codeInitFailed        = "init_failed"
+	codeServerUnhealthy   = "server_unhealthy"
+	codeTemplateNotFound  = "template_not_found"
+	codeOverloaded        = "overloaded"
+	codeChecksumMismatch  = "checksum_mismatch"
+	codeUploadTooLarge    = "upload_too_large"
+	codeShellUnavailable  = "shell_unavailable"
+	codeShellNotAllowed   = "shell_not_allowed"
+	codeOutputRunaway     = "output_rate_exceeded"
+	codeCommandCancelled  = "command_cancelled"
+	codeSessionBusy       = "session_busy"
+)
+
+// apiError 带 HTTP 状态码的错误, REST 和 JSON-RPC 共用
+type apiError struct {
+	Status int
+	// Code 错误码, 为空时按状态码取通用错误码
+	Code    string
+	Message string
+	// Instance 421 时会话所在的实例
+	Instance string
+	// Busy session_busy 时正在执行的命令
+	Busy *BusyDetail
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// newAPIErrorCode 创建带具体错误码的错误
+func newAPIErrorCode(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorStatus 返回错误对应的 HTTP 状态码
+func errorStatus(err error) int {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return ae.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorCode 返回错误对应的错误码
+func errorCode(err error) string {
+	var ae *apiError
+	if errors.As(err, &ae) && ae.Code != "" {
+		return ae.Code
+	}
+	switch status := errorStatus(err); status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooManyRequests:
+		return codeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusGatewayTimeout:
+		return codeTimeout
+	default:
+		return codeInternal
+	}
+}
+
+// ErrorBody 错误响应中的错误信息
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID 与响应头 X-Request-ID 相同, 便于对照服务端日志
+	RequestID string `json:"request_id,omitempty"`
+	// Busy 仅在 session_busy 时返回
+	Busy *BusyDetail `json:"busy,omitempty"`
+}
+
+// ErrorResponse 所有接口统一的错误响应
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+	// Result 命令超时等情况下附带的部分结果
+	Result interface{} `json:"result,omitempty"`
+}
+
+// writeError 将错误写为 JSON 错误响应
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorResult(w, err, nil)
+}
+
+// writeErrorResult 将错误和部分结果写为 JSON 错误响应
+func writeErrorResult(w http.ResponseWriter, err error, result interface{}) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	if errorCode(err) == codeOverloaded {
+		header.Set("Retry-After", admission.retryAfterSeconds())
+	}
+	var ae *apiError
+	if errors.As(err, &ae) && ae.Instance != "" {
+		header.Set(ownerInstanceHeader, ae.Instance)
+	}
+	var busy *BusyDetail
+	if ae != nil {
+		busy = ae.Busy
+	}
+	w.WriteHeader(errorStatus(err))
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorBody{
+			Code:    errorCode(err),
+			Message: err.Error(),
+			// 由 withRequestID 在调用处理器之前设置
+			RequestID: header.Get(requestIDHeader),
+			Busy:      busy,
+		},
+		Result: result,
+	})
+}
+
+// validateSessionID 检查会话 ID 是否为标准格式的 UUID, 在查找会话之前调用
+// 客户端构造的 ID 不会进入之后的查找和日志, 也便于区分格式错误和会话不存在
+func validateSessionID(sessionID string) error {
+	if _, err := uuid.Parse(sessionID); err != nil || len(sessionID) != 36 {
+		log.Printf("✗ Malformed session ID | SessionID: %q", sessionID)
+		return newAPIError(http.StatusBadRequest, "session_id must be a UUID")
+	}
+	return nil
+}
+
+// startSession 为请求方创建会话
+func startSession(identity *Identity, opts SessionOptions) (*Session, error) {
+	log.Printf("→ Request: Start new session | Owner: %s", identity.Name)
+
+	session, err := sessionManager.CreateSession(identity.Name, opts)
+	if errors.Is(err, errInvalidOptions) {
+		log.Printf("✗ Invalid session options | Error: %v", err)
+		return nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	if errors.Is(err, errSessionQuota) {
+		log.Printf("✗ Session quota exceeded | Owner: %s | Error: %v", identity.Name, err)
+		return nil, newAPIErrorCode(http.StatusTooManyRequests, codeSessionQuota, "%v", err)
+	}
+	if errors.Is(err, errShellUnavailable) {
+		return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnavailable, "%v", err)
+	}
+	if errors.Is(err, errTooManySpawns) {
+		return nil, newAPIErrorCode(http.StatusTooManyRequests, codeServerBusy, "%v", err)
+	}
+	if errors.Is(err, errMemoryLimit) {
+		return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeMemoryLimit, "%v", err)
+	}
+	if errors.Is(err, errRemoteAuth) {
+		return nil, newAPIErrorCode(http.StatusBadGateway, codeRemoteAuthFailed, "%v", err)
+	}
+	if errors.Is(err, errRemoteConnect) {
+		return nil, newAPIErrorCode(http.StatusBadGateway, codeRemoteConnectFailed, "%v", err)
+	}
+	if errors.Is(err, errShellNotReady) {
+		return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnresponsive, "%v", err)
+	}
+	if errors.Is(err, errShellStartup) {
+		return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellStartupFailed, "%v", err)
+	}
+	if err != nil {
+		log.Printf("✗ Failed to start session | Error: %v", err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to create session: %v", err)
+	}
+
+	// 先导入模块, 初始化命令可以使用模块中的命令
+	err = importModules(identity, session)
+	if err == nil {
+		err = runInit(identity, session, opts.Init, true)
+	}
+	if err != nil {
+		log.Printf("✗ Session init failed | SessionID: %s | Error: %v", session.ID, err)
+		// 初始化不完整的会话不交给客户端
+		sessionManager.EndSession(session.ID, true)
+		return nil, newAPIErrorCode(http.StatusBadRequest, codeInitFailed, "%v", err)
+	}
+
+	log.Printf("✓ Session started successfully | SessionID: %s", session.ID)
+	return session, nil
+}
+
+// RunCommandRequest 执行命令的参数
+type RunCommandRequest struct {
+	SessionID string `json:"session_id"`
+	Command   string `json:"command"`
+	// Script scripts_dir 中的脚本, 与 Command 二选一, Args 为按位置传给脚本的参数
+	Script string   `json:"script"`
+	Args   []string `json:"args"`
+	// Template 服务端登记的命令模板, Params 为模板参数, 与 Command 和 Script 三选一
+	Template     string                     `json:"template"`
+	Params       map[string]json.RawMessage `json:"params"`
+	OutputToFile bool                       `json:"output_to_file"`
+	// TimeoutMs 本条命令的超时(毫秒), 不能超过服务端配置的 command_timeout
+	TimeoutMs int `json:"timeout_ms"`
+	// IdleTimeoutMs 命令连续没有输出的最长时间(毫秒), 不能超过服务端配置的 output_idle_timeout
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+	// Debug 在结果中返回写入 stdin 的完整文本和读到的原始字节, 仅管理员可用
+	Debug bool `json:"debug"`
+	// EmptyOutput 覆盖服务端的 empty_output: text 或 json
+	EmptyOutput string `json:"empty_output"`
+	// OutputFormat 输出格式: text(默认) 或 json
+	OutputFormat OutputFormat `json:"output_format"`
+	// JSONDepth json 格式的序列化深度, 0 表示使用服务端配置的 json_depth
+	JSONDepth int `json:"json_depth"`
+	// JSONFilter 对 json 格式的输出应用的 jq 表达式, 结果替换 data
+	JSONFilter string `json:"json_filter"`
+	// StripANSI 去除输出中的 ANSI 转义序列, 为空时使用服务端配置的 strip_ansi
+	StripANSI *bool `json:"strip_ansi"`
+	// NormalizeNewlines 将输出中的 CRLF 转换为 LF, 为空时使用服务端配置的 normalize_newlines
+	NormalizeNewlines *bool `json:"normalize_newlines"`
+	// StripBOM 去除输出开头的 UTF-8 BOM, 为空时使用服务端配置的 strip_bom
+	StripBOM *bool `json:"strip_bom"`
+	// RecordInit 命令成功后追加到会话的初始化命令, 克隆会话时重放
+	RecordInit bool `json:"record_init"`
+	// MaxLines 只返回输出的前若干行, 之后的输出被丢弃, 0 表示不限制
+	MaxLines int `json:"max_lines"`
+	// Truncate 超过输出上限或 max_lines 时保留开头(head, 默认)还是末尾(tail)
+	Truncate TruncateMode `json:"truncate"`
+	// Coalesce 与同一会话中正在执行的相同命令共享一次执行和结果, 只适用于幂等的只读命令
+	Coalesce bool `json:"coalesce"`
+	// ReportUsage 在结果中返回命令使用的 CPU 时间和内存峰值
+	ReportUsage bool `json:"report_usage"`
+	// ReportStatus 在结果中返回命令是否成功, 退出码不为 0 或抛出终止错误时为 error
+	ReportStatus bool `json:"report_status"`
+	// EchoCommand 在输出开头回显执行的命令, EchoTimestamp 同时带上发送命令的时间
+	EchoCommand   bool `json:"echo_command"`
+	EchoTimestamp bool `json:"echo_timestamp"`
+	// MarkerChannel 覆盖会话的标记输出方式: host 或 console, 仅 PowerShell 支持
+	MarkerChannel MarkerChannel `json:"marker_channel"`
+	// Checkpoints 按命令中的 rce:checkpoint 注释分段返回输出
+	Checkpoints bool `json:"checkpoints"`
+	// Shell 用另一个 shell 预设执行本条命令, 在会话的 shell 中启动, 为空时使用会话的 shell
+	Shell string `json:"shell"`
+	// Baseline 与租户保存的同名基线逐行比较输出, 基线不存在时保存本次输出
+	Baseline string `json:"baseline"`
+	// UpdateBaseline 比较后用本次输出替换基线
+	UpdateBaseline bool `json:"update_baseline"`
+	// Queue 会话正在执行其他命令时排队等待, 默认立即返回 409 session_busy
+	Queue bool `json:"queue"`
+	// QueueTimeoutMs 排队等待的最长时间(毫秒), 超过时返回 429 queue_wait_timeout, 不能超过服务端的 session_queue_timeout
+	QueueTimeoutMs int `json:"queue_timeout_ms"`
+	// Probe 健康检查等探测命令, 不写入审计日志、webhook 和命令日志, 不计入命令数上限, 也不更新会话的最近使用时间
+	Probe bool `json:"probe"`
+
+	// trace 请求的 span, 不为空时为命令执行创建子 span
+	trace *Span
+	// stream 不为空时输出边执行边写入, 用于 Accept: application/x-ndjson 的请求
+	stream *ndjsonWriter
+	// budget 不为空时为批量执行共享的 total_timeout_ms
+	budget context.Context
+	// env 按 forward_headers 从请求头转发的环境变量
+	env []envVar
+}
+
+// validate 检查会话 ID 以及 command、script 和 template 恰好提供了一个
+func (req *RunCommandRequest) validate() error {
+	given := 0
+	for _, s := range []string{req.Command, req.Script, req.Template} {
+		if s != "" {
+			given++
+		}
+	}
+	switch {
+	case req.SessionID == "" || given == 0:
+		log.Printf("✗ Missing required parameters | SessionID: %s | Command: %s", req.SessionID, req.Command)
+		return newAPIError(http.StatusBadRequest, "session_id and command (or script, or template) are required")
+	case given > 1:
+		log.Printf("✗ More than one of command, script and template given | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusBadRequest, "command, script and template are mutually exclusive")
+	case req.Script == "" && len(req.Args) > 0:
+		log.Printf("✗ Args given without script | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusBadRequest, "args can only be used with script")
+	case req.Template == "" && len(req.Params) > 0:
+		log.Printf("✗ Params given without template | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusBadRequest, "params can only be used with template")
+	case currentSettings().templatesOnly && req.Command != "":
+		log.Printf("✗ Free-form command rejected | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusForbidden, "%v", errTemplatesOnly)
+	}
+	return validateSessionID(req.SessionID)
+}
+
+// resolveTemplate 用参数展开命令模板, 参数按执行命令的 shell 转义
+func resolveTemplate(shellType ShellType, req RunCommandRequest) (string, error) {
+	tmpl, ok := currentSettings().templates[req.Template]
+	if !ok {
+		log.Printf("✗ Template not found | SessionID: %s | Template: %q", req.SessionID, req.Template)
+		return "", newAPIErrorCode(http.StatusNotFound, codeTemplateNotFound, "%v: %s", errTemplateNotFound, req.Template)
+	}
+	command, err := tmpl.expand(shellType, req.Params)
+	if err != nil {
+		log.Printf("✗ Template rejected | SessionID: %s | Template: %q | Error: %v", req.SessionID, req.Template, err)
+		return "", newAPIError(http.StatusBadRequest, "%v", err)
+	}
+
+	log.Printf("✓ Template expanded | SessionID: %s | Template: %q", req.SessionID, req.Template)
+	return command, nil
+}
+
+// resolveScript 将 script 和 args 转换为执行命令的 shell 中执行脚本的命令
+func resolveScript(shellType ShellType, req RunCommandRequest) (string, error) {
+	if scriptLibrary == nil {
+		log.Printf("✗ Script rejected | SessionID: %s | Script: %q | Error: %v", req.SessionID, req.Script, errScriptsDisabled)
+		return "", newAPIError(http.StatusBadRequest, "%v", errScriptsDisabled)
+	}
+	path, err := scriptLibrary.Resolve(req.Script)
+	var command string
+	if err == nil {
+		command, err = scriptCommand(shellType, path, req.Args)
+	}
+	if err != nil {
+		log.Printf("✗ Script rejected | SessionID: %s | Script: %q | Error: %v", req.SessionID, req.Script, err)
+		switch {
+		case errors.Is(err, errScriptNotFound):
+			return "", newAPIErrorCode(http.StatusNotFound, codeScriptNotFound, "%v: %s", err, req.Script)
+		case errors.Is(err, errScriptOutside) || errors.Is(err, errScriptsUnsupported):
+			return "", newAPIError(http.StatusBadRequest, "%v", err)
+		default:
+			return "", newAPIError(http.StatusInternalServerError, "%v", err)
+		}
+	}
+
+	log.Printf("✓ Script resolved | SessionID: %s | Script: %q | Path: %s", req.SessionID, req.Script, path)
+	return command, nil
+}
+
+// runCommand 在请求方的会话中执行命令
+// 超时时 result(或 file)与错误同时返回, 其中包含超时前已产生的输出
+func runCommand(identity *Identity, req RunCommandRequest) (*CommandResult, *OutputFile, error) {
+	if err := req.validate(); err != nil {
+		return nil, nil, err
+	}
+	if req.TimeoutMs < 0 {
+		log.Printf("✗ Invalid timeout | SessionID: %s | TimeoutMs: %d", req.SessionID, req.TimeoutMs)
+		return nil, nil, newAPIError(http.StatusBadRequest, "timeout_ms must not be negative")
+	}
+	if req.IdleTimeoutMs < 0 {
+		log.Printf("✗ Invalid idle timeout | SessionID: %s | IdleTimeoutMs: %d", req.SessionID, req.IdleTimeoutMs)
+		return nil, nil, newAPIError(http.StatusBadRequest, "idle_timeout_ms must not be negative")
+	}
+	if req.QueueTimeoutMs < 0 {
+		log.Printf("✗ Invalid queue timeout | SessionID: %s | QueueTimeoutMs: %d", req.SessionID, req.QueueTimeoutMs)
+		return nil, nil, newAPIError(http.StatusBadRequest, "queue_timeout_ms must not be negative")
+	}
+	if req.QueueTimeoutMs > 0 && !req.Queue {
+		log.Printf("✗ queue_timeout_ms without queue | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "queue_timeout_ms requires queue")
+	}
+	switch req.OutputFormat {
+	case "", OutputText, OutputJSON, OutputBase64:
+	default:
+		log.Printf("✗ Invalid output format | SessionID: %s | Format: %s", req.SessionID, req.OutputFormat)
+		return nil, nil, newAPIError(http.StatusBadRequest, "output_format must be %s, %s or %s", OutputText, OutputJSON, OutputBase64)
+	}
+	if err := validateJSONDepth(req.JSONDepth); err != nil {
+		log.Printf("✗ Invalid JSON depth | SessionID: %s | JSONDepth: %d", req.SessionID, req.JSONDepth)
+		return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	var filter *jsonFilter
+	if req.JSONFilter != "" {
+		if req.OutputFormat != OutputJSON || req.OutputToFile {
+			log.Printf("✗ json_filter without json output | SessionID: %s", req.SessionID)
+			return nil, nil, newAPIError(http.StatusBadRequest, "json_filter requires output_format json and cannot be used with output_to_file")
+		}
+		var err error
+		if filter, err = parseJSONFilter(req.JSONFilter); err != nil {
+			log.Printf("✗ Invalid json_filter | SessionID: %s | Error: %v", req.SessionID, err)
+			return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if _, err := parseEmptyOutputMode(req.EmptyOutput, currentSettings().emptyOutput); err != nil {
+		log.Printf("✗ Invalid empty_output | SessionID: %s | EmptyOutput: %s", req.SessionID, req.EmptyOutput)
+		return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	if req.MaxLines < 0 {
+		log.Printf("✗ Invalid max_lines | SessionID: %s | MaxLines: %d", req.SessionID, req.MaxLines)
+		return nil, nil, newAPIError(http.StatusBadRequest, "max_lines must not be negative")
+	}
+	if req.MaxLines > 0 && (req.OutputFormat == OutputJSON || req.OutputFormat == OutputBase64) {
+		log.Printf("✗ max_lines with %s output | SessionID: %s", req.OutputFormat, req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "max_lines cannot be used with output_format %s", req.OutputFormat)
+	}
+	if _, err := parseTruncateMode(req.Truncate); err != nil {
+		log.Printf("✗ Invalid truncate | SessionID: %s | Truncate: %s", req.SessionID, req.Truncate)
+		return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	if req.Truncate == TruncateTail && (req.Checkpoints || req.stream != nil) {
+		log.Printf("✗ Invalid truncate request | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "truncate tail cannot be used with checkpoints or streaming")
+	}
+	if req.EchoTimestamp && !req.EchoCommand {
+		log.Printf("✗ echo_timestamp without echo_command | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "echo_timestamp requires echo_command")
+	}
+	if req.EchoCommand && (req.OutputFormat == OutputJSON || req.OutputFormat == OutputBase64) {
+		log.Printf("✗ echo_command with %s output | SessionID: %s", req.OutputFormat, req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "echo_command cannot be used with output_format %s", req.OutputFormat)
+	}
+	if req.Checkpoints && (req.OutputToFile || req.OutputFormat == OutputJSON || req.OutputFormat == OutputBase64 || req.MaxLines > 0 || req.EchoCommand) {
+		log.Printf("✗ Invalid checkpoints request | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "checkpoints cannot be used with output_to_file, output_format json or base64, max_lines or echo_command")
+	}
+	if req.Probe && (req.OutputToFile || req.RecordInit) {
+		log.Printf("✗ Invalid probe request | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "probe cannot be used with output_to_file or record_init")
+	}
+	if req.Coalesce && (req.OutputToFile || req.RecordInit) {
+		log.Printf("✗ Invalid coalesce request | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "coalesce cannot be used with output_to_file or record_init")
+	}
+	if req.UpdateBaseline && req.Baseline == "" {
+		log.Printf("✗ update_baseline without baseline | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "update_baseline requires baseline")
+	}
+	if req.Baseline != "" {
+		if err := validateBaselineName(req.Baseline); err != nil {
+			log.Printf("✗ Invalid baseline | SessionID: %s | Error: %v", req.SessionID, err)
+			return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+		}
+		if req.OutputToFile || req.Coalesce || req.Checkpoints || req.OutputFormat == OutputJSON || req.OutputFormat == OutputBase64 || req.stream != nil {
+			log.Printf("✗ Invalid baseline request | SessionID: %s", req.SessionID)
+			return nil, nil, newAPIError(http.StatusBadRequest, "baseline cannot be used with output_to_file, coalesce, checkpoints, streaming or output_format json or base64")
+		}
+	}
+	if req.Debug {
+		if !identity.Admin {
+			log.Printf("✗ Debug request rejected | SessionID: %s | Owner: %s", req.SessionID, identity.Name)
+			return nil, nil, newAPIError(http.StatusForbidden, "%v", errDebugForbidden)
+		}
+		if req.OutputToFile || req.Coalesce || req.stream != nil {
+			log.Printf("✗ Invalid debug request | SessionID: %s", req.SessionID)
+			return nil, nil, newAPIError(http.StatusBadRequest, "debug cannot be used with output_to_file, coalesce or streaming")
+		}
+	}
+	if req.stream != nil && (req.OutputToFile || req.Coalesce || req.Checkpoints || req.OutputFormat == OutputJSON || req.OutputFormat == OutputBase64) {
+		log.Printf("✗ Invalid streaming request | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIError(http.StatusBadRequest, "streaming output cannot be used with output_to_file, coalesce, checkpoints or output_format json or base64")
+	}
+	opts := RunOptions{
+		Timeout:      time.Duration(req.TimeoutMs) * time.Millisecond,
+		IdleTimeout:  time.Duration(req.IdleTimeoutMs) * time.Millisecond,
+		QueueTimeout: time.Duration(req.QueueTimeoutMs) * time.Millisecond,
+		Format:       req.OutputFormat,
+		JSONDepth:    req.JSONDepth,
+		StripANSI:    req.StripANSI,
+
+		NormalizeNewlines: req.NormalizeNewlines,
+		StripBOM:          req.StripBOM,
+		MaxLines:          req.MaxLines,
+		Truncate:          req.Truncate,
+		ReportUsage:       req.ReportUsage,
+		ReportStatus:      req.ReportStatus,
+		EchoCommand:       req.EchoCommand,
+		EchoTimestamp:     req.EchoTimestamp,
+		MarkerChannel:     req.MarkerChannel,
+		counted:           true,
+		probe:             req.Probe,
+		failIfBusy:        !req.Queue,
+		env:               req.env,
+		budget:            req.budget,
+		debug:             req.Debug,
+	}
+
+	opts.logCommand("→ Request: Run command | SessionID: %s | Command: %s", req.SessionID, req.Command)
+
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, nil, sessionNotFound(req.SessionID, identity)
+	}
+	// shell 指定其他 shell 时命令、脚本、模板和检查点都按该 shell 生成, 再包装为会话 shell 中的语句
+	child, err := resolveShellOverride(session, req.Shell)
+	if errors.Is(err, errShellNotAllowed) {
+		log.Printf("✗ Shell override rejected | SessionID: %s | Shell: %s | Owner: %s", req.SessionID, req.Shell, identity.Name)
+		return nil, nil, newAPIErrorCode(http.StatusForbidden, codeShellNotAllowed, "%v", err)
+	}
+	if err != nil {
+		log.Printf("✗ Invalid shell override | SessionID: %s | Shell: %s | Error: %v", req.SessionID, req.Shell, err)
+		if errors.Is(err, errShellUnavailable) {
+			return nil, nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnavailable, "%v", err)
+		}
+		return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	shellType := session.shell.Type
+	if child != nil {
+		shellType = child.Type
+		if opts.Format == OutputJSON {
+			log.Printf("✗ JSON output with shell override | SessionID: %s | Shell: %s", req.SessionID, req.Shell)
+			return nil, nil, newAPIError(http.StatusBadRequest, "output_format json cannot be used with shell")
+		}
+	}
+	if opts.Format == OutputJSON && session.shell.Type != ShellPowerShell {
+		log.Printf("✗ JSON output requires PowerShell | SessionID: %s | Shell: %s", req.SessionID, session.ShellName)
+		return nil, nil, newAPIError(http.StatusBadRequest, "output_format json is only supported by PowerShell sessions")
+	}
+	if _, err := parseMarkerChannel(req.MarkerChannel, session.shell.Type); err != nil {
+		log.Printf("✗ Invalid marker channel | SessionID: %s | Error: %v", req.SessionID, err)
+		return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	if req.Script != "" {
+		// 审计日志和 webhook 记录实际执行的命令
+		command, err := resolveScript(shellType, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Command = command
+	}
+	if req.Template != "" {
+		command, err := resolveTemplate(shellType, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Command = command
+	}
+
+	// 审计日志和 webhook 记录客户端提交的命令, 执行的是替换了检查点的命令
+	command := req.Command
+	if req.Checkpoints {
+		command, opts.checkpoints, err = injectCheckpoints(req.Command, shellType)
+		if err != nil {
+			log.Printf("✗ Invalid checkpoints | SessionID: %s | Error: %v", req.SessionID, err)
+			return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if child != nil {
+		if command, err = wrapInShell(command, session.shell.Type, child); err != nil {
+			log.Printf("✗ Invalid shell override | SessionID: %s | Shell: %s | Error: %v", req.SessionID, req.Shell, err)
+			return nil, nil, newAPIError(http.StatusBadRequest, "%v", err)
+		}
+		logCommand("→ Command wrapped for shell | SessionID: %s | Shell: %s", req.SessionID, req.Shell)
+	}
+
+	span := req.trace.child("command.run")
+	defer span.finish()
+	span.set("rce.session_id", req.SessionID)
+	span.set("rce.command_length", len(req.Command))
+	opts.trace = span
+
+	var result *CommandResult
+	var file *OutputFile
+	var shared bool
+	started := time.Now()
+	switch {
+	case req.OutputToFile:
+		file, result, err = runCommandToFile(session, command, identity.Name, opts)
+	case req.Coalesce:
+		result, shared, err = commandCoalescer.Do(coalesceKey(session.ID, req.Shell, req.Command, opts), func() (*CommandResult, error) {
+			return session.RunCommand(command, opts)
+		})
+		if shared {
+			log.Printf("✓ Command coalesced, sharing result | SessionID: %s | Command: %s", req.SessionID, req.Command)
+			span.set("rce.coalesced", true)
+		}
+	case req.stream != nil:
+		// 流式输出不在服务端缓冲, 也不转存
+		result, err = session.RunCommandTo(command, req.stream, opts)
+	case currentSettings().spoolThreshold > 0 && (opts.Format == "" || opts.Format == OutputText) && opts.checkpoints == "" && req.Baseline == "":
+		result, err = runCommandSpooled(session, command, identity.Name, opts)
+	default:
+		result, err = session.RunCommand(command, opts)
+	}
+	traceCommandResult(span, result, err)
+	if !req.Probe {
+		auditCommand(identity, req.SessionID, req.Command, result, err)
+		notifyCommand(identity, req.SessionID, req.Command, result, err)
+	}
+	wantInit := err == nil && req.RecordInit && (result.ExitCode == nil || *result.ExitCode == 0)
+	var recordErr error
+	if !req.Probe && !shared && result != nil {
+		// 合并执行时只有实际执行的请求记录历史
+		rec := newCommandRecord(req.Command, started, result, err)
+		rec.Template, rec.Params, rec.Script, rec.Args, rec.Shell = req.Template, req.Params, req.Script, req.Args, req.Shell
+		if wantInit {
+			recordErr = session.recordInit(rec)
+		} else {
+			session.recordCommand(rec)
+		}
+	}
+
+	if err == nil && filter != nil {
+		// 合并执行时结果由多个请求共享, 在副本上替换
+		filtered := *result
+		if filtered.Data == nil {
+			err = fmt.Errorf("%w: output is not valid JSON", errJSONFilterFailed)
+		} else if filtered.Data, err = filter.apply(filtered.Data); err == nil {
+			logCommand("✓ JSON filter applied | SessionID: %s | Filter: %s | Size: %d bytes", req.SessionID, req.JSONFilter, len(filtered.Data))
+		}
+		if err != nil {
+			log.Printf("✗ JSON filter failed | SessionID: %s | Filter: %s | Error: %v", req.SessionID, req.JSONFilter, err)
+			return result, nil, newAPIErrorCode(http.StatusUnprocessableEntity, codeJSONFilterFailed, "%v", err)
+		}
+		result = &filtered
+	}
+
+	if err == nil && req.Baseline != "" {
+		// 只比较成功读完的输出, 超时等情况下的部分输出不比较也不保存
+		if result.Baseline, err = compareBaseline(sessionManager.Store, identity.Name, req.Baseline, result.Output, req.UpdateBaseline); err != nil {
+			log.Printf("✗ Baseline comparison failed | SessionID: %s | Baseline: %s | Error: %v", req.SessionID, req.Baseline, err)
+			return result, file, newAPIError(http.StatusInternalServerError, "%v", err)
+		}
+		log.Printf("✓ Output compared with baseline | SessionID: %s | Baseline: %s | Created: %t | Changed: %t | Added: %d | Removed: %d", req.SessionID, req.Baseline, result.Baseline.Created, result.Baseline.Changed, result.Baseline.Added, result.Baseline.Removed)
+	}
+
+	if err == nil && wantInit {
+		if recordErr != nil {
+			log.Printf("✗ Failed to record init command | SessionID: %s | Error: %v", req.SessionID, recordErr)
+			return result, file, newAPIError(http.StatusConflict, "command succeeded but was not recorded: %v", recordErr)
+		}
+		log.Printf("✓ Init command recorded | SessionID: %s", req.SessionID)
+	}
+
+	if result != nil && result.Recycled == recycledRestarted {
+		// 连续出错后 shell 已在 RunCommandTo 中重启, 与输出失控时一样重放初始化命令
+		if err := replayInit(identity, session); err != nil {
+			log.Printf("✗ Session init failed after recycling, ending session | SessionID: %s | Error: %v", req.SessionID, err)
+			sessionManager.EndSession(req.SessionID, true)
+			result.Recycled = recycledEnded
+		}
+	}
+
+	switch {
+	case err == nil:
+		return result, file, nil
+	case errors.Is(err, errIncompleteCommand) || errors.Is(err, errSyntaxError):
+		log.Printf("✗ Command rejected | SessionID: %s | Error: %v", req.SessionID, err)
+		message := err.Error()
+		if result != nil && result.Output != "" {
+			// 语法错误时输出为解析器给出的错误信息
+			message += "\n" + result.Output
+		}
+		return nil, nil, newAPIErrorCode(http.StatusBadRequest, codeInvalidCommand, "%s", message)
+	case errors.Is(err, errIdleTimeout):
+		log.Printf("✗ Command produced no output | SessionID: %s | Partial output: %d bytes", req.SessionID, result.Size)
+		return result, file, newAPIErrorCode(http.StatusGatewayTimeout, codeIdleTimeout, "%v", err)
+	case errors.Is(err, errCommandTimeout):
+		log.Printf("✗ Command timed out | SessionID: %s | Partial output: %d bytes", req.SessionID, result.Size)
+		return result, file, newAPIErrorCode(http.StatusGatewayTimeout, codeCommandTimeout, "%v", err)
+	case errors.Is(err, errRunawayOutput):
+		// shell 已在 RunCommandTo 中重启, 重放初始化命令后会话可以继续使用
+		if err := replayInit(identity, session); err != nil {
+			log.Printf("✗ Session init failed after runaway output, ending session | SessionID: %s | Error: %v", req.SessionID, err)
+			sessionManager.EndSession(req.SessionID, true)
+		}
+		return result, file, newAPIErrorCode(http.StatusUnprocessableEntity, codeOutputRunaway, "%v", err)
+	case errors.Is(err, errTooManyCommands):
+		return nil, nil, newAPIErrorCode(http.StatusTooManyRequests, codeServerBusy, "%v", err)
+	case errors.Is(err, errReadGuardSaturated):
+		return nil, nil, newAPIErrorCode(http.StatusServiceUnavailable, codeServerUnhealthy, "%v", err)
+	case errors.Is(err, errMemoryLimit):
+		return nil, nil, newAPIErrorCode(http.StatusServiceUnavailable, codeMemoryLimit, "%v", err)
+	case errors.Is(err, errCommandLimit):
+		return nil, nil, newAPIErrorCode(http.StatusConflict, codeCommandLimit, "%v", err)
+	case errors.Is(err, errBudgetExceeded):
+		return nil, nil, newAPIErrorCode(http.StatusGatewayTimeout, codeBudgetExceeded, "%v", err)
+	case errors.Is(err, errQueueWaitTimeout):
+		return nil, nil, newAPIErrorCode(http.StatusTooManyRequests, codeQueueWaitTimeout, "%v", err)
+	case errors.Is(err, errSessionBusy):
+		apiErr := newAPIErrorCode(http.StatusConflict, codeSessionBusy, "%v", err)
+		var busy *sessionBusyError
+		if errors.As(err, &busy) {
+			apiErr.Busy = &busy.detail
+		}
+		return nil, nil, apiErr
+	case errors.Is(err, errCommandCancelled):
+		// 开始前被取消时没有结果, 执行中被取消时返回取消前的输出
+		return result, file, newAPIErrorCode(http.StatusConflict, codeCommandCancelled, "%v", err)
+	case errors.Is(err, errCommandAborted):
+		log.Printf("✗ Command cancelled by restart | SessionID: %s", req.SessionID)
+		return nil, nil, newAPIErrorCode(http.StatusConflict, codeConflict, "%v", err)
+	case errors.Is(err, errStdinTimeout):
+		log.Printf("✗ Shell is unresponsive | SessionID: %s | Error: %v", req.SessionID, err)
+		// 可能带有会话已被回收的提示
+		return result, nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnresponsive, "%v", err)
+	default:
+		log.Printf("✗ Command execution failed | SessionID: %s | Error: %v", req.SessionID, err)
+		return result, nil, newAPIError(http.StatusInternalServerError, "Failed to execute command: %v", err)
+	}
+}
+
+// OutputFileResponse output_to_file 模式下返回的下载信息
+type OutputFileResponse struct {
+	DownloadToken string    `json:"download_token"`
+	DownloadURL   string    `json:"download_url"`
+	Size          int       `json:"size"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ExitCode      *int      `json:"exit_code"`
+	TimedOut      bool      `json:"timed_out"`
+	Truncated     bool      `json:"truncated"`
+	// Truncate 截断时保留的部分: head 或 tail
+	Truncate TruncateMode `json:"truncate,omitempty"`
+	// Encoding 输出的编码和替换字符数
+	Encoding *OutputEncoding `json:"encoding,omitempty"`
+	// Status 仅在请求 report_status 时返回
+	Status string `json:"status,omitempty"`
+	// CPUMs 和 PeakMemoryBytes 仅在请求 report_usage 时返回
+	CPUMs           *int64  `json:"cpu_ms,omitempty"`
+	PeakMemoryBytes *uint64 `json:"peak_memory_bytes,omitempty"`
+}
+
+func newOutputFileResponse(file *OutputFile, result *CommandResult) *OutputFileResponse {
+	return &OutputFileResponse{
+		DownloadToken: file.Token,
+		DownloadURL:   "/download?token=" + file.Token,
+		Size:          file.Size,
+		ExpiresAt:     file.ExpiresAt,
+		ExitCode:      result.ExitCode,
+		TimedOut:      result.TimedOut,
+		Truncated:     result.Truncated,
+		Truncate:      result.Truncate,
+		Encoding:      result.Encoding,
+		Status:        result.Status,
+
+		CPUMs:           result.CPUMs,
+		PeakMemoryBytes: result.PeakMemoryBytes,
+	}
+}
+
+// runCommandResponse 返回 JSON 形式的命令结果, output_to_file 时为下载信息
+func runCommandResponse(result *CommandResult, file *OutputFile) interface{} {
+	if file != nil {
+		return newOutputFileResponse(file, result)
+	}
+	if result != nil {
+		return result
+	}
+	return nil
+}
+
+// killAllSessions 强制结束所有租户的会话, 调用方需为管理员
+func killAllSessions(identity *Identity) []string {
+	log.Printf("→ Request: Kill all sessions | Operator: %s", identity.Name)
+	ended := sessionManager.CloseAll()
+	log.Printf("✓ Killed all sessions | Operator: %s | Count: %d | SessionIDs: %v", identity.Name, len(ended), ended)
+	return ended
+}
+
+// EndSessionRequest 结束会话的参数
+type EndSessionRequest struct {
+	SessionID string `json:"session_id"`
+	// Force 跳过等待 shell 自行退出, 直接结束进程树
+	Force bool `json:"force"`
+}
+
+// EndSessionResponse 结束会话的结果
+type EndSessionResponse struct {
+	Message string `json:"message"`
+	// AlreadyEnded 会话在请求之前已结束或不存在
+	AlreadyEnded bool `json:"already_ended"`
+}
+
+// endSession 结束请求方的会话
+// 会话已结束或不存在时同样成功, 客户端可以安全地重试
+// 属于其他租户的会话按不存在处理, 不会被结束
+func endSession(identity *Identity, req EndSessionRequest) (*EndSessionResponse, error) {
+	sessionID := req.SessionID
+	if sessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "session_id is required")
+	}
+	if err := validateSessionID(sessionID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("→ Request: End session | SessionID: %s | Force: %t", sessionID, req.Force)
+
+	alreadyEnded := &EndSessionResponse{Message: "Session already ended", AlreadyEnded: true}
+	if _, exists := sessionManager.GetSessionFor(sessionID, identity); !exists {
+		// 会话在其他实例中时不能当作已结束, 否则客户端会以为已释放
+		if err := sessionNotFound(sessionID, identity); errorCode(err) == codeMisdirected {
+			return nil, err
+		}
+		// 并发的请求正在结束该会话时, 等到清理完成再返回
+		if sessionManager.waitEnding(sessionID, identity, req.Force) {
+			log.Printf("✓ Session already ended by a concurrent request | SessionID: %s", sessionID)
+			return alreadyEnded, nil
+		}
+		log.Printf("✓ Session already ended | SessionID: %s", sessionID)
+		return alreadyEnded, nil
+	}
+
+	if err := sessionManager.EndSession(sessionID, req.Force); err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			// 并发的请求已结束该会话
+			log.Printf("✓ Session already ended | SessionID: %s", sessionID)
+			return alreadyEnded, nil
+		}
+		log.Printf("✗ Failed to end session | SessionID: %s | Error: %v", sessionID, err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to end session: %v", err)
+	}
+
+	log.Printf("✓ Session ended successfully | SessionID: %s", sessionID)
+	return &EndSessionResponse{Message: "Session ended successfully"}, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{newAPIError(http.StatusBadRequest, "bad"), codeInvalidRequest},
+		{newAPIError(http.StatusNotFound, "missing"), codeNotFound},
+		{newAPIError(http.StatusMethodNotAllowed, "method"), codeMethodNotAllowed},
+		{newAPIError(http.StatusTooManyRequests, "busy"), codeTooManyRequests},
+		{newAPIError(http.StatusGatewayTimeout, "slow"), codeTimeout},
+		// 具体的错误码优先于按状态码取的通用错误码
+		{newAPIErrorCode(http.StatusNotFound, codeSessionNotFound, "missing"), codeSessionNotFound},
+		{fmt.Errorf("wrapped: %w", newAPIErrorCode(http.StatusTooManyRequests, codeServerBusy, "busy")), codeServerBusy},
+		{errors.New("plain"), codeInternal},
+	}
+	for _, tt := range tests {
+		if code := errorCode(tt.err); code != tt.code {
+			t.Errorf("errorCode(%v) = %q, want %q", tt.err, code, tt.code)
+		}
+	}
+	if status := errorStatus(errors.New("plain")); status != http.StatusInternalServerError {
+		t.Errorf("errorStatus(plain) = %d", status)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	ts := newTestServer(t, nil)
+	tests := []struct {
+		method, path string
+		body         any
+		status       int
+		code         string
+	}{
+		{http.MethodPost, "/run-command", map[string]any{"session_id": uuid.New().String(), "command": "echo"}, http.StatusNotFound, codeSessionNotFound},
+		{http.MethodPost, "/run-command", map[string]any{"session_id": "not-a-uuid", "command": "echo"}, http.StatusBadRequest, codeInvalidRequest},
+		{http.MethodGet, "/run-command", nil, http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodPost, "/end-session", map[string]any{}, http.StatusBadRequest, codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		resp, data := ts.do(tt.method, aliceToken, tt.path, tt.body)
+		if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s = %d %s %s", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Content-Type"), data)
+			continue
+		}
+		var body ErrorResponse
+		decodeJSON(t, data, &body)
+		if body.Error.Code != tt.code || body.Error.Message == "" {
+			t.Errorf("%s %s error = %+v, want code %q", tt.method, tt.path, body.Error, tt.code)
+		}
+		// 错误响应中的请求 ID 与响应头一致
+		if id := resp.Header.Get(requestIDHeader); id == "" || body.Error.RequestID != id {
+			t.Errorf("%s %s request_id = %q, header %q", tt.method, tt.path, body.Error.RequestID, id)
+		}
+	}
+
+	// 请求体不是合法的 JSON
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/start-session", strings.NewReader("{"))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid JSON = %d", resp.StatusCode)
+	}
+}
+
+func TestRequestIDFromClient(t *testing.T) {
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, newAPIError(http.StatusTeapot, "teapot"))
+	}))
+	for id, kept := range map[string]bool{
+		"client-id_1.2":         true,
+		"":                      false,
+		"has space":             false,
+		"newline\nX-Injected:1": false,
+		strings.Repeat("a", maxRequestIDLength+1): false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		got := rec.Header().Get(requestIDHeader)
+		if kept != (got == id) {
+			t.Errorf("request ID %q -> %q, want kept %t", id, got, kept)
+		}
+		if _, err := uuid.Parse(got); !kept && err != nil {
+			t.Errorf("request ID %q replaced by %q, want a UUID", id, got)
+		}
+	}
+}
+
+// endSession 结束会话, 返回状态码和响应
+func (ts *testServer) endSession(token, id string) (int, EndSessionResponse) {
+	ts.t.Helper()
+	resp, data := ts.post(token, "/end-session", map[string]any{"session_id": id})
+	var out EndSessionResponse
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out
+}
+
+func TestEndSessionIdempotent(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	if status, out := ts.endSession(aliceToken, id); status != http.StatusOK || out.AlreadyEnded {
+		t.Fatalf("first end = %d %+v", status, out)
+	}
+	// 重试和结束不存在的会话同样成功
+	for _, target := range []string{id, uuid.New().String()} {
+		if status, out := ts.endSession(aliceToken, target); status != http.StatusOK || !out.AlreadyEnded {
+			t.Fatalf("end %s again = %d %+v", target, status, out)
+		}
+	}
+
+	// 缺少或不合法的会话 ID 仍返回 400
+	for _, target := range []string{"", "../etc"} {
+		resp, data := ts.post(aliceToken, "/end-session", map[string]any{"session_id": target})
+		if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInvalidRequest {
+			t.Fatalf("end %q = %d %s", target, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestEndSessionConcurrent(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	const n = 8
+	results := make(chan EndSessionResponse, n)
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			status, out := ts.endSession(aliceToken, id)
+			statuses <- status
+			results <- out
+		}()
+	}
+	ended := 0
+	for i := 0; i < n; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Fatalf("concurrent end = %d", status)
+		}
+		if out := <-results; !out.AlreadyEnded {
+			ended++
+		}
+	}
+	// 只有一个请求真正结束会话, 其余请求在清理完成后返回 already_ended
+	if ended != 1 {
+		t.Fatalf("%d requests ended the session", ended)
+	}
+	if sessionManager.Owned("alice") != 0 {
+		t.Fatal("session still counted after concurrent ends")
+	}
+}
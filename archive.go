@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultArchiveRetention 归档输出的默认保留时间
+	defaultArchiveRetention = 7 * 24 * time.Hour
+	// archiveQueueSize 每条命令等待写入归档的数据块数, 写入跟不上时丢弃之后的数据块, 不阻塞读取输出
+	archiveQueueSize = 1024
+	// archiveCleanupInterval 检查过期归档的间隔
+	archiveCleanupInterval = 10 * time.Minute
+	// archiveTimeFormat 归档文件名中的时间, 按文件名排序即按时间排序
+	archiveTimeFormat = "20060102T150405.000Z"
+)
+
+// ArchiveMetadata 归档输出旁的 .json 文件内容
+type ArchiveMetadata struct {
+	CommandID string `json:"command_id"`
+	SessionID string `json:"session_id"`
+	Owner     string `json:"owner"`
+	Shell     string `json:"shell"`
+	// Command 客户端给出的命令, 机密值已替换
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	ExitCode   *int      `json:"exit_code"`
+	TimedOut   bool      `json:"timed_out,omitempty"`
+	Aborted    bool      `json:"aborted,omitempty"`
+	// Truncated 返回给客户端的输出被截断, 归档中仍是完整输出
+	Truncated bool `json:"truncated,omitempty"`
+	// ClientBytes 返回给客户端的输出字节数
+	ClientBytes int `json:"client_bytes"`
+	// ArchivedBytes 写入归档的输出字节数
+	ArchivedBytes int64 `json:"archived_bytes"`
+	// DroppedBytes 写入跟不上或写入失败而未归档的字节数, 不为 0 时归档不完整
+	DroppedBytes int64  `json:"dropped_bytes,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// OutputArchive 把每条命令的完整输出写入 <dir>/<session_id>/ 下, 按保留时间删除旧文件
+// 输出在 redact 之后、max_lines 等截断之前写入, 由每条命令的 goroutine 异步写盘
+type OutputArchive struct {
+	dir string
+	// retention 归档的保留时间, 0 表示不删除
+	retention time.Duration
+}
+
+// outputArchive 为 nil 时不归档
+var outputArchive *OutputArchive
+
+func NewOutputArchive(dir string, retention time.Duration) (*OutputArchive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	archive := &OutputArchive{dir: dir, retention: retention}
+	if retention > 0 {
+		go archive.cleanupLoop()
+	}
+	return archive, nil
+}
+
+// archiveEntry 一条命令的归档, write 和 finish 只在执行命令的 goroutine 中调用
+type archiveEntry struct {
+	path    string
+	meta    ArchiveMetadata
+	chunks  chan []byte
+	dropped int64
+}
+
+// Begin 开始归档一条命令的输出, 未启用归档时返回 nil
+func (a *OutputArchive) Begin(s *Session, commandID, command string) *archiveEntry {
+	if a == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	e := &archiveEntry{
+		path: filepath.Join(a.dir, s.ID, now.Format(archiveTimeFormat)+"-"+commandID),
+		meta: ArchiveMetadata{
+			CommandID: commandID,
+			SessionID: s.ID,
+			Owner:     s.Owner,
+			Shell:     s.ShellName,
+			Command:   secretRegistry.Redact(command),
+			StartedAt: now,
+		},
+		chunks: make(chan []byte, archiveQueueSize),
+	}
+	go e.run()
+	return e
+}
+
+// write 复制数据块交给写盘的 goroutine, 队列已满时丢弃
+func (e *archiveEntry) write(b []byte) {
+	if e == nil || len(b) == 0 {
+		return
+	}
+	select {
+	case e.chunks <- append([]byte(nil), b...):
+	default:
+		e.dropped += int64(len(b))
+	}
+}
+
+// finish 记录命令结果, 写完剩余的输出后写入元数据, 不等待写盘完成
+func (e *archiveEntry) finish(result *CommandResult, err error) {
+	if e == nil {
+		return
+	}
+	e.meta.FinishedAt = time.Now().UTC()
+	e.meta.DurationMs = e.meta.FinishedAt.Sub(e.meta.StartedAt).Milliseconds()
+	if result != nil {
+		e.meta.ExitCode = result.ExitCode
+		e.meta.TimedOut = result.TimedOut
+		e.meta.Aborted = result.Aborted
+		e.meta.Truncated = result.Truncated
+		e.meta.ClientBytes = result.Size
+	}
+	if err != nil {
+		e.meta.Error = secretRegistry.Redact(err.Error())
+	}
+	e.meta.DroppedBytes = e.dropped
+	close(e.chunks)
+}
+
+// run 把输出写入 .log 文件, 输出结束后写入 .json 元数据
+func (e *archiveEntry) run() {
+	var archived, failed int64
+	f, err := createArchiveFile(e.path + ".log")
+	if err != nil {
+		log.Printf("⚠ Failed to archive output | SessionID: %s | CommandID: %s | Error: %v", e.meta.SessionID, e.meta.CommandID, err)
+	}
+	for chunk := range e.chunks {
+		if f == nil {
+			failed += int64(len(chunk))
+			continue
+		}
+		n, err := f.Write(chunk)
+		archived += int64(n)
+		if err != nil {
+			log.Printf("⚠ Failed to archive output, discarding the rest | SessionID: %s | CommandID: %s | Error: %v", e.meta.SessionID, e.meta.CommandID, err)
+			failed += int64(len(chunk) - n)
+			f.Close()
+			f = nil
+		}
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			log.Printf("⚠ Failed to archive output | SessionID: %s | CommandID: %s | Error: %v", e.meta.SessionID, e.meta.CommandID, err)
+		}
+	}
+
+	// chunks 关闭后 finish 写入的元数据可见
+	e.meta.ArchivedBytes = archived
+	e.meta.DroppedBytes += failed
+	if e.meta.DroppedBytes > 0 {
+		log.Printf("⚠ Archived output is incomplete | SessionID: %s | CommandID: %s | Dropped: %d bytes", e.meta.SessionID, e.meta.CommandID, e.meta.DroppedBytes)
+	}
+	data, err := json.MarshalIndent(e.meta, "", "  ")
+	if err == nil {
+		err = os.WriteFile(e.path+".json", append(data, '\n'), 0600)
+	}
+	if err != nil {
+		log.Printf("⚠ Failed to write archive metadata | SessionID: %s | CommandID: %s | Error: %v", e.meta.SessionID, e.meta.CommandID, err)
+	}
+}
+
+// createArchiveFile 创建归档文件, 会话的目录在第一条命令时创建
+func createArchiveFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive file: %v", err)
+	}
+	return f, nil
+}
+
+// cleanupLoop 定期删除超过保留时间的归档文件和已清空的会话目录
+func (a *OutputArchive) cleanupLoop() {
+	ticker := time.NewTicker(archiveCleanupInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		a.cleanup(now.Add(-a.retention))
+	}
+}
+
+// cleanup 删除修改时间早于 cutoff 的归档文件
+func (a *OutputArchive) cleanup(cutoff time.Time) {
+	sessions, err := os.ReadDir(a.dir)
+	if err != nil {
+		log.Printf("⚠ Failed to list archive directory | Error: %v", err)
+		return
+	}
+	removed := 0
+	for _, session := range sessions {
+		if !session.IsDir() {
+			continue
+		}
+		dir := filepath.Join(a.dir, session.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("⚠ Failed to list archive directory | Dir: %s | Error: %v", dir, err)
+			continue
+		}
+		kept := 0
+		for _, file := range files {
+			info, err := file.Info()
+			name := file.Name()
+			if err != nil || file.IsDir() || !(strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".json")) || !info.ModTime().Before(cutoff) {
+				kept++
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("⚠ Failed to remove archived output | File: %s | Error: %v", name, err)
+				kept++
+				continue
+			}
+			removed++
+		}
+		if kept == 0 {
+			os.Remove(dir)
+		}
+	}
+	if removed > 0 {
+		log.Printf("✓ Archived output expired | Files: %d | Retention: %s", removed, a.retention)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readArchive 等待命令的归档写完, 返回输出和元数据
+func readArchive(t *testing.T, dir, sessionID, commandID string) (string, ArchiveMetadata) {
+	t.Helper()
+	var matches []string
+	waitFor(t, func() bool {
+		matches, _ = filepath.Glob(filepath.Join(dir, sessionID, "*-"+commandID+".json"))
+		return len(matches) == 1
+	})
+	var meta ArchiveMetadata
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodeJSON(t, data, &meta)
+	output, err := os.ReadFile(strings.TrimSuffix(matches[0], ".json") + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), meta
+}
+
+func TestOutputArchive(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Lines": {Output: "one\ntwo\nthree", ExitCode: 4}}
+	})
+	dir := t.TempDir()
+	archive, err := NewOutputArchive(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputArchive = archive
+	t.Cleanup(func() { outputArchive = nil })
+
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo init"}})
+	resp, data := ts.run(aliceToken, id, "Lines", map[string]any{"max_lines": 1})
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "one\n...[output truncated") {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+	commandID := resp.Header.Get("X-Command-ID")
+
+	// 归档中是截断之前的完整输出
+	output, meta := readArchive(t, dir, id, commandID)
+	if output != "one\ntwo\nthree" {
+		t.Fatalf("archived output = %q", output)
+	}
+	if meta.SessionID != id || meta.Owner != "alice" || meta.Command != "Lines" || meta.ExitCode == nil || *meta.ExitCode != 4 ||
+		!meta.Truncated || meta.ArchivedBytes != int64(len(output)) || meta.ClientBytes >= len(output) || meta.DroppedBytes != 0 {
+		t.Fatalf("metadata = %+v", meta)
+	}
+
+	// 初始化命令不归档
+	files, _ := os.ReadDir(filepath.Join(dir, id))
+	if len(files) != 2 {
+		t.Fatalf("archive files = %d, want 2", len(files))
+	}
+}
+
+func TestArchiveCleanup(t *testing.T) {
+	dir := t.TempDir()
+	archive := &OutputArchive{dir: dir, retention: time.Hour}
+	old, fresh := filepath.Join(dir, "old"), filepath.Join(dir, "fresh")
+	for _, path := range []string{old + "/a.log", old + "/a.json", fresh + "/b.log", fresh + "/notes.txt"} {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, []byte("x"), 0600)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{old + "/a.log", old + "/a.json", fresh + "/notes.txt"} {
+		os.Chtimes(path, past, past)
+	}
+
+	archive.cleanup(time.Now().Add(-time.Hour))
+	// 过期的归档和清空的会话目录被删除, 其他文件保留
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expired session directory kept: %v", err)
+	}
+	for _, path := range []string{fresh + "/b.log", fresh + "/notes.txt"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s removed: %v", path, err)
+		}
+	}
+}
+
+func TestArchiveEntryDropsWhenQueueFull(t *testing.T) {
+	e := &archiveEntry{chunks: make(chan []byte, 1)}
+	e.write([]byte("kept"))
+	e.write([]byte("dropped"))
+	e.write(nil)
+	if e.dropped != int64(len("dropped")) {
+		t.Fatalf("dropped = %d", e.dropped)
+	}
+	var nilEntry *archiveEntry
+	nilEntry.write([]byte("x"))
+	nilEntry.finish(nil, nil)
+}
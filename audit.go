@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// errAuditLogBroken 之前的写入或刷盘失败, 文件中可能已有不完整的记录, 之后的记录无法接上链条
+var errAuditLogBroken = errors.New("audit log is unusable after a failed write")
+
+// AuditEntry 审计日志中的一条命令记录
+// Hash 由上一条记录的 Hash 与本条内容计算得到, 修改或删除任意一条都会破坏链条
+type AuditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant"`
+	SessionID string    `json:"session_id"`
+	Command   string    `json:"command"`
+	ExitCode  *int      `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// AuditLog 只追加的审计日志, 与运行日志分开
+type AuditLog struct {
+	w   io.Writer
+	key []byte
+
+	mu       sync.Mutex
+	seq      int64
+	prevHash string
+	// failed 不为空时写入或刷盘曾经失败, 之后的 Record 都返回 errAuditLogBroken
+	failed error
+}
+
+// NewAuditLog 创建写入 w 的审计日志, key 不为空时使用 HMAC 对链条签名
+func NewAuditLog(w io.Writer, key []byte) *AuditLog {
+	return &AuditLog{w: w, key: key}
+}
+
+// OpenAuditLog 以追加方式打开审计日志文件, 并从已有记录继续链条
+func OpenAuditLog(path string, key []byte) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+
+	a := NewAuditLog(f, key)
+	last, err := verifyAuditEntries(f, key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("existing audit log is invalid: %v", err)
+	}
+	if last != nil {
+		a.seq = last.Seq
+		a.prevHash = last.Hash
+	}
+	return a, nil
+}
+
+// Record 追加一条记录, 写入后立即刷盘
+// 序号和链条只在写入成功后推进; 写入或刷盘失败后日志不再可用, 需要检查文件后重新打开
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.failed != nil {
+		return fmt.Errorf("%w: %v", errAuditLogBroken, a.failed)
+	}
+	entry.Seq = a.seq + 1
+	entry.Time = entry.Time.UTC()
+	entry.PrevHash = a.prevHash
+	entry.Hash = ""
+	sum, err := auditHash(a.key, entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = sum
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		a.failed = err
+		return fmt.Errorf("failed to write audit entry: %v", err)
+	}
+	if f, ok := a.w.(*os.File); ok {
+		if err := f.Sync(); err != nil {
+			// 记录可能已部分写入, 不能确定文件中的链条停在哪一条
+			a.failed = err
+			return fmt.Errorf("failed to sync audit log: %v", err)
+		}
+	}
+
+	a.seq = entry.Seq
+	a.prevHash = entry.Hash
+	return nil
+}
+
+// auditHash 计算记录的链式哈希, 计算时 Hash 字段为空
+func auditHash(key []byte, entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(entry.PrevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyAuditLog 校验审计日志的哈希链, 返回第一个断裂处的错误
+func VerifyAuditLog(r io.Reader, key []byte) error {
+	_, err := verifyAuditEntries(r, key)
+	return err
+}
+
+// verifyAuditEntries 校验哈希链并返回最后一条记录
+func verifyAuditEntries(r io.Reader, key []byte) (*AuditEntry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var last *AuditEntry
+	prevHash := ""
+	var seq int64
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: invalid entry: %v", line, err)
+		}
+		if entry.Seq != seq+1 {
+			return nil, fmt.Errorf("line %d: sequence break: expected %d, got %d", line, seq+1, entry.Seq)
+		}
+		if entry.PrevHash != prevHash {
+			return nil, fmt.Errorf("line %d: chain break: prev_hash does not match previous entry", line)
+		}
+		sum, err := auditHash(key, entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !hmac.Equal([]byte(sum), []byte(entry.Hash)) {
+			return nil, fmt.Errorf("line %d: hash mismatch, entry has been modified", line)
+		}
+		seq = entry.Seq
+		prevHash = entry.Hash
+		last = &entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return last, nil
+}
+
+var auditLog *AuditLog
+
+// auditCommand 记录一次命令执行, 未启用审计时不做任何事
+func auditCommand(identity *Identity, sessionID, command string, result *CommandResult, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:      time.Now(),
+		Tenant:    identity.Name,
+		SessionID: sessionID,
+		Command:   secretRegistry.Redact(command),
+	}
+	if result != nil {
+		entry.ExitCode = result.ExitCode
+	}
+	if err != nil {
+		entry.Error = secretRegistry.Redact(err.Error())
+	}
+	if err := auditLog.Record(entry); err != nil {
+		log.Printf("✗ Failed to write audit log | SessionID: %s | Error: %v", sessionID, err)
+	}
+}
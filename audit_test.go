@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordAudit 向审计日志追加 n 条记录
+func recordAudit(t *testing.T, a *AuditLog, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := a.Record(AuditEntry{Time: time.Now(), Tenant: "alice", SessionID: "s1", Command: "echo hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// auditLines 读取审计日志文件的每一行, 保留行尾的换行符
+func auditLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	return lines[:len(lines)-1]
+}
+
+// verifyAuditFile 校验审计日志文件
+func verifyAuditFile(t *testing.T, path string, key []byte) error {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return VerifyAuditLog(f, key)
+}
+
+func TestAuditLogReopen(t *testing.T) {
+	key := []byte("audit-key")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(t, a, 2)
+	a.w.(*os.File).Close()
+
+	// 重新打开后从最后一条记录继续链条
+	if a, err = OpenAuditLog(path, key); err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(t, a, 1)
+	a.w.(*os.File).Close()
+	if lines := auditLines(t, path); len(lines) != 3 || !strings.Contains(lines[2], `"seq":3`) {
+		t.Fatalf("audit log = %q", lines)
+	}
+	if err := verifyAuditFile(t, path, key); err != nil {
+		t.Fatal(err)
+	}
+	// 密钥不同时链条无法通过校验
+	if err := verifyAuditFile(t, path, []byte("other-key")); err == nil || !strings.Contains(err.Error(), "line 1: hash mismatch") {
+		t.Fatalf("verify with wrong key = %v", err)
+	}
+}
+
+func TestVerifyAuditLogDetectsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(t, a, 3)
+	a.w.(*os.File).Close()
+	lines := auditLines(t, path)
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"tampered", []string{lines[0], strings.Replace(lines[1], "echo hi", "echo bye", 1), lines[2]}, "line 2: hash mismatch"},
+		{"deleted", []string{lines[0], lines[2]}, "line 2: sequence break"},
+		{"reordered", []string{lines[0], lines[2], lines[1]}, "line 2: sequence break"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := filepath.Join(t.TempDir(), "audit.log")
+			if err := os.WriteFile(changed, []byte(strings.Join(tt.lines, "")), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyAuditFile(t, changed, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("verify = %v, want %q", err, tt.want)
+			}
+			// 已被修改的日志不能继续追加
+			if _, err := OpenAuditLog(changed, nil); err == nil {
+				t.Fatal("OpenAuditLog accepted a broken chain")
+			}
+		})
+	}
+}
+
+// failingWriter 在第 failAt 次写入时返回错误, 之前的写入追加到 lines
+type failingWriter struct {
+	writes int
+	failAt int
+	lines  []string
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == w.failAt {
+		return 0, errors.New("disk full")
+	}
+	w.lines = append(w.lines, string(p))
+	return len(p), nil
+}
+
+func TestAuditLogWriteFailure(t *testing.T) {
+	w := &failingWriter{failAt: 2}
+	a := NewAuditLog(w, nil)
+	recordAudit(t, a, 1)
+	if err := a.Record(AuditEntry{Command: "echo lost"}); err == nil {
+		t.Fatal("Record ignored the write error")
+	}
+	// 序号和链条没有为失败的记录推进
+	if a.seq != 1 {
+		t.Fatalf("seq after failed write = %d", a.seq)
+	}
+	// 之后的记录不再写入, 避免接在不完整的记录之后
+	if err := a.Record(AuditEntry{Command: "echo after"}); !errors.Is(err, errAuditLogBroken) {
+		t.Fatalf("Record after failure = %v", err)
+	}
+	if len(w.lines) != 1 || VerifyAuditLog(strings.NewReader(strings.Join(w.lines, "")), nil) != nil {
+		t.Fatalf("written = %q", w.lines)
+	}
+}
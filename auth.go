@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity 请求方身份, Name 同时作为会话归属的租户
+type Identity struct {
+	Name  string
+	Admin bool
+	// Method 通过认证的方式, 见 authMethod* 常量
+	Method string
+}
+
+// 通过认证的方式, 用于 /whoami
+const (
+	authMethodNone      = "none"
+	authMethodToken     = "token"
+	authMethodSignature = "signature"
+	authMethodJWT       = "jwt"
+	authMethodCert      = "cert"
+)
+
+// CanAccess 判断身份是否可以操作指定租户的会话
+func (id *Identity) CanAccess(owner string) bool {
+	return id.Admin || id.Name == owner
+}
+
+// AuthMode 认证方式
+type AuthMode string
+
+const (
+	// AuthToken 只使用令牌类凭据(默认), 未配置任何令牌类后端时不启用认证
+	AuthToken AuthMode = "token"
+	// AuthCert 只使用客户端证书
+	AuthCert AuthMode = "cert"
+	// AuthAny 令牌或客户端证书任一通过即可
+	AuthAny AuthMode = "any"
+	// AuthBoth 同时要求客户端证书和令牌, 以令牌作为租户身份
+	AuthBoth AuthMode = "both"
+)
+
+// Authenticator 一种认证后端, 请求中没有该后端的凭据或凭据无效时返回 false
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, bool)
+}
+
+// TokenAuth 按认证方式组合令牌类后端和客户端证书后端
+type TokenAuth struct {
+	// Mode 认证方式, 为空时等同于 AuthToken
+	Mode AuthMode
+	// Credentials 令牌类后端(静态令牌、JWT、请求签名), 按顺序尝试, 任一通过即可
+	Credentials []Authenticator
+	// Cert 客户端证书后端
+	Cert Authenticator
+}
+
+// NewTokenAuth 以配置的静态令牌和请求签名作为令牌类后端, 没有令牌时不添加
+func NewTokenAuth(tokens []TokenConfig, signatureSkew time.Duration) *TokenAuth {
+	a := &TokenAuth{Cert: &certAuth{}}
+	if len(tokens) > 0 {
+		a.Credentials = append(a.Credentials, &staticTokenAuth{tokens: tokens}, newSignatureAuth(tokens, signatureSkew))
+	}
+	return a
+}
+
+// Enabled 只使用令牌且没有任何令牌类后端时不启用认证
+func (a *TokenAuth) Enabled() bool {
+	return len(a.Credentials) > 0 || (a.Mode != "" && a.Mode != AuthToken)
+}
+
+// Authenticate 按认证方式校验请求中的令牌和客户端证书
+func (a *TokenAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	if !a.Enabled() {
+		// 未启用认证时所有请求共享同一个租户
+		return &Identity{Admin: true, Method: authMethodNone}, true
+	}
+
+	switch a.Mode {
+	case AuthCert:
+		return a.Cert.Authenticate(r)
+	case AuthAny:
+		if identity, ok := a.credentialIdentity(r); ok {
+			return identity, true
+		}
+		return a.Cert.Authenticate(r)
+	case AuthBoth:
+		if _, ok := a.Cert.Authenticate(r); !ok {
+			return nil, false
+		}
+		identity, ok := a.credentialIdentity(r)
+		if ok {
+			identity.Method = authMethodCert + "+" + identity.Method
+		}
+		return identity, ok
+	default:
+		return a.credentialIdentity(r)
+	}
+}
+
+// credentialIdentity 依次尝试令牌类后端
+func (a *TokenAuth) credentialIdentity(r *http.Request) (*Identity, bool) {
+	for _, backend := range a.Credentials {
+		if identity, ok := backend.Authenticate(r); ok {
+			return identity, true
+		}
+	}
+	return nil, false
+}
+
+// bearerToken 返回请求中的 Bearer Token, 没有时返回空字符串
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// certIdentityPrefix 客户端证书身份的租户名前缀, 与同名的令牌不属于同一租户
+const certIdentityPrefix = "cert:"
+
+// certAuth 以已验证的客户端证书中的名称加上 certIdentityPrefix 作为租户
+type certAuth struct {
+	// admins 作为管理员的客户端证书身份, 不带前缀
+	admins map[string]bool
+}
+
+func (c *certAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	name, ok := clientCertName(r)
+	if !ok {
+		return nil, false
+	}
+	return &Identity{Name: certIdentityPrefix + name, Admin: c.admins[name], Method: authMethodCert}, true
+}
+
+// staticTokenAuth 校验配置文件中的静态 Bearer Token
+type staticTokenAuth struct {
+	tokens []TokenConfig
+}
+
+func (s *staticTokenAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, false
+	}
+	for _, t := range s.tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return &Identity{Name: t.Name, Admin: t.Admin, Method: authMethodToken}, true
+		}
+	}
+	return nil, false
+}
+
+type identityKey struct{}
+
+var tokenAuth = NewTokenAuth(nil, defaultSignatureSkew)
+
+// requireAuth 认证中间件, 认证通过后将身份放入请求上下文
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := tokenAuth.Authenticate(r)
+		if !ok {
+			log.Printf("✗ Unauthorized request | Path: %s | Remote: %s", r.URL.Path, r.RemoteAddr)
+			writeError(w, newAPIError(http.StatusUnauthorized, "Unauthorized"))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	}
+}
+
+// requireAdmin 在 requireAuth 之后使用, 只允许管理员令牌访问
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if identity := identityFrom(r); !identity.Admin {
+			log.Printf("✗ Forbidden admin request | Path: %s | Token: %s", r.URL.Path, identity.Name)
+			writeError(w, newAPIError(http.StatusForbidden, "Forbidden"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// identityFrom 获取请求方身份
+func identityFrom(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	if identity == nil {
+		return &Identity{}
+	}
+	return identity
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSessionsIsolatedPerTenant(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "echo hello", nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != "hello" {
+		t.Fatalf("owner run = %d %q", resp.StatusCode, data)
+	}
+
+	// 其他租户的会话按不存在处理, 与错误的 ID 无法区分
+	resp, data = ts.run(bobToken, id, "echo hello", nil)
+	if resp.StatusCode != http.StatusNotFound || errorCodeOf(t, data) != codeSessionNotFound {
+		t.Fatalf("cross-tenant run = %d %s", resp.StatusCode, data)
+	}
+	resp, data = ts.do(http.MethodGet, bobToken, "/session-info?session_id="+id, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cross-tenant session-info = %d %s", resp.StatusCode, data)
+	}
+	resp, data = ts.post(bobToken, "/end-session", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cross-tenant end-session = %d %s", resp.StatusCode, data)
+	}
+	if _, ok := sessionManager.GetSession(id); !ok {
+		t.Fatal("another tenant ended the session")
+	}
+
+	var list struct {
+		Sessions []SessionSummary `json:"sessions"`
+	}
+	_, data = ts.do(http.MethodGet, bobToken, "/sessions", nil)
+	decodeJSON(t, data, &list)
+	if len(list.Sessions) != 0 {
+		t.Fatalf("bob sees %d sessions", len(list.Sessions))
+	}
+	_, data = ts.do(http.MethodGet, aliceToken, "/sessions", nil)
+	decodeJSON(t, data, &list)
+	if len(list.Sessions) != 1 || list.Sessions[0].SessionID != id {
+		t.Fatalf("alice sees %+v", list.Sessions)
+	}
+}
+
+func TestAdminCanAccessAllTenants(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(adminToken, id, "echo admin", nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != "admin" {
+		t.Fatalf("admin run = %d %q", resp.StatusCode, data)
+	}
+	resp, data = ts.post(adminToken, "/end-session", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin end-session = %d %s", resp.StatusCode, data)
+	}
+	if _, ok := sessionManager.GetSession(id); ok {
+		t.Fatal("session still exists after admin ended it")
+	}
+}
+
+func TestRequestsWithoutTokenRejected(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, token := range []string{"", "wrong-token"} {
+		resp, data := ts.post(token, "/start-session", map[string]any{})
+		if resp.StatusCode != http.StatusUnauthorized || errorCodeOf(t, data) != codeUnauthorized {
+			t.Fatalf("token %q: %d %s", token, resp.StatusCode, data)
+		}
+	}
+	if n := sessionManager.Count(); n != 0 {
+		t.Fatalf("%d sessions created without a valid token", n)
+	}
+}
+
+func TestConcurrentTenantsDoNotSeeEachOther(t *testing.T) {
+	ts := newTestServer(t, nil)
+	tokens := map[string]string{"alice": aliceToken, "bob": bobToken}
+	ids := make(map[string][]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, token := range tokens {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(name, token string) {
+				defer wg.Done()
+				id := ts.startSession(token, nil)
+				mu.Lock()
+				ids[name] = append(ids[name], id)
+				mu.Unlock()
+			}(name, token)
+		}
+	}
+	wg.Wait()
+
+	for name, token := range tokens {
+		for other, otherIDs := range ids {
+			for _, id := range otherIDs {
+				resp, _ := ts.run(token, id, "echo x", nil)
+				want := http.StatusOK
+				if other != name {
+					want = http.StatusNotFound
+				}
+				if resp.StatusCode != want {
+					t.Errorf("%s running in %s's session: %d, want %d", name, other, resp.StatusCode, want)
+				}
+			}
+		}
+	}
+}
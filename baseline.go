@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBaselineNameLength 基线名称的最大长度
+	maxBaselineNameLength = 128
+	// maxDiffCells 逐行比较时 LCS 表的最大单元数, 去掉相同的开头和结尾后仍超过时整段按替换处理
+	maxDiffCells = 1 << 20
+	// maxDiffLines 结果中最多返回的差异行数, 超过时只返回计数
+	maxDiffLines = 1000
+)
+
+// Baseline 租户保存的命令输出基线, 按 (Owner, Name) 区分
+type Baseline struct {
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Output    string    `json:"output"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DiffLine 一行差异, Op 为 + (新增) 或 - (删除), 行号从 1 开始
+type DiffLine struct {
+	Op string `json:"op"`
+	// OldLine 删除的行在基线中的行号, NewLine 新增的行在本次输出中的行号
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+	Text    string `json:"text"`
+}
+
+// BaselineResult 本次输出与基线的比较结果
+type BaselineResult struct {
+	Name string `json:"name"`
+	// Created 基线不存在, 本次输出已保存为基线
+	Created bool `json:"created"`
+	Changed bool `json:"changed"`
+	// Updated 请求了 update_baseline, 本次输出已替换原基线
+	Updated bool `json:"updated"`
+	// BaselineAt 比较所用基线的保存时间, 首次保存时为本次时间
+	BaselineAt time.Time `json:"baseline_at"`
+	Added      int       `json:"added"`
+	Removed    int       `json:"removed"`
+	// Lines 新增和删除的行, 按出现顺序排列, 不包含未变化的行
+	Lines []DiffLine `json:"lines,omitempty"`
+	// LinesTruncated 差异行超过 maxDiffLines, Lines 只包含前面的部分
+	LinesTruncated bool `json:"lines_truncated,omitempty"`
+}
+
+// validateBaselineName 基线名称只能包含字母、数字和 -_.:/
+func validateBaselineName(name string) error {
+	if name == "" || len(name) > maxBaselineNameLength {
+		return fmt.Errorf("baseline must be 1 to %d characters", maxBaselineNameLength)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:/", c)) {
+			return fmt.Errorf("baseline may only contain letters, digits and -_.:/")
+		}
+	}
+	return nil
+}
+
+// compareBaseline 比较输出与租户的基线, 基线不存在或 update 为 true 时保存本次输出
+func compareBaseline(store Store, owner, name, output string, update bool) (*BaselineResult, error) {
+	baseline, err := store.GetBaseline(owner, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load baseline: %v", err)
+	}
+
+	now := time.Now()
+	result := &BaselineResult{Name: name, BaselineAt: now}
+	if baseline == nil {
+		result.Created = true
+	} else {
+		result.BaselineAt = baseline.UpdatedAt
+		result.Lines, result.Added, result.Removed = diffLines(splitOutputLines(baseline.Output), splitOutputLines(output))
+		result.Changed = result.Added > 0 || result.Removed > 0
+		if len(result.Lines) > maxDiffLines {
+			result.Lines = result.Lines[:maxDiffLines]
+			result.LinesTruncated = true
+		}
+		result.Updated = update
+	}
+
+	if result.Created || result.Updated {
+		if err := store.PutBaseline(Baseline{Owner: owner, Name: name, Output: output, UpdatedAt: now}); err != nil {
+			return nil, fmt.Errorf("failed to save baseline: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// splitOutputLines 按行拆分输出, 行尾的 \r 不参与比较, 空输出没有行
+func splitOutputLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// diffLines 逐行比较基线 base 和本次输出 cur, 返回新增和删除的行
+// 先去掉相同的开头和结尾, 中间部分按最长公共子序列比较, 过大时整段按删除后新增处理
+func diffLines(base, cur []string) ([]DiffLine, int, int) {
+	prefix := 0
+	for prefix < len(base) && prefix < len(cur) && base[prefix] == cur[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(cur)-prefix && base[len(base)-1-suffix] == cur[len(cur)-1-suffix] {
+		suffix++
+	}
+	a, b := base[prefix:len(base)-suffix], cur[prefix:len(cur)-suffix]
+
+	var lines []DiffLine
+	removed := func(i int) { lines = append(lines, DiffLine{Op: "-", OldLine: prefix + i + 1, Text: a[i]}) }
+	added := func(j int) { lines = append(lines, DiffLine{Op: "+", NewLine: prefix + j + 1, Text: b[j]}) }
+
+	if len(a)*len(b) > maxDiffCells {
+		for i := range a {
+			removed(i)
+		}
+		for j := range b {
+			added(j)
+		}
+		return lines, len(b), len(a)
+	}
+
+	// lcs[i][j] 为 a[i:] 和 b[j:] 的最长公共子序列长度
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	nAdded, nRemoved := 0, 0
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			added(j)
+			nAdded++
+			j++
+		default:
+			removed(i)
+			nRemoved++
+			i++
+		}
+	}
+	return lines, nAdded, nRemoved
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateBaselineName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"disk-usage":             true,
+		"host01:/var/log_v2.txt": true,
+		"":                       false,
+		"has space":              false,
+		"semi;colon":             false,
+		strings.Repeat("a", maxBaselineNameLength):   true,
+		strings.Repeat("a", maxBaselineNameLength+1): false,
+	} {
+		if err := validateBaselineName(name); (err == nil) != ok {
+			t.Errorf("validateBaselineName(%q) = %v, want ok %t", name, err, ok)
+		}
+	}
+}
+
+func TestSplitOutputLines(t *testing.T) {
+	if lines := splitOutputLines(""); lines != nil {
+		t.Fatalf("empty output = %q", lines)
+	}
+	// 行尾的 \r 和末尾换行不参与比较
+	if lines := splitOutputLines("a\r\nb\n"); len(lines) != 2 || lines[0] != "a" || lines[1] != "b" {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	format := func(lines []DiffLine) string {
+		var parts []string
+		for _, l := range lines {
+			n := l.NewLine
+			if l.Op == "-" {
+				n = l.OldLine
+			}
+			parts = append(parts, fmt.Sprintf("%s%s@%d", l.Op, l.Text, n))
+		}
+		return strings.Join(parts, " ")
+	}
+	tests := []struct {
+		base, cur      []string
+		want           string
+		added, removed int
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, "", 0, 0},
+		{[]string{"a", "b", "c"}, []string{"a", "x", "c"}, "-b@2 +x@2", 1, 1},
+		{[]string{"a", "c"}, []string{"a", "b", "c", "d"}, "+b@2 +d@4", 2, 0},
+		{[]string{"a", "b", "c", "d"}, []string{"b", "d"}, "-a@1 -c@3", 0, 2},
+		{nil, []string{"new"}, "+new@1", 1, 0},
+	}
+	for _, tt := range tests {
+		lines, added, removed := diffLines(tt.base, tt.cur)
+		if got := format(lines); got != tt.want || added != tt.added || removed != tt.removed {
+			t.Errorf("diff(%q, %q) = %q +%d -%d, want %q +%d -%d", tt.base, tt.cur, got, added, removed, tt.want, tt.added, tt.removed)
+		}
+	}
+
+	// 过大时整段按删除后新增处理
+	big := make([]string, 1100)
+	other := make([]string, 1100)
+	for i := range big {
+		big[i], other[i] = "old"+strings.Repeat("x", i%7), "new"
+	}
+	if _, added, removed := diffLines(big, other); added != len(other) || removed != len(big) {
+		t.Fatalf("large diff = +%d -%d", added, removed)
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	store := NewMemoryStore()
+	result, err := compareBaseline(store, "alice", "disk", "a\nb\n", false)
+	if err != nil || !result.Created || result.Changed {
+		t.Fatalf("first compare = %+v, %v", result, err)
+	}
+	if result, _ = compareBaseline(store, "alice", "disk", "a\nb\n", false); result.Created || result.Changed {
+		t.Fatalf("unchanged = %+v", result)
+	}
+	// 不更新时保留原基线
+	if result, _ = compareBaseline(store, "alice", "disk", "a\nc\n", false); !result.Changed || result.Updated || result.Added != 1 || result.Removed != 1 {
+		t.Fatalf("changed = %+v", result)
+	}
+	if b, _ := store.GetBaseline("alice", "disk"); b.Output != "a\nb\n" {
+		t.Fatalf("baseline replaced without update_baseline: %q", b.Output)
+	}
+	if result, _ = compareBaseline(store, "alice", "disk", "a\nc\n", true); !result.Updated {
+		t.Fatalf("update = %+v", result)
+	}
+	if b, _ := store.GetBaseline("alice", "disk"); b.Output != "a\nc\n" {
+		t.Fatalf("baseline after update = %q", b.Output)
+	}
+
+	// 差异行超过上限时只返回前面的部分
+	many := strings.Repeat("line\n", maxDiffLines+10)
+	compareBaseline(store, "alice", "many", "", false)
+	if result, _ = compareBaseline(store, "alice", "many", many, false); len(result.Lines) != maxDiffLines || !result.LinesTruncated || result.Added != maxDiffLines+10 {
+		t.Fatalf("truncated diff = %d lines, truncated %t, added %d", len(result.Lines), result.LinesTruncated, result.Added)
+	}
+}
+
+func TestRunCommandBaseline(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	compare := func(token, session, command string, extra map[string]any) (*BaselineResult, int, []byte) {
+		t.Helper()
+		body := map[string]any{"baseline": "status"}
+		for k, v := range extra {
+			body[k] = v
+		}
+		resp, data := ts.run(token, session, command, body)
+		var result CommandResult
+		if resp.StatusCode == http.StatusOK {
+			decodeJSON(t, data, &result)
+		}
+		return result.Baseline, resp.StatusCode, data
+	}
+
+	if b, status, data := compare(aliceToken, id, "echo ok", nil); status != http.StatusOK || b == nil || !b.Created {
+		t.Fatalf("first run = %d %s", status, data)
+	}
+	b, _, data := compare(aliceToken, id, "echo degraded", nil)
+	if b == nil || !b.Changed || len(b.Lines) != 2 || b.Lines[0].Text != "ok" || b.Lines[1].Text != "degraded" {
+		t.Fatalf("changed run = %s", data)
+	}
+
+	// 基线按租户区分, 与会话无关
+	other := ts.startSession(bobToken, nil)
+	if b, _, data = compare(bobToken, other, "echo degraded", nil); b == nil || !b.Created {
+		t.Fatalf("other tenant = %s", data)
+	}
+
+	for _, extra := range []map[string]any{
+		{"baseline": "bad name"},
+		{"baseline": "", "update_baseline": true},
+		{"output_format": "base64"},
+		{"output_to_file": true},
+	} {
+		if _, status, data := compare(aliceToken, id, "echo ok", extra); status != http.StatusBadRequest {
+			t.Errorf("baseline with %v = %d %s", extra, status, data)
+		}
+	}
+}
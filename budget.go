@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// codeBudgetExceeded total_timeout_ms 已用完, 命令没有执行
+const codeBudgetExceeded = "budget_exceeded"
+
+// errBudgetExceeded 共享的 total_timeout_ms 已用完, 之后的命令跳过不执行
+var errBudgetExceeded = errors.New("total timeout budget exceeded")
+
+// newBudget 创建 total 时长的共享预算, 批量执行的每条命令都在同一个截止时间之前执行
+// total 为 0 时不限制, 返回的 context 为 nil
+func newBudget(total time.Duration) (context.Context, context.CancelFunc) {
+	if total <= 0 {
+		return nil, func() {}
+	}
+	return context.WithTimeout(context.Background(), total)
+}
+
+// budgetTimeout 预算剩余的时间比 timeout 短(或 timeout 为 0 即不限制)时返回剩余时间, 按毫秒取整, 至少 1 毫秒
+func budgetTimeout(budget context.Context, timeout time.Duration) time.Duration {
+	if budget == nil {
+		return timeout
+	}
+	deadline, ok := budget.Deadline()
+	if !ok {
+		return timeout
+	}
+	if remaining := time.Until(deadline).Round(time.Millisecond); timeout == 0 || remaining < timeout {
+		return max(remaining, time.Millisecond)
+	}
+	return timeout
+}
+
+// budgetExceeded 预算已用完时返回 true, budget 为 nil 时不限制
+// 同时比较截止时间, 命令按剩余时间超时后 context 的计时器可能还没有触发
+func budgetExceeded(budget context.Context) bool {
+	if budget == nil {
+		return false
+	}
+	if budget.Err() != nil {
+		return true
+	}
+	deadline, ok := budget.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// totalTimeout 将请求体中的 total_timeout_ms 转换为时长, 0 表示不限制, 负数返回 400
+// JSON-RPC 批量请求和组命令使用同一个字段
+func totalTimeout(ms int) (time.Duration, error) {
+	if ms < 0 {
+		return 0, newAPIError(http.StatusBadRequest, "total_timeout_ms must not be negative")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBudgetTimeout(t *testing.T) {
+	if got := budgetTimeout(nil, time.Minute); got != time.Minute {
+		t.Fatalf("timeout without budget = %s", got)
+	}
+	budget, cancel := newBudget(time.Second)
+	defer cancel()
+	// 剩余的预算比命令的超时短, 或命令不限制超时时, 以剩余的预算为准
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		if got := budgetTimeout(budget, timeout); got <= 0 || got > time.Second {
+			t.Errorf("timeout %s with 1s budget = %s", timeout, got)
+		}
+	}
+	if got := budgetTimeout(budget, 10*time.Millisecond); got != 10*time.Millisecond {
+		t.Errorf("shorter timeout = %s", got)
+	}
+
+	cancel()
+	if !budgetExceeded(budget) || budgetExceeded(nil) {
+		t.Fatal("budgetExceeded")
+	}
+	if none, _ := newBudget(0); none != nil {
+		t.Fatal("zero total timeout created a budget")
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	if d, err := totalTimeout(1500); err != nil || d != 1500*time.Millisecond {
+		t.Fatalf("totalTimeout(1500) = %s, %v", d, err)
+	}
+	if d, err := totalTimeout(0); err != nil || d != 0 {
+		t.Fatalf("totalTimeout(0) = %s, %v", d, err)
+	}
+	if _, err := totalTimeout(-1); err == nil {
+		t.Fatal("negative total timeout accepted")
+	}
+}
+
+// rpcRunCommand 一个 run_command 请求
+func rpcRunCommand(id int, sessionID, command string) map[string]any {
+	return map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  "run_command",
+		"params":  map[string]any{"session_id": sessionID, "command": command},
+	}
+}
+
+func TestRPCBatchTotalTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.JSONRPC = true
+		cfg.FakeOutputs = map[string]FakeOutput{"Slow": {Output: "done", DelayMs: 400}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 第一条命令用掉大部分预算, 第二条命令在剩余的预算内超时, 之后的命令不再执行
+	batch := []map[string]any{
+		rpcRunCommand(1, id, "Slow"),
+		rpcRunCommand(2, id, "Slow"),
+		rpcRunCommand(3, id, "echo skipped"),
+		{"jsonrpc": "2.0", "id": 4, "method": "list_sessions"},
+	}
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/rpc", map[string]any{"total_timeout_ms": 600, "batch": batch})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("batch took %s with a 600ms budget", elapsed)
+	}
+	var responses []struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Data struct {
+				Status int    `json:"status"`
+				Code   string `json:"code"`
+			} `json:"data"`
+		} `json:"error"`
+	}
+	decodeJSON(t, data, &responses)
+	if len(responses) != 4 {
+		t.Fatalf("responses = %s", data)
+	}
+	if responses[0].Error != nil {
+		t.Fatalf("first command failed: %s", data)
+	}
+	if e := responses[1].Error; e == nil || e.Data.Code != codeCommandTimeout {
+		t.Fatalf("second command = %s", data)
+	}
+	if e := responses[2].Error; e == nil || e.Data.Code != codeBudgetExceeded || e.Data.Status != http.StatusGatewayTimeout {
+		t.Fatalf("third command = %s", data)
+	}
+	// 其他方法不受预算限制
+	if responses[3].Error != nil {
+		t.Fatalf("list_sessions after budget = %s", data)
+	}
+
+	if resp, data = ts.post(aliceToken, "/rpc", map[string]any{"total_timeout_ms": -1, "batch": batch}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative total_timeout_ms = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.post(aliceToken, "/rpc", map[string]any{"total_timeout_ms": 600, "batch": batch[0]}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("batch that is not an array = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestGroupCommandTotalTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 2000}}
+	})
+	idle := ts.startSession(aliceToken, nil)
+	busy := ts.startSession(aliceToken, nil)
+	if resp, data := ts.post(aliceToken, "/group-members", map[string]any{"group": "web", "add": []string{idle, busy}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("add members = %d %s", resp.StatusCode, data)
+	}
+	s, _ := sessionManager.GetSession(busy)
+	go ts.run(aliceToken, busy, "Hang", nil)
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	// 排队等待忙碌会话的成员在预算用完后不再执行
+	resp, data := ts.post(aliceToken, "/run-group-command", map[string]any{
+		"group": "web", "command": "echo hi", "queue": true, "total_timeout_ms": 200,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("group command = %d %s", resp.StatusCode, data)
+	}
+	var out GroupCommandResponse
+	decodeJSON(t, data, &out)
+	if r := out.Results[idle]; r.Status != http.StatusOK {
+		t.Fatalf("idle member = %s", data)
+	}
+	if r := out.Results[busy]; r.Status != http.StatusGatewayTimeout || r.Error == nil || r.Error.Code != codeBudgetExceeded {
+		t.Fatalf("queued member = %s", data)
+	}
+	if out.Failed != 1 {
+		t.Fatalf("failed = %d", out.Failed)
+	}
+
+	if resp, data = ts.post(aliceToken, "/run-group-command", map[string]any{"group": "web", "command": "echo hi", "total_timeout_ms": -1}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative total_timeout_ms = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestBudgetCoversSlotWait(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 2000}}
+		cfg.MaxConcurrentCommands = 1
+		cfg.CommandQueueTimeout = Duration(time.Minute)
+	})
+	busy := ts.startSession(aliceToken, nil)
+	idle := ts.startSession(aliceToken, nil)
+	if resp, data := ts.post(aliceToken, "/group-members", map[string]any{"group": "web", "add": []string{idle}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("add members = %d %s", resp.StatusCode, data)
+	}
+	go ts.run(aliceToken, busy, "Hang", nil)
+	waitFor(t, func() bool { return commandLimiter.InFlight() == 1 })
+
+	// 执行名额被占满时等待名额的时间同样消耗预算, 不会等满 command_queue_timeout
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/run-group-command", map[string]any{"group": "web", "command": "echo hi", "total_timeout_ms": 200})
+	var out GroupCommandResponse
+	decodeJSON(t, data, &out)
+	if r := out.Results[idle]; resp.StatusCode != http.StatusOK || r.Status != http.StatusGatewayTimeout || r.Error == nil || r.Error.Code != codeBudgetExceeded {
+		t.Fatalf("group command waiting for a slot = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("group command took %s with a 200ms budget", elapsed)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// OutputBuffering 读取 shell 输出时的分块方式
+type OutputBuffering string
+
+const (
+	// BufferingByte 读到多少送出多少(默认), 延迟最低
+	BufferingByte OutputBuffering = "byte"
+	// BufferingLine 只在行尾处分块, 不完整的行暂存到读到换行符为止
+	BufferingLine OutputBuffering = "line"
+)
+
+// lineFlushDelay 行缓冲时不完整的行最多暂存的时间, 之后原样送出, 避免提示符等不换行的输出一直不出现
+// 小于静默模式的最小判定时长, 暂存不会让静默模式提前判定命令结束
+const lineFlushDelay = 50 * time.Millisecond
+
+// parseOutputBuffering 检查会话的 output_buffering, 为空时为 byte
+func parseOutputBuffering(buffering OutputBuffering) (OutputBuffering, error) {
+	switch buffering {
+	case "", BufferingByte:
+		return BufferingByte, nil
+	case BufferingLine:
+		return BufferingLine, nil
+	}
+	return "", fmt.Errorf("%w: output_buffering must be %s or %s", errInvalidOptions, BufferingByte, BufferingLine)
+}
+
+// startReader 按会话的分块方式启动读取 stdout 的 goroutine
+func (s *Session) startReader(stdout io.Reader, output chan<- []byte) {
+	if s.outputBuffering != BufferingLine {
+		go readLoop(stdout, output, s.readBufferSize, s.tail)
+		return
+	}
+	raw := make(chan []byte, cap(output))
+	go readLoop(stdout, raw, s.readBufferSize, nil)
+	go lineLoop(raw, output, s.readBufferSize, s.tail)
+}
+
+// lineLoop 把 raw 中的数据块重新按行分块送入 ch, raw 关闭时送出剩余内容并关闭 ch
+// 每块以换行符结尾, 除非暂存超过 lineFlushDelay 或达到 bufferSize; 连续的多行合并为一块
+// tail 不为空时写入送出的数据块
+func lineLoop(raw <-chan []byte, ch chan<- []byte, bufferSize int, tail *ringBuffer) {
+	defer close(ch)
+
+	var pending []byte
+	timer := time.NewTimer(lineFlushDelay)
+	defer timer.Stop()
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+	stopTimer()
+	send := func(b []byte) {
+		if len(b) == 0 {
+			return
+		}
+		if tail != nil {
+			tail.Write(b)
+		}
+		ch <- append([]byte(nil), b...)
+	}
+
+	for {
+		select {
+		case chunk, ok := <-raw:
+			if !ok {
+				send(pending)
+				return
+			}
+			wasEmpty := len(pending) == 0
+			pending = append(pending, chunk...)
+			if i := bytes.LastIndexByte(pending, '\n'); i >= 0 {
+				send(pending[:i+1])
+				pending = append(pending[:0], pending[i+1:]...)
+				wasEmpty = true
+			}
+			if len(pending) >= bufferSize {
+				send(pending)
+				pending = pending[:0]
+			}
+			if len(pending) == 0 {
+				stopTimer()
+			} else if wasEmpty {
+				// 从不完整的行开始暂存时计时
+				stopTimer()
+				timer.Reset(lineFlushDelay)
+			}
+		case <-timer.C:
+			send(pending)
+			pending = pending[:0]
+		}
+	}
+}
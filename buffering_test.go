@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutputBuffering(t *testing.T) {
+	for in, want := range map[OutputBuffering]OutputBuffering{"": BufferingByte, "byte": BufferingByte, "line": BufferingLine} {
+		if got, err := parseOutputBuffering(in); err != nil || got != want {
+			t.Errorf("parse %q = %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseOutputBuffering("block"); err == nil {
+		t.Error("unknown buffering accepted")
+	}
+}
+
+// runLineLoop 依次送入 chunks, 返回 lineLoop 送出的数据块
+func runLineLoop(bufferSize int, chunks ...string) []string {
+	raw := make(chan []byte)
+	ch := make(chan []byte, 16)
+	go lineLoop(raw, ch, bufferSize, nil)
+	for _, c := range chunks {
+		raw <- []byte(c)
+	}
+	close(raw)
+	var out []string
+	for b := range ch {
+		out = append(out, string(b))
+	}
+	return out
+}
+
+func TestLineLoop(t *testing.T) {
+	tests := []struct {
+		bufferSize int
+		chunks     []string
+		want       []string
+	}{
+		// 不完整的行暂存到换行符为止, 连续的多行合并为一块
+		{64, []string{"ab", "c\nde", "f\n"}, []string{"abc\n", "def\n"}},
+		{64, []string{"one\ntwo\nthr"}, []string{"one\ntwo\n", "thr"}},
+		// 达到 bufferSize 时不等换行符
+		{4, []string{"abcdef"}, []string{"abcdef"}},
+		{4, []string{"ab", "cd", "e\n"}, []string{"abcd", "e\n"}},
+	}
+	for _, tt := range tests {
+		if got := runLineLoop(tt.bufferSize, tt.chunks...); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("lineLoop(%d, %q) = %q, want %q", tt.bufferSize, tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestLineLoopFlushesPartialLine(t *testing.T) {
+	raw := make(chan []byte)
+	ch := make(chan []byte, 4)
+	tail := newRingBuffer(64)
+	go lineLoop(raw, ch, 64, tail)
+	defer close(raw)
+
+	// 不换行的提示符在 lineFlushDelay 后原样送出
+	start := time.Now()
+	raw <- []byte("Password: ")
+	select {
+	case b := <-ch:
+		if string(b) != "Password: " {
+			t.Fatalf("flushed %q", b)
+		}
+		if elapsed := time.Since(start); elapsed < lineFlushDelay {
+			t.Fatalf("partial line flushed after %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial line never flushed")
+	}
+	if b, _ := tail.Tail(64); string(b) != "Password: " {
+		t.Fatalf("tail = %q", b)
+	}
+}
+
+func TestOutputBufferingSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Lines": {Output: "first\nsecond\nthird"}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"output_buffering": "line"})
+	if s, _ := sessionManager.GetSession(id); s.outputBuffering != BufferingLine {
+		t.Fatalf("session buffering = %q", s.outputBuffering)
+	}
+	if resp, data := ts.run(aliceToken, id, "Lines", nil); resp.StatusCode != http.StatusOK || string(data) != "first\nsecond\nthird" {
+		t.Fatalf("line-buffered run = %d %q", resp.StatusCode, data)
+	}
+	if resp, data := ts.post(aliceToken, "/start-session", map[string]any{"output_buffering": "block"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown buffering = %d %s", resp.StatusCode, data)
+	}
+}
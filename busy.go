@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errSessionBusy 会话正在执行其他命令, 请求没有选择排队
+var errSessionBusy = errors.New("session is busy")
+
+// codeQueueWaitTimeout 排队等待会话超过 queue_timeout_ms 或 session_queue_timeout, 命令没有执行
+const codeQueueWaitTimeout = "queue_wait_timeout"
+
+// errQueueWaitTimeout 排队的命令在等待时间内没有开始执行, 已离开队列
+var errQueueWaitTimeout = errors.New("command did not start within the queue wait timeout")
+
+// BusyDetail 会话忙时正在执行的命令, 在 session_busy 错误中返回
+type BusyDetail struct {
+	CommandID string    `json:"command_id"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+	// Queued 排队等待执行的命令数
+	Queued int `json:"queued"`
+}
+
+// sessionBusyError 带正在执行的命令的 errSessionBusy
+type sessionBusyError struct {
+	detail BusyDetail
+}
+
+func (e *sessionBusyError) Error() string {
+	return fmt.Sprintf("session is busy running command %s (%s elapsed)", e.detail.CommandID, (time.Duration(e.detail.ElapsedMs) * time.Millisecond).String())
+}
+
+func (e *sessionBusyError) Unwrap() error {
+	return errSessionBusy
+}
+
+// busyError 会话正在执行客户端的命令时返回 sessionBusyError, 空闲或执行内部命令时返回 nil, 不获取 s.mu
+func (s *Session) busyError() error {
+	current := s.current.Load()
+	if current == nil || current.internal {
+		return nil
+	}
+	return &sessionBusyError{detail: BusyDetail{
+		CommandID: current.ID,
+		StartedAt: current.StartedAt,
+		ElapsedMs: time.Since(current.StartedAt).Milliseconds(),
+		Queued:    int(s.queued.Load()),
+	}}
+}
+
+// lockForCommand 获取 s.mu, failIfBusy 时会话正在执行命令则立即返回 sessionBusyError
+// 锁被内部命令或重启 shell 等短暂操作持有时照常等待, ctx 到期时放弃等待并返回 errQueueWaitTimeout
+func (s *Session) lockForCommand(ctx context.Context, failIfBusy bool) error {
+	if s.mu.TryLock() {
+		return nil
+	}
+	if failIfBusy {
+		if err := s.busyError(); err != nil {
+			return err
+		}
+	}
+	if ctx.Done() == nil {
+		s.mu.Lock()
+		return nil
+	}
+
+	locked := make(chan struct{}, 1)
+	go func() {
+		s.mu.Lock()
+		locked <- struct{}{}
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// 等待锁的 goroutine 无法取消, 拿到锁后立即释放
+		go func() {
+			<-locked
+			s.mu.Unlock()
+		}()
+		return errQueueWaitTimeout
+	}
+}
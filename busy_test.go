@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionBusy(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.JSONRPC = true
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {Output: "done", DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	done := make(chan string, 1)
+	go func() {
+		_, data := ts.run(aliceToken, id, "Hang", nil)
+		done <- string(data)
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+	current := s.current.Load()
+
+	// 默认立即返回 409, 附带正在执行的命令
+	resp, data := ts.run(aliceToken, id, "echo hi", nil)
+	var body ErrorResponse
+	decodeJSON(t, data, &body)
+	if resp.StatusCode != http.StatusConflict || body.Error.Code != codeSessionBusy || body.Error.Busy == nil || body.Error.Busy.CommandID != current.ID {
+		t.Fatalf("busy = %d %s", resp.StatusCode, data)
+	}
+
+	resp, data = ts.post(aliceToken, "/rpc", map[string]any{"jsonrpc": "2.0", "id": 1, "method": "run_command", "params": map[string]any{"session_id": id, "command": "echo hi"}})
+	var rpc struct {
+		Error struct {
+			Data struct {
+				Code string      `json:"code"`
+				Busy *BusyDetail `json:"busy"`
+			} `json:"data"`
+		} `json:"error"`
+	}
+	decodeJSON(t, data, &rpc)
+	if rpc.Error.Data.Code != codeSessionBusy || rpc.Error.Data.Busy == nil || rpc.Error.Data.Busy.CommandID != current.ID {
+		t.Fatalf("rpc busy = %s", data)
+	}
+
+	// queue 为 true 时等待正在执行的命令结束
+	queued := make(chan []byte, 1)
+	go func() {
+		_, data := ts.run(aliceToken, id, "echo queued", map[string]any{"queue": true})
+		queued <- data
+	}()
+	waitFor(t, func() bool { return s.queued.Load() == 1 })
+	if _, status := ts.sessionStatus(aliceToken, id); status == nil || !status.Busy || status.Queued != 1 {
+		t.Fatalf("status while queued = %+v", status)
+	}
+	if out := <-done; out != "done" {
+		t.Fatalf("running command = %q", out)
+	}
+	if out := <-queued; string(out) != "queued" {
+		t.Fatalf("queued command = %q", out)
+	}
+}
+
+func TestSessionNotBusyForInternalCommands(t *testing.T) {
+	s := &Session{}
+	if s.busyError() != nil {
+		t.Fatal("idle session busy")
+	}
+	s.beginCommand("init", "echo init", true)
+	if s.busyError() != nil {
+		t.Fatal("internal command reported as busy")
+	}
+	s.beginCommand("c1", "Get-Date", false)
+	if err := s.busyError(); err == nil || err.(*sessionBusyError).detail.CommandID != "c1" {
+		t.Fatalf("busy error = %v", err)
+	}
+}
+
+func TestQueueWaitTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.SessionQueueTimeout = Duration(time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {Output: "done", DelayMs: 1500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	done := make(chan string, 1)
+	go func() {
+		_, data := ts.run(aliceToken, id, "Hang", nil)
+		done <- string(data)
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	// 在 queue_timeout_ms 内没有开始执行时返回 429, 并离开队列
+	start := time.Now()
+	resp, data := ts.run(aliceToken, id, "echo queued", map[string]any{"queue": true, "queue_timeout_ms": 100})
+	if resp.StatusCode != http.StatusTooManyRequests || errorCodeOf(t, data) != codeQueueWaitTimeout {
+		t.Fatalf("queue wait timeout = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queued command waited %s", elapsed)
+	}
+	if s.queued.Load() != 0 {
+		t.Fatalf("%d commands still queued", s.queued.Load())
+	}
+
+	// 请求的值不能延长服务端的 session_queue_timeout
+	resp, data = ts.run(aliceToken, id, "echo queued", map[string]any{"queue": true, "queue_timeout_ms": 60000})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("server queue timeout = %d %s", resp.StatusCode, data)
+	}
+	if out := <-done; out != "done" {
+		t.Fatalf("running command = %q", out)
+	}
+	// 放弃等待后锁被释放, 会话可以继续使用
+	if resp, data = ts.run(aliceToken, id, "echo after", map[string]any{"queue": true, "queue_timeout_ms": 100}); resp.StatusCode != http.StatusOK || string(data) != "after" {
+		t.Fatalf("run after queue timeout = %d %s", resp.StatusCode, data)
+	}
+
+	for _, extra := range []map[string]any{{"queue_timeout_ms": -1, "queue": true}, {"queue_timeout_ms": 100}} {
+		if resp, data = ts.run(aliceToken, id, "echo hi", extra); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("run with %v = %d %s", extra, resp.StatusCode, data)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.SessionQueueTimeout = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("negative session_queue_timeout accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// errCommandCancelled 命令被 /cancel-session-commands 取消
+var errCommandCancelled = errors.New("command was cancelled")
+
+const (
+	// cancelStopTimeout 取消后等待正在运行的命令结束的时间, 超过后重启 shell
+	cancelStopTimeout = 5 * time.Second
+	// cancelKillInterval 等待期间反复结束 shell 子进程的间隔, 命令中之后的语句启动的进程同样被结束
+	cancelKillInterval = 100 * time.Millisecond
+)
+
+// CancelCommandsResult 取消会话命令的结果
+type CancelCommandsResult struct {
+	SessionID string `json:"session_id"`
+	// Running 是否取消了正在执行的命令
+	Running bool `json:"running"`
+	// Queued 取消时等待执行的命令数
+	Queued int `json:"queued"`
+	// Restarted 正在执行的命令未能在 cancelStopTimeout 内结束, shell 已重启
+	Restarted bool `json:"restarted"`
+}
+
+// CancelCommands 取消正在执行和等待执行的命令, shell 进程保留
+// 等待中的命令获取到 mu 后直接返回 errCommandCancelled, 不发送给 shell; 正在执行的命令立即返回,
+// 之后结束 shell 的子进程并读走该命令的剩余输出, 命令仍未结束(如 shell 内置命令的死循环)时重启 shell
+func (s *Session) CancelCommands() (*CancelCommandsResult, error) {
+	s.cancelling.Store(true)
+	queued := int(s.queued.Load())
+	s.cancelGen.Add(1)
+	s.abortCommands()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 先于解锁执行, 之后获取到 mu 的命令正常执行
+	defer s.cancelling.Store(false)
+	s.resetAbort()
+
+	if s.State() != stateRunning {
+		return nil, fmt.Errorf("%w: %s", errSessionNotFound, s.ID)
+	}
+
+	marker := s.unfinished
+	s.unfinished = ""
+	result := &CancelCommandsResult{SessionID: s.ID, Running: marker != "", Queued: queued}
+	if result.Running || result.Queued > 0 {
+		s.addEvent("commands_cancelled", fmt.Sprintf("running: %t, queued: %d", result.Running, result.Queued))
+	}
+	// shell 已退出时由自动重启或结束会话处理
+	if marker == "" || !s.running.Load() || s.stopUnfinished(marker) {
+		return result, nil
+	}
+	log.Printf("⚠ Cancelled command did not stop, restarting shell | SessionID: %s | Timeout: %s", s.ID, cancelStopTimeout)
+	if err := s.restartShell("cancel: command did not stop"); err != nil {
+		return nil, err
+	}
+	result.Restarted = true
+	return result, nil
+}
+
+// stopUnfinished 反复结束 shell 的子进程, 直到读到被取消命令的结束标记, 调用方需持有 s.mu
+// 静默模式下读到 quiescence 时长的无输出即认为命令已结束
+func (s *Session) stopUnfinished(marker string) bool {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(cancelKillInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.group.killChildren(); err != nil {
+				log.Printf("⚠ Failed to kill command processes | SessionID: %s | Error: %v", s.ID, err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	timer := time.NewTimer(cancelStopTimeout)
+	defer timer.Stop()
+	if s.terminator == TerminatorQuiescence {
+		ow := &outputWriter{out: io.Discard, sessionID: s.ID}
+		return s.collectQuiescent(ow, maxFileOutputSize, timer.C, nil) == nil
+	}
+
+	markerBytes := []byte(marker)
+	var window []byte
+	for {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				return false
+			}
+			// 开始标记已被取消的命令读走, 这里只会读到结束标记
+			window = append(window, chunk...)
+			if bytes.Contains(window, markerBytes) {
+				return true
+			}
+			if keep := len(markerBytes) - 1; len(window) > keep {
+				window = append(window[:0], window[len(window)-keep:]...)
+			}
+		case <-timer.C:
+			return false
+		case <-s.interrupt:
+			return false
+		}
+	}
+}
+
+// CancelCommandsRequest 取消会话命令的参数
+type CancelCommandsRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// cancelSessionCommands 取消请求方会话中正在执行和等待执行的命令
+// shell 重启时重放初始化命令, 与重启会话一致
+func cancelSessionCommands(identity *Identity, req CancelCommandsRequest) (*CancelCommandsResult, error) {
+	if req.SessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "session_id is required")
+	}
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("→ Request: Cancel session commands | SessionID: %s", req.SessionID)
+
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+
+	result, err := session.CancelCommands()
+	if err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			log.Printf("✗ Session ended during cancel | SessionID: %s", req.SessionID)
+			return nil, newAPIErrorCode(http.StatusNotFound, codeSessionNotFound, "Session not found")
+		}
+		if errors.Is(err, errShellUnavailable) {
+			return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnavailable, "%v", err)
+		}
+		log.Printf("✗ Failed to cancel commands | SessionID: %s | Error: %v", req.SessionID, err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to cancel commands: %v", err)
+	}
+	if result.Restarted {
+		if err := replayInit(identity, session); err != nil {
+			log.Printf("✗ Session init failed after cancel, ending session | SessionID: %s | Error: %v", req.SessionID, err)
+			sessionManager.EndSession(req.SessionID, true)
+			return nil, newAPIErrorCode(http.StatusBadRequest, codeInitFailed, "%v", err)
+		}
+	}
+
+	log.Printf("✓ Session commands cancelled | SessionID: %s | Running: %t | Queued: %d | Restarted: %t", req.SessionID, result.Running, result.Queued, result.Restarted)
+	return result, nil
+}
+
+// API24: 取消会话中正在执行和等待执行的命令, 不结束会话
+func handleCancelSessionCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req CancelCommandsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	resp, err := cancelSessionCommands(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// cancelCommands 取消会话中的命令, 返回状态码和结果
+func (ts *testServer) cancelCommands(token, id string) (int, CancelCommandsResult) {
+	ts.t.Helper()
+	resp, data := ts.post(token, "/cancel-session-commands", map[string]any{"session_id": id})
+	var out CancelCommandsResult
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out
+}
+
+func TestCancelSessionCommands(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {Output: "started", DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	type reply struct {
+		status int
+		data   []byte
+	}
+	running, queued := make(chan reply, 1), make(chan reply, 1)
+	go func() {
+		resp, data := ts.run(aliceToken, id, "Hang", nil)
+		running <- reply{resp.StatusCode, data}
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+	go func() {
+		resp, data := ts.run(aliceToken, id, "echo queued", map[string]any{"queue": true})
+		queued <- reply{resp.StatusCode, data}
+	}()
+	waitFor(t, func() bool { return s.queued.Load() == 1 })
+
+	start := time.Now()
+	status, out := ts.cancelCommands(aliceToken, id)
+	if status != http.StatusOK || !out.Running || out.Queued != 1 || out.Restarted {
+		t.Fatalf("cancel = %d %+v", status, out)
+	}
+	// 正在执行和等待执行的命令都立即返回
+	for name, ch := range map[string]chan reply{"running": running, "queued": queued} {
+		if r := <-ch; r.status != http.StatusConflict || errorCodeOf(t, r.data) != codeCommandCancelled {
+			t.Errorf("%s command = %d %s", name, r.status, r.data)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancel took %s", elapsed)
+	}
+
+	// shell 保留, 之后的命令照常执行
+	if resp, data := ts.run(aliceToken, id, "echo after", nil); resp.StatusCode != http.StatusOK || string(data) != "after" {
+		t.Fatalf("run after cancel = %d %q", resp.StatusCode, data)
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "commands_cancelled" {
+		t.Fatalf("last event = %+v", last)
+	}
+
+	if status, out = ts.cancelCommands(aliceToken, id); status != http.StatusOK || out.Running || out.Queued != 0 {
+		t.Fatalf("cancel idle session = %d %+v", status, out)
+	}
+	if status, _ = ts.cancelCommands(bobToken, id); status != http.StatusNotFound {
+		t.Fatalf("cross-tenant cancel = %d", status)
+	}
+}
+
+func TestCancelKillsCommandProcesses(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	s, _ := sessionManager.GetSession(id)
+	_, pid := ts.run(aliceToken, id, "echo $$", nil)
+
+	done := make(chan int, 1)
+	go func() {
+		resp, _ := ts.run(aliceToken, id, "sleep 30", nil)
+		done <- resp.StatusCode
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+	time.Sleep(100 * time.Millisecond)
+
+	// 子进程被结束, 不需要重启 shell
+	status, out := ts.cancelCommands(aliceToken, id)
+	if status != http.StatusOK || !out.Running || out.Restarted {
+		t.Fatalf("cancel = %d %+v", status, out)
+	}
+	if code := <-done; code != http.StatusConflict {
+		t.Fatalf("cancelled command = %d", code)
+	}
+	if _, after := ts.run(aliceToken, id, "echo $$", nil); string(after) != string(pid) {
+		t.Fatalf("shell pid changed from %s to %s", pid, after)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// capabilitiesVersion 能力文档的格式版本, 字段含义变化或删除字段时递增, 新增字段不递增
+const capabilitiesVersion = 1
+
+// Capabilities 描述服务支持的功能和限制, 供客户端调整行为
+// 不包含令牌、文件路径、shell 的可执行文件和参数等内部信息
+type Capabilities struct {
+	CapabilitiesVersion int                `json:"capabilities_version"`
+	Version             string             `json:"version"`
+	Auth                CapabilityAuth     `json:"auth"`
+	Features            CapabilityFeatures `json:"features"`
+	Shells              []CapabilityShell  `json:"shells"`
+	DefaultShell        string             `json:"default_shell"`
+	// ForwardHeaders 转发为命令环境变量的请求头, 不包含变量名
+	ForwardHeaders []string         `json:"forward_headers"`
+	Limits         CapabilityLimits `json:"limits"`
+}
+
+// CapabilityAuth 认证方式
+type CapabilityAuth struct {
+	// Required 是否需要认证
+	Required bool     `json:"required"`
+	Mode     AuthMode `json:"mode"`
+	TLS      bool     `json:"tls"`
+	// JWT 是否接受 JWT 作为 Bearer Token
+	JWT bool `json:"jwt"`
+	// ClientAuth TLS 客户端证书要求, 未开启 TLS 时为空
+	ClientAuth ClientAuth `json:"client_auth,omitempty"`
+}
+
+// CapabilityFeatures 可选功能是否可用
+type CapabilityFeatures struct {
+	JSONRPC      bool `json:"json_rpc"`
+	Async        bool `json:"async"`
+	OutputToFile bool `json:"output_to_file"`
+	JSONOutput   bool `json:"json_output"`
+	SubShells    bool `json:"subshells"`
+	Transcripts  bool `json:"transcripts"`
+	Scripts      bool `json:"scripts"`
+	Templates    bool `json:"templates"`
+	Uploads      bool `json:"uploads"`
+	// TemplatesOnly 只允许执行模板和脚本
+	TemplatesOnly  bool `json:"templates_only"`
+	CloneSession   bool `json:"clone_session"`
+	RestartSession bool `json:"restart_session"`
+	CancelCommands bool `json:"cancel_commands"`
+	Replay         bool `json:"replay"`
+	Constrained    bool `json:"constrained_language"`
+	Coalesce       bool `json:"coalesce"`
+	Compression    bool `json:"compression"`
+	// Streaming /run-command 支持 Accept: application/x-ndjson 的流式输出
+	Streaming bool `json:"streaming"`
+	Webhook   bool `json:"webhook"`
+	Audit     bool `json:"audit"`
+	Archive   bool `json:"archive"`
+	// WebUI /ui/ 调试页面
+	WebUI bool `json:"web_ui"`
+	// SessionGroups 会话组和 /run-group-command
+	SessionGroups bool `json:"session_groups"`
+	// Reattach /orphaned-sessions 和 /reattach-session
+	Reattach bool `json:"reattach"`
+	// RunOnce /run-once 临时会话
+	RunOnce bool `json:"run_once"`
+	// Whoami /whoami 身份检查
+	Whoami bool `json:"whoami"`
+	// Remote 创建会话时的 remote, 通过 PSRemoting 在远程计算机上执行命令
+	Remote bool `json:"remote_sessions"`
+	// JSONFilter 执行命令时的 json_filter, 对 json 格式的输出应用 jq 表达式
+	JSONFilter bool `json:"json_filter"`
+	// NoExec 服务端配置了 no_exec, 命令不会真正执行
+	NoExec bool `json:"no_exec"`
+	// ConfigReload 管理员可以通过 /admin/reload 重新加载配置
+	ConfigReload bool `json:"config_reload"`
+}
+
+// CapabilityShell 可用的 shell 预设
+type CapabilityShell struct {
+	Name string    `json:"name"`
+	Type ShellType `json:"type"`
+	// Installed 启动时可执行文件是否存在, 为 false 时创建会话返回 503 shell_unavailable
+	Installed bool `json:"installed"`
+	// Override 是否可以在执行命令时通过 shell 参数指定, 见 shell_overrides
+	Override bool `json:"override"`
+}
+
+// CapabilityLimits 服务端限制, 0 表示不限制
+type CapabilityLimits struct {
+	MaxOutputBytes        int   `json:"max_output_bytes"`
+	CommandTimeoutMs      int64 `json:"command_timeout_ms"`
+	OutputIdleTimeoutMs   int64 `json:"output_idle_timeout_ms"`
+	MaxConcurrentCommands int   `json:"max_concurrent_commands"`
+	MaxConcurrentSpawns   int   `json:"max_concurrent_spawns"`
+	MaxBlockedReads       int   `json:"max_blocked_reads"`
+	MaxQueueDepth         int   `json:"max_queue_depth"`
+	MaxTotalMemoryMB      int   `json:"max_total_memory_mb"`
+	MaxSessionsPerToken   int   `json:"max_sessions_per_token"`
+	MaxSubShells          int   `json:"max_subshells"`
+	MaxInitCommands       int   `json:"max_init_commands"`
+	SessionTailBytes      int   `json:"session_tail_bytes"`
+	DefaultJSONDepth      int   `json:"default_json_depth"`
+	MaxJSONDepth          int   `json:"max_json_depth"`
+	MaxUploadBytes        int64 `json:"max_upload_bytes"`
+	SpoolThresholdBytes   int   `json:"spool_threshold_bytes"`
+}
+
+// newCapabilities 根据配置生成能力文档, 启动时生成一次
+func newCapabilities(cfg *Config) *Capabilities {
+	c := &Capabilities{
+		CapabilitiesVersion: capabilitiesVersion,
+		Version:             version,
+		Auth: CapabilityAuth{
+			Required: tokenAuth.Enabled(),
+			Mode:     cfg.AuthMode,
+			JWT:      cfg.JWT != nil,
+			TLS:      cfg.TLS != nil,
+		},
+		Features: CapabilityFeatures{
+			JSONRPC:        cfg.JSONRPC,
+			Async:          true,
+			OutputToFile:   true,
+			JSONOutput:     true,
+			SubShells:      true,
+			Transcripts:    true,
+			Scripts:        scriptLibrary != nil,
+			Templates:      len(cfg.Templates) > 0,
+			Uploads:        cfg.UploadDir != "",
+			TemplatesOnly:  cfg.TemplatesOnly,
+			CloneSession:   true,
+			RestartSession: true,
+			CancelCommands: true,
+			Replay:         true,
+			Constrained:    true,
+			Coalesce:       true,
+			Compression:    true,
+			Streaming:      true,
+			Webhook:        webhook != nil,
+			Audit:          auditLog != nil,
+			Archive:        cfg.ArchiveDir != "",
+			WebUI:          cfg.WebUI,
+			SessionGroups:  true,
+			Reattach:       true,
+			RunOnce:        true,
+			Whoami:         true,
+			Remote:         true,
+			JSONFilter:     true,
+			NoExec:         cfg.NoExec,
+			ConfigReload:   true,
+		},
+		DefaultShell: cfg.DefaultShell,
+		Limits: CapabilityLimits{
+			MaxOutputBytes:        maxOutputSize,
+			CommandTimeoutMs:      time.Duration(cfg.CommandTimeout).Milliseconds(),
+			OutputIdleTimeoutMs:   time.Duration(cfg.OutputIdleTimeout).Milliseconds(),
+			MaxConcurrentCommands: cfg.MaxConcurrentCommands,
+			MaxConcurrentSpawns:   cfg.MaxConcurrentSpawns,
+			MaxBlockedReads:       cfg.MaxBlockedReads,
+			MaxQueueDepth:         cfg.MaxQueueDepth,
+			MaxTotalMemoryMB:      cfg.MaxTotalMemoryMB,
+			MaxSessionsPerToken:   cfg.MaxSessionsPerToken,
+			MaxSubShells:          maxSubShells,
+			MaxInitCommands:       maxInitCommands,
+			SessionTailBytes:      cfg.SessionTailSize,
+			DefaultJSONDepth:      cfg.JSONDepth,
+			MaxJSONDepth:          maxJSONDepth,
+			MaxUploadBytes:        cfg.MaxUploadSize,
+			SpoolThresholdBytes:   cfg.SpoolThreshold,
+		},
+	}
+	if cfg.TLS != nil {
+		c.Auth.ClientAuth = cfg.TLS.ClientAuth
+	}
+	for name, shell := range cfg.Shells {
+		c.Shells = append(c.Shells, CapabilityShell{Name: name, Type: shell.Type, Installed: shell.installed(), Override: slices.Contains(cfg.ShellOverrides, name)})
+	}
+	sort.Slice(c.Shells, func(i, j int) bool { return c.Shells[i].Name < c.Shells[j].Name })
+	c.ForwardHeaders = []string{}
+	for header := range canonicalForwardHeaders(cfg.ForwardHeaders) {
+		c.ForwardHeaders = append(c.ForwardHeaders, header)
+	}
+	sort.Strings(c.ForwardHeaders)
+	return c
+}
+
+// capabilities 启动和重新加载配置时生成
+var capabilities atomic.Pointer[Capabilities]
+
+// API18: 服务能力, 不需要认证
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities.Load())
+}
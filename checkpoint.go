@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxCheckpoints 一条命令中检查点的数量上限
+const maxCheckpoints = 100
+
+// checkpointDirective 独占一行的检查点注释, 如 "# rce:checkpoint build", cmd 中为 "rem rce:checkpoint build"
+// 不开启 checkpoints 时该行只是普通注释, 命令照常执行
+var checkpointDirective = regexp.MustCompile(`^\s*(?:#|::|(?i:rem)\s)\s*rce:checkpoint\s+(\S+)\s*$`)
+
+// checkpointName 检查点名称允许的字符
+var checkpointName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// CommandSegment 两个检查点之间的输出
+type CommandSegment struct {
+	// Checkpoint 结束本段的检查点, 最后一个检查点之后的输出为空
+	Checkpoint string `json:"checkpoint,omitempty"`
+	Output     string `json:"output"`
+}
+
+// injectCheckpoints 把命令中的检查点注释替换为输出分段标记的语句, 返回替换后的命令和标记前缀
+// 标记前缀每条命令不同, 命令自身的输出不会被误认为检查点
+func injectCheckpoints(command string, shellType ShellType) (string, string, error) {
+	token := "__RCE_CP_" + strings.ReplaceAll(uuid.New().String(), "-", "") + "_"
+	lines := strings.Split(command, "\n")
+	seen := make(map[string]bool)
+	for i, line := range lines {
+		m := checkpointDirective.FindStringSubmatch(strings.TrimSuffix(line, "\r"))
+		if m == nil {
+			continue
+		}
+		name := m[1]
+		if !checkpointName.MatchString(name) {
+			return "", "", fmt.Errorf("invalid checkpoint name %q, use up to 64 letters, digits, '_', '.' or '-'", name)
+		}
+		if seen[name] {
+			return "", "", fmt.Errorf("duplicate checkpoint %q", name)
+		}
+		if seen[name] = true; len(seen) > maxCheckpoints {
+			return "", "", fmt.Errorf("at most %d checkpoints per command", maxCheckpoints)
+		}
+		// 输出标记不改变命令的退出码: Write-Output 和 cmd 的 echo 不修改退出码, bash 中恢复 $?
+		switch shellType {
+		case ShellPowerShell:
+			lines[i] = "Write-Output '" + token + name + "'"
+		case ShellCmd:
+			lines[i] = "echo " + token + name
+		default:
+			lines[i] = "__rce_cp=$?; echo '" + token + name + "'; (exit $__rce_cp)"
+		}
+	}
+	if len(seen) == 0 {
+		return "", "", fmt.Errorf("checkpoints requested but the command has no rce:checkpoint lines")
+	}
+	return strings.Join(lines, "\n"), token, nil
+}
+
+// splitSegments 按检查点标记把输出分段, 标记行从 Output 中去除
+// 命令超时或失败时只包含已到达的检查点, 之后的输出在最后一段中
+func (r *CommandResult) splitSegments(token string) {
+	var output, segment strings.Builder
+	r.Segments = []CommandSegment{}
+	for _, line := range strings.SplitAfter(r.Output, "\n") {
+		if name, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), token); ok {
+			r.Segments = append(r.Segments, CommandSegment{Checkpoint: name, Output: segment.String()})
+			segment.Reset()
+			continue
+		}
+		segment.WriteString(line)
+		output.WriteString(line)
+	}
+	r.Segments = append(r.Segments, CommandSegment{Output: segment.String()})
+	r.Output = output.String()
+	r.Size = len(r.Output)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestInjectCheckpoints(t *testing.T) {
+	command := "Get-Date\r\n  # rce:checkpoint date\nGet-Location\n# rce:checkpoint loc-1.x\nGet-ChildItem"
+	got, token, err := injectCheckpoints(command, ShellPowerShell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Get-Date\r\nWrite-Output '" + token + "date'\nGet-Location\nWrite-Output '" + token + "loc-1.x'\nGet-ChildItem"
+	if got != want || !strings.HasPrefix(token, "__RCE_CP_") {
+		t.Fatalf("injected = %q, want %q", got, want)
+	}
+	// 每条命令的标记前缀不同
+	if _, other, _ := injectCheckpoints(command, ShellPowerShell); other == token {
+		t.Fatal("checkpoint token reused")
+	}
+	if got, token, _ = injectCheckpoints("dir\nrem rce:checkpoint a\n:: rce:checkpoint b", ShellCmd); got != "dir\necho "+token+"a\necho "+token+"b" {
+		t.Fatalf("cmd = %q", got)
+	}
+	if got, token, _ = injectCheckpoints("ls\n# rce:checkpoint a", ShellBash); got != "ls\n__rce_cp=$?; echo '"+token+"a'; (exit $__rce_cp)" {
+		t.Fatalf("bash = %q", got)
+	}
+
+	for _, bad := range []string{
+		"Get-Date",
+		"# rce:checkpoint a\n# rce:checkpoint a",
+		"# rce:checkpoint bad/name",
+		"echo # rce:checkpoint inline",
+	} {
+		if _, _, err := injectCheckpoints(bad, ShellPowerShell); err == nil {
+			t.Errorf("inject %q accepted", bad)
+		}
+	}
+	var many strings.Builder
+	for i := 0; i <= maxCheckpoints; i++ {
+		fmt.Fprintf(&many, "# rce:checkpoint c%d\n", i)
+	}
+	if _, _, err := injectCheckpoints(many.String(), ShellPowerShell); err == nil {
+		t.Error("more than maxCheckpoints accepted")
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	const token = "__RCE_CP_t_"
+	r := &CommandResult{Output: "a\r\n" + token + "one\r\nb\nc\n" + token + "two\ntail"}
+	r.splitSegments(token)
+	want := []CommandSegment{{"one", "a\r\n"}, {"two", "b\nc\n"}, {"", "tail"}}
+	if len(r.Segments) != len(want) {
+		t.Fatalf("segments = %+v", r.Segments)
+	}
+	for i := range want {
+		if r.Segments[i] != want[i] {
+			t.Errorf("segment %d = %+v, want %+v", i, r.Segments[i], want[i])
+		}
+	}
+	if r.Output != "a\r\nb\nc\ntail" || r.Size != len(r.Output) {
+		t.Fatalf("output = %q size %d", r.Output, r.Size)
+	}
+}
+
+func TestCheckpointsRequest(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	tests := []struct {
+		command string
+		extra   map[string]any
+	}{
+		// 命令中没有检查点
+		{"echo a", nil},
+		{"echo a\n# rce:checkpoint a\necho b", map[string]any{"max_lines": 1}},
+		{"echo a\n# rce:checkpoint a\necho b", map[string]any{"output_format": "json"}},
+		{"echo a\n# rce:checkpoint a\necho b", map[string]any{"echo_command": true}},
+	}
+	for _, tt := range tests {
+		req := map[string]any{"checkpoints": true}
+		for k, v := range tt.extra {
+			req[k] = v
+		}
+		if resp, data := ts.run(aliceToken, id, tt.command, req); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q %v = %d %s", tt.command, tt.extra, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestCheckpointSegmentsBash(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+
+	command := "echo build\n# rce:checkpoint build\nfalse\n# rce:checkpoint test\necho done; (exit 3)"
+	resp, data := ts.run(aliceToken, id, command, map[string]any{"checkpoints": true})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("checkpoints = %d %s", resp.StatusCode, data)
+	}
+	var result CommandResult
+	decodeJSON(t, data, &result)
+	want := []CommandSegment{{"build", "build\n"}, {"test", ""}, {"", "done"}}
+	if len(result.Segments) != 3 || result.Segments[0] != want[0] || result.Segments[1] != want[1] || result.Segments[2] != want[2] {
+		t.Fatalf("segments = %+v", result.Segments)
+	}
+	// 插入的语句不改变退出码
+	if result.Output != "build\ndone" || result.ExitCode == nil || *result.ExitCode != 3 {
+		t.Fatalf("result = %q exit %v", result.Output, result.ExitCode)
+	}
+}
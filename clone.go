@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxInitCommands 每个会话记录的初始化命令数上限
+const maxInitCommands = 100
+
+var (
+	errInitFailed  = errors.New("init command failed")
+	errInitSetFull = fmt.Errorf("init set is full, at most %d commands", maxInitCommands)
+)
+
+// recordInit 在会话历史中追加一条初始化命令的记录, 克隆会话时按顺序重放
+// 已有 maxInitCommands 条初始化命令时追加为普通记录并返回 errInitSetFull
+func (s *Session) recordInit(rec CommandRecord) error {
+	s.initMu.Lock()
+	defer s.initMu.Unlock()
+	history, err := s.store.History(s.ID)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, r := range history {
+		if r.Init {
+			count++
+		}
+	}
+	rec.Init = count < maxInitCommands
+	if err := s.store.AppendHistory(s.ID, rec); err != nil {
+		return err
+	}
+	if !rec.Init {
+		return errInitSetFull
+	}
+	return nil
+}
+
+// recordCommand 在会话历史中追加一条客户端命令的记录, 写入失败只记录日志
+func (s *Session) recordCommand(rec CommandRecord) {
+	if err := s.store.AppendHistory(s.ID, rec); err != nil {
+		log.Printf("⚠ Failed to record command history | SessionID: %s | Error: %v", s.ID, err)
+	}
+}
+
+// InitCommands 按顺序返回会话历史中的初始化命令, 不等待正在执行的命令
+func (s *Session) InitCommands() []string {
+	history, err := s.store.History(s.ID)
+	if err != nil {
+		return nil
+	}
+	var commands []string
+	for _, r := range history {
+		if r.Init {
+			commands = append(commands, r.Command)
+		}
+	}
+	return commands
+}
+
+// newCommandRecord 由命令的执行结果生成历史记录
+func newCommandRecord(command string, started time.Time, result *CommandResult, err error) CommandRecord {
+	rec := CommandRecord{Command: command, StartedAt: started, FinishedAt: time.Now()}
+	if result != nil {
+		rec.CommandID = result.CommandID
+		rec.ExitCode = result.ExitCode
+		rec.TimedOut = result.TimedOut
+		rec.OutputBytes = result.Size
+		rec.Truncated = result.Truncated
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+// runInit 在会话中依次执行初始化命令, 任一命令出错或退出码不为 0 时返回 errInitFailed
+// record 为 true 时记录为会话的初始化命令, 重放已记录的命令时为 false
+func runInit(identity *Identity, session *Session, commands []string, record bool) error {
+	for i, command := range commands {
+		started := time.Now()
+		result, err := session.RunCommand(command, RunOptions{})
+		auditCommand(identity, session.ID, command, result, err)
+		if err != nil {
+			if result != nil && result.Output != "" && (errors.Is(err, errSyntaxError) || errors.Is(err, errIncompleteCommand)) {
+				err = fmt.Errorf("%v\n%s", err, result.Output)
+			}
+			return fmt.Errorf("%w: command %d: %v", errInitFailed, i+1, err)
+		}
+		if result.ExitCode != nil && *result.ExitCode != 0 {
+			return fmt.Errorf("%w: command %d: exit code %d", errInitFailed, i+1, *result.ExitCode)
+		}
+		if !record {
+			continue
+		}
+		if err := session.recordInit(newCommandRecord(command, started, result, nil)); err != nil {
+			return fmt.Errorf("%w: command %d: %v", errInitFailed, i+1, err)
+		}
+	}
+	return nil
+}
+
+// CloneSessionRequest 克隆会话的参数
+type CloneSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// CloneSessionResponse 克隆得到的新会话
+type CloneSessionResponse struct {
+	SessionID       string `json:"session_id"`
+	SourceSessionID string `json:"source_session_id"`
+	// InitCommands 重放的初始化命令数
+	InitCommands int `json:"init_commands"`
+}
+
+// cloneSession 以源会话的参数创建新会话, 并重放源会话记录的初始化命令
+// 进程状态无法复制, 只有初始化命令产生的状态会出现在新会话中
+func cloneSession(identity *Identity, req CloneSessionRequest) (*CloneSessionResponse, error) {
+	if req.SessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "session_id is required")
+	}
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("→ Request: Clone session | SessionID: %s", req.SessionID)
+
+	source, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+
+	opts := source.options
+	opts.Init = source.InitCommands()
+	session, err := startSession(identity, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("✓ Session cloned | SourceSessionID: %s | SessionID: %s | Init commands: %d", req.SessionID, session.ID, len(opts.Init))
+	return &CloneSessionResponse{
+		SessionID:       session.ID,
+		SourceSessionID: req.SessionID,
+		InitCommands:    len(opts.Init),
+	}, nil
+}
+
+// API17: 克隆会话
+func handleCloneSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req CloneSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	resp, err := cloneSession(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
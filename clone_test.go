@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+// cloneSession 克隆会话, 返回响应
+func (ts *testServer) cloneSession(token, id string) (*http.Response, CloneSessionResponse) {
+	ts.t.Helper()
+	resp, data := ts.post(token, "/clone-session", map[string]any{"session_id": id})
+	var out CloneSessionResponse
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp, out
+}
+
+func TestCloneSessionReplaysInit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"fail": {ExitCode: 1}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash", "init": []string{"echo a", "echo b"}})
+	ts.run(aliceToken, id, "echo c", map[string]any{"record_init": true})
+	// 退出码不为 0 和没有 record_init 的命令不记录
+	ts.run(aliceToken, id, "fail", map[string]any{"record_init": true})
+	ts.run(aliceToken, id, "echo d", nil)
+
+	resp, clone := ts.cloneSession(aliceToken, id)
+	if resp.StatusCode != http.StatusOK || clone.SourceSessionID != id || clone.InitCommands != 3 {
+		t.Fatalf("clone = %d %+v", resp.StatusCode, clone)
+	}
+	s, _ := sessionManager.GetSession(clone.SessionID)
+	if want := []string{"echo a", "echo b", "echo c"}; !reflect.DeepEqual(s.InitCommands(), want) {
+		t.Fatalf("clone init commands = %q, want %q", s.InitCommands(), want)
+	}
+	if s.ShellName != "bash" || s.Owner != "alice" {
+		t.Fatalf("clone shell %q, owner %q", s.ShellName, s.Owner)
+	}
+
+	// 其他租户的会话按不存在处理
+	if resp, _ = ts.cloneSession(bobToken, id); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cross-tenant clone = %d", resp.StatusCode)
+	}
+}
+
+func TestRecordInitSetFull(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	for i := 0; i < maxInitCommands; i++ {
+		if err := s.recordInit(CommandRecord{Command: "echo x"}); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	// 已满时命令照常执行, 但返回 409
+	resp, data := ts.run(aliceToken, id, "echo full", map[string]any{"record_init": true})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("record into a full init set = %d %s", resp.StatusCode, data)
+	}
+	if err := s.recordInit(CommandRecord{Command: "echo x"}); !errors.Is(err, errInitSetFull) {
+		t.Fatalf("recordInit = %v, want errInitSetFull", err)
+	}
+}
+
+func TestInitFailureEndsSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"fail": {Output: "boom", ExitCode: 3}}
+	})
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"init": []string{"echo ok", "fail"}})
+	if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInitFailed {
+		t.Fatalf("start with failing init = %d %s", resp.StatusCode, data)
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions left after init failed", n)
+	}
+}
+
+func TestCloneSessionKeepsInitVariables(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash", "init": []string{"export GREETING=hello"}})
+	ts.run(aliceToken, id, "ANSWER=42", map[string]any{"record_init": true})
+	// 没有记录的运行时状态不会出现在克隆的会话中
+	ts.run(aliceToken, id, "RUNTIME=lost", nil)
+
+	resp, clone := ts.cloneSession(aliceToken, id)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("clone = %d", resp.StatusCode)
+	}
+	resp, data := ts.run(aliceToken, clone.SessionID, `echo "$GREETING $ANSWER [$RUNTIME]"`, nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "hello 42 []" {
+		t.Fatalf("variables in clone = %d %q", resp.StatusCode, data)
+	}
+}
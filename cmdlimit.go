@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// CommandLimitAction 会话执行的命令数达到 max_commands_per_session 后的处理方式
+type CommandLimitAction string
+
+const (
+	// CommandLimitRefuse 会话保留, 之后的命令返回 409 command_limit_reached(默认)
+	CommandLimitRefuse CommandLimitAction = "refuse"
+	// CommandLimitEnd 达到上限的命令执行完后结束会话
+	CommandLimitEnd CommandLimitAction = "end"
+)
+
+// codeCommandLimit 会话的命令数已达上限, 客户端应创建新会话
+const codeCommandLimit = "command_limit_reached"
+
+// errCommandLimit 会话的命令数已达上限
+var errCommandLimit = errors.New("session has reached its command limit, start a new session")
+
+// parseCommandLimitAction 检查配置的处理方式, 为空时为 refuse
+func parseCommandLimitAction(action string) (CommandLimitAction, error) {
+	switch CommandLimitAction(action) {
+	case "", CommandLimitRefuse:
+		return CommandLimitRefuse, nil
+	case CommandLimitEnd:
+		return CommandLimitEnd, nil
+	}
+	return "", fmt.Errorf("command_limit_action must be %s or %s", CommandLimitRefuse, CommandLimitEnd)
+}
+
+// checkCommandLimit 会话的命令数已达上限时返回 errCommandLimit, 调用方需持有 s.mu
+func (s *Session) checkCommandLimit() error {
+	if count := int(s.commandCount.Load()); s.maxCommands > 0 && count >= s.maxCommands {
+		log.Printf("✗ Command limit reached | SessionID: %s | Commands: %d", s.ID, count)
+		return fmt.Errorf("%w: %d commands executed", errCommandLimit, count)
+	}
+	return nil
+}
+
+// countCommand 记录一条已发送给 shell 的命令, 调用方需持有 s.mu
+// 处理方式为 end 且达到上限时在后台结束会话, 结束前等待本条命令返回并释放 s.mu
+func (s *Session) countCommand() {
+	count := int(s.commandCount.Add(1))
+	if s.maxCommands == 0 || count < s.maxCommands {
+		return
+	}
+	s.addEvent("command_limit", fmt.Sprintf("%d commands executed", count))
+	if s.commandLimitAction != CommandLimitEnd {
+		log.Printf("⚠ Command limit reached, further commands will be refused | SessionID: %s | Commands: %d", s.ID, count)
+		return
+	}
+	log.Printf("⚠ Command limit reached, ending session | SessionID: %s | Commands: %d", s.ID, count)
+	go func() {
+		if err := sessionManager.EndSession(s.ID, false); err == nil {
+			log.Printf("✓ Session ended at command limit | SessionID: %s", s.ID)
+		}
+	}()
+}
+
+// CommandsRemaining 会话还能执行的命令数, 未设置上限时返回 nil
+func (s *Session) CommandsRemaining() *int {
+	if s.maxCommands == 0 {
+		return nil
+	}
+	remaining := s.maxCommands - int(s.commandCount.Load())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
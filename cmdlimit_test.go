@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseCommandLimitAction(t *testing.T) {
+	for in, want := range map[string]CommandLimitAction{"": CommandLimitRefuse, "refuse": CommandLimitRefuse, "end": CommandLimitEnd} {
+		if got, err := parseCommandLimitAction(in); err != nil || got != want {
+			t.Errorf("parse %q = %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseCommandLimitAction("kill"); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
+
+func TestCommandLimitRefuse(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.MaxCommandsPerSession = 2 })
+	// 初始化命令不计入上限
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo init"}})
+	if _, status := ts.sessionStatus(aliceToken, id); status.CommandsRemaining == nil || *status.CommandsRemaining != 2 {
+		t.Fatalf("remaining after init = %v", status.CommandsRemaining)
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp, data := ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("command %d = %d %s", i+1, resp.StatusCode, data)
+		}
+	}
+	resp, data := ts.run(aliceToken, id, "echo hi", nil)
+	if resp.StatusCode != http.StatusConflict || errorCodeOf(t, data) != codeCommandLimit {
+		t.Fatalf("command past the limit = %d %s", resp.StatusCode, data)
+	}
+	// 会话保留, 状态中剩余 0 条
+	if _, status := ts.sessionStatus(aliceToken, id); status == nil || status.CommandsRemaining == nil || *status.CommandsRemaining != 0 {
+		t.Fatalf("status at limit = %+v", status)
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "command_limit" {
+		t.Fatalf("last event = %+v", last)
+	}
+}
+
+func TestCommandLimitEnd(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxCommandsPerSession = 1
+		cfg.CommandLimitAction = "end"
+	})
+	id := ts.startSession(aliceToken, nil)
+	// 达到上限的命令正常返回, 之后结束会话
+	if resp, data := ts.run(aliceToken, id, "echo last", nil); resp.StatusCode != http.StatusOK || string(data) != "last" {
+		t.Fatalf("last command = %d %q", resp.StatusCode, data)
+	}
+	waitFor(t, func() bool {
+		_, exists := sessionManager.GetSession(id)
+		return !exists
+	})
+	if resp, _ := ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("command after end = %d", resp.StatusCode)
+	}
+}
+
+func TestCommandLimitUnset(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	if _, status := ts.sessionStatus(aliceToken, id); status.CommandsRemaining != nil {
+		t.Fatalf("remaining without a limit = %d", *status.CommandsRemaining)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// coalesceCall 正在执行的合并命令, done 关闭后 result 和 err 可读
+type coalesceCall struct {
+	done   chan struct{}
+	result *CommandResult
+	err    error
+}
+
+// Coalescer 合并同一会话中同时执行的相同命令, 只执行一次, 所有请求共享结果
+// 只适用于幂等的只读命令, 由请求的 coalesce 参数开启
+type Coalescer struct {
+	calls map[string]*coalesceCall
+	mu    sync.Mutex
+
+	shared atomic.Int64
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalesceCall)}
+}
+
+// coalesceKey 由会话 ID、命令和影响输出的参数生成, 参数不同的请求不会合并
+func coalesceKey(sessionID, shell, command string, opts RunOptions) string {
+	data, _ := json.Marshal([]interface{}{sessionID, shell, command, opts.Timeout, opts.IdleTimeout, opts.Format, opts.JSONDepth, opts.StripANSI, opts.NormalizeNewlines, opts.StripBOM, opts.MaxLines, opts.Truncate, opts.ReportUsage, opts.ReportStatus, opts.EchoCommand, opts.EchoTimestamp, opts.MarkerChannel, opts.checkpoints != "", opts.probe, envKey(opts.env)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Do 执行 fn, 相同 key 的 fn 正在执行时等待并共享其结果, shared 表示结果来自其他请求
+// 每个调用方得到结果的副本
+func (c *Coalescer) Do(key string, fn func() (*CommandResult, error)) (result *CommandResult, shared bool, err error) {
+	c.mu.Lock()
+	call, exists := c.calls[key]
+	if !exists {
+		call = &coalesceCall{done: make(chan struct{})}
+		c.calls[key] = call
+	}
+	c.mu.Unlock()
+
+	if exists {
+		<-call.done
+		c.shared.Add(1)
+	} else {
+		call.result, call.err = fn()
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}
+
+	if call.result != nil {
+		r := *call.result
+		result = &r
+	}
+	return result, exists, call.err
+}
+
+// Shared 共享了其他请求结果的命令总数
+func (c *Coalescer) Shared() int64 {
+	return c.shared.Load()
+}
+
+var commandCoalescer *Coalescer
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesOneExecution(t *testing.T) {
+	c := NewCoalescer()
+	release := make(chan struct{})
+	var calls atomic.Int64
+	fn := func() (*CommandResult, error) {
+		calls.Add(1)
+		<-release
+		return &CommandResult{Output: "shared"}, nil
+	}
+
+	const n = 10
+	results := make(chan *CommandResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, _, err := c.Do("key", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result
+		}()
+	}
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return calls.Load() == 1 && len(c.calls) == 1
+	})
+	// 给其余调用方进入等待的时间
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	// 每个调用方得到各自的副本
+	seen := make(map[*CommandResult]bool)
+	for r := range results {
+		if r.Output != "shared" || seen[r] {
+			t.Fatalf("result %p %+v", r, r)
+		}
+		seen[r] = true
+	}
+	if calls.Load() != 1 || c.Shared() != n-1 {
+		t.Fatalf("calls %d, shared %d", calls.Load(), c.Shared())
+	}
+
+	// 执行结束后相同的 key 重新执行
+	if _, shared, _ := c.Do("key", func() (*CommandResult, error) { return &CommandResult{}, nil }); shared {
+		t.Fatal("finished call shared with a later one")
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	base := coalesceKey("s1", "", "Get-Date", RunOptions{})
+	if coalesceKey("s1", "", "Get-Date", RunOptions{}) != base {
+		t.Fatal("identical requests have different keys")
+	}
+	for name, key := range map[string]string{
+		"session": coalesceKey("s2", "", "Get-Date", RunOptions{}),
+		"shell":   coalesceKey("s1", "cmd", "Get-Date", RunOptions{}),
+		"command": coalesceKey("s1", "", "Get-Date -UFormat %s", RunOptions{}),
+		"timeout": coalesceKey("s1", "", "Get-Date", RunOptions{Timeout: time.Second}),
+		"format":  coalesceKey("s1", "", "Get-Date", RunOptions{Format: OutputJSON}),
+	} {
+		if key == base {
+			t.Errorf("different %s has the same key", name)
+		}
+	}
+}
+
+func TestCoalesceIdenticalCommands(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Status": {Output: "green", DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	const n = 5
+	var wg sync.WaitGroup
+	var ok atomic.Int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, data := ts.run(aliceToken, id, "Get-Status", map[string]any{"coalesce": true})
+			if resp.StatusCode == http.StatusOK && string(data) == "green" {
+				ok.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// 同时到达的相同命令只在 shell 中执行一次, 所有请求得到同样的输出
+	if ok.Load() != n {
+		t.Fatalf("%d of %d requests got the shared output", ok.Load(), n)
+	}
+	if count := s.commandCount.Load(); count != 1 {
+		t.Fatalf("shell executed the command %d times", count)
+	}
+	if shared := commandCoalescer.Shared(); shared != n-1 {
+		t.Fatalf("shared %d", shared)
+	}
+
+	// 不带 coalesce 的请求各自执行
+	ts.run(aliceToken, id, "echo a", nil)
+	ts.run(aliceToken, id, "echo a", nil)
+	if count := s.commandCount.Load(); count != 3 {
+		t.Fatalf("commands executed %d, want 3", count)
+	}
+}
+
+func TestCoalesceRejectsSideEffects(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	for _, extra := range []map[string]any{
+		{"coalesce": true, "record_init": true},
+		{"coalesce": true, "output_to_file": true},
+	} {
+		if resp, data := ts.run(aliceToken, id, "echo x", extra); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("run %v = %d %s", extra, resp.StatusCode, data)
+		}
+	}
+}
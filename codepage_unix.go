@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// systemCodePageDecoder 非 Windows 平台只支持内置的代码页
+func systemCodePageDecoder(codePage int) (codePageDecoder, bool) {
+	return nil, false
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"unicode/utf16"
+
+	"golang.org/x/sys/windows"
+)
+
+// systemCodePageDecoder 通过 MultiByteToWideChar 解码, 支持 936 等多字节代码页
+// 系统不支持该代码页时返回 false
+func systemCodePageDecoder(codePage int) (codePageDecoder, bool) {
+	probe := []byte("a")
+	if _, err := windows.MultiByteToWideChar(uint32(codePage), 0, &probe[0], 1, nil, 0); err != nil {
+		return nil, false
+	}
+
+	return func(b []byte) []byte {
+		n, err := windows.MultiByteToWideChar(uint32(codePage), 0, &b[0], int32(len(b)), nil, 0)
+		if err != nil || n == 0 {
+			return []byte("\uFFFD")
+		}
+		buf := make([]uint16, n)
+		n, err = windows.MultiByteToWideChar(uint32(codePage), 0, &b[0], int32(len(b)), &buf[0], n)
+		if err != nil {
+			return []byte("\uFFFD")
+		}
+		return []byte(string(utf16.Decode(buf[:n])))
+	}, true
+}
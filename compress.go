@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize 小于该大小的响应不压缩, 压缩收益抵不过开销
+const minCompressSize = 1024
+
+// acceptedEncoding 根据 Accept-Encoding 选择压缩方式, 优先 gzip, 都不支持时返回空
+func acceptedEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			// q=0 表示不接受
+			if q, err := strconv.ParseFloat(v, 64); err != nil || q == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"] || accepted["*"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressResponseWriter 先缓冲响应开头, 超过 minCompressSize 后才开始压缩
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	started  bool
+	cw       io.WriteCloser
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.started {
+		return w.write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= minCompressSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *compressResponseWriter) write(b []byte) (int, error) {
+	if w.cw != nil {
+		return w.cw.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start 决定是否压缩, 写出响应头和已缓冲的内容
+func (w *compressResponseWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	// 处理器已自行编码的响应原样输出
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.cw = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.cw, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	_, err := w.write(buf)
+	return err
+}
+
+// finish 写出剩余内容并结束压缩流
+func (w *compressResponseWriter) finish() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.cw != nil {
+		w.cw.Close()
+	}
+}
+
+// compressResponse 压缩中间件, 按 Accept-Encoding 使用 gzip 或 deflate 压缩响应
+// 整个响应写完后才结束压缩流, 不适用于需要边执行边输出的接口, 请求 NDJSON 流式输出时不压缩
+func compressResponse(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || acceptsNDJSON(r.Header.Get("Accept")) {
+			next(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.finish()
+		next(cw, r)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                      "",
+		"gzip":                  "gzip",
+		"deflate, gzip":         "gzip",
+		"deflate":               "deflate",
+		"gzip;q=0, deflate":     "deflate",
+		"GZIP; q=0.5":           "gzip",
+		"*":                     "gzip",
+		"br":                    "",
+		"gzip;q=0, deflate;q=0": "",
+	} {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+// runEncoded 以指定的 Accept-Encoding 执行命令, 返回未解压的响应
+func runEncoded(t *testing.T, ts *testServer, sessionID, command, encoding string) (*http.Response, []byte) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"session_id": sessionID, "command": command})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/run-command", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.Header.Set("Accept-Encoding", encoding)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestRunCommandCompressesLargeOutput(t *testing.T) {
+	large := strings.Repeat("compressible line of output\n", 1000)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"large": {Output: large}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	want := strings.TrimSuffix(large, "\n")
+
+	resp, data := runEncoded(t, ts, id, "large", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" || !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("headers = %v", resp.Header)
+	}
+	if len(data) >= len(want) {
+		t.Fatalf("compressed %d bytes to %d", len(want), len(data))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != want {
+		t.Fatalf("gzip body = %d bytes, %v", len(plain), err)
+	}
+	// 元数据响应头在压缩时保留
+	if resp.Header.Get("X-Exit-Code") != "0" {
+		t.Fatalf("X-Exit-Code = %q", resp.Header.Get("X-Exit-Code"))
+	}
+
+	resp, data = runEncoded(t, ts, id, "large", "deflate")
+	if resp.Header.Get("Content-Encoding") != "deflate" {
+		t.Fatalf("deflate headers = %v", resp.Header)
+	}
+	if plain, err := io.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil || string(plain) != want {
+		t.Fatalf("deflate body = %d bytes, %v", len(plain), err)
+	}
+}
+
+func TestRunCommandSkipsCompressionForSmallOutput(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := runEncoded(t, ts, id, "echo small", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || string(data) != "small" {
+		t.Fatalf("small output = %q, Content-Encoding %q", data, resp.Header.Get("Content-Encoding"))
+	}
+	resp, data = runEncoded(t, ts, id, "echo small", "identity")
+	if resp.Header.Get("Content-Encoding") != "" || string(data) != "small" {
+		t.Fatalf("identity output = %q", data)
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config 服务配置, 可通过 -config 指定 JSON 文件覆盖默认值
+type Config struct {
+	// Addr TCP 监听地址, 为空时不监听 TCP
+	Addr string `json:"addr"`
+	// InstanceID 本实例的标识, 多实例部署时用于会话亲和, 为空时不启用
+	InstanceID string `json:"instance_id"`
+	// WorkingDir 新会话默认的工作目录, 为空时使用服务进程的当前目录
+	WorkingDir string `json:"working_dir"`
+	// UnixSocket Unix 域套接字的路径, 为空时不监听
+	UnixSocket string `json:"unix_socket"`
+	// UnixSocketMode 套接字文件的权限, 八进制字符串
+	UnixSocketMode string `json:"unix_socket_mode"`
+	// Listeners 额外的监听, 各自设置 TLS 和提供的接口
+	Listeners []ListenerConfig `json:"listeners"`
+	// ReadHeaderTimeout 读取请求头的超时
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	// ReadTimeout 读取整个请求(包括请求体)的超时
+	ReadTimeout Duration `json:"read_timeout"`
+	// WriteTimeout 每次写出响应的超时, 不包括等待命令执行的时间
+	WriteTimeout Duration `json:"write_timeout"`
+	// IdleTimeout keep-alive 连接的空闲超时
+	IdleTimeout Duration `json:"idle_timeout"`
+	// TCPKeepAlive TCP keep-alive 探测间隔, 0 表示关闭
+	TCPKeepAlive Duration `json:"tcp_keep_alive"`
+	// MaxConnections 所有监听上同时打开的连接数上限, 超过时新连接被立即关闭, 0 表示不限制
+	MaxConnections int `json:"max_connections"`
+	// MaxHeaderBytes 请求头(包括请求行)的大小上限(字节), 超过时返回 431
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	// ReadBufferSize 读取命令输出时的缓冲区大小(字节)
+	ReadBufferSize int `json:"read_buffer_size"`
+	// CommandTimeout 单条命令的最长执行时间, 0 表示不限制
+	CommandTimeout Duration `json:"command_timeout"`
+	// OutputIdleTimeout 命令连续没有输出的最长时间, 同时是请求 idle_timeout_ms 的上限, 0 表示不限制
+	OutputIdleTimeout Duration `json:"output_idle_timeout"`
+	// SessionQueueTimeout 会话忙时命令排队等待的最长时间, 同时是请求 queue_timeout_ms 的上限, 0 表示不限制
+	SessionQueueTimeout Duration `json:"session_queue_timeout"`
+	// ReadyTimeout 创建会话时等待 shell 执行完初始化、可以接受命令的最长时间, 0 表示不等待
+	ReadyTimeout Duration `json:"ready_timeout"`
+	// LateOutputDrain 读到结束标记后继续丢弃输出, 直到连续该时长没有输出, 0 表示不等待
+	LateOutputDrain Duration `json:"late_output_drain"`
+	// CommandTemplate 包装每条命令的模板, 必须包含 {{command}} 占位符, 为空时不包装
+	CommandTemplate string `json:"command_template"`
+	// Shells shell 预设, 与内置预设合并, 同名时覆盖内置预设
+	Shells map[string]*ShellPreset `json:"shells"`
+	// DefaultShell 未指定 shell 时使用的预设
+	DefaultShell string `json:"default_shell"`
+	// ShellOverrides 允许在执行命令时通过 shell 参数指定的预设, 为空时不允许
+	ShellOverrides []string `json:"shell_overrides"`
+	// NoExec 不启动任何 shell 进程, 会话由回应固定输出的模拟 shell 处理, 用于测试客户端集成和 HTTP 层
+	NoExec bool `json:"no_exec"`
+	// FakeOutputs no_exec 时各命令的固定输出和退出码, 键为命令文本
+	FakeOutputs map[string]FakeOutput `json:"fake_outputs"`
+	// JSONDepth JSON 输出模式默认的 ConvertTo-Json 序列化深度
+	JSONDepth int `json:"json_depth"`
+	// StripANSI 默认去除命令输出中的 ANSI 转义序列, 可被单条命令的 strip_ansi 覆盖
+	StripANSI bool `json:"strip_ansi"`
+	// NormalizeNewlines 默认将命令输出中的 CRLF 转换为 LF, 可被单条命令的 normalize_newlines 覆盖
+	NormalizeNewlines bool `json:"normalize_newlines"`
+	// StripBOM 默认去除命令输出开头的 UTF-8 BOM, 可被单条命令的 strip_bom 覆盖
+	StripBOM bool `json:"strip_bom"`
+	// OutputPipeline 命令输出依次经过的处理器, strip_ansi 等开关决定对应的处理器是否启用
+	OutputPipeline []OutputProcessorConfig `json:"output_pipeline"`
+	// OutputRateLimit 命令输出速率上限(字节/秒), 一个 output_rate_window 内超过时中止命令并重启 shell, 0 表示不检查
+	OutputRateLimit int `json:"output_rate_limit"`
+	// OutputRateWindow 统计输出速率的窗口
+	OutputRateWindow Duration `json:"output_rate_window"`
+	// SpoolThreshold 文本输出超过该字节数时转存到临时文件, 响应只包含开头的预览和下载信息, 0 表示不转存
+	SpoolThreshold int `json:"spool_threshold"`
+	// StreamHeartbeatInterval 流式输出超过该时长没有输出时发送 heartbeat 帧, 0 表示不发送
+	StreamHeartbeatInterval Duration `json:"stream_heartbeat_interval"`
+	// StreamMinFlushBytes 流式输出暂存达到该字节数才写出, 与 StreamMaxFlushDelay 先到者为准, 0 表示读到即写出
+	StreamMinFlushBytes int `json:"stream_min_flush_bytes"`
+	// StreamMaxFlushDelay 暂存的输出不足 stream_min_flush_bytes 时最多等待的时间
+	StreamMaxFlushDelay Duration `json:"stream_max_flush_delay"`
+	// TruncationNotice 输出被截断时附加在文本输出末尾的提示, {{reason}} 替换为截断原因, 为空时不附加
+	TruncationNotice string `json:"truncation_notice"`
+	// EmptyOutput 命令没有输出时的响应方式: text(默认) 返回空的响应体, json 返回 JSON 结果
+	EmptyOutput string `json:"empty_output"`
+	// ForwardHeaders 转发为命令环境变量的请求头, 键为请求头名称, 值为环境变量名, 只在命令执行期间设置
+	ForwardHeaders map[string]string `json:"forward_headers"`
+	// PlainTextRendering 启动 PowerShell 会话后设置 $PSStyle.OutputRendering = 'PlainText'
+	PlainTextRendering bool `json:"plain_text_rendering"`
+	// MaxConcurrentCommands 整个服务同时执行的命令数上限, 0 表示不限制
+	MaxConcurrentCommands int `json:"max_concurrent_commands"`
+	// CommandQueueTimeout 达到上限时命令排队等待的最长时间, 0 表示立即返回 429
+	CommandQueueTimeout Duration `json:"command_queue_timeout"`
+	// MaxConcurrentSpawns 同时启动 shell 进程的会话数上限, 与会话总数无关, 0 表示不限制
+	MaxConcurrentSpawns int `json:"max_concurrent_spawns"`
+	// SpawnQueueTimeout 达到上限时创建会话排队等待的最长时间, 0 表示立即返回 429
+	SpawnQueueTimeout Duration `json:"spawn_queue_timeout"`
+	// SessionTailSize 每个会话保留的最近 stdout 字节数, 供 /session-tail 查看, 0 表示不保留
+	SessionTailSize int `json:"session_tail_size"`
+	// SelfTest 启动时在默认 shell 中执行 canary 命令检查输出, 失败时服务不启动
+	SelfTest bool `json:"self_test"`
+	// SelfTestTimeout 自检命令的超时
+	SelfTestTimeout Duration `json:"self_test_timeout"`
+	// StderrHandling shell stderr 的处理方式: discard(默认)、log 或 tail, stderr 始终被持续读取
+	StderrHandling StderrHandling `json:"stderr_handling"`
+	// MaxQueueDepth 整个服务同时处理的执行类请求数上限(包括排队和未完成的异步任务), 超过时返回 503, 0 表示不限制
+	MaxQueueDepth int `json:"max_queue_depth"`
+	// RetryAfter 因 max_queue_depth 拒绝请求时 Retry-After 响应头建议的等待时间
+	RetryAfter Duration `json:"retry_after"`
+	// MaxTotalMemoryMB 所有会话进程树的内存占用之和上限(MB), 超过时新会话和新命令返回 503, 0 表示不限制
+	MaxTotalMemoryMB int `json:"max_total_memory_mb"`
+	// MemorySampleInterval 统计所有会话内存占用的间隔
+	MemorySampleInterval Duration `json:"memory_sample_interval"`
+	// MemoryReapIdle 超过 max_total_memory_mb 时按最近使用时间从早到晚结束空闲会话, 直到低于上限
+	MemoryReapIdle bool `json:"memory_reap_idle"`
+	// MaxBlockedReads 整个服务同时等待 shell 输出的命令数上限, 达到上限时新命令返回 503, 0 表示不限制
+	MaxBlockedReads int `json:"max_blocked_reads"`
+	// SessionIdleTimeout 会话空闲超过该时间后被结束, 0 表示不结束
+	SessionIdleTimeout Duration `json:"session_idle_timeout"`
+	// IdleWarning 会话空闲达到该时间时发出一次警告, 0 表示 session_idle_timeout 的 80%
+	IdleWarning Duration `json:"idle_warning"`
+	// LogCommands 记录每条命令的执行过程和输出, 为 false 时只记录失败和慢命令
+	LogCommands bool `json:"log_commands"`
+	// SlowCommandThreshold 执行时间达到该值的命令记录警告日志, 0 表示不记录
+	SlowCommandThreshold Duration `json:"slow_command_threshold"`
+	// SlowCommandMaxLength 慢命令日志中命令文本的最大长度(字节), 0 表示不截断
+	SlowCommandMaxLength int `json:"slow_command_max_length"`
+	// MaxCommandsPerSession 每个会话最多执行的命令数, 0 表示不限制
+	MaxCommandsPerSession int `json:"max_commands_per_session"`
+	// CommandLimitAction 达到 max_commands_per_session 后的处理: refuse(默认) 拒绝之后的命令, end 结束会话
+	CommandLimitAction string `json:"command_limit_action"`
+	// RecycleAfterErrors 会话连续出错(超时、读写 shell 失败)的命令数达到该值时回收会话, 0 表示不回收
+	RecycleAfterErrors int `json:"recycle_after_errors"`
+	// RecycleAction 回收会话的方式: restart(默认) 重启 shell, end 结束会话
+	RecycleAction string `json:"recycle_action"`
+	// EndGracePeriod 结束会话时等待 shell 执行 exit 退出的时间, 0 表示直接结束
+	EndGracePeriod Duration `json:"end_grace_period"`
+	// InheritEnv shell 进程继承服务进程环境变量的方式: full(默认) 继承全部, clean 只继承 EnvAllowlist 中的变量
+	InheritEnv string `json:"inherit_env"`
+	// EnvAllowlist clean 模式下继承的变量名, 以 * 结尾时按前缀匹配, 未设置时使用内置的列表, 为 [] 时不继承任何变量
+	EnvAllowlist []string `json:"env_allowlist"`
+	// Priority 会话 shell 的默认优先级, 也是会话可以使用的最高优先级: normal(默认)、below_normal 或 idle
+	Priority ProcessPriority `json:"priority"`
+	// LogSessionIDs 运行日志中会话 ID 的记录方式: full(默认) 记录完整 ID, hashed 只记录哈希的前 12 位, 审计日志不受影响
+	LogSessionIDs string `json:"log_session_ids"`
+	// WebUI 在 /ui/ 提供手动执行命令的调试页面, 需要管理员令牌
+	WebUI bool `json:"web_ui"`
+	// TranscriptDir 会话记录文件所在目录
+	TranscriptDir string `json:"transcript_dir"`
+	// TranscriptRetention 会话结束后记录文件的保留时间, 0 表示立即删除
+	TranscriptRetention Duration `json:"transcript_retention"`
+	// ArchiveDir 设置后把每条命令的完整输出和元数据写入该目录, 为空时不归档
+	ArchiveDir string `json:"archive_dir"`
+	// ArchiveRetention 归档输出的保留时间, 0 表示不删除
+	ArchiveRetention Duration `json:"archive_retention"`
+	// IdempotencyTTL Idempotency-Key 在首次请求之后的保留时间, 过期后同一个键按新请求处理
+	IdempotencyTTL Duration `json:"idempotency_ttl"`
+	// ScriptsDir 可按名称执行的脚本所在目录, 为空时不允许执行脚本
+	ScriptsDir string `json:"scripts_dir"`
+	// UploadDir 接收上传文件的目录, 为空时不提供上传接口
+	UploadDir string `json:"upload_dir"`
+	// MaxUploadSize 单个上传文件的大小上限(字节), 0 表示不限制
+	MaxUploadSize int64 `json:"max_upload_size"`
+	// Templates 可按名称调用的命令模板
+	Templates map[string]*CommandTemplate `json:"templates"`
+	// TemplatesOnly 只允许执行模板和脚本, 拒绝自由格式的 command
+	TemplatesOnly bool `json:"templates_only"`
+	// JSONRPC 启用 /rpc JSON-RPC 2.0 接口
+	JSONRPC bool `json:"jsonrpc"`
+	// AuditLog 审计日志文件路径, 为空时不记录
+	AuditLog string `json:"audit_log"`
+	// AuditLogKey 审计日志哈希链的 HMAC 密钥, 为空时使用普通 SHA-256
+	AuditLogKey string `json:"audit_log_key"`
+	// Webhook 事件通知, 为空时不发送
+	Webhook *WebhookConfig `json:"webhook"`
+	// TLS 设置后以 HTTPS 提供服务, 可要求客户端证书
+	TLS *TLSConfig `json:"tls"`
+	// AuthMode 认证方式: token(默认)、cert、any 或 both, 使用证书时需要开启 tls.client_auth
+	AuthMode AuthMode `json:"auth_mode"`
+	// CertAdmins 作为管理员的客户端证书身份(CN 或 SAN)
+	CertAdmins []string `json:"cert_admins"`
+	// MaxSessionsPerToken 每个令牌同时持有的会话数上限, 0 表示不限制, 可被令牌的 max_sessions 覆盖
+	MaxSessionsPerToken int `json:"max_sessions_per_token"`
+	// Tokens 访问令牌, 与 JWT 都未配置时不启用认证
+	Tokens []TokenConfig `json:"tokens"`
+	// JWT 设置后 Bearer Token 也可以是 JWKS 中的密钥签发的 JWT, 以 sub 作为租户
+	JWT *JWTConfig `json:"jwt"`
+	// SignatureSkew 签名请求的时间戳与服务端时间允许的偏差, 也是签名防重放的时间窗口
+	SignatureSkew Duration `json:"signature_skew"`
+}
+
+// TokenConfig 访问令牌配置, Name 作为租户标识
+type TokenConfig struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// SigningSecret 设置后可以用 HMAC 签名代替 Bearer Token, 与 Token 至少设置一个
+	SigningSecret string `json:"signing_secret"`
+	// Admin 管理员令牌可以操作所有租户的会话
+	Admin bool `json:"admin"`
+	// MaxSessions 该令牌同时持有的会话数上限, 0 表示不限制, 未设置时使用 max_sessions_per_token
+	MaxSessions *int `json:"max_sessions"`
+}
+
+// DefaultConfig 返回默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:                 ":8833",
+		UnixSocketMode:       defaultUnixSocketMode,
+		SessionTailSize:      defaultSessionTailSize,
+		ReadHeaderTimeout:    Duration(defaultReadHeaderTimeout),
+		MaxHeaderBytes:       defaultMaxHeaderBytes,
+		ReadTimeout:          Duration(defaultReadTimeout),
+		WriteTimeout:         Duration(defaultWriteTimeout),
+		IdleTimeout:          Duration(defaultIdleTimeout),
+		TCPKeepAlive:         Duration(defaultTCPKeepAlive),
+		ReadBufferSize:       defaultReadBufferSize,
+		CommandTimeout:       Duration(defaultCommandTimeout),
+		StripBOM:             true,
+		Shells:               defaultShellPresets(),
+		DefaultShell:         defaultShell,
+		JSONDepth:            defaultJSONDepth,
+		OutputPipeline:       defaultOutputPipeline(),
+		OutputRateWindow:     Duration(defaultOutputRateWindow),
+		EndGracePeriod:       Duration(defaultEndGracePeriod),
+		RetryAfter:           Duration(defaultRetryAfter),
+		AuthMode:             AuthToken,
+		SignatureSkew:        Duration(defaultSignatureSkew),
+		LogCommands:          true,
+		TranscriptDir:        filepath.Join(os.TempDir(), "remote-command-executor", "transcripts"),
+		ArchiveRetention:     Duration(defaultArchiveRetention),
+		IdempotencyTTL:       Duration(defaultIdempotencyTTL),
+		SelfTestTimeout:      Duration(defaultSelfTestTimeout),
+		SpawnQueueTimeout:    Duration(defaultSpawnQueueTimeout),
+		ReadyTimeout:         Duration(defaultReadyTimeout),
+		MemorySampleInterval: Duration(defaultMemorySampleInterval),
+		TruncationNotice:     defaultTruncationNotice,
+		StreamMaxFlushDelay:  Duration(defaultStreamMaxFlushDelay),
+	}
+}
+
+// LoadConfig 加载配置文件, path 为空时使用默认配置
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate 检查配置是否合法
+func (c *Config) Validate() error {
+	if c.Addr == "" && c.UnixSocket == "" && len(c.Listeners) == 0 {
+		return fmt.Errorf("addr, unix_socket or listeners is required")
+	}
+	for i := range c.Listeners {
+		if err := c.Listeners[i].validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %v", i, err)
+		}
+	}
+	if _, err := c.unixSocketMode(); err != nil {
+		return err
+	}
+	if c.InstanceID != "" && !validInstanceID(c.InstanceID) {
+		return fmt.Errorf("instance_id must be at most %d letters, digits or -_.", maxRequestIDLength)
+	}
+	if c.WorkingDir != "" {
+		if err := checkDir(c.WorkingDir); err != nil {
+			return fmt.Errorf("working_dir: %v", err)
+		}
+	}
+	if c.ReadBufferSize <= 0 {
+		return fmt.Errorf("read_buffer_size must be positive")
+	}
+	if c.CommandTemplate != "" && !strings.Contains(c.CommandTemplate, commandPlaceholder) {
+		return fmt.Errorf("command_template must contain %s", commandPlaceholder)
+	}
+	for name, shell := range c.Shells {
+		if shell == nil {
+			return fmt.Errorf("shell %s: preset is empty", name)
+		}
+		if err := shell.validate(); err != nil {
+			return fmt.Errorf("shell %s: %v", name, err)
+		}
+	}
+	if _, ok := c.Shells[c.DefaultShell]; !ok {
+		return fmt.Errorf("default_shell %q is not a configured shell", c.DefaultShell)
+	}
+	if err := validateShellOverrides(c.ShellOverrides, c.Shells); err != nil {
+		return err
+	}
+	if err := validateOutputPipeline(c.OutputPipeline); err != nil {
+		return err
+	}
+	if c.JSONDepth <= 0 || c.JSONDepth > maxJSONDepth {
+		return fmt.Errorf("json_depth must be between 1 and %d", maxJSONDepth)
+	}
+	if c.CommandTimeout < 0 {
+		return fmt.Errorf("command_timeout must not be negative")
+	}
+	if c.OutputIdleTimeout < 0 {
+		return fmt.Errorf("output_idle_timeout must not be negative")
+	}
+	if c.SessionQueueTimeout < 0 {
+		return fmt.Errorf("session_queue_timeout must not be negative")
+	}
+	if c.LateOutputDrain < 0 || time.Duration(c.LateOutputDrain) > maxLateOutputDrain {
+		return fmt.Errorf("late_output_drain must be between 0 and %s", maxLateOutputDrain)
+	}
+	if c.ReadyTimeout < 0 {
+		return fmt.Errorf("ready_timeout must not be negative")
+	}
+	if c.MaxConcurrentCommands < 0 {
+		return fmt.Errorf("max_concurrent_commands must not be negative")
+	}
+	if c.MaxConcurrentSpawns < 0 {
+		return fmt.Errorf("max_concurrent_spawns must not be negative")
+	}
+	if c.SpawnQueueTimeout < 0 {
+		return fmt.Errorf("spawn_queue_timeout must not be negative")
+	}
+	if c.OutputRateLimit < 0 {
+		return fmt.Errorf("output_rate_limit must not be negative")
+	}
+	if c.OutputRateWindow <= 0 {
+		return fmt.Errorf("output_rate_window must be positive")
+	}
+	if c.SpoolThreshold < 0 || c.SpoolThreshold > maxOutputSize {
+		return fmt.Errorf("spool_threshold must be between 0 and %d", maxOutputSize)
+	}
+	if c.StreamHeartbeatInterval < 0 {
+		return fmt.Errorf("stream_heartbeat_interval must not be negative")
+	}
+	if c.StreamMinFlushBytes < 0 || c.StreamMinFlushBytes > maxOutputSize {
+		return fmt.Errorf("stream_min_flush_bytes must be between 0 and %d", maxOutputSize)
+	}
+	if c.StreamMinFlushBytes > 0 && c.StreamMaxFlushDelay <= 0 {
+		return fmt.Errorf("stream_max_flush_delay must be positive when stream_min_flush_bytes is set")
+	}
+	if err := validateTruncationNotice(c.TruncationNotice); err != nil {
+		return err
+	}
+	mode, err := parseEmptyOutputMode(c.EmptyOutput, EmptyOutputText)
+	if err != nil {
+		return err
+	}
+	c.EmptyOutput = string(mode)
+	if err := validateForwardHeaders(c.ForwardHeaders); err != nil {
+		return err
+	}
+	if c.SessionTailSize < 0 {
+		return fmt.Errorf("session_tail_size must not be negative")
+	}
+	if c.SelfTestTimeout <= 0 {
+		return fmt.Errorf("self_test_timeout must be positive")
+	}
+	handling, err := parseStderrHandling(c.StderrHandling)
+	if err != nil {
+		return err
+	}
+	if handling == StderrTail && c.SessionTailSize == 0 {
+		return fmt.Errorf("stderr_handling %s requires session_tail_size", StderrTail)
+	}
+	c.StderrHandling = handling
+	if c.MaxQueueDepth < 0 {
+		return fmt.Errorf("max_queue_depth must not be negative")
+	}
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("retry_after must not be negative")
+	}
+	if c.MaxTotalMemoryMB < 0 {
+		return fmt.Errorf("max_total_memory_mb must not be negative")
+	}
+	if c.MemorySampleInterval <= 0 {
+		return fmt.Errorf("memory_sample_interval must be positive")
+	}
+	if c.MaxBlockedReads < 0 {
+		return fmt.Errorf("max_blocked_reads must not be negative")
+	}
+	if c.CommandQueueTimeout < 0 {
+		return fmt.Errorf("command_queue_timeout must not be negative")
+	}
+	if c.SessionIdleTimeout < 0 || c.IdleWarning < 0 {
+		return fmt.Errorf("session_idle_timeout and idle_warning must not be negative")
+	}
+	if c.IdleWarning > 0 && c.IdleWarning >= c.SessionIdleTimeout {
+		return fmt.Errorf("idle_warning must be shorter than session_idle_timeout")
+	}
+	if c.SlowCommandThreshold < 0 || c.SlowCommandMaxLength < 0 {
+		return fmt.Errorf("slow_command_threshold and slow_command_max_length must not be negative")
+	}
+	if c.MaxCommandsPerSession < 0 {
+		return fmt.Errorf("max_commands_per_session must not be negative")
+	}
+	inherit, err := parseEnvInheritance(c.InheritEnv)
+	if err != nil {
+		return err
+	}
+	c.InheritEnv = string(inherit)
+	if err := validateEnvAllowlist(c.EnvAllowlist); err != nil {
+		return err
+	}
+	logIDs, err := parseLogSessionIDs(c.LogSessionIDs)
+	if err != nil {
+		return err
+	}
+	c.LogSessionIDs = string(logIDs)
+	priority, err := parsePriority(c.Priority, PriorityNormal)
+	if err != nil {
+		return err
+	}
+	c.Priority = priority
+	action, err := parseCommandLimitAction(c.CommandLimitAction)
+	if err != nil {
+		return err
+	}
+	c.CommandLimitAction = string(action)
+	if c.RecycleAfterErrors < 0 {
+		return fmt.Errorf("recycle_after_errors must not be negative")
+	}
+	recycle, err := parseRecycleAction(c.RecycleAction)
+	if err != nil {
+		return err
+	}
+	c.RecycleAction = string(recycle)
+	if c.EndGracePeriod < 0 {
+		return fmt.Errorf("end_grace_period must not be negative")
+	}
+	if c.TranscriptDir == "" {
+		return fmt.Errorf("transcript_dir is required")
+	}
+	if c.TranscriptRetention < 0 {
+		return fmt.Errorf("transcript_retention must not be negative")
+	}
+	if c.ArchiveRetention < 0 {
+		return fmt.Errorf("archive_retention must not be negative")
+	}
+	if c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency_ttl must be positive")
+	}
+	if c.UploadDir != "" {
+		if err := checkDir(c.UploadDir); err != nil {
+			return fmt.Errorf("upload_dir: %v", err)
+		}
+	}
+	if c.MaxUploadSize < 0 {
+		return fmt.Errorf("max_upload_size must not be negative")
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.TCPKeepAlive < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+	if len(c.FakeOutputs) > 0 && !c.NoExec {
+		return fmt.Errorf("fake_outputs requires no_exec")
+	}
+	for command, out := range c.FakeOutputs {
+		if out.DelayMs < 0 {
+			return fmt.Errorf("fake_outputs[%q]: delay_ms must not be negative", command)
+		}
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("max_header_bytes must be positive")
+	}
+	if c.Webhook != nil {
+		if err := c.Webhook.validate(); err != nil {
+			return err
+		}
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return err
+		}
+	}
+	if c.JWT != nil {
+		if err := c.JWT.validate(); err != nil {
+			return err
+		}
+	}
+	switch c.AuthMode {
+	case "", AuthToken:
+	case AuthCert, AuthAny, AuthBoth:
+		if !c.verifiesClients() {
+			return fmt.Errorf("auth_mode %s requires tls.client_auth optional or require", c.AuthMode)
+		}
+		if c.AuthMode == AuthBoth && len(c.Tokens) == 0 && c.JWT == nil {
+			return fmt.Errorf("auth_mode both requires tokens or jwt")
+		}
+	default:
+		return fmt.Errorf("unknown auth_mode %q", c.AuthMode)
+	}
+	for name, tmpl := range c.Templates {
+		if tmpl == nil {
+			return fmt.Errorf("template %s: definition is empty", name)
+		}
+		if err := tmpl.validate(); err != nil {
+			return fmt.Errorf("template %s: %v", name, err)
+		}
+	}
+	if c.SignatureSkew <= 0 {
+		return fmt.Errorf("signature_skew must be positive")
+	}
+	if c.MaxSessionsPerToken < 0 {
+		return fmt.Errorf("max_sessions_per_token must not be negative")
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Tokens {
+		if t.Name == "" || (t.Token == "" && t.SigningSecret == "") {
+			return fmt.Errorf("token name and token (or signing_secret) are required")
+		}
+		if strings.HasPrefix(t.Name, certIdentityPrefix) {
+			return fmt.Errorf("token %s: name must not start with %q, reserved for client certificates", t.Name, certIdentityPrefix)
+		}
+		if strings.HasPrefix(t.Name, jwtIdentityPrefix) {
+			return fmt.Errorf("token %s: name must not start with %q, reserved for JWT subjects", t.Name, jwtIdentityPrefix)
+		}
+		if t.MaxSessions != nil && *t.MaxSessions < 0 {
+			return fmt.Errorf("token %s: max_sessions must not be negative", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate token name: %s", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// sessionQuotas 返回单独设置了会话数上限的令牌
+func (c *Config) sessionQuotas() map[string]int {
+	quotas := make(map[string]int)
+	for _, t := range c.Tokens {
+		if t.MaxSessions != nil {
+			quotas[t.Name] = *t.MaxSessions
+		}
+	}
+	return quotas
+}
+
+// Duration 以 "30s", "5m" 形式在 JSON 中表示的时长
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: expected a string like \"30s\"", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// checkDir 检查 path 是已存在的目录
+func checkDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
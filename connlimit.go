@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connRejectLogInterval 连接数达到上限时两条拒绝日志之间的最短间隔, 避免连接洪泛刷满日志
+const connRejectLogInterval = 10 * time.Second
+
+// ConnLimiter 限制所有监听上同时打开的连接数, 与 max_concurrent_commands 无关, 保护 HTTP 层本身
+type ConnLimiter struct {
+	// limit 上限, 0 表示不限制
+	limit    int64
+	open     atomic.Int64
+	rejected atomic.Int64
+	// lastLog 上次记录拒绝日志的时间(UnixNano)
+	lastLog atomic.Int64
+}
+
+func NewConnLimiter(limit int) *ConnLimiter {
+	return &ConnLimiter{limit: int64(limit)}
+}
+
+// wrap 返回受 l 限制的监听, 多个监听共用同一个上限
+// 不限制时原样返回, 连接保持原来的类型, 不影响 sendfile 等优化
+func (l *ConnLimiter) wrap(ln net.Listener) net.Listener {
+	if l.limit == 0 {
+		return ln
+	}
+	return &limitListener{Listener: ln, limiter: l}
+}
+
+// Open 当前打开的连接数, 不限制时不统计
+func (l *ConnLimiter) Open() int64 {
+	return l.open.Load()
+}
+
+// Rejected 因达到上限被关闭的连接总数
+func (l *ConnLimiter) Rejected() int64 {
+	return l.rejected.Load()
+}
+
+// acquire 占用一个连接名额, 已达到上限时返回 false
+func (l *ConnLimiter) acquire() bool {
+	if n := l.open.Add(1); l.limit > 0 && n > l.limit {
+		l.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+// reject 记录一次拒绝, 日志按 connRejectLogInterval 限速
+func (l *ConnLimiter) reject(remote net.Addr) {
+	total := l.rejected.Add(1)
+	now := time.Now().UnixNano()
+	last := l.lastLog.Load()
+	if now-last < int64(connRejectLogInterval) || !l.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+	log.Printf("⚠ Connection limit reached, closing new connections | Limit: %d | Remote: %s | Rejected total: %d", l.limit, remote, total)
+}
+
+// limitListener 连接数达到上限时接受后立即关闭新连接, 客户端看到连接被重置, 而不是在队列中等待
+type limitListener struct {
+	net.Listener
+	limiter *ConnLimiter
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ln.limiter.acquire() {
+			return &limitConn{Conn: conn, limiter: ln.limiter}, nil
+		}
+		ln.limiter.reject(conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// limitConn 关闭时归还连接名额
+type limitConn struct {
+	net.Conn
+	limiter *ConnLimiter
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.limiter.open.Add(-1) })
+	return err
+}
+
+var connLimiter *ConnLimiter
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptAll 在后台接受 ln 上的连接, 接受到的连接发送到返回的 channel
+func acceptAll(t *testing.T, ln net.Listener) <-chan net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return accepted
+}
+
+// dialClosed 连接 addr, 返回服务端是否立即关闭了连接
+func dialClosed(t *testing.T, addr string) (net.Conn, bool) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	timedOut := err != nil && errors.As(err, &netErr) && netErr.Timeout()
+	return conn, !timedOut
+}
+
+func TestConnLimiter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不限制时原样返回
+	if NewConnLimiter(0).wrap(ln) != ln {
+		t.Fatal("unlimited listener wrapped")
+	}
+
+	limiter := NewConnLimiter(1)
+	accepted := acceptAll(t, limiter.wrap(ln))
+	if _, closed := dialClosed(t, ln.Addr().String()); closed {
+		t.Fatal("first connection closed")
+	}
+	first := <-accepted
+
+	// 达到上限后新连接被立即关闭, 不在队列中等待
+	if _, closed := dialClosed(t, ln.Addr().String()); !closed {
+		t.Fatal("connection over the limit not closed")
+	}
+	waitFor(t, func() bool { return limiter.Rejected() == 1 })
+	if limiter.Open() != 1 {
+		t.Fatalf("open = %d", limiter.Open())
+	}
+
+	// 关闭连接后归还名额, 重复关闭只归还一次
+	first.Close()
+	first.Close()
+	if limiter.Open() != 0 {
+		t.Fatalf("open after close = %d", limiter.Open())
+	}
+	if _, closed := dialClosed(t, ln.Addr().String()); closed {
+		t.Fatal("connection after release closed")
+	}
+	<-accepted
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxHeaderBytes = 1024
+	})
+	mux := http.NewServeMux()
+	registerRoutes(mux, ts.cfg)
+	srv, err := newServer(ts.cfg, mux, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	// net/http 在上限之外留有少量余量
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("oversized header = %d", resp.StatusCode)
+	}
+
+	for _, configure := range []func(*Config){
+		func(cfg *Config) { cfg.MaxConnections = -1 },
+		func(cfg *Config) { cfg.MaxHeaderBytes = 0 },
+	} {
+		cfg := DefaultConfig()
+		configure(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("invalid config accepted: max_connections %d, max_header_bytes %d", cfg.MaxConnections, cfg.MaxHeaderBytes)
+		}
+	}
+}
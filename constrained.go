@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LanguageMode PowerShell 会话执行命令的语言模式
+type LanguageMode string
+
+const (
+	// LanguageFull 完整语言模式, 默认
+	LanguageFull LanguageMode = "full"
+	// LanguageConstrained 命令在受限语言模式(ConstrainedLanguage)的 runspace 中执行
+	LanguageConstrained LanguageMode = "constrained"
+)
+
+// errSubShellConstrained 子 shell 的 runspace 不受限, 受限会话中不能打开
+var errSubShellConstrained = errors.New("sub-shells are not available in constrained language sessions")
+
+// psCreateConstrained 在 shell 中创建受限语言模式的 runspace, 所有命令都在其中执行
+// 语言模式在创建 runspace 时通过 InitialSessionState 设置, 而不是在命令中修改 $ExecutionContext,
+// runspace 中的代码只能进一步降低而不能提升语言模式; 外层 shell 仍为完整语言模式, 只执行服务端生成的包装语句
+// 不关联宿主, Read-Host 等交互命令直接失败而不会等待输入, Write-Host 的输出进入 Information 流
+const psCreateConstrained = "$__rceIss = [initialsessionstate]::CreateDefault(); $__rceIss.LanguageMode = 'ConstrainedLanguage'; " +
+	"$global:__rceCL = [powershell]::Create(); $global:__rceCL.Runspace = [runspacefactory]::CreateRunspace($__rceIss); $global:__rceCL.Runspace.Open()"
+
+// psConstrainedPlainText 关闭受限 runspace 的彩色输出, 在外层设置, 受限模式不允许修改 $PSStyle 的属性
+const psConstrainedPlainText = "$__rceStyle = $global:__rceCL.Runspace.SessionStateProxy.GetVariable('PSStyle'); " +
+	"if ($__rceStyle) { $__rceStyle.OutputRendering = 'PlainText' }"
+
+// psConstrainedInvoke 在受限 runspace 中执行 $__rceSrc, 逐个输出结果对象, 结束后取回 $LASTEXITCODE
+// 所有输出流在 runspace 中合并, 取回 $LASTEXITCODE 后重新抛出 runspace 中的终止错误
+const psConstrainedInvoke = "& { $__cl = $global:__rceCL; [void]$__cl.Commands.Clear(); " +
+	"[void]$__cl.AddScript(\"`$global:LASTEXITCODE = 0`n& {`n\" + $__rceSrc + \"`n} *>&1\"); " +
+	"$__in = New-Object 'System.Management.Automation.PSDataCollection[psobject]'; $__in.Complete(); " +
+	"$__out = New-Object 'System.Management.Automation.PSDataCollection[psobject]'; " +
+	"$__h = $__cl.BeginInvoke($__in, $__out); $__n = 0; " +
+	"while ($true) { $__done = $__h.IsCompleted; while ($__n -lt $__out.Count) { $__out[$__n]; $__n++ }; if ($__done) { break }; Start-Sleep -Milliseconds 20 }; " +
+	"$__err = $null; try { [void]$__cl.EndInvoke($__h) } catch { $__err = $_ }; " +
+	"$global:LASTEXITCODE = $__cl.Runspace.SessionStateProxy.GetVariable('LASTEXITCODE'); if ($__err) { throw $__err } }"
+
+// constrainedSetup 创建受限 runspace 并应用偏好变量的语句, 没有输出
+func constrainedSetup(preferences map[string]string, plainText bool) string {
+	setup := psCreateConstrained
+	if len(preferences) > 0 {
+		// 偏好变量属于各自的 runspace, 在受限 runspace 中同样设置一次
+		setup += fmt.Sprintf("; [void]$global:__rceCL.AddScript(%s).Invoke(); [void]$global:__rceCL.Commands.Clear()", psQuote(preferenceCommand(preferences)))
+	}
+	if plainText {
+		setup += "; " + psConstrainedPlainText
+	}
+	return setup
+}
+
+// parseLanguageMode 解析 language_mode, 为空时为完整语言模式
+func parseLanguageMode(mode LanguageMode, shellType ShellType) (bool, error) {
+	switch mode {
+	case "", LanguageFull:
+		return false, nil
+	case LanguageConstrained:
+		if shellType != ShellPowerShell {
+			return false, fmt.Errorf("%w: constrained language mode requires a PowerShell session", errInvalidOptions)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: unknown language_mode %q", errInvalidOptions, mode)
+}
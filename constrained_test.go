@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseLanguageMode(t *testing.T) {
+	tests := []struct {
+		mode        LanguageMode
+		shell       ShellType
+		constrained bool
+		ok          bool
+	}{
+		{"", ShellPowerShell, false, true},
+		{LanguageFull, ShellBash, false, true},
+		{LanguageConstrained, ShellPowerShell, true, true},
+		{LanguageConstrained, ShellBash, false, false},
+		{LanguageConstrained, ShellCmd, false, false},
+		{"restricted", ShellPowerShell, false, false},
+	}
+	for _, tt := range tests {
+		constrained, err := parseLanguageMode(tt.mode, tt.shell)
+		if constrained != tt.constrained || (err == nil) != tt.ok {
+			t.Errorf("parseLanguageMode(%q, %s) = %t, %v", tt.mode, tt.shell, constrained, err)
+		}
+		if err != nil && !errors.Is(err, errInvalidOptions) {
+			t.Errorf("parseLanguageMode(%q, %s) error %v is not errInvalidOptions", tt.mode, tt.shell, err)
+		}
+	}
+}
+
+func TestConstrainedSetup(t *testing.T) {
+	setup := constrainedSetup(nil, false)
+	// 语言模式在创建 runspace 时设置, 不是在命令中修改 $ExecutionContext
+	if !strings.Contains(setup, "$__rceIss.LanguageMode = 'ConstrainedLanguage'") || strings.Contains(setup, "$ExecutionContext") {
+		t.Fatalf("setup = %s", setup)
+	}
+	if strings.Contains(setup, "PSStyle") || strings.Contains(setup, "AddScript") {
+		t.Fatalf("setup without preferences or plain text = %s", setup)
+	}
+	setup = constrainedSetup(map[string]string{"ProgressPreference": "SilentlyContinue"}, true)
+	if !strings.Contains(setup, "AddScript('$global:ProgressPreference = ''SilentlyContinue''')") || !strings.Contains(setup, psConstrainedPlainText) {
+		t.Fatalf("setup with preferences = %s", setup)
+	}
+
+	preset := defaultShellPresets()["pwsh"]
+	if frame := preset.frame("Get-Date", "m1", TerminatorMarker, frameOptions{constrained: true}); !strings.Contains(frame, "$global:__rceCL") {
+		t.Fatalf("constrained frame does not use the runspace:\n%s", frame)
+	}
+	if frame := preset.frame("Get-Date", "m1", TerminatorMarker, frameOptions{}); strings.Contains(frame, "__rceCL") {
+		t.Fatalf("full language frame uses the constrained runspace:\n%s", frame)
+	}
+}
+
+func TestConstrainedSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	recorder := &stdinRecorder{}
+	spawner = recorder
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "language_mode": "constrained"})
+	if resp, data := ts.run(aliceToken, id, "echo ok", nil); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+	// 受限 runspace 在第一条命令之前创建
+	stdin := recorder.String()
+	setup := strings.Index(stdin, psCreateConstrained)
+	if first := strings.Index(stdin, beginMarkerPrefix); setup < 0 || first < 0 || setup > first {
+		t.Fatalf("constrained runspace not created before the first command:\n%s", stdin)
+	}
+
+	// 子 shell 的 runspace 不受限, 不能打开
+	resp, data := ts.post(aliceToken, "/open-subshell", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), errSubShellConstrained.Error()) {
+		t.Fatalf("open-subshell = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash", "language_mode": "constrained"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("constrained bash = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestConstrainedLanguageBlocksReflection(t *testing.T) {
+	if _, err := exec.LookPath("pwsh"); err != nil {
+		t.Skip("pwsh is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	const mode = "$ExecutionContext.SessionState.LanguageMode"
+	// 受限模式不允许调用非核心类型的方法
+	const reflection = "[System.Reflection.Assembly]::GetExecutingAssembly().FullName"
+
+	full := ts.startSession(aliceToken, map[string]any{"shell": "pwsh"})
+	if _, data := ts.run(aliceToken, full, mode, nil); string(data) != "FullLanguage" {
+		t.Fatalf("full session language mode = %q", data)
+	}
+	if _, data := ts.run(aliceToken, full, reflection, nil); !strings.Contains(string(data), "System.Management.Automation") {
+		t.Fatalf("reflection in full session = %q", data)
+	}
+
+	constrained := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "language_mode": "constrained"})
+	if _, data := ts.run(aliceToken, constrained, mode, nil); string(data) != "ConstrainedLanguage" {
+		t.Fatalf("constrained session language mode = %q", data)
+	}
+	if _, data := ts.run(aliceToken, constrained, reflection, nil); strings.Contains(string(data), "System.Management.Automation,") {
+		t.Fatalf("reflection allowed in constrained session: %q", data)
+	}
+	// 命令不能把语言模式改回完整模式
+	ts.run(aliceToken, constrained, mode+" = 'FullLanguage'", nil)
+	if _, data := ts.run(aliceToken, constrained, mode, nil); string(data) != "ConstrainedLanguage" {
+		t.Fatalf("language mode after escalation attempt = %q", data)
+	}
+}
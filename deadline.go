@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// deadlineHeader 客户端的截止时间(RFC 3339), 换算为本条命令的超时
+const deadlineHeader = "X-Deadline"
+
+// timeoutParam 以查询参数给出的命令超时, 如 30s、1m30s
+const timeoutParam = "timeout"
+
+// requestTimeout 从 X-Deadline 请求头和 timeout 查询参数取本条命令的超时, 都没有时返回 0
+// 两者同时给出时取较短的一个
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	var timeout time.Duration
+	if value := r.Header.Get(deadlineHeader); value != "" {
+		deadline, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return 0, newAPIError(http.StatusBadRequest, "%s must be an RFC 3339 timestamp", deadlineHeader)
+		}
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, newAPIError(http.StatusBadRequest, "%s %s has already passed", deadlineHeader, value)
+		}
+	}
+	if value := r.URL.Query().Get(timeoutParam); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return 0, newAPIError(http.StatusBadRequest, "%s must be a positive duration such as 30s", timeoutParam)
+		}
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	return timeout, nil
+}
+
+// applyRequestTimeout 将请求头或查询参数中的超时与 timeout_ms 合并, 取较短的一个
+// 合并后的超时与 timeout_ms 一样不能超过服务端的 command_timeout
+func applyRequestTimeout(r *http.Request, req *RunCommandRequest) error {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		log.Printf("✗ Invalid request timeout | SessionID: %s | Error: %v", req.SessionID, err)
+		return err
+	}
+	if timeout == 0 || req.TimeoutMs < 0 {
+		// 负数的 timeout_ms 由 runCommand 拒绝
+		return nil
+	}
+	// 不足 1 毫秒的部分向上取整, 避免截止时间临近时得到 0(即使用默认超时)
+	ms := int((timeout + time.Millisecond - 1) / time.Millisecond)
+	if req.TimeoutMs == 0 || ms < req.TimeoutMs {
+		req.TimeoutMs = ms
+	}
+	return nil
+}
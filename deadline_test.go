@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	future := time.Now().Add(time.Minute).Format(time.RFC3339Nano)
+	tests := []struct {
+		deadline, query string
+		timeoutMs       int
+		want            int
+		ok              bool
+	}{
+		{"", "", 0, 0, true},
+		{"", "", 5000, 5000, true},
+		{"", "30s", 0, 30000, true},
+		// 取较短的一个
+		{"", "30s", 5000, 5000, true},
+		{"", "2s", 5000, 2000, true},
+		{future, "", 0, 60000, true},
+		{future, "10s", 0, 10000, true},
+		// 不足 1 毫秒向上取整
+		{"", "1us", 0, 1, true},
+		{"", "soon", 0, 0, false},
+		{"", "-1s", 0, 0, false},
+		{"tomorrow", "", 0, 0, false},
+		{time.Now().Add(-time.Second).Format(time.RFC3339), "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/run-command", nil)
+		if tt.query != "" {
+			r.URL.RawQuery = timeoutParam + "=" + tt.query
+		}
+		if tt.deadline != "" {
+			r.Header.Set(deadlineHeader, tt.deadline)
+		}
+		req := RunCommandRequest{TimeoutMs: tt.timeoutMs}
+		err := applyRequestTimeout(r, &req)
+		if (err == nil) != tt.ok {
+			t.Errorf("deadline %q timeout %q: %v", tt.deadline, tt.query, err)
+			continue
+		}
+		// X-Deadline 换算的超时随时间减少, 允许少量误差
+		if tt.ok && (req.TimeoutMs > tt.want || req.TimeoutMs < tt.want-1000) {
+			t.Errorf("deadline %q timeout %q timeout_ms %d = %d, want %d", tt.deadline, tt.query, tt.timeoutMs, req.TimeoutMs, tt.want)
+		}
+	}
+}
+
+func TestRunCommandDeadline(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 5000}}
+	})
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/run-command?timeout=100ms", map[string]any{"session_id": ts.startSession(aliceToken, nil), "command": "Hang"})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("timeout query = %d %s", resp.StatusCode, data)
+	}
+
+	// 超时的命令仍在执行, 使用另一个会话
+	body, _ := json.Marshal(map[string]any{"session_id": ts.startSession(aliceToken, nil), "command": "Hang"})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/run-command", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.Header.Set(deadlineHeader, time.Now().Add(100*time.Millisecond).Format(time.RFC3339Nano))
+	if resp, data = ts.send(req); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("X-Deadline = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("commands ran for %s", elapsed)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/run-command", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.Header.Set(deadlineHeader, time.Now().Add(-time.Minute).Format(time.RFC3339))
+	if resp, data = ts.send(req); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("passed X-Deadline = %d %s", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// maxDebugRawSize 调试时保存的原始输出的上限, 超过部分不保存
+const maxDebugRawSize = 4 << 20
+
+// errDebugForbidden 非管理员请求调试信息
+var errDebugForbidden = errors.New("debug requires an admin token")
+
+// CommandDebug 命令的调试信息, 仅在管理员请求 debug 时返回, 用于排查结束标记和退出码的解析问题
+type CommandDebug struct {
+	// Stdin 写入 shell stdin 的完整文本, 包括包装语句和结束标记
+	Stdin string `json:"stdin"`
+	// Marker 本条命令的结束标记
+	Marker string `json:"marker"`
+	// RawBase64 从发送命令到检测到结束标记为止从 shell 读到的原始字节, 不经过输出处理器
+	RawBase64 string `json:"raw_base64"`
+	// RawTruncated 原始字节超过上限, 只保存了开头部分
+	RawTruncated bool `json:"raw_truncated,omitempty"`
+}
+
+// debugCapture 保存从 shell 读到的原始字节
+type debugCapture struct {
+	raw       []byte
+	truncated bool
+}
+
+// add 追加读到的原始字节, capture 为空时不保存
+func (c *debugCapture) add(chunk []byte) {
+	if c == nil {
+		return
+	}
+	if room := maxDebugRawSize - len(c.raw); len(chunk) > room {
+		chunk = chunk[:room]
+		c.truncated = true
+	}
+	c.raw = append(c.raw, chunk...)
+}
+
+// result 生成调试信息, 机密值与输出一样被替换
+func (c *debugCapture) result(stdin, marker string, secrets [][]byte) *CommandDebug {
+	if c == nil {
+		return nil
+	}
+	raw := c.raw
+	if redact := newRedactFilter(secrets); redact != nil {
+		raw = redact.scan(raw, true)
+		stdin = string(newRedactFilter(secrets).scan([]byte(stdin), true))
+	}
+	return &CommandDebug{
+		Stdin:        stdin,
+		Marker:       marker,
+		RawBase64:    base64.StdEncoding.EncodeToString(raw),
+		RawTruncated: c.truncated,
+	}
+}
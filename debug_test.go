@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugCapture(t *testing.T) {
+	var nilCapture *debugCapture
+	nilCapture.add([]byte("ignored"))
+	if nilCapture.result("stdin", "m", nil) != nil {
+		t.Fatal("result of nil capture")
+	}
+
+	c := &debugCapture{}
+	c.add([]byte("head "))
+	c.add(bytes.Repeat([]byte("x"), maxDebugRawSize))
+	// 超过上限只保留开头部分
+	if len(c.raw) != maxDebugRawSize || !c.truncated || !bytes.HasPrefix(c.raw, []byte("head x")) {
+		t.Fatalf("captured %d bytes, truncated %t", len(c.raw), c.truncated)
+	}
+
+	c = &debugCapture{}
+	c.add([]byte("token=hunter2\n"))
+	d := c.result("export T='hunter2'\n", "m-1", [][]byte{[]byte("hunter2")})
+	raw, _ := base64.StdEncoding.DecodeString(d.RawBase64)
+	// stdin 和原始字节中的机密值都被替换
+	if strings.Contains(d.Stdin, "hunter2") || strings.Contains(string(raw), "hunter2") || d.Marker != "m-1" || d.RawTruncated {
+		t.Fatalf("debug = %+v, raw %q", d, raw)
+	}
+}
+
+func TestRunCommandDebug(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(adminToken, map[string]any{"secret_env": map[string]string{"API_KEY": "s3cr3t-value"}})
+
+	resp, data := ts.run(adminToken, id, "echo s3cr3t-value", map[string]any{"debug": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("debug run = %d %s", resp.StatusCode, data)
+	}
+	var result CommandResult
+	decodeJSON(t, data, &result)
+	if result.Debug == nil || result.Output != "[REDACTED]" {
+		t.Fatalf("result = %+v", result)
+	}
+	raw, err := base64.StdEncoding.DecodeString(result.Debug.RawBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stdin 包含包装语句和结束标记, 原始输出包含开始和结束标记
+	if !strings.Contains(result.Debug.Stdin, result.Debug.Marker) || !strings.Contains(string(raw), beginMarkerPrefix+result.Debug.Marker) {
+		t.Fatalf("debug = %+v, raw %q", result.Debug, raw)
+	}
+	if strings.Contains(result.Debug.Stdin, "s3cr3t-value") || strings.Contains(string(raw), "s3cr3t-value") {
+		t.Fatalf("secret in debug output: %+v, raw %q", result.Debug, raw)
+	}
+
+	// 不请求时不返回调试信息
+	if _, data = ts.run(adminToken, id, "echo plain", nil); string(data) != "plain" {
+		t.Fatalf("run without debug = %q", data)
+	}
+}
+
+func TestRunCommandDebugRejected(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	if resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"debug": true}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("debug from non-admin = %d %s", resp.StatusCode, data)
+	}
+	admin := ts.startSession(adminToken, nil)
+	for _, extra := range []map[string]any{{"output_to_file": true}, {"coalesce": true}} {
+		extra["debug"] = true
+		if resp, data := ts.run(adminToken, admin, "echo hi", extra); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("debug with %v = %d %s", extra, resp.StatusCode, data)
+		}
+	}
+	if resp, _ := ts.stream(adminToken, admin, "echo hi", map[string]any{"debug": true}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("streamed debug = %d", resp.StatusCode)
+	}
+}
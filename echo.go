@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// echoPrompt 回显命令第一行的前缀
+	echoPrompt = "$ "
+	// echoContinuation 回显多行命令时之后各行的前缀
+	echoContinuation = "> "
+)
+
+// echoHeader 返回输出开头的命令回显: 第一行以 "$ " 开头, 之后各行以 "> " 开头, 以换行结束
+// timestamp 不为零时在第一行之前加上 [RFC3339 时间]
+func echoHeader(command string, timestamp time.Time) []byte {
+	var b strings.Builder
+	if !timestamp.IsZero() {
+		b.WriteString("[" + timestamp.UTC().Format(time.RFC3339) + "] ")
+	}
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(command, "\r\n", "\n"), "\n"), "\n")
+	for i, line := range lines {
+		if i == 0 {
+			b.WriteString(echoPrompt)
+		} else {
+			b.WriteString(echoContinuation)
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// writeEcho 在输出开头写出命令回显, 不经过 max_lines 等过滤器, 只替换机密值
+func (ow *outputWriter) writeEcho(header []byte, secrets [][]byte) error {
+	if redact := newRedactFilter(secrets); redact != nil {
+		header = append(redact.filter(header), redact.flush()...)
+	}
+	return ow.emit(header)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoHeader(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"Get-Date", "$ Get-Date\n"},
+		{"a\r\nb\nc\n\n", "$ a\n> b\n> c\n"},
+		{"", "$ \n"},
+	}
+	for _, tt := range tests {
+		if got := string(echoHeader(tt.command, time.Time{})); got != tt.want {
+			t.Errorf("echo %q = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	if got := string(echoHeader("ls", at)); got != "[2024-05-01T04:30:00Z] $ ls\n" {
+		t.Errorf("echo with timestamp = %q", got)
+	}
+}
+
+func TestEchoCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Lines": {Output: "1\n2\n3"}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"KEY": "hunter2-key"}})
+
+	resp, data := ts.run(aliceToken, id, "Get-Lines", map[string]any{"echo_command": true, "max_lines": 1})
+	// 回显不计入 max_lines
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "$ Get-Lines\n1\n") || strings.Contains(string(data), "2") {
+		t.Fatalf("echoed output = %d %q", resp.StatusCode, data)
+	}
+	resp, data = ts.run(aliceToken, id, "echo hunter2-key", map[string]any{"echo_command": true, "echo_timestamp": true})
+	if want := regexp.MustCompile(`^\[\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ\] \$ echo \[REDACTED\]\n\[REDACTED\]$`); resp.StatusCode != http.StatusOK || !want.Match(data) {
+		t.Fatalf("echo with secret = %d %q", resp.StatusCode, data)
+	}
+
+	for _, extra := range []map[string]any{
+		{"echo_timestamp": true},
+		{"echo_command": true, "output_format": "json"},
+		{"echo_command": true, "output_format": "base64"},
+	} {
+		if resp, data := ts.run(aliceToken, id, "Get-Lines", extra); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v = %d %s", extra, resp.StatusCode, data)
+		}
+	}
+}
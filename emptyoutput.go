@@ -0,0 +1,34 @@
+package main
+
+import "fmt"
+
+// EmptyOutputMode 命令成功但没有输出时 /run-command 的响应方式
+type EmptyOutputMode string
+
+const (
+	// EmptyOutputText 与有输出时一样返回文本, 响应体为空(默认)
+	EmptyOutputText EmptyOutputMode = "text"
+	// EmptyOutputJSON 返回包含 exit_code 和 had_output 的 JSON 结果, 客户端不必根据空响应体判断
+	EmptyOutputJSON EmptyOutputMode = "json"
+)
+
+// parseEmptyOutputMode 检查 empty_output, 为空时返回 fallback
+func parseEmptyOutputMode(mode string, fallback EmptyOutputMode) (EmptyOutputMode, error) {
+	switch EmptyOutputMode(mode) {
+	case "":
+		return fallback, nil
+	case EmptyOutputText, EmptyOutputJSON:
+		return EmptyOutputMode(mode), nil
+	}
+	return "", fmt.Errorf("empty_output must be %s or %s", EmptyOutputText, EmptyOutputJSON)
+}
+
+// emptyOutputMode 返回请求的 empty_output, 未指定时为服务端的配置, 请求已在 runCommand 中检查
+func (req *RunCommandRequest) emptyOutputMode() EmptyOutputMode {
+	fallback := currentSettings().emptyOutput
+	mode, err := parseEmptyOutputMode(req.EmptyOutput, fallback)
+	if err != nil {
+		return fallback
+	}
+	return mode
+}
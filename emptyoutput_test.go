@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseEmptyOutputMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		fallback EmptyOutputMode
+		want     EmptyOutputMode
+		ok       bool
+	}{
+		{"", EmptyOutputText, EmptyOutputText, true},
+		{"", EmptyOutputJSON, EmptyOutputJSON, true},
+		{"json", EmptyOutputText, EmptyOutputJSON, true},
+		{"text", EmptyOutputJSON, EmptyOutputText, true},
+		{"JSON", EmptyOutputText, "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseEmptyOutputMode(tt.mode, tt.fallback)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parse(%q, %s) = %q, %v, want %q ok %t", tt.mode, tt.fallback, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHadOutput(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Quiet": {ExitCode: 3}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "Quiet", nil)
+	if resp.StatusCode != http.StatusOK || len(data) != 0 || resp.Header.Get("X-Had-Output") != "false" {
+		t.Fatalf("empty output = %d %q, X-Had-Output %q", resp.StatusCode, data, resp.Header.Get("X-Had-Output"))
+	}
+	if resp, _ = ts.run(aliceToken, id, "echo hi", nil); resp.Header.Get("X-Had-Output") != "true" {
+		t.Fatalf("X-Had-Output with output = %q", resp.Header.Get("X-Had-Output"))
+	}
+
+	// 请求 empty_output json 时没有输出返回 JSON 结果, 有输出时仍返回文本
+	resp, data = ts.run(aliceToken, id, "Quiet", map[string]any{"empty_output": "json"})
+	var result CommandResult
+	decodeJSON(t, data, &result)
+	if result.HadOutput || result.ExitCode == nil || *result.ExitCode != 3 || result.Output != "" {
+		t.Fatalf("empty output as JSON = %d %s", resp.StatusCode, data)
+	}
+	if _, data = ts.run(aliceToken, id, "echo hi", map[string]any{"empty_output": "json"}); string(data) != "hi" {
+		t.Fatalf("output with empty_output json = %q", data)
+	}
+	if resp, data = ts.run(aliceToken, id, "Quiet", map[string]any{"empty_output": "xml"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid empty_output = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestEmptyOutputConfig(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.EmptyOutput = "json"
+		cfg.FakeOutputs = map[string]FakeOutput{"Quiet": {}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	_, data := ts.run(aliceToken, id, "Quiet", nil)
+	var result CommandResult
+	decodeJSON(t, data, &result)
+	if result.HadOutput || result.ExitCode == nil {
+		t.Fatalf("configured empty_output json = %s", data)
+	}
+	// 请求的 empty_output 覆盖服务端的配置
+	if _, data = ts.run(aliceToken, id, "Quiet", map[string]any{"empty_output": "text"}); len(data) != 0 {
+		t.Fatalf("empty_output text override = %q", data)
+	}
+
+	cfg := DefaultConfig()
+	cfg.EmptyOutput = "bytes"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("invalid empty_output accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCodePageDecoder(t *testing.T) {
+	tests := []struct {
+		codePage int
+		in, want string
+	}{
+		{437, "caf\x82", "café"},
+		{850, "\x9d", "Ø"},
+		{866, "\x8f\xe0\xa8\xa2\xa5\xe2", "Привет"},
+		{1251, "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{1252, "\x80 \x93q\x94", "€ “q”"},
+		// 代码页中未定义的字节为 U+FFFD
+		{1252, "\x81", "�"},
+	}
+	for _, tt := range tests {
+		decode, err := newCodePageDecoder(tt.codePage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(decode([]byte(tt.in))); got != tt.want {
+			t.Errorf("decode %d %q = %q, want %q", tt.codePage, tt.in, got, tt.want)
+		}
+	}
+	if _, err := newCodePageDecoder(99999); !errors.Is(err, errInvalidOptions) {
+		t.Fatalf("unknown code page = %v, want errInvalidOptions", err)
+	}
+}
+
+func TestEncodingFilterFallback(t *testing.T) {
+	decode, _ := newCodePageDecoder(437)
+	tests := []struct {
+		chunks []string
+		want   string
+		bytes  int
+	}{
+		// 合法的 UTF-8 原样保留, 只有无效序列按代码页解码
+		{[]string{"UTF-8 é, OEM caf\x82!"}, "UTF-8 é, OEM café!", 1},
+		{[]string{"ascii only"}, "ascii only", 0},
+		// 被分块截断的 UTF-8 字符不当作无效字节
+		{[]string{"\xc3", "\xa9t\xc3", "\xa9"}, "été", 0},
+		// 跨数据块的无效序列暂存后一起解码
+		{[]string{"x\x82", "\x8a y"}, "xéè y", 2},
+		// 末尾的无效字节在 flush 时解码
+		{[]string{"end\x82"}, "endé", 1},
+		{[]string{"\xe2\x82"}, "Γé", 2},
+	}
+	for _, tt := range tests {
+		f := &encodingFilter{decode: decode, codePage: 437}
+		if got := filterChunks(f, tt.chunks...); got != tt.want {
+			t.Errorf("filter %q = %q, want %q", tt.chunks, got, tt.want)
+		}
+		if meta := f.metadata(); meta.FallbackBytes != tt.bytes || meta.Replacements != 0 || meta.Lossy {
+			t.Errorf("filter %q metadata = %+v, want %d fallback bytes", tt.chunks, meta, tt.bytes)
+		}
+	}
+}
+
+func TestEncodingFilterWithoutFallback(t *testing.T) {
+	// 未设置代码页时无效字节原样保留, 只统计
+	f := &encodingFilter{}
+	if got := filterChunks(f, "a\xff\xfeb", "é"); got != "a\xff\xfebé" {
+		t.Fatalf("filter = %q", got)
+	}
+	if meta := f.metadata(); meta.Replacements != 2 || !meta.Lossy || meta.FallbackBytes != 0 || meta.FallbackCodePage != 0 {
+		t.Fatalf("metadata = %+v", meta)
+	}
+	var nilFilter *encodingFilter
+	if nilFilter.metadata() != nil {
+		t.Fatal("metadata of nil filter")
+	}
+}
+
+func TestEncodingFilterLongInvalidRun(t *testing.T) {
+	decode, _ := newCodePageDecoder(1252)
+	f := &encodingFilter{decode: decode}
+	run := make([]byte, maxInvalidRun+10)
+	for i := range run {
+		run[i] = 0xe9
+	}
+	// 超过 maxInvalidRun 后不再等待后续数据
+	if out := f.filter(run); len(out) == 0 || len(f.pending) != 0 {
+		t.Fatalf("long run held back: %d bytes out, %d pending", len(out), len(f.pending))
+	}
+}
+
+func TestFallbackCodePageSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Mixed-Tool": {Output: "ok é / caf\x82"}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"fallback_code_page": 437})
+	resp, data := ts.run(aliceToken, id, "Mixed-Tool", map[string]any{"output_format": "text"})
+	if resp.StatusCode != http.StatusOK || string(data) != "ok é / café" {
+		t.Fatalf("mixed output = %d %q", resp.StatusCode, data)
+	}
+
+	// 不支持的代码页在创建会话时拒绝
+	if resp, data = ts.post(aliceToken, "/start-session", map[string]any{"fallback_code_page": 99999}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unsupported code page = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestOutputEncodingReport(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Mixed-Tool": {Output: "caf\x82 \xff"},
+			"Clean-Tool": {Output: "café"},
+		}
+	})
+
+	// 未设置代码页时无效字节原样保留, 计为替换字符
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.run(aliceToken, id, "Mixed-Tool", map[string]any{"output_format": "text"})
+	if string(data) != "caf\x82 \xff" || resp.Header.Get("X-Output-Replacements") != "2" {
+		t.Fatalf("lossy output = %q %v", data, resp.Header)
+	}
+	_, frames := ts.stream(aliceToken, id, "Mixed-Tool", nil)
+	if _, end := streamOutput(t, frames); end.Encoding == nil || end.Encoding.Encoding != "utf-8" || end.Encoding.Replacements != 2 || !end.Encoding.Lossy {
+		t.Fatalf("lossy end frame = %+v", end.Encoding)
+	}
+	if resp, _ = ts.run(aliceToken, id, "Clean-Tool", nil); resp.Header.Get("X-Output-Replacements") != "" {
+		t.Fatalf("clean output reported replacements: %v", resp.Header)
+	}
+	_, frames = ts.stream(aliceToken, id, "Clean-Tool", nil)
+	if _, end := streamOutput(t, frames); end.Encoding == nil || end.Encoding.Replacements != 0 || end.Encoding.Lossy {
+		t.Fatalf("clean end frame = %+v", end.Encoding)
+	}
+
+	// 按代码页解码的字节单独统计
+	id = ts.startSession(aliceToken, map[string]any{"fallback_code_page": 437})
+	_, frames = ts.stream(aliceToken, id, "Mixed-Tool", nil)
+	if _, end := streamOutput(t, frames); end.Encoding == nil || end.Encoding.FallbackCodePage != 437 || end.Encoding.FallbackBytes != 2 || end.Encoding.Lossy {
+		t.Fatalf("fallback end frame = %+v", end.Encoding)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnvInheritance shell 进程从服务进程继承环境变量的方式
+type EnvInheritance string
+
+const (
+	// EnvInheritFull 继承服务进程的全部环境变量(默认)
+	EnvInheritFull EnvInheritance = "full"
+	// EnvInheritClean 只继承 env_allowlist 中的变量, 服务自身的令牌等变量不会出现在命令中
+	EnvInheritClean EnvInheritance = "clean"
+)
+
+var (
+	// envInheritance 服务端配置的 inherit_env
+	envInheritance = EnvInheritFull
+	// envAllowlist clean 模式下继承的变量名, 以 * 结尾时按前缀匹配
+	envAllowlist = defaultEnvAllowlist
+)
+
+// parseEnvInheritance 检查 inherit_env, 为空时为 full
+func parseEnvInheritance(mode string) (EnvInheritance, error) {
+	switch EnvInheritance(mode) {
+	case "", EnvInheritFull:
+		return EnvInheritFull, nil
+	case EnvInheritClean:
+		return EnvInheritClean, nil
+	}
+	return "", fmt.Errorf("inherit_env must be %s or %s", EnvInheritFull, EnvInheritClean)
+}
+
+// validateEnvAllowlist 检查 env_allowlist, * 只能出现在末尾
+func validateEnvAllowlist(names []string) error {
+	for _, name := range names {
+		prefix := strings.TrimSuffix(name, "*")
+		if name == "" || strings.ContainsAny(prefix, "=*\x00") {
+			return fmt.Errorf("env_allowlist: invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// inheritedEnviron 返回 shell 进程从服务进程继承的环境变量
+func inheritedEnviron(environ []string) []string {
+	if envInheritance != EnvInheritClean {
+		return environ
+	}
+	env := make([]string, 0, len(envAllowlist))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if envAllowed(name) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// envAllowed 变量名是否在 envAllowlist 中, Windows 上不区分大小写
+func envAllowed(name string) bool {
+	if envNameFold {
+		name = strings.ToUpper(name)
+	}
+	for _, pattern := range envAllowlist {
+		if envNameFold {
+			pattern = strings.ToUpper(pattern)
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestValidateEnvAllowlist(t *testing.T) {
+	for _, names := range [][]string{nil, {}, {"PATH", "LC_*", "*"}} {
+		if err := validateEnvAllowlist(names); err != nil {
+			t.Errorf("validate(%q) = %v", names, err)
+		}
+	}
+	// * 只能出现在末尾
+	for _, names := range [][]string{{""}, {"A=B"}, {"L*C"}, {"**"}, {"A\x00"}} {
+		if err := validateEnvAllowlist(names); err == nil {
+			t.Errorf("validate(%q) accepted", names)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.InheritEnv = "none"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("invalid inherit_env accepted")
+	}
+}
+
+func TestInheritedEnviron(t *testing.T) {
+	previous := envAllowlist
+	t.Cleanup(func() { envInheritance, envAllowlist = EnvInheritFull, previous })
+	environ := []string{"PATH=/bin", "LC_ALL=C", "LCX=1", "API_TOKEN=secret", "HOME=/root"}
+
+	// full 模式原样继承
+	envInheritance = EnvInheritFull
+	if got := inheritedEnviron(environ); !reflect.DeepEqual(got, environ) {
+		t.Fatalf("full = %q", got)
+	}
+
+	envInheritance = EnvInheritClean
+	envAllowlist = []string{"PATH", "LC_*"}
+	if got, want := inheritedEnviron(environ), []string{"PATH=/bin", "LC_ALL=C"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("clean = %q, want %q", got, want)
+	}
+	// 为 [] 时不继承任何变量
+	envAllowlist = []string{}
+	if got := inheritedEnviron(environ); len(got) != 0 {
+		t.Fatalf("empty allowlist = %q", got)
+	}
+}
+
+func TestInheritEnvClean(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	t.Setenv("RCE_TEST_SERVER_SECRET", "leaked")
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.InheritEnv = "clean"
+	})
+	t.Cleanup(func() { envInheritance = EnvInheritFull })
+	spawner = execSpawner{}
+
+	// 服务进程的变量不出现在命令中, 会话设置的变量和默认列表中的 PATH 仍然可用
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash", "env": map[string]string{"SEEDED": "env"}})
+	resp, data := ts.run(aliceToken, id, `echo "[$RCE_TEST_SERVER_SECRET] $SEEDED ${PATH:+path}"`, nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "[] env path" {
+		t.Fatalf("clean environment = %d %q", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// envNameFold 环境变量名是否不区分大小写
+const envNameFold = false
+
+// defaultEnvAllowlist clean 模式下默认继承的变量, shell 和常用命令运行所需
+var defaultEnvAllowlist = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_*", "TERM", "TMPDIR", "TZ"}
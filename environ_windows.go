@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+// envNameFold 环境变量名是否不区分大小写
+const envNameFold = true
+
+// defaultEnvAllowlist clean 模式下默认继承的变量, 缺少 SystemRoot 等变量时 PowerShell 和很多程序无法正常运行
+var defaultEnvAllowlist = []string{
+	"PATH", "PATHEXT", "SystemRoot", "SystemDrive", "windir", "ComSpec", "TEMP", "TMP",
+	"USERNAME", "USERDOMAIN", "USERPROFILE", "HOMEDRIVE", "HOMEPATH", "APPDATA", "LOCALAPPDATA",
+	"ProgramData", "ProgramFiles", "ProgramFiles(x86)", "ProgramW6432", "CommonProgramFiles", "CommonProgramFiles(x86)", "CommonProgramW6432",
+	"PSModulePath", "COMPUTERNAME", "OS", "NUMBER_OF_PROCESSORS", "PROCESSOR_ARCHITECTURE",
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// statusExceptionPrefix 结束标记中结构化终止错误的前缀, 之后为 base64 编码的 JSON, 位于状态的末尾
+const statusExceptionPrefix = "!exception:"
+
+// psExceptionInfo 把 catch 中保存在 $__rceErr 的错误转为 base64 编码的 JSON, 附加在结束标记之后, 不混入命令输出
+const psExceptionInfo = "'" + statusExceptionPrefix + "' + [System.Convert]::ToBase64String([System.Text.Encoding]::UTF8.GetBytes(([ordered]@{ " +
+	"message = $__rceErr.Exception.Message; category = $__rceErr.CategoryInfo.Category.ToString(); error_id = $__rceErr.FullyQualifiedErrorId; " +
+	"exception_type = $__rceErr.Exception.GetType().FullName; script_stack_trace = $__rceErr.ScriptStackTrace; position = $__rceErr.InvocationInfo.PositionMessage " +
+	"} | ConvertTo-Json -Compress)))"
+
+// psCatchException structured_errors 时 catch 中执行的语句, 错误不写入输出; 无法转为 JSON 时退回文本输出
+const psCatchException = "$__rceErr = $_; $__rceThrew = '" + statusThrew + "'; try { $__rceException = " + psExceptionInfo + " } catch { $__rceErr | Out-String -Stream }"
+
+// CommandException 命令抛出的终止错误, 仅在会话开启 structured_errors 时返回
+type CommandException struct {
+	Message  string `json:"message"`
+	Category string `json:"category"`
+	// ErrorID FullyQualifiedErrorId, 如 CommandNotFoundException
+	ErrorID       string `json:"error_id"`
+	ExceptionType string `json:"exception_type"`
+	// ScriptStackTrace 和 Position 为 PowerShell 给出的调用栈和出错位置
+	ScriptStackTrace string `json:"script_stack_trace"`
+	Position         string `json:"position"`
+}
+
+// splitException 从结束标记的状态中分离结构化终止错误, 返回去掉错误之后的状态
+// 错误信息无法解析时只记录日志, 不影响退出码等其余状态
+func splitException(sessionID, status string) (string, *CommandException) {
+	rest, encoded, ok := strings.Cut(status, statusExceptionPrefix)
+	if !ok {
+		return status, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Printf("⚠ Invalid exception info | SessionID: %s | Error: %v", sessionID, err)
+		return rest, nil
+	}
+	var exception CommandException
+	if err := json.Unmarshal(data, &exception); err != nil {
+		log.Printf("⚠ Invalid exception info | SessionID: %s | Error: %v", sessionID, err)
+		return rest, nil
+	}
+	return rest, &exception
+}
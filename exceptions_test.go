@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSplitException(t *testing.T) {
+	info := base64.StdEncoding.EncodeToString([]byte(`{"message":"boom","category":"OperationStopped","error_id":"boom","exception_type":"System.Management.Automation.RuntimeException","script_stack_trace":"at <ScriptBlock>","position":"At line:1 char:1"}`))
+	status, exception := splitException("s", exitCodeSeparator+"0"+statusThrew+statusExceptionPrefix+info)
+	if status != exitCodeSeparator+"0"+statusThrew || exception == nil {
+		t.Fatalf("split = %q %+v", status, exception)
+	}
+	if exception.Message != "boom" || exception.ExceptionType != "System.Management.Automation.RuntimeException" || exception.Position != "At line:1 char:1" {
+		t.Fatalf("exception = %+v", exception)
+	}
+	// 去掉错误信息后按原来的方式解析退出码和状态
+	if code := parseExitCode(status); code == nil || *code != 0 || commandStatus(status) != commandStatusError {
+		t.Fatalf("status after split = %q", status)
+	}
+
+	// 没有错误信息时状态不变
+	if status, exception := splitException("s", exitCodeSeparator+"3"); status != exitCodeSeparator+"3" || exception != nil {
+		t.Fatalf("no exception = %q %+v", status, exception)
+	}
+	// 无法解析的错误信息丢弃, 不影响其余状态
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("{"))} {
+		logs := captureLogs(func() {
+			status, exception = splitException("s", exitCodeSeparator+"1"+statusThrew+statusExceptionPrefix+encoded)
+		})
+		if status != exitCodeSeparator+"1"+statusThrew || exception != nil || !strings.Contains(logs, "Invalid exception info") {
+			t.Fatalf("invalid exception %q = %q %+v", encoded, status, exception)
+		}
+	}
+}
+
+func TestStructuredErrorsFrame(t *testing.T) {
+	p := defaultShellPresets()["pwsh"]
+	full := p.frame("throw 'boom'", "marker", TerminatorMarker, frameOptions{structuredErrors: true})
+	if !strings.Contains(full, psCatchException) || strings.Count(full, "\n") != 1 {
+		t.Fatalf("structured errors frame = %q", full)
+	}
+	// 默认把错误记录写入输出
+	if full = p.frame("throw 'boom'", "marker", TerminatorMarker, frameOptions{}); strings.Contains(full, statusExceptionPrefix) {
+		t.Fatalf("default frame = %q", full)
+	}
+}
+
+func TestStructuredErrorsRequiresPowerShell(t *testing.T) {
+	ts := newTestServer(t, nil)
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash", "structured_errors": true})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bash structured_errors = %d %s", resp.StatusCode, data)
+	}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "structured_errors": true})
+	if s, _ := sessionManager.GetSession(id); !s.structuredErrors {
+		t.Fatal("structured_errors not set on the session")
+	}
+}
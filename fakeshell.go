@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeOutput no_exec 时某条命令的固定结果
+type FakeOutput struct {
+	Output   string `json:"output"`
+	ExitCode int    `json:"exit_code"`
+	// DelayMs 写出输出后等待多久(毫秒)再写出结束标记, 用于模拟长时间运行的命令
+	DelayMs int `json:"delay_ms"`
+}
+
+// errFakeShellKilled 模拟 shell 被结束
+var errFakeShellKilled = errors.New("fake shell killed")
+
+// fakeBeginMarker 写入 stdin 的命令中的开始标记, 标记为会话前缀加命令 UUID
+var fakeBeginMarker = regexp.MustCompile(beginMarkerPrefix + `([0-9a-f]{16}-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
+
+// fakePSSource PowerShell 命令以 base64 传入
+var fakePSSource = regexp.MustCompile(`FromBase64String\('([A-Za-z0-9+/=]*)'\)`)
+
+// fakeExit 使模拟 shell 退出的命令
+var fakeExit = regexp.MustCompile(`^exit(\s+-?\d+)?$`)
+
+// fakeSpawner 不启动进程, 每个会话由一个按固定规则回应命令的模拟 shell 处理:
+// outputs 中的命令返回配置的输出和退出码, echo 返回其参数, exit 使 shell 退出, 其余命令没有输出、退出码为 0
+type fakeSpawner struct {
+	outputs map[string]FakeOutput
+}
+
+func (fakeSpawner) available(p *ShellPreset) bool {
+	return true
+}
+
+func (f fakeSpawner) spawn(s *Session) (*shellProcess, error) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	shell := &fakeShell{
+		shellType: s.shell.Type,
+		outputs:   f.outputs,
+		stdin:     stdinR,
+		stdout:    stdoutW,
+		stderr:    stderrW,
+		done:      make(chan struct{}),
+	}
+	go shell.run()
+	return &shellProcess{stdin: stdinW, stdout: stdoutR, stderr: stderrR, tree: shell, wait: shell.wait}, nil
+}
+
+// fakeShell 一个会话的模拟 shell, 同时作为它自己的进程树
+type fakeShell struct {
+	shellType ShellType
+	outputs   map[string]FakeOutput
+	stdin     *io.PipeReader
+	stdout    *io.PipeWriter
+	stderr    *io.PipeWriter
+
+	once   sync.Once
+	done   chan struct{}
+	killed bool
+}
+
+// run 逐行读取 stdin, 读到一条完整的带标记的命令后回应, 没有标记的语句(如启动时的初始化语句)忽略
+func (f *fakeShell) run() {
+	defer f.exit(false)
+	r := bufio.NewReader(f.stdin)
+	var pending strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		trimmed := strings.TrimSpace(line)
+		if pending.Len() == 0 && (fakeExit.MatchString(trimmed) || strings.HasSuffix(trimmed, "; exit")) {
+			return
+		}
+		pending.WriteString(line)
+		text := pending.String()
+		m := fakeBeginMarker.FindStringSubmatchIndex(text)
+		if m == nil {
+			pending.Reset()
+			continue
+		}
+		marker := text[m[2]:m[3]]
+		end := marker + exitCodeSeparator
+		if !strings.Contains(text[m[1]:], end) {
+			// bash 中多行命令的其余部分还未读到
+			continue
+		}
+		pending.Reset()
+		command := f.command(text[m[1]:], end)
+		if fakeExit.MatchString(strings.TrimSpace(command)) {
+			return
+		}
+		output, status, delay := f.respond(command, marker, f.raw(text, end))
+		if _, err := io.WriteString(f.stdout, output); err != nil {
+			return
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-f.done:
+				return
+			}
+		}
+		if _, err := io.WriteString(f.stdout, status); err != nil {
+			return
+		}
+	}
+}
+
+// command 从写入 stdin 的文本中取出客户端的命令, 文本为开始标记之后的部分
+func (f *fakeShell) command(text, end string) string {
+	switch f.shellType {
+	case ShellBash:
+		i := strings.Index(text, "{ ")
+		j := strings.LastIndex(text, "\n} 2>&1")
+		if i < 0 || j < i {
+			return ""
+		}
+		return text[i+2 : j]
+	case ShellCmd:
+		i := strings.Index(text, "& (")
+		j := strings.LastIndex(text, ") 2>&1 &")
+		if i < 0 || j < i {
+			return ""
+		}
+		return text[i+3 : j]
+	default:
+		m := fakePSSource.FindStringSubmatch(text)
+		if m == nil {
+			return ""
+		}
+		src, _ := base64.StdEncoding.DecodeString(m[1])
+		return string(src)
+	}
+}
+
+// raw 命令是否以原始字节模式执行, 此时结束标记前有一个分隔换行
+func (f *fakeShell) raw(text, end string) bool {
+	switch f.shellType {
+	case ShellBash:
+		return strings.Contains(text, `printf '\n`+end)
+	case ShellCmd:
+		return strings.Contains(text, "echo.& echo "+end)
+	default:
+		return strings.Contains(text, "WriteByte(10)")
+	}
+}
+
+// respond 生成命令的输出(开始标记和固定的输出)、带退出码的结束标记, 以及两者之间等待的时间
+func (f *fakeShell) respond(command, marker string, raw bool) (string, string, time.Duration) {
+	newline := "\n"
+	if f.shellType == ShellCmd {
+		newline = "\r\n"
+	}
+	result, ok := f.outputs[strings.TrimSpace(command)]
+	if !ok {
+		result.Output = fakeEcho(command)
+	}
+	output := strings.ReplaceAll(result.Output, "\n", newline)
+	if output != "" && !strings.HasSuffix(output, newline) && !raw {
+		output += newline
+	}
+	if raw {
+		// 与 rawSeparator 相同
+		output += newline
+	}
+	return beginMarkerPrefix + marker + newline + output, marker + exitCodeSeparator + strconv.Itoa(result.ExitCode) + newline, time.Duration(result.DelayMs) * time.Millisecond
+}
+
+// fakeEcho echo 和 Write-Output 返回其参数(去掉一层引号), 其他命令没有输出
+func fakeEcho(command string) string {
+	command = strings.TrimSpace(command)
+	for _, prefix := range []string{"echo ", "Write-Output "} {
+		if arg, ok := strings.CutPrefix(command, prefix); ok {
+			arg = strings.TrimSpace(arg)
+			if len(arg) >= 2 && (arg[0] == '\'' || arg[0] == '"') && arg[len(arg)-1] == arg[0] {
+				arg = arg[1 : len(arg)-1]
+			}
+			return arg
+		}
+	}
+	return ""
+}
+
+// exit 关闭模拟 shell 的管道, 之后的读写都返回错误
+func (f *fakeShell) exit(killed bool) {
+	f.once.Do(func() {
+		f.killed = killed
+		f.stdin.Close()
+		f.stdout.Close()
+		f.stderr.Close()
+		close(f.done)
+	})
+}
+
+func (f *fakeShell) wait() error {
+	<-f.done
+	if f.killed {
+		return errFakeShellKilled
+	}
+	return nil
+}
+
+func (f *fakeShell) kill() error {
+	f.exit(true)
+	return nil
+}
+
+func (f *fakeShell) killChildren() error {
+	return nil
+}
+
+func (f *fakeShell) remaining() ([]int, error) {
+	select {
+	case <-f.done:
+		return nil, nil
+	default:
+		// 与进程组一样, shell 本身算作一个进程
+		return []int{0}, nil
+	}
+}
+
+func (f *fakeShell) usage() (processUsage, error) {
+	return processUsage{}, nil
+}
+
+func (f *fakeShell) release() {}
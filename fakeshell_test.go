@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestFakeEcho(t *testing.T) {
+	tests := map[string]string{
+		"echo hi":                "hi",
+		"  echo 'a b'  ":         "a b",
+		`Write-Output "c"`:       "c",
+		"echo 'unbalanced":       "'unbalanced",
+		"Get-Date":               "",
+		"printf 'no output'\n":   "",
+		"echo":                   "",
+		"echoes are not matched": "",
+	}
+	for command, want := range tests {
+		if got := fakeEcho(command); got != want {
+			t.Errorf("fakeEcho(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestFakeShells(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Get-Thing": {Output: "line 1\nline 2", ExitCode: 3},
+		}
+	})
+	// 每种 shell 的命令格式都能取出客户端的命令
+	for _, shell := range []string{"bash", "cmd", "pwsh"} {
+		id := ts.startSession(aliceToken, map[string]any{"shell": shell})
+		if resp, data := ts.run(aliceToken, id, "echo 'hi'", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+			t.Errorf("%s echo = %d %q", shell, resp.StatusCode, data)
+		}
+		// cmd 的输出以 \r\n 换行
+		newline := "\n"
+		if shell == "cmd" {
+			newline = "\r\n"
+		}
+		resp, data := ts.run(aliceToken, id, "Get-Thing", nil)
+		if string(data) != "line 1"+newline+"line 2" || resp.Header.Get("X-Exit-Code") != "3" {
+			t.Errorf("%s configured output = %q exit %s", shell, data, resp.Header.Get("X-Exit-Code"))
+		}
+		if resp, data = ts.run(aliceToken, id, "Get-Unknown", nil); string(data) != "" || resp.Header.Get("X-Exit-Code") != "0" {
+			t.Errorf("%s unknown command = %q exit %s", shell, data, resp.Header.Get("X-Exit-Code"))
+		}
+		if resp, data = ts.run(aliceToken, id, "Get-Thing", map[string]any{"output_format": "base64"}); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s raw output = %d %s", shell, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestFakeShellExit(t *testing.T) {
+	ts := newTestServer(t, nil)
+	tracker := &trackingSpawner{}
+	spawner = tracker
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	// exit 使模拟 shell 退出, 与真实的 shell 一样记为意外退出
+	ts.run(aliceToken, id, "exit 3", nil)
+	waitFor(t, func() bool { return tracker.alive() == 0 && !s.running.Load() })
+	if events, _ := sessionManager.Store.Events(id); len(events) == 0 || events[len(events)-1].Type != "exited" {
+		t.Fatalf("events after exit = %+v", events)
+	}
+
+	// 结束进程时 wait 返回错误, 与被结束的进程一致
+	proc, err := fakeSpawner{}.spawn(&Session{shell: &ShellPreset{Type: ShellBash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pids, _ := proc.tree.remaining(); len(pids) != 1 {
+		t.Fatalf("running shell has %d processes", len(pids))
+	}
+	proc.tree.kill()
+	if err := proc.wait(); !errors.Is(err, errFakeShellKilled) {
+		t.Fatalf("wait after kill = %v", err)
+	}
+	if pids, _ := proc.tree.remaining(); len(pids) != 0 {
+		t.Fatalf("killed shell has %d processes", len(pids))
+	}
+}
+
+func TestNoExecConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FakeOutputs = map[string]FakeOutput{"echo": {}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("fake_outputs without no_exec accepted")
+	}
+	cfg.NoExec = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if caps := newCapabilities(cfg); !caps.Features.NoExec {
+		t.Fatal("capabilities do not report no_exec")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPsInvokeFlush(t *testing.T) {
+	tests := []struct {
+		opts frameOptions
+		want []string
+		not  []string
+	}{
+		// 默认整体经过 Out-String -Stream
+		{frameOptions{}, []string{"*>&1 | Out-String -Stream"}, []string{"ForEach-Object", "Out-Default"}},
+		// flush 时每个对象单独格式化并刷新
+		{frameOptions{flush: true}, []string{"| ForEach-Object { $_ | Out-String -Stream | Out-Default; [Console]::Out.Flush() }"}, nil},
+		{frameOptions{flush: true, raw: true}, []string{"$__rceStdout.WriteByte($_)", "else { $_ | Out-String -Stream | Out-Default; [Console]::Out.Flush() }"}, nil},
+		// JSON 输出需要收集全部对象, flush 不生效
+		{frameOptions{flush: true, jsonDepth: 2}, []string{"ConvertTo-Json"}, []string{"Out-Default"}},
+	}
+	for _, tt := range tests {
+		got := psInvoke(tt.opts)
+		for _, s := range tt.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("psInvoke(%+v) = %q, missing %q", tt.opts, got, s)
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(got, s) {
+				t.Errorf("psInvoke(%+v) = %q, unexpected %q", tt.opts, got, s)
+			}
+		}
+	}
+}
+
+func TestFlushOutputSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "flush_output": true})
+	if s, _ := sessionManager.GetSession(id); !s.flushOutput {
+		t.Fatal("flush_output not kept on the session")
+	}
+	if resp, data := ts.run(aliceToken, id, "echo 'hello'", nil); resp.StatusCode != http.StatusOK || string(data) != "hello" {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+
+	// 只有 PowerShell 支持
+	for _, shell := range []string{"bash", "cmd"} {
+		resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": shell, "flush_output": true})
+		if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInvalidRequest {
+			t.Errorf("flush_output for %s = %d %s", shell, resp.StatusCode, data)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// OutputFormat 命令输出的格式
+type OutputFormat string
+
+const (
+	// OutputText 经 Out-String 转为文本(默认)
+	OutputText OutputFormat = "text"
+	// OutputJSON 经 ConvertTo-Json 序列化命令返回的对象, 仅 PowerShell 会话支持
+	OutputJSON OutputFormat = "json"
+	// OutputBase64 不做解码和换行等转换, 原始输出字节以 base64 返回
+	OutputBase64 OutputFormat = "base64"
+)
+
+const (
+	// defaultJSONDepth 默认的 ConvertTo-Json 序列化深度
+	defaultJSONDepth = 4
+	// maxJSONDepth ConvertTo-Json 允许的最大深度
+	maxJSONDepth = 100
+)
+
+// validateJSONDepth 检查序列化深度, 0 表示使用默认值
+func validateJSONDepth(depth int) error {
+	if depth < 0 || depth > maxJSONDepth {
+		return fmt.Errorf("json_depth must be between 1 and %d", maxJSONDepth)
+	}
+	return nil
+}
+
+// parseJSONOutput 将 JSON 模式的输出解析到 Data
+// 对象无法序列化时 shell 退回文本输出, 此时保留 Output 不变
+func (r *CommandResult) parseJSONOutput() bool {
+	data := bytes.TrimSpace([]byte(r.Output))
+	if !json.Valid(data) {
+		return false
+	}
+	r.Data = json.RawMessage(data)
+	r.Output = ""
+	return true
+}
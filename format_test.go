@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runBase64 以 base64 输出格式执行命令, 返回解码后的输出字节
+func (ts *testServer) runBase64(token, id, command string, extra map[string]any) (*CommandResult, []byte) {
+	ts.t.Helper()
+	req := map[string]any{"output_format": "base64"}
+	for k, v := range extra {
+		req[k] = v
+	}
+	resp, data := ts.run(token, id, command, req)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		ts.t.Fatalf("base64 run = %d %s", resp.StatusCode, data)
+	}
+	var result CommandResult
+	decodeJSON(ts.t, data, &result)
+	if result.OutputBase64 == nil || result.Output != "" {
+		ts.t.Fatalf("base64 result = %s", data)
+	}
+	raw, err := base64.StdEncoding.DecodeString(*result.OutputBase64)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return &result, raw
+}
+
+func TestBase64OutputKeepsRawBytes(t *testing.T) {
+	raw := "\x1b[31mred\x1b[0m\r\n\xff\xfe\x00bin\r\n"
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Bytes": {Output: raw}}
+		cfg.StripANSI = true
+		cfg.NormalizeNewlines = true
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 文本输出经过去除 ANSI 和换行转换, 原始字节模式原样返回
+	if resp, data := ts.run(aliceToken, id, "Get-Bytes", nil); resp.StatusCode != http.StatusOK || strings.Contains(string(data), "\x1b") || strings.Contains(string(data), "\r") {
+		t.Fatalf("text output = %d %q", resp.StatusCode, data)
+	}
+	result, got := ts.runBase64(aliceToken, id, "Get-Bytes", nil)
+	if string(got) != raw {
+		t.Fatalf("raw output = %q, want %q", got, raw)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 0 {
+		t.Fatalf("exit code = %v", result.ExitCode)
+	}
+
+	// 行数限制只能用于文本输出
+	if resp, data := ts.run(aliceToken, id, "Get-Bytes", map[string]any{"output_format": "base64", "max_lines": 1}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("max_lines with base64 = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.run(aliceToken, id, "Get-Bytes", map[string]any{"output_format": "binary"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestBase64OutputRedactsSecrets(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"TOKEN": "s3cr3t-value"}})
+	_, got := ts.runBase64(aliceToken, id, "echo s3cr3t-value", nil)
+	if bytes.Contains(got, []byte("s3cr3t-value")) {
+		t.Fatalf("secret in raw output: %q", got)
+	}
+}
+
+func TestBase64OutputBash(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+
+	// 结尾没有换行、带有 NUL 和无效 UTF-8 的输出原样返回
+	tests := map[string]string{
+		`printf 'a\0b\377'`:     "a\x00b\xff",
+		`printf 'line\r\n\r\n'`: "line\r\n\r\n",
+		`true`:                  "",
+	}
+	for command, want := range tests {
+		if _, got := ts.runBase64(aliceToken, id, command, nil); string(got) != want {
+			t.Errorf("%s = %q, want %q", command, got, want)
+		}
+	}
+}
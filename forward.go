@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxForwardedValue 转发为环境变量的请求头值的最大字节数, 超过部分截断
+const maxForwardedValue = 1024
+
+// credentialHeaders 携带凭据或由服务自身使用的请求头, 不能转发到 shell
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", webhookSignatureHeader}
+
+// envVar 命令执行期间设置的环境变量
+type envVar struct {
+	name  string
+	value string
+}
+
+// validateForwardHeaders 检查 forward_headers, 请求头名称必须合法且不携带凭据, 环境变量名不能重复
+func validateForwardHeaders(headers map[string]string) error {
+	seen := make(map[string]string)
+	canonical := make(map[string]bool)
+	for header, name := range headers {
+		if header == "" || strings.IndexFunc(header, func(c rune) bool { return !isHeaderTokenChar(c) }) >= 0 {
+			return fmt.Errorf("forward_headers: invalid header name %q", header)
+		}
+		if canonical[textproto.CanonicalMIMEHeaderKey(header)] {
+			return fmt.Errorf("forward_headers: header %s is listed more than once", header)
+		}
+		canonical[textproto.CanonicalMIMEHeaderKey(header)] = true
+		for _, h := range credentialHeaders {
+			if strings.EqualFold(header, h) {
+				return fmt.Errorf("forward_headers: header %s carries credentials and cannot be forwarded", header)
+			}
+		}
+		if !validEnvName(name) {
+			return fmt.Errorf("forward_headers: %s: env var name must be letters, digits and _ and not start with a digit", header)
+		}
+		if strings.HasPrefix(strings.ToUpper(name), "__RCE") {
+			return fmt.Errorf("forward_headers: %s: env var names starting with __RCE are reserved", header)
+		}
+		if other, ok := seen[strings.ToUpper(name)]; ok {
+			return fmt.Errorf("forward_headers: headers %s and %s map to the same env var %s", other, header, name)
+		}
+		seen[strings.ToUpper(name)] = header
+	}
+	return nil
+}
+
+// canonicalForwardHeaders 返回以规范化请求头名称为键的映射
+func canonicalForwardHeaders(headers map[string]string) map[string]string {
+	canonical := make(map[string]string, len(headers))
+	for header, name := range headers {
+		canonical[textproto.CanonicalMIMEHeaderKey(header)] = name
+	}
+	return canonical
+}
+
+// isHeaderTokenChar 是否为 RFC 7230 token 中允许的字符
+func isHeaderTokenChar(c rune) bool {
+	return c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
+
+// validEnvName 环境变量名只能包含字母、数字和 _, 不能以数字开头
+func validEnvName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardedEnv 按 forward_headers 从请求头生成环境变量, 按变量名排序
+// 同名请求头有多个时以逗号连接, 值经过 sanitizeForwardedValue 处理, 处理后为空的请求头不转发
+func forwardedEnv(header http.Header) []envVar {
+	var env []envVar
+	for name, envName := range currentSettings().forwardHeaders {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		if value := sanitizeForwardedValue(strings.Join(values, ", ")); value != "" {
+			env = append(env, envVar{name: envName, value: value})
+		}
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].name < env[j].name })
+	return env
+}
+
+// sanitizeForwardedValue 去掉控制字符和无效的 UTF-8, 截断到 maxForwardedValue 字节
+// 值在写入 shell 时还会按 shell 的规则加引号, 这里保证值只有一行且不含 NUL
+func sanitizeForwardedValue(value string) string {
+	value = strings.ToValidUTF8(value, "")
+	value = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, value)
+	value = strings.TrimSpace(value)
+	if len(value) > maxForwardedValue {
+		value = value[:maxForwardedValue-incompleteRuneSuffix([]byte(value[:maxForwardedValue]))]
+	}
+	return value
+}
+
+// envScope 返回在 shell 中设置环境变量和之后恢复原值的语句, 恢复后命令之前已有的变量保持原值, 原本不存在的变量被删除
+// cmd 没有可靠的方式保存未定义的变量, 不支持转发
+func envScope(shellType ShellType, env []envVar) (setup, restore string) {
+	if len(env) == 0 {
+		return "", ""
+	}
+	names := make([]string, len(env))
+	for i, v := range env {
+		names[i] = v.name
+	}
+	switch shellType {
+	case ShellBash:
+		// declare -p 只输出已定义的变量, eval 重新定义它们
+		assign := make([]string, len(env))
+		for i, v := range env {
+			assign[i] = v.name + "=" + bashQuote(v.value)
+		}
+		setup = fmt.Sprintf("__rce_env=$(declare -p %s 2>/dev/null); export %s; ", strings.Join(names, " "), strings.Join(assign, " "))
+		restore = fmt.Sprintf("unset %s; eval \"$__rce_env\"", strings.Join(names, " "))
+	case ShellPowerShell:
+		quoted := make([]string, len(env))
+		assign := make([]string, len(env))
+		for i, v := range env {
+			quoted[i] = psQuote(v.name)
+			assign[i] = fmt.Sprintf("[Environment]::SetEnvironmentVariable(%s, %s)", psQuote(v.name), psQuote(v.value))
+		}
+		// SetEnvironmentVariable 的值为 $null 时删除变量
+		setup = fmt.Sprintf("$__rceEnv = @{}; foreach ($__rceName in %s) { $__rceEnv[$__rceName] = [Environment]::GetEnvironmentVariable($__rceName) }; %s; ",
+			strings.Join(quoted, ", "), strings.Join(assign, "; "))
+		restore = "foreach ($__rceName in $__rceEnv.Keys) { [Environment]::SetEnvironmentVariable($__rceName, $__rceEnv[$__rceName]) }"
+	}
+	return setup, restore
+}
+
+// envKey 转发的环境变量在合并命令的 key 中的表示, 变量已按名称排序
+func envKey(env []envVar) []string {
+	key := make([]string, len(env))
+	for i, v := range env {
+		key[i] = v.name + "=" + v.value
+	}
+	return key
+}
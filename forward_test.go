@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestValidateForwardHeaders(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		ok      bool
+	}{
+		{map[string]string{"X-Request-ID": "RCE_REQUEST_ID", "X-Tenant": "TENANT"}, true},
+		{map[string]string{"Bad Header": "X"}, false},
+		{map[string]string{"X-Id": "1ID"}, false},
+		{map[string]string{"X-Id": "ID-X"}, false},
+		// 携带凭据的请求头不能转发
+		{map[string]string{"authorization": "AUTH"}, false},
+		{map[string]string{"Cookie": "COOKIE"}, false},
+		{map[string]string{"X-Id": "__RCE_ID"}, false},
+		// 大小写不同的同一请求头、映射到同一变量
+		{map[string]string{"X-Id": "A", "x-id": "B"}, false},
+		{map[string]string{"X-A": "ID", "X-B": "id"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateForwardHeaders(tt.headers); (err == nil) != tt.ok {
+			t.Errorf("validate(%v) = %v, want ok %t", tt.headers, err, tt.ok)
+		}
+	}
+}
+
+func TestSanitizeForwardedValue(t *testing.T) {
+	tests := map[string]string{
+		"plain":            "plain",
+		"  padded  ":       "padded",
+		"two\r\nlines":     "twolines",
+		"nul\x00byte":      "nulbyte",
+		"bad\xffutf8":      "badutf8",
+		"\t\n":             "",
+		"café 'quoted' $x": "café 'quoted' $x",
+	}
+	for in, want := range tests {
+		if got := sanitizeForwardedValue(in); got != want {
+			t.Errorf("sanitize(%q) = %q, want %q", in, got, want)
+		}
+	}
+	// 截断时不拆开多字节字符
+	long := strings.Repeat("a", maxForwardedValue-1) + "é"
+	if got := sanitizeForwardedValue(long); got != strings.Repeat("a", maxForwardedValue-1) {
+		t.Fatalf("truncated to %d bytes", len(got))
+	}
+}
+
+func TestForwardedEnv(t *testing.T) {
+	newTestServer(t, func(cfg *Config) {
+		cfg.ForwardHeaders = map[string]string{"x-tenant": "TENANT", "X-Trace": "TRACE", "X-Empty": "EMPTY"}
+	})
+	header := http.Header{}
+	header.Add("X-Trace", "a")
+	header.Add("X-Trace", "b")
+	header.Set("X-Tenant", "acme")
+	header.Set("X-Empty", "\r\n")
+	header.Set("X-Other", "ignored")
+	env := forwardedEnv(header)
+	// 按变量名排序, 多个同名请求头以逗号连接, 处理后为空的不转发
+	if len(env) != 2 || env[0] != (envVar{"TENANT", "acme"}) || env[1] != (envVar{"TRACE", "a, b"}) {
+		t.Fatalf("env = %+v", env)
+	}
+	if key := envKey(env); strings.Join(key, ";") != "TENANT=acme;TRACE=a, b" {
+		t.Fatalf("env key = %q", key)
+	}
+}
+
+func TestForwardHeadersToCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ForwardHeaders = map[string]string{"X-Tenant": "RCE_TENANT", "X-Trace": "RCE_TRACE"}
+	})
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	ts.run(aliceToken, id, "export RCE_TRACE=before", nil)
+
+	run := func(command string, header map[string]string) string {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"session_id": id, "command": command})
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/run-command", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, data := ts.send(req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("run %q = %d %s", command, resp.StatusCode, data)
+		}
+		return string(data)
+	}
+
+	// 值原样传给命令, 不被 shell 解释
+	tenant := `x'; echo pwned; '$(id)`
+	if out := run(`echo "[$RCE_TENANT] [$RCE_TRACE]"`, map[string]string{"X-Tenant": tenant, "X-Trace": "t1"}); out != "["+tenant+"] [t1]" {
+		t.Fatalf("forwarded env = %q", out)
+	}
+	// 命令结束后恢复原值, 原本不存在的变量被删除
+	if out := run(`echo "[${RCE_TENANT-unset}] [$RCE_TRACE]"`, nil); out != "[unset] [before]" {
+		t.Fatalf("env after command = %q", out)
+	}
+}
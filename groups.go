@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxGroupMembers 每个会话组最多包含的会话数
+const maxGroupMembers = 256
+
+// codeGroupNotFound 会话组不存在或属于其他租户
+const codeGroupNotFound = "group_not_found"
+
+// SessionGroups 按租户保存的会话组, 组名在租户内唯一, 只保存在内存中
+type SessionGroups struct {
+	mu sync.Mutex
+	// groups 租户 -> 组名 -> 按加入顺序排列的会话 ID
+	groups map[string]map[string][]string
+}
+
+var sessionGroups = &SessionGroups{groups: make(map[string]map[string][]string)}
+
+// Members 返回会话组的成员, 组不存在时返回 false
+func (g *SessionGroups) Members(owner, name string) ([]string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	members, ok := g.groups[owner][name]
+	return append([]string(nil), members...), ok
+}
+
+// Update 向会话组加入和移除成员, 组不存在时创建, 成员为空时删除, 返回更新后的成员
+func (g *SessionGroups) Update(owner, name string, add, remove []string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	removed := make(map[string]bool, len(remove))
+	for _, id := range remove {
+		removed[id] = true
+	}
+	var members []string
+	seen := make(map[string]bool)
+	for _, id := range append(append([]string(nil), g.groups[owner][name]...), add...) {
+		if removed[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		members = append(members, id)
+	}
+	if len(members) > maxGroupMembers {
+		return nil, fmt.Errorf("group %s would have %d members, at most %d", name, len(members), maxGroupMembers)
+	}
+
+	if len(members) == 0 {
+		delete(g.groups[owner], name)
+		if len(g.groups[owner]) == 0 {
+			delete(g.groups, owner)
+		}
+		return []string{}, nil
+	}
+	if g.groups[owner] == nil {
+		g.groups[owner] = make(map[string][]string)
+	}
+	g.groups[owner][name] = members
+	return append([]string(nil), members...), nil
+}
+
+// validateGroupName 组名与标签名的规则相同
+func validateGroupName(name string) error {
+	if name == "" {
+		log.Printf("✗ Missing group parameter")
+		return newAPIError(http.StatusBadRequest, "group is required")
+	}
+	if !labelKey.MatchString(name) {
+		log.Printf("✗ Invalid group name | Group: %q", name)
+		return newAPIError(http.StatusBadRequest, "invalid group %q, use up to 63 letters, digits, '.', '_', '-' or '/' starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// GroupMembersRequest 调整会话组成员的参数, 同一会话同时在 add 和 remove 中时被移除
+type GroupMembersRequest struct {
+	Group  string   `json:"group"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// GroupMembersResponse 会话组当前的成员
+type GroupMembersResponse struct {
+	Group   string   `json:"group"`
+	Members []string `json:"members"`
+}
+
+// updateGroupMembers 调整请求方的会话组, 加入的会话必须存在且可以被请求方访问
+func updateGroupMembers(identity *Identity, req GroupMembersRequest) (*GroupMembersResponse, error) {
+	if err := validateGroupName(req.Group); err != nil {
+		return nil, err
+	}
+	for _, id := range append(append([]string(nil), req.Add...), req.Remove...) {
+		if err := validateSessionID(id); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range req.Add {
+		if _, exists := sessionManager.GetSessionFor(id, identity); !exists {
+			return nil, sessionNotFound(id, identity)
+		}
+	}
+
+	log.Printf("→ Request: Update group | Group: %s | Owner: %s | Add: %d | Remove: %d", req.Group, identity.Name, len(req.Add), len(req.Remove))
+	members, err := sessionGroups.Update(identity.Name, req.Group, req.Add, req.Remove)
+	if err != nil {
+		log.Printf("✗ Group too large | Group: %s | Error: %v", req.Group, err)
+		return nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+	log.Printf("✓ Group updated | Group: %s | Owner: %s | Members: %d", req.Group, identity.Name, len(members))
+	return &GroupMembersResponse{Group: req.Group, Members: members}, nil
+}
+
+// groupMembers 返回请求方的会话组
+func groupMembers(identity *Identity, name string) (*GroupMembersResponse, error) {
+	if err := validateGroupName(name); err != nil {
+		return nil, err
+	}
+	members, ok := sessionGroups.Members(identity.Name, name)
+	if !ok {
+		log.Printf("✗ Group not found | Group: %s | Owner: %s", name, identity.Name)
+		return nil, newAPIErrorCode(http.StatusNotFound, codeGroupNotFound, "Group not found")
+	}
+	return &GroupMembersResponse{Group: name, Members: members}, nil
+}
+
+// GroupCommandRequest 在会话组的所有成员中执行命令的参数, 其余字段与 /run-command 相同, 不能指定 session_id
+type GroupCommandRequest struct {
+	Group string `json:"group"`
+	// TotalTimeoutMs 所有成员共享的总超时(毫秒), 包括排队等待的时间, 用完后尚未开始的成员不再执行
+	TotalTimeoutMs int `json:"total_timeout_ms"`
+	RunCommandRequest
+}
+
+// GroupCommandResult 一个成员的执行结果, 失败时 Error 为与 /run-command 相同的错误, Result 为可能附带的部分结果
+type GroupCommandResult struct {
+	Status int         `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *ErrorBody  `json:"error,omitempty"`
+}
+
+// GroupCommandResponse 会话组中各成员的执行结果, 按会话 ID 索引
+type GroupCommandResponse struct {
+	Group   string                         `json:"group"`
+	Results map[string]*GroupCommandResult `json:"results"`
+	// Failed 执行失败的成员数
+	Failed int `json:"failed"`
+}
+
+// runGroupCommand 在会话组的所有成员中并行执行命令
+// 每个成员与单独调用 runCommand 相同, 各自检查会话的归属、策略和限制, 一个成员失败不影响其他成员
+func runGroupCommand(identity *Identity, req GroupCommandRequest) (*GroupCommandResponse, error) {
+	if req.SessionID != "" {
+		log.Printf("✗ session_id in group command | Group: %s", req.Group)
+		return nil, newAPIError(http.StatusBadRequest, "session_id cannot be used with group, commands run in every member")
+	}
+	total, err := totalTimeout(req.TotalTimeoutMs)
+	if err != nil {
+		log.Printf("✗ Invalid total timeout | Group: %s | TotalTimeoutMs: %d", req.Group, req.TotalTimeoutMs)
+		return nil, err
+	}
+	group, err := groupMembers(identity, req.Group)
+	if err != nil {
+		return nil, err
+	}
+	budget, cancel := newBudget(total)
+	defer cancel()
+
+	log.Printf("→ Request: Run group command | Group: %s | Owner: %s | Members: %d", req.Group, identity.Name, len(group.Members))
+	start := time.Now()
+	results := make([]*GroupCommandResult, len(group.Members))
+	var wg sync.WaitGroup
+	for i, sessionID := range group.Members {
+		wg.Add(1)
+		go func(i int, sessionID string) {
+			defer wg.Done()
+			member := req.RunCommandRequest
+			member.SessionID = sessionID
+			member.budget = budget
+			result, file, err := runCommand(identity, member)
+			results[i] = &GroupCommandResult{Status: http.StatusOK, Result: runCommandResponse(result, file)}
+			if err != nil {
+				results[i].Status = errorStatus(err)
+				results[i].Error = &ErrorBody{Code: errorCode(err), Message: err.Error()}
+			}
+		}(i, sessionID)
+	}
+	wg.Wait()
+
+	resp := &GroupCommandResponse{Group: req.Group, Results: make(map[string]*GroupCommandResult, len(results))}
+	for i, sessionID := range group.Members {
+		resp.Results[sessionID] = results[i]
+		if results[i].Error != nil {
+			resp.Failed++
+		}
+	}
+	log.Printf("✓ Group command finished | Group: %s | Members: %d | Failed: %d | Duration: %s", req.Group, len(results), resp.Failed, time.Since(start))
+	return resp, nil
+}
+
+// API27: 查询(GET)或调整(POST)会话组的成员
+func handleGroupMembers(w http.ResponseWriter, r *http.Request) {
+	identity := identityFrom(r)
+	var resp *GroupMembersResponse
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		resp, err = groupMembers(identity, r.URL.Query().Get("group"))
+	case http.MethodPost:
+		var req GroupMembersRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("✗ Invalid request body | Error: %v", err)
+			writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+			return
+		}
+		resp, err = updateGroupMembers(identity, req)
+	default:
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// API28: 在会话组的所有成员中并行执行命令
+func handleRunGroupCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req GroupCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	req.trace = spanFrom(r)
+	req.env = forwardedEnv(r.Header)
+	if err := applyRequestTimeout(r, &req.RunCommandRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := runGroupCommand(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
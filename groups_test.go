@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSessionGroupsUpdate(t *testing.T) {
+	g := &SessionGroups{groups: make(map[string]map[string][]string)}
+	// 按加入顺序保存, 重复的成员只保留一个
+	if members, _ := g.Update("alice", "web", []string{"a", "b", "a"}, nil); !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Fatalf("add = %q", members)
+	}
+	// 同时在 add 和 remove 中时被移除
+	if members, _ := g.Update("alice", "web", []string{"c", "d"}, []string{"a", "d"}); !reflect.DeepEqual(members, []string{"b", "c"}) {
+		t.Fatalf("add and remove = %q", members)
+	}
+	// 组名在租户内唯一
+	if _, ok := g.Members("bob", "web"); ok {
+		t.Fatal("group visible to another tenant")
+	}
+	// 成员为空时删除
+	if members, _ := g.Update("alice", "web", nil, []string{"b", "c"}); len(members) != 0 {
+		t.Fatalf("remove all = %q", members)
+	}
+	if _, ok := g.Members("alice", "web"); ok || len(g.groups) != 0 {
+		t.Fatalf("empty group kept: %v", g.groups)
+	}
+
+	many := make([]string, maxGroupMembers+1)
+	for i := range many {
+		many[i] = fmt.Sprint(i)
+	}
+	if _, err := g.Update("alice", "web", many, nil); err == nil {
+		t.Fatal("oversized group accepted")
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	ts := newTestServer(t, nil)
+	a := ts.startSession(aliceToken, nil)
+	b := ts.startSession(aliceToken, nil)
+	other := ts.startSession(bobToken, nil)
+
+	resp, data := ts.post(aliceToken, "/group-members", map[string]any{"group": "web", "add": []string{a, b}})
+	var out GroupMembersResponse
+	if decodeJSON(t, data, &out); resp.StatusCode != http.StatusOK || !reflect.DeepEqual(out.Members, []string{a, b}) {
+		t.Fatalf("add = %d %s", resp.StatusCode, data)
+	}
+	resp, data = ts.do(http.MethodGet, aliceToken, "/group-members?group=web", nil)
+	if decodeJSON(t, data, &out); resp.StatusCode != http.StatusOK || out.Group != "web" || len(out.Members) != 2 {
+		t.Fatalf("get = %d %s", resp.StatusCode, data)
+	}
+
+	// 其他租户的会话不能加入, 也看不到其他租户的组
+	if resp, data = ts.post(aliceToken, "/group-members", map[string]any{"group": "web", "add": []string{other}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("add cross-tenant session = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.do(http.MethodGet, bobToken, "/group-members?group=web", nil); resp.StatusCode != http.StatusNotFound || errorCodeOf(t, data) != codeGroupNotFound {
+		t.Fatalf("cross-tenant get = %d %s", resp.StatusCode, data)
+	}
+	for _, group := range []string{"", "-web", "a b"} {
+		if resp, data = ts.post(aliceToken, "/group-members", map[string]any{"group": group, "add": []string{a}}); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("group %q = %d %s", group, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestRunGroupCommand(t *testing.T) {
+	ts := newTestServer(t, nil)
+	a := ts.startSession(aliceToken, nil)
+	b := ts.startSession(aliceToken, nil)
+	ended := ts.startSession(aliceToken, nil)
+	ts.post(aliceToken, "/group-members", map[string]any{"group": "web", "add": []string{a, b, ended}})
+	ts.endSession(aliceToken, ended)
+
+	// 一个成员失败不影响其他成员
+	resp, data := ts.post(aliceToken, "/run-group-command", map[string]any{"group": "web", "command": "echo hi"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("group command = %d %s", resp.StatusCode, data)
+	}
+	var out struct {
+		Results map[string]struct {
+			Status int            `json:"status"`
+			Result *CommandResult `json:"result"`
+			Error  *ErrorBody     `json:"error"`
+		} `json:"results"`
+		Failed int `json:"failed"`
+	}
+	decodeJSON(t, data, &out)
+	for _, id := range []string{a, b} {
+		if r := out.Results[id]; r.Status != http.StatusOK || r.Result == nil || r.Result.Output != "hi" {
+			t.Fatalf("member %s = %s", id, data)
+		}
+	}
+	if r := out.Results[ended]; r.Status != http.StatusNotFound || r.Error == nil || r.Error.Code != codeSessionNotFound || out.Failed != 1 {
+		t.Fatalf("ended member = %s", data)
+	}
+
+	if resp, data = ts.post(aliceToken, "/run-group-command", map[string]any{"group": "web", "session_id": a, "command": "echo hi"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("group command with session_id = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.post(bobToken, "/run-group-command", map[string]any{"group": "web", "command": "echo hi"}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cross-tenant group command = %d %s", resp.StatusCode, data)
+	}
+}
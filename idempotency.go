@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader 客户端为可重试的请求设置的键, 同一租户重用键的请求只执行一次
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader 响应是首次请求保存的响应时为 true
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength Idempotency-Key 的最大长度
+	maxIdempotencyKeyLength = 255
+	// defaultIdempotencyTTL 键的默认保留时间
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	codeIdempotencyInProgress = "idempotency_key_in_progress"
+	codeIdempotencyReused     = "idempotency_key_reused"
+)
+
+// idempotencyTTL 键在首次请求之后的保留时间
+var idempotencyTTL = defaultIdempotencyTTL
+
+// idempotencyFingerprint 请求方法、路径和请求体的摘要
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder 把响应同时写给客户端和缓冲区, 首次请求成功后保存
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// withIdempotency 在 requireAuth 之后使用, 请求带 Idempotency-Key 时同一租户的重试返回首次请求的响应
+// 键和响应保存在 sessionManager.Store 中; 首次请求失败(状态码不是 2xx)时释放键, 客户端可以重试
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, newAPIError(http.StatusBadRequest, "%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, newAPIError(http.StatusBadRequest, "failed to read request body: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		owner := identityFrom(r).Name
+		store := sessionManager.Store
+		fingerprint := idempotencyFingerprint(r, body)
+		existing, err := store.ClaimIdempotencyKey(owner, key, fingerprint, time.Now().Add(idempotencyTTL))
+		if err != nil {
+			log.Printf("✗ Failed to claim idempotency key | Path: %s | Owner: %s | Error: %v", r.URL.Path, owner, err)
+			writeError(w, newAPIError(http.StatusInternalServerError, "%v", err))
+			return
+		}
+		switch {
+		case existing != nil && existing.Fingerprint != fingerprint:
+			log.Printf("✗ Idempotency key reused for a different request | Path: %s | Owner: %s", r.URL.Path, owner)
+			writeError(w, newAPIErrorCode(http.StatusUnprocessableEntity, codeIdempotencyReused, "%s was used for a different request", idempotencyKeyHeader))
+			return
+		case existing != nil && existing.Pending:
+			log.Printf("✗ Idempotency key in progress | Path: %s | Owner: %s", r.URL.Path, owner)
+			writeError(w, newAPIErrorCode(http.StatusConflict, codeIdempotencyInProgress, "a request with this %s is still in progress", idempotencyKeyHeader))
+			return
+		case existing != nil:
+			log.Printf("✓ Idempotent request replayed | Path: %s | Owner: %s | Status: %d", r.URL.Path, owner, existing.Status)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(existing.Status)
+			w.Write(existing.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// handler panic 或失败时释放键
+			if !completed {
+				store.ReleaseIdempotencyKey(owner, key)
+			}
+		}()
+		next(rec, r)
+		if rec.status < 200 || rec.status >= 300 {
+			return
+		}
+		if err := store.CompleteIdempotencyKey(owner, key, rec.status, rec.body.Bytes()); err != nil {
+			log.Printf("⚠ Failed to save idempotent response | Path: %s | Owner: %s | Error: %v", r.URL.Path, owner, err)
+			return
+		}
+		completed = true
+	}
+}
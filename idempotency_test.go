@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postWithKey 带 Idempotency-Key 发送 POST 请求, 返回响应和响应体
+func (ts *testServer) postWithKey(token, path, key, body string) (*http.Response, string) {
+	ts.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(idempotencyKeyHeader, key)
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestIdempotentStartSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	first, body := ts.postWithKey(aliceToken, "/start-session", "start-1", "{}")
+	if first.StatusCode != http.StatusOK || first.Header.Get(idempotentReplayedHeader) != "" {
+		t.Fatalf("first start = %d %s", first.StatusCode, body)
+	}
+	// 重试返回同一个会话, 不创建新会话
+	retry, replayed := ts.postWithKey(aliceToken, "/start-session", "start-1", "{}")
+	if retry.StatusCode != http.StatusOK || replayed != body || retry.Header.Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("retry = %d %s, want %s", retry.StatusCode, replayed, body)
+	}
+	if n := sessionManager.Owned("alice"); n != 1 {
+		t.Fatalf("alice owns %d sessions", n)
+	}
+
+	// 同一个键用于不同的请求体
+	resp, data := ts.postWithKey(aliceToken, "/start-session", "start-1", `{"shell":"bash"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity || errorCodeOf(t, []byte(data)) != codeIdempotencyReused {
+		t.Fatalf("reused key = %d %s", resp.StatusCode, data)
+	}
+	// 键按租户区分
+	if resp, _ = ts.postWithKey(bobToken, "/start-session", "start-1", "{}"); resp.StatusCode != http.StatusOK || resp.Header.Get(idempotentReplayedHeader) != "" {
+		t.Fatalf("bob with alice's key = %d replayed %q", resp.StatusCode, resp.Header.Get(idempotentReplayedHeader))
+	}
+	if n := sessionManager.Owned("bob"); n != 1 {
+		t.Fatalf("bob owns %d sessions", n)
+	}
+
+	if resp, _ = ts.postWithKey(aliceToken, "/start-session", strings.Repeat("k", maxIdempotencyKeyLength+1), "{}"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("long key = %d", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"fail": {ExitCode: 1}}
+	})
+	body := `{"init":["fail"]}`
+	if resp, data := ts.postWithKey(aliceToken, "/start-session", "retry-me", body); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("failing start = %d %s", resp.StatusCode, data)
+	}
+	// 失败的响应不保存, 重试重新执行
+	resp, data := ts.postWithKey(aliceToken, "/start-session", "retry-me", body)
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get(idempotentReplayedHeader) != "" || errorCodeOf(t, []byte(data)) != codeInitFailed {
+		t.Fatalf("retry = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestIdempotentRunCommandAsync(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Slow-Job": {Output: "done", DelayMs: 300}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	body := `{"session_id":"` + id + `","command":"Slow-Job"}`
+
+	// 首次请求仍在处理时重试返回 409
+	fingerprint := idempotencyFingerprint(httptest.NewRequest(http.MethodPost, "/run-command-async", nil), []byte(body))
+	sessionManager.Store.ClaimIdempotencyKey("alice", "pending", fingerprint, time.Now().Add(time.Hour))
+	if resp, data := ts.postWithKey(aliceToken, "/run-command-async", "pending", body); resp.StatusCode != http.StatusConflict || errorCodeOf(t, []byte(data)) != codeIdempotencyInProgress {
+		t.Fatalf("pending key = %d %s", resp.StatusCode, data)
+	}
+
+	first, job := ts.postWithKey(aliceToken, "/run-command-async", "job-1", body)
+	if first.StatusCode != http.StatusAccepted {
+		t.Fatalf("first async = %d %s", first.StatusCode, job)
+	}
+	retry, replayed := ts.postWithKey(aliceToken, "/run-command-async", "job-1", body)
+	if retry.StatusCode != http.StatusAccepted || replayed != job {
+		t.Fatalf("retry = %d %s, want %s", retry.StatusCode, replayed, job)
+	}
+	jobStore.mu.Lock()
+	jobs := len(jobStore.jobs)
+	jobStore.mu.Unlock()
+	if jobs != 1 {
+		t.Fatalf("%d jobs after retry", jobs)
+	}
+}
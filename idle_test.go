@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutFor(t *testing.T) {
+	tests := []struct {
+		server, request time.Duration
+		counted         bool
+		want            time.Duration
+	}{
+		{0, 0, true, 0},
+		{0, time.Second, true, time.Second},
+		{time.Minute, 0, true, time.Minute},
+		{time.Minute, time.Second, true, time.Second},
+		// 请求的值超过 output_idle_timeout 时使用 output_idle_timeout
+		{time.Second, time.Minute, true, time.Second},
+		// 内部命令不受限制
+		{time.Second, time.Second, false, 0},
+	}
+	s := &Session{}
+	for _, tt := range tests {
+		opts := RunOptions{IdleTimeout: tt.request, counted: tt.counted, live: &serverSettings{outputIdleTimeout: tt.server}}
+		if got := s.idleTimeoutFor(opts); got != tt.want {
+			t.Errorf("idleTimeoutFor(server %s, request %s, counted %t) = %s, want %s", tt.server, tt.request, tt.counted, got, tt.want)
+		}
+	}
+	if !errors.Is(errIdleTimeout, errCommandTimeout) {
+		t.Fatal("errIdleTimeout is not a command timeout")
+	}
+}
+
+// idleTimeoutResult 执行命令并解析 504 响应中的错误和部分结果
+func idleTimeoutResult(t *testing.T, ts *testServer, id string, extra map[string]any) (ErrorBody, CommandResult) {
+	t.Helper()
+	resp, data := ts.run(aliceToken, id, "Stall", extra)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("stalled command = %d %s", resp.StatusCode, data)
+	}
+	var body struct {
+		ErrorResponse
+		Result CommandResult `json:"result"`
+	}
+	decodeJSON(t, data, &body)
+	return body.Error, body.Result
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Stall": {Output: "step 1", DelayMs: 2000}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	start := time.Now()
+	e, result := idleTimeoutResult(t, ts, id, map[string]any{"idle_timeout_ms": 100, "timeout_ms": 10000})
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("idle timeout took %s", elapsed)
+	}
+	// 与总超时一样返回部分输出, 但错误码不同
+	if e.Code != codeIdleTimeout || !result.TimedOut || !result.Truncated {
+		t.Fatalf("error = %+v, result = %+v", e, result)
+	}
+	if !strings.HasPrefix(result.Output, "step 1\n") || !strings.Contains(result.Output, "no output for 100ms") {
+		t.Fatalf("partial output = %q", result.Output)
+	}
+
+	if resp, data := ts.run(aliceToken, id, "echo x", map[string]any{"idle_timeout_ms": -1}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative idle_timeout_ms = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestOutputIdleTimeoutCapsRequest(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.OutputIdleTimeout = Duration(100 * time.Millisecond)
+		cfg.FakeOutputs = map[string]FakeOutput{"Stall": {Output: "step 1", DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 未设置 idle_timeout_ms 时使用 output_idle_timeout, 请求的值也不能超过它
+	for i, extra := range []map[string]any{nil, {"idle_timeout_ms": 60000}} {
+		if i > 0 {
+			// 等上一条命令在 shell 中结束
+			time.Sleep(600 * time.Millisecond)
+		}
+		if e, result := idleTimeoutResult(t, ts, id, extra); e.Code != codeIdleTimeout || !strings.Contains(result.Output, "no output for 100ms") {
+			t.Fatalf("idle timeout with %v = %+v %q", extra, e, result.Output)
+		}
+	}
+	if caps := newCapabilities(ts.cfg); caps.Limits.OutputIdleTimeoutMs != 100 {
+		t.Fatalf("capabilities output_idle_timeout_ms = %d", caps.Limits.OutputIdleTimeoutMs)
+	}
+}
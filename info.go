@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// sessionInfoCommand 查询会话当前目录和环境变量
+// 结果序列化为单行 JSON, 变量值中的换行会被转义, 不会破坏解析
+const sessionInfoCommand = `@{ location = (Get-Location).Path; env = @(Get-ChildItem Env: | ForEach-Object { @{ name = $_.Name; value = [string]$_.Value } }) } | ConvertTo-Json -Depth 3 -Compress`
+
+// SessionInfo 会话的环境信息
+type SessionInfo struct {
+	SessionID string            `json:"session_id"`
+	Location  string            `json:"location"`
+	Env       map[string]string `json:"env"`
+	Events    []SessionEvent    `json:"events"`
+	// Labels 创建会话时设置的标签
+	Labels map[string]string `json:"labels,omitempty"`
+	// OutputStats 客户端命令的输出大小统计
+	OutputStats *OutputStats `json:"output_stats"`
+	// History 会话的命令历史, 命令中的机密值已替换
+	History []CommandRecord `json:"history"`
+}
+
+// Info 在会话中执行内省命令并解析结果
+func (s *Session) Info() (*SessionInfo, error) {
+	if s.shell.Type != ShellPowerShell {
+		return nil, fmt.Errorf("session info requires a PowerShell session, got %s", s.ShellName)
+	}
+
+	result, err := s.RunCommand(sessionInfoCommand, RunOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := parseSessionInfo(result.Output)
+	if err != nil {
+		return nil, err
+	}
+	info.SessionID = s.ID
+	info.Labels = s.options.Labels
+	for name := range info.Env {
+		// Windows 的环境变量名不区分大小写
+		for secret := range s.options.SecretEnv {
+			if strings.EqualFold(name, secret) {
+				info.Env[name] = redacted
+			}
+		}
+	}
+	info.Events = s.EventsSnapshot()
+	info.OutputStats = s.outputStats.snapshot()
+	history, err := s.store.History(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history {
+		history[i] = history[i].redacted()
+	}
+	info.History = history
+	return info, nil
+}
+
+// redacted 返回替换了命令、模板参数和脚本参数中机密值的记录副本
+func (rec CommandRecord) redacted() CommandRecord {
+	rec.Command = secretRegistry.Redact(rec.Command)
+	if rec.Params != nil {
+		params := make(map[string]json.RawMessage, len(rec.Params))
+		for name, value := range rec.Params {
+			params[name] = json.RawMessage(secretRegistry.Redact(string(value)))
+		}
+		rec.Params = params
+	}
+	if rec.Args != nil {
+		args := make([]string, len(rec.Args))
+		for i, arg := range rec.Args {
+			args[i] = secretRegistry.Redact(arg)
+		}
+		rec.Args = args
+	}
+	return rec
+}
+
+// parseSessionInfo 从命令输出中提取 JSON 对象并解析
+func parseSessionInfo(output string) (*SessionInfo, error) {
+	// 忽略 JSON 前后可能混入的其他输出
+	start := strings.Index(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("unexpected session info output: %q", output)
+	}
+
+	var raw struct {
+		Location string `json:"location"`
+		Env      []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"env"`
+	}
+	if err := json.Unmarshal([]byte(output[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse session info: %v", err)
+	}
+
+	info := &SessionInfo{
+		Location: raw.Location,
+		Env:      make(map[string]string, len(raw.Env)),
+	}
+	for _, e := range raw.Env {
+		info.Env[e.Name] = e.Value
+	}
+	return info, nil
+}
+
+// API4: 查询会话信息
+func handleSessionInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "session_id is required"))
+		return
+	}
+	if err := validateSessionID(sessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("→ Request: Session info | SessionID: %s", sessionID)
+
+	session, exists := sessionManager.GetSessionFor(sessionID, identityFrom(r))
+	if !exists {
+		writeError(w, sessionNotFound(sessionID, identityFrom(r)))
+		return
+	}
+
+	info, err := session.Info()
+	if err != nil {
+		log.Printf("✗ Failed to get session info | SessionID: %s | Error: %v", sessionID, err)
+		writeError(w, newAPIError(http.StatusInternalServerError, "Failed to get session info: %v", err))
+		return
+	}
+
+	log.Printf("✓ Session info sent | SessionID: %s | Env vars: %d", sessionID, len(info.Env))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// jobTTL 已完成的任务结果的保留时间, 取走结果或过期后删除
+	jobTTL = 30 * time.Minute
+	// maxJobWait 查询任务结果时长轮询的最长等待时间
+	maxJobWait = 60 * time.Second
+)
+
+// JobStatus 异步任务的状态
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+)
+
+// Job 在后台执行的命令, 与提交它的 HTTP 连接无关
+type Job struct {
+	ID        string
+	SessionID string
+	// Owner 提交任务的租户, 只有同一租户可以查询
+	Owner     string
+	CreatedAt time.Time
+
+	mu         sync.Mutex
+	status     JobStatus
+	result     interface{}
+	err        error
+	finishedAt time.Time
+	// done 任务完成后关闭
+	done chan struct{}
+}
+
+// JobResponse 任务状态, 完成后包含与同步执行相同的结果
+type JobResponse struct {
+	JobID      string     `json:"job_id"`
+	SessionID  string     `json:"session_id"`
+	Status     JobStatus  `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Result 命令结果, output_to_file 时为下载信息, 超时时为部分输出
+	Result interface{} `json:"result,omitempty"`
+	// Error 命令失败的原因, ErrorStatus 和 ErrorCode 为同步执行时对应的 HTTP 状态码和错误码
+	Error       string `json:"error,omitempty"`
+	ErrorStatus int    `json:"error_status,omitempty"`
+	ErrorCode   string `json:"error_code,omitempty"`
+}
+
+// snapshot 返回任务当前状态
+func (j *Job) snapshot() *JobResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	resp := &JobResponse{
+		JobID:     j.ID,
+		SessionID: j.SessionID,
+		Status:    j.status,
+		CreatedAt: j.CreatedAt,
+	}
+	if j.status == JobDone {
+		finishedAt := j.finishedAt
+		resp.FinishedAt = &finishedAt
+		resp.Result = j.result
+		if j.err != nil {
+			resp.Error = j.err.Error()
+			resp.ErrorStatus = errorStatus(j.err)
+			resp.ErrorCode = errorCode(j.err)
+		}
+	}
+	return resp
+}
+
+// JobStore 管理异步任务
+type JobStore struct {
+	ttl  time.Duration
+	jobs map[string]*Job
+	mu   sync.Mutex
+}
+
+func NewJobStore(ttl time.Duration) *JobStore {
+	store := &JobStore{
+		ttl:  ttl,
+		jobs: make(map[string]*Job),
+	}
+	go store.cleanupLoop()
+	return store
+}
+
+// Submit 登记任务并在后台执行 run
+func (st *JobStore) Submit(owner, sessionID string, run func() (interface{}, error)) *Job {
+	job := &Job{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		Owner:     owner,
+		CreatedAt: time.Now(),
+		status:    JobPending,
+		done:      make(chan struct{}),
+	}
+
+	st.mu.Lock()
+	st.jobs[job.ID] = job
+	st.mu.Unlock()
+
+	go func() {
+		job.mu.Lock()
+		job.status = JobRunning
+		job.mu.Unlock()
+
+		result, err := run()
+
+		job.mu.Lock()
+		job.status = JobDone
+		job.result = result
+		job.err = err
+		job.finishedAt = time.Now()
+		job.mu.Unlock()
+		close(job.done)
+
+		log.Printf("✓ Job finished | JobID: %s | SessionID: %s", job.ID, sessionID)
+	}()
+	return job
+}
+
+// Get 获取任务
+func (st *JobStore) Get(id string) (*Job, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	job, exists := st.jobs[id]
+	return job, exists
+}
+
+// Remove 删除任务, 结果已被取走
+func (st *JobStore) Remove(id string) {
+	st.mu.Lock()
+	delete(st.jobs, id)
+	st.mu.Unlock()
+}
+
+// cleanupLoop 定期删除完成后超过保留时间仍未取走的任务
+func (st *JobStore) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		st.mu.Lock()
+		for id, job := range st.jobs {
+			job.mu.Lock()
+			expired := job.status == JobDone && now.Sub(job.finishedAt) > st.ttl
+			job.mu.Unlock()
+			if expired {
+				delete(st.jobs, id)
+				log.Printf("✓ Job result expired | JobID: %s", id)
+			}
+		}
+		st.mu.Unlock()
+	}
+}
+
+var jobStore *JobStore
+
+// submitCommand 在后台执行命令, 立即返回任务
+func submitCommand(identity *Identity, req RunCommandRequest) (*JobResponse, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	logCommand("→ Request: Run command async | SessionID: %s | Command: %s", req.SessionID, req.Command)
+
+	if _, exists := sessionManager.GetSessionFor(req.SessionID, identity); !exists {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+
+	// 异步任务在后台执行, 会话忙时排队, 不因正在执行的命令失败
+	req.Queue = true
+
+	// 异步任务执行完之前一直占用准入名额
+	if !admission.Enter() {
+		log.Printf("✗ Request shed | SessionID: %s | Depth: %d", req.SessionID, admission.Depth())
+		return nil, overloadedError()
+	}
+	job := jobStore.Submit(identity.Name, req.SessionID, func() (interface{}, error) {
+		defer admission.Exit()
+		result, file, err := runCommand(identity, req)
+		return runCommandResponse(result, file), err
+	})
+
+	log.Printf("✓ Job submitted | JobID: %s | SessionID: %s", job.ID, req.SessionID)
+	return job.snapshot(), nil
+}
+
+// commandResult 查询任务状态, 未完成时最多等待 wait, 完成的结果取走后删除
+func commandResult(identity *Identity, jobID string, wait time.Duration) (*JobResponse, error) {
+	if jobID == "" {
+		log.Printf("✗ Missing job_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "job_id is required")
+	}
+	if wait < 0 {
+		log.Printf("✗ Invalid wait | JobID: %s | Wait: %s", jobID, wait)
+		return nil, newAPIError(http.StatusBadRequest, "wait_ms must not be negative")
+	}
+	if wait > maxJobWait {
+		wait = maxJobWait
+	}
+
+	log.Printf("→ Request: Command result | JobID: %s | Wait: %s", jobID, wait)
+
+	job, exists := jobStore.Get(jobID)
+	if !exists || !identity.CanAccess(job.Owner) {
+		log.Printf("✗ Job not found | JobID: %s", jobID)
+		return nil, newAPIErrorCode(http.StatusNotFound, codeJobNotFound, "Job not found")
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-job.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	resp := job.snapshot()
+	if resp.Status == JobDone {
+		jobStore.Remove(jobID)
+		log.Printf("✓ Job result retrieved | JobID: %s", jobID)
+	}
+	return resp, nil
+}
+
+// API8: 异步执行命令
+func handleRunCommandAsync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req RunCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	req.trace = spanFrom(r)
+	req.env = forwardedEnv(r.Header)
+	if err := applyRequestTimeout(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := submitCommand(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// API9: 查询异步命令结果
+func handleCommandResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	query := r.URL.Query()
+	var waitMs int
+	if v := query.Get("wait_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("✗ Invalid wait_ms parameter | Value: %s", v)
+			writeError(w, newAPIError(http.StatusBadRequest, "wait_ms must be an integer"))
+			return
+		}
+		waitMs = n
+	}
+
+	resp, err := commandResult(identityFrom(r), query.Get("job_id"), time.Duration(waitMs)*time.Millisecond)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
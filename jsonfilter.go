@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// maxJSONFilterLength json_filter 的最大长度
+const maxJSONFilterLength = 1024
+
+// maxJSONFilterResults 表达式最多产生的结果数, 超过时视为失败, 避免 range 等生成器构造过大的结果
+const maxJSONFilterResults = 10000
+
+// jsonFilterTimeout 对一条命令的输出执行表达式的最长时间
+const jsonFilterTimeout = 2 * time.Second
+
+// codeJSONFilterFailed json_filter 应用到命令的输出时出错
+const codeJSONFilterFailed = "json_filter_failed"
+
+var (
+	// errJSONFilterSyntax json_filter 不是合法的 jq 表达式, 或使用了未定义的函数
+	errJSONFilterSyntax = errors.New("invalid json_filter")
+	// errJSONFilterFailed 命令的输出不是 JSON, 或表达式不适用于输出的结构(如对数组取字段)
+	errJSONFilterFailed = errors.New("json_filter failed")
+)
+
+// jsonFilter 编译后的 jq 表达式, 由 gojq 执行
+// 表达式中不能读取服务进程的环境变量($ENV、env 为空), 也不能使用 input、inputs
+type jsonFilter struct {
+	code *gojq.Code
+}
+
+// parseJSONFilter 解析并编译 json_filter, 语法错误和未定义的函数返回 errJSONFilterSyntax
+func parseJSONFilter(expr string) (*jsonFilter, error) {
+	if len(expr) > maxJSONFilterLength {
+		return nil, fmt.Errorf("%w: longer than %d bytes", errJSONFilterSyntax, maxJSONFilterLength)
+	}
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		var parseErr *gojq.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("%w: %v at offset %d", errJSONFilterSyntax, err, parseErr.Offset)
+		}
+		return nil, fmt.Errorf("%w: %v", errJSONFilterSyntax, err)
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJSONFilterSyntax, err)
+	}
+	return &jsonFilter{code: code}, nil
+}
+
+// apply 对 JSON 文本执行表达式, 返回结果的 JSON 文本
+// 只有一个结果时为该结果, 没有结果或有多个结果时为由所有结果组成的数组
+func (f *jsonFilter) apply(data []byte) (json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// 保持整数的精度, gojq 将超出 int 范围的整数作为大整数处理
+	dec.UseNumber()
+	var input interface{}
+	if err := dec.Decode(&input); err != nil {
+		return nil, fmt.Errorf("%w: output is not valid JSON", errJSONFilterFailed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jsonFilterTimeout)
+	defer cancel()
+	values := []interface{}{}
+	iter := f.code.RunWithContext(ctx, input)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, isErr := v.(error); isErr {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%w: did not finish within %s", errJSONFilterFailed, jsonFilterTimeout)
+			}
+			return nil, fmt.Errorf("%w: %v", errJSONFilterFailed, err)
+		}
+		if len(values) == maxJSONFilterResults {
+			return nil, fmt.Errorf("%w: more than %d results", errJSONFilterFailed, maxJSONFilterResults)
+		}
+		values = append(values, v)
+	}
+
+	var result interface{} = values
+	if len(values) == 1 {
+		result = values[0]
+	}
+	// 与 jq 相同: 对象的键按字母顺序, NaN 为 null, 不转义字符串中的 <、>、&
+	out, err := gojq.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJSONFilterFailed, err)
+	}
+	return json.RawMessage(out), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// processesJSON 示例的 ConvertTo-Json 输出
+const processesJSON = `[{"Name":"pwsh","Id":1204,"Tags":["a<b"]},{"Name":"svchost","Id":880,"Handle":12345678901234567890}]`
+
+func TestJSONFilter(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{".", `[{"Id":1204,"Name":"pwsh","Tags":["a<b"]},{"Handle":12345678901234567890,"Id":880,"Name":"svchost"}]`},
+		{".[0].Name", `"pwsh"`},
+		{".[-1].Id", `880`},
+		{".[5].Name", `null`},
+		// 多个结果组成数组, 超出 int64 的整数保持精度
+		{".[].Id", `[1204,880]`},
+		{".[1].Handle", `12345678901234567890`},
+		{`.[] | select(.Id > 1000) | .Name`, `"pwsh"`},
+		{`[.[] | select(.Id > 1000) | .Name]`, `["pwsh"]`},
+		{`map({(.Name): .Id}) | add`, `{"pwsh":1204,"svchost":880}`},
+		{".[0].Tags[0]", `"a<b"`},
+		{"length", `2`},
+		{".[] | select(.Id < 0)", `[]`},
+		// 不能读取服务进程的环境变量
+		{"$ENV | length", `0`},
+	}
+	for _, tt := range tests {
+		f, err := parseJSONFilter(tt.expr)
+		if err != nil {
+			t.Errorf("parse %q: %v", tt.expr, err)
+			continue
+		}
+		got, err := f.apply([]byte(processesJSON))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("apply %q = %s, %v, want %s", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestJSONFilterErrors(t *testing.T) {
+	for _, expr := range []string{".[", ".a |", "no_such_function", "input", strings.Repeat(".a", maxJSONFilterLength)} {
+		if _, err := parseJSONFilter(expr); !errors.Is(err, errJSONFilterSyntax) {
+			t.Errorf("parse %q = %v, want errJSONFilterSyntax", expr, err)
+		}
+	}
+	tests := []struct{ expr, input string }{
+		{".[0].Name", `"text"`},
+		{".[]", `null`},
+		{`error("bad")`, `{}`},
+		{".", `not json`},
+		// 产生的结果过多
+		{"range(1000000)", `0`},
+	}
+	for _, tt := range tests {
+		f, err := parseJSONFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.expr, err)
+		}
+		if _, err := f.apply([]byte(tt.input)); !errors.Is(err, errJSONFilterFailed) {
+			t.Errorf("apply %q to %s = %v, want errJSONFilterFailed", tt.expr, tt.input, err)
+		}
+	}
+}
+
+func TestRunCommandJSONFilter(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Process": {Output: processesJSON}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh"})
+	resp, data := ts.run(aliceToken, id, "Get-Process", map[string]any{"output_format": "json", "json_filter": ".[].Name"})
+	if resp.StatusCode != http.StatusOK || string(data) != `["pwsh","svchost"]` {
+		t.Fatalf("filtered = %d %s", resp.StatusCode, data)
+	}
+
+	// 语法错误在执行命令前返回 400
+	resp, data = ts.run(aliceToken, id, "Get-Process", map[string]any{"output_format": "json", "json_filter": ".[] |"})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "invalid json_filter") {
+		t.Fatalf("syntax error = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, id, "Get-Process", map[string]any{"json_filter": ".[].Name"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("json_filter with text output = %d %s", resp.StatusCode, data)
+	}
+
+	// 不适用于输出的结构时返回 422, result 为未经过滤的结果
+	resp, data = ts.run(aliceToken, id, "Get-Process", map[string]any{"output_format": "json", "json_filter": ".Name"})
+	if resp.StatusCode != http.StatusUnprocessableEntity || errorCodeOf(t, data) != codeJSONFilterFailed || !strings.Contains(string(data), `"Name":"svchost"`) {
+		t.Fatalf("filter failure = %d %s", resp.StatusCode, data)
+	}
+}
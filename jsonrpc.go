@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// JSON-RPC 2.0 标准错误码
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	// rpcServerError 业务错误, data.status 和 data.code 为对应的 HTTP 状态码和错误码
+	rpcServerError = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcBatchEnvelope 带总超时的批量请求, 请求体为对象而不是数组, Batch 为标准的批量请求
+// JSON-RPC 的请求体本身是请求或请求数组, 没有放置整个批量请求参数的位置, 因此用外层对象携带
+type rpcBatchEnvelope struct {
+	// TotalTimeoutMs 批量请求中所有 run_command 共享的总超时(毫秒), 与组命令的字段相同
+	TotalTimeoutMs int             `json:"total_timeout_ms"`
+	Batch          json.RawMessage `json:"batch"`
+}
+
+// rpcNullID 无法解析请求 ID 时使用 null
+var rpcNullID = json.RawMessage("null")
+
+// API7: JSON-RPC 2.0, 方法与 REST 接口共用同一套实现
+func handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("✗ Failed to read request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	var total time.Duration
+	if len(body) > 0 && body[0] == '{' {
+		var envelope rpcBatchEnvelope
+		if json.Unmarshal(body, &envelope) == nil && envelope.Batch != nil {
+			if total, err = totalTimeout(envelope.TotalTimeoutMs); err != nil {
+				log.Printf("✗ Invalid total timeout | TotalTimeoutMs: %d", envelope.TotalTimeoutMs)
+				writeError(w, err)
+				return
+			}
+			if body = bytes.TrimSpace(envelope.Batch); len(body) == 0 || body[0] != '[' {
+				writeError(w, newAPIError(http.StatusBadRequest, "batch must be an array of JSON-RPC requests"))
+				return
+			}
+		}
+	}
+	// 批量请求中的 run_command 共享同一个截止时间, 用完后之后的命令不再执行
+	budget, cancel := newBudget(total)
+	defer cancel()
+
+	identity := identityFrom(r)
+	// 批量请求中的命令都使用本次请求的请求头
+	env := forwardedEnv(r.Header)
+
+	var response interface{}
+	if len(body) > 0 && body[0] == '[' {
+		// 批量请求
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			response = rpcErrorResponse(rpcNullID, rpcParseError, "Parse error", nil)
+		} else if len(batch) == 0 {
+			response = rpcErrorResponse(rpcNullID, rpcInvalidRequest, "Invalid Request", nil)
+		} else {
+			responses := make([]*rpcResponse, 0, len(batch))
+			for _, raw := range batch {
+				if resp := dispatchRPC(identity, env, budget, raw); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				response = responses
+			}
+		}
+	} else {
+		if resp := dispatchRPC(identity, env, budget, body); resp != nil {
+			response = resp
+		}
+	}
+
+	// 只包含通知的请求没有响应内容
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// dispatchRPC 处理单个请求, 通知(没有 id)返回 nil
+func dispatchRPC(identity *Identity, env []envVar, budget context.Context, raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		var probe interface{}
+		if json.Unmarshal(raw, &probe) != nil {
+			return rpcErrorResponse(rpcNullID, rpcParseError, "Parse error", nil)
+		}
+		return rpcErrorResponse(rpcNullID, rpcInvalidRequest, "Invalid Request", nil)
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		id := req.ID
+		if id == nil {
+			id = rpcNullID
+		}
+		return rpcErrorResponse(id, rpcInvalidRequest, "Invalid Request", nil)
+	}
+
+	log.Printf("→ Request: JSON-RPC | Method: %s", req.Method)
+	result, rpcErr := callRPC(identity, env, budget, req.Method, req.Params)
+
+	if req.ID == nil {
+		return nil
+	}
+	if rpcErr != nil {
+		return &rpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+// rpcAdmitted 与 REST 执行类接口对应、需要经过准入控制的方法
+// run_command_async 在 submitCommand 中单独占用名额, 直到任务执行完
+var rpcAdmitted = map[string]bool{
+	"start_session":   true,
+	"clone_session":   true,
+	"restart_session": true,
+	"run_command":     true,
+	"open_subshell":   true,
+	"run_in_subshell": true,
+}
+
+// callRPC 将方法映射到 SessionManager 的操作, env 为从请求头转发的环境变量
+// budget 不为空时为批量请求的 total_timeout_ms, run_command 在其截止时间之前执行
+func callRPC(identity *Identity, env []envVar, budget context.Context, method string, params json.RawMessage) (interface{}, *rpcError) {
+	if rpcAdmitted[method] {
+		if !admission.Enter() {
+			log.Printf("✗ Request shed | Method: %s | Depth: %d", method, admission.Depth())
+			return nil, toRPCError(overloadedError(), nil)
+		}
+		defer admission.Exit()
+	}
+
+	switch method {
+	case "start_session":
+		var opts SessionOptions
+		if err := decodeRPCParams(params, &opts); err != nil {
+			return nil, err
+		}
+		session, err := startSession(identity, opts)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return map[string]string{"session_id": session.ID}, nil
+
+	case "clone_session":
+		var req CloneSessionRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		resp, err := cloneSession(identity, req)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "restart_session":
+		var req RestartSessionRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		resp, err := restartSession(identity, req)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "run_command":
+		var req RunCommandRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		req.env = env
+		req.budget = budget
+		result, file, err := runCommand(identity, req)
+		data := runCommandResponse(result, file)
+		if err != nil {
+			// 超时时在 data 中附带部分输出
+			return nil, toRPCError(err, data)
+		}
+		return data, nil
+
+	case "run_command_async":
+		var req RunCommandRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		req.env = env
+		resp, err := submitCommand(identity, req)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "command_result":
+		var req struct {
+			JobID  string `json:"job_id"`
+			WaitMs int    `json:"wait_ms"`
+		}
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		resp, err := commandResult(identity, req.JobID, time.Duration(req.WaitMs)*time.Millisecond)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "open_subshell":
+		var req SubShellRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		subID, err := openSubShell(identity, req)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return map[string]string{"session_id": req.SessionID, "subshell_id": subID}, nil
+
+	case "run_in_subshell":
+		var req SubShellRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		result, err := runInSubShell(identity, req)
+		if err != nil {
+			// 超时时在 data 中附带结果
+			return nil, toRPCError(err, runCommandResponse(result, nil))
+		}
+		return result, nil
+
+	case "close_subshell":
+		var req SubShellRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		if err := closeSubShell(identity, req); err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return map[string]string{"message": "Sub-shell closed successfully"}, nil
+
+	case "end_session":
+		var req EndSessionRequest
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		resp, err := endSession(identity, req)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "get_transcript":
+		var req struct {
+			SessionID string `json:"session_id"`
+		}
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		resp, err := fetchTranscript(identity, req.SessionID)
+		if err != nil {
+			return nil, toRPCError(err, nil)
+		}
+		return resp, nil
+
+	case "list_sessions":
+		var req struct {
+			// Label 与 GET /sessions 的 label 参数相同
+			Label []string `json:"label"`
+		}
+		if err := decodeRPCParams(params, &req); err != nil {
+			return nil, err
+		}
+		selector, err := parseLabelSelector(req.Label)
+		if err != nil {
+			return nil, toRPCError(newAPIError(http.StatusBadRequest, "%v", err), nil)
+		}
+		sessions, err := sessionManager.ListSessions(identity, selector)
+		if err != nil {
+			return nil, toRPCError(newAPIError(http.StatusInternalServerError, "%v", err), nil)
+		}
+		return map[string]interface{}{"sessions": sessions}, nil
+
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found"}
+	}
+}
+
+// decodeRPCParams 解析按名称传递的参数, 参数可省略
+func decodeRPCParams(params json.RawMessage, v interface{}) *rpcError {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: "Invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// toRPCError 将业务错误转换为 JSON-RPC 错误对象
+func toRPCError(err error, result interface{}) *rpcError {
+	status := errorStatus(err)
+	code := rpcServerError
+	switch {
+	case status == http.StatusBadRequest:
+		code = rpcInvalidParams
+	case status >= http.StatusInternalServerError && status != http.StatusGatewayTimeout:
+		code = rpcInternalError
+	}
+
+	data := map[string]interface{}{"status": status, "code": errorCode(err)}
+	var ae *apiError
+	if errors.As(err, &ae) && ae.Busy != nil {
+		data["busy"] = ae.Busy
+	}
+	if result != nil {
+		data["result"] = result
+	}
+	return &rpcError{Code: code, Message: err.Error(), Data: data}
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string, data interface{}) *rpcResponse {
+	return &rpcResponse{
+		JSONRPC: "2.0",
+		Error:   &rpcError{Code: code, Message: message, Data: data},
+		ID:      id,
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJWTLeeway exp 和 nbf 允许的默认时钟偏差
+	defaultJWTLeeway = time.Minute
+	// defaultJWKSRefresh 定期重新获取 JWKS 的默认间隔
+	defaultJWKSRefresh = time.Hour
+	// minJWKSRefetch 遇到未知 kid 时重新获取 JWKS 的最短间隔, 防止伪造的 kid 引发大量请求
+	minJWKSRefetch = time.Minute
+	// jwksFetchTimeout 获取 JWKS 的超时
+	jwksFetchTimeout = 10 * time.Second
+	// maxJWKSSize JWKS 响应体的上限
+	maxJWKSSize = 1 << 20
+	// jwtIdentityPrefix JWT 身份的租户名前缀, 与同名的令牌和证书身份不属于同一租户
+	jwtIdentityPrefix = "jwt:"
+)
+
+// JWTConfig 以 JWT 作为 Bearer Token 的认证后端, 签名用 JWKS 中的公钥校验, sub 加上 jwtIdentityPrefix 作为租户
+type JWTConfig struct {
+	// JWKSURL 提供签名公钥的 JWKS 地址
+	JWKSURL string `json:"jwks_url"`
+	// Issuer JWT 的 iss 必须与之相同
+	Issuer string `json:"issuer"`
+	// Audience 不为空时 JWT 的 aud 必须包含该值
+	Audience string `json:"audience"`
+	// AdminSubjects 作为管理员的 sub, 不带前缀
+	AdminSubjects []string `json:"admin_subjects"`
+	// Leeway 校验 exp 和 nbf 时允许的时钟偏差
+	Leeway Duration `json:"leeway"`
+	// RefreshInterval 定期重新获取 JWKS 的间隔
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+// UnmarshalJSON 未设置的字段使用默认值
+func (c *JWTConfig) UnmarshalJSON(data []byte) error {
+	type plain JWTConfig
+	v := plain{
+		Leeway:          Duration(defaultJWTLeeway),
+		RefreshInterval: Duration(defaultJWKSRefresh),
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = JWTConfig(v)
+	return nil
+}
+
+func (c *JWTConfig) validate() error {
+	u, err := url.Parse(c.JWKSURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("jwt jwks_url must be an http or https URL")
+	}
+	if c.Issuer == "" {
+		return fmt.Errorf("jwt issuer is required")
+	}
+	if c.Leeway < 0 {
+		return fmt.Errorf("jwt leeway must not be negative")
+	}
+	if time.Duration(c.RefreshInterval) < minJWKSRefetch {
+		return fmt.Errorf("jwt refresh_interval must be at least %s", minJWKSRefetch)
+	}
+	return nil
+}
+
+// jwtAlgorithms 支持的签名算法, 不接受 none 和 HS256 等对称算法
+var jwtAlgorithms = map[string]struct {
+	kty  string
+	hash crypto.Hash
+}{
+	"RS256": {"RSA", crypto.SHA256},
+	"RS384": {"RSA", crypto.SHA384},
+	"RS512": {"RSA", crypto.SHA512},
+	"ES256": {"EC", crypto.SHA256},
+	"ES384": {"EC", crypto.SHA384},
+	"ES512": {"EC", crypto.SHA512},
+}
+
+// jwk JWKS 中的一个公钥
+type jwk struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// JWTAuth 校验 Bearer Token 中的 JWT
+type JWTAuth struct {
+	cfg    *JWTConfig
+	admins map[string]bool
+	client *http.Client
+	// now 当前时间, 校验 exp 和 nbf 时使用
+	now func() time.Time
+
+	// fetchMu 同一时间只获取一次 JWKS
+	fetchMu sync.Mutex
+	mu      sync.RWMutex
+	keys    map[string]*jwk
+	fetched time.Time
+}
+
+// NewJWTAuth 创建 JWT 后端并获取 JWKS, 获取失败时只记录日志, 之后遇到未知 kid 时重试
+func NewJWTAuth(cfg *JWTConfig) *JWTAuth {
+	a := &JWTAuth{
+		cfg:    cfg,
+		admins: make(map[string]bool, len(cfg.AdminSubjects)),
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		now:    time.Now,
+		keys:   make(map[string]*jwk),
+	}
+	for _, sub := range cfg.AdminSubjects {
+		a.admins[sub] = true
+	}
+	if err := a.refresh(); err != nil {
+		log.Printf("⚠ Failed to fetch JWKS | URL: %s | Error: %v", cfg.JWKSURL, err)
+	}
+	return a
+}
+
+// fetchedAt 上次开始获取 JWKS 的时间
+func (a *JWTAuth) fetchedAt() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.fetched
+}
+
+// Run 按 refresh_interval 定期重新获取 JWKS, 不返回
+func (a *JWTAuth) Run() {
+	ticker := time.NewTicker(time.Duration(a.cfg.RefreshInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.refresh(); err != nil {
+			log.Printf("⚠ Failed to refresh JWKS, keeping previous keys | URL: %s | Error: %v", a.cfg.JWKSURL, err)
+		}
+	}
+}
+
+// refresh 获取 JWKS 并替换当前的公钥
+func (a *JWTAuth) refresh() error {
+	a.fetchMu.Lock()
+	defer a.fetchMu.Unlock()
+	return a.fetch()
+}
+
+// fetch 获取 JWKS, 获取失败时保留之前的公钥, 调用方需持有 fetchMu
+func (a *JWTAuth) fetch() error {
+	a.mu.Lock()
+	a.fetched = time.Now()
+	a.mu.Unlock()
+
+	resp, err := a.client.Get(a.cfg.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxJWKSSize {
+		return fmt.Errorf("JWKS exceeds %d bytes", maxJWKSSize)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	log.Printf("✓ JWKS loaded | URL: %s | Keys: %d", a.cfg.JWKSURL, len(keys))
+	return nil
+}
+
+// parseJWKS 解析 JWKS 中的 RSA 和 EC 签名公钥, 跳过其他用途和不支持的密钥
+func parseJWKS(data []byte) (map[string]*jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]*jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if errX != nil || errY != nil || !curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key = pub
+		default:
+			continue
+		}
+		keys[k.Kid] = &jwk{alg: k.Alg, key: key}
+	}
+	return keys, nil
+}
+
+// key 返回 kid 对应的公钥, 没有 kid 时只有一个公钥才使用它
+// 找不到时距上次获取超过 minJWKSRefetch 则重新获取一次, 以支持签名密钥轮换
+func (a *JWTAuth) key(kid string) (*jwk, error) {
+	lookup := func() (*jwk, bool) {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		if kid == "" && len(a.keys) == 1 {
+			for _, k := range a.keys {
+				return k, true
+			}
+		}
+		k, ok := a.keys[kid]
+		return k, ok
+	}
+
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	if time.Since(a.fetchedAt()) < minJWKSRefetch {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	a.fetchMu.Lock()
+	// 等待期间其他请求可能已重新获取过
+	if time.Since(a.fetchedAt()) >= minJWKSRefetch {
+		if err := a.fetch(); err != nil {
+			log.Printf("⚠ Failed to fetch JWKS | URL: %s | Error: %v", a.cfg.JWKSURL, err)
+		}
+	}
+	a.fetchMu.Unlock()
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// Authenticate 请求的 Bearer Token 不是 JWT 时返回 false, 不记录日志
+func (a *JWTAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, false
+	}
+	sub, err := a.verify(token)
+	if err != nil {
+		log.Printf("✗ Invalid JWT | Path: %s | Remote: %s | Error: %v", r.URL.Path, r.RemoteAddr, err)
+		return nil, false
+	}
+	return &Identity{Name: jwtIdentityPrefix + sub, Admin: a.admins[sub], Method: authMethodJWT}, true
+}
+
+// jwtClaims 校验时使用的 claim, aud 可以是字符串或字符串数组
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verify 校验签名和 claim, 返回 sub
+func (a *JWTAuth) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid header encoding")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return "", fmt.Errorf("invalid header")
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return "", fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+	k, err := a.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if k.alg != "" && k.alg != header.Alg {
+		return "", fmt.Errorf("key %q is for %s, token uses %s", header.Kid, k.alg, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding")
+	}
+	if err := verifyJWTSignature(k.key, alg.kty, alg.hash, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid payload encoding")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("invalid claims")
+	}
+	if err := a.checkClaims(&claims); err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// verifyJWTSignature 用公钥校验签名, 公钥类型必须与算法一致
+func verifyJWTSignature(key crypto.PublicKey, kty string, hash crypto.Hash, signed string, signature []byte) error {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if kty != "RSA" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if kty != "EC" {
+			break
+		}
+		// JWS 中的 ECDSA 签名为定长的 r 和 s 拼接
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature mismatch")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	}
+	return errors.New("key type does not match alg")
+}
+
+// checkClaims 检查 iss、aud、exp、nbf 和 sub, exp 必须存在
+func (a *JWTAuth) checkClaims(claims *jwtClaims) error {
+	if claims.Issuer != a.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.cfg.Audience != "" && !audienceContains(claims.Audience, a.cfg.Audience) {
+		return fmt.Errorf("token is not for audience %q", a.cfg.Audience)
+	}
+	now := a.now()
+	leeway := time.Duration(a.cfg.Leeway)
+	if claims.ExpiresAt == nil {
+		return fmt.Errorf("token has no exp")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(leeway)) {
+		return fmt.Errorf("token expired at %s", unixTime(*claims.ExpiresAt).UTC().Format(time.RFC3339))
+	}
+	if claims.NotBefore != nil && now.Add(leeway).Before(unixTime(*claims.NotBefore)) {
+		return fmt.Errorf("token is not valid before %s", unixTime(*claims.NotBefore).UTC().Format(time.RFC3339))
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("token has no sub")
+	}
+	return nil
+}
+
+// audienceContains aud 为字符串时与 audience 相同, 为数组时包含 audience
+func audienceContains(aud json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) == nil {
+		for _, v := range list {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxNumericDate NumericDate 的上限(约公元 2262 年), 即 time.Duration 能表示的最大秒数, 更大的值按上限处理, 避免转换溢出
+const maxNumericDate = math.MaxInt64 / int64(time.Second)
+
+// unixTime 把 NumericDate(秒, 可以有小数)转为时间
+func unixTime(seconds float64) time.Time {
+	if limit := float64(maxNumericDate); seconds > limit {
+		seconds = limit
+	} else if seconds < -limit {
+		seconds = -limit
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second)))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://idp.example.com"
+
+// testJWKS 提供 JWKS 的测试服务器, 记录被获取的次数
+type testJWKS struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches atomic.Int32
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	j := &testJWKS{}
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.fetches.Add(1)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": j.keys})
+	}))
+	t.Cleanup(j.Close)
+	return j
+}
+
+// add 把公钥加入 JWKS
+func (j *testJWKS) add(kid string, key crypto.Signer) {
+	enc := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	k := map[string]string{"kid": kid, "use": "sig"}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		k["kty"], k["n"], k["e"] = "RSA", enc(pub.N.Bytes()), enc(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k["kty"], k["crv"], k["x"], k["y"] = "EC", pub.Curve.Params().Name, enc(pub.X.FillBytes(make([]byte, size))), enc(pub.Y.FillBytes(make([]byte, size)))
+	}
+	j.mu.Lock()
+	j.keys = append(j.keys, k)
+	j.mu.Unlock()
+}
+
+// signJWT 以 key 签发 JWT, RSA 密钥使用 RS256, EC 密钥使用 ES256
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims 对测试服务器有效的 claim
+func validClaims(sub string) map[string]any {
+	return map[string]any{"iss": testIssuer, "sub": sub, "aud": []string{"rce"}, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+// newJWTServer 启动同时接受静态令牌和 JWT 的测试服务器
+func newJWTServer(t *testing.T, jwks *testJWKS) (*testServer, *JWTAuth) {
+	ts := newTestServer(t, nil)
+	cfg := &JWTConfig{JWKSURL: jwks.URL, Issuer: testIssuer, Audience: "rce", AdminSubjects: []string{"root"}, Leeway: Duration(time.Minute), RefreshInterval: Duration(time.Hour)}
+	auth := NewJWTAuth(cfg)
+	tokenAuth.Credentials = append(tokenAuth.Credentials, auth)
+	return ts, auth
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newTestJWKS(t)
+	jwks.add("rsa", rsaKey)
+	jwks.add("ec", ecKey)
+	ts, _ := newJWTServer(t, jwks)
+
+	// sub 加上 jwt: 前缀作为租户, 与同名的令牌不属于同一租户
+	for kid, key := range map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey} {
+		status, out := ts.whoami(signJWT(t, key, kid, validClaims("alice")))
+		if status != http.StatusOK || out.Tenant != "jwt:alice" || out.Method != authMethodJWT || out.Admin {
+			t.Fatalf("%s token = %d %+v", kid, status, out)
+		}
+	}
+	if status, out := ts.whoami(signJWT(t, rsaKey, "rsa", validClaims("root"))); status != http.StatusOK || out.Tenant != "jwt:root" || !out.Admin {
+		t.Fatalf("admin subject = %d %+v", status, out)
+	}
+	// 静态令牌仍然可用
+	if status, out := ts.whoami(aliceToken); status != http.StatusOK || out.Tenant != "alice" {
+		t.Fatalf("static token = %d %+v", status, out)
+	}
+
+	id := ts.startSession(aliceToken, nil)
+	if resp, _ := ts.run(signJWT(t, rsaKey, "rsa", validClaims("alice")), id, "echo hi", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("JWT subject used a token's session: %d", resp.StatusCode)
+	}
+}
+
+func TestJWTAuthRejects(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := newTestJWKS(t)
+	jwks.add("rsa", rsaKey)
+	ts, _ := newJWTServer(t, jwks)
+
+	// with 修改或删除(value 为 nil)一个 claim
+	with := func(key string, value any) map[string]any {
+		claims := validClaims("alice")
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	valid := signJWT(t, rsaKey, "rsa", validClaims("alice"))
+	parts := strings.Split(valid, ".")
+	unsigned := func(alg string) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","kid":"rsa"}`))
+		return header + "." + parts[1] + "." + parts[2]
+	}
+	tokens := map[string]string{
+		"wrong issuer":    signJWT(t, rsaKey, "rsa", with("iss", "https://evil.example.com")),
+		"wrong audience":  signJWT(t, rsaKey, "rsa", with("aud", "other")),
+		"expired":         signJWT(t, rsaKey, "rsa", with("exp", time.Now().Add(-2*time.Minute).Unix())),
+		"no exp":          signJWT(t, rsaKey, "rsa", with("exp", nil)),
+		"not yet valid":   signJWT(t, rsaKey, "rsa", with("nbf", time.Now().Add(2*time.Minute).Unix())),
+		"no sub":          signJWT(t, rsaKey, "rsa", with("sub", nil)),
+		"wrong key":       signJWT(t, otherKey, "rsa", validClaims("alice")),
+		"tampered claims": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+testIssuer+`","sub":"root","aud":"rce","exp":9999999999}`)) + "." + parts[2],
+		"alg none":        unsigned("none"),
+		"alg HS256":       unsigned("HS256"),
+	}
+	for name, token := range tokens {
+		if status, out := ts.whoami(token); status != http.StatusUnauthorized {
+			t.Errorf("%s = %d %+v", name, status, out)
+		}
+	}
+	// 时钟偏差在 leeway 之内时接受
+	if status, _ := ts.whoami(signJWT(t, rsaKey, "rsa", with("exp", time.Now().Add(-30*time.Second).Unix()))); status != http.StatusOK {
+		t.Fatalf("exp within leeway = %d", status)
+	}
+}
+
+func TestJWKSRefetchOnUnknownKid(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newTestJWKS(t)
+	jwks.add("old", oldKey)
+	ts, auth := newJWTServer(t, jwks)
+	if n := jwks.fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times at startup", n)
+	}
+
+	// 轮换签名密钥后, 距上次获取不到 minJWKSRefetch 时不重新获取
+	jwks.add("new", newKey)
+	token := signJWT(t, newKey, "new", validClaims("alice"))
+	if status, _ := ts.whoami(token); status != http.StatusUnauthorized || jwks.fetches.Load() != 1 {
+		t.Fatalf("unknown kid = %d, %d fetches", status, jwks.fetches.Load())
+	}
+	auth.mu.Lock()
+	auth.fetched = time.Now().Add(-minJWKSRefetch)
+	auth.mu.Unlock()
+	if status, _ := ts.whoami(token); status != http.StatusOK || jwks.fetches.Load() != 2 {
+		t.Fatalf("rotated key = %d, %d fetches", status, jwks.fetches.Load())
+	}
+	// 伪造的 kid 在 minJWKSRefetch 内不会再次引发获取
+	for i := 0; i < 3; i++ {
+		ts.whoami(signJWT(t, newKey, "forged", validClaims("alice")))
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Fatalf("forged kids caused %d fetches", n)
+	}
+}
+
+func TestJWTNumericDateOverflow(t *testing.T) {
+	jwks := newTestJWKS(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks.add("ec", key)
+	ts, _ := newJWTServer(t, jwks)
+
+	// 超出 time.Duration 范围的 exp 不会溢出为过去的时间, nbf 不会溢出为更早的时间
+	for _, exp := range []float64{1e10, 1e11, 1 << 40, 1e300} {
+		if at := unixTime(exp); !at.After(time.Now().AddDate(200, 0, 0)) {
+			t.Fatalf("unixTime(%g) = %s", exp, at)
+		}
+		claims := validClaims("alice")
+		claims["exp"] = exp
+		if status, _ := ts.whoami(signJWT(t, key, "ec", claims)); status != http.StatusOK {
+			t.Fatalf("exp %g = %d", exp, status)
+		}
+		claims["nbf"] = exp
+		if status, _ := ts.whoami(signJWT(t, key, "ec", claims)); status != http.StatusUnauthorized {
+			t.Fatalf("nbf %g = %d", exp, status)
+		}
+	}
+	if at := unixTime(-1e300); !at.Before(time.Unix(0, 0)) {
+		t.Fatalf("unixTime(-1e300) = %s", at)
+	}
+	if at := unixTime(1.5); !at.Equal(time.Unix(1, 5e8)) {
+		t.Fatalf("unixTime(1.5) = %s", at)
+	}
+}
+
+func TestJWTConfig(t *testing.T) {
+	var cfg JWTConfig
+	if err := json.Unmarshal([]byte(`{"jwks_url": "https://idp.example.com/jwks", "issuer": "idp"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Leeway != Duration(defaultJWTLeeway) || cfg.RefreshInterval != Duration(defaultJWKSRefresh) || cfg.validate() != nil {
+		t.Fatalf("defaults = %+v", cfg)
+	}
+	for _, bad := range []JWTConfig{
+		{JWKSURL: "file:///jwks.json", Issuer: "idp", RefreshInterval: Duration(time.Hour)},
+		{JWKSURL: "https://idp.example.com/jwks", RefreshInterval: Duration(time.Hour)},
+		{JWKSURL: "https://idp.example.com/jwks", Issuer: "idp", Leeway: -1, RefreshInterval: Duration(time.Hour)},
+		{JWKSURL: "https://idp.example.com/jwks", Issuer: "idp", RefreshInterval: Duration(time.Second)},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("validate(%+v) accepted", bad)
+		}
+	}
+
+	// 令牌名不能占用 JWT 身份的前缀
+	c := DefaultConfig()
+	c.Tokens = []TokenConfig{{Name: "jwt:alice", Token: "t"}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "jwt:") {
+		t.Fatalf("jwt: token name = %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxLabels 每个会话的标签数上限
+const maxLabels = 32
+
+var (
+	// labelKey 标签名: 以字母或数字开头, 最长 63 个字符, 可包含 . _ - /
+	labelKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+	// labelValue 标签值: 最长 63 个字符, 可以为空
+	labelValue = regexp.MustCompile(`^[A-Za-z0-9._-]{0,63}$`)
+)
+
+// validateLabels 检查会话标签的数量、名称和值
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%w: labels: at most %d labels", errInvalidOptions, maxLabels)
+	}
+	for key, value := range labels {
+		if !labelKey.MatchString(key) {
+			return fmt.Errorf("%w: labels: invalid key %q, use up to 63 letters, digits, '.', '_', '-' or '/' starting with a letter or digit", errInvalidOptions, key)
+		}
+		if !labelValue.MatchString(value) {
+			return fmt.Errorf("%w: labels: invalid value %q for %s, use up to 63 letters, digits, '.', '_' or '-'", errInvalidOptions, value, key)
+		}
+	}
+	return nil
+}
+
+// formatLabels 按名称排序输出标签, 用于日志
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// labelSelector 列出会话时的标签条件, 所有条件都满足才匹配
+// 值为 nil 的条件只要求存在该标签
+type labelSelector map[string]*string
+
+// parseLabelSelector 解析 label 查询参数, 每个参数可以是逗号分隔的多个 key=value 或 key
+func parseLabelSelector(params []string) (labelSelector, error) {
+	selector := make(labelSelector)
+	for _, param := range params {
+		for _, term := range strings.Split(param, ",") {
+			key, value, hasValue := strings.Cut(strings.TrimSpace(term), "=")
+			if !labelKey.MatchString(key) || (hasValue && !labelValue.MatchString(value)) {
+				return nil, fmt.Errorf("invalid label selector %q, use key=value or key", term)
+			}
+			if _, exists := selector[key]; exists {
+				return nil, fmt.Errorf("label %s is given more than once in the selector", key)
+			}
+			if hasValue {
+				selector[key] = &value
+			} else {
+				selector[key] = nil
+			}
+		}
+	}
+	return selector, nil
+}
+
+// matches 判断会话标签是否满足所有条件
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for key, want := range sel {
+		value, ok := labels[key]
+		if !ok || (want != nil && value != *want) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidateLabels(t *testing.T) {
+	if err := validateLabels(map[string]string{"team": "infra", "app.kubernetes.io/name": "web-1", "empty": ""}); err != nil {
+		t.Fatalf("valid labels = %v", err)
+	}
+	many := map[string]string{}
+	for i := 0; i <= maxLabels; i++ {
+		many[strings.Repeat("k", i+1)] = "v"
+	}
+	for _, labels := range []map[string]string{
+		many,
+		{"-team": "infra"},
+		{strings.Repeat("k", 64): "v"},
+		{"team": "has space"},
+		{"team": "a=b"},
+	} {
+		if err := validateLabels(labels); !errors.Is(err, errInvalidOptions) {
+			t.Errorf("validate %d labels = %v, want errInvalidOptions", len(labels), err)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	sel, err := parseLabelSelector([]string{"team=infra,env", " tier=web "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"team": "infra", "env": "prod", "tier": "web"}, true},
+		// 只写名称的条件匹配任意值, 包括空值
+		{map[string]string{"team": "infra", "env": "", "tier": "web"}, true},
+		{map[string]string{"team": "infra", "tier": "web"}, false},
+		{map[string]string{"team": "data", "env": "prod", "tier": "web"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := sel.matches(tt.labels); got != tt.want {
+			t.Errorf("matches(%v) = %t, want %t", tt.labels, got, tt.want)
+		}
+	}
+	if empty, _ := parseLabelSelector(nil); !empty.matches(nil) {
+		t.Error("empty selector does not match")
+	}
+	for _, bad := range [][]string{{"team=infra", "team=data"}, {"=x"}, {"team=a b"}, {"team,,env"}} {
+		if _, err := parseLabelSelector(bad); err == nil {
+			t.Errorf("parse %q accepted", bad)
+		}
+	}
+}
+
+// listSessions 按 label 查询参数列出会话, 返回会话 ID
+func (ts *testServer) listSessions(token string, labels ...string) (int, []string) {
+	ts.t.Helper()
+	query := url.Values{"label": labels}
+	resp, data := ts.do(http.MethodGet, token, "/sessions?"+query.Encode(), nil)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var list struct {
+		Sessions []SessionSummary `json:"sessions"`
+	}
+	decodeJSON(ts.t, data, &list)
+	ids := []string{}
+	for _, s := range list.Sessions {
+		ids = append(ids, s.SessionID)
+	}
+	sort.Strings(ids)
+	return resp.StatusCode, ids
+}
+
+func TestListSessionsByLabel(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.JSONRPC = true })
+	web := ts.startSession(aliceToken, map[string]any{"labels": map[string]string{"tier": "web", "env": "prod"}})
+	db := ts.startSession(aliceToken, map[string]any{"labels": map[string]string{"tier": "db", "env": "prod"}})
+	ts.startSession(aliceToken, nil)
+	ts.startSession(bobToken, map[string]any{"labels": map[string]string{"tier": "web", "env": "prod"}})
+
+	prod := []string{web, db}
+	sort.Strings(prod)
+	tests := []struct {
+		labels []string
+		want   []string
+	}{
+		{[]string{"tier=web"}, []string{web}},
+		{[]string{"env=prod"}, prod},
+		{[]string{"env"}, prod},
+		{[]string{"env=prod", "tier=db"}, []string{db}},
+		{[]string{"env=prod,tier=cache"}, []string{}},
+	}
+	for _, tt := range tests {
+		// 其他租户的会话不出现在结果中
+		if status, ids := ts.listSessions(aliceToken, tt.labels...); status != http.StatusOK || strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("label %v = %d %v, want %v", tt.labels, status, ids, tt.want)
+		}
+	}
+	if status, _ := ts.listSessions(aliceToken, "tier=a b"); status != http.StatusBadRequest {
+		t.Errorf("invalid selector = %d", status)
+	}
+
+	resp, data := ts.post(aliceToken, "/rpc", map[string]any{"jsonrpc": "2.0", "id": 1, "method": "list_sessions", "params": map[string]any{"label": []string{"tier=db"}}})
+	var rpc struct {
+		Result struct {
+			Sessions []SessionSummary `json:"sessions"`
+		} `json:"result"`
+	}
+	decodeJSON(t, data, &rpc)
+	if resp.StatusCode != http.StatusOK || len(rpc.Result.Sessions) != 1 || rpc.Result.Sessions[0].SessionID != db || rpc.Result.Sessions[0].Labels["tier"] != "db" {
+		t.Fatalf("rpc list_sessions = %d %s", resp.StatusCode, data)
+	}
+
+	if resp, data = ts.post(aliceToken, "/start-session", map[string]any{"labels": map[string]string{"bad key": "v"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid labels = %d %s", resp.StatusCode, data)
+	}
+}
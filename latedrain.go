@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxLateOutputDrain late_output_drain 的上限, 每条命令结束后都要等待该时长
+	maxLateOutputDrain = time.Second
+	// lateOutputDrainRounds 持续有输出时最多等待 late_output_drain 的倍数, 之后不再等待
+	lateOutputDrainRounds = 10
+)
+
+// lateOutputBytes 结束标记之后读走并丢弃的输出字节数
+var lateOutputBytes atomic.Int64
+
+// drainLateOutput 读到结束标记后继续读取并丢弃 shell 紧接着写出的输出, 直到连续 window 没有输出
+// 命令启动的后台任务在标记之后写到控制台的内容不会混入下一条命令的输出; 调用方需持有 s.mu
+func (s *Session) drainLateOutput(window time.Duration, debug *debugCapture) {
+	quiet := time.NewTimer(window)
+	defer quiet.Stop()
+	limit := time.NewTimer(window * lateOutputDrainRounds)
+	defer limit.Stop()
+	aborted := s.aborted()
+
+	drained := 0
+	defer func() {
+		if drained > 0 {
+			lateOutputBytes.Add(int64(drained))
+			log.Printf("⚠ Discarded late output after marker | SessionID: %s | Bytes: %d", s.ID, drained)
+		}
+	}()
+	for {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				return
+			}
+			debug.add(chunk)
+			drained += len(chunk)
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(window)
+		case <-quiet.C:
+			return
+		case <-limit.C:
+			return
+		case <-s.interrupt:
+			return
+		case <-aborted:
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainLateOutput(t *testing.T) {
+	output := make(chan []byte, 16)
+	s := &Session{ID: "s", output: output}
+	before := lateOutputBytes.Load()
+
+	// 连续 window 没有输出时结束, 期间的输出全部丢弃
+	output <- []byte("late")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		output <- []byte("r")
+	}()
+	start := time.Now()
+	s.drainLateOutput(100*time.Millisecond, nil)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("drain returned after %s", elapsed)
+	}
+	if n := lateOutputBytes.Load() - before; n != 5 || len(output) != 0 {
+		t.Fatalf("drained %d bytes, %d chunks left", n, len(output))
+	}
+
+	// 持续有输出时最多等待 lateOutputDrainRounds 倍
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case output <- []byte("x"):
+				time.Sleep(2 * time.Millisecond)
+			}
+		}
+	}()
+	start = time.Now()
+	s.drainLateOutput(10*time.Millisecond, nil)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond*lateOutputDrainRounds+time.Second {
+		t.Fatalf("drain of continuous output took %s", elapsed)
+	}
+}
+
+func TestLateOutputDrain(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.LateOutputDrain = Duration(500 * time.Millisecond)
+	})
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+
+	// 后台任务在结束标记之后写出的内容不混入下一条命令的输出
+	ts.run(aliceToken, id, "{ sleep 0.1; echo late; } &", nil)
+	if resp, data := ts.run(aliceToken, id, "echo next", nil); resp.StatusCode != http.StatusOK || string(data) != "next" {
+		t.Fatalf("next command = %d %q", resp.StatusCode, data)
+	}
+	if _, metrics := ts.do(http.MethodGet, adminToken, "/metrics", nil); !strings.Contains(string(metrics), "rce_late_output_bytes_total") {
+		t.Fatal("late output metric missing")
+	}
+
+	cfg := DefaultConfig()
+	cfg.LateOutputDrain = Duration(2 * maxLateOutputDrain)
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("late_output_drain above the limit accepted")
+	}
+}
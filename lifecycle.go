@@ -0,0 +1,51 @@
+package main
+
+// sessionState 会话的生命周期状态, 只会按 created → running → ending → ended 的顺序前进
+type sessionState int32
+
+const (
+	// stateCreated 已创建, shell 尚未启动完成, 还不在会话列表中
+	stateCreated sessionState = iota
+	// stateRunning 已加入会话列表, 可以执行命令
+	stateRunning
+	// stateEnding EndSession 正在结束会话, 之后的结束请求和 watch 都不再处理
+	stateEnding
+	// stateEnded 进程已结束, 资源已释放
+	stateEnded
+)
+
+func (st sessionState) String() string {
+	switch st {
+	case stateCreated:
+		return "created"
+	case stateRunning:
+		return "running"
+	case stateEnding:
+		return "ending"
+	case stateEnded:
+		return "ended"
+	}
+	return "unknown"
+}
+
+// State 返回会话当前的生命周期状态, 不获取 s.mu
+func (s *Session) State() sessionState {
+	return sessionState(s.state.Load())
+}
+
+// transition 仅当会话处于 from 时切换到 to, 并发调用时只有一个调用方成功
+func (s *Session) transition(from, to sessionState) bool {
+	return s.state.CompareAndSwap(int32(from), int32(to))
+}
+
+// teardown 关闭当前 shell 的 stdin 并结束其进程树, 调用方需持有 s.mu
+// watch 和 EndSession 可能先后清理同一个 shell 进程, 每个进程只清理一次,
+// 避免重复关闭句柄或向已回收的进程发送信号; start 启动新进程时重置
+func (s *Session) teardown() {
+	s.teardownOnce.Do(func() {
+		s.Stdin.Close()
+		// 结束整个进程树, 避免 shell 启动的子进程成为孤儿
+		killProcessTree(s.ID, s.group)
+		s.group.release()
+	})
+}
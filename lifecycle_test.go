@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionTransition(t *testing.T) {
+	s := &Session{}
+	if s.State() != stateCreated || s.State().String() != "created" {
+		t.Fatalf("initial state = %s", s.State())
+	}
+	if !s.transition(stateCreated, stateRunning) {
+		t.Fatal("created → running refused")
+	}
+	// 只有处于 from 状态时才切换
+	if s.transition(stateCreated, stateEnding) || s.State() != stateRunning {
+		t.Fatalf("transition from a stale state, now %s", s.State())
+	}
+
+	// 并发切换只有一个调用方成功
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.transition(stateRunning, stateEnding) {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 || s.State() != stateEnding {
+		t.Fatalf("%d callers won, state %s", won, s.State())
+	}
+}
+
+// trackingSpawner 记录启动的每个模拟 shell, 用于检查进程是否都已结束
+type trackingSpawner struct {
+	fakeSpawner
+	mu     sync.Mutex
+	shells []*fakeShell
+}
+
+func (ts *trackingSpawner) spawn(s *Session) (*shellProcess, error) {
+	p, err := ts.fakeSpawner.spawn(s)
+	if err == nil {
+		ts.mu.Lock()
+		ts.shells = append(ts.shells, p.tree.(*fakeShell))
+		ts.mu.Unlock()
+	}
+	return p, err
+}
+
+// alive 返回仍在运行的模拟 shell 数
+func (ts *trackingSpawner) alive() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	n := 0
+	for _, shell := range ts.shells {
+		if pids, _ := shell.remaining(); len(pids) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSessionChurn(t *testing.T) {
+	ts := newTestServer(t, nil)
+	tracker := &trackingSpawner{}
+	spawner = tracker
+
+	// 清理器在创建和结束的同时不断结束所有空闲会话
+	reaper := NewReaper(time.Nanosecond, time.Nanosecond)
+	stop := make(chan struct{})
+	reaped := make(chan struct{})
+	go func() {
+		defer close(reaped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				reaper.sweep(time.Now())
+			}
+		}
+	}()
+
+	const workers, rounds = 8, 15
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				resp, data := ts.post(aliceToken, "/start-session", map[string]any{})
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("start = %d %s", resp.StatusCode, data)
+					return
+				}
+				var started struct {
+					SessionID string `json:"session_id"`
+				}
+				json.Unmarshal(data, &started)
+				id := started.SessionID
+
+				switch (w + i) % 3 {
+				case 0:
+					// shell 自行退出, watch 和结束请求都可能清理
+					ts.run(aliceToken, id, "exit", nil)
+				case 1:
+					ts.run(aliceToken, id, "echo hi", nil)
+				}
+				// 同一会话的两个结束请求并发, 其中一个强制结束
+				var ends sync.WaitGroup
+				for _, force := range []bool{false, true} {
+					ends.Add(1)
+					go func(force bool) {
+						defer ends.Done()
+						resp, data := ts.post(aliceToken, "/end-session", map[string]any{"session_id": id, "force": force})
+						if resp.StatusCode != http.StatusOK {
+							t.Errorf("end %s force %t = %d %s", id, force, resp.StatusCode, data)
+						}
+					}(force)
+				}
+				ends.Wait()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-reaped
+
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions still counted", n)
+	}
+	if n := len(sessionManager.snapshot()); n != 0 {
+		t.Fatalf("%d sessions still listed", n)
+	}
+	if records, _ := sessionManager.Store.ListSessions(); len(records) != 0 {
+		t.Fatalf("%d session records left", len(records))
+	}
+	// 所有 shell 都已结束, 没有泄漏的进程
+	waitFor(t, func() bool { return tracker.alive() == 0 })
+	if len(tracker.shells) < workers*rounds {
+		t.Fatalf("%d shells started, want at least %d", len(tracker.shells), workers*rounds)
+	}
+}
+
+func TestConcurrentEndWaitsForCleanup(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 300}}
+	})
+	tracker := &trackingSpawner{fakeSpawner: fakeSpawner{outputs: ts.cfg.FakeOutputs}}
+	spawner = tracker
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	go ts.run(aliceToken, id, "Hang", nil)
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	// 第一个结束请求等待正在执行的命令
+	first := make(chan int, 1)
+	go func() {
+		status, _ := ts.endSession(aliceToken, id)
+		first <- status
+	}()
+	waitFor(t, func() bool {
+		_, exists := sessionManager.GetSession(id)
+		return !exists
+	})
+
+	// 其他租户不能借此判断会话存在
+	if status, out := ts.endSession(bobToken, id); status != http.StatusOK || !out.AlreadyEnded {
+		t.Fatalf("cross-tenant end = %d %+v", status, out)
+	}
+	// 并发的结束请求等到清理完成才返回
+	status, out := ts.endSession(aliceToken, id)
+	if status != http.StatusOK || !out.AlreadyEnded {
+		t.Fatalf("concurrent end = %d %+v", status, out)
+	}
+	if s.State() != stateEnded || tracker.alive() != 0 {
+		t.Fatalf("concurrent end returned before cleanup: state %s, %d shells alive", s.State(), tracker.alive())
+	}
+	if records, _ := sessionManager.Store.ListSessions(); len(records) != 0 {
+		t.Fatalf("%d session records left after concurrent end", len(records))
+	}
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first end = %d", status)
+	}
+}
+
+func TestConcurrentForceEndInterruptsWait(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 10000}}
+		// 模拟 shell 执行命令时不读取 stdin, 非强制结束在宽限期后结束进程
+		cfg.EndGracePeriod = Duration(100 * time.Millisecond)
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	go ts.run(aliceToken, id, "Hang", nil)
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	first := make(chan int, 1)
+	go func() {
+		status, _ := ts.endSession(aliceToken, id)
+		first <- status
+	}()
+	waitFor(t, func() bool {
+		_, exists := sessionManager.GetSession(id)
+		return !exists
+	})
+
+	// 强制结束不等待先到的非强制结束完成命令
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/end-session", map[string]any{"session_id": id, "force": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("force end = %d %s", resp.StatusCode, data)
+	}
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first end = %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("force end waited %s for the running command", elapsed)
+	}
+}
+
+func TestEndSessionFromManyGoroutines(t *testing.T) {
+	newTestServer(t, nil)
+	tracker := &trackingSpawner{}
+	spawner = tracker
+	for round := 0; round < 20; round++ {
+		s, err := sessionManager.CreateSession("alice", SessionOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 只有一个调用方清理, 其余调用方等待清理完成后返回 errSessionNotFound
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		succeeded := 0
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(force bool) {
+				defer wg.Done()
+				err := sessionManager.EndSession(s.ID, force)
+				if err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				} else if !errors.Is(err, errSessionNotFound) {
+					t.Errorf("end = %v", err)
+				}
+				if s.State() != stateEnded {
+					t.Errorf("EndSession returned in state %s", s.State())
+				}
+			}(i%2 == 0)
+		}
+		wg.Wait()
+		if succeeded != 1 {
+			t.Fatalf("%d callers ended the session", succeeded)
+		}
+	}
+	waitFor(t, func() bool { return tracker.alive() == 0 })
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions still counted", n)
+	}
+}
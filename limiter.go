@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errTooManyCommands 同时执行的命令数已达上限, 且在等待时间内没有空出名额
+var errTooManyCommands = errors.New("too many commands in flight, try again later")
+
+// defaultSpawnQueueTimeout 同时启动的会话数达到上限时默认的排队时间
+const defaultSpawnQueueTimeout = 30 * time.Second
+
+// errTooManySpawns 同时启动的会话数已达上限, 且在等待时间内没有空出名额
+var errTooManySpawns = errors.New("too many sessions starting, try again later")
+
+// CommandLimiter 限制整个服务同时执行的命令数, 防止大量会话同时执行命令耗尽主机资源
+type CommandLimiter struct {
+	// slots 容量为上限的信号量, 为 nil 时不限制
+	slots chan struct{}
+	// wait 名额已满时排队等待的最长时间, 0 表示立即拒绝
+	wait time.Duration
+	// full 等待超时或立即拒绝时返回的错误
+	full error
+
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+}
+
+func NewCommandLimiter(limit int, wait time.Duration) *CommandLimiter {
+	l := &CommandLimiter{wait: wait, full: errTooManyCommands}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// NewSpawnLimiter 限制同时启动 shell 进程的会话数, 与会话总数无关, 用于平滑突发的启动请求
+func NewSpawnLimiter(limit int, wait time.Duration) *CommandLimiter {
+	l := NewCommandLimiter(limit, wait)
+	l.full = errTooManySpawns
+	return l
+}
+
+// Acquire 获取执行名额, 成功后调用方需调用 Release
+// 名额已满时最多等待 wait, cancel 关闭时放弃等待并返回 errSessionEnded
+func (l *CommandLimiter) Acquire(cancel <-chan struct{}) error {
+	return l.AcquireWithin(cancel, nil)
+}
+
+// AcquireWithin 与 Acquire 相同, budget 不为空时等待名额同样消耗共享的 total_timeout_ms
+// 预算在获得名额之前用完时返回 errBudgetExceeded
+func (l *CommandLimiter) AcquireWithin(cancel <-chan struct{}, budget context.Context) error {
+	if budgetExceeded(budget) {
+		return errBudgetExceeded
+	}
+	if l.slots == nil {
+		l.inFlight.Add(1)
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return nil
+	default:
+	}
+	if l.wait == 0 {
+		l.rejected.Add(1)
+		return l.full
+	}
+
+	var budgetDone <-chan struct{}
+	if budget != nil {
+		budgetDone = budget.Done()
+	}
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return nil
+	case <-timer.C:
+		l.rejected.Add(1)
+		return l.full
+	case <-cancel:
+		return errSessionEnded
+	case <-budgetDone:
+		return errBudgetExceeded
+	}
+}
+
+// Release 归还执行名额
+func (l *CommandLimiter) Release() {
+	l.inFlight.Add(-1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// InFlight 正在执行的命令数
+func (l *CommandLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// Queued 排队等待名额的命令数
+func (l *CommandLimiter) Queued() int64 {
+	return l.queued.Load()
+}
+
+// Rejected 因名额已满被拒绝的命令总数
+func (l *CommandLimiter) Rejected() int64 {
+	return l.rejected.Load()
+}
+
+var commandLimiter *CommandLimiter
+
+// spawnLimiter 限制同时创建的会话数
+var spawnLimiter = NewSpawnLimiter(0, 0)
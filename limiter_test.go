@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCommandLimiterRejectsWithoutWait(t *testing.T) {
+	l := NewCommandLimiter(1, 0)
+	if err := l.Acquire(nil); err != nil {
+		t.Fatalf("first acquire = %v", err)
+	}
+	if err := l.Acquire(nil); !errors.Is(err, errTooManyCommands) {
+		t.Fatalf("second acquire = %v, want errTooManyCommands", err)
+	}
+	if l.InFlight() != 1 || l.Rejected() != 1 {
+		t.Fatalf("in flight %d, rejected %d", l.InFlight(), l.Rejected())
+	}
+	l.Release()
+	if err := l.Acquire(nil); err != nil {
+		t.Fatalf("acquire after release = %v", err)
+	}
+}
+
+func TestCommandLimiterQueues(t *testing.T) {
+	l := NewCommandLimiter(1, time.Second)
+	if err := l.Acquire(nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- l.Acquire(nil) }()
+	waitFor(t, func() bool { return l.Queued() == 1 })
+
+	// 排队的命令在名额空出后开始执行
+	l.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("queued acquire = %v", err)
+	}
+	if l.Queued() != 0 || l.InFlight() != 1 || l.Rejected() != 0 {
+		t.Fatalf("queued %d, in flight %d, rejected %d", l.Queued(), l.InFlight(), l.Rejected())
+	}
+}
+
+func TestCommandLimiterQueueTimeout(t *testing.T) {
+	l := NewCommandLimiter(1, 50*time.Millisecond)
+	l.Acquire(nil)
+	if err := l.Acquire(nil); !errors.Is(err, errTooManyCommands) {
+		t.Fatalf("acquire = %v, want errTooManyCommands", err)
+	}
+	if l.Queued() != 0 || l.Rejected() != 1 {
+		t.Fatalf("queued %d, rejected %d", l.Queued(), l.Rejected())
+	}
+
+	// 启动会话的限制返回各自的错误
+	s := NewSpawnLimiter(1, 0)
+	s.Acquire(nil)
+	if err := s.Acquire(nil); !errors.Is(err, errTooManySpawns) {
+		t.Fatalf("spawn acquire = %v, want errTooManySpawns", err)
+	}
+}
+
+func TestCommandLimiterCancel(t *testing.T) {
+	l := NewCommandLimiter(1, time.Minute)
+	l.Acquire(nil)
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- l.Acquire(cancel) }()
+	waitFor(t, func() bool { return l.Queued() == 1 })
+	close(cancel)
+	if err := <-done; !errors.Is(err, errSessionEnded) {
+		t.Fatalf("cancelled acquire = %v, want errSessionEnded", err)
+	}
+	if l.Rejected() != 0 {
+		t.Fatalf("cancelled acquire counted as rejected")
+	}
+}
+
+func TestCommandLimiterBudget(t *testing.T) {
+	l := NewCommandLimiter(1, time.Minute)
+	l.Acquire(nil)
+	// 等待名额的时间计入共享的预算, 预算用完时不再等待 wait
+	budget, cancel := newBudget(50 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.AcquireWithin(nil, budget); !errors.Is(err, errBudgetExceeded) {
+		t.Fatalf("acquire with budget = %v, want errBudgetExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("acquire waited %s", elapsed)
+	}
+	// 预算已用完时即使有空闲名额也不获取
+	l.Release()
+	if err := l.AcquireWithin(nil, budget); !errors.Is(err, errBudgetExceeded) || l.InFlight() != 0 {
+		t.Fatalf("acquire after budget = %v, in flight %d", err, l.InFlight())
+	}
+	if l.Rejected() != 0 {
+		t.Fatalf("budget exhaustion counted as rejected")
+	}
+}
+
+func TestCommandLimiterNeverExceedsLimit(t *testing.T) {
+	const limit = 3
+	l := NewCommandLimiter(limit, time.Minute)
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Acquire(nil); err != nil {
+				t.Error(err)
+				return
+			}
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			l.Release()
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > limit {
+		t.Fatalf("%d commands ran at once, limit %d", peak.Load(), limit)
+	}
+	if l.InFlight() != 0 {
+		t.Fatalf("in flight %d after all released", l.InFlight())
+	}
+}
+
+func TestServerWideCommandLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxConcurrentCommands = 1
+		cfg.FakeOutputs = map[string]FakeOutput{"Long-Job": {Output: "done", DelayMs: 300}}
+	})
+	first, second := ts.startSession(aliceToken, nil), ts.startSession(bobToken, nil)
+
+	done := make(chan string, 1)
+	go func() {
+		_, data := ts.run(aliceToken, first, "Long-Job", nil)
+		done <- string(data)
+	}()
+	waitFor(t, func() bool { return commandLimiter.InFlight() == 1 })
+
+	// 名额被其他租户的会话占用, 未配置排队时间时立即拒绝
+	resp, data := ts.run(bobToken, second, "echo hi", nil)
+	if resp.StatusCode != http.StatusTooManyRequests || errorCodeOf(t, data) != codeServerBusy {
+		t.Fatalf("run over the limit = %d %s", resp.StatusCode, data)
+	}
+	if out := <-done; out != "done" {
+		t.Fatalf("first command = %q", out)
+	}
+	if resp, data = ts.run(bobToken, second, "echo hi", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+		t.Fatalf("run after release = %d %q", resp.StatusCode, data)
+	}
+
+	_, data = ts.do(http.MethodGet, adminToken, "/metrics", nil)
+	if !strings.Contains(string(data), "rce_commands_rejected_total 1\n") {
+		t.Fatalf("metrics do not count the rejected command:\n%s", data)
+	}
+}
+
+func TestServerWideCommandLimitQueues(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxConcurrentCommands = 1
+		cfg.CommandQueueTimeout = Duration(5 * time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{"Long-Job": {Output: "done", DelayMs: 200}}
+	})
+	first, second := ts.startSession(aliceToken, nil), ts.startSession(bobToken, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.run(aliceToken, first, "Long-Job", nil)
+	}()
+	waitFor(t, func() bool { return commandLimiter.InFlight() == 1 })
+	resp, data := ts.run(bobToken, second, "echo queued", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "queued" {
+		t.Fatalf("queued run = %d %q", resp.StatusCode, data)
+	}
+	<-done
+}
+
+// gatedSpawner 启动 shell 前等待 gate 关闭, 用于模拟启动较慢的 shell
+type gatedSpawner struct {
+	fakeSpawner
+	gate     chan struct{}
+	spawning atomic.Int32
+}
+
+func (g *gatedSpawner) spawn(s *Session) (*shellProcess, error) {
+	g.spawning.Add(1)
+	<-g.gate
+	return g.fakeSpawner.spawn(s)
+}
+
+func TestSpawnLimiter(t *testing.T) {
+	l := NewSpawnLimiter(1, 0)
+	if err := l.Acquire(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire(nil); !errors.Is(err, errTooManySpawns) {
+		t.Fatalf("second acquire = %v, want errTooManySpawns", err)
+	}
+	// 不影响命令的限制器
+	if err := NewCommandLimiter(1, 0).Acquire(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxConcurrentSpawns(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxConcurrentSpawns = 1
+		cfg.SpawnQueueTimeout = 0
+	})
+	gated := &gatedSpawner{gate: make(chan struct{})}
+	spawner = gated
+
+	first := make(chan int, 1)
+	go func() {
+		resp, _ := ts.post(aliceToken, "/start-session", map[string]any{})
+		first <- resp.StatusCode
+	}()
+	waitFor(t, func() bool { return gated.spawning.Load() == 1 })
+
+	// 同时启动的会话数达到上限时立即返回 429
+	resp, data := ts.post(bobToken, "/start-session", map[string]any{})
+	if resp.StatusCode != http.StatusTooManyRequests || errorCodeOf(t, data) != codeServerBusy {
+		t.Fatalf("second start = %d %s", resp.StatusCode, data)
+	}
+	if _, metrics := ts.do(http.MethodGet, adminToken, "/metrics", nil); !strings.Contains(string(metrics), "rce_session_starts_rejected_total 1") {
+		t.Fatalf("rejected start not counted:\n%s", metrics)
+	}
+
+	close(gated.gate)
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first start = %d", status)
+	}
+	// 启动完成后名额释放, 已运行的会话不占用名额
+	if resp, data = ts.post(bobToken, "/start-session", map[string]any{}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("start after release = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestSpawnQueueTimeout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxConcurrentSpawns = 1
+		cfg.SpawnQueueTimeout = Duration(5 * time.Second)
+	})
+	gated := &gatedSpawner{gate: make(chan struct{})}
+	spawner = gated
+
+	results := make(chan int, 2)
+	for _, token := range []string{aliceToken, bobToken} {
+		go func(token string) {
+			resp, _ := ts.post(token, "/start-session", map[string]any{})
+			results <- resp.StatusCode
+		}(token)
+	}
+	// 第二个请求排队等待, 不调用 spawn
+	waitFor(t, func() bool { return gated.spawning.Load() == 1 && spawnLimiter.Queued() == 1 })
+	close(gated.gate)
+	for i := 0; i < 2; i++ {
+		if status := <-results; status != http.StatusOK {
+			t.Fatalf("queued start = %d", status)
+		}
+	}
+}
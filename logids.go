@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LogSessionIDs 运行日志中会话 ID 的记录方式
+type LogSessionIDs string
+
+const (
+	// LogSessionIDsFull 记录完整的会话 ID(默认)
+	LogSessionIDsFull LogSessionIDs = "full"
+	// LogSessionIDsHashed 只记录会话 ID 的 SHA-256 前 12 位十六进制, 审计日志、webhook 和接口响应中仍为完整 ID
+	LogSessionIDsHashed LogSessionIDs = "hashed"
+)
+
+// logSessionIDs 服务端配置的 log_session_ids
+var logSessionIDs = LogSessionIDsFull
+
+// logSessionIDField 日志中取值为会话 ID 的字段, 如 SessionID、SourceSessionID 和 SessionIDs
+// 字段值到下一个 " | " 或行尾为止
+var logSessionIDField = regexp.MustCompile(`([A-Za-z]*SessionIDs?: )([^|\n]*[^|\n ])`)
+
+// parseLogSessionIDs 检查 log_session_ids, 为空时为 full
+func parseLogSessionIDs(mode string) (LogSessionIDs, error) {
+	switch LogSessionIDs(mode) {
+	case "", LogSessionIDsFull:
+		return LogSessionIDsFull, nil
+	case LogSessionIDsHashed:
+		return LogSessionIDsHashed, nil
+	}
+	return "", fmt.Errorf("log_session_ids must be %s or %s", LogSessionIDsFull, LogSessionIDsHashed)
+}
+
+// hashSessionID 返回会话 ID 在日志中的形式, 同一 ID 总是得到相同的结果, 便于关联同一会话的日志
+// 持有完整 ID 时可以用 printf %s <id> | sha256sum 的前 12 位查找对应的日志
+func hashSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return "#" + hex.EncodeToString(sum[:6])
+}
+
+// redactSessionIDs 把一条日志中会话 ID 字段的值换为 hashSessionID 的结果, full 时原样返回
+// %v 格式化的 ID 列表([id1 id2])逐个替换
+func redactSessionIDs(line string) string {
+	if logSessionIDs != LogSessionIDsHashed {
+		return line
+	}
+	return logSessionIDField.ReplaceAllStringFunc(line, func(field string) string {
+		m := logSessionIDField.FindStringSubmatch(field)
+		key, value := m[1], m[2]
+		if list, ok := strings.CutPrefix(value, "["); ok && strings.HasSuffix(list, "]") {
+			ids := strings.Fields(strings.TrimSuffix(list, "]"))
+			for i, id := range ids {
+				ids[i] = hashSessionID(id)
+			}
+			return key + "[" + strings.Join(ids, " ") + "]"
+		}
+		return key + hashSessionID(value)
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactSessionIDs(t *testing.T) {
+	t.Cleanup(func() { logSessionIDs = LogSessionIDsFull })
+	line := "✓ Session cloned | SourceSessionID: abc | SessionID: def | Owner: alice\n"
+	if got := redactSessionIDs(line); got != line {
+		t.Fatalf("full = %q", got)
+	}
+
+	logSessionIDs = LogSessionIDsHashed
+	want := "✓ Session cloned | SourceSessionID: " + hashSessionID("abc") + " | SessionID: " + hashSessionID("def") + " | Owner: alice\n"
+	if got := redactSessionIDs(line); got != want {
+		t.Fatalf("hashed = %q, want %q", got, want)
+	}
+	// %v 格式化的列表逐个替换
+	if got := redactSessionIDs("✓ Killed all sessions | SessionIDs: [abc def]"); got != "✓ Killed all sessions | SessionIDs: ["+hashSessionID("abc")+" "+hashSessionID("def")+"]" {
+		t.Fatalf("list = %q", got)
+	}
+	// 同一 ID 总是得到相同的结果
+	if h := hashSessionID("abc"); h != hashSessionID("abc") || len(h) != 13 || h == hashSessionID("abd") {
+		t.Fatalf("hash = %q", h)
+	}
+	if _, err := parseLogSessionIDs("partial"); err == nil {
+		t.Fatal("invalid log_session_ids accepted")
+	}
+}
+
+func TestLogSessionIDsHashed(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.LogSessionIDs = "hashed"
+	})
+	t.Cleanup(func() { logSessionIDs = LogSessionIDsFull })
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&redactingWriter{w: &logs, registry: secretRegistry})
+	defer log.SetOutput(previous)
+
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.run(aliceToken, id, "echo hi", nil)
+	log.SetOutput(previous)
+	// 接口响应中仍为完整 ID, 日志中只有哈希
+	if resp.StatusCode != http.StatusOK || !strings.Contains(logs.String(), "SessionID: "+hashSessionID(id)) {
+		t.Fatalf("run = %d %q, logs:\n%s", resp.StatusCode, data, logs.String())
+	}
+	if strings.Contains(logs.String(), id) {
+		t.Fatalf("full session ID in logs:\n%s", logs.String())
+	}
+}
@@ -1,86 +1,598 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // Session 表示一个 PowerShell 会话
 type Session struct {
-	ID      string
-	Cmd     *exec.Cmd
-	Stdin   io.WriteCloser
-	Stdout  io.ReadCloser
-	Stderr  io.ReadCloser
-	Running bool
-	mu      sync.Mutex
+	ID     string
+	proc   *shellProcess
+	Stdin  io.WriteCloser
+	Stdout io.ReadCloser
+	Stderr io.ReadCloser
+	mu     sync.Mutex
+
+	// state 会话的生命周期状态, 见 sessionState
+	state atomic.Int32
+	// running 当前 shell 是否在运行, 在持有 mu 时修改, 读取状态时无需等待正在执行的命令
+	running atomic.Bool
+	// suspect 写入命令超时, shell 可能已挂起, 不再接受命令
+	suspect atomic.Bool
+	// lastUsed 最近一条命令结束的时间(UnixNano), 会话创建时为创建时间
+	lastUsed atomic.Int64
+	// current 正在执行的命令, 空闲时为 nil
+	current atomic.Pointer[CommandStatus]
+	// markerPrefix 会话的标记前缀, 结束标记为前缀加命令 ID, 重启 shell 后不变
+	markerPrefix string
+	// lastCommand 最近一条执行完的客户端命令, 还没有执行过时为 nil
+	lastCommand atomic.Pointer[CommandStatus]
+	// outputStats 客户端命令的输出大小统计, 每条命令的大小记录在命令历史中
+	outputStats outputStats
+
+	// Owner 创建会话的租户
+	Owner     string
+	CreatedAt time.Time
+	// ShellName 会话使用的 shell 预设名称
+	ShellName string
+	shell     *ShellPreset
+
+	// limits 进程树的资源限制, group 为当前 shell 所在的进程组
+	limits ProcessLimits
+	group  processTree
+
+	// AutoRespawn shell 意外退出时自动重启
+	AutoRespawn bool
+	// respawning 正在等待重启 shell
+	respawning bool
+	// store 保存会话元数据和生命周期事件
+	store Store
+
+	// output 读取 goroutine 送出的 stdout 数据块, 进程退出后关闭
+	output <-chan []byte
+	// exited 当前 shell 进程退出后关闭
+	exited chan struct{}
+	// teardownOnce 保证当前 shell 进程只被清理一次, 每次启动 shell 时重新创建
+	teardownOnce *sync.Once
+	// subShells 当前 shell 中打开的子 shell, shell 重启后清空
+	subShells map[string]*subShell
+	// interrupt 强制结束会话时关闭, 让正在执行的命令立即返回并释放 mu
+	interrupt     chan struct{}
+	interruptOnce sync.Once
+	// ended 会话清理完成(状态为 ended)后关闭
+	ended chan struct{}
+	// abort 重启 shell 时关闭, 让正在执行的命令立即返回, 每次启动 shell 时重新创建
+	abort   chan struct{}
+	abortMu sync.Mutex
+	// cancelGen 每次取消会话的命令时递增, 命令开始等待时记录, 获取到 mu 后发现已变化即被取消
+	cancelGen atomic.Int64
+	// cancelling 正在取消命令, 期间获取到 mu 的命令同样被取消
+	cancelling atomic.Bool
+	// queued 等待名额或 mu 的命令数
+	queued atomic.Int32
+	// unfinished 被取消时仍在 shell 中运行的命令的标记, 由取消请求读走其剩余输出, 在 s.mu 中修改
+	unfinished string
+
+	// readBufferSize 读取输出的缓冲区大小
+	readBufferSize int
+	// terminator 判断命令结束的方式
+	terminator Terminator
+	// markerChannel 命令未指定时的标记输出方式
+	markerChannel MarkerChannel
+	// flushOutput 每个输出对象单独格式化并刷新, 不等待格式化批量输出
+	flushOutput bool
+	// structuredErrors 命令抛出的终止错误以结构化信息返回, 不写入输出
+	structuredErrors bool
+	// outputBuffering 读取输出的分块方式
+	outputBuffering OutputBuffering
+	// priority shell 进程的优先级, 重启 shell 时重新设置
+	priority ProcessPriority
+	// quiescence 静默模式下判定命令结束的无输出时长
+	quiescence time.Duration
+	// runtimeSettings 命令超时和输出限制, 创建后可通过 /session-config 调整
+	runtimeSettings atomic.Pointer[sessionSettings]
+	settingsMu      sync.Mutex
+	// commandTemplate 包装每条命令的模板
+	commandTemplate string
+	// jsonDepth JSON 输出模式默认的序列化深度
+	jsonDepth int
+	// stripANSI 默认去除输出中的 ANSI 转义序列
+	stripANSI bool
+	// normalizeNewlines 默认将输出中的 CRLF 转换为 LF
+	normalizeNewlines bool
+	// stripBOM 默认去除输出开头的 UTF-8 BOM
+	stripBOM bool
+	// plainTextRendering 启动 PowerShell 后关闭彩色输出
+	plainTextRendering bool
+	// transcript Start-Transcript 写入的记录文件, 为空时不记录
+	transcript string
+
+	// options 创建会话时的参数, 克隆会话时使用
+	options SessionOptions
+	// preferences 启动 shell 后设置的 PowerShell 偏好变量
+	preferences map[string]string
+
+	// tail 最近的 stdout 输出, 为空时未开启, shell 重启后继续写入
+	tail *ringBuffer
+	// stderrTail 最近的 stderr 输出, stderr_handling 为 tail 时开启
+	stderrTail *ringBuffer
+	// startup 启动期间的 stderr, 就绪检查结束后不再保存
+	startup *startupCapture
+
+	// workingDir shell 启动时的工作目录, 为空时使用服务进程的当前目录
+	workingDir string
+
+	// constrained 命令在受限语言模式的 runspace 中执行
+	constrained bool
+	// fallbackDecoder 不为空时输出中无效的 UTF-8 字节按备用代码页解码
+	fallbackDecoder codePageDecoder
+	// fallbackCodePage fallbackDecoder 使用的代码页, 0 表示未设置
+	fallbackCodePage int
+
+	// secrets secret_env 的值, 按长度从长到短排列, 命令输出中出现时被替换
+	secrets [][]byte
+
+	// maxCommands 会话最多执行的客户端命令数, 0 表示不限制
+	maxCommands int
+	// commandLimitAction 命令数达到上限后的处理方式
+	commandLimitAction CommandLimitAction
+	// commandCount 已执行的客户端命令数, 在 s.mu 中修改, 重启 shell 后不清零
+	commandCount atomic.Int64
+	// recycleAfter 连续出错多少条命令后回收会话, 0 表示不回收
+	recycleAfter int
+	// recycleAction 回收会话的方式
+	recycleAction RecycleAction
+	// consecutiveErrors 连续出错的客户端命令数, 在 s.mu 中修改, 命令成功或重启 shell 后清零
+	consecutiveErrors atomic.Int32
+
+	// initMu 保证初始化命令的计数和追加不被并发的记录打断, 初始化命令保存在 store 的命令历史中
+	initMu sync.Mutex
 }
 
+// defaultReadBufferSize 默认读取缓冲区大小
+const defaultReadBufferSize = 32 * 1024
+
 // SessionManager 管理所有会话
 type SessionManager struct {
 	sessions map[string]*Session
-	mu       sync.RWMutex
+	// ending 已从 sessions 中移除、正在清理的会话, 并发的结束请求等待清理完成
+	ending map[string]*Session
+	// owned 各租户持有的会话数, 包括正在创建的会话
+	owned map[string]int
+	mu    sync.RWMutex
+
+	// ReadBufferSize 新会话读取输出的缓冲区大小
+	ReadBufferSize int
+	// ReadyTimeout 创建会话时等待 shell 就绪的最长时间, 0 表示不等待
+	ReadyTimeout time.Duration
+	// Priority 会话 shell 的默认优先级, 也是会话可以使用的最高优先级
+	Priority ProcessPriority
+	// CommandTemplate 包装每条命令的模板, 为空时不包装
+	CommandTemplate string
+	// Shells 可选的 shell 预设, DefaultShell 为未指定时使用的预设
+	Shells       map[string]*ShellPreset
+	DefaultShell string
+	// JSONDepth JSON 输出模式默认的序列化深度
+	JSONDepth int
+	// StripANSI 默认去除输出中的 ANSI 转义序列, 可被单条命令覆盖
+	StripANSI bool
+	// NormalizeNewlines 默认将输出中的 CRLF 转换为 LF, 可被单条命令覆盖
+	NormalizeNewlines bool
+	// StripBOM 默认去除输出开头的 UTF-8 BOM, 可被单条命令覆盖
+	StripBOM bool
+	// PlainTextRendering 启动 PowerShell 后设置 $PSStyle.OutputRendering = 'PlainText'
+	PlainTextRendering bool
+	// EndGracePeriod 结束会话时等待 shell 执行 exit 退出的时间, 0 表示直接结束
+	EndGracePeriod time.Duration
+	// SessionQuotas 按租户覆盖服务端的 max_sessions_per_token
+	SessionQuotas map[string]int
+	// WorkingDir 新会话默认的工作目录, 为空时使用服务进程的当前目录
+	WorkingDir string
+	// TailSize 每个会话保留的最近 stdout 字节数, 0 表示不保留
+	TailSize int
+	// Store 会话元数据和事件历史的存储, 运行中的进程只保存在 sessions 中
+	Store Store
 }
 
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		sessions:       make(map[string]*Session),
+		ending:         make(map[string]*Session),
+		owned:          make(map[string]int),
+		ReadBufferSize: defaultReadBufferSize,
+		Shells:         defaultShellPresets(),
+		DefaultShell:   defaultShell,
+		Priority:       PriorityNormal,
+		JSONDepth:      defaultJSONDepth,
+		EndGracePeriod: defaultEndGracePeriod,
+		Store:          NewMemoryStore(),
 	}
 }
 
-// CreateSession 创建新的 PowerShell 会话
-func (sm *SessionManager) CreateSession() (*Session, error) {
-	sessionID := uuid.New().String()
-
-	// -NoProfile: 不加载 PowerShell 配置文件
-	// -NoLogo: 不显示版权信息
-	// -NoExit: 执行命令后不退出
-	// 设置所有编码为 UTF-8 以避免中文乱码
-	cmd := exec.Command("powershell.exe", "-NoProfile", "-NoLogo", "-NoExit", "-InputFormat", "Text", "-OutputFormat", "Text", "-Command", "[Console]::OutputEncoding = [System.Text.Encoding]::UTF8; [Console]::InputEncoding = [System.Text.Encoding]::UTF8; $OutputEncoding = [System.Text.Encoding]::UTF8")
+// SessionOptions 创建会话时的可选参数
+type SessionOptions struct {
+	// Shell shell 预设名称, 为空时使用默认预设
+	Shell string `json:"shell"`
+	// AutoRespawn shell 意外退出时自动重启, 会丢失变量和当前目录等状态
+	AutoRespawn bool `json:"auto_respawn"`
+	// Limits 会话进程树的资源限制
+	Limits ProcessLimits `json:"limits"`
+	// Terminator 判断命令结束的方式: marker(默认) 或 quiescence
+	Terminator Terminator `json:"terminator"`
+	// QuiescenceMs 静默模式下无输出多久视为命令结束(毫秒)
+	QuiescenceMs int `json:"quiescence_ms"`
+	// Transcript 用 Start-Transcript 记录会话的完整记录, 仅 PowerShell 支持
+	Transcript bool `json:"transcript"`
+	// Init 会话启动后依次执行的初始化命令, 记录下来供克隆会话时重放
+	Init []string `json:"init"`
+	// ImportModules 会话启动后、初始化命令之前导入的 PowerShell 模块, 重启 shell 和克隆会话时重新导入
+	ImportModules []string `json:"import_modules"`
+	// Env shell 进程的环境变量, 在服务进程的环境之上设置
+	Env map[string]string `json:"env"`
+	// SecretEnv 与 Env 相同, 但值会在命令输出、会话信息和日志中替换为 [REDACTED]
+	SecretEnv map[string]string `json:"secret_env"`
+	// WorkingDir shell 的初始工作目录, 为空时使用服务端配置的 working_dir
+	WorkingDir string `json:"working_dir"`
+	// Preferences PowerShell 偏好变量, 如 ProgressPreference: SilentlyContinue, 仅 PowerShell 支持
+	Preferences map[string]string `json:"preferences"`
+	// LanguageMode 命令的语言模式: full(默认) 或 constrained, 仅 PowerShell 支持
+	LanguageMode LanguageMode `json:"language_mode"`
+	// Remote 不为空时命令通过 PSRemoting 在远程计算机上执行, 仅 PowerShell 支持
+	Remote *RemoteOptions `json:"remote"`
+	// FallbackCodePage 输出中无效的 UTF-8 字节按该代码页解码, 如 437、850, 0 表示不处理
+	FallbackCodePage int `json:"fallback_code_page"`
+	// MarkerChannel 命令默认的标记输出方式: host(默认) 或 console, 仅 PowerShell 支持
+	MarkerChannel MarkerChannel `json:"marker_channel"`
+	// Labels 会话标签, 用于列出会话时筛选和在日志中关联
+	Labels map[string]string `json:"labels"`
+	// FlushOutput 命令返回的每个对象单独格式化并立即刷新输出, 仅 PowerShell 支持
+	FlushOutput bool `json:"flush_output"`
+	// StructuredErrors 命令抛出的终止错误以 exception 字段返回, 不写入输出, 仅 PowerShell 支持
+	StructuredErrors bool `json:"structured_errors"`
+	// OutputBuffering 读取输出的分块方式: byte(默认) 或 line
+	OutputBuffering OutputBuffering `json:"output_buffering"`
+	// Priority shell 进程的优先级: normal、below_normal 或 idle, 不能高于服务端的 priority, 为空时使用服务端的 priority
+	Priority ProcessPriority `json:"priority"`
+}
 
-	stdin, err := cmd.StdinPipe()
+// CreateSession 为指定租户创建新的 PowerShell 会话
+func (sm *SessionManager) CreateSession(owner string, opts SessionOptions) (*Session, error) {
+	terminator, quiescence, err := opts.terminator()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+		return nil, err
+	}
+	if err := opts.Limits.validate(); err != nil {
+		return nil, err
 	}
 
-	stdout, err := cmd.StdoutPipe()
+	shellName := opts.Shell
+	if shellName == "" {
+		shellName = sm.DefaultShell
+	}
+	shell, ok := sm.Shells[shellName]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown shell %q", errInvalidOptions, shellName)
+	}
+	if !shell.installed() {
+		return nil, shellUnavailable(shellName, shell)
+	}
+	if opts.Transcript && shell.Type != ShellPowerShell {
+		return nil, fmt.Errorf("%w: transcript requires a PowerShell session", errInvalidOptions)
+	}
+	preferences, err := normalizePreferences(opts.Preferences)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+		return nil, err
 	}
-
-	stderr, err := cmd.StderrPipe()
+	if preferences != nil && shell.Type != ShellPowerShell {
+		return nil, fmt.Errorf("%w: preferences require a PowerShell session", errInvalidOptions)
+	}
+	if opts.FlushOutput && shell.Type != ShellPowerShell {
+		return nil, fmt.Errorf("%w: flush_output requires a PowerShell session", errInvalidOptions)
+	}
+	if opts.StructuredErrors && shell.Type != ShellPowerShell {
+		return nil, fmt.Errorf("%w: structured_errors requires a PowerShell session", errInvalidOptions)
+	}
+	if err := validateImportModules(opts.ImportModules, shell.Type); err != nil {
+		return nil, err
+	}
+	markerChannel, err := parseMarkerChannel(opts.MarkerChannel, shell.Type)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidOptions, err)
+	}
+	buffering, err := parseOutputBuffering(opts.OutputBuffering)
+	if err != nil {
+		return nil, err
+	}
+	priority, err := sessionPriority(opts.Priority, sm.Priority)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
+		return nil, err
+	}
+	if err := validateEnv(opts.Env, "env"); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(opts.Labels); err != nil {
+		return nil, err
+	}
+	if err := opts.validateSecretEnv(); err != nil {
+		return nil, err
+	}
+	constrained, err := parseLanguageMode(opts.LanguageMode, shell.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateRemote(opts.Remote, shell.Type, constrained); err != nil {
+		return nil, err
+	}
+	var fallbackDecoder codePageDecoder
+	if opts.FallbackCodePage != 0 {
+		if fallbackDecoder, err = newCodePageDecoder(opts.FallbackCodePage); err != nil {
+			return nil, err
+		}
+	}
+	workingDir := opts.WorkingDir
+	if workingDir == "" {
+		workingDir = sm.WorkingDir
+	} else if err := checkDir(workingDir); err != nil {
+		return nil, fmt.Errorf("%w: working_dir: %v", errInvalidOptions, err)
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start powershell: %v", err)
+	if err := memoryGuard.Check(); err != nil {
+		log.Printf("✗ Session start refused: total session memory over limit | Owner: %s | Memory: %d MB", owner, memoryGuard.Total()>>20)
+		return nil, err
 	}
+	if err := sm.reserve(owner); err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			sm.unreserve(owner)
+		}
+	}()
+
+	// 启动 shell 进程开销较大, 突发的创建请求在这里排队, 同时启动的数量不超过 max_concurrent_spawns
+	if err := spawnLimiter.Acquire(nil); err != nil {
+		log.Printf("✗ Session start rejected | Owner: %s | Starting: %d | Error: %v", owner, spawnLimiter.InFlight(), err)
+		return nil, err
+	}
+	defer spawnLimiter.Release()
+
+	sessionID := uuid.New().String()
+	// 重新加载配置后创建的会话使用新的默认值, 已有会话不变
+	live := currentSettings()
 
 	session := &Session{
-		ID:      sessionID,
-		Cmd:     cmd,
-		Stdin:   stdin,
-		Stdout:  stdout,
-		Stderr:  stderr,
-		Running: true,
+		ID:           sessionID,
+		markerPrefix: newMarkerPrefix(),
+		Owner:        owner,
+		CreatedAt:    time.Now(),
+		AutoRespawn:  opts.AutoRespawn,
+		ShellName:    shellName,
+		shell:        shell,
+		limits:       opts.Limits,
+		interrupt:    make(chan struct{}),
+		ended:        make(chan struct{}),
+		options:      opts,
+		secrets:      secretValues(opts.redactedValues()),
+		workingDir:   workingDir,
+		preferences:  preferences,
+		store:        sm.Store,
+
+		fallbackDecoder:  fallbackDecoder,
+		fallbackCodePage: opts.FallbackCodePage,
+		constrained:      constrained,
+
+		readBufferSize:   sm.ReadBufferSize,
+		terminator:       terminator,
+		markerChannel:    markerChannel,
+		flushOutput:      opts.FlushOutput,
+		structuredErrors: opts.StructuredErrors,
+		quiescence:       quiescence,
+		outputBuffering:  buffering,
+		priority:         priority,
+
+		commandTemplate: sm.CommandTemplate,
+		jsonDepth:       sm.JSONDepth,
+		stripANSI:       sm.StripANSI,
+
+		normalizeNewlines: sm.NormalizeNewlines,
+		stripBOM:          sm.StripBOM,
+
+		plainTextRendering: sm.PlainTextRendering,
+
+		maxCommands:        live.maxCommands,
+		commandLimitAction: live.commandLimitAction,
+
+		recycleAfter:  live.recycleAfterErrors,
+		recycleAction: live.recycleAction,
+	}
+
+	session.runtimeSettings.Store(&sessionSettings{commandTimeout: live.commandTimeout, maxOutput: maxOutputSize})
+	if sm.TailSize > 0 {
+		session.tail = newRingBuffer(sm.TailSize)
+		if stderrHandling == StderrTail {
+			session.stderrTail = newRingBuffer(sm.TailSize)
+		}
 	}
 
+	if opts.Transcript {
+		path, err := transcriptStore.Create(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		session.transcript = path
+	}
+
+	err = sm.Store.PutSession(SessionRecord{
+		ID:        sessionID,
+		Owner:     owner,
+		Shell:     shellName,
+		CreatedAt: session.CreatedAt,
+		Instance:  instanceID,
+		Labels:    opts.Labels,
+	})
+	if err != nil {
+		if session.transcript != "" {
+			removeTranscript(sessionID, session.transcript)
+		}
+		return nil, fmt.Errorf("failed to store session: %v", err)
+	}
+
+	// 先登记机密值, 启动过程中的日志也会被替换
+	secretRegistry.Add(sessionID, opts.redactedValues())
+	if err := session.start(); err != nil {
+		secretRegistry.Remove(sessionID)
+		sm.deleteRecord(sessionID)
+		if session.transcript != "" {
+			removeTranscript(sessionID, session.transcript)
+		}
+		return nil, err
+	}
+	session.running.Store(true)
+	// 会话加入 sm.sessions 之前客户端无法访问, 就绪检查不会与客户端命令交错
+	err = session.connectRemote()
+	if err == nil {
+		err = session.waitReady(sm.ReadyTimeout)
+	}
+	if err != nil {
+		session.running.Store(false)
+		session.teardown()
+		session.proc.wait()
+		secretRegistry.Remove(sessionID)
+		sm.deleteRecord(sessionID)
+		if session.transcript != "" {
+			removeTranscript(sessionID, session.transcript)
+		}
+		return nil, err
+	}
+	session.lastUsed.Store(session.CreatedAt.UnixNano())
+	session.addEvent("started", "")
+
 	sm.mu.Lock()
+	session.transition(stateCreated, stateRunning)
 	sm.sessions[sessionID] = session
 	sm.mu.Unlock()
+	created = true
 
-	log.Printf("✓ Created new session | SessionID: %s", sessionID)
+	go session.watch(session.proc, session.exited)
+
+	log.Printf("✓ Created new session | SessionID: %s | Owner: %s | Shell: %s | Dir: %s | Labels: %s", sessionID, owner, shellName, workingDir, formatLabels(opts.Labels))
+	notifySession(EventSessionCreated, owner, sessionID)
 	return session, nil
 }
 
+// quotaFor 返回租户的会话数上限, 0 表示不限制
+func (sm *SessionManager) quotaFor(owner string) int {
+	if quota, ok := sm.SessionQuotas[owner]; ok {
+		return quota
+	}
+	return currentSettings().sessionQuota
+}
+
+// Owned 返回租户当前持有的会话数, 包括正在创建的会话
+func (sm *SessionManager) Owned(owner string) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.owned[owner]
+}
+
+// reserve 为租户占用一个会话名额, 已达上限时返回 errSessionQuota
+// 在启动 shell 之前占用, 并发创建的会话不会超过上限
+func (sm *SessionManager) reserve(owner string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if quota := sm.quotaFor(owner); quota > 0 && sm.owned[owner] >= quota {
+		return fmt.Errorf("%w: at most %d sessions", errSessionQuota, quota)
+	}
+	sm.owned[owner]++
+	return nil
+}
+
+// unreserve 归还租户的会话名额
+func (sm *SessionManager) unreserve(owner string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.owned[owner]--; sm.owned[owner] <= 0 {
+		delete(sm.owned, owner)
+	}
+}
+
+// start 启动 shell 进程并建立管道, 调用方需持有 s.mu 或会话尚未共享
+func (s *Session) start() error {
+	proc, err := spawner.spawn(s)
+	if err != nil {
+		return err
+	}
+
+	// 这些语句没有输出, 不影响之后命令的标记
+	var setup []string
+	if s.plainTextRendering && s.shell.Type == ShellPowerShell {
+		setup = append(setup, psPlainTextRendering)
+	}
+	if s.constrained {
+		setup = append(setup, constrainedSetup(s.preferences, s.plainTextRendering))
+	}
+	if s.options.Remote != nil {
+		setup = append(setup, remoteSetup(s.options.Remote, s.preferences))
+	}
+	if len(s.preferences) > 0 {
+		setup = append(setup, preferenceCommand(s.preferences))
+	}
+	if s.transcript != "" {
+		setup = append(setup, startTranscriptCommand(s.transcript))
+	}
+	if len(setup) > 0 {
+		if _, err := proc.stdin.Write([]byte(strings.Join(setup, "; ") + "\n")); err != nil {
+			proc.abort()
+			return fmt.Errorf("failed to initialize shell: %v", err)
+		}
+	}
+
+	output := make(chan []byte, 64)
+	s.startReader(proc.stdout, output)
+	// 不读取 stderr 时管道写满会阻塞写入 stderr 的 shell
+	// 启动期间的 stderr 同时保存一份, 启动失败时附带在错误信息中
+	startup := newStartupCapture()
+	go func() {
+		drainStderr(s.ID, io.TeeReader(proc.stderr, startup), s.stderrTail, s.readBufferSize)
+		close(startup.eof)
+	}()
+
+	s.proc = proc
+	s.Stdin = proc.stdin
+	s.Stdout = proc.stdout
+	s.Stderr = proc.stderr
+	s.output = output
+	s.exited = make(chan struct{})
+	s.startup = startup
+	s.subShells = make(map[string]*subShell)
+	s.group = proc.tree
+	s.teardownOnce = new(sync.Once)
+	s.resetAbort()
+	s.suspect.Store(false)
+	return nil
+}
+
 // GetSession 获取指定的会话
 func (sm *SessionManager) GetSession(sessionID string) (*Session, bool) {
 	sm.mu.RLock()
@@ -89,101 +601,729 @@ func (sm *SessionManager) GetSession(sessionID string) (*Session, bool) {
 	return session, exists
 }
 
+// Count 返回当前的会话数
+func (sm *SessionManager) Count() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.sessions)
+}
+
+// GetSessionFor 获取请求方有权访问的会话
+// 跨租户访问与会话不存在的结果相同, 避免泄露会话是否存在
+func (sm *SessionManager) GetSessionFor(sessionID string, identity *Identity) (*Session, bool) {
+	session, exists := sm.GetSession(sessionID)
+	if !exists || !identity.CanAccess(session.Owner) {
+		return nil, false
+	}
+	return session, true
+}
+
+// SessionSummary 会话列表中的摘要信息
+type SessionSummary struct {
+	SessionID string    `json:"session_id"`
+	Owner     string    `json:"owner"`
+	Shell     string    `json:"shell"`
+	Running   bool      `json:"running"`
+	Suspect   bool      `json:"suspect"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsed 最近一条命令结束的时间, 不在本进程中的会话为空
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	// Instance 会话所在的服务实例
+	Instance string `json:"instance,omitempty"`
+	// Labels 创建会话时设置的标签
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ListSessions 列出请求方有权访问且标签满足 selector 的会话
+// 元数据来自 Store, 运行状态来自本进程中的会话, 不在本进程中的会话 running 为 false
+func (sm *SessionManager) ListSessions(identity *Identity, selector labelSelector) ([]SessionSummary, error) {
+	records, err := sm.Store.ListSessions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	summaries := make([]SessionSummary, 0, len(records))
+	for _, rec := range records {
+		if !identity.CanAccess(rec.Owner) || !selector.matches(rec.Labels) {
+			continue
+		}
+		summary := SessionSummary{
+			SessionID: rec.ID,
+			Owner:     rec.Owner,
+			Shell:     rec.Shell,
+			CreatedAt: rec.CreatedAt,
+			Instance:  rec.Instance,
+			Labels:    rec.Labels,
+		}
+		if session, exists := sm.GetSession(rec.ID); exists {
+			summary.Running = session.running.Load()
+			summary.Suspect = session.suspect.Load()
+			lastUsed := session.LastUsed()
+			summary.LastUsed = &lastUsed
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].CreatedAt.Before(summaries[j].CreatedAt)
+	})
+	return summaries, nil
+}
+
+// deleteRecord 从 Store 删除会话元数据, 失败时只记录日志
+func (sm *SessionManager) deleteRecord(sessionID string) {
+	if err := sm.Store.DeleteSession(sessionID); err != nil {
+		log.Printf("⚠ Failed to delete session record | SessionID: %s | Error: %v", sessionID, err)
+	}
+}
+
 // EndSession 结束指定的会话
-func (sm *SessionManager) EndSession(sessionID string) error {
+// force 为 false 时先让 shell 执行 exit, 超过 EndGracePeriod 仍未退出再强制结束
+func (sm *SessionManager) EndSession(sessionID string, force bool) error {
+	// 先从列表中移除, 等待进程退出时不占用管理器的锁
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
 	session, exists := sm.sessions[sessionID]
+	ending := sm.ending[sessionID]
+	if exists {
+		delete(sm.sessions, sessionID)
+		sm.ending[sessionID] = session
+	}
+	sm.mu.Unlock()
+
 	if !exists {
+		if ending != nil {
+			// 其他调用方正在清理, 等待清理完成后同样按已结束返回
+			ending.waitEnded(force)
+			log.Printf("✓ Session already ended by a concurrent call | SessionID: %s", sessionID)
+		} else {
+			log.Printf("✗ Failed to end session: session not found | SessionID: %s", sessionID)
+		}
+		return fmt.Errorf("%w: %s", errSessionNotFound, sessionID)
+	}
+	// 从列表中移除的调用方负责清理, 列表中只有 running 状态的会话, 状态切换再次确认只有一个调用方继续
+	if !session.transition(stateRunning, stateEnding) {
+		sm.finishEnding(session)
 		log.Printf("✗ Failed to end session: session not found | SessionID: %s", sessionID)
-		return fmt.Errorf("session not found: %s", sessionID)
+		return fmt.Errorf("%w: %s", errSessionNotFound, sessionID)
+	}
+	sm.unreserve(session.Owner)
+	// 在释放 session.mu 之后执行, 等待的调用方返回时清理已全部完成
+	defer sm.finishEnding(session)
+
+	if force {
+		// 不等待正在执行的命令结束
+		session.interruptOnce.Do(func() { close(session.interrupt) })
 	}
 
 	session.mu.Lock()
 	defer session.mu.Unlock()
+	defer session.state.Store(int32(stateEnded))
+	defer secretRegistry.Remove(sessionID)
+	defer sm.deleteRecord(sessionID)
+	defer notifySession(EventSessionEnded, session.Owner, sessionID)
+	if session.transcript != "" {
+		// 在进程结束之后处理, shell 不再写入记录文件
+		defer transcriptStore.Release(sessionID, session.Owner, session.transcript)
+	}
+
+	if !session.running.Load() {
+		// watch 已清理过退出的 shell, 这里不会重复清理
+		session.teardown()
+		log.Printf("✓ Closed session | SessionID: %s | Shell already exited", sessionID)
+		return nil
+	}
+	session.running.Store(false)
 
-	if session.Running {
-		session.Stdin.Close()
-		session.Cmd.Process.Kill()
-		session.Running = false
+	graceful := false
+	// 等待重启时没有可以接收 exit 的 shell
+	if !force && sm.EndGracePeriod > 0 && !session.respawning {
+		graceful = session.exitGracefully(sm.EndGracePeriod)
 	}
+	session.teardown()
 
-	delete(sm.sessions, sessionID)
-	log.Printf("✓ Closed session | SessionID: %s", sessionID)
+	if graceful {
+		log.Printf("✓ Closed session | SessionID: %s | Shell exited gracefully", sessionID)
+	} else {
+		log.Printf("✓ Closed session | SessionID: %s | Shell was force-killed", sessionID)
+	}
 	return nil
 }
 
+// finishEnding 清理完成后移出 ending 并通知等待的调用方
+func (sm *SessionManager) finishEnding(session *Session) {
+	sm.mu.Lock()
+	delete(sm.ending, session.ID)
+	sm.mu.Unlock()
+	close(session.ended)
+}
+
+// waitEnding 请求方的会话正在被其他调用方清理时等待清理完成, 返回是否等待过
+func (sm *SessionManager) waitEnding(sessionID string, identity *Identity, force bool) bool {
+	sm.mu.RLock()
+	session := sm.ending[sessionID]
+	sm.mu.RUnlock()
+	if session == nil || !identity.CanAccess(session.Owner) {
+		return false
+	}
+	session.waitEnded(force)
+	return true
+}
+
+// waitEnded 等待会话清理完成, force 时让正在执行的命令立即返回, 不等待先到的非强制结束
+func (s *Session) waitEnded(force bool) {
+	if force {
+		s.interruptOnce.Do(func() { close(s.interrupt) })
+	}
+	<-s.ended
+}
+
+// CloseAll 强制结束所有会话, 返回被结束的会话 ID
+// 各会话并行结束, 与正常请求并发调用是安全的, 已被其他请求结束的会话会被跳过
+func (sm *SessionManager) CloseAll() []string {
+	sm.mu.RLock()
+	ids := make([]string, 0, len(sm.sessions))
+	for id := range sm.sessions {
+		ids = append(ids, id)
+	}
+	sm.mu.RUnlock()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		ended = make([]string, 0, len(ids))
+	)
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := sm.EndSession(id, true); err != nil {
+				return
+			}
+			mu.Lock()
+			ended = append(ended, id)
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	sort.Strings(ended)
+	return ended
+}
+
+const (
+	// maxOutputSize 内存中保留的命令输出上限
+	maxOutputSize = 1024 * 1024 // 1MB 限制
+	// maxFileOutputSize 输出写入文件时的上限
+	maxFileOutputSize = 1024 * 1024 * 1024 // 1GB 限制
+)
+
+// CommandResult 命令执行结果
+type CommandResult struct {
+	// CommandID 命令的 ID, 与会话历史中的记录对应
+	CommandID string `json:"command_id,omitempty"`
+	Output    string `json:"output"`
+	// Data JSON 输出模式下解析后的对象, 此时 Output 为空
+	Data json.RawMessage `json:"data,omitempty"`
+	// OutputBase64 base64 输出模式下 base64 编码的原始输出字节, 此时 Output 为空
+	OutputBase64 *string `json:"output_base64,omitempty"`
+	// Size 输出的字节数
+	Size int `json:"size"`
+	// ExitCode 命令结束后的 $LASTEXITCODE, 静默模式下无法获取时为 null
+	ExitCode *int `json:"exit_code"`
+	// TimedOut 命令超时, Output 为超时前已产生的输出
+	TimedOut bool `json:"timed_out"`
+	// Aborted 输出速率超过 output_rate_limit, 命令被中止并重启了 shell, Output 为中止前的输出
+	Aborted bool `json:"aborted,omitempty"`
+	// Cancelled 命令被 /cancel-session-commands 取消, Output 为取消前的输出
+	Cancelled bool `json:"cancelled,omitempty"`
+	// Encoding 输出的编码和替换字符数, 管道中没有 decode 处理器或输出为原始字节时不返回
+	Encoding *OutputEncoding `json:"encoding,omitempty"`
+	// Recycled 会话连续出错达到 recycle_after_errors 被回收: restarted 已重启 shell, ended 会话即将结束
+	Recycled string `json:"recycled,omitempty"`
+	// Truncated 输出不完整: 超过输出上限、超过 max_lines 或命令超时, 文本输出末尾附有截断提示
+	Truncated bool `json:"truncated"`
+	// Truncate 截断时保留的部分: head 或 tail, 未截断时为空; tail 时截断提示在输出开头
+	Truncate TruncateMode `json:"truncate,omitempty"`
+	// HadOutput 命令产生了输出, 不包括命令回显和截断提示
+	HadOutput bool `json:"had_output"`
+	// Error 命令失败的原因
+	Error string `json:"error,omitempty"`
+	// Status 命令是否成功: success 或 error, 仅在请求 report_status 且能获取退出码时返回
+	Status string `json:"status,omitempty"`
+	// CPUMs 命令执行期间会话进程树使用的 CPU 时间(毫秒), 仅在请求 report_usage 时返回
+	CPUMs *int64 `json:"cpu_ms,omitempty"`
+	// PeakMemoryBytes 命令执行期间会话进程树采样到的内存峰值, 仅在请求 report_usage 时返回
+	PeakMemoryBytes *uint64 `json:"peak_memory_bytes,omitempty"`
+	// Segments 按检查点分段的输出, 仅在请求 checkpoints 时返回
+	Segments []CommandSegment `json:"segments,omitempty"`
+	// Spooled 输出超过 spool_threshold 时为完整输出的下载信息, Output 只包含开头的预览
+	Spooled *SpooledOutput `json:"spooled,omitempty"`
+	// Debug 写入 stdin 的完整文本和读到的原始字节, 仅在管理员请求 debug 时返回
+	Debug *CommandDebug `json:"debug,omitempty"`
+	// Exception 命令抛出的终止错误, 仅在会话开启 structured_errors 时返回
+	Exception *CommandException `json:"exception,omitempty"`
+	// Baseline 与基线的比较结果, 仅在请求 baseline 时返回
+	Baseline *BaselineResult `json:"baseline,omitempty"`
+}
+
+// RunOptions 单条命令的执行参数
+type RunOptions struct {
+	// Timeout 覆盖会话的默认超时, 不能超过会话的超时时间
+	Timeout time.Duration
+	// IdleTimeout 连续没有输出的最长时间, 不能超过服务端的 output_idle_timeout, 0 表示使用服务端的值
+	IdleTimeout time.Duration
+	// Limit 输出上限(字节), 0 表示使用 maxOutputSize
+	Limit int
+	// Format 输出格式, 为空时为文本
+	Format OutputFormat
+	// JSONDepth JSON 输出的序列化深度, 0 表示使用会话的默认值
+	JSONDepth int
+	// StripANSI 是否去除 ANSI 转义序列, 为空时使用会话的默认值
+	StripANSI *bool
+	// NormalizeNewlines 是否将 CRLF 转换为 LF, 为空时使用会话的默认值
+	NormalizeNewlines *bool
+	// StripBOM 是否去除输出开头的 UTF-8 BOM, 为空时使用会话的默认值
+	StripBOM *bool
+	// MaxLines 只返回输出的前若干行, 0 表示不限制
+	MaxLines int
+	// Truncate 超过输出上限或 MaxLines 时保留开头还是末尾, 为空时保留开头
+	Truncate TruncateMode
+	// ReportUsage 统计命令执行期间进程树的 CPU 时间和内存峰值
+	ReportUsage bool
+	// ReportStatus 根据退出码和终止错误返回命令是否成功
+	ReportStatus bool
+	// EchoCommand 在输出开头回显执行的命令
+	EchoCommand bool
+	// EchoTimestamp 回显命令时带上发送命令的时间
+	EchoTimestamp bool
+	// MarkerChannel 本条命令的标记输出方式, 为空时使用会话的默认值
+	MarkerChannel MarkerChannel
+	// counted 客户端请求的命令, 受会话的命令数上限限制并使用会话调整后的输出限制; 初始化和内部命令不计入
+	counted bool
+	// trace 不为空时为写入命令和读取输出创建子 span
+	trace *Span
+	// checkpoints 不为空时为命令中检查点标记的前缀, 输出按检查点分段
+	checkpoints string
+	// probe 探测命令, 不记录命令日志和慢命令日志, 不计入命令数, 不更新最近使用时间
+	probe bool
+	// holdsSlot 调用方已持有执行名额, 不再重复获取
+	holdsSlot bool
+	// failIfBusy 会话正在执行其他命令时立即返回 errSessionBusy, 不排队等待
+	failIfBusy bool
+	// QueueTimeout 排队等待会话的最长时间, 不能超过服务端的 session_queue_timeout, 0 表示使用服务端的值
+	QueueTimeout time.Duration
+	// env 从请求头转发的环境变量, 只在本条命令执行期间设置
+	env []envVar
+	// budget 不为空时为批量执行共享的 total_timeout_ms, 用完后命令不再执行, 执行中的命令不超过其截止时间
+	budget context.Context
+	// debug 在结果中返回写入 stdin 的完整文本和读到的原始字节
+	debug bool
+	// local 命令在外层 shell 中执行, 不进入远程会话或受限语言的 runspace, 用于检查 shell 本身的状态
+	local bool
+	// live 命令开始执行时的服务端配置快照, 由 RunCommandTo 设置, 执行期间重新加载配置不影响该命令
+	live *serverSettings
+}
+
+// timeoutFor 返回命令的超时时间, 请求的超时不能超过会话的超时
+func (s *Session) timeoutFor(opts RunOptions) time.Duration {
+	timeout := s.settings().commandTimeout
+	if opts.Timeout > 0 && (timeout == 0 || opts.Timeout < timeout) {
+		timeout = opts.Timeout
+	}
+	return budgetTimeout(opts.budget, timeout)
+}
+
+// idleTimeoutFor 返回命令的无输出超时, 请求的值不能超过服务端的 output_idle_timeout, 0 表示不限制
+// 内部命令不受该超时限制
+func (s *Session) idleTimeoutFor(opts RunOptions) time.Duration {
+	if !opts.counted {
+		return 0
+	}
+	idle := opts.live.outputIdleTimeout
+	if opts.IdleTimeout > 0 && (idle == 0 || opts.IdleTimeout < idle) {
+		idle = opts.IdleTimeout
+	}
+	return idle
+}
+
+// queueTimeoutFor 返回排队等待会话的最长时间, 请求的值不能超过服务端的 session_queue_timeout, 0 表示不限制
+// 内部命令不受限制
+func (s *Session) queueTimeoutFor(opts RunOptions) time.Duration {
+	if !opts.counted {
+		return 0
+	}
+	wait := opts.live.sessionQueueTimeout
+	if opts.QueueTimeout > 0 && (wait == 0 || opts.QueueTimeout < wait) {
+		wait = opts.QueueTimeout
+	}
+	return wait
+}
+
 // RunCommand 在指定会话中执行命令
-func (s *Session) RunCommand(command string) (string, error) {
-	s.mu.Lock()
+// 命令已发送时即使出错(如超时)也返回已产生的输出
+func (s *Session) RunCommand(command string, opts RunOptions) (*CommandResult, error) {
+	var buf bytes.Buffer
+	result, err := s.RunCommandTo(command, &buf, opts)
+	if result == nil {
+		return nil, err
+	}
+
+	if opts.Format == OutputBase64 {
+		encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+		result.OutputBase64 = &encoded
+		opts.logCommand("← Output | SessionID: %s | Raw: %d bytes", s.ID, buf.Len())
+		return result, err
+	}
+	result.Output = buf.String()
+	if opts.checkpoints != "" {
+		result.splitSegments(opts.checkpoints)
+	}
+	opts.logCommand("← Output | SessionID: %s | Content:\n%s", s.ID, result.Output)
+	if opts.Format == OutputJSON && err == nil && !result.parseJSONOutput() {
+		log.Printf("⚠ Output is not valid JSON, returning text | SessionID: %s", s.ID)
+	}
+	return result, err
+}
+
+// RunCommandTo 在指定会话中执行命令, 输出写入 out, 返回结果中不包含输出内容
+func (s *Session) RunCommandTo(command string, out io.Writer, opts RunOptions) (*CommandResult, error) {
+	gen := s.cancelGen.Load()
+	opts.live = currentSettings()
+	if opts.failIfBusy {
+		// 会话忙时不必等待执行名额
+		if err := s.busyError(); err != nil {
+			log.Printf("✗ Session busy | SessionID: %s | Error: %v", s.ID, err)
+			return nil, err
+		}
+	}
+	s.queued.Add(1)
+	if !opts.holdsSlot {
+		// 先获取名额再等待会话锁, 与子 shell 持有名额后执行内部命令的顺序一致
+		if err := commandLimiter.AcquireWithin(s.interrupt, opts.budget); err != nil {
+			s.queued.Add(-1)
+			if errors.Is(err, errBudgetExceeded) {
+				log.Printf("✗ Command skipped: total timeout exhausted while waiting for a slot | SessionID: %s", s.ID)
+				return nil, err
+			}
+			log.Printf("✗ Command execution failed | SessionID: %s | Error: %v", s.ID, err)
+			return nil, err
+		}
+		defer commandLimiter.Release()
+	}
+
+	if budgetExceeded(opts.budget) {
+		s.queued.Add(-1)
+		log.Printf("✗ Command skipped: total timeout exhausted | SessionID: %s", s.ID)
+		return nil, errBudgetExceeded
+	}
+	queueCtx := context.Background()
+	if opts.budget != nil {
+		// 排队等待同样消耗共享的预算
+		queueCtx = opts.budget
+	}
+	if wait := s.queueTimeoutFor(opts); wait > 0 {
+		var cancel context.CancelFunc
+		queueCtx, cancel = context.WithTimeout(queueCtx, wait)
+		defer cancel()
+	}
+	if err := s.lockForCommand(queueCtx, opts.failIfBusy); err != nil {
+		s.queued.Add(-1)
+		if errors.Is(err, errQueueWaitTimeout) && budgetExceeded(opts.budget) {
+			log.Printf("✗ Command skipped: total timeout exhausted while queued | SessionID: %s", s.ID)
+			return nil, errBudgetExceeded
+		}
+		if errors.Is(err, errQueueWaitTimeout) {
+			log.Printf("✗ Command did not start within queue wait timeout | SessionID: %s | Wait: %s", s.ID, s.queueTimeoutFor(opts))
+			return nil, fmt.Errorf("%w (%s)", err, s.queueTimeoutFor(opts))
+		}
+		log.Printf("✗ Session busy | SessionID: %s | Error: %v", s.ID, err)
+		return nil, err
+	}
+	s.queued.Add(-1)
 	defer s.mu.Unlock()
 
-	if !s.Running {
+	if s.cancelGen.Load() != gen || s.cancelling.Load() {
+		log.Printf("✗ Command cancelled before it started | SessionID: %s", s.ID)
+		return nil, errCommandCancelled
+	}
+	if budgetExceeded(opts.budget) {
+		log.Printf("✗ Command skipped: total timeout exhausted | SessionID: %s", s.ID)
+		return nil, errBudgetExceeded
+	}
+
+	if !s.running.Load() {
 		log.Printf("✗ Command execution failed: session not running | SessionID: %s", s.ID)
-		return "", fmt.Errorf("session is not running")
+		return nil, fmt.Errorf("session is not running")
+	}
+	if s.respawning {
+		log.Printf("✗ Command execution failed: shell is restarting | SessionID: %s", s.ID)
+		return nil, errRespawning
+	}
+	if s.suspect.Load() {
+		log.Printf("✗ Command execution failed: shell is unresponsive | SessionID: %s", s.ID)
+		return nil, fmt.Errorf("session shell is unresponsive: %w", errStdinTimeout)
+	}
+
+	if opts.counted {
+		if err := memoryGuard.Check(); err != nil {
+			log.Printf("✗ Command refused: total session memory over limit | SessionID: %s | Memory: %d MB", s.ID, memoryGuard.Total()>>20)
+			return nil, err
+		}
+	}
+	if !readGuard.Enter() {
+		log.Printf("✗ Command refused: too many blocked reads | SessionID: %s | Blocked reads: %d", s.ID, readGuard.Blocked())
+		return nil, errReadGuardSaturated
 	}
+	defer readGuard.Exit()
 
-	log.Printf("→ Executing command | SessionID: %s | Command: %s", s.ID, command)
+	if opts.counted && !opts.probe {
+		if err := s.checkCommandLimit(); err != nil {
+			return nil, err
+		}
+	}
+
+	opts.logCommand("→ Executing command | SessionID: %s | Command: %s", s.ID, command)
 
-	// 使用唯一标记来分隔输出
-	marker := uuid.New().String()
-	// 使用 *>&1 将所有输出流(包括错误)重定向到标准输出
-	fullCommand := fmt.Sprintf("& { %s } *>&1 | Out-String; Write-Host '%s'\n", command, marker)
+	// 使用唯一标记来分隔输出: 会话的标记前缀加命令 ID, 前缀不出现在命令 ID 中
+	commandID := uuid.New().String()
+	marker := s.markerPrefix + commandID
+	s.beginCommand(commandID, command, !opts.counted)
+	defer s.endCommand(!opts.probe)
+
+	// 回显客户端给出的命令, 不包括运维配置的模板
+	echoed := command
+	// 先套用运维配置的模板, 再加上输出重定向和标记
+	command = wrapCommand(s.commandTemplate, command)
+
+	markerChannel := s.markerChannel
+	if opts.MarkerChannel != "" {
+		markerChannel = opts.MarkerChannel
+	}
+	frameOpts := frameOptions{
+		constrained:      s.constrained && !opts.local,
+		remote:           s.options.Remote != nil && !opts.local,
+		raw:              opts.Format == OutputBase64,
+		console:          markerChannel == MarkerConsole,
+		flush:            s.flushOutput,
+		structuredErrors: s.structuredErrors,
+		env:              opts.env,
+	}
+	if opts.Format == OutputJSON {
+		frameOpts.jsonDepth = opts.JSONDepth
+		if frameOpts.jsonDepth == 0 {
+			frameOpts.jsonDepth = s.jsonDepth
+		}
+	}
+	fullCommand := s.shell.frame(command, marker, s.terminator, frameOpts)
 
-	// 写入命令
-	if _, err := s.Stdin.Write([]byte(fullCommand)); err != nil {
+	// 写入命令, 管道是无缓冲的, 写入返回即已交给 shell
+	writeSpan := opts.trace.child("stdin.write")
+	writeSpan.set("rce.command_bytes", len(fullCommand))
+	err := writeWithTimeout(s.Stdin, []byte(fullCommand), stdinWriteTimeout)
+	writeSpan.fail(err)
+	writeSpan.finish()
+	if err != nil {
+		if errors.Is(err, errStdinTimeout) {
+			// 未写完的命令可能随时被 shell 读到, 之后的命令无法可靠执行
+			s.suspect.Store(true)
+			s.addEvent("suspect", err.Error())
+		}
 		log.Printf("✗ Failed to write command | SessionID: %s | Error: %v", s.ID, err)
-		return "", fmt.Errorf("failed to write command: %v", err)
-	}
-
-	// 读取输出直到遇到标记
-	output := make([]byte, 0, 4096)
-	buffer := make([]byte, 1024)
-	markerBytes := []byte(marker)
-
-	for {
-		n, err := s.Stdout.Read(buffer)
-		if err != nil && err != io.EOF {
-			log.Printf("✗ Failed to read output | SessionID: %s | Error: %v", s.ID, err)
-			return "", fmt.Errorf("failed to read output: %v", err)
-		}
-
-		if n > 0 {
-			output = append(output, buffer[:n]...)
-
-			// 检查是否包含标记
-			if len(output) >= len(markerBytes) {
-				// 在输出中查找标记
-				for i := len(output) - n; i <= len(output)-len(markerBytes); i++ {
-					if string(output[i:i+len(markerBytes)]) == marker {
-						// 找到标记,返回标记之前的内容
-						result := string(output[:i])
-						// 清理剩余的换行符
-						if len(result) > 0 && result[len(result)-1] == '\n' {
-							result = result[:len(result)-1]
-						}
-						if len(result) > 0 && result[len(result)-1] == '\r' {
-							result = result[:len(result)-1]
-						}
-						log.Printf("✓ Command executed successfully | SessionID: %s | Output length: %d bytes", s.ID, len(result))
-						log.Printf("← Output | SessionID: %s | Content:\n%s", s.ID, result)
-						return result, nil
-					}
-				}
+		err = fmt.Errorf("failed to write command: %w", err)
+		if opts.counted && !opts.probe {
+			if recycled := s.noteCommandResult(err); recycled != "" {
+				return &CommandResult{Error: err.Error(), Recycled: recycled}, err
 			}
 		}
+		return nil, err
+	}
+	sentAt := time.Now()
+	if !opts.probe {
+		defer func() { logSlowCommand(s.ID, echoed, time.Since(sentAt)) }()
+	}
+	if opts.counted && !opts.probe {
+		s.countCommand()
+	}
+	var usage *usageMonitor
+	if opts.ReportUsage {
+		usage = startUsageMonitor(s.ID, s.group)
+	}
 
-		// 避免无限等待
-		if len(output) > 1024*1024 { // 1MB 限制
-			log.Printf("⚠ Output size limit exceeded | SessionID: %s | Size: %d bytes", s.ID, len(output))
-			break
+	timeout := s.timeoutFor(opts)
+	idle := s.idleTimeoutFor(opts)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	settings := s.settings()
+	limit := opts.Limit
+	if limit == 0 {
+		limit = maxOutputSize
+		if opts.counted {
+			limit = settings.maxOutput
 		}
 	}
+	maxLines := opts.MaxLines
+	if maxLines == 0 && opts.counted && opts.checkpoints == "" && opts.Format != OutputJSON && opts.Format != OutputBase64 {
+		maxLines = settings.maxLines
+	}
 
-	result := string(output)
-	log.Printf("✓ Command completed (no marker found) | SessionID: %s | Output length: %d bytes", s.ID, len(result))
-	log.Printf("← Output | SessionID: %s | Content:\n%s", s.ID, result)
+	ow := &outputWriter{out: out, sessionID: s.ID, truncationNotice: opts.live.truncationNotice}
+	if opts.debug {
+		ow.debug = &debugCapture{}
+	}
+	if frameOpts.raw {
+		// 原始字节模式只替换机密值, 不做解码、去除 ANSI 和换行转换
+		ow.separator = s.shell.rawSeparator()
+	}
+	pipeline := pipelineOptions{
+		raw:               frameOpts.raw,
+		stripANSI:         s.stripANSI,
+		normalizeNewlines: s.normalizeNewlines,
+		stripBOM:          s.stripBOM,
+		maxLines:          maxLines,
+		keepLines:         opts.checkpoints != "" || opts.Format == OutputJSON,
+	}
+	if opts.StripANSI != nil {
+		pipeline.stripANSI = *opts.StripANSI
+	}
+	if opts.NormalizeNewlines != nil {
+		pipeline.normalizeNewlines = *opts.NormalizeNewlines
+	}
+	if opts.StripBOM != nil {
+		pipeline.stripBOM = *opts.StripBOM
+	}
+	if opts.Truncate == TruncateTail {
+		// 保留末尾时读取结束后再按行截断
+		pipeline.maxLines = 0
+	}
+	s.buildPipeline(ow, pipeline)
+	if opts.EchoCommand {
+		var timestamp time.Time
+		if opts.EchoTimestamp {
+			timestamp = sentAt
+		}
+		// 命令已发送, 之后的命令会跳过本条命令的残留输出
+		if err := ow.writeEcho(echoHeader(echoed, timestamp), s.secrets); err != nil {
+			return nil, err
+		}
+	}
+	// 回显之后写出的才是命令的输出
+	echoBytes := ow.written
+	readLimit := limit
+	if opts.Truncate == TruncateTail {
+		// 保留末尾时读取到结束标记, 内存中只保留最后的 limit 字节, 会话的下一条命令不受影响
+		ow.startTail(limit, maxLines)
+		readLimit = math.MaxInt
+	}
+	result := &CommandResult{CommandID: commandID}
+	if opts.counted && !opts.probe {
+		// 归档在返回之前提交, 写盘在后台进行
+		ow.archive = outputArchive.Begin(s, commandID, echoed)
+		defer func() { ow.archive.finish(result, err) }()
+	}
+	readSpan := opts.trace.child("output.read")
+	defer readSpan.finish()
+	switch s.terminator {
+	case TerminatorQuiescence:
+		err = s.collectQuiescent(ow, readLimit, deadline, newRateWatchdog(opts.live))
+	default:
+		var status string
+		status, err = s.collectUntilMarker(ow, marker, readLimit, deadline, idle, newRateWatchdog(opts.live))
+		if err == nil && opts.counted && opts.live.lateOutputDrain > 0 {
+			s.drainLateOutput(opts.live.lateOutputDrain, ow.debug)
+		}
+		status, result.Exception = splitException(s.ID, status)
+		result.ExitCode = parseExitCode(status)
+		if opts.ReportStatus {
+			result.Status = commandStatus(status)
+		}
+		if err == nil {
+			err = statusError(status)
+		}
+	}
+	if flushErr := ow.flush(); err == nil {
+		err = flushErr
+	}
+	ow.finishTail()
+	reason := truncationReason(ow, limit, maxLines, timeout, idle, err)
+	// 原始字节和 JSON 输出附加提示后无法解析, 内部命令的输出由服务自己解析, 都只设置 truncated
+	notice := opts.counted && !frameOpts.raw && opts.Format != OutputJSON
+	if ow.tail != nil {
+		if emitErr := ow.emitTail(reason, notice); err == nil {
+			err = emitErr
+		}
+	}
+	usage.finish(result)
+	result.Size = ow.written
+	result.Encoding = ow.encoding.metadata()
+	result.HadOutput = ow.written > echoBytes
+	readSpan.set("rce.output_bytes", ow.written)
+	readSpan.fail(err)
+	result.Debug = ow.debug.result(fullCommand, marker, s.secrets)
+	if ow.limited {
+		log.Printf("⚠ Output truncated | SessionID: %s | Limit: %d bytes", s.ID, limit)
+	}
+	if ow.lines != nil && ow.lines.truncated {
+		log.Printf("⚠ Output truncated | SessionID: %s | Max lines: %d", s.ID, maxLines)
+	}
+	if reason != "" {
+		result.Truncated = true
+		result.Truncate = TruncateHead
+		if ow.tail != nil {
+			result.Truncate = TruncateTail
+		} else if notice {
+			if noticeErr := ow.writeTruncationNotice(reason); err == nil {
+				err = noticeErr
+			}
+		}
+	}
+	if opts.counted && !opts.probe {
+		s.outputStats.record(result)
+		result.Recycled = s.noteCommandResult(err)
+	}
+	if errors.Is(err, errIncompleteCommand) || errors.Is(err, errSyntaxError) {
+		log.Printf("✗ Command rejected by parser | SessionID: %s | Error: %v", s.ID, err)
+		return result, err
+	}
+	if errors.Is(err, errIdleTimeout) {
+		// 命令仍在 shell 中运行, 与总超时一样处理
+		log.Printf("✗ Command produced no output | SessionID: %s | Idle timeout: %s | Partial output: %d bytes", s.ID, idle, ow.written)
+		err = fmt.Errorf("%w (%s)", errIdleTimeout, idle)
+	} else if errors.Is(err, errCommandTimeout) {
+		log.Printf("✗ Command timed out | SessionID: %s | Timeout: %s | Partial output: %d bytes", s.ID, timeout, ow.written)
+	}
+	if errors.Is(err, errCommandTimeout) {
+		// 保留超时前的输出, 由调用方返回给客户端
+		result.TimedOut = true
+		result.Error = err.Error()
+		return result, err
+	}
+	if errors.Is(err, errCommandAborted) && s.cancelGen.Load() != gen {
+		// 命令仍在 shell 中运行, 由取消请求结束其进程并读走剩余输出
+		log.Printf("✗ Command cancelled | SessionID: %s | Partial output: %d bytes", s.ID, ow.written)
+		s.unfinished = marker
+		result.Cancelled = true
+		result.Error = errCommandCancelled.Error()
+		return result, errCommandCancelled
+	}
+	if errors.Is(err, errRunawayOutput) {
+		// 命令仍在 shell 中输出, 不重启 shell 会话无法继续使用
+		log.Printf("✗ Command aborted by output watchdog | SessionID: %s | Output: %d bytes | Error: %v", s.ID, ow.written, err)
+		result.Aborted = true
+		result.Error = err.Error()
+		if restartErr := s.restartShell("output watchdog: " + err.Error()); restartErr != nil {
+			log.Printf("✗ Failed to restart shell after runaway output | SessionID: %s | Error: %v", s.ID, restartErr)
+		}
+		return result, err
+	}
+	if err != nil {
+		return result, err
+	}
+
+	opts.logCommand("✓ Command executed successfully | SessionID: %s | Output length: %d bytes", s.ID, ow.written)
 	return result, nil
 }
 
@@ -192,118 +1332,430 @@ var sessionManager *SessionManager
 // API1: 开启新会话
 func handleStartSession(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	log.Printf("→ Request: Start new session")
-	session, err := sessionManager.CreateSession()
+	// 请求体可选, 为空时使用默认参数
+	var opts SessionOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	span := spanFrom(r).child("session.create")
+	session, err := startSession(identityFrom(r), opts)
+	span.fail(err)
+	if err == nil {
+		span.set("rce.session_id", session.ID)
+		span.set("rce.shell", session.ShellName)
+	}
+	span.finish()
 	if err != nil {
-		log.Printf("✗ Failed to start session | Error: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to create session: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("✓ Session started successfully | SessionID: %s", session.ID)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"session_id": session.ID,
-	})
+	resp := map[string]string{"session_id": session.ID}
+	if instanceID != "" {
+		// 客户端在之后的请求中通过 X-RCE-Instance 带上该值
+		resp["instance"] = instanceID
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 // API2: 执行命令
 func handleRunCommand(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	var req struct {
-		SessionID string `json:"session_id"`
-		Command   string `json:"command"`
-	}
-
+	var req RunCommandRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("✗ Invalid request body | Error: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
 		return
 	}
 
-	if req.SessionID == "" || req.Command == "" {
-		log.Printf("✗ Missing required parameters | SessionID: %s | Command: %s", req.SessionID, req.Command)
-		http.Error(w, "session_id and command are required", http.StatusBadRequest)
+	req.trace = spanFrom(r)
+	req.env = forwardedEnv(r.Header)
+	if err := applyRequestTimeout(r, &req); err != nil {
+		writeError(w, err)
 		return
 	}
-
-	log.Printf("→ Request: Run command | SessionID: %s | Command: %s", req.SessionID, req.Command)
-
-	session, exists := sessionManager.GetSession(req.SessionID)
-	if !exists {
-		log.Printf("✗ Session not found | SessionID: %s", req.SessionID)
-		http.Error(w, "Session not found", http.StatusNotFound)
+	if acceptsNDJSON(r.Header.Get("Accept")) {
+		streamRunCommand(w, r, req)
 		return
 	}
+	result, file, err := runCommand(identityFrom(r), req)
+	writeRunCommandResult(w, req, result, file, err)
+}
 
-	output, err := session.RunCommand(req.Command)
+// writeRunCommandResult 按 /run-command 的格式返回命令结果: 默认为纯文本, 元数据在响应头中
+func writeRunCommandResult(w http.ResponseWriter, req RunCommandRequest, result *CommandResult, file *OutputFile, err error) {
+	if result != nil && result.Recycled != "" {
+		w.Header().Set(recycledHeader, result.Recycled)
+	}
+	if file != nil {
+		logCommand("✓ Response sent | SessionID: %s | Output file: %s | Size: %d bytes", req.SessionID, file.Token, file.Size)
+		if err != nil {
+			writeErrorResult(w, err, newOutputFileResponse(file, result))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newOutputFileResponse(file, result))
+		return
+	}
+	if result != nil && (result.TimedOut || result.Aborted || result.Cancelled || errorCode(err) == codeJSONFilterFailed) {
+		// 超时、被中止或被取消时返回已产生的部分输出, 便于排查; json_filter 出错时返回未经过滤的结果
+		writeErrorResult(w, err, result)
+		return
+	}
 	if err != nil {
-		log.Printf("✗ Command execution failed | SessionID: %s | Error: %v", req.SessionID, err)
-		http.Error(w, fmt.Sprintf("Failed to execute command: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("✓ Response sent | SessionID: %s | Output length: %d bytes", req.SessionID, len(output))
+	if !req.Probe {
+		logCommand("✓ Response sent | SessionID: %s | Output length: %d bytes", req.SessionID, result.Size)
+	}
+	if result.CommandID != "" {
+		w.Header().Set("X-Command-ID", result.CommandID)
+	}
+	if result.ExitCode != nil {
+		w.Header().Set("X-Exit-Code", strconv.Itoa(*result.ExitCode))
+	}
+	if result.Truncated {
+		w.Header().Set("X-Output-Truncated", "true")
+		w.Header().Set("X-Output-Truncate", string(result.Truncate))
+	}
+	if result.Status != "" {
+		w.Header().Set("X-Command-Status", result.Status)
+	}
+	if result.CPUMs != nil {
+		w.Header().Set("X-CPU-Ms", strconv.FormatInt(*result.CPUMs, 10))
+		w.Header().Set("X-Peak-Memory-Bytes", strconv.FormatUint(*result.PeakMemoryBytes, 10))
+	}
+	if result.Encoding != nil && result.Encoding.Lossy {
+		w.Header().Set("X-Output-Replacements", strconv.Itoa(result.Encoding.Replacements))
+	}
+	w.Header().Set("X-Had-Output", strconv.FormatBool(result.HadOutput))
+	emptyJSON := !result.HadOutput && req.emptyOutputMode() == EmptyOutputJSON
+	if req.OutputFormat == OutputBase64 || result.Segments != nil || result.Spooled != nil || result.Baseline != nil || result.Debug != nil || result.Exception != nil || emptyJSON {
+		// 原始字节无法作为文本返回, 与元数据一起以 JSON 返回; 分段输出、转存的输出、基线比较结果、调试信息和终止错误同样以 JSON 返回
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if result.Data != nil {
+		// JSON 输出模式直接返回序列化后的对象
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result.Data)
+		return
+	}
 	// 返回纯文本,保留原始格式
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(output))
+	w.Write([]byte(result.Output))
 }
 
 // API3: 结束会话
 func handleEndSession(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	var req struct {
-		SessionID string `json:"session_id"`
-	}
-
+	var req EndSessionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("✗ Invalid request body | Error: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	resp, err := endSession(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// API6: 列出会话
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		log.Printf("✗ Invalid label selector | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "%v", err))
 		return
 	}
 
-	if req.SessionID == "" {
-		log.Printf("✗ Missing session_id parameter")
-		http.Error(w, "session_id is required", http.StatusBadRequest)
+	identity := identityFrom(r)
+	sessions, err := sessionManager.ListSessions(identity, selector)
+	if err != nil {
+		log.Printf("✗ Failed to list sessions | Error: %v", err)
+		writeError(w, newAPIError(http.StatusInternalServerError, "%v", err))
 		return
 	}
 
-	log.Printf("→ Request: End session | SessionID: %s", req.SessionID)
+	log.Printf("✓ Sessions listed | Owner: %s | Count: %d", identity.Name, len(sessions))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
 
-	if err := sessionManager.EndSession(req.SessionID); err != nil {
-		log.Printf("✗ Failed to end session | SessionID: %s | Error: %v", req.SessionID, err)
-		http.Error(w, fmt.Sprintf("Failed to end session: %v", err), http.StatusInternalServerError)
+// handleNotFound 未注册的路径
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, newAPIError(http.StatusNotFound, "Not found"))
+}
+
+// API13: 结束所有会话(管理员)
+func handleKillAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	log.Printf("✓ Session ended successfully | SessionID: %s", req.SessionID)
+	ended := killAllSessions(identityFrom(r))
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Session ended successfully",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":       len(ended),
+		"session_ids": ended,
 	})
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to JSON config file")
+	verifyAudit := flag.String("verify-audit", "", "verify the hash chain of an audit log file and exit")
+	flag.Parse()
+	log.SetOutput(&redactingWriter{w: os.Stderr, registry: secretRegistry})
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	liveSettings.Store(newServerSettings(cfg))
+	configReloader = NewConfigReloader(*configPath, cfg)
+	logSessionIDs = LogSessionIDs(cfg.LogSessionIDs)
+
+	if *verifyAudit != "" {
+		f, err := os.Open(*verifyAudit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := VerifyAuditLog(f, []byte(cfg.AuditLogKey)); err != nil {
+			log.Fatalf("✗ Audit log verification failed: %v", err)
+		}
+		log.Printf("✓ Audit log verified | Path: %s", *verifyAudit)
+		return
+	}
+
+	logBuildInfo()
+	if cfg.AuditLog != "" {
+		auditLog, err = OpenAuditLog(cfg.AuditLog, []byte(cfg.AuditLogKey))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✓ Audit log enabled | Path: %s", cfg.AuditLog)
+	}
+
+	tokenAuth = NewTokenAuth(cfg.Tokens, time.Duration(cfg.SignatureSkew))
+	tokenAuth.Mode = cfg.AuthMode
+	certAdmins := make(map[string]bool, len(cfg.CertAdmins))
+	for _, name := range cfg.CertAdmins {
+		certAdmins[name] = true
+	}
+	tokenAuth.Cert = &certAuth{admins: certAdmins}
+	if cfg.JWT != nil {
+		jwtAuth := NewJWTAuth(cfg.JWT)
+		go jwtAuth.Run()
+		// 静态令牌先匹配, 请求签名只处理没有 Bearer Token 的请求, 因此 JWT 放在最后
+		tokenAuth.Credentials = append(tokenAuth.Credentials, jwtAuth)
+		log.Printf("✓ JWT authentication enabled | Issuer: %s | Audience: %s | JWKS: %s", cfg.JWT.Issuer, cfg.JWT.Audience, cfg.JWT.JWKSURL)
+	}
+	if !tokenAuth.Enabled() {
+		log.Printf("⚠ No tokens configured, authentication disabled")
+	}
+
+	if cfg.Webhook != nil {
+		webhook = NewWebhook(cfg.Webhook)
+		log.Printf("✓ Webhook enabled | URL: %s", cfg.Webhook.URL)
+	}
+
 	sessionManager = NewSessionManager()
+	sessionManager.ReadBufferSize = cfg.ReadBufferSize
+	sessionManager.ReadyTimeout = time.Duration(cfg.ReadyTimeout)
+	sessionManager.Priority = ProcessPriority(cfg.Priority)
+	sessionManager.CommandTemplate = cfg.CommandTemplate
+	sessionManager.Shells = cfg.Shells
+	if cfg.NoExec {
+		spawner = fakeSpawner{outputs: cfg.FakeOutputs}
+		log.Printf("⚠ no_exec is set, sessions use a fake shell and no commands are executed | Fake outputs: %d", len(cfg.FakeOutputs))
+	}
+	if err := checkShells(cfg.Shells, cfg.DefaultShell); err != nil {
+		log.Fatalf("✗ No usable shell: %v", err)
+	}
+	sessionManager.DefaultShell = cfg.DefaultShell
+	sessionManager.JSONDepth = cfg.JSONDepth
+	sessionManager.StripANSI = cfg.StripANSI
+	sessionManager.NormalizeNewlines = cfg.NormalizeNewlines
+	sessionManager.StripBOM = cfg.StripBOM
+	outputPipeline = cfg.OutputPipeline
+	sessionManager.PlainTextRendering = cfg.PlainTextRendering
+	sessionManager.EndGracePeriod = time.Duration(cfg.EndGracePeriod)
+	sessionManager.SessionQuotas = cfg.sessionQuotas()
+	sessionManager.WorkingDir = cfg.WorkingDir
+	sessionManager.TailSize = cfg.SessionTailSize
+	streamHeartbeatInterval = time.Duration(cfg.StreamHeartbeatInterval)
+	idempotencyTTL = time.Duration(cfg.IdempotencyTTL)
+	streamMinFlushBytes = cfg.StreamMinFlushBytes
+	streamMaxFlushDelay = time.Duration(cfg.StreamMaxFlushDelay)
+	envInheritance = EnvInheritance(cfg.InheritEnv)
+	if cfg.EnvAllowlist != nil {
+		envAllowlist = cfg.EnvAllowlist
+	}
+	stderrHandling = cfg.StderrHandling
 
-	http.HandleFunc("/start-session", handleStartSession)
-	http.HandleFunc("/run-command", handleRunCommand)
-	http.HandleFunc("/end-session", handleEndSession)
+	store, err := NewOutputFileStore(filepath.Join(os.TempDir(), "remote-command-executor"), outputFileTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outputFileStore = store
+	jobStore = NewJobStore(jobTTL)
+	if cfg.ScriptsDir != "" {
+		scriptLibrary, err = NewScriptLibrary(cfg.ScriptsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✓ Scripts enabled | Dir: %s", scriptLibrary.dir)
+	}
+	if cfg.UploadDir != "" {
+		uploadStore, err = NewUploadStore(cfg.UploadDir, cfg.MaxUploadSize, time.Duration(cfg.ReadTimeout))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✓ Uploads enabled | Dir: %s | Max size: %d bytes", uploadStore.dir, cfg.MaxUploadSize)
+	}
+	if len(cfg.Templates) > 0 || cfg.TemplatesOnly {
+		log.Printf("✓ Command templates enabled | Templates: %d | Templates only: %t", len(cfg.Templates), cfg.TemplatesOnly)
+	}
+	commandLimiter = NewCommandLimiter(cfg.MaxConcurrentCommands, time.Duration(cfg.CommandQueueTimeout))
+	spawnLimiter = NewSpawnLimiter(cfg.MaxConcurrentSpawns, time.Duration(cfg.SpawnQueueTimeout))
+	connLimiter = NewConnLimiter(cfg.MaxConnections)
+	readGuard = NewReadGuard(cfg.MaxBlockedReads)
+	memoryGuard = NewMemoryGuard(cfg.MaxTotalMemoryMB, cfg.MemoryReapIdle)
+	go memoryGuard.Run(time.Duration(cfg.MemorySampleInterval))
+	if cfg.MaxTotalMemoryMB > 0 {
+		log.Printf("✓ Total session memory limit enabled | Limit: %d MB | Interval: %s | Reap idle: %t", cfg.MaxTotalMemoryMB, time.Duration(cfg.MemorySampleInterval), cfg.MemoryReapIdle)
+	}
+	admission = NewAdmission(cfg.MaxQueueDepth, time.Duration(cfg.RetryAfter))
+	if cfg.MaxQueueDepth > 0 {
+		log.Printf("✓ Admission control enabled | Max queue depth: %d | Retry after: %s", cfg.MaxQueueDepth, time.Duration(cfg.RetryAfter))
+	}
+	commandCoalescer = NewCoalescer()
+	transcriptStore, err = NewTranscriptStore(cfg.TranscriptDir, time.Duration(cfg.TranscriptRetention))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.ArchiveDir != "" {
+		outputArchive, err = NewOutputArchive(cfg.ArchiveDir, time.Duration(cfg.ArchiveRetention))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("✓ Output archive enabled | Dir: %s | Retention: %s", cfg.ArchiveDir, time.Duration(cfg.ArchiveRetention))
+	}
+
+	if cfg.SessionIdleTimeout > 0 {
+		reaper := NewReaper(time.Duration(cfg.SessionIdleTimeout), time.Duration(cfg.IdleWarning))
+		go reaper.Run()
+		log.Printf("✓ Idle session reaping enabled | Timeout: %s | Warning: %s", reaper.timeout, reaper.warning)
+	}
+	capabilities.Store(newCapabilities(cfg))
+	instanceID = cfg.InstanceID
+	if instanceID != "" {
+		log.Printf("✓ Session affinity enabled | Instance: %s", instanceID)
+	}
+	tracer, err = newTracerFromEnv()
+	if err != nil {
+		log.Fatalf("✗ Invalid tracing configuration: %v", err)
+	}
+	if tracer != nil {
+		log.Printf("✓ Tracing enabled | Endpoint: %s", tracer.endpoint)
+	}
+
+	registerRoutes(http.DefaultServeMux, cfg)
+
+	if cfg.SelfTest {
+		if err := runSelfTest(cfg.DefaultShell, time.Duration(cfg.SelfTestTimeout)); err != nil {
+			log.Fatalf("✗ Self-test failed | Shell: %s | Error: %v", cfg.DefaultShell, err)
+		}
+	}
 
-	log.Println("Server starting on port 8833...")
-	if err := http.ListenAndServe(":8833", nil); err != nil {
+	log.Printf("Server starting...")
+	if cfg.TLS != nil {
+		log.Printf("✓ TLS enabled | Client auth: %s | Auth mode: %s", cfg.TLS.ClientAuth, cfg.AuthMode)
+	}
+	if err := listenAndServe(cfg, http.DefaultServeMux); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// registerRoutes 注册所有接口, 可选接口按配置注册
+func registerRoutes(mux *http.ServeMux, cfg *Config) {
+	mux.HandleFunc("/", handleNotFound)
+	mux.HandleFunc("/capabilities", handleCapabilities)
+	mux.HandleFunc("/version", handleVersion)
+	// 执行类接口经过准入控制, 查询状态、指标和下载的接口不受影响, 过载时仍可观察和结束会话
+	mux.HandleFunc("/start-session", requireAuth(withIdempotency(admit(handleStartSession))))
+	mux.HandleFunc("/run-command", requireAuth(admit(compressResponse(handleRunCommand))))
+	mux.HandleFunc("/run-once", requireAuth(admit(compressResponse(handleRunOnce))))
+	mux.HandleFunc("/clone-session", requireAuth(admit(handleCloneSession)))
+	mux.HandleFunc("/restart-session", requireAuth(admit(handleRestartSession)))
+	mux.HandleFunc("/replay-command", requireAuth(admit(compressResponse(handleReplayCommand))))
+	mux.HandleFunc("/end-session", requireAuth(handleEndSession))
+	mux.HandleFunc("/cancel-session-commands", requireAuth(handleCancelSessionCommands))
+	mux.HandleFunc("/session-info", requireAuth(admit(handleSessionInfo)))
+	mux.HandleFunc("/session-status", requireAuth(handleSessionStatus))
+	mux.HandleFunc("/session-config", requireAuth(handleSessionConfig))
+	mux.HandleFunc("/session-tail", requireAuth(handleSessionTail))
+	mux.HandleFunc("/download", requireAuth(handleDownload))
+	mux.HandleFunc("/transcript", requireAuth(handleTranscript))
+	mux.HandleFunc("/sessions", requireAuth(handleListSessions))
+	mux.HandleFunc("/whoami", requireAuth(handleWhoami))
+	mux.HandleFunc("/orphaned-sessions", requireAuth(handleOrphanedSessions))
+	mux.HandleFunc("/reattach-session", requireAuth(handleReattachSession))
+	mux.HandleFunc("/run-command-async", requireAuth(withIdempotency(handleRunCommandAsync)))
+	mux.HandleFunc("/command-result", requireAuth(compressResponse(handleCommandResult)))
+	mux.HandleFunc("/metrics", requireAuth(handleMetrics))
+	mux.HandleFunc("/admin/kill-all", requireAuth(requireAdmin(handleKillAll)))
+	mux.HandleFunc("/admin/reload", requireAuth(requireAdmin(handleReloadConfig)))
+	mux.HandleFunc("/open-subshell", requireAuth(admit(handleOpenSubShell)))
+	mux.HandleFunc("/run-in-subshell", requireAuth(admit(compressResponse(handleRunInSubShell))))
+	mux.HandleFunc("/close-subshell", requireAuth(handleCloseSubShell))
+	mux.HandleFunc("/group-members", requireAuth(handleGroupMembers))
+	mux.HandleFunc("/run-group-command", requireAuth(admit(compressResponse(handleRunGroupCommand))))
+	if uploadStore != nil {
+		mux.HandleFunc("/upload", requireAuth(handleUpload))
+	}
+	if cfg.WebUI {
+		mux.HandleFunc("/ui/", webUIHandler())
+		mux.HandleFunc("/ui/check", requireAuth(requireAdmin(handleWebUICheck)))
+		log.Printf("✓ Web UI enabled | Path: /ui/")
+	}
+	if cfg.JSONRPC {
+		mux.HandleFunc("/rpc", requireAuth(handleJSONRPC))
+		log.Printf("✓ JSON-RPC endpoint enabled | Path: /rpc")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试服务器的令牌: 两个普通租户和一个管理员
+const (
+	aliceToken = "alice-token"
+	bobToken   = "bob-token"
+	adminToken = "admin-token"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// testServer 按 main 的顺序初始化全局状态的测试服务器, 会话使用 no_exec 的模拟 shell
+type testServer struct {
+	*httptest.Server
+	t   *testing.T
+	cfg *Config
+}
+
+// newTestServer 以默认配置加上三个令牌启动测试服务器, configure 不为空时在检查配置之前修改配置
+// 测试结束时结束所有会话并恢复被替换的全局变量
+func newTestServer(t *testing.T, configure func(cfg *Config)) *testServer {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.NoExec = true
+	cfg.Tokens = []TokenConfig{
+		{Name: "alice", Token: aliceToken},
+		{Name: "bob", Token: bobToken},
+		{Name: "admin", Token: adminToken, Admin: true},
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	initTestGlobals(t, cfg)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, cfg)
+	ts := &testServer{Server: httptest.NewServer(withRequestID(mux)), t: t, cfg: cfg}
+	t.Cleanup(func() {
+		ts.Close()
+		sessions := sessionManager.snapshot()
+		sessionManager.CloseAll()
+		// 等待读取 stderr 的 goroutine 结束, 之后的测试修改全局变量时不与其竞争
+		for _, s := range sessions {
+			<-s.startup.eof
+		}
+	})
+	return ts
+}
+
+// initTestGlobals 与 main 一样根据配置设置全局变量, 不启动后台 goroutine
+func initTestGlobals(t *testing.T, cfg *Config) {
+	t.Helper()
+	previousSpawner := spawner
+	t.Cleanup(func() { spawner = previousSpawner })
+
+	liveSettings.Store(newServerSettings(cfg))
+	configReloader = NewConfigReloader("", cfg)
+	setGlobal(&logSessionIDs, LogSessionIDs(cfg.LogSessionIDs))
+	tokenAuth = NewTokenAuth(cfg.Tokens, time.Duration(cfg.SignatureSkew))
+	tokenAuth.Mode = cfg.AuthMode
+
+	spawner = fakeSpawner{outputs: cfg.FakeOutputs}
+	sessionManager = NewSessionManager()
+	sessionManager.ReadBufferSize = cfg.ReadBufferSize
+	sessionManager.ReadyTimeout = time.Duration(cfg.ReadyTimeout)
+	sessionManager.Priority = ProcessPriority(cfg.Priority)
+	sessionManager.CommandTemplate = cfg.CommandTemplate
+	sessionManager.Shells = cfg.Shells
+	sessionManager.DefaultShell = cfg.DefaultShell
+	sessionManager.JSONDepth = cfg.JSONDepth
+	sessionManager.StripANSI = cfg.StripANSI
+	sessionManager.NormalizeNewlines = cfg.NormalizeNewlines
+	sessionManager.StripBOM = cfg.StripBOM
+	outputPipeline = cfg.OutputPipeline
+	sessionManager.PlainTextRendering = cfg.PlainTextRendering
+	sessionManager.EndGracePeriod = time.Duration(cfg.EndGracePeriod)
+	sessionManager.SessionQuotas = cfg.sessionQuotas()
+	sessionManager.WorkingDir = cfg.WorkingDir
+	sessionManager.TailSize = cfg.SessionTailSize
+	setGlobal(&streamHeartbeatInterval, time.Duration(cfg.StreamHeartbeatInterval))
+	setGlobal(&idempotencyTTL, time.Duration(cfg.IdempotencyTTL))
+	setGlobal(&streamMinFlushBytes, cfg.StreamMinFlushBytes)
+	setGlobal(&streamMaxFlushDelay, time.Duration(cfg.StreamMaxFlushDelay))
+	setGlobal(&stderrHandling, cfg.StderrHandling)
+	setGlobal(&envInheritance, EnvInheritance(cfg.InheritEnv))
+
+	store, err := NewOutputFileStore(t.TempDir(), outputFileTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputFileStore = store
+	jobStore = NewJobStore(jobTTL)
+	sessionGroups = &SessionGroups{groups: make(map[string]map[string][]string)}
+	setGlobal(&uploadStore, nil)
+	if cfg.UploadDir != "" {
+		if uploadStore, err = NewUploadStore(cfg.UploadDir, cfg.MaxUploadSize, time.Duration(cfg.ReadTimeout)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commandLimiter = NewCommandLimiter(cfg.MaxConcurrentCommands, time.Duration(cfg.CommandQueueTimeout))
+	spawnLimiter = NewSpawnLimiter(cfg.MaxConcurrentSpawns, time.Duration(cfg.SpawnQueueTimeout))
+	connLimiter = NewConnLimiter(cfg.MaxConnections)
+	readGuard = NewReadGuard(cfg.MaxBlockedReads)
+	memoryGuard = NewMemoryGuard(cfg.MaxTotalMemoryMB, cfg.MemoryReapIdle)
+	admission = NewAdmission(cfg.MaxQueueDepth, time.Duration(cfg.RetryAfter))
+	commandCoalescer = NewCoalescer()
+	if transcriptStore, err = NewTranscriptStore(cfg.TranscriptDir, time.Duration(cfg.TranscriptRetention)); err != nil {
+		t.Fatal(err)
+	}
+	capabilities.Store(newCapabilities(cfg))
+	setGlobal(&instanceID, cfg.InstanceID)
+}
+
+// setGlobal 只在取值不同时修改全局变量, 前一个测试中尚未结束的 goroutine 读取时不构成竞争
+func setGlobal[T comparable](p *T, v T) {
+	if *p != v {
+		*p = v
+	}
+}
+
+// do 以 token 发送请求, body 不为 nil 时编码为 JSON, 返回响应和完整的响应体
+func (ts *testServer) do(method, token, path string, body any) (*http.Response, []byte) {
+	ts.t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp, data
+}
+
+// post 以 token 发送 POST 请求
+func (ts *testServer) post(token, path string, body any) (*http.Response, []byte) {
+	ts.t.Helper()
+	return ts.do(http.MethodPost, token, path, body)
+}
+
+// startSession 以 token 创建会话并返回会话 ID, opts 为 nil 时使用默认参数
+func (ts *testServer) startSession(token string, opts map[string]any) string {
+	ts.t.Helper()
+	if opts == nil {
+		opts = map[string]any{}
+	}
+	resp, data := ts.post(token, "/start-session", opts)
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("start-session: %d %s", resp.StatusCode, data)
+	}
+	var out struct {
+		SessionID string `json:"session_id"`
+	}
+	decodeJSON(ts.t, data, &out)
+	return out.SessionID
+}
+
+// run 在会话中执行命令, req 中的其他字段与 session_id 和 command 一起发送
+func (ts *testServer) run(token, sessionID, command string, req map[string]any) (*http.Response, []byte) {
+	ts.t.Helper()
+	body := map[string]any{"session_id": sessionID, "command": command}
+	for k, v := range req {
+		body[k] = v
+	}
+	return ts.post(token, "/run-command", body)
+}
+
+// decodeJSON 解析 JSON, 失败时结束测试
+func decodeJSON(t *testing.T, data []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+}
+
+// waitFor 等待 cond 成立, 最多等待 5 秒
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// errorCodeOf 返回错误响应中的 error.code
+func errorCodeOf(t *testing.T, data []byte) string {
+	t.Helper()
+	var resp ErrorResponse
+	decodeJSON(t, data, &resp)
+	return resp.Error.Code
+}
+
+func TestTimeoutReturnsPartialOutput(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Long-Job": {Output: "started", DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "Long-Job", map[string]any{"timeout_ms": 100})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d %s", resp.StatusCode, data)
+	}
+	var body struct {
+		ErrorResponse
+		Result CommandResult `json:"result"`
+	}
+	decodeJSON(t, data, &body)
+	if body.Error.Code != codeCommandTimeout || !body.Result.TimedOut {
+		t.Fatalf("error = %+v, timed_out = %t", body.Error, body.Result.TimedOut)
+	}
+	// 默认的 truncation_notice 跟在部分输出之后
+	if !strings.HasPrefix(body.Result.Output, "started\n") || !body.Result.Truncated {
+		t.Fatalf("partial output = %q, truncated = %t", body.Result.Output, body.Result.Truncated)
+	}
+
+	// 超时的命令结束后, 其剩余输出不会混入下一条命令
+	time.Sleep(600 * time.Millisecond)
+	resp, data = ts.run(aliceToken, id, "echo next", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "next" {
+		t.Fatalf("next command = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestTimeoutWithoutOutput(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Quiet-Job": {DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "Quiet-Job", map[string]any{"timeout_ms": 100})
+	var body struct {
+		ErrorResponse
+		Result CommandResult `json:"result"`
+	}
+	decodeJSON(t, data, &body)
+	if resp.StatusCode != http.StatusGatewayTimeout || !body.Result.TimedOut || body.Result.HadOutput {
+		t.Fatalf("status = %d, result = %+v", resp.StatusCode, body.Result)
+	}
+}
+
+func TestSessionQuotaPerToken(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxSessionsPerToken = 2
+		one := 1
+		cfg.Tokens[0].MaxSessions = &one
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// alice 单独设置的上限优先, 达到上限后不影响其他租户
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{})
+	if resp.StatusCode != http.StatusTooManyRequests || errorCodeOf(t, data) != codeSessionQuota {
+		t.Fatalf("start over quota = %d %s", resp.StatusCode, data)
+	}
+	ts.startSession(bobToken, nil)
+	ts.startSession(bobToken, nil)
+	if resp, data = ts.post(bobToken, "/start-session", map[string]any{}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("bob over the default quota = %d %s", resp.StatusCode, data)
+	}
+
+	// 结束会话后归还名额
+	if resp, data = ts.post(aliceToken, "/end-session", map[string]any{"session_id": id}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("end-session = %d %s", resp.StatusCode, data)
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("alice owns %d sessions after ending", n)
+	}
+	ts.startSession(aliceToken, nil)
+
+	// 空闲会话被清理后同样归还名额
+	NewReaper(time.Minute, 0).sweep(time.Now().Add(2 * time.Minute))
+	if n := sessionManager.Owned("alice") + sessionManager.Owned("bob"); n != 0 {
+		t.Fatalf("%d sessions still counted after reaping", n)
+	}
+	ts.startSession(aliceToken, nil)
+}
+
+func TestSessionQuotaConcurrentStarts(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.MaxSessionsPerToken = 3 })
+	var started, rejected atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch resp, _ := ts.post(aliceToken, "/start-session", map[string]any{}); resp.StatusCode {
+			case http.StatusOK:
+				started.Add(1)
+			case http.StatusTooManyRequests:
+				rejected.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// 启动 shell 之前占用名额, 并发创建时不超过上限
+	if started.Load() != 3 || rejected.Load() != 7 {
+		t.Fatalf("started %d, rejected %d", started.Load(), rejected.Load())
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	defaultDir, sessionDir := t.TempDir(), t.TempDir()
+	ts := newTestServer(t, func(cfg *Config) { cfg.WorkingDir = defaultDir })
+
+	id := ts.startSession(aliceToken, nil)
+	if s, _ := sessionManager.GetSession(id); s.workingDir != defaultDir {
+		t.Fatalf("default working dir = %q, want %q", s.workingDir, defaultDir)
+	}
+	id = ts.startSession(aliceToken, map[string]any{"working_dir": sessionDir})
+	if s, _ := sessionManager.GetSession(id); s.workingDir != sessionDir {
+		t.Fatalf("session working dir = %q, want %q", s.workingDir, sessionDir)
+	}
+
+	// 不存在的目录和普通文件在启动 shell 之前被拒绝
+	file := filepath.Join(sessionDir, "file")
+	os.WriteFile(file, nil, 0600)
+	for _, dir := range []string{filepath.Join(sessionDir, "missing"), file} {
+		resp, data := ts.post(aliceToken, "/start-session", map[string]any{"working_dir": dir})
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "working_dir") {
+			t.Errorf("working_dir %s = %d %s", dir, resp.StatusCode, data)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.WorkingDir = filepath.Join(sessionDir, "missing")
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("missing default working_dir accepted")
+	}
+}
+
+func TestWorkingDirAppliedToShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, func(cfg *Config) { cfg.WorkingDir = dir })
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	if resp, data := ts.run(aliceToken, id, "pwd -P", nil); resp.StatusCode != http.StatusOK || string(data) != dir {
+		t.Fatalf("pwd = %d %q, want %q", resp.StatusCode, data, dir)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestParseMarkerChannel(t *testing.T) {
+	tests := []struct {
+		channel MarkerChannel
+		shell   ShellType
+		want    MarkerChannel
+		ok      bool
+	}{
+		{"", ShellBash, "", true},
+		{MarkerHost, ShellPowerShell, MarkerHost, true},
+		{MarkerConsole, ShellPowerShell, MarkerConsole, true},
+		{MarkerConsole, ShellBash, "", false},
+		{MarkerConsole, ShellCmd, "", false},
+		{"stderr", ShellPowerShell, "", false},
+	}
+	for _, tt := range tests {
+		if got, err := parseMarkerChannel(tt.channel, tt.shell); got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseMarkerChannel(%q, %s) = %q, %v", tt.channel, tt.shell, got, err)
+		}
+	}
+}
+
+func TestConsoleMarkerFrame(t *testing.T) {
+	preset := defaultShellPresets()["pwsh"]
+	host := preset.frame("Get-Date", "m1", TerminatorMarker, frameOptions{})
+	console := preset.frame("Get-Date", "m1", TerminatorMarker, frameOptions{console: true})
+	if !strings.Contains(host, "Write-Host '"+beginMarkerPrefix) || strings.Contains(host, "[Console]::Out.WriteLine") {
+		t.Fatalf("host frame:\n%s", host)
+	}
+	// 标记和语法错误都不经过 Write-Host
+	if strings.Contains(console, "Write-Host") || strings.Count(console, "[Console]::Out.WriteLine(") != 5 {
+		t.Fatalf("console frame:\n%s", console)
+	}
+}
+
+func TestMarkerChannelSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	recorder := &stdinRecorder{}
+	spawner = recorder
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "marker_channel": "console"})
+	if resp, data := ts.run(aliceToken, id, "echo ok", nil); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+	if !strings.Contains(recorder.String(), "[Console]::Out.WriteLine('"+beginMarkerPrefix) {
+		t.Fatalf("session default not used:\n%s", recorder.String())
+	}
+	// 命令中的 marker_channel 覆盖会话的默认值
+	before := len(recorder.String())
+	ts.run(aliceToken, id, "echo ok", map[string]any{"marker_channel": "host"})
+	if !strings.Contains(recorder.String()[before:], "Write-Host '"+beginMarkerPrefix) {
+		t.Fatalf("command override not used:\n%s", recorder.String())
+	}
+
+	bash := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	if resp, data := ts.run(aliceToken, bash, "echo ok", map[string]any{"marker_channel": "console"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("console marker in bash = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash", "marker_channel": "console"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bash session with console marker = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestConsoleMarkerSurvivesHostRedirect(t *testing.T) {
+	if _, err := exec.LookPath("pwsh"); err != nil {
+		t.Skip("pwsh is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "marker_channel": "console"})
+	// 屏蔽 Write-Host 后标记仍然输出, 命令正常结束
+	ts.run(aliceToken, id, "function global:Write-Host {}", nil)
+	if resp, data := ts.run(aliceToken, id, "'after'", nil); resp.StatusCode != http.StatusOK || string(data) != "after" {
+		t.Fatalf("run after overriding Write-Host = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestMarkerPrefix(t *testing.T) {
+	prefix := newMarkerPrefix()
+	if len(prefix) != 2*markerPrefixBytes+1 || !strings.HasSuffix(prefix, "-") || prefix == newMarkerPrefix() {
+		t.Fatalf("marker prefix = %q", prefix)
+	}
+
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{}
+	})
+	id := ts.startSession(aliceToken, nil)
+	otherID := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	other, _ := sessionManager.GetSession(otherID)
+	if s.markerPrefix == other.markerPrefix {
+		t.Fatalf("sessions share marker prefix %q", s.markerPrefix)
+	}
+
+	// 其他会话的结束标记出现在输出中时不会结束命令
+	foreign := other.markerPrefix + "00000000-0000-0000-0000-000000000000" + exitCodeSeparator + "0"
+	ts.cfg.FakeOutputs["Foreign"] = FakeOutput{Output: "before\n" + foreign + "\nafter"}
+	resp, data := ts.run(aliceToken, id, "Foreign", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "before\n"+foreign+"\nafter" {
+		t.Fatalf("foreign marker = %d %q", resp.StatusCode, data)
+	}
+	// 命令 ID 中没有前缀
+	if commandID := resp.Header.Get("X-Command-Id"); strings.Contains(commandID, s.markerPrefix) || len(commandID) != 36 {
+		t.Fatalf("command ID = %q", commandID)
+	}
+
+	// 重启 shell 后前缀不变
+	prefix = s.markerPrefix
+	if status, _ := ts.restartSession(aliceToken, id); status != http.StatusOK || s.markerPrefix != prefix {
+		t.Fatalf("restart = %d, prefix %q → %q", status, prefix, s.markerPrefix)
+	}
+}
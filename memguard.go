@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMemorySampleInterval 采样所有会话内存占用的默认间隔
+const defaultMemorySampleInterval = 5 * time.Second
+
+// codeMemoryLimit 所有会话的内存占用之和超过 max_total_memory_mb
+const codeMemoryLimit = "memory_limit_exceeded"
+
+// errMemoryLimit 最近一次采样时所有会话的内存占用之和超过上限, 拒绝新会话和新命令
+var errMemoryLimit = errors.New("total memory of all sessions exceeds max_total_memory_mb, try again later")
+
+// MemoryGuard 定期统计所有会话进程树的内存占用之和, 超过上限时拒绝新会话和新命令,
+// 开启 reapIdle 时按最近使用时间从早到晚结束空闲会话, 直到低于上限
+// 与会话的 max_memory_mb 不同, 限制的是整个主机上所有 shell 的总和
+type MemoryGuard struct {
+	// limit 上限(字节), 0 表示只统计不限制
+	limit    uint64
+	reapIdle bool
+	// sample 返回会话进程树当前的内存占用, 平台不支持时返回错误, 该会话不计入总和
+	sample func(*Session) (uint64, error)
+
+	total    atomic.Uint64
+	over     atomic.Bool
+	rejected atomic.Int64
+	reaped   atomic.Int64
+}
+
+func NewMemoryGuard(limitMB int, reapIdle bool) *MemoryGuard {
+	return &MemoryGuard{limit: uint64(limitMB) << 20, reapIdle: reapIdle, sample: sampleSessionMemory}
+}
+
+// sampleSessionMemory 读取会话进程树的内存占用, 与 report_usage 的统计方式相同
+func sampleSessionMemory(s *Session) (uint64, error) {
+	u, err := s.group.usage()
+	return u.memory, err
+}
+
+// Run 按采样间隔循环统计, 不返回
+func (g *MemoryGuard) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.sweep(sessionManager.snapshot())
+	}
+}
+
+// sweep 统计 sessions 的内存占用之和, 超过上限时按需结束空闲会话
+func (g *MemoryGuard) sweep(sessions []*Session) {
+	var total uint64
+	memory := make(map[*Session]uint64, len(sessions))
+	for _, session := range sessions {
+		// 重启 shell 期间进程组会被替换, 跳过本次采样
+		if session.State() != stateRunning || !session.running.Load() {
+			continue
+		}
+		m, err := g.sample(session)
+		if err != nil {
+			continue
+		}
+		memory[session] = m
+		total += m
+	}
+
+	if g.limit > 0 && total > g.limit && g.reapIdle {
+		total = g.reap(memory, total)
+	}
+	g.total.Store(total)
+	over := g.limit > 0 && total > g.limit
+	if over != g.over.Swap(over) {
+		if over {
+			log.Printf("⚠ Total session memory over limit, refusing new sessions and commands | Memory: %d MB | Limit: %d MB", total>>20, g.limit>>20)
+		} else {
+			log.Printf("✓ Total session memory back under limit | Memory: %d MB | Limit: %d MB", total>>20, g.limit>>20)
+		}
+	}
+}
+
+// reap 按最近使用时间从早到晚结束空闲会话, 直到总和不超过上限, 返回结束后的总和
+func (g *MemoryGuard) reap(memory map[*Session]uint64, total uint64) uint64 {
+	idle := make([]*Session, 0, len(memory))
+	for session := range memory {
+		if session.current.Load() == nil {
+			idle = append(idle, session)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUsed.Load() < idle[j].lastUsed.Load() })
+
+	for _, session := range idle {
+		if total <= g.limit {
+			break
+		}
+		// 检查之后开始执行命令的会话不再结束
+		if session.current.Load() != nil {
+			continue
+		}
+		log.Printf("→ Ending idle session to free memory | SessionID: %s | Memory: %d MB | Total: %d MB", session.ID, memory[session]>>20, total>>20)
+		if err := sessionManager.EndSession(session.ID, false); err != nil {
+			// 期间已被其他请求结束
+			continue
+		}
+		log.Printf("✓ Idle session ended to free memory | SessionID: %s", session.ID)
+		g.reaped.Add(1)
+		total -= memory[session]
+	}
+	return total
+}
+
+// Check 最近一次采样超过上限时返回 errMemoryLimit
+func (g *MemoryGuard) Check() error {
+	if g == nil || !g.over.Load() {
+		return nil
+	}
+	g.rejected.Add(1)
+	return errMemoryLimit
+}
+
+// Total 最近一次采样时所有会话的内存占用之和(字节)
+func (g *MemoryGuard) Total() uint64 {
+	return g.total.Load()
+}
+
+// Rejected 因超过上限被拒绝的会话和命令总数
+func (g *MemoryGuard) Rejected() int64 {
+	return g.rejected.Load()
+}
+
+// Reaped 为释放内存而结束的空闲会话总数
+func (g *MemoryGuard) Reaped() int64 {
+	return g.reaped.Load()
+}
+
+var memoryGuard *MemoryGuard
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fixedMemory 每个会话的进程树占用 mb MB
+func fixedMemory(mb uint64) func(*Session) (uint64, error) {
+	return func(*Session) (uint64, error) { return mb << 20, nil }
+}
+
+func TestMemoryGuardRejects(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxTotalMemoryMB = 100
+	})
+	id := ts.startSession(aliceToken, nil)
+	other := ts.startSession(bobToken, nil)
+	memoryGuard.sample = fixedMemory(60)
+	memoryGuard.sweep(sessionManager.snapshot())
+	if memoryGuard.Total() != 120<<20 {
+		t.Fatalf("total = %d", memoryGuard.Total())
+	}
+
+	// 超过上限时拒绝新会话和新命令, 不结束已有的会话
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeMemoryLimit {
+		t.Fatalf("start over limit = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeMemoryLimit {
+		t.Fatalf("run over limit = %d %s", resp.StatusCode, data)
+	}
+	if _, exists := sessionManager.GetSession(other); !exists {
+		t.Fatal("session ended without memory_reap_idle")
+	}
+	_, metrics := ts.do(http.MethodGet, adminToken, "/metrics", nil)
+	for _, want := range []string{"rce_session_memory_bytes 125829120", "rce_memory_limit_rejected_total 2", "rce_memory_reaped_sessions_total 0"} {
+		if !strings.Contains(string(metrics), want+"\n") {
+			t.Fatalf("metrics missing %q:\n%s", want, metrics)
+		}
+	}
+
+	// 低于上限后恢复
+	memoryGuard.sample = fixedMemory(40)
+	memoryGuard.sweep(sessionManager.snapshot())
+	if resp, data = ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("run under limit = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestMemoryGuardReapsIdleSessions(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxTotalMemoryMB = 100
+		cfg.MemoryReapIdle = true
+	})
+	oldest := ts.startSession(aliceToken, nil)
+	middle := ts.startSession(aliceToken, nil)
+	newest := ts.startSession(bobToken, nil)
+	// 按最近使用时间排序
+	for i, id := range []string{oldest, middle, newest} {
+		s, _ := sessionManager.GetSession(id)
+		s.lastUsed.Store(int64(i + 1))
+	}
+	memoryGuard.sample = fixedMemory(40)
+	memoryGuard.sweep(sessionManager.snapshot())
+
+	// 只结束最早使用的会话, 总和已不超过上限
+	if _, exists := sessionManager.GetSession(oldest); exists {
+		t.Fatal("oldest idle session not reaped")
+	}
+	for _, id := range []string{middle, newest} {
+		if _, exists := sessionManager.GetSession(id); !exists {
+			t.Fatalf("session %s reaped", id)
+		}
+	}
+	if memoryGuard.Total() != 80<<20 || memoryGuard.Reaped() != 1 {
+		t.Fatalf("total = %d, reaped = %d", memoryGuard.Total(), memoryGuard.Reaped())
+	}
+	if err := memoryGuard.Check(); err != nil {
+		t.Fatalf("check after reap = %v", err)
+	}
+}
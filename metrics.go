@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// writeMetric 以 Prometheus 文本格式写出一个指标
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// API16: 运行指标, Prometheus 文本格式
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "rce_sessions", "gauge", "Number of open sessions.", int64(sessionManager.Count()))
+	writeMetric(w, "rce_commands_in_flight", "gauge", "Number of commands currently executing.", commandLimiter.InFlight())
+	writeMetric(w, "rce_commands_queued", "gauge", "Number of commands waiting for an execution slot.", commandLimiter.Queued())
+	writeMetric(w, "rce_commands_rejected_total", "counter", "Commands rejected because the concurrency limit was reached.", commandLimiter.Rejected())
+	writeMetric(w, "rce_session_starts_in_flight", "gauge", "Number of sessions currently starting a shell process.", spawnLimiter.InFlight())
+	writeMetric(w, "rce_session_starts_queued", "gauge", "Number of session starts waiting for a spawn slot.", spawnLimiter.Queued())
+	writeMetric(w, "rce_session_starts_rejected_total", "counter", "Session starts rejected because max_concurrent_spawns was reached.", spawnLimiter.Rejected())
+	writeMetric(w, "rce_connections_open", "gauge", "Number of open HTTP connections, counted only when max_connections is set.", connLimiter.Open())
+	writeMetric(w, "rce_connections_rejected_total", "counter", "Connections closed because max_connections was reached.", connLimiter.Rejected())
+	writeMetric(w, "rce_queue_depth", "gauge", "Number of execution requests being handled, including pending async jobs.", admission.Depth())
+	writeMetric(w, "rce_requests_shed_total", "counter", "Requests rejected because max_queue_depth was reached.", admission.Shed())
+	writeMetric(w, "rce_blocked_reads", "gauge", "Number of commands waiting for shell output.", readGuard.Blocked())
+	writeMetric(w, "rce_blocked_reads_rejected_total", "counter", "Commands refused because max_blocked_reads was reached.", readGuard.Rejected())
+	writeMetric(w, "rce_session_memory_bytes", "gauge", "Total memory of all session process trees at the last sample.", int64(memoryGuard.Total()))
+	writeMetric(w, "rce_memory_limit_rejected_total", "counter", "Sessions and commands refused because max_total_memory_mb was exceeded.", memoryGuard.Rejected())
+	writeMetric(w, "rce_memory_reaped_sessions_total", "counter", "Idle sessions ended to bring total session memory under max_total_memory_mb.", memoryGuard.Reaped())
+	writeMetric(w, "rce_late_output_bytes_total", "counter", "Bytes of shell output discarded after the end marker by late_output_drain.", lateOutputBytes.Load())
+	writeMetric(w, "rce_sessions_recycled_total", "counter", "Sessions restarted or ended after recycle_after_errors consecutive command errors.", sessionsRecycled.Load())
+	commandOutputSizes.write(w, "rce_command_output_bytes", "Output size of client commands as returned to the client, after truncation.")
+	writeMetric(w, "rce_commands_coalesced_total", "counter", "Commands that shared the result of an identical in-flight command.", commandCoalescer.Shared())
+	if uploadStore != nil {
+		writeMetric(w, "rce_upload_bytes_total", "counter", "Bytes of uploaded content written to disk.", uploadStore.Received())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxImportModules 每个会话启动时导入的模块数上限
+	maxImportModules = 32
+	// maxModuleNameLength 模块名称或路径的最大长度
+	maxModuleNameLength = 256
+	// maxImportErrorLength 导入失败时错误信息中附带的输出的最大长度
+	maxImportErrorLength = 1024
+)
+
+// validateImportModules 检查 import_modules, 只支持 PowerShell 会话
+func validateImportModules(modules []string, shellType ShellType) error {
+	if len(modules) == 0 {
+		return nil
+	}
+	if shellType != ShellPowerShell {
+		return fmt.Errorf("%w: import_modules requires a PowerShell session", errInvalidOptions)
+	}
+	if len(modules) > maxImportModules {
+		return fmt.Errorf("%w: import_modules: at most %d modules", errInvalidOptions, maxImportModules)
+	}
+	for _, name := range modules {
+		if strings.TrimSpace(name) == "" || len(name) > maxModuleNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%w: import_modules: invalid module name %q", errInvalidOptions, name)
+		}
+	}
+	return nil
+}
+
+// importModules 依次导入会话的 import_modules, 在初始化命令之前执行, 任一模块导入失败时返回 errInitFailed
+// 导入失败时的错误信息包含 Import-Module 输出的错误, 模块较慢时可以从日志中的耗时看出
+func importModules(identity *Identity, session *Session) error {
+	for _, name := range session.options.ImportModules {
+		command := "Import-Module -Name " + psQuote(name) + " -ErrorAction Stop"
+		start := time.Now()
+		result, err := session.RunCommand(command, RunOptions{ReportStatus: true})
+		elapsed := time.Since(start).Round(time.Millisecond)
+		auditCommand(identity, session.ID, command, result, err)
+		if err != nil {
+			log.Printf("✗ Module import failed | SessionID: %s | Module: %s | Duration: %s | Error: %v", session.ID, name, elapsed, err)
+			return fmt.Errorf("%w: import module %s: %v", errInitFailed, name, err)
+		}
+		if result.Status == commandStatusError {
+			output := strings.TrimSpace(result.Output)
+			if len(output) > maxImportErrorLength {
+				output = output[:maxImportErrorLength-incompleteRuneSuffix([]byte(output[:maxImportErrorLength]))] + "..."
+			}
+			log.Printf("✗ Module import failed | SessionID: %s | Module: %s | Duration: %s", session.ID, name, elapsed)
+			return fmt.Errorf("%w: import module %s: %s", errInitFailed, name, output)
+		}
+		log.Printf("✓ Module imported | SessionID: %s | Module: %s | Duration: %s", session.ID, name, elapsed)
+	}
+	return nil
+}
+
+// replayInit 重启 shell 后重新导入模块并重放已记录的初始化命令
+// 远程会话先检查新的 shell 是否重新建立了远程会话
+func replayInit(identity *Identity, session *Session) error {
+	if err := session.connectRemote(); err != nil {
+		return fmt.Errorf("%w: %v", errInitFailed, err)
+	}
+	if err := importModules(identity, session); err != nil {
+		return err
+	}
+	return runInit(identity, session, session.InitCommands(), false)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateImportModules(t *testing.T) {
+	tests := []struct {
+		modules []string
+		shell   ShellType
+		ok      bool
+	}{
+		{nil, ShellBash, true},
+		{[]string{"ActiveDirectory", `C:\Modules\Tools.psm1`}, ShellPowerShell, true},
+		// 只支持 PowerShell 会话
+		{[]string{"ActiveDirectory"}, ShellBash, false},
+		{[]string{" "}, ShellPowerShell, false},
+		{[]string{"a\nb"}, ShellPowerShell, false},
+		{[]string{strings.Repeat("m", maxModuleNameLength+1)}, ShellPowerShell, false},
+		{make([]string, maxImportModules+1), ShellPowerShell, false},
+	}
+	for _, tt := range tests {
+		err := validateImportModules(tt.modules, tt.shell)
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, errInvalidOptions)) {
+			t.Errorf("validate(%q, %s) = %v, want ok %t", tt.modules, tt.shell, err, tt.ok)
+		}
+	}
+}
+
+func TestImportModules(t *testing.T) {
+	ts := newTestServer(t, nil)
+	var id string
+	logs := captureLogs(func() {
+		id = ts.startSession(aliceToken, map[string]any{"import_modules": []string{"First", "Sec'ond"}})
+	})
+	// 按顺序导入, 名称中可以有单引号
+	first := strings.Index(logs, "Module imported | SessionID: "+id+" | Module: First")
+	second := strings.Index(logs, "Module imported | SessionID: "+id+" | Module: Sec'ond")
+	if first < 0 || second < first {
+		t.Fatalf("modules not imported in order:\n%s", logs)
+	}
+
+	// 重启 shell 后重新导入
+	logs = captureLogs(func() {
+		if status, _ := ts.restartSession(aliceToken, id); status != http.StatusOK {
+			t.Fatalf("restart = %d", status)
+		}
+	})
+	if !strings.Contains(logs, "Module: First") || !strings.Contains(logs, "Module: Sec'ond") {
+		t.Fatalf("modules not imported after restart:\n%s", logs)
+	}
+
+	if resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash", "import_modules": []string{"First"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("import_modules for bash = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestImportModuleFailure(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Import-Module -Name 'Missing' -ErrorAction Stop": {Output: "The specified module 'Missing' was not loaded", ExitCode: 1},
+		}
+	})
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{
+		"import_modules": []string{"Missing"},
+		"init":           []string{"echo never"},
+	})
+	if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInitFailed {
+		t.Fatalf("failed import = %d %s", resp.StatusCode, data)
+	}
+	// 错误信息包含 Import-Module 的输出, 会话不交给客户端
+	if !strings.Contains(string(data), "was not loaded") {
+		t.Fatalf("error does not include module output: %s", data)
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions left after failed import", n)
+	}
+}
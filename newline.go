@@ -0,0 +1,144 @@
+package main
+
+import "bytes"
+
+// maxLineEndingSize 最长的行尾序列 \r\r\n 的长度
+// PowerShell 将已带 \r\n 的文本写到控制台时可能再补一个 \r
+const maxLineEndingSize = 3
+
+// trimLineEnding 去除末尾的一个行尾序列: \n、\r\n、\r\r\n 或单独的 \r
+// 只去除标记行之前由 shell 补上的换行, 输出中其余的空行保持不变
+func trimLineEnding(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+	}
+	for len(b) > 0 && b[len(b)-1] == '\r' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// newlineFilter 将输出中的 CRLF 转换为 LF
+// 连续的 \r 后跟 \n 视为一个换行, 不跟 \n 的 \r(如进度条回到行首)保留
+// 数据块末尾的 \r 暂存到下一次调用, 被拆分到两个数据块中的 \r\n 也能正确转换
+type newlineFilter struct {
+	// cr 暂存的 \r 个数
+	cr int
+}
+
+// filter 返回转换后的内容
+func (f *newlineFilter) filter(b []byte) []byte {
+	out := make([]byte, 0, len(b)+f.cr)
+	for _, c := range b {
+		switch c {
+		case '\r':
+			f.cr++
+			continue
+		case '\n':
+			f.cr = 0
+		default:
+			out = f.appendCR(out)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// flush 返回暂存的 \r, 输出结束时调用
+func (f *newlineFilter) flush() []byte {
+	return f.appendCR(nil)
+}
+
+func (f *newlineFilter) appendCR(out []byte) []byte {
+	for ; f.cr > 0; f.cr-- {
+		out = append(out, '\r')
+	}
+	return out
+}
+
+// lineLimiter 只保留输出的前 max 行, 之后的内容丢弃但调用方仍继续读取到结束标记, 会话保持干净
+// 按 \n 计行, 第 max 个 \n 及其之前的 \r 不输出, CRLF 输出同样按行计数
+type lineLimiter struct {
+	max   int
+	lines int
+	// cr 暂存的 \r 个数, 在确定其后是否为截断位置的 \n 之前不输出
+	cr int
+	// done 已达到 max 行, truncated 之后还有被丢弃的内容
+	done      bool
+	truncated bool
+}
+
+// filter 返回未超出行数限制的内容
+func (l *lineLimiter) filter(b []byte) []byte {
+	if l.done {
+		if len(b) > 0 {
+			l.truncated = true
+		}
+		return nil
+	}
+	out := make([]byte, 0, len(b))
+	for i, c := range b {
+		switch c {
+		case '\r':
+			l.cr++
+			continue
+		case '\n':
+			l.lines++
+			if l.lines >= l.max {
+				l.cr = 0
+				l.done = true
+				l.truncated = i+1 < len(b)
+				return out
+			}
+		}
+		for ; l.cr > 0; l.cr-- {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// flush 返回暂存的 \r, 输出结束时调用
+func (l *lineLimiter) flush() []byte {
+	if l.done {
+		return nil
+	}
+	var out []byte
+	for ; l.cr > 0; l.cr-- {
+		out = append(out, '\r')
+	}
+	return out
+}
+
+// utf8BOM UTF-8 编码的字节顺序标记 U+FEFF
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// bomFilter 去除输出开头的一个 UTF-8 BOM, 之后的内容(包括再次出现的 BOM)原样输出
+// 开头不足 3 个字节且可能是 BOM 的前缀时暂存, 被拆分到多个数据块中的 BOM 也能去除
+type bomFilter struct {
+	pending []byte
+	done    bool
+}
+
+func (f *bomFilter) filter(b []byte) []byte {
+	if f.done {
+		return b
+	}
+	f.pending = append(f.pending, b...)
+	if len(f.pending) < len(utf8BOM) && bytes.HasPrefix(utf8BOM, f.pending) {
+		return nil
+	}
+	f.done = true
+	out := bytes.TrimPrefix(f.pending, utf8BOM)
+	f.pending = nil
+	return out
+}
+
+// flush 返回暂存的开头, 输出不足 3 个字节时调用
+func (f *bomFilter) flush() []byte {
+	f.done = true
+	out := f.pending
+	f.pending = nil
+	return out
+}
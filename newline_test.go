@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrimLineEnding(t *testing.T) {
+	for in, want := range map[string]string{
+		"":           "",
+		"out":        "out",
+		"out\n":      "out",
+		"out\r\n":    "out",
+		"out\r\r\n":  "out",
+		"out\r":      "out",
+		"out\n\n":    "out\n",
+		"a\r\nb\r\n": "a\r\nb",
+	} {
+		if got := string(trimLineEnding([]byte(in))); got != want {
+			t.Errorf("trimLineEnding(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// filterChunks 把 chunks 依次经过 p 处理, 最后 flush
+func filterChunks(p outputProcessor, chunks ...string) string {
+	var out []byte
+	for _, c := range chunks {
+		out = append(out, p.filter([]byte(c))...)
+	}
+	return string(append(out, p.flush()...))
+}
+
+func TestNewlineFilter(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"a\nb", "a\nb"},
+		{"a\r\r\nb", "a\nb"},
+		// 不跟 \n 的 \r 保留, 如进度条
+		{"10%\r50%\r100%\r\n", "10%\r50%\r100%\n"},
+		{"trailing\r", "trailing\r"},
+		{"中文\r\n输出", "中文\n输出"},
+	}
+	for _, tt := range tests {
+		if got := filterChunks(&newlineFilter{}, tt.in); got != tt.want {
+			t.Errorf("filter(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		for i := 1; i < len(tt.in); i++ {
+			if got := filterChunks(&newlineFilter{}, tt.in[:i], tt.in[i:]); got != tt.want {
+				t.Errorf("filter(%q) split at %d = %q, want %q", tt.in, i, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestLineLimiter(t *testing.T) {
+	tests := []struct {
+		in        string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"a\nb\nc\nd\n", 2, "a\nb", true},
+		{"a\r\nb\r\nc\r\n", 2, "a\r\nb", true},
+		{"a\nb\n", 2, "a\nb", false},
+		{"a\nb", 5, "a\nb", false},
+		{"a\nb\r", 5, "a\nb\r", false},
+		// 单独的 \r 不计为换行
+		{"10%\r100%\ndone\nmore\n", 2, "10%\r100%\ndone", true},
+		{"一\n二\n三\n", 1, "一", true},
+	}
+	for _, tt := range tests {
+		for i := 0; i <= len(tt.in); i++ {
+			l := &lineLimiter{max: tt.max}
+			if got := filterChunks(l, tt.in[:i], tt.in[i:]); got != tt.want || l.truncated != tt.truncated {
+				t.Errorf("limit(%q, %d) split at %d = %q truncated %t, want %q truncated %t", tt.in, tt.max, i, got, l.truncated, tt.want, tt.truncated)
+			}
+		}
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Lines": {Output: "1\n2\n3\n4\n5\n6\n7\n8"}}
+	})
+	for _, shell := range []string{"bash", "cmd"} {
+		id := ts.startSession(aliceToken, map[string]any{"shell": shell, "normalize_newlines": false})
+		resp, data := ts.run(aliceToken, id, "Get-Lines", map[string]any{"max_lines": 3})
+		want := "1\n2\n3"
+		if shell == "cmd" {
+			want = "1\r\n2\r\n3"
+		}
+		// 默认的 truncation_notice 跟在保留的行之后
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), want) || !strings.Contains(string(data), "exceeded 3 lines") || strings.Contains(string(data), "4") || resp.Header.Get("X-Output-Truncated") != "true" {
+			t.Fatalf("%s max_lines = %d %q truncated %s", shell, resp.StatusCode, data, resp.Header.Get("X-Output-Truncated"))
+		}
+		// 被丢弃的输出已读取到结束标记, 不会混入下一条命令
+		if resp, data = ts.run(aliceToken, id, "echo next", nil); resp.StatusCode != http.StatusOK || string(data) != "next" {
+			t.Fatalf("%s next command = %d %q", shell, resp.StatusCode, data)
+		}
+	}
+
+	id := ts.startSession(aliceToken, nil)
+	resp, _ := ts.run(aliceToken, id, "Get-Lines", map[string]any{"max_lines": -1})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative max_lines = %d", resp.StatusCode)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"lines": {Output: "one\ntwo\nthree"}}
+	})
+	// 模拟的 cmd 与真实的 cmd 一样以 CRLF 输出
+	id := ts.startSession(aliceToken, map[string]any{"shell": "cmd"})
+
+	if _, data := ts.run(aliceToken, id, "lines", nil); string(data) != "one\r\ntwo\r\nthree" {
+		t.Fatalf("default output = %q", data)
+	}
+	resp, data := ts.run(aliceToken, id, "lines", map[string]any{"normalize_newlines": true})
+	if resp.StatusCode != http.StatusOK || string(data) != "one\ntwo\nthree" {
+		t.Fatalf("normalized output = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestNormalizeNewlinesServerDefault(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.NormalizeNewlines = true
+		cfg.FakeOutputs = map[string]FakeOutput{"lines": {Output: "one\ntwo"}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"shell": "cmd"})
+
+	if _, data := ts.run(aliceToken, id, "lines", nil); string(data) != "one\ntwo" {
+		t.Fatalf("default output = %q", data)
+	}
+	if _, data := ts.run(aliceToken, id, "lines", map[string]any{"normalize_newlines": false}); string(data) != "one\r\ntwo" {
+		t.Fatalf("normalize_newlines false output = %q", data)
+	}
+}
+
+func TestBOMFilter(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"\xef\xbb\xbfhello"}, "hello"},
+		// 被拆分到多个数据块中的 BOM
+		{[]string{"\xef", "\xbb", "\xbfhi"}, "hi"},
+		{[]string{"\xef\xbb", "\xbf"}, ""},
+		// 只去除开头的一个 BOM
+		{[]string{"\xef\xbb\xbf\xef\xbb\xbfx"}, "\xef\xbb\xbfx"},
+		{[]string{"a\xef\xbb\xbf"}, "a\xef\xbb\xbf"},
+		{[]string{"\xef\xbbx"}, "\xef\xbbx"},
+		// 不足 3 个字节的 BOM 前缀在 flush 时原样输出
+		{[]string{"\xef\xbb"}, "\xef\xbb"},
+		{[]string{""}, ""},
+	}
+	for _, tt := range tests {
+		if got := filterChunks(&bomFilter{}, tt.chunks...); got != tt.want {
+			t.Errorf("filter %q = %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestStripBOM(t *testing.T) {
+	outputs := map[string]FakeOutput{"Get-Content": {Output: "\xef\xbb\xbfname=value"}}
+	ts := newTestServer(t, func(cfg *Config) { cfg.FakeOutputs = outputs })
+	id := ts.startSession(aliceToken, nil)
+	// 默认去除开头的 BOM
+	if _, data := ts.run(aliceToken, id, "Get-Content", nil); string(data) != "name=value" {
+		t.Fatalf("default output = %q", data)
+	}
+	if _, data := ts.run(aliceToken, id, "Get-Content", map[string]any{"strip_bom": false}); string(data) != "\xef\xbb\xbfname=value" {
+		t.Fatalf("output with strip_bom false = %q", data)
+	}
+
+	ts = newTestServer(t, func(cfg *Config) {
+		cfg.StripBOM = false
+		cfg.FakeOutputs = outputs
+	})
+	id = ts.startSession(aliceToken, nil)
+	if _, data := ts.run(aliceToken, id, "Get-Content", nil); string(data) != "\xef\xbb\xbfname=value" {
+		t.Fatalf("output with server strip_bom false = %q", data)
+	}
+	if _, data := ts.run(aliceToken, id, "Get-Content", map[string]any{"strip_bom": true}); string(data) != "name=value" {
+		t.Fatalf("output with strip_bom true = %q", data)
+	}
+}
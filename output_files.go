@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// outputFileTTL 输出文件的保留时间, 过期后自动删除
+const outputFileTTL = 30 * time.Minute
+
+// OutputFile 写入命令输出的临时文件
+type OutputFile struct {
+	Token string
+	Path  string
+	// Owner 执行命令的租户, 只有同一租户可以下载
+	Owner     string
+	Size      int
+	ExpiresAt time.Time
+	// once 转存的输出文件, 下载一次后删除
+	once bool
+}
+
+// OutputFileStore 管理命令输出临时文件
+type OutputFileStore struct {
+	dir   string
+	ttl   time.Duration
+	files map[string]*OutputFile
+	mu    sync.Mutex
+}
+
+func NewOutputFileStore(dir string, ttl time.Duration) (*OutputFileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	store := &OutputFileStore{
+		dir:   dir,
+		ttl:   ttl,
+		files: make(map[string]*OutputFile),
+	}
+	go store.cleanupLoop()
+	return store, nil
+}
+
+// Create 创建新的输出文件, 调用方负责写入并在完成后调用 Commit
+func (st *OutputFileStore) Create(owner string) (*os.File, *OutputFile, error) {
+	token := uuid.New().String()
+	path := filepath.Join(st.dir, token+".txt")
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+	return f, &OutputFile{Token: token, Path: path, Owner: owner}, nil
+}
+
+// Commit 登记已写完的输出文件, 开始计算过期时间
+func (st *OutputFileStore) Commit(file *OutputFile, size int) {
+	file.Size = size
+	file.ExpiresAt = time.Now().Add(st.ttl)
+
+	st.mu.Lock()
+	st.files[file.Token] = file
+	st.mu.Unlock()
+
+	log.Printf("✓ Output file stored | Token: %s | Size: %d bytes", file.Token, size)
+}
+
+// Get 获取未过期的输出文件
+func (st *OutputFileStore) Get(token string) (*OutputFile, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	file, exists := st.files[token]
+	if !exists || time.Now().After(file.ExpiresAt) {
+		return nil, false
+	}
+	return file, true
+}
+
+// Remove 删除输出文件, 之后无法再下载
+func (st *OutputFileStore) Remove(file *OutputFile) {
+	st.mu.Lock()
+	delete(st.files, file.Token)
+	st.mu.Unlock()
+	if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠ Failed to remove output file | Token: %s | Error: %v", file.Token, err)
+	}
+}
+
+// cleanupLoop 定期删除过期的输出文件
+func (st *OutputFileStore) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		st.mu.Lock()
+		for token, file := range st.files {
+			if now.After(file.ExpiresAt) {
+				if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+					log.Printf("⚠ Failed to remove output file | Token: %s | Error: %v", token, err)
+				}
+				delete(st.files, token)
+				log.Printf("✓ Output file expired | Token: %s", token)
+			}
+		}
+		st.mu.Unlock()
+	}
+}
+
+var outputFileStore *OutputFileStore
+
+// runCommandToFile 执行命令并将输出写入临时文件
+// 超时、被输出看门狗中止或被取消时仍保留已写入的部分输出, 同时返回文件和错误
+func runCommandToFile(session *Session, command, owner string, opts RunOptions) (*OutputFile, *CommandResult, error) {
+	f, file, err := outputFileStore.Create(owner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts.Limit = maxFileOutputSize
+	result, err := session.RunCommandTo(command, f, opts)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close output file: %v", closeErr)
+	}
+	if err != nil && (result == nil || !(result.TimedOut || result.Aborted || result.Cancelled)) {
+		os.Remove(file.Path)
+		return nil, result, err
+	}
+
+	outputFileStore.Commit(file, result.Size)
+	return file, result, err
+}
+
+// API5: 下载命令输出文件
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		log.Printf("✗ Missing token parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "token is required"))
+		return
+	}
+
+	log.Printf("→ Request: Download output | Token: %s", token)
+
+	file, exists := outputFileStore.Get(token)
+	if !exists || !identityFrom(r).CanAccess(file.Owner) {
+		log.Printf("✗ Output file not found | Token: %s", token)
+		writeError(w, newAPIError(http.StatusNotFound, "Output file not found"))
+		return
+	}
+
+	f, err := os.Open(file.Path)
+	if err != nil {
+		log.Printf("✗ Failed to open output file | Token: %s | Error: %v", token, err)
+		writeError(w, newAPIError(http.StatusNotFound, "Output file not found"))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", token+".txt"))
+	w.Header().Set("Content-Length", fmt.Sprint(file.Size))
+	n, err := io.Copy(w, f)
+	if err != nil {
+		log.Printf("✗ Failed to send output file | Token: %s | Error: %v", token, err)
+		return
+	}
+	log.Printf("✓ Output file sent | Token: %s | Size: %d bytes", token, n)
+	if file.once {
+		outputFileStore.Remove(file)
+		log.Printf("✓ Spooled output file removed after download | Token: %s", token)
+	}
+}
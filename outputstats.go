@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// outputSizeBuckets 命令输出大小直方图的桶上限(字节), 覆盖到 max_output_size 的上限和输出文件
+var outputSizeBuckets = []int64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 16 << 20, 256 << 20}
+
+// commandOutputSizes 所有会话客户端命令的输出大小分布
+var commandOutputSizes = newSizeHistogram(outputSizeBuckets)
+
+// sizeHistogram 累计直方图, counts[i] 为不超过 buckets[i] 的观测数, 最后一项为超过所有上限的观测数
+type sizeHistogram struct {
+	mu      sync.Mutex
+	buckets []int64
+	counts  []int64
+	sum     int64
+	count   int64
+}
+
+func newSizeHistogram(buckets []int64) *sizeHistogram {
+	return &sizeHistogram{buckets: buckets, counts: make([]int64, len(buckets)+1)}
+}
+
+func (h *sizeHistogram) observe(n int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.buckets) && n > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += n
+	h.count++
+}
+
+// write 以 Prometheus 文本格式写出直方图, 桶的计数为累计值
+func (h *sizeHistogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%d\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %d\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
+
+// OutputStats 会话中客户端命令输出大小的汇总, 每条命令的大小见命令历史中的 output_bytes
+type OutputStats struct {
+	Commands     int64 `json:"commands"`
+	TotalBytes   int64 `json:"total_bytes"`
+	MaxBytes     int   `json:"max_bytes"`
+	AverageBytes int64 `json:"average_bytes"`
+	// Truncated 输出被截断的命令数
+	Truncated int64 `json:"truncated"`
+}
+
+// outputStats 会话的输出大小统计, 零值可用; 在执行命令时写入, 查询时不等待 s.mu
+type outputStats struct {
+	mu        sync.Mutex
+	commands  int64
+	total     int64
+	max       int
+	truncated int64
+}
+
+// record 记录一条已返回结果的客户端命令的输出大小, 同时计入 commandOutputSizes
+func (st *outputStats) record(result *CommandResult) {
+	commandOutputSizes.observe(int64(result.Size))
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.commands++
+	st.total += int64(result.Size)
+	if result.Size > st.max {
+		st.max = result.Size
+	}
+	if result.Truncated {
+		st.truncated++
+	}
+}
+
+// snapshot 返回统计的副本
+func (st *outputStats) snapshot() *OutputStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := &OutputStats{
+		Commands:   st.commands,
+		TotalBytes: st.total,
+		MaxBytes:   st.max,
+		Truncated:  st.truncated,
+	}
+	if st.commands > 0 {
+		stats.AverageBytes = st.total / st.commands
+	}
+	return stats
+}
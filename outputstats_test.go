@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	h := newSizeHistogram([]int64{10, 100})
+	for _, n := range []int64{0, 10, 11, 100, 5000} {
+		h.observe(n)
+	}
+	var out strings.Builder
+	h.write(&out, "sizes", "Sizes.")
+	// 桶的计数为累计值
+	want := "# HELP sizes Sizes.\n# TYPE sizes histogram\n" +
+		"sizes_bucket{le=\"10\"} 2\nsizes_bucket{le=\"100\"} 4\nsizes_bucket{le=\"+Inf\"} 5\nsizes_sum 5121\nsizes_count 5\n"
+	if out.String() != want {
+		t.Fatalf("histogram =\n%s", out.String())
+	}
+}
+
+func TestCommandOutputSizes(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			sessionInfoCommand: {Output: `{"location":"C:\\","env":[]}`},
+			"Get-Lines":        {Output: "one\ntwo\nthree"},
+		}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo init"}})
+	ts.run(aliceToken, id, "echo hello", nil)
+	ts.run(aliceToken, id, "Get-Lines", map[string]any{"max_lines": 1})
+	// 探测命令不记录
+	ts.run(aliceToken, id, "Get-Lines", map[string]any{"probe": true})
+
+	_, data := ts.do(http.MethodGet, aliceToken, "/session-info?session_id="+id, nil)
+	var info SessionInfo
+	decodeJSON(t, data, &info)
+	if len(info.History) != 3 {
+		t.Fatalf("history = %+v", info.History)
+	}
+	// 每条历史记录包含输出大小, 截断时为保留部分的大小
+	if rec := info.History[1]; rec.OutputBytes != len("hello") || rec.Truncated {
+		t.Fatalf("echo record = %+v", rec)
+	}
+	if rec := info.History[2]; rec.OutputBytes != len("one") || !rec.Truncated {
+		t.Fatalf("truncated record = %+v", rec)
+	}
+
+	// 汇总只计入客户端命令, 不包括初始化命令
+	_, status := ts.sessionStatus(aliceToken, id)
+	stats := status.OutputStats
+	if stats == nil || stats.Commands != 2 || stats.TotalBytes != 8 || stats.MaxBytes != 5 || stats.AverageBytes != 4 || stats.Truncated != 1 {
+		t.Fatalf("output stats = %+v", stats)
+	}
+	if info.OutputStats == nil || *info.OutputStats != *stats {
+		t.Fatalf("session-info output stats = %+v, status %+v", info.OutputStats, stats)
+	}
+	if _, metrics := ts.do(http.MethodGet, adminToken, "/metrics", nil); !strings.Contains(string(metrics), "rce_command_output_bytes_count") {
+		t.Fatal("metrics missing command output sizes")
+	}
+}
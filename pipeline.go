@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// outputProcessor 命令输出的处理器, outputWriter 按 output_pipeline 的顺序依次调用
+// filter 可以暂存跨数据块的内容, flush 在输出结束时返回暂存的内容
+type outputProcessor interface {
+	filter(b []byte) []byte
+	flush() []byte
+}
+
+// 内置的输出处理器
+const (
+	// ProcessorDecode 按会话的 fallback_code_page 解码无效的 UTF-8 字节, 并统计输出的编码信息
+	ProcessorDecode = "decode"
+	// ProcessorStripBOM 去除输出开头的 UTF-8 BOM, 由 strip_bom 决定是否启用
+	ProcessorStripBOM = "strip_bom"
+	// ProcessorStripANSI 去除 ANSI 转义序列, 由 strip_ansi 决定是否启用
+	ProcessorStripANSI = "strip_ansi"
+	// ProcessorRedact 替换会话的机密值, 必须包含在管道中
+	ProcessorRedact = "redact"
+	// ProcessorNormalizeNewlines 将 CRLF 转换为 LF, 由 normalize_newlines 决定是否启用
+	ProcessorNormalizeNewlines = "normalize_newlines"
+	// ProcessorMaxLines 只保留前 max_lines 行
+	ProcessorMaxLines = "max_lines"
+	// ProcessorTrimTrailingSpace 去除每行末尾的空格和制表符
+	ProcessorTrimTrailingSpace = "trim_trailing_space"
+	// ProcessorTruncateLines 每行只保留前 max_length 个字符, 被截断的行以 … 结尾
+	ProcessorTruncateLines = "truncate_lines"
+	// ProcessorStripPrompt 去除行首混入输出的 shell 提示符, 如 PS C:\>
+	ProcessorStripPrompt = "strip_prompt"
+)
+
+// defaultPromptPattern strip_prompt 默认匹配的 PowerShell 提示符: PS 路径> 及其后的一个空格
+const defaultPromptPattern = `PS(?: [^\r\n>]*)?> ?`
+
+// maxPendingLine strip_prompt 暂存的不完整行上限, 超过后只检查已读到的开头, 该行其余部分原样写出
+const maxPendingLine = 4096
+
+// maxPendingSpace trim_trailing_space 暂存的空白上限, 超过后原样写出, 避免只有空白的输出一直暂存
+const maxPendingSpace = 4096
+
+// OutputProcessorConfig output_pipeline 中的一个处理器, 可以只写名称
+type OutputProcessorConfig struct {
+	Name string `json:"name"`
+	// MaxLength truncate_lines 每行保留的字符数
+	MaxLength int `json:"max_length,omitempty"`
+	// Pattern strip_prompt 匹配提示符的正则表达式, 只在行首匹配, 为空时为 defaultPromptPattern
+	Pattern string `json:"pattern,omitempty"`
+
+	// prompt 编译后的 Pattern, 检查配置时设置
+	prompt *regexp.Regexp
+}
+
+func (c *OutputProcessorConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*c = OutputProcessorConfig{Name: name}
+		return nil
+	}
+	type plain OutputProcessorConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// defaultOutputPipeline 默认的处理顺序
+func defaultOutputPipeline() []OutputProcessorConfig {
+	return []OutputProcessorConfig{
+		{Name: ProcessorDecode},
+		{Name: ProcessorStripBOM},
+		{Name: ProcessorStripANSI},
+		{Name: ProcessorRedact},
+		{Name: ProcessorNormalizeNewlines},
+		{Name: ProcessorMaxLines},
+	}
+}
+
+// outputPipeline 配置的输出处理顺序
+var outputPipeline = defaultOutputPipeline()
+
+// validateOutputPipeline 检查处理器名称和参数, 每个处理器最多出现一次
+func validateOutputPipeline(pipeline []OutputProcessorConfig) error {
+	seen := make(map[string]bool)
+	for i := range pipeline {
+		p := &pipeline[i]
+		switch p.Name {
+		case ProcessorDecode, ProcessorStripBOM, ProcessorStripANSI, ProcessorRedact, ProcessorNormalizeNewlines, ProcessorMaxLines, ProcessorTrimTrailingSpace:
+		case ProcessorTruncateLines:
+			if p.MaxLength <= 0 {
+				return fmt.Errorf("output_pipeline: %s requires a positive max_length", p.Name)
+			}
+		case ProcessorStripPrompt:
+			pattern := p.Pattern
+			if pattern == "" {
+				pattern = defaultPromptPattern
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("output_pipeline: invalid %s pattern: %v", p.Name, err)
+			}
+			p.prompt = regexp.MustCompile(`^(?:` + pattern + `)`)
+		default:
+			return fmt.Errorf("output_pipeline: unknown processor %q", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("output_pipeline: duplicate processor %q", p.Name)
+		}
+		if (p.Name == ProcessorTrimTrailingSpace || p.Name == ProcessorTruncateLines || p.Name == ProcessorStripPrompt) && !seen[ProcessorRedact] {
+			// 先修改再替换时机密值可能只剩一部分而不被识别
+			return fmt.Errorf("output_pipeline: %s must come after %s", p.Name, ProcessorRedact)
+		}
+		seen[p.Name] = true
+	}
+	if !seen[ProcessorRedact] {
+		return fmt.Errorf("output_pipeline must include %s", ProcessorRedact)
+	}
+	return nil
+}
+
+// pipelineOptions 决定本条命令启用哪些处理器
+type pipelineOptions struct {
+	// raw 原始字节模式只启用 redact
+	raw               bool
+	stripANSI         bool
+	normalizeNewlines bool
+	stripBOM          bool
+	maxLines          int
+	// keepLines 为 true 时不截断行, 用于 JSON 输出和按检查点分段, 避免截断 JSON 和检查点标记
+	keepLines bool
+}
+
+// buildPipeline 按 output_pipeline 的顺序创建本条命令启用的处理器
+func (s *Session) buildPipeline(ow *outputWriter, opts pipelineOptions) {
+	for _, p := range outputPipeline {
+		var processor outputProcessor
+		switch {
+		case p.Name == ProcessorRedact:
+			if redact := newRedactFilter(s.secrets); redact != nil {
+				processor = redact
+			}
+		case opts.raw:
+		case p.Name == ProcessorDecode:
+			// 未设置 fallback_code_page 时只统计无效字节
+			ow.encoding = &encodingFilter{decode: s.fallbackDecoder, codePage: s.fallbackCodePage}
+			processor = ow.encoding
+		case p.Name == ProcessorStripBOM && opts.stripBOM:
+			processor = &bomFilter{}
+		case p.Name == ProcessorStripANSI && opts.stripANSI:
+			processor = &ansiFilter{}
+		case p.Name == ProcessorNormalizeNewlines && opts.normalizeNewlines:
+			processor = &newlineFilter{}
+		case p.Name == ProcessorMaxLines && opts.maxLines > 0:
+			ow.lines = &lineLimiter{max: opts.maxLines}
+			processor = ow.lines
+		case p.Name == ProcessorTrimTrailingSpace:
+			processor = &trailingSpaceFilter{}
+		case p.Name == ProcessorTruncateLines && !opts.keepLines:
+			processor = &lineTruncator{max: p.MaxLength}
+		case p.Name == ProcessorStripPrompt:
+			processor = &promptFilter{prompt: p.prompt}
+		}
+		if processor != nil {
+			ow.processors = append(ow.processors, processor)
+		}
+		if p.Name == ProcessorRedact {
+			ow.archiveAt = len(ow.processors)
+		}
+	}
+}
+
+// trailingSpaceFilter 去除每行末尾的空格和制表符
+// 空白暂存到确定其后是行尾还是其他内容为止, 输出结尾的空白也被去除
+type trailingSpaceFilter struct {
+	pending []byte
+}
+
+func (f *trailingSpaceFilter) filter(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(f.pending))
+	for _, c := range b {
+		switch c {
+		case ' ', '\t':
+			f.pending = append(f.pending, c)
+			continue
+		case '\r', '\n':
+			f.pending = f.pending[:0]
+		default:
+			out = append(out, f.pending...)
+			f.pending = f.pending[:0]
+		}
+		out = append(out, c)
+	}
+	if len(f.pending) > maxPendingSpace {
+		out = append(out, f.pending...)
+		f.pending = f.pending[:0]
+	}
+	return out
+}
+
+func (f *trailingSpaceFilter) flush() []byte {
+	f.pending = nil
+	return nil
+}
+
+// lineTruncator 每行只保留前 max 个字符, 之后的内容丢弃并以 … 标记, \r 和 \n 都视为行的开始
+type lineTruncator struct {
+	max int
+	// chars 当前行已读到的字符数
+	chars int
+}
+
+func (t *lineTruncator) filter(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, c := range b {
+		switch {
+		case c == '\r' || c == '\n':
+			t.chars = 0
+		case !utf8.RuneStart(c):
+			// 多字节字符的后续字节跟随首字节保留或丢弃
+			if t.chars > t.max {
+				continue
+			}
+		default:
+			t.chars++
+			if t.chars == t.max+1 {
+				out = append(out, "…"...)
+			}
+			if t.chars > t.max {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (t *lineTruncator) flush() []byte {
+	return nil
+}
+
+// promptFilter 去除行首的 shell 提示符, 只剩提示符的行整行去除, 其他内容原样保留
+// 不完整的行暂存到行尾或输出结束, 以便匹配跨数据块的提示符
+type promptFilter struct {
+	prompt *regexp.Regexp
+	line   []byte
+	// passing 当前行超过 maxPendingLine, 已检查过开头, 到行尾之前原样写出
+	passing bool
+}
+
+func (f *promptFilter) filter(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(f.line))
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if f.passing {
+			if nl < 0 {
+				return append(out, b...)
+			}
+			out = append(out, b[:nl+1]...)
+			b = b[nl+1:]
+			f.passing = false
+			continue
+		}
+		if nl < 0 {
+			f.line = append(f.line, b...)
+			if len(f.line) > maxPendingLine {
+				out = append(out, f.strip(f.line)...)
+				f.line = f.line[:0]
+				f.passing = true
+			}
+			return out
+		}
+		f.line = append(f.line, b[:nl+1]...)
+		out = append(out, f.strip(f.line)...)
+		f.line = f.line[:0]
+		b = b[nl+1:]
+	}
+	return out
+}
+
+// strip 去除行首连续出现的提示符, 行中只剩行尾或空白时返回 nil
+func (f *promptFilter) strip(line []byte) []byte {
+	rest := line
+	for {
+		loc := f.prompt.FindIndex(rest)
+		if loc == nil || loc[1] == 0 {
+			break
+		}
+		rest = rest[loc[1]:]
+	}
+	if len(rest) == len(line) {
+		return line
+	}
+	if len(bytes.TrimSpace(rest)) == 0 {
+		return nil
+	}
+	return rest
+}
+
+func (f *promptFilter) flush() []byte {
+	out := f.strip(f.line)
+	f.line, f.passing = nil, false
+	return out
+}
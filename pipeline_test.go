@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// pipelineOf 解析 JSON 形式的 output_pipeline
+func pipelineOf(t *testing.T, s string) []OutputProcessorConfig {
+	t.Helper()
+	var pipeline []OutputProcessorConfig
+	if err := json.Unmarshal([]byte(s), &pipeline); err != nil {
+		t.Fatal(err)
+	}
+	return pipeline
+}
+
+func TestValidateOutputPipeline(t *testing.T) {
+	tests := []struct {
+		pipeline string
+		ok       bool
+	}{
+		{`["redact"]`, true},
+		{`["decode", "redact", {"name": "truncate_lines", "max_length": 80}, "strip_prompt"]`, true},
+		{`["redact", {"name": "strip_prompt", "pattern": "\\$ "}]`, true},
+		{`[]`, false},
+		{`["decode"]`, false},
+		{`["redact", "redact"]`, false},
+		{`["redact", "gzip"]`, false},
+		{`["redact", "truncate_lines"]`, false},
+		{`["redact", {"name": "strip_prompt", "pattern": "("}]`, false},
+		// 会修改内容的处理器必须在 redact 之后
+		{`["trim_trailing_space", "redact"]`, false},
+	}
+	for _, tt := range tests {
+		if err := validateOutputPipeline(pipelineOf(t, tt.pipeline)); (err == nil) != tt.ok {
+			t.Errorf("validate %s = %v, want ok %t", tt.pipeline, err, tt.ok)
+		}
+	}
+	if err := validateOutputPipeline(defaultOutputPipeline()); err != nil {
+		t.Errorf("default pipeline = %v", err)
+	}
+}
+
+func TestTrailingSpaceFilter(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"a  \nb\t\r\n"}, "a\nb\r\n"},
+		// 跨数据块的空白暂存到确定其后的内容
+		{[]string{"a  ", " b  ", "\n"}, "a   b\n"},
+		{[]string{"end   "}, "end"},
+	}
+	for _, tt := range tests {
+		if got := filterChunks(&trailingSpaceFilter{}, tt.chunks...); got != tt.want {
+			t.Errorf("trim %q = %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestLineTruncator(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"abcdef\nab\n"}, "abc…\nab\n"},
+		{[]string{"ab", "cd", "ef\r\nxyz"}, "abc…\r\nxyz"},
+		// 按字符计数, 不拆开多字节字符
+		{[]string{"你好世界"}, "你好世…"},
+	}
+	for _, tt := range tests {
+		if got := filterChunks(&lineTruncator{max: 3}, tt.chunks...); got != tt.want {
+			t.Errorf("truncate %q = %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestPromptFilter(t *testing.T) {
+	prompt := regexp.MustCompile(`^(?:` + defaultPromptPattern + `)`)
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"PS C:\\> Get-Date\nresult\n"}, "Get-Date\nresult\n"},
+		// 只剩提示符的行整行去除, 提示符可以跨数据块
+		{[]string{"P", "S C:\\Users> \nok"}, "ok"},
+		{[]string{"PS> PS> nested\n"}, "nested\n"},
+		{[]string{"not PS> a prompt\n"}, "not PS> a prompt\n"},
+	}
+	for _, tt := range tests {
+		if got := filterChunks(&promptFilter{prompt: prompt}, tt.chunks...); got != tt.want {
+			t.Errorf("strip prompt %q = %q, want %q", tt.chunks, got, tt.want)
+		}
+	}
+	// 超长的行只检查开头, 之后原样写出
+	line := strings.Repeat("x", maxPendingLine+10)
+	long := "PS> " + line + "\nPS> y\n"
+	if got := filterChunks(&promptFilter{prompt: prompt}, long[:maxPendingLine+5], long[maxPendingLine+5:]); got != line+"\ny\n" {
+		t.Errorf("long line = %d bytes", len(got))
+	}
+}
+
+func TestStripPromptCustomPattern(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.OutputPipeline = pipelineOf(t, `["redact", {"name": "strip_prompt", "pattern": "[a-z]+@[a-z]+:[^$]*\\$ "}]`)
+		cfg.FakeOutputs = map[string]FakeOutput{"Leaky": {Output: "user@host:~$ \nuser@host:/tmp$ ls\nPS C:\\> kept"}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	// 配置的 pattern 替换默认的 PowerShell 提示符
+	if resp, data := ts.run(aliceToken, id, "Leaky", nil); resp.StatusCode != http.StatusOK || string(data) != "ls\nPS C:\\> kept" {
+		t.Fatalf("custom prompt = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestOutputPipelineOrder(t *testing.T) {
+	const secret = "hunter2-pipeline"
+	// 机密值中间夹着 ANSI 转义序列, 先去除 ANSI 才能识别
+	output := "hun\x1b[1mter2-pipeline   \r\nPS C:\\> next"
+	run := func(pipeline string) string {
+		ts := newTestServer(t, func(cfg *Config) {
+			cfg.OutputPipeline = pipelineOf(t, pipeline)
+			cfg.StripANSI = true
+			cfg.NormalizeNewlines = true
+			cfg.FakeOutputs = map[string]FakeOutput{"Get-Secret": {Output: output}}
+		})
+		id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"KEY": secret}})
+		resp, data := ts.run(aliceToken, id, "Get-Secret", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: run = %d %s", pipeline, resp.StatusCode, data)
+		}
+		return string(data)
+	}
+
+	if got := run(`["strip_ansi", "redact", "trim_trailing_space", "normalize_newlines", "strip_prompt"]`); got != "[REDACTED]\nnext" {
+		t.Errorf("strip_ansi before redact = %q", got)
+	}
+	if got := run(`["redact", "strip_ansi"]`); strings.Contains(got, "[REDACTED]") {
+		t.Errorf("redact before strip_ansi = %q", got)
+	}
+	// 管道中没有的处理器不启用, 即使 strip_ansi 和 normalize_newlines 为 true
+	if got := run(`["redact"]`); got != output {
+		t.Errorf("redact only = %q", got)
+	}
+}
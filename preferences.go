@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// preferenceVariables 可在创建会话时设置的 PowerShell 偏好变量
+var preferenceVariables = []string{
+	"ProgressPreference",
+	"VerbosePreference",
+	"DebugPreference",
+	"WarningPreference",
+	"InformationPreference",
+	"ErrorActionPreference",
+}
+
+// preferenceValues 允许的取值
+// 不允许 Inquire、Suspend 和 Break: 它们会等待交互输入, 使命令无法结束
+var preferenceValues = []string{"SilentlyContinue", "Continue", "Stop", "Ignore"}
+
+// normalizePreferences 校验偏好变量并将名称和取值规范为 PowerShell 中的写法, 不区分大小写
+func normalizePreferences(prefs map[string]string) (map[string]string, error) {
+	if len(prefs) == 0 {
+		return nil, nil
+	}
+	normalized := make(map[string]string, len(prefs))
+	for name, value := range prefs {
+		n, ok := matchFold(preferenceVariables, name)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown preference variable %q", errInvalidOptions, name)
+		}
+		v, ok := matchFold(preferenceValues, value)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s must be one of %s", errInvalidOptions, n, strings.Join(preferenceValues, ", "))
+		}
+		// ErrorActionPreference 不支持 Ignore, 只能用于单条命令的 -ErrorAction
+		if n == "ErrorActionPreference" && v == "Ignore" {
+			return nil, fmt.Errorf("%w: ErrorActionPreference cannot be Ignore", errInvalidOptions)
+		}
+		if _, exists := normalized[n]; exists {
+			return nil, fmt.Errorf("%w: preference %s is set more than once", errInvalidOptions, n)
+		}
+		normalized[n] = v
+	}
+	return normalized, nil
+}
+
+// preferenceCommand 生成设置偏好变量的语句, 没有输出
+func preferenceCommand(prefs map[string]string) string {
+	names := make([]string, 0, len(prefs))
+	for name := range prefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	statements := make([]string, 0, len(names))
+	for _, name := range names {
+		statements = append(statements, fmt.Sprintf("$global:%s = '%s'", name, prefs[name]))
+	}
+	return strings.Join(statements, "; ")
+}
+
+func matchFold(candidates []string, s string) (string, bool) {
+	for _, c := range candidates {
+		if strings.EqualFold(c, s) {
+			return c, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNormalizePreferences(t *testing.T) {
+	prefs, err := normalizePreferences(map[string]string{"progresspreference": "silentlycontinue", "WarningPreference": "Stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs["ProgressPreference"] != "SilentlyContinue" || prefs["WarningPreference"] != "Stop" || len(prefs) != 2 {
+		t.Fatalf("normalized = %v", prefs)
+	}
+	if got, want := preferenceCommand(prefs), "$global:ProgressPreference = 'SilentlyContinue'; $global:WarningPreference = 'Stop'"; got != want {
+		t.Fatalf("preferenceCommand = %q, want %q", got, want)
+	}
+
+	for _, prefs := range []map[string]string{
+		{"FooPreference": "Continue"},
+		{"ProgressPreference": "Inquire"},
+		{"VerbosePreference": "Suspend"},
+		{"ErrorActionPreference": "Ignore"},
+		{"ProgressPreference": "Continue", "progresspreference": "Stop"},
+	} {
+		if _, err := normalizePreferences(prefs); !errors.Is(err, errInvalidOptions) {
+			t.Errorf("normalizePreferences(%v) = %v, want errInvalidOptions", prefs, err)
+		}
+	}
+}
+
+// stdinRecorder 记录写入模拟 shell stdin 的内容
+type stdinRecorder struct {
+	fakeSpawner
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (r *stdinRecorder) spawn(s *Session) (*shellProcess, error) {
+	proc, err := r.fakeSpawner.spawn(s)
+	if err != nil {
+		return nil, err
+	}
+	proc.stdin = struct {
+		io.Writer
+		io.Closer
+	}{io.MultiWriter(r, proc.stdin), proc.stdin}
+	return proc, nil
+}
+
+func (r *stdinRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(b)
+}
+
+func (r *stdinRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+func TestPreferencesAppliedBeforeCommands(t *testing.T) {
+	ts := newTestServer(t, nil)
+	recorder := &stdinRecorder{}
+	spawner = recorder
+	id := ts.startSession(aliceToken, map[string]any{
+		"shell":       "pwsh",
+		"preferences": map[string]string{"ProgressPreference": "SilentlyContinue"},
+	})
+	if resp, data := ts.run(aliceToken, id, "echo ok", nil); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+	// 偏好变量在启动时设置, 早于第一条命令
+	stdin := recorder.String()
+	pref := strings.Index(stdin, "$global:ProgressPreference = 'SilentlyContinue'")
+	if first := strings.Index(stdin, beginMarkerPrefix); pref < 0 || first < 0 || pref > first {
+		t.Fatalf("preference not set before the first command:\n%s", stdin)
+	}
+}
+
+func TestPreferencesRejected(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, opts := range []map[string]any{
+		{"shell": "bash", "preferences": map[string]string{"ProgressPreference": "SilentlyContinue"}},
+		{"shell": "pwsh", "preferences": map[string]string{"ProgressPreference": "Inquire"}},
+	} {
+		resp, data := ts.post(aliceToken, "/start-session", opts)
+		if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInvalidRequest {
+			t.Errorf("start %v = %d %s", opts, resp.StatusCode, data)
+		}
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions left after rejected starts", n)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// ProcessPriority shell 进程的调度优先级, shell 启动的命令继承该优先级
+type ProcessPriority string
+
+const (
+	// PriorityNormal 与服务进程相同的优先级(默认)
+	PriorityNormal ProcessPriority = "normal"
+	// PriorityBelowNormal Unix 上 nice 值为 10, Windows 上为 BELOW_NORMAL_PRIORITY_CLASS
+	PriorityBelowNormal ProcessPriority = "below_normal"
+	// PriorityIdle Unix 上 nice 值为 19, Windows 上为 IDLE_PRIORITY_CLASS, 只在系统空闲时运行
+	PriorityIdle ProcessPriority = "idle"
+)
+
+// priorityRank 优先级从高到低的顺序, 会话只能使用不高于服务端 priority 的优先级
+var priorityRank = map[ProcessPriority]int{PriorityNormal: 0, PriorityBelowNormal: 1, PriorityIdle: 2}
+
+// parsePriority 检查优先级, 为空时返回 fallback
+func parsePriority(priority, fallback ProcessPriority) (ProcessPriority, error) {
+	if priority == "" {
+		return fallback, nil
+	}
+	if _, ok := priorityRank[priority]; !ok {
+		return "", fmt.Errorf("priority must be %s, %s or %s", PriorityNormal, PriorityBelowNormal, PriorityIdle)
+	}
+	return priority, nil
+}
+
+// sessionPriority 返回会话的优先级, 请求的优先级不能高于服务端的 priority
+func sessionPriority(requested, server ProcessPriority) (ProcessPriority, error) {
+	priority, err := parsePriority(requested, server)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidOptions, err)
+	}
+	if priorityRank[priority] < priorityRank[server] {
+		return "", fmt.Errorf("%w: priority %s is higher than the server priority %s", errInvalidOptions, priority, server)
+	}
+	return priority, nil
+}
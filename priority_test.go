@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSessionPriority(t *testing.T) {
+	tests := []struct {
+		requested, server ProcessPriority
+		want              ProcessPriority
+		ok                bool
+	}{
+		{"", PriorityNormal, PriorityNormal, true},
+		// 为空时使用服务端的 priority
+		{"", PriorityIdle, PriorityIdle, true},
+		{PriorityBelowNormal, PriorityNormal, PriorityBelowNormal, true},
+		{PriorityIdle, PriorityBelowNormal, PriorityIdle, true},
+		// 不能高于服务端的 priority
+		{PriorityNormal, PriorityBelowNormal, "", false},
+		{PriorityBelowNormal, PriorityIdle, "", false},
+		{"high", PriorityNormal, "", false},
+	}
+	for _, tt := range tests {
+		got, err := sessionPriority(tt.requested, tt.server)
+		if got != tt.want || (err == nil) != tt.ok || (err != nil && !errors.Is(err, errInvalidOptions)) {
+			t.Errorf("sessionPriority(%q, %q) = %q, %v", tt.requested, tt.server, got, err)
+		}
+	}
+}
+
+func TestSessionPriorityRequest(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Priority = PriorityBelowNormal
+	})
+	id := ts.startSession(aliceToken, map[string]any{"priority": "idle"})
+	if s, _ := sessionManager.GetSession(id); s.priority != PriorityIdle {
+		t.Fatalf("session priority = %q", s.priority)
+	}
+	id = ts.startSession(aliceToken, nil)
+	if s, _ := sessionManager.GetSession(id); s.priority != PriorityBelowNormal {
+		t.Fatalf("default session priority = %q", s.priority)
+	}
+
+	for _, priority := range []string{"normal", "fast"} {
+		resp, data := ts.post(aliceToken, "/start-session", map[string]any{"priority": priority})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("start with priority %s = %d %s", priority, resp.StatusCode, data)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Priority = "realtime"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("invalid priority accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.LogCommands = true
+		cfg.MaxCommandsPerSession = 1
+	})
+	var audit bytes.Buffer
+	auditLog = NewAuditLog(&audit, nil)
+	t.Cleanup(func() { auditLog = nil })
+
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	lastUsed := s.LastUsed()
+	time.Sleep(2 * lastUsedResolution)
+
+	var resp *http.Response
+	var data []byte
+	logs := captureLogs(func() {
+		resp, data = ts.run(aliceToken, id, "echo alive", map[string]any{"probe": true})
+	})
+	if resp.StatusCode != http.StatusOK || string(data) != "alive" {
+		t.Fatalf("probe = %d %q", resp.StatusCode, data)
+	}
+	// 探测命令不写入命令日志和审计日志, 不计入命令数, 也不更新最近使用时间
+	if strings.Contains(logs, "echo alive") || strings.Contains(logs, "Output length") {
+		t.Fatalf("probe logged:\n%s", logs)
+	}
+	if audit.Len() != 0 {
+		t.Fatalf("probe audited: %s", audit.String())
+	}
+	if !s.LastUsed().Equal(lastUsed) {
+		t.Fatalf("last used moved from %s to %s", lastUsed, s.LastUsed())
+	}
+	if _, status := ts.sessionStatus(aliceToken, id); status.CommandsRemaining == nil || *status.CommandsRemaining != 1 {
+		t.Fatalf("remaining after probe = %v", status.CommandsRemaining)
+	}
+
+	// 普通命令照常记录
+	logs = captureLogs(func() { ts.run(aliceToken, id, "echo real", nil) })
+	if !strings.Contains(logs, "echo real") || audit.Len() == 0 {
+		t.Fatalf("regular command not recorded, logs:\n%s", logs)
+	}
+	if s.LastUsed().Equal(lastUsed) {
+		t.Fatal("regular command did not update last used")
+	}
+}
+
+func TestProbeRejectsSideEffects(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	for _, opt := range []string{"output_to_file", "record_init"} {
+		resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"probe": true, opt: true})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("probe with %s = %d %s", opt, resp.StatusCode, data)
+		}
+	}
+}
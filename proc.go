@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ProcessLimits 会话进程树的资源限制, 0 表示不限制
+// Windows 上通过 Job Object 由系统强制执行, 其他平台暂不支持
+type ProcessLimits struct {
+	// MaxMemoryMB 会话所有进程的内存总和上限(MB)
+	MaxMemoryMB int `json:"max_memory_mb"`
+	// MaxProcesses 会话中同时存在的进程数上限, 包括 shell 本身
+	MaxProcesses int `json:"max_processes"`
+}
+
+func (l ProcessLimits) validate() error {
+	if l.MaxMemoryMB < 0 || l.MaxProcesses < 0 {
+		return fmt.Errorf("%w: process limits must not be negative", errInvalidOptions)
+	}
+	return nil
+}
+
+func (l ProcessLimits) isZero() bool {
+	return l.MaxMemoryMB == 0 && l.MaxProcesses == 0
+}
+
+// processUsage 进程树的资源使用快照
+type processUsage struct {
+	// cpu 进程树累计使用的 CPU 时间(用户态和内核态)
+	cpu time.Duration
+	// memory 进程树当前的内存占用(工作集或 RSS 之和)
+	memory uint64
+}
+
+const (
+	// processTreeWait 结束进程树后等待其退出的最长时间
+	processTreeWait = 3 * time.Second
+	// defaultEndGracePeriod 结束会话时默认等待 shell 自行退出的时间
+	defaultEndGracePeriod = 5 * time.Second
+)
+
+// exitGracefully 向 shell 发送 exit 并等待其在 grace 内退出, 调用方需持有 s.mu
+// 正在执行的命令不会被打断, 超时后由调用方强制结束
+func (s *Session) exitGracefully(grace time.Duration) bool {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	exit := "exit\n"
+	if s.shell.Type == ShellPowerShell && len(s.subShells) > 0 {
+		exit = psCloseAllSubShells + "; " + exit
+	}
+	if s.options.Remote != nil {
+		exit = psRemoveRemote + "; " + exit
+	}
+	if err := writeWithTimeout(s.Stdin, []byte(exit), grace); err != nil {
+		log.Printf("⚠ Failed to send exit | SessionID: %s | Error: %v", s.ID, err)
+		return false
+	}
+
+	select {
+	case <-s.exited:
+		return true
+	case <-timer.C:
+		log.Printf("⚠ Shell did not exit within grace period | SessionID: %s | Grace: %s", s.ID, grace)
+		return false
+	}
+}
+
+// killProcessTree 结束进程组中的所有进程并短暂等待其退出, 记录未能结束的进程
+func killProcessTree(sessionID string, group processTree) {
+	if err := group.kill(); err != nil {
+		log.Printf("⚠ Failed to kill process tree | SessionID: %s | Error: %v", sessionID, err)
+	}
+
+	deadline := time.Now().Add(processTreeWait)
+	for {
+		pids, err := group.remaining()
+		if err != nil {
+			log.Printf("⚠ Failed to check process tree | SessionID: %s | Error: %v", sessionID, err)
+			return
+		}
+		if len(pids) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("⚠ Processes still running after kill | SessionID: %s | PIDs: %v", sessionID, pids)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
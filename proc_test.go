@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProcessLimitsValidate(t *testing.T) {
+	for _, tt := range []struct {
+		limits ProcessLimits
+		ok     bool
+	}{
+		{ProcessLimits{}, true},
+		{ProcessLimits{MaxMemoryMB: 512, MaxProcesses: 16}, true},
+		{ProcessLimits{MaxMemoryMB: -1}, false},
+		{ProcessLimits{MaxProcesses: -1}, false},
+	} {
+		if err := tt.limits.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok %t", tt.limits, err, tt.ok)
+		}
+	}
+}
+
+func TestStartSessionWithLimits(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"limits": map[string]any{"max_memory_mb": 256, "max_processes": 8}})
+	if s, _ := sessionManager.GetSession(id); s.limits != (ProcessLimits{MaxMemoryMB: 256, MaxProcesses: 8}) {
+		t.Fatalf("session limits = %+v", s.limits)
+	}
+
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"limits": map[string]any{"max_processes": -1}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("negative limits = %d %s", resp.StatusCode, data)
+	}
+}
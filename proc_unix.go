@@ -0,0 +1,162 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processGroup 通过进程组管理 shell 及其所有子进程
+type processGroup struct {
+	pgid int
+}
+
+// prepareProcess 让 shell 成为新进程组的组长, 子进程默认继承该进程组
+func prepareProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// newProcessGroup 记录进程组, 资源限制仅在 Windows 上支持
+func newProcessGroup(cmd *exec.Cmd, limits ProcessLimits) (*processGroup, error) {
+	if !limits.isZero() {
+		log.Printf("⚠ Process limits are only enforced on Windows | PID: %d", cmd.Process.Pid)
+	}
+	return &processGroup{pgid: cmd.Process.Pid}, nil
+}
+
+// priorityNice 各优先级对应的 nice 值
+var priorityNice = map[ProcessPriority]int{PriorityBelowNormal: 10, PriorityIdle: 19}
+
+// setPriority 在 shell 启动后设置其 nice 值, 之后启动的子进程继承该值; normal 时不修改
+func setPriority(pid int, priority ProcessPriority) error {
+	nice, ok := priorityNice[priority]
+	if !ok {
+		return nil
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		return fmt.Errorf("failed to set priority %s: %v", priority, err)
+	}
+	return nil
+}
+
+// kill 结束进程组中的所有进程
+func (g *processGroup) kill() error {
+	err := syscall.Kill(-g.pgid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// killChildren 结束进程组中除 shell 以外的进程, shell 本身继续运行
+// 需要 /proc 列出进程, 没有时返回错误
+func (g *processGroup) killChildren() error {
+	stats, err := g.procStats()
+	if err != nil {
+		return fmt.Errorf("failed to list processes: %v", err)
+	}
+	for pid := range stats {
+		if pid == g.pgid {
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+// remaining 返回进程组中仍存在的进程
+// 有 /proc 时列出具体进程, 否则只能判断进程组是否还存在
+func (g *processGroup) remaining() ([]int, error) {
+	stats, err := g.procStats()
+	if err != nil {
+		if err := syscall.Kill(-g.pgid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil, nil
+		}
+		return []int{g.pgid}, nil
+	}
+
+	pids := make([]int, 0, len(stats))
+	for pid := range stats {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// procStats 从 /proc 读取进程组中各进程 stat 中 comm 之后的字段, 已退出等待回收的僵尸进程不算
+func (g *processGroup) procStats() (map[int][]string, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[int][]string)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// 格式为 "pid (comm) state ppid pgrp ...", comm 中可能包含空格和括号
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) >= 3 && fields[0] != "Z" && fields[2] == strconv.Itoa(g.pgid) {
+			stats[pid] = fields
+		}
+	}
+	return stats, nil
+}
+
+// userHZ /proc 中 CPU 时间的单位, Linux 对用户空间固定为每秒 100
+const userHZ = 100
+
+// usage 统计进程组的 CPU 时间和 RSS 之和
+// CPU 时间包括各进程自身的 utime、stime 和已被其回收的子进程的 cutime、cstime,
+// 被 init 回收的孤儿进程的 CPU 时间无法统计; 没有 /proc 的平台返回错误
+func (g *processGroup) usage() (processUsage, error) {
+	stats, err := g.procStats()
+	if err != nil {
+		return processUsage{}, fmt.Errorf("failed to read process stats: %v", err)
+	}
+
+	var u processUsage
+	var ticks int64
+	pageSize := uint64(os.Getpagesize())
+	for _, fields := range stats {
+		// fields[11:15] 为 utime stime cutime cstime, fields[21] 为 rss(页数)
+		if len(fields) < 22 {
+			continue
+		}
+		for _, f := range fields[11:15] {
+			n, _ := strconv.ParseInt(f, 10, 64)
+			ticks += n
+		}
+		if rss, err := strconv.ParseUint(fields[21], 10, 64); err == nil {
+			u.memory += rss * pageSize
+		}
+	}
+	u.cpu = time.Duration(ticks) * time.Second / userHZ
+	return u, nil
+}
+
+// release 进程组不需要释放资源
+func (g *processGroup) release() {}
@@ -0,0 +1,187 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startProcessGroup 启动 sh 执行 script, sh 为新进程组的组长
+func startProcessGroup(t *testing.T, script string) (*exec.Cmd, *processGroup) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	cmd := exec.Command("sh", "-c", script)
+	prepareProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	group, err := newProcessGroup(cmd, ProcessLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		group.kill()
+		cmd.Wait()
+	})
+	return cmd, group
+}
+
+// waitRemaining 等待进程组中的进程数满足 ok
+func waitRemaining(t *testing.T, group *processGroup, ok func(n int) bool) []int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pids, err := group.remaining()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok(len(pids)) {
+			return pids
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process group still has %d processes: %v", len(pids), pids)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestProcessGroupKillsWholeTree(t *testing.T) {
+	cmd, group := startProcessGroup(t, "sleep 30 & sleep 30 & wait")
+	waitRemaining(t, group, func(n int) bool { return n >= 3 })
+
+	killProcessTree("test", group)
+	cmd.Wait()
+	waitRemaining(t, group, func(n int) bool { return n == 0 })
+}
+
+func TestProcessGroupKillChildrenKeepsShell(t *testing.T) {
+	cmd, group := startProcessGroup(t, "sleep 30 & sleep 30 & while true; do sleep 1; done")
+	waitRemaining(t, group, func(n int) bool { return n >= 3 })
+
+	if err := group.killChildren(); err != nil {
+		t.Fatal(err)
+	}
+	// shell 本身保留, 循环中的 sleep 之后会重新启动
+	pids := waitRemaining(t, group, func(n int) bool { return n <= 2 })
+	found := false
+	for _, pid := range pids {
+		found = found || pid == cmd.Process.Pid
+	}
+	if !found {
+		t.Fatalf("shell %d was killed, remaining %v", cmd.Process.Pid, pids)
+	}
+}
+
+func TestProcessGroupUsage(t *testing.T) {
+	_, group := startProcessGroup(t, "sleep 30")
+	waitRemaining(t, group, func(n int) bool { return n >= 1 })
+	u, err := group.usage()
+	if err != nil {
+		t.Skipf("usage not available: %v", err)
+	}
+	if u.memory == 0 {
+		t.Fatal("usage reports no memory for a running process group")
+	}
+}
+
+// processAlive 进程是否存在且没有退出
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	i := bytes.LastIndexByte(stat, ')')
+	return i < 0 || !bytes.HasPrefix(bytes.TrimSpace(stat[i+1:]), []byte("Z"))
+}
+
+func TestEndSessionKillsBackgroundProcesses(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.EndGracePeriod = Duration(200 * time.Millisecond)
+	})
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+
+	// 后台进程忽略 shell 退出时的 SIGHUP, 只有结束整个进程组才能结束它
+	resp, data := ts.run(aliceToken, id, "nohup sleep 60 >/dev/null 2>&1 & echo $!", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("run = %d %s", resp.StatusCode, data)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || !processAlive(pid) {
+		t.Fatalf("background process %q not running", data)
+	}
+
+	resp, data = ts.post(aliceToken, "/end-session", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("end-session = %d %s", resp.StatusCode, data)
+	}
+	// EndSession 返回前已等待进程树退出
+	if processAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatalf("background process %d survived EndSession", pid)
+	}
+}
+
+func TestReportUsageCPUBurn(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	s, _ := sessionManager.GetSession(id)
+	if _, err := s.group.usage(); err != nil {
+		t.Skipf("usage not available: %v", err)
+	}
+
+	// 空循环计数的子进程, 最多运行 1 秒
+	burn := `end=$((SECONDS+1)); i=0; while [ $SECONDS -lt $end ] && [ $i -lt 300000 ]; do i=$((i+1)); done; echo $i`
+	resp, data := ts.run(aliceToken, id, "bash -c '"+burn+"'", map[string]any{"report_usage": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("run = %d %s", resp.StatusCode, data)
+	}
+	cpu, err := strconv.ParseInt(resp.Header.Get("X-CPU-Ms"), 10, 64)
+	if err != nil || cpu <= 0 {
+		t.Fatalf("X-CPU-Ms = %q for a CPU-bound command", resp.Header.Get("X-CPU-Ms"))
+	}
+	if peak, _ := strconv.ParseUint(resp.Header.Get("X-Peak-Memory-Bytes"), 10, 64); peak == 0 {
+		t.Fatalf("X-Peak-Memory-Bytes = %q", resp.Header.Get("X-Peak-Memory-Bytes"))
+	}
+}
+
+func TestSessionPriorityNice(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	if _, err := exec.LookPath("nice"); err != nil {
+		t.Skip("nice is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	// shell 启动的命令继承 shell 的 nice 值
+	for priority, want := range map[string]string{"below_normal": "10", "idle": "19"} {
+		id := ts.startSession(aliceToken, map[string]any{"shell": "bash", "priority": priority})
+		resp, data := ts.run(aliceToken, id, "nice", nil)
+		if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != want {
+			t.Errorf("nice with priority %s = %d %q, want %s", priority, resp.StatusCode, data, want)
+		}
+		ts.endSession(aliceToken, id)
+	}
+}
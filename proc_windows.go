@@ -0,0 +1,201 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// processGroup 通过 Job Object 管理 shell 及其所有子进程
+type processGroup struct {
+	job windows.Handle
+	pid int
+}
+
+// jobProcessIDList 对应 JOBOBJECT_BASIC_PROCESS_ID_LIST, 只取前 64 个进程
+type jobProcessIDList struct {
+	NumberOfAssignedProcesses uint32
+	NumberOfProcessIdsInList  uint32
+	ProcessIdList             [64]uintptr
+}
+
+// prepareProcess 在进程启动前设置属性
+func prepareProcess(cmd *exec.Cmd) {}
+
+// newProcessGroup 将已启动的进程加入新建的 Job Object 并应用资源限制
+// 进程之后创建的子进程会自动加入同一个 Job Object
+func newProcessGroup(cmd *exec.Cmd, limits ProcessLimits) (*processGroup, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job object: %v", err)
+	}
+
+	var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	// 关闭 Job Object 句柄时结束其中所有进程, 服务退出后也不会遗留进程
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if limits.MaxProcesses > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_ACTIVE_PROCESS
+		info.BasicLimitInformation.ActiveProcessLimit = uint32(limits.MaxProcesses)
+	}
+	if limits.MaxMemoryMB > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		info.JobMemoryLimit = uintptr(limits.MaxMemoryMB) * 1024 * 1024
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to set job object limits: %v", err)
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to open process: %v", err)
+	}
+	defer windows.CloseHandle(process)
+
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to assign process to job object: %v", err)
+	}
+	return &processGroup{job: job, pid: cmd.Process.Pid}, nil
+}
+
+// priorityClass 各优先级对应的优先级类
+var priorityClass = map[ProcessPriority]uint32{PriorityBelowNormal: windows.BELOW_NORMAL_PRIORITY_CLASS, PriorityIdle: windows.IDLE_PRIORITY_CLASS}
+
+// setPriority 在 shell 启动后设置其优先级类, 低于正常的优先级类会被子进程继承; normal 时不修改
+func setPriority(pid int, priority ProcessPriority) error {
+	class, ok := priorityClass[priority]
+	if !ok {
+		return nil
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return fmt.Errorf("failed to open process: %v", err)
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.SetPriorityClass(process, class); err != nil {
+		return fmt.Errorf("failed to set priority %s: %v", priority, err)
+	}
+	return nil
+}
+
+// kill 结束 Job Object 中的所有进程, 失败时退回到 taskkill /T 结束进程树
+func (g *processGroup) kill() error {
+	err := windows.TerminateJobObject(g.job, 1)
+	if err == nil {
+		return nil
+	}
+	if out, tkErr := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(g.pid)).CombinedOutput(); tkErr != nil {
+		return fmt.Errorf("terminate job object: %v; taskkill: %v: %s", err, tkErr, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// killChildren 结束 Job Object 中除 shell 以外的进程, shell 本身继续运行
+// 已退出的进程打开失败, 直接跳过
+func (g *processGroup) killChildren() error {
+	pids, err := g.remaining()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if pid == g.pid {
+			continue
+		}
+		process, err := windows.OpenProcess(windows.PROCESS_TERMINATE, false, uint32(pid))
+		if err != nil {
+			continue
+		}
+		err = windows.TerminateProcess(process, 1)
+		windows.CloseHandle(process)
+		if err != nil {
+			return fmt.Errorf("failed to terminate process %d: %v", pid, err)
+		}
+	}
+	return nil
+}
+
+// remaining 返回 Job Object 中仍在运行的进程
+func (g *processGroup) remaining() ([]int, error) {
+	var list jobProcessIDList
+	err := windows.QueryInformationJobObject(g.job, windows.JobObjectBasicProcessIdList, uintptr(unsafe.Pointer(&list)), uint32(unsafe.Sizeof(list)), nil)
+	if err != nil && err != windows.ERROR_MORE_DATA {
+		return nil, fmt.Errorf("failed to query job object: %v", err)
+	}
+
+	pids := make([]int, 0, list.NumberOfProcessIdsInList)
+	for i := uint32(0); i < list.NumberOfProcessIdsInList && i < uint32(len(list.ProcessIdList)); i++ {
+		pids = append(pids, int(list.ProcessIdList[i]))
+	}
+	return pids, nil
+}
+
+// release 释放 Job Object 句柄
+func (g *processGroup) release() {
+	windows.CloseHandle(g.job)
+}
+
+// jobAccountingInfo 对应 JOBOBJECT_BASIC_ACCOUNTING_INFORMATION, 时间单位为 100 纳秒
+type jobAccountingInfo struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
+// processMemoryCounters 对应 PROCESS_MEMORY_COUNTERS
+type processMemoryCounters struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+var procGetProcessMemoryInfo = windows.NewLazySystemDLL("kernel32.dll").NewProc("K32GetProcessMemoryInfo")
+
+// usage 统计 Job Object 的 CPU 时间和其中进程的工作集之和
+// CPU 时间由系统记账, 包括已退出的进程; 工作集只统计前 64 个进程
+func (g *processGroup) usage() (processUsage, error) {
+	var info jobAccountingInfo
+	err := windows.QueryInformationJobObject(g.job, windows.JobObjectBasicAccountingInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil)
+	if err != nil {
+		return processUsage{}, fmt.Errorf("failed to query job accounting: %v", err)
+	}
+	u := processUsage{cpu: time.Duration(info.TotalUserTime+info.TotalKernelTime) * 100}
+
+	pids, err := g.remaining()
+	if err != nil {
+		return processUsage{}, err
+	}
+	for _, pid := range pids {
+		process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+		if err != nil {
+			continue
+		}
+		counters := processMemoryCounters{CB: uint32(unsafe.Sizeof(processMemoryCounters{}))}
+		r, _, _ := procGetProcessMemoryInfo.Call(uintptr(process), uintptr(unsafe.Pointer(&counters)), uintptr(counters.CB))
+		windows.CloseHandle(process)
+		if r != 0 {
+			u.memory += uint64(counters.WorkingSetSize)
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// errReadGuardSaturated 等待 shell 输出的命令数已达上限
+// 通常说明大量 shell 已无响应, 是整体故障的征兆, 继续接受命令只会堆积更多等待的 goroutine
+var errReadGuardSaturated = errors.New("too many commands waiting for shell output, server is unhealthy")
+
+// ReadGuard 限制整个服务同时等待 shell 输出的命令数
+// 与 CommandLimiter 不同, 达到上限时不排队, 直接拒绝新命令
+type ReadGuard struct {
+	// limit 上限, 0 表示不限制
+	limit int64
+
+	blocked  atomic.Int64
+	rejected atomic.Int64
+}
+
+func NewReadGuard(limit int) *ReadGuard {
+	return &ReadGuard{limit: int64(limit)}
+}
+
+// Enter 开始等待输出前调用, 返回 false 时不能执行命令, 返回 true 时调用方需调用 Exit
+func (g *ReadGuard) Enter() bool {
+	n := g.blocked.Add(1)
+	if g.limit > 0 && n > g.limit {
+		g.blocked.Add(-1)
+		g.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// Exit 结束等待输出
+func (g *ReadGuard) Exit() {
+	g.blocked.Add(-1)
+}
+
+// Blocked 正在等待 shell 输出的命令数
+func (g *ReadGuard) Blocked() int64 {
+	return g.blocked.Load()
+}
+
+// Rejected 因达到上限被拒绝的命令总数
+func (g *ReadGuard) Rejected() int64 {
+	return g.rejected.Load()
+}
+
+var readGuard *ReadGuard
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadGuard(t *testing.T) {
+	g := NewReadGuard(2)
+	if !g.Enter() || !g.Enter() {
+		t.Fatal("enter below the limit refused")
+	}
+	if g.Enter() {
+		t.Fatal("enter over the limit accepted")
+	}
+	if g.Blocked() != 2 || g.Rejected() != 1 {
+		t.Fatalf("blocked %d, rejected %d", g.Blocked(), g.Rejected())
+	}
+	g.Exit()
+	if !g.Enter() {
+		t.Fatal("enter after exit refused")
+	}
+
+	unlimited := NewReadGuard(0)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.Enter() {
+			t.Fatal("unlimited guard refused")
+		}
+	}
+}
+
+func TestReadGuardTripsOnStuckReads(t *testing.T) {
+	const limit = 3
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxBlockedReads = limit
+		// 长时间没有结束标记, 模拟已无响应的 shell
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 10000}}
+	})
+	other := ts.startSession(bobToken, nil)
+	var stuck []string
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		id := ts.startSession(aliceToken, nil)
+		stuck = append(stuck, id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.run(aliceToken, id, "Hang", nil)
+		}()
+	}
+	waitFor(t, func() bool { return readGuard.Blocked() == limit })
+
+	// 其他会话中的新命令被拒绝, 不再堆积等待的 goroutine
+	resp, data := ts.run(bobToken, other, "echo hi", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeServerUnhealthy {
+		t.Fatalf("run with saturated guard = %d %s", resp.StatusCode, data)
+	}
+	_, data = ts.do(http.MethodGet, adminToken, "/metrics", nil)
+	for _, metric := range []string{"rce_blocked_reads 3\n", "rce_blocked_reads_rejected_total 1\n"} {
+		if !strings.Contains(string(data), metric) {
+			t.Errorf("metrics do not contain %q", metric)
+		}
+	}
+
+	// 结束无响应的会话后恢复
+	for _, id := range stuck {
+		sessionManager.EndSession(id, true)
+	}
+	wg.Wait()
+	if n := readGuard.Blocked(); n != 0 {
+		t.Fatalf("%d reads still blocked", n)
+	}
+	if resp, data = ts.run(bobToken, other, "echo hi", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+		t.Fatalf("run after recovery = %d %q", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultReadyTimeout 创建会话时等待 shell 就绪的默认时间
+const defaultReadyTimeout = 10 * time.Second
+
+// maxStartupOutput 启动失败时错误信息中附带的 stdout 和 stderr 各自的上限
+const maxStartupOutput = 4096
+
+// startupExitWait shell 在启动时退出后, 等待读完其 stderr 的时间
+const startupExitWait = time.Second
+
+// codeShellStartupFailed shell 启动时退出或初始化语句报错
+const codeShellStartupFailed = "shell_startup_failed"
+
+var (
+	// errShellNotReady shell 在 ready_timeout 内没有执行完就绪检查命令, 会话未创建
+	errShellNotReady = errors.New("shell did not become ready")
+	// errShellStartup shell 在就绪前退出, 或启动时写入的初始化语句报错, 会话未创建
+	errShellStartup = errors.New("shell failed to start")
+)
+
+// readyCommand 就绪检查使用的命令, 正常启动时没有输出
+// PowerShell 输出启动期间记录在 $Error 中的错误, 如受限主机上编码设置失败
+func readyCommand(shellType ShellType) string {
+	switch shellType {
+	case ShellBash:
+		return ":"
+	case ShellCmd:
+		return "cd ."
+	default:
+		return "$Error | ForEach-Object { $_.ToString() }"
+	}
+}
+
+// startupCapture 保存 shell 启动期间 stderr 的开头部分, 就绪检查结束后不再保存
+type startupCapture struct {
+	mu      sync.Mutex
+	buf     []byte
+	stopped bool
+	// eof stderr 读到结尾(shell 已退出)时关闭
+	eof chan struct{}
+}
+
+func newStartupCapture() *startupCapture {
+	return &startupCapture{eof: make(chan struct{})}
+}
+
+// Write 实现 io.Writer, 超过上限的部分丢弃, 不返回错误
+func (c *startupCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped {
+		if room := maxStartupOutput - len(c.buf); room > 0 {
+			c.buf = append(c.buf, p[:min(len(p), room)]...)
+		}
+	}
+	return len(p), nil
+}
+
+// stop 停止保存并释放已保存的内容
+func (c *startupCapture) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.buf = nil
+	c.mu.Unlock()
+}
+
+// exited 等待最多 wait, 返回 stderr 是否已读到结尾, 即 shell 是否已退出
+func (c *startupCapture) exited(wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-c.eof:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// text 已保存的内容
+func (c *startupCapture) text() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.TrimSpace(string(c.buf))
+}
+
+// waitReady 执行就绪检查命令并等到其结束标记, 此时 shell 已执行完启动时写入的编码设置等初始化语句,
+// 启动过程中的输出(如 profile 的输出)也已被跳过; timeout 为 0 时不检查
+// shell 在就绪前退出或初始化语句报错时返回 errShellStartup, 错误信息附带启动期间的 stdout 和 stderr
+// 调用方在会话对客户端可见之前调用, 第一条客户端命令因此不会与初始化交错
+func (s *Session) waitReady(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	defer s.startup.stop()
+	start := time.Now()
+	var out bytes.Buffer
+	// 就绪检查是启动的一部分, 不占用 max_concurrent_commands 的名额; local 检查外层 shell 本身的状态
+	// debug 保存结束标记之前的原始输出, 失败时附带在错误信息中
+	result, err := s.RunCommandTo(readyCommand(s.shell.Type), &out, RunOptions{Timeout: timeout, probe: true, holdsSlot: true, local: true, debug: true})
+	if err != nil {
+		// stdout 关闭或写入 stdin 失败通常是 shell 已退出, 超时时 shell 仍在运行, 不再等待
+		wait := startupExitWait
+		if errors.Is(err, errCommandTimeout) {
+			wait = 0
+		}
+		if s.startup.exited(wait) {
+			details := s.startupDetails(result)
+			log.Printf("✗ Shell exited during startup | SessionID: %s | Error: %v", s.ID, err)
+			return fmt.Errorf("%w: shell exited during startup%s", errShellStartup, details)
+		}
+		log.Printf("✗ Shell not ready | SessionID: %s | Timeout: %s | Error: %v", s.ID, timeout, err)
+		return fmt.Errorf("%w within %s: %v%s", errShellNotReady, timeout, err, s.startupDetails(result))
+	}
+	if reported := strings.TrimSpace(out.String()); reported != "" {
+		log.Printf("✗ Shell initialization failed | SessionID: %s | Error: %q", s.ID, reported)
+		return fmt.Errorf("%w: initialization reported errors: %s", errShellStartup, truncateStartup(reported))
+	}
+	log.Printf("✓ Shell ready | SessionID: %s | Duration: %s", s.ID, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// startupDetails 拼接启动期间的 stdout 和 stderr, 都为空时返回空字符串
+// stdout 为就绪检查的开始标记之前的原始输出, 加上 shell 退出后尚未读取的输出
+func (s *Session) startupDetails(result *CommandResult) string {
+	var raw []byte
+	if result != nil && result.Debug != nil {
+		raw, _ = base64.StdEncoding.DecodeString(result.Debug.RawBase64)
+		if i := bytes.Index(raw, []byte(beginMarkerPrefix+result.Debug.Marker)); i >= 0 {
+			raw = raw[:i]
+		}
+	}
+	raw = append(raw, s.pendingOutput(maxStartupOutput-len(raw))...)
+	var details string
+	if stdout := strings.TrimSpace(string(raw)); stdout != "" {
+		details += "; stdout: " + truncateStartup(stdout)
+	}
+	if stderr := s.startup.text(); stderr != "" {
+		details += "; stderr: " + stderr
+	}
+	return details
+}
+
+// pendingOutput 读取已到达但尚未被命令读取的输出, 最多 limit 字节, 在输出关闭或短时间内没有新输出时返回
+func (s *Session) pendingOutput(limit int) []byte {
+	var pending []byte
+	for len(pending) < limit {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				return pending
+			}
+			pending = append(pending, chunk[:min(len(chunk), limit-len(pending))]...)
+		case <-time.After(100 * time.Millisecond):
+			return pending
+		}
+	}
+	return pending
+}
+
+// truncateStartup 截断过长的启动输出
+func truncateStartup(text string) string {
+	if len(text) > maxStartupOutput {
+		return text[:maxStartupOutput] + "..."
+	}
+	return text
+}
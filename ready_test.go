@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionWaitsForReady(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ReadyTimeout = Duration(2 * time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{":": {DelayMs: 200}}
+	})
+	// 就绪检查结束之后才返回会话
+	start := time.Now()
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("session returned after %s, before the shell was ready", elapsed)
+	}
+	if resp, data := ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+		t.Fatalf("first command = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestSessionNotReady(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ReadyTimeout = Duration(100 * time.Millisecond)
+		cfg.FakeOutputs = map[string]FakeOutput{":": {DelayMs: 5000}}
+	})
+	tracker := &trackingSpawner{fakeSpawner: fakeSpawner{outputs: ts.cfg.FakeOutputs}}
+	spawner = tracker
+
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash"})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellUnresponsive {
+		t.Fatalf("start = %d %s", resp.StatusCode, data)
+	}
+	// 未就绪的会话不保留, shell 已结束
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions counted", n)
+	}
+	if records, _ := sessionManager.Store.ListSessions(); len(records) != 0 {
+		t.Fatalf("%d session records left", len(records))
+	}
+	waitFor(t, func() bool { return tracker.alive() == 0 })
+}
+
+func TestReadyTimeoutDisabled(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ReadyTimeout = 0
+		cfg.FakeOutputs = map[string]FakeOutput{":": {DelayMs: 5000}}
+	})
+	// 为 0 时不执行就绪检查
+	start := time.Now()
+	ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("start waited %s with ready_timeout 0", elapsed)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ReadyTimeout = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("negative ready_timeout accepted")
+	}
+}
+
+func TestStartupCapture(t *testing.T) {
+	c := newStartupCapture()
+	// 超过上限的部分丢弃, 写入不返回错误
+	if n, err := c.Write([]byte(strings.Repeat("x", maxStartupOutput+10))); n != maxStartupOutput+10 || err != nil {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+	if got := c.text(); len(got) != maxStartupOutput {
+		t.Fatalf("captured %d bytes", len(got))
+	}
+	if c.exited(0) {
+		t.Fatal("exited before eof")
+	}
+	close(c.eof)
+	if !c.exited(time.Second) {
+		t.Fatal("not exited after eof")
+	}
+	// 停止后不再保存
+	c.stop()
+	c.Write([]byte("late"))
+	if got := c.text(); got != "" {
+		t.Fatalf("captured after stop: %q", got)
+	}
+	if got := truncateStartup(strings.Repeat("y", maxStartupOutput+1)); len(got) != maxStartupOutput+3 || !strings.HasSuffix(got, "...") {
+		t.Fatalf("truncated to %d bytes", len(got))
+	}
+}
+
+func TestSessionInitializationErrors(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ReadyTimeout = Duration(2 * time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{
+			readyCommand(ShellPowerShell): {Output: "Exception setting \"OutputEncoding\": \"The handle is invalid.\""},
+		}
+	})
+	// 就绪检查输出的 $Error 记录视为启动失败
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "pwsh"})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellStartupFailed || !strings.Contains(string(data), "The handle is invalid.") {
+		t.Fatalf("start = %d %s", resp.StatusCode, data)
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions counted", n)
+	}
+	// 其他 shell 的就绪检查没有输出
+	ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+}
+
+func TestShellExitsDuringStartup(t *testing.T) {
+	path, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not available")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ReadyTimeout = Duration(5 * time.Second)
+		cfg.Shells["broken"] = &ShellPreset{Type: ShellBash, Path: path, Args: []string{"--norc", "-c", "echo profile loaded; echo missing config >&2; exit 3"}}
+	})
+	spawner = execSpawner{}
+	// shell 在就绪前退出, 错误信息附带启动期间的 stdout 和 stderr
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "broken"})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellStartupFailed {
+		t.Fatalf("start = %d %s", resp.StatusCode, data)
+	}
+	if !strings.Contains(string(data), "stderr: missing config") || !strings.Contains(string(data), "stdout: profile loaded") {
+		t.Fatalf("startup details missing: %s", data)
+	}
+	// 不等到 ready_timeout
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatalf("start waited %s for an exited shell", elapsed)
+	}
+}
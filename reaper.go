@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIdleWarningRatio 未设置 idle_warning 时, 空闲达到 session_idle_timeout 的该比例时发出警告
+	defaultIdleWarningRatio = 0.8
+	// maxReapInterval 检查空闲会话的最长间隔
+	maxReapInterval = 30 * time.Second
+	// minReapInterval 检查空闲会话的最短间隔
+	minReapInterval = time.Second
+)
+
+// Reaper 定期结束空闲超过 timeout 的会话, 空闲达到 warning 时先发出一次警告
+// 正在执行命令的会话不计为空闲, 子 shell 中执行命令时内部轮询同样刷新最近使用时间
+type Reaper struct {
+	timeout time.Duration
+	warning time.Duration
+	// warned 已发出警告的会话及其当时的最近使用时间, 会话再次被使用后开始新的空闲周期
+	warned map[string]int64
+	mu     sync.Mutex
+}
+
+// NewReaper 创建空闲会话清理器, warning 为 0 时取 timeout 的 80%
+func NewReaper(timeout, warning time.Duration) *Reaper {
+	if warning == 0 {
+		warning = time.Duration(float64(timeout) * defaultIdleWarningRatio)
+	}
+	return &Reaper{timeout: timeout, warning: warning, warned: make(map[string]int64)}
+}
+
+// interval 检查间隔, 为超时时间的十分之一, 限制在 1 秒到 30 秒之间
+func (rp *Reaper) interval() time.Duration {
+	interval := rp.timeout / 10
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	return interval
+}
+
+// Run 按检查间隔循环清理, 不返回
+func (rp *Reaper) Run() {
+	ticker := time.NewTicker(rp.interval())
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rp.sweep(now)
+	}
+}
+
+// sweep 检查所有会话: 空闲超过 warning 的发出警告, 超过 timeout 的结束
+func (rp *Reaper) sweep(now time.Time) {
+	for _, session := range sessionManager.snapshot() {
+		if session.State() != stateRunning || session.current.Load() != nil {
+			continue
+		}
+		last := session.lastUsed.Load()
+		idle := now.Sub(time.Unix(0, last))
+		switch {
+		case idle >= rp.timeout:
+			rp.reap(session, idle)
+		case idle >= rp.warning:
+			rp.warn(session, last, rp.timeout-idle)
+		}
+	}
+	rp.forgetEnded()
+}
+
+// warn 在每个空闲周期中只发出一次警告
+func (rp *Reaper) warn(session *Session, last int64, remaining time.Duration) {
+	rp.mu.Lock()
+	if rp.warned[session.ID] == last {
+		rp.mu.Unlock()
+		return
+	}
+	rp.warned[session.ID] = last
+	rp.mu.Unlock()
+
+	remaining = remaining.Round(time.Second)
+	log.Printf("⚠ Session idle, will be ended soon | SessionID: %s | Remaining: %s", session.ID, remaining)
+	session.addEvent("idle_warning", "session will be ended for inactivity in "+remaining.String())
+	notifyIdleWarning(session.Owner, session.ID, remaining)
+}
+
+// reap 结束空闲会话, 检查之后开始的命令会先执行完再结束
+func (rp *Reaper) reap(session *Session, idle time.Duration) {
+	if session.current.Load() != nil {
+		return
+	}
+	log.Printf("→ Ending idle session | SessionID: %s | Idle: %s", session.ID, idle.Round(time.Second))
+	if err := sessionManager.EndSession(session.ID, false); err != nil {
+		// 期间已被其他请求结束
+		return
+	}
+	log.Printf("✓ Idle session ended | SessionID: %s", session.ID)
+}
+
+// forgetEnded 删除已结束会话的警告记录
+func (rp *Reaper) forgetEnded() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for id := range rp.warned {
+		if _, exists := sessionManager.GetSession(id); !exists {
+			delete(rp.warned, id)
+		}
+	}
+}
+
+// snapshot 返回当前所有会话, 不持有管理器的锁
+func (sm *SessionManager) snapshot() []*Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	sessions := make([]*Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReaperInterval(t *testing.T) {
+	for timeout, want := range map[time.Duration]time.Duration{
+		time.Second:      minReapInterval,
+		time.Minute:      6 * time.Second,
+		10 * time.Minute: maxReapInterval,
+	} {
+		if got := NewReaper(timeout, 0).interval(); got != want {
+			t.Errorf("interval for %s = %s, want %s", timeout, got, want)
+		}
+	}
+	if rp := NewReaper(10*time.Minute, 0); rp.warning != 8*time.Minute {
+		t.Errorf("default warning = %s", rp.warning)
+	}
+}
+
+// idleWarnings 返回会话的空闲警告事件数
+func idleWarnings(t *testing.T, id string) int {
+	t.Helper()
+	events, _ := sessionManager.Store.Events(id)
+	n := 0
+	for _, e := range events {
+		if e.Type == "idle_warning" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReaperWarnsOncePerIdlePeriod(t *testing.T) {
+	newTestServer(t, nil)
+	rp := NewReaper(10*time.Minute, 8*time.Minute)
+	s, err := sessionManager.CreateSession("alice", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := s.LastUsed()
+
+	rp.sweep(start.Add(7 * time.Minute))
+	if n := idleWarnings(t, s.ID); n != 0 {
+		t.Fatalf("%d warnings before idle_warning", n)
+	}
+	rp.sweep(start.Add(8 * time.Minute))
+	rp.sweep(start.Add(9 * time.Minute))
+	if n := idleWarnings(t, s.ID); n != 1 {
+		t.Fatalf("%d warnings in one idle period", n)
+	}
+
+	// 再次使用后开始新的空闲周期, 到期前重新警告
+	used := start.Add(9 * time.Minute)
+	s.touch(used)
+	rp.sweep(used.Add(9 * time.Minute))
+	if n := idleWarnings(t, s.ID); n != 2 {
+		t.Fatalf("%d warnings after reuse", n)
+	}
+
+	rp.sweep(used.Add(10 * time.Minute))
+	if _, exists := sessionManager.GetSession(s.ID); exists {
+		t.Fatal("idle session was not ended")
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if len(rp.warned) != 0 {
+		t.Fatalf("warnings of ended sessions kept: %v", rp.warned)
+	}
+}
+
+func TestReaperSkipsRunningCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 10000}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.run(aliceToken, id, "Hang", nil)
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	// 执行中的命令即使超过空闲时间也不结束会话
+	NewReaper(time.Minute, 0).sweep(time.Now().Add(time.Hour))
+	if _, exists := sessionManager.GetSession(id); !exists || idleWarnings(t, id) != 0 {
+		t.Fatal("session with a running command was reaped")
+	}
+	sessionManager.EndSession(id, true)
+	<-done
+}
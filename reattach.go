@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// OrphanedSession 客户端重新接管会话所需的信息
+type OrphanedSession struct {
+	SessionID string `json:"session_id"`
+	Shell     string `json:"shell"`
+	// Labels 创建会话时设置的标签, 客户端可用来识别会话的用途
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	// AgeSeconds 会话已存在的秒数
+	AgeSeconds int64     `json:"age_seconds"`
+	LastUsed   time.Time `json:"last_used"`
+	// IdleSeconds 距最近一条命令结束的秒数, 正在执行命令时为 0
+	IdleSeconds int64 `json:"idle_seconds"`
+	// LastCommand 最近一条执行完的命令, 还没有执行过时为空
+	LastCommand *CommandStatus `json:"last_command,omitempty"`
+	// Current 正在执行的命令
+	Current *CommandStatus `json:"current_command,omitempty"`
+	Running bool           `json:"running"`
+	Suspect bool           `json:"suspect"`
+}
+
+// orphanedSession 汇总会话的接管信息, 不获取 s.mu
+func (s *Session) orphanedSession(now time.Time) OrphanedSession {
+	info := OrphanedSession{
+		SessionID:   s.ID,
+		Shell:       s.ShellName,
+		Labels:      s.options.Labels,
+		CreatedAt:   s.CreatedAt,
+		AgeSeconds:  int64(now.Sub(s.CreatedAt) / time.Second),
+		LastUsed:    s.LastUsed(),
+		LastCommand: s.lastCommand.Load(),
+		Current:     s.current.Load(),
+		Running:     s.running.Load(),
+		Suspect:     s.suspect.Load(),
+	}
+	if info.Current == nil {
+		info.IdleSeconds = int64(now.Sub(info.LastUsed) / time.Second)
+	}
+	return info
+}
+
+// orphanedSessions 列出本进程中属于请求方租户、标签满足 selector 且空闲至少 minIdle 的会话
+// 只按租户匹配, 管理员也只看到自己创建的会话, 按创建时间排列
+func orphanedSessions(identity *Identity, selector labelSelector, minIdle time.Duration) []OrphanedSession {
+	now := time.Now()
+	sessions := make([]OrphanedSession, 0)
+	for _, session := range sessionManager.snapshot() {
+		if session.Owner != identity.Name || session.State() != stateRunning || !selector.matches(session.options.Labels) {
+			continue
+		}
+		info := session.orphanedSession(now)
+		if minIdle > 0 && (info.Current != nil || time.Duration(info.IdleSeconds)*time.Second < minIdle) {
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// ReattachRequest 重新接管会话的参数
+type ReattachRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// reattachSession 确认会话仍可使用并刷新最近使用时间, 空闲计时从此时重新开始
+func reattachSession(identity *Identity, req ReattachRequest) (*OrphanedSession, error) {
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, err
+	}
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists || session.State() != stateRunning {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+
+	session.touch(time.Now())
+	session.addEvent("reattached", "")
+	info := session.orphanedSession(time.Now())
+	log.Printf("✓ Session reattached | SessionID: %s | Owner: %s | Age: %ds | Idle: %ds", session.ID, identity.Name, info.AgeSeconds, info.IdleSeconds)
+	return &info, nil
+}
+
+// API29: 列出请求方租户的会话, 客户端重启后用于找回并重新接管
+func handleOrphanedSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	query := r.URL.Query()
+	selector, err := parseLabelSelector(query["label"])
+	if err != nil {
+		log.Printf("✗ Invalid label selector | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "%v", err))
+		return
+	}
+	var minIdle time.Duration
+	if v := query.Get("min_idle"); v != "" {
+		if minIdle, err = time.ParseDuration(v); err != nil || minIdle < 0 {
+			log.Printf("✗ Invalid min_idle | Value: %q", v)
+			writeError(w, newAPIError(http.StatusBadRequest, "invalid min_idle %q, use a duration such as 30s", v))
+			return
+		}
+	}
+
+	identity := identityFrom(r)
+	sessions := orphanedSessions(identity, selector, minIdle)
+	log.Printf("✓ Orphaned sessions listed | Owner: %s | Count: %d", identity.Name, len(sessions))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// API30: 重新接管会话
+func handleReattachSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req ReattachRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	resp, err := reattachSession(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
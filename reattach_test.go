@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// orphaned 以 token 列出租户的会话
+func (ts *testServer) orphaned(token, query string) (int, []OrphanedSession) {
+	ts.t.Helper()
+	resp, data := ts.do(http.MethodGet, token, "/orphaned-sessions"+query, nil)
+	var out struct {
+		Sessions []OrphanedSession `json:"sessions"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out.Sessions
+}
+
+func TestOrphanedSessions(t *testing.T) {
+	ts := newTestServer(t, nil)
+	first := ts.startSession(aliceToken, map[string]any{"labels": map[string]string{"app": "web"}})
+	second := ts.startSession(aliceToken, map[string]any{"labels": map[string]string{"app": "db"}})
+	ts.startSession(bobToken, nil)
+	ts.run(aliceToken, first, "echo hi", nil)
+
+	// 只列出请求方租户的会话, 按创建时间排列
+	status, sessions := ts.orphaned(aliceToken, "")
+	if status != http.StatusOK || len(sessions) != 2 || sessions[0].SessionID != first || sessions[1].SessionID != second {
+		t.Fatalf("list = %d %+v", status, sessions)
+	}
+	if last := sessions[0].LastCommand; last == nil || last.Command != "echo hi" || sessions[1].LastCommand != nil {
+		t.Fatalf("last command = %+v", sessions)
+	}
+	if sessions[0].Labels["app"] != "web" || !sessions[0].Running {
+		t.Fatalf("session info = %+v", sessions[0])
+	}
+	if _, sessions = ts.orphaned(aliceToken, "?label=app=db"); len(sessions) != 1 || sessions[0].SessionID != second {
+		t.Fatalf("label selector = %+v", sessions)
+	}
+
+	// min_idle 只列出空闲足够久的会话
+	s, _ := sessionManager.GetSession(second)
+	s.lastUsed.Store(time.Now().Add(-time.Hour).UnixNano())
+	if _, sessions = ts.orphaned(aliceToken, "?min_idle=30m"); len(sessions) != 1 || sessions[0].SessionID != second || sessions[0].IdleSeconds < 3600 {
+		t.Fatalf("min_idle = %+v", sessions)
+	}
+	for _, query := range []string{"?min_idle=soon", "?min_idle=-1s", "?label=="} {
+		if status, _ = ts.orphaned(aliceToken, query); status != http.StatusBadRequest {
+			t.Fatalf("%s = %d", query, status)
+		}
+	}
+}
+
+func TestReattachSession(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	s.lastUsed.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// 接管后空闲计时重新开始
+	resp, data := ts.post(aliceToken, "/reattach-session", map[string]any{"session_id": id})
+	var out OrphanedSession
+	decodeJSON(t, data, &out)
+	if resp.StatusCode != http.StatusOK || out.SessionID != id || out.IdleSeconds != 0 {
+		t.Fatalf("reattach = %d %s", resp.StatusCode, data)
+	}
+	if time.Since(s.LastUsed()) > time.Minute {
+		t.Fatalf("last used not refreshed: %s", s.LastUsed())
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "reattached" {
+		t.Fatalf("last event = %+v", last)
+	}
+
+	// 其他租户的会话和已结束的会话按不存在处理
+	if resp, data = ts.post(bobToken, "/reattach-session", map[string]any{"session_id": id}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cross-tenant reattach = %d %s", resp.StatusCode, data)
+	}
+	ts.endSession(aliceToken, id)
+	if resp, data = ts.post(aliceToken, "/reattach-session", map[string]any{"session_id": id}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("reattach ended session = %d %s", resp.StatusCode, data)
+	}
+}
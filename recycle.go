@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// RecycleAction 会话连续出错的命令数达到 recycle_after_errors 后的处理方式
+type RecycleAction string
+
+const (
+	// RecycleRestart 重启 shell 并重放初始化命令, 会话 ID 和环境变量不变(默认)
+	RecycleRestart RecycleAction = "restart"
+	// RecycleEnd 出错的命令返回后结束会话
+	RecycleEnd RecycleAction = "end"
+)
+
+// recycledHeader 命令返回后会话被回收时的响应头, 值为 restarted 或 ended
+const recycledHeader = "X-Session-Recycled"
+
+const (
+	// recycledRestarted 已重启 shell, 会话可以继续使用, 之前的 shell 状态已丢失
+	recycledRestarted = "restarted"
+	// recycledEnded 会话在后台结束, 客户端应创建新会话
+	recycledEnded = "ended"
+)
+
+// sessionsRecycled 因连续出错被回收的会话次数
+var sessionsRecycled atomic.Int64
+
+// parseRecycleAction 检查配置的处理方式, 为空时为 restart
+func parseRecycleAction(action string) (RecycleAction, error) {
+	switch RecycleAction(action) {
+	case "", RecycleRestart:
+		return RecycleRestart, nil
+	case RecycleEnd:
+		return RecycleEnd, nil
+	}
+	return "", fmt.Errorf("recycle_action must be %s or %s", RecycleRestart, RecycleEnd)
+}
+
+// unhealthyError 命令的错误是否说明 shell 可能处于异常状态
+// 超时、写入或读取输出失败计入; 退出码不为 0、解析器拒绝、取消和参数错误与 shell 状态无关, 不计入
+func unhealthyError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errIncompleteCommand), errors.Is(err, errSyntaxError):
+		return false
+	case errors.Is(err, errCommandCancelled), errors.Is(err, errCommandAborted):
+		return false
+	case errors.Is(err, errRunawayOutput):
+		// 已由输出监视重启 shell
+		return false
+	}
+	return true
+}
+
+// noteCommandResult 记录一条已发送给 shell 的客户端命令的结果, 调用方需持有 s.mu
+// 成功的命令清零连续出错数; 达到 recycle_after_errors 时按 recycleAction 回收会话并返回 recycledRestarted 或 recycledEnded
+// 重启后由调用方重放初始化命令
+func (s *Session) noteCommandResult(err error) string {
+	if s.recycleAfter == 0 {
+		return ""
+	}
+	if err == nil {
+		s.consecutiveErrors.Store(0)
+		return ""
+	}
+	if !unhealthyError(err) {
+		return ""
+	}
+	count := int(s.consecutiveErrors.Add(1))
+	if count < s.recycleAfter {
+		return ""
+	}
+	s.consecutiveErrors.Store(0)
+	sessionsRecycled.Add(1)
+	reason := fmt.Sprintf("%d consecutive errors, last: %v", count, err)
+	s.addEvent("recycled", reason)
+
+	if s.recycleAction == RecycleRestart {
+		log.Printf("⚠ Too many consecutive errors, restarting shell | SessionID: %s | Errors: %d", s.ID, count)
+		restartErr := s.restartShell("recycle: " + reason)
+		if restartErr == nil {
+			return recycledRestarted
+		}
+		log.Printf("✗ Failed to restart shell, ending session | SessionID: %s | Error: %v", s.ID, restartErr)
+	} else {
+		log.Printf("⚠ Too many consecutive errors, ending session | SessionID: %s | Errors: %d", s.ID, count)
+	}
+	go func() {
+		if err := sessionManager.EndSession(s.ID, false); err == nil {
+			log.Printf("✓ Session ended after consecutive errors | SessionID: %s", s.ID)
+		}
+	}()
+	return recycledEnded
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUnhealthyError(t *testing.T) {
+	for _, err := range []error{errCommandTimeout, errOutputClosed, fmt.Errorf("failed to write command: %w", errors.New("broken pipe"))} {
+		if !unhealthyError(err) {
+			t.Errorf("%v not counted", err)
+		}
+	}
+	// 与 shell 状态无关的错误不计入
+	for _, err := range []error{nil, errSyntaxError, errIncompleteCommand, errCommandCancelled, errCommandAborted, errRunawayOutput} {
+		if unhealthyError(err) {
+			t.Errorf("%v counted", err)
+		}
+	}
+	if _, err := parseRecycleAction("reboot"); err == nil {
+		t.Fatal("invalid recycle_action accepted")
+	}
+}
+
+func TestRecycleRestartsShell(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RecycleAfterErrors = 2
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 5000}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo init"}})
+	s, _ := sessionManager.GetSession(id)
+	before := sessionsRecycled.Load()
+	timeout := map[string]any{"timeout_ms": 100}
+
+	// 成功的命令清零连续出错数
+	for _, command := range []string{"Hang", "echo ok", "Hang"} {
+		if resp, _ := ts.run(aliceToken, id, command, timeout); resp.Header.Get(recycledHeader) != "" {
+			t.Fatalf("%s recycled the session", command)
+		}
+	}
+	oldProc := s.proc
+	resp, data := ts.run(aliceToken, id, "Hang", timeout)
+	if resp.StatusCode != http.StatusGatewayTimeout || resp.Header.Get(recycledHeader) != recycledRestarted {
+		t.Fatalf("second consecutive timeout = %d %v %s", resp.StatusCode, resp.Header, data)
+	}
+	if s.proc == oldProc || sessionsRecycled.Load()-before != 1 {
+		t.Fatal("shell was not restarted")
+	}
+	// 会话 ID 不变, 可以继续使用
+	if resp, data = ts.run(aliceToken, id, "echo after", nil); resp.StatusCode != http.StatusOK || string(data) != "after" {
+		t.Fatalf("run after recycle = %d %q", resp.StatusCode, data)
+	}
+	events, _ := sessionManager.Store.Events(id)
+	found := false
+	for _, e := range events {
+		found = found || e.Type == "recycled"
+	}
+	if !found {
+		t.Fatalf("no recycled event: %+v", events)
+	}
+}
+
+func TestRecycleEndsSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RecycleAfterErrors = 1
+		cfg.RecycleAction = "end"
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 5000}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	// 第一次超时即结束会话
+	resp, data := ts.run(aliceToken, id, "Hang", map[string]any{"timeout_ms": 100})
+	if resp.Header.Get(recycledHeader) != recycledEnded {
+		t.Fatalf("timeout = %d %v %s", resp.StatusCode, resp.Header, data)
+	}
+	waitFor(t, func() bool {
+		_, exists := sessionManager.GetSession(id)
+		return !exists
+	})
+	if _, metrics := ts.do(http.MethodGet, adminToken, "/metrics", nil); !strings.Contains(string(metrics), "rce_sessions_recycled_total") {
+		t.Fatalf("metrics missing recycled sessions: %s", metrics)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// codeConfigInvalid 重新加载的配置文件无法读取或不合法, 当前配置不变
+const codeConfigInvalid = "config_invalid"
+
+// serverSettings 可在运行时重新加载的服务端配置, 创建后不再修改, 重新加载时整体替换
+// 每条命令开始执行时取一次快照, 执行期间重新加载不影响该命令
+type serverSettings struct {
+	// commandTimeout 新会话的命令超时, 同时是 /session-config 中 command_timeout_ms 的上限
+	commandTimeout time.Duration
+	// outputIdleTimeout 命令连续没有输出的最长时间, 0 表示不限制
+	outputIdleTimeout time.Duration
+	// sessionQueueTimeout 命令排队等待会话的最长时间, 0 表示不限制
+	sessionQueueTimeout time.Duration
+	// lateOutputDrain 客户端命令读到结束标记后继续丢弃输出的静默时长, 0 表示不等待
+	lateOutputDrain time.Duration
+	// sessionQuota 每个租户同时持有的会话数上限, 0 表示不限制, 令牌的 max_sessions 优先
+	sessionQuota int
+	// maxCommands、commandLimitAction、recycleAfterErrors 和 recycleAction 在创建会话时复制到会话中
+	maxCommands        int
+	commandLimitAction CommandLimitAction
+	recycleAfterErrors int
+	recycleAction      RecycleAction
+	// logCommands 是否记录每条命令的执行过程和输出, 为 false 时只记录失败和慢命令
+	logCommands bool
+	// slowCommandThreshold 执行时间达到该值的命令记录警告日志, 0 表示不记录
+	slowCommandThreshold time.Duration
+	// slowCommandMaxLength 慢命令日志中命令文本的最大长度(字节), 0 表示不截断
+	slowCommandMaxLength int
+	// outputRateLimit 命令输出速率上限(字节/秒), 0 表示不检查; outputRateWindow 为统计窗口
+	outputRateLimit  int
+	outputRateWindow time.Duration
+	// spoolThreshold 文本输出超过该字节数时转存到临时文件, 0 表示不转存
+	spoolThreshold int
+	// truncationNotice 输出被截断时附加的提示, 为空时不附加
+	truncationNotice string
+	// emptyOutput 服务端配置的 empty_output, 请求可以覆盖
+	emptyOutput EmptyOutputMode
+	// templates 命令模板; templatesOnly 为 true 时不允许执行自由格式的 command
+	templates     map[string]*CommandTemplate
+	templatesOnly bool
+	// shellOverrides 允许通过请求的 shell 参数使用的预设, 为空时不允许指定 shell
+	shellOverrides map[string]bool
+	// forwardHeaders 转发到命令环境变量的请求头, 键为规范化的请求头名称, 值为环境变量名
+	forwardHeaders map[string]string
+}
+
+// reloadableKeys 重新加载后立即生效的配置项, 与 serverSettings 对应; 其余配置项修改后需要重启服务
+var reloadableKeys = map[string]bool{
+	"command_timeout": true, "output_idle_timeout": true, "session_queue_timeout": true, "late_output_drain": true,
+	"max_sessions_per_token": true, "max_commands_per_session": true, "command_limit_action": true,
+	"recycle_after_errors": true, "recycle_action": true,
+	"log_commands": true, "slow_command_threshold": true, "slow_command_max_length": true,
+	"output_rate_limit": true, "output_rate_window": true, "spool_threshold": true,
+	"truncation_notice": true, "empty_output": true, "templates": true, "templates_only": true,
+	"shell_overrides": true, "forward_headers": true,
+}
+
+// liveSettings 当前生效的配置, 在 main 中加载配置后设置
+var liveSettings atomic.Pointer[serverSettings]
+
+// currentSettings 返回当前生效的配置快照
+func currentSettings() *serverSettings {
+	return liveSettings.Load()
+}
+
+func newServerSettings(cfg *Config) *serverSettings {
+	overrides := make(map[string]bool, len(cfg.ShellOverrides))
+	for _, name := range cfg.ShellOverrides {
+		overrides[name] = true
+	}
+	return &serverSettings{
+		commandTimeout:       time.Duration(cfg.CommandTimeout),
+		outputIdleTimeout:    time.Duration(cfg.OutputIdleTimeout),
+		sessionQueueTimeout:  time.Duration(cfg.SessionQueueTimeout),
+		lateOutputDrain:      time.Duration(cfg.LateOutputDrain),
+		sessionQuota:         cfg.MaxSessionsPerToken,
+		maxCommands:          cfg.MaxCommandsPerSession,
+		commandLimitAction:   CommandLimitAction(cfg.CommandLimitAction),
+		recycleAfterErrors:   cfg.RecycleAfterErrors,
+		recycleAction:        RecycleAction(cfg.RecycleAction),
+		logCommands:          cfg.LogCommands,
+		slowCommandThreshold: time.Duration(cfg.SlowCommandThreshold),
+		slowCommandMaxLength: cfg.SlowCommandMaxLength,
+		outputRateLimit:      cfg.OutputRateLimit,
+		outputRateWindow:     time.Duration(cfg.OutputRateWindow),
+		spoolThreshold:       cfg.SpoolThreshold,
+		truncationNotice:     cfg.TruncationNotice,
+		emptyOutput:          EmptyOutputMode(cfg.EmptyOutput),
+		templates:            cfg.Templates,
+		templatesOnly:        cfg.TemplatesOnly,
+		shellOverrides:       overrides,
+		forwardHeaders:       canonicalForwardHeaders(cfg.ForwardHeaders),
+	}
+}
+
+// ConfigReloader 从启动时的配置文件重新加载配置
+type ConfigReloader struct {
+	path string
+
+	// mu 保证同时只有一个重新加载, loaded 为最近一次生效的完整配置
+	mu     sync.Mutex
+	loaded *Config
+}
+
+var configReloader *ConfigReloader
+
+func NewConfigReloader(path string, cfg *Config) *ConfigReloader {
+	return &ConfigReloader{path: path, loaded: cfg}
+}
+
+// ReloadResponse 重新加载的结果
+type ReloadResponse struct {
+	// Changed 已生效的配置项
+	Changed []string `json:"changed"`
+	// RestartRequired 已修改但需要重启服务才能生效的配置项, 这些配置项保持原值
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reload 读取并检查配置文件, 合法时替换 liveSettings, 不合法时返回错误且当前配置不变
+func (cr *ConfigReloader) Reload() (*ReloadResponse, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	next, err := LoadConfig(cr.path)
+	if err != nil {
+		return nil, err
+	}
+	// 预设不能重新加载, shell_overrides 只能引用正在使用的预设
+	if err := validateShellOverrides(next.ShellOverrides, sessionManager.Shells); err != nil {
+		return nil, err
+	}
+
+	resp := &ReloadResponse{Changed: []string{}, RestartRequired: []string{}}
+	for _, key := range configDiff(cr.loaded, next) {
+		if reloadableKeys[key] {
+			resp.Changed = append(resp.Changed, key)
+		} else {
+			resp.RestartRequired = append(resp.RestartRequired, key)
+		}
+	}
+
+	// 只有可以重新加载的配置项生效, 其余配置项仍与启动时一致, 下次比较时同样报告
+	applied := *cr.loaded
+	copyReloadable(&applied, next)
+	cr.loaded = &applied
+	liveSettings.Store(newServerSettings(&applied))
+	capabilities.Store(newCapabilities(&applied))
+	return resp, nil
+}
+
+// configDiff 返回两份配置中取值不同的配置项(JSON 名称), 按名称排序
+func configDiff(a, b *Config) []string {
+	var keys []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyReloadable 把 src 中可以重新加载的配置项复制到 dst
+func copyReloadable(dst, src *Config) {
+	vd, vs := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	t := vd.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if reloadableKeys[configKey(t.Field(i))] {
+			vd.Field(i).Set(vs.Field(i))
+		}
+	}
+}
+
+// configKey 返回配置项的 JSON 名称, 不参与序列化的字段返回空字符串
+func configKey(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" || !f.IsExported() {
+		return ""
+	}
+	return name
+}
+
+// API33: 重新加载配置(管理员)
+func handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	log.Printf("→ Request: Reload config | Path: %s | Token: %s", configReloader.path, identityFrom(r).Name)
+	resp, err := configReloader.Reload()
+	if err != nil {
+		log.Printf("✗ Config reload rejected, keeping current config | Error: %v", err)
+		writeError(w, newAPIErrorCode(http.StatusUnprocessableEntity, codeConfigInvalid, "%v", err))
+		return
+	}
+
+	log.Printf("✓ Config reloaded | Changed: %v | Restart required: %v", resp.Changed, resp.RestartRequired)
+	if len(resp.RestartRequired) > 0 {
+		log.Printf("⚠ Some config changes take effect only after a restart | Keys: %s", strings.Join(resp.RestartRequired, ", "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestReloadableKeys(t *testing.T) {
+	// 每个可重新加载的配置项都对应 Config 的一个字段
+	fields := map[string]bool{}
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		fields[configKey(typ.Field(i))] = true
+	}
+	for key := range reloadableKeys {
+		if !fields[key] {
+			t.Errorf("reloadable key %q is not a config field", key)
+		}
+	}
+
+	a, b := DefaultConfig(), DefaultConfig()
+	b.TemplatesOnly = true
+	b.Addr = ":9999"
+	b.MaxSessionsPerToken = 2
+	if diff := configDiff(a, b); !slices.Equal(diff, []string{"addr", "max_sessions_per_token", "templates_only"}) {
+		t.Fatalf("diff = %v", diff)
+	}
+	// 只复制可以重新加载的配置项
+	copyReloadable(a, b)
+	if !a.TemplatesOnly || a.MaxSessionsPerToken != 2 || a.Addr == b.Addr {
+		t.Fatalf("copied config = %+v", a)
+	}
+}
+
+// writeConfig 将 cfg 与 changes 合并后写入配置文件 path
+func writeConfig(t *testing.T, path string, cfg *Config, changes map[string]any) {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]any
+	json.Unmarshal(data, &values)
+	for k, v := range changes {
+		values[k] = v
+	}
+	if data, err = json.Marshal(values); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	ts := newTestServer(t, nil)
+	path := filepath.Join(t.TempDir(), "config.json")
+	configReloader = NewConfigReloader(path, ts.cfg)
+	id := ts.startSession(aliceToken, nil)
+
+	writeConfig(t, path, ts.cfg, map[string]any{"templates_only": true, "max_sessions_per_token": 1, "addr": ":9999"})
+	if resp, data := ts.post(aliceToken, "/admin/reload", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("reload by tenant = %d %s", resp.StatusCode, data)
+	}
+	resp, data := ts.post(adminToken, "/admin/reload", nil)
+	var out ReloadResponse
+	decodeJSON(t, data, &out)
+	if resp.StatusCode != http.StatusOK || !slices.Equal(out.Changed, []string{"max_sessions_per_token", "templates_only"}) || !slices.Contains(out.RestartRequired, "addr") {
+		t.Fatalf("reload = %d %s", resp.StatusCode, data)
+	}
+	// 重新加载的配置对已有会话的下一条命令立即生效
+	if resp, data = ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("free-form command after templates_only = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.post(aliceToken, "/start-session", map[string]any{}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("start over reloaded quota = %d %s", resp.StatusCode, data)
+	}
+	// 需要重启的配置项保持原值, 再次加载时仍然报告
+	resp, data = ts.post(adminToken, "/admin/reload", nil)
+	decodeJSON(t, data, &out)
+	if len(out.Changed) != 0 || !slices.Contains(out.RestartRequired, "addr") {
+		t.Fatalf("second reload = %s", data)
+	}
+
+	// 不合法的配置被拒绝, 当前配置不变
+	writeConfig(t, path, ts.cfg, map[string]any{"templates_only": false, "command_timeout": "-1s"})
+	if resp, data = ts.post(adminToken, "/admin/reload", nil); resp.StatusCode != http.StatusUnprocessableEntity || errorCodeOf(t, data) != codeConfigInvalid {
+		t.Fatalf("invalid reload = %d %s", resp.StatusCode, data)
+	}
+	if !currentSettings().templatesOnly {
+		t.Fatal("invalid config was applied")
+	}
+}
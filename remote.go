@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// remotePasswordEnv 向 shell 传递远程凭据密码的环境变量, 建立远程会话前读取后删除, 不出现在写入 stdin 的语句中
+const remotePasswordEnv = "__RCE_REMOTE_PASSWORD"
+
+// remoteOpenTimeout New-PSSession 等待远程计算机响应的时间
+const remoteOpenTimeout = 60 * time.Second
+
+// psRemoveRemote 结束会话时关闭远程会话, 远程计算机上的进程随之结束
+const psRemoveRemote = "if ($global:__rceRemote) { Remove-PSSession $global:__rceRemote -ErrorAction SilentlyContinue }"
+
+// remoteConnectTimeout 等待建立远程会话的总时间, 略长于 remoteOpenTimeout
+const remoteConnectTimeout = remoteOpenTimeout + 30*time.Second
+
+const (
+	// codeRemoteConnectFailed 无法连接远程计算机
+	codeRemoteConnectFailed = "remote_connect_failed"
+	// codeRemoteAuthFailed 远程计算机拒绝了凭据
+	codeRemoteAuthFailed = "remote_auth_failed"
+)
+
+var (
+	// errRemoteConnect 无法建立远程会话, 如计算机不存在、WinRM 未启用或网络不通
+	errRemoteConnect = errors.New("failed to connect to remote computer")
+	// errRemoteAuth 远程计算机拒绝了凭据
+	errRemoteAuth = errors.New("remote computer rejected the credentials")
+	// errSubShellRemote 子 shell 的 runspace 在本机, 远程会话中不能打开
+	errSubShellRemote = errors.New("sub-shells are not available in remote sessions")
+)
+
+// remoteComputerName 计算机名、域名或 IP 地址(包括 IPv6)
+var remoteComputerName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.:_-]{0,252}[A-Za-z0-9])?$`)
+
+// remoteAuthentications New-PSSession 支持的 Authentication 取值
+var remoteAuthentications = map[string]bool{
+	"Default": true, "Basic": true, "Negotiate": true, "NegotiateWithImplicitCredential": true,
+	"Credssp": true, "Digest": true, "Kerberos": true,
+}
+
+// RemoteOptions 会话通过 PSRemoting 在远程计算机上执行命令, 本机的 shell 只负责转发
+type RemoteOptions struct {
+	// ComputerName 远程计算机的名称或地址
+	ComputerName string `json:"computer_name"`
+	// Username 和 Password 远程计算机的凭据, 都为空时使用服务进程的身份
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Port WinRM 端口, 0 表示默认端口(HTTP 5985, HTTPS 5986)
+	Port int `json:"port"`
+	// UseSSL 通过 HTTPS 连接
+	UseSSL bool `json:"use_ssl"`
+	// Authentication 认证方式, 如 Negotiate、Kerberos、Basic, 为空时为 Default
+	Authentication string `json:"authentication"`
+	// ConfigurationName 远程端点的会话配置, 如 JEA 端点, 为空时为默认配置
+	ConfigurationName string `json:"configuration_name"`
+}
+
+// validateRemote 检查远程会话的参数, 只支持 PowerShell 会话, 不能与受限语言模式同时使用
+func validateRemote(remote *RemoteOptions, shellType ShellType, constrained bool) error {
+	if remote == nil {
+		return nil
+	}
+	if shellType != ShellPowerShell {
+		return fmt.Errorf("%w: remote requires a PowerShell session", errInvalidOptions)
+	}
+	if constrained {
+		return fmt.Errorf("%w: remote cannot be used with constrained language mode", errInvalidOptions)
+	}
+	if !remoteComputerName.MatchString(remote.ComputerName) {
+		return fmt.Errorf("%w: remote.computer_name must be a host name or address", errInvalidOptions)
+	}
+	if (remote.Username == "") != (remote.Password == "") {
+		return fmt.Errorf("%w: remote.username and remote.password must be set together", errInvalidOptions)
+	}
+	if remote.Port < 0 || remote.Port > 65535 {
+		return fmt.Errorf("%w: remote.port must be between 0 and 65535", errInvalidOptions)
+	}
+	if remote.Authentication != "" && !remoteAuthentications[remote.Authentication] {
+		return fmt.Errorf("%w: unknown remote.authentication %q", errInvalidOptions, remote.Authentication)
+	}
+	if remote.ConfigurationName != "" && !labelKey.MatchString(remote.ConfigurationName) {
+		return fmt.Errorf("%w: invalid remote.configuration_name %q", errInvalidOptions, remote.ConfigurationName)
+	}
+	return nil
+}
+
+// environ 返回 shell 进程额外的环境变量
+func (r *RemoteOptions) environ() []string {
+	if r == nil || r.Password == "" {
+		return nil
+	}
+	return []string{remotePasswordEnv + "=" + r.Password}
+}
+
+// remoteSetup 建立远程会话并应用偏好变量的语句, 没有输出
+// 失败时错误记录保存在 $global:__rceRemoteError 中, 由 connectRemote 检查
+func remoteSetup(remote *RemoteOptions, preferences map[string]string) string {
+	args := []string{
+		"ComputerName = " + psQuote(remote.ComputerName),
+		fmt.Sprintf("SessionOption = (New-PSSessionOption -OpenTimeout %d)", remoteOpenTimeout.Milliseconds()),
+		"ErrorAction = 'Stop'",
+	}
+	if remote.Port != 0 {
+		args = append(args, fmt.Sprintf("Port = %d", remote.Port))
+	}
+	if remote.UseSSL {
+		args = append(args, "UseSSL = $true")
+	}
+	if remote.Authentication != "" {
+		args = append(args, "Authentication = "+psQuote(remote.Authentication))
+	}
+	if remote.ConfigurationName != "" {
+		args = append(args, "ConfigurationName = "+psQuote(remote.ConfigurationName))
+	}
+	credential := ""
+	if remote.Username != "" {
+		credential = "$__rceArgs.Credential = New-Object System.Management.Automation.PSCredential(" + psQuote(remote.Username) +
+			", (ConvertTo-SecureString $env:" + remotePasswordEnv + " -AsPlainText -Force)); "
+	}
+	prefs := ""
+	if len(preferences) > 0 {
+		// 偏好变量属于各自的 runspace, 在远程会话中同样设置一次
+		prefs = "; [void](Invoke-Command -Session $global:__rceRemote -ScriptBlock ([scriptblock]::Create(" + psQuote(preferenceCommand(preferences)) + ")))"
+	}
+	return "$global:__rceRemote = $null; $global:__rceRemoteError = $null; " +
+		"try { $__rceArgs = @{ " + strings.Join(args, "; ") + " }; " + credential +
+		"$global:__rceRemote = New-PSSession @__rceArgs" + prefs + " } catch { $global:__rceRemoteError = $_ } " +
+		"finally { Remove-Item Env:" + remotePasswordEnv + " -ErrorAction SilentlyContinue; Remove-Variable __rceArgs -ErrorAction SilentlyContinue }"
+}
+
+// psRemoteInvoke 在远程会话中执行 $__rceSrc, 结束后取回远程的 $LASTEXITCODE
+// 远程返回的是反序列化的对象, 在本机格式化; 远程会话未建立或已断开时抛出终止错误
+const psRemoteInvoke = "& { if (-not $global:__rceRemote -or $global:__rceRemote.State -ne 'Opened') { throw 'remote session is not connected, restart the session to reconnect' }; " +
+	"Invoke-Command -Session $global:__rceRemote -ScriptBlock { param($__rceSrc) $global:LASTEXITCODE = 0; & ([scriptblock]::Create($__rceSrc)) *>&1 } -ArgumentList $__rceSrc; " +
+	"$global:LASTEXITCODE = Invoke-Command -Session $global:__rceRemote -ScriptBlock { $global:LASTEXITCODE } }"
+
+// remoteStatusCommand 在本机检查 remoteSetup 的结果, 输出一行: ok、auth|错误信息 或 connect|错误信息
+// 只能根据错误 ID 区分凭据错误, Access is denied 等拒绝访问同样归为凭据错误
+const remoteStatusCommand = "if ($global:__rceRemote) { 'ok' } " +
+	"elseif ($global:__rceRemoteError -and $global:__rceRemoteError.FullyQualifiedErrorId -match '^(AccessDenied|LogonFailure|InvalidCredentials)') { 'auth|' + $global:__rceRemoteError.Exception.Message } " +
+	"else { 'connect|' + $global:__rceRemoteError }"
+
+// connectRemote 等待 shell 建立远程会话, 失败时按原因返回 errRemoteAuth 或 errRemoteConnect
+// 在创建会话和重启 shell 后调用, 调用方不能持有 s.mu
+func (s *Session) connectRemote() error {
+	remote := s.options.Remote
+	if remote == nil {
+		return nil
+	}
+	start := time.Now()
+	output, err := s.runInternal(remoteStatusCommand, RunOptions{Timeout: remoteConnectTimeout, probe: true, holdsSlot: true, local: true})
+	if err != nil {
+		log.Printf("✗ Remote session not established | SessionID: %s | Computer: %s | Error: %v", s.ID, remote.ComputerName, err)
+		return fmt.Errorf("%w %s: %v", errRemoteConnect, remote.ComputerName, err)
+	}
+	status, message, _ := strings.Cut(strings.TrimSpace(output), "|")
+	switch status {
+	case "ok":
+		log.Printf("✓ Remote session established | SessionID: %s | Computer: %s | Duration: %s", s.ID, remote.ComputerName, time.Since(start).Round(time.Millisecond))
+		return nil
+	case "auth":
+		log.Printf("✗ Remote credentials rejected | SessionID: %s | Computer: %s | User: %s", s.ID, remote.ComputerName, remote.Username)
+		return fmt.Errorf("%w by %s: %s", errRemoteAuth, remote.ComputerName, strings.TrimSpace(message))
+	}
+	log.Printf("✗ Failed to connect to remote computer | SessionID: %s | Computer: %s | Error: %s", s.ID, remote.ComputerName, strings.TrimSpace(message))
+	return fmt.Errorf("%w %s: %s", errRemoteConnect, remote.ComputerName, strings.TrimSpace(message))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateRemote(t *testing.T) {
+	tests := []struct {
+		remote      *RemoteOptions
+		shell       ShellType
+		constrained bool
+		ok          bool
+	}{
+		{nil, ShellBash, false, true},
+		{&RemoteOptions{ComputerName: "srv01.corp.example"}, ShellPowerShell, false, true},
+		{&RemoteOptions{ComputerName: "fe80::1", Port: 5986, UseSSL: true, Authentication: "Kerberos"}, ShellPowerShell, false, true},
+		{&RemoteOptions{ComputerName: "srv01", Username: `CORP\ops`, Password: "secret", ConfigurationName: "JEA.Maintenance"}, ShellPowerShell, false, true},
+		// 只支持 PowerShell, 不能与受限语言模式同时使用
+		{&RemoteOptions{ComputerName: "srv01"}, ShellBash, false, false},
+		{&RemoteOptions{ComputerName: "srv01"}, ShellPowerShell, true, false},
+		{&RemoteOptions{ComputerName: ""}, ShellPowerShell, false, false},
+		{&RemoteOptions{ComputerName: "srv01; Remove-Item C:\\"}, ShellPowerShell, false, false},
+		{&RemoteOptions{ComputerName: "srv01", Username: "ops"}, ShellPowerShell, false, false},
+		{&RemoteOptions{ComputerName: "srv01", Port: 70000}, ShellPowerShell, false, false},
+		{&RemoteOptions{ComputerName: "srv01", Authentication: "NTLM"}, ShellPowerShell, false, false},
+		{&RemoteOptions{ComputerName: "srv01", ConfigurationName: "a'b"}, ShellPowerShell, false, false},
+	}
+	for _, tt := range tests {
+		err := validateRemote(tt.remote, tt.shell, tt.constrained)
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, errInvalidOptions)) {
+			t.Errorf("validateRemote(%+v, %s, %t) = %v", tt.remote, tt.shell, tt.constrained, err)
+		}
+	}
+}
+
+func TestRemoteSetup(t *testing.T) {
+	remote := &RemoteOptions{ComputerName: "srv01", Username: `CORP\ops`, Password: "hunter2-pw", Port: 5986, UseSSL: true, Authentication: "Negotiate"}
+	setup := remoteSetup(remote, map[string]string{"ProgressPreference": "SilentlyContinue"})
+	for _, want := range []string{"ComputerName = 'srv01'", "Port = 5986", "UseSSL = $true", "Authentication = 'Negotiate'", "$env:" + remotePasswordEnv, "Remove-Item Env:" + remotePasswordEnv, "Invoke-Command -Session $global:__rceRemote"} {
+		if !strings.Contains(setup, want) {
+			t.Errorf("setup missing %q:\n%s", want, setup)
+		}
+	}
+	// 密码只通过环境变量传递
+	if strings.Contains(setup, remote.Password) {
+		t.Fatalf("password written to stdin:\n%s", setup)
+	}
+	if env := remote.environ(); len(env) != 1 || env[0] != remotePasswordEnv+"=hunter2-pw" {
+		t.Fatalf("environ = %v", env)
+	}
+	if env := (&RemoteOptions{ComputerName: "srv01"}).environ(); env != nil {
+		t.Fatalf("environ without credentials = %v", env)
+	}
+	setup = remoteSetup(&RemoteOptions{ComputerName: "srv01"}, nil)
+	if strings.Contains(setup, "Credential") || strings.Contains(setup, "Invoke-Command") {
+		t.Fatalf("setup without credentials or preferences:\n%s", setup)
+	}
+
+	preset := defaultShellPresets()["pwsh"]
+	if frame := preset.frame("Get-Date", "m1", TerminatorMarker, frameOptions{remote: true}); !strings.Contains(frame, "Invoke-Command -Session $global:__rceRemote") {
+		t.Fatalf("remote frame does not use the remote session:\n%s", frame)
+	}
+}
+
+func TestRemoteSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			remoteStatusCommand: {Output: "ok"},
+			"Show-Password":     {Output: "password is hunter2-pw"},
+		}
+	})
+	recorder := &stdinRecorder{fakeSpawner: fakeSpawner{outputs: ts.cfg.FakeOutputs}}
+	spawner = recorder
+	remote := map[string]any{"computer_name": "srv01", "username": "ops", "password": "hunter2-pw"}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "remote": remote})
+	if resp, data := ts.run(aliceToken, id, "echo ok", nil); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Fatalf("run = %d %q", resp.StatusCode, data)
+	}
+	stdin := recorder.String()
+	if !strings.Contains(stdin, "New-PSSession") || !strings.Contains(stdin, "$global:__rceRemote.State") || strings.Contains(stdin, "hunter2-pw") {
+		t.Fatalf("remote session stdin:\n%s", stdin)
+	}
+	// 密码与 secret_env 一样在输出中替换
+	if _, data := ts.run(aliceToken, id, "Show-Password", nil); string(data) != "password is "+redacted {
+		t.Fatalf("password not redacted: %q", data)
+	}
+	// 子 shell 的 runspace 在本机, 不能打开
+	resp, data := ts.post(aliceToken, "/open-subshell", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), errSubShellRemote.Error()) {
+		t.Fatalf("open-subshell = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.post(aliceToken, "/start-session", map[string]any{"shell": "bash", "remote": remote}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("remote bash = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestRemoteConnectFailure(t *testing.T) {
+	tests := []struct {
+		status string
+		code   string
+	}{
+		{"auth|Access is denied.", codeRemoteAuthFailed},
+		{"connect|WinRM cannot complete the operation.", codeRemoteConnectFailed},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t, func(cfg *Config) {
+			cfg.FakeOutputs = map[string]FakeOutput{remoteStatusCommand: {Output: tt.status}}
+		})
+		resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "pwsh", "remote": map[string]any{"computer_name": "srv01"}})
+		if resp.StatusCode != http.StatusBadGateway || errorCodeOf(t, data) != tt.code {
+			t.Errorf("status %q = %d %s", tt.status, resp.StatusCode, data)
+		}
+		// 失败的会话不占用配额
+		if n := sessionManager.Owned("alice"); n != 0 {
+			t.Errorf("status %q left %d sessions", tt.status, n)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// codeHistoryNotFound 会话历史中没有请求的命令
+const codeHistoryNotFound = "history_not_found"
+
+// ReplayCommandRequest 重新执行会话历史中一条命令的参数, index 和 command_id 二选一
+type ReplayCommandRequest struct {
+	SessionID string `json:"session_id"`
+	// Index 历史记录的序号, 见 /session-info 的 history
+	Index int64 `json:"index"`
+	// CommandID 历史记录的命令 ID
+	CommandID string `json:"command_id"`
+	// IncludeOriginal 以 JSON 返回新的结果和原来的历史记录, 便于比较
+	IncludeOriginal bool `json:"include_original"`
+	// TimeoutMs 和 Queue 与 /run-command 相同
+	TimeoutMs int  `json:"timeout_ms"`
+	Queue     bool `json:"queue"`
+}
+
+// ReplayCommandResponse include_original 时的响应
+type ReplayCommandResponse struct {
+	// Original 重新执行的历史记录, 命令中的机密值已替换
+	Original *CommandRecord `json:"original"`
+	Result   interface{}    `json:"result"`
+}
+
+// findHistoryRecord 在会话历史中按序号或命令 ID 查找记录
+func findHistoryRecord(session *Session, index int64, commandID string) (*CommandRecord, error) {
+	history, err := session.store.History(session.ID)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to read history: %v", err)
+	}
+	for i := range history {
+		if (index > 0 && history[i].Index == index) || (commandID != "" && history[i].CommandID == commandID) {
+			return &history[i], nil
+		}
+	}
+	log.Printf("✗ Command not found in history | SessionID: %s | Index: %d | CommandID: %s", session.ID, index, commandID)
+	return nil, newAPIErrorCode(http.StatusNotFound, codeHistoryNotFound, "Command not found in session history")
+}
+
+// replayCommand 以请求方的身份重新执行历史记录中的命令, 与 /run-command 一样检查会话归属和限制
+// 由模板或脚本展开的命令用记录的参数按当前配置重新展开, 记录之后收紧的模板和删除的脚本不会被绕过
+// 返回的 RunCommandRequest 供调用方按 /run-command 的格式写出结果
+func replayCommand(identity *Identity, req ReplayCommandRequest, run RunCommandRequest) (*CommandRecord, RunCommandRequest, *CommandResult, *OutputFile, error) {
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, run, nil, nil, err
+	}
+	if (req.Index > 0) == (req.CommandID != "") || req.Index < 0 {
+		log.Printf("✗ Invalid replay request | SessionID: %s | Index: %d | CommandID: %s", req.SessionID, req.Index, req.CommandID)
+		return nil, run, nil, nil, newAPIError(http.StatusBadRequest, "exactly one of index and command_id is required")
+	}
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, run, nil, nil, sessionNotFound(req.SessionID, identity)
+	}
+	rec, err := findHistoryRecord(session, req.Index, req.CommandID)
+	if err != nil {
+		return nil, run, nil, nil, err
+	}
+
+	log.Printf("→ Request: Replay command | SessionID: %s | Index: %d | Owner: %s", req.SessionID, rec.Index, identity.Name)
+	run.SessionID = req.SessionID
+	switch {
+	case rec.Template != "":
+		run.Template, run.Params = rec.Template, rec.Params
+	case rec.Script != "":
+		run.Script, run.Args = rec.Script, rec.Args
+	default:
+		run.Command = rec.Command
+	}
+	run.Shell = rec.Shell
+	run.Queue = req.Queue
+	if req.TimeoutMs != 0 && (run.TimeoutMs == 0 || req.TimeoutMs < run.TimeoutMs) {
+		run.TimeoutMs = req.TimeoutMs
+	}
+	result, file, err := runCommand(identity, run)
+	return rec, run, result, file, err
+}
+
+// API26: 重新执行会话历史中的一条命令
+func handleReplayCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req ReplayCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	run := RunCommandRequest{trace: spanFrom(r), env: forwardedEnv(r.Header)}
+	if err := applyRequestTimeout(r, &run); err != nil {
+		writeError(w, err)
+		return
+	}
+	rec, run, result, file, err := replayCommand(identityFrom(r), req, run)
+	if !req.IncludeOriginal || rec == nil {
+		writeRunCommandResult(w, run, result, file, err)
+		return
+	}
+
+	original := rec.redacted()
+	resp := &ReplayCommandResponse{Original: &original, Result: runCommandResponse(result, file)}
+	if err != nil {
+		writeErrorResult(w, err, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replay 重新执行历史中的命令, 返回响应和响应体
+func (ts *testServer) replay(token string, body map[string]any) (*http.Response, []byte) {
+	ts.t.Helper()
+	return ts.post(token, "/replay-command", body)
+}
+
+// history 返回会话当前的命令历史
+func history(t *testing.T, id string) []CommandRecord {
+	t.Helper()
+	records, err := sessionManager.Store.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// changeSettings 修改当前生效的配置, 与 /admin/reload 一样整体替换
+func changeSettings(ts *testServer, change func(cfg *Config)) {
+	cfg := *ts.cfg
+	change(&cfg)
+	liveSettings.Store(newServerSettings(&cfg))
+}
+
+func TestReplayCommand(t *testing.T) {
+	ts := newTestServer(t, nil)
+	var audit bytes.Buffer
+	auditLog = NewAuditLog(&audit, nil)
+	t.Cleanup(func() { auditLog = nil })
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "echo first", nil)
+	original := history(t, id)[0]
+
+	resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": original.Index})
+	if resp.StatusCode != http.StatusOK || string(data) != "first" {
+		t.Fatalf("replay by index = %d %q", resp.StatusCode, data)
+	}
+	// 重新执行同样记录到历史中, 命令 ID 不同
+	records := history(t, id)
+	if len(records) != 2 || records[1].Command != "echo first" || records[1].CommandID == original.CommandID {
+		t.Fatalf("history after replay = %+v", records)
+	}
+
+	resp, data = ts.replay(aliceToken, map[string]any{"session_id": id, "command_id": original.CommandID, "include_original": true})
+	var out struct {
+		Original CommandRecord `json:"original"`
+		Result   CommandResult `json:"result"`
+	}
+	decodeJSON(t, data, &out)
+	if resp.StatusCode != http.StatusOK || out.Original.Index != original.Index || out.Result.Output != "first" || out.Result.CommandID == original.CommandID {
+		t.Fatalf("replay with original = %d %s", resp.StatusCode, data)
+	}
+
+	// 管理员重新执行时以管理员的身份审计
+	audit.Reset()
+	if resp, data = ts.replay(adminToken, map[string]any{"session_id": id, "index": original.Index}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin replay = %d %s", resp.StatusCode, data)
+	}
+	var entry AuditEntry
+	decodeJSON(t, bytes.TrimSpace(audit.Bytes()), &entry)
+	if entry.Tenant != "admin" || entry.Command != "echo first" {
+		t.Fatalf("audit entry = %+v", entry)
+	}
+}
+
+func TestReplayCommandErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "echo first", nil)
+	rec := history(t, id)[0]
+
+	tests := []struct {
+		token  string
+		body   map[string]any
+		status int
+		code   string
+	}{
+		{bobToken, map[string]any{"session_id": id, "index": rec.Index}, http.StatusNotFound, codeSessionNotFound},
+		{aliceToken, map[string]any{"session_id": id, "index": 99}, http.StatusNotFound, codeHistoryNotFound},
+		{aliceToken, map[string]any{"session_id": id, "command_id": "missing"}, http.StatusNotFound, codeHistoryNotFound},
+		{aliceToken, map[string]any{"session_id": id, "index": rec.Index, "command_id": rec.CommandID}, http.StatusBadRequest, codeInvalidRequest},
+		{aliceToken, map[string]any{"session_id": id}, http.StatusBadRequest, codeInvalidRequest},
+		{aliceToken, map[string]any{"session_id": id, "index": rec.Index, "timeout_ms": -1}, http.StatusBadRequest, codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		resp, data := ts.replay(tt.token, tt.body)
+		if resp.StatusCode != tt.status || errorCodeOf(t, data) != tt.code {
+			t.Errorf("replay %v = %d %s", tt.body, resp.StatusCode, data)
+		}
+	}
+}
+
+func TestReplayRechecksPolicy(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Templates = map[string]*CommandTemplate{
+			"greet": {Command: "echo {{name}}", Params: map[string]*TemplateParam{"name": {Type: ParamString}}},
+		}
+		cfg.ShellOverrides = []string{"bash"}
+	})
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "echo free", nil)
+	ts.run(aliceToken, id, "", map[string]any{"template": "greet", "params": map[string]any{"name": "world"}})
+	ts.run(aliceToken, id, "echo child", map[string]any{"shell": "bash"})
+	records := history(t, id)
+	if len(records) != 3 || records[1].Template != "greet" || records[1].Command != "echo 'world'" || records[2].Shell != "bash" {
+		t.Fatalf("history = %+v", records)
+	}
+	free, templated, child := records[0].Index, records[1].Index, records[2].Index
+
+	// templates_only 之后自由格式的命令不能重新执行, 由模板展开的命令可以
+	changeSettings(ts, func(cfg *Config) { cfg.TemplatesOnly = true })
+	if resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": free}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("free-form replay under templates_only = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": templated}); resp.StatusCode != http.StatusOK || string(data) != "world" {
+		t.Fatalf("template replay under templates_only = %d %q", resp.StatusCode, data)
+	}
+
+	// 模板删除后不能再执行由它展开的命令
+	changeSettings(ts, func(cfg *Config) { cfg.Templates = nil })
+	resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": templated, "include_original": true})
+	if resp.StatusCode != http.StatusNotFound || errorCodeOf(t, data) != codeTemplateNotFound {
+		t.Fatalf("replay of removed template = %d %s", resp.StatusCode, data)
+	}
+	// 出错时原来的记录在 result 中
+	if !strings.Contains(string(data), `"original"`) {
+		t.Fatalf("original missing from error response: %s", data)
+	}
+
+	// shell 不再在 shell_overrides 中
+	changeSettings(ts, func(cfg *Config) { cfg.ShellOverrides = nil })
+	if resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": child}); resp.StatusCode != http.StatusForbidden || errorCodeOf(t, data) != codeShellNotAllowed {
+		t.Fatalf("replay with removed shell override = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestReplayRedactsOriginal(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"API_KEY": "s3cr3t-value"}})
+	ts.run(aliceToken, id, "echo s3cr3t-value", nil)
+	resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": history(t, id)[0].Index, "include_original": true})
+	var out ReplayCommandResponse
+	if err := json.Unmarshal(data, &out); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("replay = %d %s", resp.StatusCode, data)
+	}
+	// 执行的是原来的命令文本, 返回的记录中机密值已替换
+	if strings.Contains(string(data), "s3cr3t-value") || out.Original.Command != "echo [REDACTED]" {
+		t.Fatalf("replay response = %s", data)
+	}
+}
+
+func TestReplayReexpandsTemplate(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Templates = map[string]*CommandTemplate{
+			"deploy": {Command: "echo deploy {{env}}", Params: map[string]*TemplateParam{"env": {Type: ParamEnum, Values: []string{"staging", "prod"}}}},
+		}
+	})
+	path := filepath.Join(t.TempDir(), "config.json")
+	configReloader = NewConfigReloader(path, ts.cfg)
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "", map[string]any{"template": "deploy", "params": map[string]any{"env": "prod"}})
+	records := history(t, id)
+	if len(records) != 1 || string(records[0].Params["env"]) != `"prod"` {
+		t.Fatalf("history = %+v", records)
+	}
+	index := records[0].Index
+
+	// 重新加载后模板只允许 staging, 记录中的参数不再合法, 不能执行原来展开的命令
+	writeConfig(t, path, ts.cfg, map[string]any{"templates": map[string]any{
+		"deploy": map[string]any{"command": "echo deploy {{env}}", "params": map[string]any{"env": map[string]any{"type": "enum", "values": []string{"staging"}}}},
+	}})
+	if resp, data := ts.post(adminToken, "/admin/reload", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": index}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("replay against tightened template = %d %s", resp.StatusCode, data)
+	}
+
+	// 参数仍然合法时按当前的模板重新展开
+	writeConfig(t, path, ts.cfg, map[string]any{"templates": map[string]any{
+		"deploy": map[string]any{"command": "echo release {{env}}", "params": map[string]any{"env": map[string]any{"type": "enum", "values": []string{"prod"}}}},
+	}})
+	if resp, data := ts.post(adminToken, "/admin/reload", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("reload = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.replay(aliceToken, map[string]any{"session_id": id, "index": index}); resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "release ") {
+		t.Fatalf("replay against changed template = %d %q", resp.StatusCode, data)
+	}
+}
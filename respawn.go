@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// maxRespawnAttempts 单次崩溃后最多尝试重启的次数
+	maxRespawnAttempts = 5
+	// respawnBaseDelay 首次重启前的等待时间, 之后每次翻倍
+	respawnBaseDelay = time.Second
+	// respawnMaxDelay 重启等待时间上限
+	respawnMaxDelay = 30 * time.Second
+)
+
+// SessionEvent 会话生命周期事件
+type SessionEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message,omitempty"`
+}
+
+// addEvent 将会话事件写入 Store, 会话已从 Store 删除(已结束)时忽略
+func (s *Session) addEvent(eventType, message string) {
+	err := s.store.AppendEvent(s.ID, SessionEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		Message: message,
+	})
+	if err != nil && !errors.Is(err, errSessionNotFound) {
+		log.Printf("⚠ Failed to record session event | SessionID: %s | Event: %s | Error: %v", s.ID, eventType, err)
+	}
+}
+
+// EventsSnapshot 返回会话事件的副本, 不等待正在执行的命令
+func (s *Session) EventsSnapshot() []SessionEvent {
+	events, err := s.store.Events(s.ID)
+	if err != nil {
+		log.Printf("⚠ Failed to read session events | SessionID: %s | Error: %v", s.ID, err)
+	}
+	return events
+}
+
+// watch 等待 shell 进程退出, 关闭 exited, 意外退出时按配置重启
+func (s *Session) watch(proc *shellProcess, exited chan struct{}) {
+	waitErr := proc.wait()
+	close(exited)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 会话正在结束或进程已被替换, 属于正常退出, 由 EndSession 清理
+	if s.State() != stateRunning || !s.running.Load() || s.proc != proc {
+		return
+	}
+
+	log.Printf("⚠ Shell exited unexpectedly | SessionID: %s | Error: %v", s.ID, waitErr)
+	// shell 退出后清理它留下的子进程
+	s.teardown()
+	s.addEvent("exited", fmt.Sprintf("shell exited unexpectedly: %v", waitErr))
+
+	if !s.AutoRespawn {
+		s.running.Store(false)
+		return
+	}
+
+	s.respawning = true
+	defer func() { s.respawning = false }()
+
+	delay := respawnBaseDelay
+	for attempt := 1; attempt <= maxRespawnAttempts; attempt++ {
+		// 等待期间释放锁, 避免阻塞 EndSession
+		s.mu.Unlock()
+		time.Sleep(delay)
+		s.mu.Lock()
+
+		if s.State() != stateRunning {
+			s.running.Store(false)
+			return
+		}
+
+		if err := s.start(); err != nil {
+			log.Printf("✗ Failed to respawn shell | SessionID: %s | Attempt: %d | Error: %v", s.ID, attempt, err)
+			s.addEvent("respawn_failed", err.Error())
+			delay *= 2
+			if delay > respawnMaxDelay {
+				delay = respawnMaxDelay
+			}
+			continue
+		}
+
+		log.Printf("✓ Shell respawned | SessionID: %s | Attempt: %d", s.ID, attempt)
+		s.addEvent("respawned", fmt.Sprintf("attempt %d", attempt))
+		go s.watch(s.proc, s.exited)
+		return
+	}
+
+	log.Printf("✗ Giving up respawning shell | SessionID: %s", s.ID)
+	s.addEvent("respawn_abandoned", fmt.Sprintf("failed after %d attempts", maxRespawnAttempts))
+	s.running.Store(false)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// errCommandAborted 命令执行期间会话的 shell 被重启
+var errCommandAborted = errors.New("command was cancelled by a session restart")
+
+// errRespawning shell 意外退出后正在等待自动重启
+var errRespawning = errors.New("session shell is restarting")
+
+// aborted 返回当前 shell 的取消通道, 重启 shell 时关闭
+func (s *Session) aborted() <-chan struct{} {
+	s.abortMu.Lock()
+	defer s.abortMu.Unlock()
+	return s.abort
+}
+
+// abortCommands 关闭当前 shell 的取消通道, 正在执行和等待 mu 的命令立即返回并释放 mu
+// 通道保持关闭直到 start 启动新的 shell, 期间获取到 mu 的命令同样被取消
+func (s *Session) abortCommands() {
+	s.abortMu.Lock()
+	defer s.abortMu.Unlock()
+	select {
+	case <-s.abort:
+	default:
+		close(s.abort)
+	}
+}
+
+// resetAbort 为新启动的 shell 创建取消通道, 调用方需持有 s.mu 或会话尚未共享
+func (s *Session) resetAbort() {
+	s.abortMu.Lock()
+	defer s.abortMu.Unlock()
+	s.abort = make(chan struct{})
+}
+
+// Restart 结束当前 shell 并启动新的 shell, 会话 ID、环境变量和偏好变量保持不变
+// 正在执行的命令被取消; 初始化命令由调用方在之后重放
+func (s *Session) Restart() error {
+	s.abortCommands()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.State() != stateRunning {
+		return fmt.Errorf("%w: %s", errSessionNotFound, s.ID)
+	}
+	if s.respawning {
+		// 等待重启的 watch 醒来后会启动 shell, 放弃本次重启并恢复取消通道
+		s.resetAbort()
+		return errRespawning
+	}
+
+	return s.restartShell("")
+}
+
+// restartShell 结束当前 shell 并启动新的 shell, reason 记录在 restarted 事件中, 调用方需持有 s.mu
+func (s *Session) restartShell(reason string) error {
+	// 旧进程的 watch 获取 mu 后发现进程已被替换, 不会当作意外退出处理
+	s.running.Store(false)
+	s.teardown()
+	if err := s.start(); err != nil {
+		s.addEvent("restart_failed", err.Error())
+		return err
+	}
+	s.running.Store(true)
+	s.consecutiveErrors.Store(0)
+	s.touch(time.Now())
+	s.addEvent("restarted", reason)
+	go s.watch(s.proc, s.exited)
+	return nil
+}
+
+// RestartSessionRequest 重启会话 shell 的参数
+type RestartSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// RestartSessionResponse 重启会话 shell 的结果
+type RestartSessionResponse struct {
+	SessionID string `json:"session_id"`
+	// InitCommands 重放的初始化命令数
+	InitCommands int `json:"init_commands"`
+}
+
+// restartSession 重启请求方的会话 shell 并重放初始化命令
+// 与克隆会话不同, 会话 ID 不变, 原来的 shell 进程被结束
+func restartSession(identity *Identity, req RestartSessionRequest) (*RestartSessionResponse, error) {
+	if req.SessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "session_id is required")
+	}
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("→ Request: Restart session | SessionID: %s", req.SessionID)
+
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+
+	if err := session.Restart(); err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			log.Printf("✗ Session ended during restart | SessionID: %s", req.SessionID)
+			return nil, newAPIErrorCode(http.StatusNotFound, codeSessionNotFound, "Session not found")
+		}
+		if errors.Is(err, errRespawning) {
+			log.Printf("✗ Shell is already restarting | SessionID: %s", req.SessionID)
+			return nil, newAPIError(http.StatusConflict, "%v", err)
+		}
+		if errors.Is(err, errShellUnavailable) {
+			return nil, newAPIErrorCode(http.StatusServiceUnavailable, codeShellUnavailable, "%v", err)
+		}
+		log.Printf("✗ Failed to restart session | SessionID: %s | Error: %v", req.SessionID, err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to restart session: %v", err)
+	}
+	log.Printf("✓ Shell restarted | SessionID: %s", req.SessionID)
+
+	init := session.InitCommands()
+	if err := replayInit(identity, session); err != nil {
+		log.Printf("✗ Session init failed | SessionID: %s | Error: %v", req.SessionID, err)
+		// 与创建会话一致, 初始化不完整的会话不再交给客户端
+		sessionManager.EndSession(req.SessionID, true)
+		return nil, newAPIErrorCode(http.StatusBadRequest, codeInitFailed, "%v", err)
+	}
+
+	log.Printf("✓ Session restarted successfully | SessionID: %s | Init commands: %d", req.SessionID, len(init))
+	return &RestartSessionResponse{
+		SessionID:    req.SessionID,
+		InitCommands: len(init),
+	}, nil
+}
+
+// API20: 重启会话 shell
+func handleRestartSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req RestartSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	resp, err := restartSession(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// restartSession 重启会话的 shell, 返回状态码和响应
+func (ts *testServer) restartSession(token, id string) (int, RestartSessionResponse) {
+	ts.t.Helper()
+	resp, data := ts.post(token, "/restart-session", map[string]any{"session_id": id})
+	var out RestartSessionResponse
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out
+}
+
+func TestRestartSessionKeepsID(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo a"}})
+	ts.run(aliceToken, id, "echo b", map[string]any{"record_init": true})
+	s, _ := sessionManager.GetSession(id)
+	oldProc := s.proc
+
+	status, out := ts.restartSession(aliceToken, id)
+	if status != http.StatusOK || out.SessionID != id || out.InitCommands != 2 {
+		t.Fatalf("restart = %d %+v", status, out)
+	}
+	if s.proc == oldProc || !s.running.Load() || s.State() != stateRunning {
+		t.Fatal("shell was not replaced")
+	}
+	if resp, data := ts.run(aliceToken, id, "echo after", nil); resp.StatusCode != http.StatusOK || string(data) != "after" {
+		t.Fatalf("run after restart = %d %q", resp.StatusCode, data)
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "restarted" {
+		t.Fatalf("last event = %+v", last)
+	}
+
+	// 其他租户的会话按不存在处理
+	if status, _ = ts.restartSession(bobToken, id); status != http.StatusNotFound {
+		t.Fatalf("cross-tenant restart = %d", status)
+	}
+	ts.endSession(aliceToken, id)
+	if status, _ = ts.restartSession(aliceToken, id); status != http.StatusNotFound {
+		t.Fatalf("restart ended session = %d", status)
+	}
+}
+
+func TestRestartSessionCancelsRunningCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {DelayMs: 10000}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	done := make(chan int, 1)
+	go func() {
+		resp, _ := ts.run(aliceToken, id, "Hang", nil)
+		done <- resp.StatusCode
+	}()
+	waitFor(t, func() bool { return s.current.Load() != nil })
+
+	start := time.Now()
+	if status, _ := ts.restartSession(aliceToken, id); status != http.StatusOK {
+		t.Fatalf("restart = %d", status)
+	}
+	// 正在执行的命令立即返回 409, 不等待命令结束
+	if status := <-done; status != http.StatusConflict {
+		t.Fatalf("cancelled command = %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("restart waited %s for the running command", elapsed)
+	}
+}
+
+func TestRestartSessionRestoresEnv(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{
+		"shell": "bash",
+		"env":   map[string]string{"SEEDED": "env"},
+		"init":  []string{"export FROM_INIT=init"},
+	})
+	ts.run(aliceToken, id, "RECORDED=yes", map[string]any{"record_init": true})
+	_, before := ts.run(aliceToken, id, "echo $$", nil)
+	ts.run(aliceToken, id, "RUNTIME=lost", nil)
+
+	if status, _ := ts.restartSession(aliceToken, id); status != http.StatusOK {
+		t.Fatalf("restart = %d", status)
+	}
+	_, after := ts.run(aliceToken, id, "echo $$", nil)
+	if string(before) == string(after) {
+		t.Fatalf("shell pid unchanged: %s", after)
+	}
+	// 环境变量和记录的初始化命令恢复, 没有记录的运行时状态丢失
+	resp, data := ts.run(aliceToken, id, `echo "$SEEDED $FROM_INIT $RECORDED [$RUNTIME]"`, nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "env init yes []" {
+		t.Fatalf("state after restart = %d %q", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RunOnceRequest 在临时会话中执行一条命令的参数, 命令的参数与 /run-command 相同, 不能指定 session_id
+type RunOnceRequest struct {
+	// Session 临时会话的启动参数, 与 /start-session 相同
+	Session SessionOptions `json:"session"`
+	RunCommandRequest
+}
+
+// runOnce 创建临时会话, 执行命令后结束会话, 无论命令成功与否会话都不会留下
+// 临时会话与普通会话一样计入请求方的会话数上限
+func runOnce(identity *Identity, req RunOnceRequest) (*Session, *CommandResult, *OutputFile, error) {
+	if req.SessionID != "" {
+		log.Printf("✗ session_id in run-once request | SessionID: %s", req.SessionID)
+		return nil, nil, nil, newAPIError(http.StatusBadRequest, "session_id cannot be used with /run-once, the command runs in a new session")
+	}
+
+	start := time.Now()
+	session, err := startSession(identity, req.Session)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		// 命令失败或超时时 shell 中可能仍有进程, 直接结束进程树
+		force := err != nil
+		if endErr := sessionManager.EndSession(session.ID, force); endErr != nil {
+			log.Printf("⚠ Failed to end run-once session | SessionID: %s | Error: %v", session.ID, endErr)
+		}
+		log.Printf("✓ Run-once session ended | SessionID: %s | Force: %t | Duration: %s", session.ID, force, time.Since(start).Round(time.Millisecond))
+	}()
+
+	req.SessionID = session.ID
+	result, file, err := runCommand(identity, req.RunCommandRequest)
+	return session, result, file, err
+}
+
+// API31: 在临时会话中执行一条命令, 返回后会话已结束
+func handleRunOnce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	var req RunOnceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return
+	}
+
+	req.trace = spanFrom(r)
+	req.env = forwardedEnv(r.Header)
+	if err := applyRequestTimeout(r, &req.RunCommandRequest); err != nil {
+		writeError(w, err)
+		return
+	}
+	session, result, file, err := runOnce(identityFrom(r), req)
+	if session != nil {
+		w.Header().Set("X-Session-ID", session.ID)
+	}
+	if session == nil && err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRunCommandResult(w, req.RunCommandRequest, result, file, err)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunOnce(t *testing.T) {
+	ts := newTestServer(t, nil)
+	tracker := &trackingSpawner{}
+	spawner = tracker
+
+	resp, data := ts.post(aliceToken, "/run-once", map[string]any{"command": "echo once", "session": map[string]any{"shell": "bash"}})
+	if resp.StatusCode != http.StatusOK || string(data) != "once" {
+		t.Fatalf("run-once = %d %q", resp.StatusCode, data)
+	}
+	// 返回时临时会话已结束, 不留下记录和进程
+	id := resp.Header.Get("X-Session-ID")
+	if _, exists := sessionManager.GetSession(id); id == "" || exists {
+		t.Fatalf("session %q still exists", id)
+	}
+	if n := sessionManager.Owned("alice"); n != 0 {
+		t.Fatalf("%d sessions counted", n)
+	}
+	if records, _ := sessionManager.Store.ListSessions(); len(records) != 0 {
+		t.Fatalf("%d session records left", len(records))
+	}
+	waitFor(t, func() bool { return tracker.alive() == 0 })
+
+	if resp, data = ts.post(aliceToken, "/run-once", map[string]any{"command": "echo once", "session_id": id}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("run-once with session_id = %d %s", resp.StatusCode, data)
+	}
+	// 会话启动失败时与 /start-session 相同
+	resp, data = ts.post(aliceToken, "/run-once", map[string]any{"command": "echo once", "session": map[string]any{"shell": "bash", "structured_errors": true}})
+	if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("X-Session-ID") != "" {
+		t.Fatalf("invalid session options = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestRunOnceTimeoutEndsSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Hang": {Output: "partial", DelayMs: 10000}}
+		cfg.EndGracePeriod = Duration(5 * time.Second)
+	})
+	tracker := &trackingSpawner{fakeSpawner: fakeSpawner{outputs: ts.cfg.FakeOutputs}}
+	spawner = tracker
+
+	// 命令超时时强制结束会话, 不等待宽限期
+	start := time.Now()
+	resp, data := ts.post(aliceToken, "/run-once", map[string]any{"command": "Hang", "timeout_ms": 200})
+	if resp.StatusCode != http.StatusGatewayTimeout || errorCodeOf(t, data) != codeCommandTimeout {
+		t.Fatalf("run-once timeout = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("run-once waited %s to end the session", elapsed)
+	}
+	if _, exists := sessionManager.GetSession(resp.Header.Get("X-Session-ID")); exists {
+		t.Fatal("session left after timeout")
+	}
+	waitFor(t, func() bool { return tracker.alive() == 0 })
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errScriptsDisabled    = errors.New("scripts are not enabled, scripts_dir is not configured")
+	errScriptNotFound     = errors.New("script not found")
+	errScriptOutside      = errors.New("script must be a relative path inside the scripts directory")
+	errScriptsUnsupported = errors.New("scripts are not supported by cmd sessions")
+)
+
+// ScriptLibrary 服务端预置的脚本目录, 命令可按名称引用其中的脚本
+type ScriptLibrary struct {
+	// dir 解析过符号链接的绝对路径
+	dir string
+}
+
+func NewScriptLibrary(dir string) (*ScriptLibrary, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scripts_dir: %v", err)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scripts_dir: %v", err)
+	}
+	return &ScriptLibrary{dir: real}, nil
+}
+
+// Resolve 返回脚本的实际路径
+// 拒绝绝对路径和 .. 等越出目录的引用, 解析符号链接后再检查一次, 指向目录外的链接同样被拒绝
+func (l *ScriptLibrary) Resolve(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errScriptOutside
+	}
+	path := filepath.Join(l.dir, name)
+	if !l.contains(path) {
+		return "", errScriptOutside
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errScriptNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve script: %v", err)
+	}
+	if !l.contains(real) {
+		return "", errScriptOutside
+	}
+	info, err := os.Stat(real)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", errScriptNotFound
+	}
+	return real, nil
+}
+
+// contains 判断 path 是否位于脚本目录中
+func (l *ScriptLibrary) contains(path string) bool {
+	rel, err := filepath.Rel(l.dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var scriptLibrary *ScriptLibrary
+
+// scriptCommand 生成执行脚本的命令, 路径和参数都作为字符串字面量传入, 不会被 shell 解释
+// PowerShell 中带引号的参数总是按位置传入, 不会被当作 -Name 形式的参数名
+func scriptCommand(shellType ShellType, path string, args []string) (string, error) {
+	quote := psQuote
+	prefix := "& "
+	switch shellType {
+	case ShellPowerShell:
+	case ShellBash:
+		// 在新的 bash 进程中执行, 脚本无需可执行权限, 脚本中的 exit 也不会结束会话的 shell
+		quote, prefix = bashQuote, `"$BASH" `
+	default:
+		return "", errScriptsUnsupported
+	}
+
+	parts := make([]string, 0, len(args)+1)
+	parts = append(parts, quote(path))
+	for _, arg := range args {
+		parts = append(parts, quote(arg))
+	}
+	return prefix + strings.Join(parts, " "), nil
+}
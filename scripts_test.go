@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScriptLibraryResolve(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "deploy.ps1"), []byte("Write-Output deploy"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.ps1"), []byte("Write-Output secret"), 0644)
+	os.Mkdir(filepath.Join(dir, "tools"), 0755)
+	if err := os.Symlink(filepath.Join(outside, "secret.ps1"), filepath.Join(dir, "escape.ps1")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	os.Symlink(outside, filepath.Join(dir, "linked"))
+	os.Symlink(filepath.Join(dir, "deploy.ps1"), filepath.Join(dir, "alias.ps1"))
+	lib, err := NewScriptLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err := lib.Resolve("deploy.ps1"); err != nil || path != filepath.Join(lib.dir, "deploy.ps1") {
+		t.Fatalf("resolve deploy.ps1 = %q, %v", path, err)
+	}
+	// 目录内的链接解析为实际的脚本
+	if path, err := lib.Resolve("alias.ps1"); err != nil || path != filepath.Join(lib.dir, "deploy.ps1") {
+		t.Fatalf("resolve alias.ps1 = %q, %v", path, err)
+	}
+	for name, want := range map[string]error{
+		"":                  errScriptOutside,
+		"../secret.ps1":     errScriptOutside,
+		"/etc/passwd":       errScriptOutside,
+		"a\x00b":            errScriptOutside,
+		"escape.ps1":        errScriptOutside,
+		"linked/secret.ps1": errScriptOutside,
+		"missing.ps1":       errScriptNotFound,
+		"tools":             errScriptNotFound,
+	} {
+		if _, err := lib.Resolve(name); !errors.Is(err, want) {
+			t.Errorf("resolve %q = %v, want %v", name, err, want)
+		}
+	}
+}
+
+func TestRunScriptRejectsEscapingSymlink(t *testing.T) {
+	ts := newTestServer(t, nil)
+	dir := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "secret.ps1")
+	os.WriteFile(secret, []byte("Write-Output secret"), 0644)
+	if err := os.Symlink(secret, filepath.Join(dir, "escape.ps1")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	lib, err := NewScriptLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptLibrary = lib
+	t.Cleanup(func() { scriptLibrary = nil })
+	id := ts.startSession(aliceToken, nil)
+
+	// 指向脚本目录外的链接与 .. 一样返回 400, 不执行链接指向的文件
+	for _, name := range []string{"escape.ps1", "../" + filepath.Base(filepath.Dir(secret)) + "/secret.ps1"} {
+		if resp, data := ts.run(aliceToken, id, "", map[string]any{"script": name}); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("script %q = %d %s", name, resp.StatusCode, data)
+		}
+	}
+	if records := history(t, id); len(records) != 0 {
+		t.Fatalf("rejected scripts recorded in history: %+v", records)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// redacted 替换机密值的文本
+	redacted = "[REDACTED]"
+	// minSecretLength 机密值的最小长度, 过短的值会把输出和日志中的普通文本一并替换
+	minSecretLength = 4
+)
+
+// validateEnv 检查会话环境变量的名称和值
+func validateEnv(env map[string]string, field string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("%w: %s: invalid variable name %q", errInvalidOptions, field, name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("%w: %s: value of %s contains NUL", errInvalidOptions, field, name)
+		}
+	}
+	return nil
+}
+
+// validateSecretEnv 在 validateEnv 之外要求机密值不短于 minSecretLength, 且不与 env 重名
+func (opts *SessionOptions) validateSecretEnv() error {
+	if err := validateEnv(opts.SecretEnv, "secret_env"); err != nil {
+		return err
+	}
+	for name, value := range opts.SecretEnv {
+		if len(value) < minSecretLength {
+			return fmt.Errorf("%w: secret_env: value of %s must be at least %d characters", errInvalidOptions, name, minSecretLength)
+		}
+		if _, exists := opts.Env[name]; exists {
+			return fmt.Errorf("%w: %s is set in both env and secret_env", errInvalidOptions, name)
+		}
+	}
+	return nil
+}
+
+// redactedValues 返回输出和日志中需要替换的机密值: secret_env 和远程凭据的密码
+// 短于 minSecretLength 的密码替换后会破坏正常输出, 不予替换
+func (opts *SessionOptions) redactedValues() map[string]string {
+	if opts.Remote == nil || len(opts.Remote.Password) < minSecretLength {
+		return opts.SecretEnv
+	}
+	values := map[string]string{remotePasswordEnv: opts.Remote.Password}
+	for name, value := range opts.SecretEnv {
+		values[name] = value
+	}
+	return values
+}
+
+// sessionEnviron 返回 shell 进程的环境变量: 从服务进程继承的环境加上会话设置的变量
+func sessionEnviron(base []string, opts SessionOptions) []string {
+	if len(opts.Env) == 0 && len(opts.SecretEnv) == 0 {
+		return base
+	}
+	env := append([]string(nil), base...)
+	for _, vars := range []map[string]string{opts.Env, opts.SecretEnv} {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			env = append(env, name+"="+vars[name])
+		}
+	}
+	return env
+}
+
+// secretValues 返回按长度从长到短排列的机密值, 较长的值优先匹配
+func secretValues(secretEnv map[string]string) [][]byte {
+	values := make([][]byte, 0, len(secretEnv))
+	for _, value := range secretEnv {
+		values = append(values, []byte(value))
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+// redactFilter 将输出中的机密值替换为 [REDACTED]
+// 数据块末尾可能是机密值前缀的内容暂存到下一次调用, 被拆分到两个数据块中的值也能替换
+type redactFilter struct {
+	secrets [][]byte
+	pending []byte
+}
+
+func newRedactFilter(secrets [][]byte) *redactFilter {
+	if len(secrets) == 0 {
+		return nil
+	}
+	return &redactFilter{secrets: secrets}
+}
+
+// filter 返回替换后可以写出的内容
+func (f *redactFilter) filter(b []byte) []byte {
+	return f.scan(append(f.pending, b...), false)
+}
+
+// flush 返回暂存的内容, 输出结束时调用
+func (f *redactFilter) flush() []byte {
+	return f.scan(f.pending, true)
+}
+
+func (f *redactFilter) scan(data []byte, final bool) []byte {
+	out := make([]byte, 0, len(data))
+	i := 0
+scan:
+	for i < len(data) {
+		rest := data[i:]
+		// 机密值从长到短排列, 剩余内容可能是较长机密值的开头时等待更多数据, 不先替换其中较短的值
+		for _, secret := range f.secrets {
+			if bytes.HasPrefix(rest, secret) {
+				out = append(out, redacted...)
+				i += len(secret)
+				continue scan
+			}
+			if !final && len(rest) < len(secret) && bytes.HasPrefix(secret, rest) {
+				break scan
+			}
+		}
+		out = append(out, data[i])
+		i++
+	}
+	f.pending = append([]byte(nil), data[i:]...)
+	return out
+}
+
+// SecretRegistry 所有会话的机密值, 用于替换日志中的机密值
+type SecretRegistry struct {
+	sessions map[string][]string
+	replacer *strings.Replacer
+	mu       sync.RWMutex
+}
+
+func NewSecretRegistry() *SecretRegistry {
+	return &SecretRegistry{sessions: make(map[string][]string)}
+}
+
+// Add 登记会话的机密值
+func (r *SecretRegistry) Add(sessionID string, secretEnv map[string]string) {
+	if len(secretEnv) == 0 {
+		return
+	}
+	values := make([]string, 0, len(secretEnv))
+	for _, value := range secretEnv {
+		values = append(values, value)
+	}
+	r.mu.Lock()
+	r.sessions[sessionID] = values
+	r.rebuild()
+	r.mu.Unlock()
+}
+
+// Remove 会话结束后移除其机密值
+func (r *SecretRegistry) Remove(sessionID string) {
+	r.mu.Lock()
+	if _, exists := r.sessions[sessionID]; exists {
+		delete(r.sessions, sessionID)
+		r.rebuild()
+	}
+	r.mu.Unlock()
+}
+
+// rebuild 重新生成替换器, 调用方需持有写锁
+func (r *SecretRegistry) rebuild() {
+	var values []string
+	for _, v := range r.sessions {
+		values = append(values, v...)
+	}
+	if len(values) == 0 {
+		r.replacer = nil
+		return
+	}
+	// strings.Replacer 在同一位置按参数顺序匹配, 较长的值放在前面
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact 替换 s 中所有会话的机密值
+func (r *SecretRegistry) Redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// redactingWriter 写出日志前替换其中的机密值和按 log_session_ids 处理会话 ID, log 每条日志调用一次 Write
+type redactingWriter struct {
+	w        io.Writer
+	registry *SecretRegistry
+}
+
+func (rw *redactingWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redactSessionIDs(rw.registry.Redact(string(b)))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+var secretRegistry = NewSecretRegistry()
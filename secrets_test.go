@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactFilterAcrossChunks(t *testing.T) {
+	secrets := secretValues(map[string]string{"A": "hunter2", "B": "hunter2-long"})
+	for _, chunks := range [][]string{
+		{"pass=hunter2-long; short=hunter2\n"},
+		{"pass=hun", "ter2-lo", "ng; short=hunter", "2\n"},
+		{"pass=hunter2-long; short=h", "u", "n", "t", "e", "r", "2", "\n"},
+	} {
+		f := newRedactFilter(secrets)
+		var out bytes.Buffer
+		for _, c := range chunks {
+			out.Write(f.filter([]byte(c)))
+		}
+		out.Write(f.flush())
+		if want := "pass=[REDACTED]; short=[REDACTED]\n"; out.String() != want {
+			t.Errorf("filter %q = %q, want %q", chunks, out.String(), want)
+		}
+	}
+
+	// 输出以机密值的前缀结束时原样写出
+	f := newRedactFilter(secrets)
+	out := append(f.filter([]byte("ends with hunt")), f.flush()...)
+	if string(out) != "ends with hunt" {
+		t.Fatalf("trailing prefix = %q", out)
+	}
+	if newRedactFilter(nil) != nil {
+		t.Fatal("filter without secrets is not nil")
+	}
+}
+
+func TestSecretEnvValidate(t *testing.T) {
+	tests := []struct {
+		opts SessionOptions
+		ok   bool
+	}{
+		{SessionOptions{SecretEnv: map[string]string{"API_KEY": "long-enough"}}, true},
+		{SessionOptions{SecretEnv: map[string]string{"API_KEY": "abc"}}, false},
+		{SessionOptions{SecretEnv: map[string]string{"A=B": "long-enough"}}, false},
+		{SessionOptions{Env: map[string]string{"API_KEY": "x"}, SecretEnv: map[string]string{"API_KEY": "long-enough"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.validateSecretEnv(); (err == nil) != tt.ok {
+			t.Errorf("validateSecretEnv(%v) = %v, want ok %t", tt.opts.SecretEnv, err, tt.ok)
+		}
+	}
+}
+
+func TestSecretEnvRedactedFromOutputAndLogs(t *testing.T) {
+	const secret = "hunter2-secret"
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.LogCommands = true
+		cfg.FakeOutputs = map[string]FakeOutput{"Get-Token": {Output: "key: " + secret + "\nend"}}
+	})
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&redactingWriter{w: &logs, registry: secretRegistry})
+	defer log.SetOutput(previous)
+
+	id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"API_KEY": secret}})
+	resp, data := ts.run(aliceToken, id, "Get-Token", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "key: [REDACTED]\nend" {
+		t.Fatalf("output = %d %q", resp.StatusCode, data)
+	}
+	// 命令文本中的机密值同样在日志中替换
+	if _, data = ts.run(aliceToken, id, "echo "+secret, nil); string(data) != redacted {
+		t.Fatalf("echo output = %q", data)
+	}
+	ts.post(aliceToken, "/end-session", map[string]any{"session_id": id})
+
+	log.SetOutput(previous)
+	if strings.Contains(logs.String(), secret) {
+		t.Fatalf("secret found in logs:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), redacted) {
+		t.Fatalf("logs do not contain the redacted output:\n%s", logs.String())
+	}
+	// 会话结束后不再替换其机密值
+	if got := secretRegistry.Redact(secret); got != secret {
+		t.Fatalf("secret still registered after the session ended: %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultSelfTestTimeout 自检命令的默认超时
+const defaultSelfTestTimeout = 30 * time.Second
+
+// canaryCommand 生成输出 token 的命令, token 只包含字母、数字、空格、- 和非 ASCII 字符, 不需要转义
+func canaryCommand(shellType ShellType, token string) string {
+	switch shellType {
+	case ShellBash:
+		return "printf '%s\\n' '" + token + "'"
+	case ShellCmd:
+		return "echo " + token
+	default:
+		return "Write-Output '" + token + "'"
+	}
+}
+
+// runSelfTest 启动时在 shell 预设中创建会话, 执行 canary 命令并检查输出, 之后结束会话
+// 输出中的非 ASCII 字符用于发现编码问题, 命令超时通常说明标记检测失败
+func runSelfTest(shellName string, timeout time.Duration) error {
+	// 自检会话不是客户端的会话, 不发送 webhook 事件
+	hook := webhook
+	webhook = nil
+	defer func() { webhook = hook }()
+
+	start := time.Now()
+	session, err := sessionManager.CreateSession("", SessionOptions{Shell: shellName})
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	defer sessionManager.EndSession(session.ID, true)
+
+	token := "rce-self-test ✓ " + uuid.New().String()
+	result, err := session.RunCommand(canaryCommand(session.shell.Type, token), RunOptions{Timeout: timeout, probe: true})
+	if err != nil {
+		return fmt.Errorf("canary command failed: %v", err)
+	}
+	if output := strings.TrimRight(result.Output, "\r\n"); output != token {
+		return fmt.Errorf("unexpected canary output %q, expected %q", output, token)
+	}
+	if result.ExitCode != nil && *result.ExitCode != 0 {
+		return fmt.Errorf("canary command exited with code %d", *result.ExitCode)
+	}
+
+	log.Printf("✓ Self-test passed | Shell: %s | Duration: %s", shellName, time.Since(start).Round(time.Millisecond))
+	return nil
+}
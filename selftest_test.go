@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanaryCommand(t *testing.T) {
+	tests := map[ShellType]string{
+		ShellBash:       "printf '%s\\n' 'rce ✓ 1'",
+		ShellCmd:        "echo rce ✓ 1",
+		ShellPowerShell: "Write-Output 'rce ✓ 1'",
+	}
+	for shellType, want := range tests {
+		if got := canaryCommand(shellType, "rce ✓ 1"); got != want {
+			t.Errorf("canary for %s = %q, want %q", shellType, got, want)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	newTestServer(t, nil)
+	// 模拟 shell 回显 Write-Output 的参数
+	if err := runSelfTest("pwsh", 5*time.Second); err != nil {
+		t.Fatalf("self-test = %v", err)
+	}
+	// 自检会话结束后不保留
+	if n := len(sessionManager.snapshot()); n != 0 {
+		t.Fatalf("%d sessions left after self-test", n)
+	}
+
+	// 模拟 shell 不执行 printf, 输出不符时失败
+	if err := runSelfTest("bash", 5*time.Second); err == nil || !strings.Contains(err.Error(), "unexpected canary output") {
+		t.Fatalf("self-test with wrong output = %v", err)
+	}
+	if err := runSelfTest("fish", 5*time.Second); err == nil {
+		t.Fatal("self-test with unknown shell passed")
+	}
+}
+
+func TestSelfTestRealShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	newTestServer(t, nil)
+	spawner = execSpawner{}
+	if err := runSelfTest("bash", 10*time.Second); err != nil {
+		t.Fatalf("self-test = %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = time.Minute
+	defaultWriteTimeout      = time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultTCPKeepAlive      = 30 * time.Second
+	defaultMaxHeaderBytes    = http.DefaultMaxHeaderBytes
+	defaultUnixSocketMode    = "0600"
+	// listenerShutdownTimeout 任一监听出错后等待其余监听上的请求结束的时间
+	listenerShutdownTimeout = 5 * time.Second
+)
+
+// ListenerConfig 额外的监听, 可以使用与 addr 不同的 TLS 设置, 只提供部分接口
+// 例如迁移到 TLS 期间同时提供 HTTP 和 HTTPS, 或在单独的明文端口上只提供 /metrics
+type ListenerConfig struct {
+	// Addr TCP 监听地址, 与 UnixSocket 二选一
+	Addr string `json:"addr"`
+	// UnixSocket Unix 域套接字的路径, 权限为 unix_socket_mode
+	UnixSocket string `json:"unix_socket"`
+	// TLS 设置后以 HTTPS 提供服务, 为空时为 HTTP, 不继承顶层的 tls
+	TLS *TLSConfig `json:"tls"`
+	// Routes 只提供这些路径, 其余路径返回 404, 为空时提供全部接口
+	Routes []string `json:"routes"`
+}
+
+func (l *ListenerConfig) validate() error {
+	if (l.Addr == "") == (l.UnixSocket == "") {
+		return fmt.Errorf("exactly one of addr and unix_socket is required")
+	}
+	if l.TLS != nil {
+		if err := l.TLS.validate(); err != nil {
+			return err
+		}
+	}
+	for _, route := range l.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("route %q must start with /", route)
+		}
+	}
+	return nil
+}
+
+// name 日志中的监听名称
+func (l *ListenerConfig) name() string {
+	if l.Addr != "" {
+		return l.Addr
+	}
+	return l.UnixSocket
+}
+
+// listenerConfigs 返回所有监听: 顶层的 addr 和 unix_socket 使用顶层的 tls 并提供全部接口, 之后是 listeners
+func (c *Config) listenerConfigs() []ListenerConfig {
+	var listeners []ListenerConfig
+	if c.Addr != "" {
+		listeners = append(listeners, ListenerConfig{Addr: c.Addr, TLS: c.TLS})
+	}
+	if c.UnixSocket != "" {
+		listeners = append(listeners, ListenerConfig{UnixSocket: c.UnixSocket, TLS: c.TLS})
+	}
+	return append(listeners, c.Listeners...)
+}
+
+// verifiesClients 是否有监听验证客户端证书
+func (c *Config) verifiesClients() bool {
+	for _, l := range c.listenerConfigs() {
+		if l.TLS != nil && l.TLS.verifiesClients() {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyRoutes 只把 routes 中的路径交给 next, 其余路径按不存在处理
+func onlyRoutes(next http.Handler, routes []string) http.Handler {
+	if len(routes) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		allowed[route] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.URL.Path] {
+			handleNotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newServer 创建带超时设置的 HTTP 服务
+// 不设置 http.Server 的 WriteTimeout: 它从读完请求开始计时, 会截断执行时间较长的命令,
+// 改由 writeDeadline 在每次写出响应时设置写超时, 等待命令执行的时间不计入
+func newServer(cfg *Config, handler http.Handler, tlsCfg *TLSConfig) (*http.Server, error) {
+	if cfg.InstanceID != "" {
+		handler = withAffinity(handler)
+	}
+	if tracer != nil {
+		handler = withTracing(handler)
+	}
+	srv := &http.Server{
+		Handler:           writeDeadline(withRequestID(handler), time.Duration(cfg.WriteTimeout)),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		// 请求头超过上限时 net/http 返回 431 并关闭连接
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if tlsCfg != nil {
+		tlsConfig, err := tlsCfg.serverConfig()
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	return srv, nil
+}
+
+// listenAndServe 在所有配置的监听上提供服务, 每个监听有各自的 TLS 设置和接口范围
+// 任一监听出错时关闭其余监听并返回该错误
+func listenAndServe(cfg *Config, handler http.Handler) error {
+	type server struct {
+		ln  net.Listener
+		srv *http.Server
+		tls *TLSConfig
+	}
+	var servers []server
+	closeAll := func() {
+		for _, s := range servers {
+			s.ln.Close()
+		}
+	}
+	for _, l := range cfg.listenerConfigs() {
+		srv, err := newServer(cfg, onlyRoutes(handler, l.Routes), l.TLS)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listener %s: %v", l.name(), err)
+		}
+		var ln net.Listener
+		if l.Addr != "" {
+			ln, err = listenTCP(l.Addr, time.Duration(cfg.TCPKeepAlive))
+		} else {
+			mode, _ := cfg.unixSocketMode()
+			ln, err = listenUnix(l.UnixSocket, mode)
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+		ln = connLimiter.wrap(ln)
+		servers = append(servers, server{ln: ln, srv: srv, tls: l.TLS})
+		log.Printf("✓ Listening | Network: %s | Address: %s | TLS: %t | Routes: %s", ln.Addr().Network(), ln.Addr(), l.TLS != nil, formatRoutes(l.Routes))
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s server) {
+			if s.tls != nil {
+				errs <- s.srv.ServeTLS(s.ln, s.tls.CertFile, s.tls.KeyFile)
+				return
+			}
+			errs <- s.srv.Serve(s.ln)
+		}(s)
+	}
+	err := <-errs
+
+	log.Printf("✗ Listener failed, shutting down all listeners | Error: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), listenerShutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if s.srv.Shutdown(ctx) != nil {
+			s.srv.Close()
+		}
+	}
+	tracer.shutdown(ctx)
+	return err
+}
+
+// formatRoutes 日志中的接口范围
+func formatRoutes(routes []string) string {
+	if len(routes) == 0 {
+		return "all"
+	}
+	return strings.Join(routes, ",")
+}
+
+// listenTCP 按配置的 keep-alive 间隔监听 TCP, keepAlive 为 0 时关闭 keep-alive
+func listenTCP(addr string, keepAlive time.Duration) (net.Listener, error) {
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return ln, nil
+}
+
+// listenUnix 监听 Unix 域套接字并设置文件权限, 只有能访问该文件的本机进程可以连接
+// 上次运行遗留的套接字文件会被删除, 同名的普通文件不会被覆盖
+// Windows 10 1803 及以上版本同样支持 Unix 域套接字, 权限由文件所在目录的 ACL 控制
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("failed to listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return ln, nil
+}
+
+// unixSocketMode 解析 unix_socket_mode
+func (c *Config) unixSocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("unix_socket_mode must be an octal permission such as 0600")
+	}
+	return os.FileMode(mode), nil
+}
+
+// requestIDHeader 请求 ID 所在的请求头和响应头
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength 客户端提供的请求 ID 的最大长度
+const maxRequestIDLength = 64
+
+// withRequestID 为每个请求设置响应头 X-Request-ID
+// 沿用客户端提供的合法请求 ID, 否则生成新的 ID
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID 只接受字母、数字和 -_. 组成的 ID, 避免客户端的内容进入响应头和日志
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeDeadline 每次写出响应前把写超时设为 timeout 之后, timeout 为 0 时不限制
+// 客户端读取过慢时连接在 timeout 后断开, 大文件下载只要持续有进展就不会超时
+func writeDeadline(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&deadlineWriter{ResponseWriter: w, rc: http.NewResponseController(w), timeout: timeout}, r)
+	})
+}
+
+// deadlineWriter 写出前延长连接的写超时
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) extend() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+}
+
+func (w *deadlineWriter) WriteHeader(status int) {
+	w.extend()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap 供 http.ResponseController 访问底层连接
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
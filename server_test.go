@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListenerConfigValidate(t *testing.T) {
+	tests := []struct {
+		l  ListenerConfig
+		ok bool
+	}{
+		{ListenerConfig{Addr: ":8080"}, true},
+		{ListenerConfig{UnixSocket: "/run/rce.sock", Routes: []string{"/metrics"}}, true},
+		{ListenerConfig{}, false},
+		{ListenerConfig{Addr: ":8080", UnixSocket: "/run/rce.sock"}, false},
+		{ListenerConfig{Addr: ":8080", Routes: []string{"metrics"}}, false},
+		{ListenerConfig{Addr: ":8443", TLS: &TLSConfig{CertFile: "c"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.l.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok %t", tt.l, err, tt.ok)
+		}
+	}
+}
+
+func TestListenerConfigs(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Addr = ":8080"
+	cfg.UnixSocket = "/run/rce.sock"
+	cfg.Listeners = []ListenerConfig{{Addr: ":9090", Routes: []string{"/metrics"}}}
+	listeners := cfg.listenerConfigs()
+	if len(listeners) != 3 || listeners[0].Addr != ":8080" || listeners[1].UnixSocket != "/run/rce.sock" || listeners[2].Addr != ":9090" {
+		t.Fatalf("listeners = %+v", listeners)
+	}
+	if len(listeners[0].Routes) != 0 || len(listeners[1].Routes) != 0 {
+		t.Fatal("top-level listeners do not serve all routes")
+	}
+}
+
+func TestUnixSocketMode(t *testing.T) {
+	cfg := DefaultConfig()
+	for mode, ok := range map[string]bool{"0600": true, "660": true, "0777": true, "1777": false, "rw": false, "": false} {
+		cfg.UnixSocketMode = mode
+		if _, err := cfg.unixSocketMode(); (err == nil) != ok {
+			t.Errorf("unixSocketMode(%q) = %v, want ok %t", mode, err, ok)
+		}
+	}
+}
+
+func TestOnlyRoutes(t *testing.T) {
+	handler := onlyRoutes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{"/metrics"})
+	for path, want := range map[string]int{"/metrics": http.StatusOK, "/run-command": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestVerifiesClients(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Addr = ":8080"
+	if cfg.verifiesClients() {
+		t.Fatal("plain HTTP verifies clients")
+	}
+	// 只在额外的监听上验证客户端证书
+	cfg.Listeners = []ListenerConfig{{Addr: ":8443", TLS: &TLSConfig{CertFile: "c", KeyFile: "k", ClientCAFile: "ca", ClientAuth: ClientAuthRequire}}}
+	if !cfg.verifiesClients() {
+		t.Fatal("client certificates on an additional listener not detected")
+	}
+}
+
+func TestConfigWithOnlyListeners(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Addr = ""
+	cfg.Listeners = []ListenerConfig{{Addr: "127.0.0.1:9090"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("listeners without addr = %v", err)
+	}
+	cfg.Listeners = []ListenerConfig{{Routes: []string{"/metrics"}}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "listeners[0]") {
+		t.Fatalf("invalid listener = %v", err)
+	}
+	cfg.Listeners = nil
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("config without any listener accepted")
+	}
+}
+
+func TestListenAndServeClosesListenersOnError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	cfg := DefaultConfig()
+	cfg.Addr = freeAddr
+	cfg.Listeners = []ListenerConfig{{Addr: busy.Addr().String(), Routes: []string{"/metrics"}}}
+	initTestGlobals(t, cfg)
+	// 第二个监听失败时返回错误, 已打开的监听被关闭
+	if err := listenAndServe(cfg, http.NewServeMux()); err == nil || !strings.Contains(err.Error(), busy.Addr().String()) {
+		t.Fatalf("listenAndServe = %v", err)
+	}
+	ln, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("first listener left open: %v", err)
+	}
+	ln.Close()
+}
+
+func TestFormatRoutes(t *testing.T) {
+	if got := formatRoutes(nil); got != "all" {
+		t.Errorf("formatRoutes(nil) = %q", got)
+	}
+	if got := formatRoutes([]string{"/metrics", "/healthz"}); got != "/metrics,/healthz" {
+		t.Errorf("formatRoutes = %q", got)
+	}
+}
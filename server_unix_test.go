@@ -0,0 +1,106 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// shortTempDir 返回较短的临时目录, Unix 域套接字的路径长度有限, t.TempDir 可能过长
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "rce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "rce.sock")
+	ln, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 || fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("socket file = %v, %v", fi.Mode(), err)
+	}
+	ln.Close()
+
+	// 上次运行遗留的套接字文件被替换
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if ln, err = listenUnix(path, 0660); err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	ln.Close()
+
+	// 同名的普通文件不会被覆盖
+	file := filepath.Join(filepath.Dir(path), "file")
+	os.WriteFile(file, []byte("keep"), 0600)
+	if _, err := listenUnix(file, 0600); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "keep" {
+		t.Fatalf("regular file overwritten: %q", data)
+	}
+}
+
+func TestServeOverUnixSocket(t *testing.T) {
+	ts := newTestServer(t, nil)
+	path := filepath.Join(shortTempDir(t), "rce.sock")
+	ln, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerRoutes(mux, ts.cfg)
+	srv, err := newServer(ts.cfg, mux, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	// 同样的接口和认证通过 Unix 域套接字提供
+	req, _ := http.NewRequest(http.MethodGet, "http://unix/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var who WhoamiResponse
+	decodeJSON(t, data, &who)
+	if resp.StatusCode != http.StatusOK || who.Tenant != "alice" || resp.Header.Get(requestIDHeader) == "" {
+		t.Fatalf("whoami over unix socket = %d %s", resp.StatusCode, data)
+	}
+
+	resp, err = client.Get("http://unix/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("request without token over unix socket = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sessionSettings 创建会话后可通过 /session-config 调整的设置, 整体替换, 读取时不获取 s.mu
+type sessionSettings struct {
+	// commandTimeout 单条命令的最长执行时间, 0 表示不限制
+	commandTimeout time.Duration
+	// maxOutput 客户端命令在内存中保留的输出上限(字节), 不超过 maxOutputSize
+	maxOutput int
+	// maxLines 客户端命令未指定 max_lines 时只返回的行数, 0 表示不限制
+	maxLines int
+}
+
+// settings 返回会话当前的设置
+func (s *Session) settings() *sessionSettings {
+	return s.runtimeSettings.Load()
+}
+
+// SessionConfigRequest 查询或调整会话设置的参数, 为空的字段保持不变
+type SessionConfigRequest struct {
+	SessionID string `json:"session_id"`
+	// CommandTimeoutMs 会话的命令超时(毫秒), 0 表示恢复为服务端的 command_timeout
+	CommandTimeoutMs *int64 `json:"command_timeout_ms"`
+	// MaxOutputBytes 命令在内存中保留的输出上限, 0 表示恢复为服务端上限
+	MaxOutputBytes *int `json:"max_output_bytes"`
+	// MaxLines 命令未指定 max_lines 时只返回的行数, 0 表示不限制
+	MaxLines *int `json:"max_lines"`
+}
+
+// SessionConfigResponse 会话生效的设置
+type SessionConfigResponse struct {
+	SessionID string `json:"session_id"`
+	// CommandTimeoutMs 0 表示不限制
+	CommandTimeoutMs int64 `json:"command_timeout_ms"`
+	MaxOutputBytes   int   `json:"max_output_bytes"`
+	MaxLines         int   `json:"max_lines"`
+	// Clamped 超过服务端上限而被限制为上限的字段
+	Clamped []string `json:"clamped,omitempty"`
+}
+
+func newSessionConfigResponse(sessionID string, settings *sessionSettings, clamped []string) *SessionConfigResponse {
+	return &SessionConfigResponse{
+		SessionID:        sessionID,
+		CommandTimeoutMs: settings.commandTimeout.Milliseconds(),
+		MaxOutputBytes:   settings.maxOutput,
+		MaxLines:         settings.maxLines,
+		Clamped:          clamped,
+	}
+}
+
+// updateSettings 按请求调整会话设置, 超过服务端上限的值被限制为上限, 返回被限制的字段
+// 正在执行的命令不受影响, 之后的命令使用新的设置
+func (s *Session) updateSettings(req SessionConfigRequest) (*sessionSettings, []string, error) {
+	if (req.CommandTimeoutMs != nil && *req.CommandTimeoutMs < 0) || (req.MaxOutputBytes != nil && *req.MaxOutputBytes < 0) || (req.MaxLines != nil && *req.MaxLines < 0) {
+		return nil, nil, fmt.Errorf("command_timeout_ms, max_output_bytes and max_lines must not be negative")
+	}
+
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	next := *s.settings()
+	var clamped []string
+	if req.CommandTimeoutMs != nil {
+		timeout := time.Duration(*req.CommandTimeoutMs) * time.Millisecond
+		serverMax := currentSettings().commandTimeout
+		switch {
+		case timeout == 0:
+			timeout = serverMax
+		case serverMax > 0 && timeout > serverMax:
+			timeout = serverMax
+			clamped = append(clamped, "command_timeout_ms")
+		}
+		next.commandTimeout = timeout
+	}
+	if req.MaxOutputBytes != nil {
+		size := *req.MaxOutputBytes
+		switch {
+		case size == 0:
+			size = maxOutputSize
+		case size > maxOutputSize:
+			size = maxOutputSize
+			clamped = append(clamped, "max_output_bytes")
+		}
+		next.maxOutput = size
+	}
+	if req.MaxLines != nil {
+		next.maxLines = *req.MaxLines
+	}
+	s.runtimeSettings.Store(&next)
+	return &next, clamped, nil
+}
+
+// API22: 查询(GET)或调整(POST)会话的命令超时和输出限制
+func handleSessionConfig(w http.ResponseWriter, r *http.Request) {
+	var req SessionConfigRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.SessionID = r.URL.Query().Get("session_id")
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("✗ Invalid request body | Error: %v", err)
+			writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+			return
+		}
+	default:
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	if req.SessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "session_id is required"))
+		return
+	}
+	if err := validateSessionID(req.SessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+	identity := identityFrom(r)
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		writeError(w, sessionNotFound(req.SessionID, identity))
+		return
+	}
+
+	settings := session.settings()
+	var clamped []string
+	if r.Method == http.MethodPost {
+		log.Printf("→ Request: Update session config | SessionID: %s", req.SessionID)
+		var err error
+		settings, clamped, err = session.updateSettings(req)
+		if err != nil {
+			log.Printf("✗ Invalid session config | SessionID: %s | Error: %v", req.SessionID, err)
+			writeError(w, newAPIError(http.StatusBadRequest, "%v", err))
+			return
+		}
+		message := fmt.Sprintf("command_timeout=%s max_output_bytes=%d max_lines=%d", settings.commandTimeout, settings.maxOutput, settings.maxLines)
+		session.addEvent("config_updated", message)
+		log.Printf("✓ Session config updated | SessionID: %s | Timeout: %s | Max output: %d bytes | Max lines: %d | Clamped: %v",
+			req.SessionID, settings.commandTimeout, settings.maxOutput, settings.maxLines, clamped)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newSessionConfigResponse(req.SessionID, settings, clamped))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionConfig 查询(body 为 nil)或调整会话设置
+func (ts *testServer) sessionConfig(token, id string, body map[string]any) (int, SessionConfigResponse) {
+	ts.t.Helper()
+	var resp *http.Response
+	var data []byte
+	if body == nil {
+		resp, data = ts.do(http.MethodGet, token, "/session-config?session_id="+id, nil)
+	} else {
+		body["session_id"] = id
+		resp, data = ts.post(token, "/session-config", body)
+	}
+	var out SessionConfigResponse
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out
+}
+
+func TestSessionConfigClampsToServerLimits(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.CommandTimeout = Duration(time.Minute) })
+	id := ts.startSession(aliceToken, nil)
+
+	status, out := ts.sessionConfig(aliceToken, id, nil)
+	if status != http.StatusOK || out.CommandTimeoutMs != 60000 || out.MaxOutputBytes != maxOutputSize || out.MaxLines != 0 {
+		t.Fatalf("initial config = %d %+v", status, out)
+	}
+	// 超过服务端上限的值限制为上限, 未给出的字段不变
+	status, out = ts.sessionConfig(aliceToken, id, map[string]any{"command_timeout_ms": 120000, "max_output_bytes": maxOutputSize * 2, "max_lines": 5})
+	if status != http.StatusOK || out.CommandTimeoutMs != 60000 || out.MaxOutputBytes != maxOutputSize || out.MaxLines != 5 ||
+		strings.Join(out.Clamped, ",") != "command_timeout_ms,max_output_bytes" {
+		t.Fatalf("clamped config = %d %+v", status, out)
+	}
+	status, out = ts.sessionConfig(aliceToken, id, map[string]any{"command_timeout_ms": 500, "max_output_bytes": 1024})
+	if status != http.StatusOK || out.CommandTimeoutMs != 500 || out.MaxOutputBytes != 1024 || out.MaxLines != 5 || out.Clamped != nil {
+		t.Fatalf("reduced config = %d %+v", status, out)
+	}
+	// 0 恢复为服务端的值
+	if status, out = ts.sessionConfig(aliceToken, id, map[string]any{"command_timeout_ms": 0, "max_output_bytes": 0}); out.CommandTimeoutMs != 60000 || out.MaxOutputBytes != maxOutputSize {
+		t.Fatalf("reset config = %d %+v", status, out)
+	}
+
+	if status, _ = ts.sessionConfig(aliceToken, id, map[string]any{"max_lines": -1}); status != http.StatusBadRequest {
+		t.Fatalf("negative max_lines = %d", status)
+	}
+	if status, _ = ts.sessionConfig(bobToken, id, nil); status != http.StatusNotFound {
+		t.Fatalf("other tenant = %d", status)
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "config_updated" {
+		t.Fatalf("last event = %+v", last)
+	}
+}
+
+func TestSessionConfigAppliesToCommands(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Get-Lines": {Output: "1\n2\n3"},
+			"Long-Job":  {Output: "partial", DelayMs: 2000},
+		}
+	})
+	id := ts.startSession(aliceToken, nil)
+	ts.sessionConfig(aliceToken, id, map[string]any{"command_timeout_ms": 100, "max_lines": 1})
+
+	resp, data := ts.run(aliceToken, id, "Get-Lines", nil)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "1\n") || strings.Contains(string(data), "2") {
+		t.Fatalf("max_lines from session config = %d %q", resp.StatusCode, data)
+	}
+	// 请求中的 max_lines 优先
+	if resp, data = ts.run(aliceToken, id, "Get-Lines", map[string]any{"max_lines": 3}); string(data) != "1\n2\n3" {
+		t.Fatalf("request max_lines = %d %q", resp.StatusCode, data)
+	}
+	start := time.Now()
+	if resp, data = ts.run(aliceToken, id, "Long-Job", nil); resp.StatusCode != http.StatusGatewayTimeout || errorCodeOf(t, data) != codeCommandTimeout {
+		t.Fatalf("timeout from session config = %d %s", resp.StatusCode, data)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("command ran for %s", elapsed)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ShellType 决定 shell 的命令包装和标记输出方式
+type ShellType string
+
+const (
+	ShellPowerShell ShellType = "powershell"
+	ShellBash       ShellType = "bash"
+	ShellCmd        ShellType = "cmd"
+)
+
+// defaultShell 未指定 shell 时使用的预设
+const defaultShell = "powershell"
+
+// shellInitScript PowerShell 启动时执行的初始化脚本, 重启时会重新执行
+// 设置所有编码为 UTF-8 以避免中文乱码
+const shellInitScript = "[Console]::OutputEncoding = [System.Text.Encoding]::UTF8; [Console]::InputEncoding = [System.Text.Encoding]::UTF8; $OutputEncoding = [System.Text.Encoding]::UTF8"
+
+// ShellPreset 可供会话选择的 shell 配置
+type ShellPreset struct {
+	Type ShellType `json:"type"`
+	Path string    `json:"path"`
+	Args []string  `json:"args"`
+}
+
+// defaultShellPresets 内置的 shell 预设, 可在配置中覆盖或追加
+func defaultShellPresets() map[string]*ShellPreset {
+	// -NoProfile: 不加载 PowerShell 配置文件
+	// -NoLogo: 不显示版权信息
+	// -NoExit: 执行命令后不退出
+	psArgs := []string{"-NoProfile", "-NoLogo", "-NoExit", "-InputFormat", "Text", "-OutputFormat", "Text", "-Command", shellInitScript}
+
+	return map[string]*ShellPreset{
+		"powershell": {Type: ShellPowerShell, Path: "powershell.exe", Args: psArgs},
+		"pwsh":       {Type: ShellPowerShell, Path: "pwsh", Args: psArgs},
+		// /Q: 关闭命令回显, /V:ON: 启用延迟变量展开以读取命令执行后的 errorlevel
+		"cmd":  {Type: ShellCmd, Path: "cmd.exe", Args: []string{"/Q", "/V:ON", "/K", "chcp 65001 >nul"}},
+		"bash": {Type: ShellBash, Path: "bash", Args: []string{"--noprofile", "--norc"}},
+	}
+}
+
+// validate 检查预设是否合法
+func (p *ShellPreset) validate() error {
+	switch p.Type {
+	case ShellPowerShell, ShellBash, ShellCmd:
+	default:
+		return fmt.Errorf("unknown shell type %q", p.Type)
+	}
+	if p.Path == "" {
+		return fmt.Errorf("shell path is required")
+	}
+	return nil
+}
+
+// errShellUnavailable 预设的 shell 没有安装在服务端
+var errShellUnavailable = errors.New("shell is not installed on the server")
+
+// installed 预设的可执行文件是否存在, 不带路径时在 PATH 中查找; no_exec 时总是存在
+func (p *ShellPreset) installed() bool {
+	return spawner.available(p)
+}
+
+// shellUnavailable 返回给客户端的 shell 未安装错误, 可执行文件的路径只记录在日志中
+func shellUnavailable(name string, p *ShellPreset) error {
+	log.Printf("✗ Shell not installed | Shell: %s | Path: %s", name, p.Path)
+	hint := "install it or set its path in the shells config"
+	if p.Type == ShellPowerShell {
+		hint = "install PowerShell, set its path in the shells config, or start the session with another shell such as bash"
+	}
+	return fmt.Errorf("%w: %s; %s", errShellUnavailable, name, hint)
+}
+
+// checkShells 启动时检查各预设的可执行文件, 未安装的预设只记录警告, 全部未安装时返回错误
+func checkShells(shells map[string]*ShellPreset, defaultShell string) error {
+	installed := 0
+	for name, shell := range shells {
+		if shell.installed() {
+			installed++
+			continue
+		}
+		log.Printf("⚠ Shell not installed, sessions using it will fail | Shell: %s | Path: %s", name, shell.Path)
+	}
+	if installed == 0 {
+		return fmt.Errorf("none of the configured shells is installed")
+	}
+	if !shells[defaultShell].installed() {
+		log.Printf("⚠ Default shell is not installed, sessions must specify another shell | Shell: %s", defaultShell)
+	}
+	return nil
+}
+
+// frameOptions 单条命令的输出方式
+type frameOptions struct {
+	// jsonDepth 大于 0 时以 JSON 输出命令返回的对象, 仅 PowerShell 支持
+	jsonDepth int
+	// constrained 为 true 时命令在受限语言模式的 runspace 中执行, 仅 PowerShell 支持
+	constrained bool
+	// remote 为 true 时命令通过 Invoke-Command 在远程会话中执行, 仅 PowerShell 支持
+	remote bool
+	// console 为 true 时 PowerShell 的标记直接写入 [Console]::Out 而不是经过 Write-Host
+	console bool
+	// raw 为 true 时结束标记之前固定输出一个换行, 命令输出的结尾原样保留;
+	// PowerShell 中命令返回的 byte 和 byte[] 直接写入标准输出
+	raw bool
+	// flush 为 true 时 PowerShell 命令返回的每个对象单独格式化并立即刷新标准输出
+	flush bool
+	// env 命令执行期间设置的环境变量, 命令结束后恢复原值, cmd 不支持
+	env []envVar
+	// structuredErrors 为 true 时 PowerShell 命令抛出的终止错误以 JSON 附加在结束标记之后, 不写入输出
+	structuredErrors bool
+}
+
+// rawSeparator 原始字节模式下 frame 在结束标记之前输出的分隔符
+func (p *ShellPreset) rawSeparator() []byte {
+	if p.Type == ShellCmd {
+		return []byte("\r\n")
+	}
+	return []byte("\n")
+}
+
+// frame 生成写入 stdin 的完整命令
+// 标记模式下先输出开始标记, 用于跳过之前超时命令的残留输出, 结束标记后附带退出码
+// PowerShell 命令抛出终止错误时输出错误记录, 并在退出码之后附加 statusThrew
+func (p *ShellPreset) frame(command, marker string, terminator Terminator, opts frameOptions) string {
+	begin := beginMarkerPrefix + marker
+	end := marker + exitCodeSeparator
+
+	switch p.Type {
+	case ShellBash:
+		// 环境变量在结束标记之后恢复, 不影响命令的退出码
+		setup, restore := envScope(p.Type, opts.env)
+		if restore != "" {
+			restore = "; " + restore
+		}
+		if terminator == TerminatorQuiescence {
+			return fmt.Sprintf("%s{ %s\n} 2>&1%s\n", setup, command, restore)
+		}
+		if opts.raw {
+			return fmt.Sprintf("%secho '%s'; { %s\n} 2>&1; printf '\\n%s%%d\\n' \"$?\"%s\n", setup, begin, command, end, restore)
+		}
+		return fmt.Sprintf("%secho '%s'; { %s\n} 2>&1; echo \"%s$?\"%s\n", setup, begin, command, end, restore)
+	case ShellCmd:
+		if terminator == TerminatorQuiescence {
+			return fmt.Sprintf("(%s) 2>&1\n", command)
+		}
+		if opts.raw {
+			return fmt.Sprintf("echo %s & (%s) 2>&1 & echo.& echo %s!errorlevel!\n", begin, command, end)
+		}
+		return fmt.Sprintf("echo %s & (%s) 2>&1 & echo %s!errorlevel!\n", begin, command, end)
+	default:
+		// 命令以 base64 传入, 整条输入只有一行, 命令中的换行和未闭合的括号不会让 shell 等待后续输入
+		// 执行前先用 PowerShell 解析器检查, 不完整或有语法错误的命令不执行
+		src := fmt.Sprintf("$__rceSrc = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String('%s')); ", base64.StdEncoding.EncodeToString([]byte(command)))
+		separator := ""
+		if opts.raw {
+			src += "$__rceStdout = [Console]::OpenStandardOutput(); "
+			separator = "[Console]::Out.Flush(); $__rceStdout.WriteByte(10); $__rceStdout.Flush(); "
+		}
+		setup, restore := envScope(p.Type, opts.env)
+		if restore != "" {
+			restore += "; "
+		}
+		if terminator == TerminatorQuiescence {
+			// 静默模式不输出标记, 依靠输出停止来判断命令结束
+			return src + setup + psInvoke(opts) + strings.TrimSuffix("; "+restore, "; ") + "\n"
+		}
+		write := psWriteLine(opts.console)
+		catch := "$_ | Out-String -Stream; $__rceThrew = '" + statusThrew + "'"
+		if opts.structuredErrors {
+			catch = psCatchException
+		}
+		return fmt.Sprintf("%s; %s"+
+			"$__rceErrors = $null; [void][System.Management.Automation.Language.Parser]::ParseInput($__rceSrc, [ref]$null, [ref]$__rceErrors); "+
+			"if ($__rceErrors | Where-Object { $_.IncompleteInput }) { %s } "+
+			"elseif ($__rceErrors) { $__rceErrors | ForEach-Object { %s }; %s } "+
+			"else { %s$global:LASTEXITCODE = 0; $__rceThrew = ''; $__rceException = ''; try { %s } catch { %s }; "+
+			"%s%s%s }\n",
+			write("'"+begin+"'"), src, write("'"+end+statusIncomplete+"'"),
+			write("$_.ToString()"), write("'"+end+statusSyntaxError+"'"),
+			setup, psInvoke(opts), catch, restore, separator, write("('"+end+"' + $global:LASTEXITCODE + $__rceThrew + $__rceException)"))
+	}
+}
+
+// psWriteLine 返回输出一行标记的函数
+// 默认使用 Write-Host; console 为 true 时直接写入 [Console]::Out, 命令重定向或屏蔽
+// Information 流(如覆盖 Write-Host、设置 $PSDefaultParameterValues)时标记仍然输出
+func psWriteLine(console bool) func(expr string) string {
+	if console {
+		return func(expr string) string { return "[Console]::Out.WriteLine(" + expr + "); [Console]::Out.Flush()" }
+	}
+	return func(expr string) string { return "Write-Host " + expr }
+}
+
+// psQuoteReplacer PowerShell 把这些弯引号也当作单引号, 转义时一并加倍
+var psQuoteReplacer = strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019", "\u201a", "\u201a\u201a", "\u201b", "\u201b\u201b")
+
+// psQuote 返回 PowerShell 单引号字符串字面量
+func psQuote(s string) string {
+	return "'" + psQuoteReplacer.Replace(s) + "'"
+}
+
+// bashQuote 返回 bash 单引号字符串字面量
+func bashQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// psInvoke 执行 $__rceSrc 中命令的 PowerShell 语句
+// 使用 *>&1 将所有输出流(包括错误)重定向到标准输出
+func psInvoke(opts frameOptions) string {
+	invoke := "& ([scriptblock]::Create($__rceSrc)) *>&1"
+	if opts.constrained {
+		invoke = psConstrainedInvoke + " *>&1"
+	}
+	if opts.remote {
+		invoke = psRemoteInvoke + " *>&1"
+	}
+	// flush 时每个对象单独经过 Out-Default, 不会被 Format-Table 等为计算列宽而暂存
+	text := "$_ | Out-String -Stream"
+	if opts.flush {
+		text = "$_ | Out-String -Stream | Out-Default; [Console]::Out.Flush()"
+	}
+	if opts.raw {
+		// 写入原始字节前先刷新文本输出, 保持两者的先后顺序
+		return invoke + " | ForEach-Object { " +
+			"if ($_ -is [byte[]]) { [Console]::Out.Flush(); $__rceStdout.Write($_, 0, $_.Length); $__rceStdout.Flush() } " +
+			"elseif ($_ -is [byte]) { [Console]::Out.Flush(); $__rceStdout.WriteByte($_); $__rceStdout.Flush() } " +
+			"else { " + text + " } }"
+	}
+	if opts.flush && opts.jsonDepth <= 0 {
+		return invoke + " | ForEach-Object { " + text + " }"
+	}
+	if opts.jsonDepth <= 0 {
+		// Out-String -Stream 逐行输出, 命令超时时已产生的输出不会丢失
+		return invoke + " | Out-String -Stream"
+	}
+	// 输出总是数组, 对象无法序列化时退回文本输出
+	return fmt.Sprintf("$__rceOut = %s; "+
+		"try { ConvertTo-Json -InputObject @($__rceOut) -Depth %d -Compress -ErrorAction Stop } "+
+		"catch { $__rceOut | Out-String -Stream }", invoke, opts.jsonDepth)
+}
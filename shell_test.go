@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShellPresetsSelectablePerSession(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"fail": {Output: "failed", ExitCode: 2}}
+		cfg.Shells["sh"] = &ShellPreset{Type: ShellBash, Path: "/bin/sh"}
+	})
+
+	for _, shell := range []string{"", "powershell", "pwsh", "cmd", "bash", "sh"} {
+		t.Run("shell="+shell, func(t *testing.T) {
+			id := ts.startSession(aliceToken, map[string]any{"shell": shell})
+			want := shell
+			if want == "" {
+				want = defaultShell
+			}
+			if s, _ := sessionManager.GetSession(id); s.ShellName != want {
+				t.Fatalf("session shell = %q, want %q", s.ShellName, want)
+			}
+
+			// 各类型的 shell 使用各自的命令包装, 输出和退出码都能正确解析
+			resp, data := ts.run(aliceToken, id, "echo 'hello'", nil)
+			if resp.StatusCode != http.StatusOK || string(data) != "hello" || resp.Header.Get("X-Exit-Code") != "0" {
+				t.Fatalf("echo = %d %q exit %s", resp.StatusCode, data, resp.Header.Get("X-Exit-Code"))
+			}
+			resp, data = ts.run(aliceToken, id, "fail", nil)
+			if resp.StatusCode != http.StatusOK || string(data) != "failed" || resp.Header.Get("X-Exit-Code") != "2" {
+				t.Fatalf("fail = %d %q exit %s", resp.StatusCode, data, resp.Header.Get("X-Exit-Code"))
+			}
+		})
+	}
+}
+
+func TestUnknownShellRejected(t *testing.T) {
+	ts := newTestServer(t, nil)
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "fish"})
+	if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInvalidRequest {
+		t.Fatalf("unknown shell = %d %s", resp.StatusCode, data)
+	}
+	if sessionManager.Owned("alice") != 0 {
+		t.Fatal("rejected session still counted against the quota")
+	}
+}
+
+func TestShellPresetValidate(t *testing.T) {
+	tests := []struct {
+		preset ShellPreset
+		ok     bool
+	}{
+		{ShellPreset{Type: ShellBash, Path: "bash"}, true},
+		{ShellPreset{Type: ShellPowerShell, Path: "pwsh", Args: []string{"-NoLogo"}}, true},
+		{ShellPreset{Type: ShellCmd, Path: "cmd.exe"}, true},
+		{ShellPreset{Type: "zsh", Path: "zsh"}, false},
+		{ShellPreset{Type: ShellBash}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.preset.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok %t", tt.preset, err, tt.ok)
+		}
+	}
+}
+
+func TestConfigRejectsUnknownDefaultShell(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DefaultShell = "fish"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("default_shell without a preset accepted")
+	}
+}
+
+func TestPowerShellFrameIsSingleLine(t *testing.T) {
+	p := defaultShellPresets()["pwsh"]
+	for _, command := range []string{
+		"Get-Date",
+		"if ($true) {",
+		"Write-Output 'a'\nWrite-Output 'b'",
+		"@\"\nhere-string\n",
+		"'unterminated",
+	} {
+		full := p.frame(command, "marker", TerminatorMarker, frameOptions{})
+		if strings.Count(full, "\n") != 1 || !strings.HasSuffix(full, "\n") {
+			t.Errorf("frame(%q) is not a single line: %q", command, full)
+		}
+		if !strings.Contains(full, base64.StdEncoding.EncodeToString([]byte(command))) {
+			t.Errorf("frame(%q) does not pass the command as base64", command)
+		}
+		// 执行前用解析器检查, 不完整和有语法错误时输出不同的状态
+		for _, status := range []string{"ParseInput", statusIncomplete, statusSyntaxError} {
+			if !strings.Contains(full, status) {
+				t.Errorf("frame(%q) does not contain %q", command, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// missingShell 可执行文件不存在的预设
+var missingShell = &ShellPreset{Type: ShellBash, Path: "/nonexistent/rce-missing-shell"}
+
+func TestCheckShells(t *testing.T) {
+	previous := spawner
+	spawner = execSpawner{}
+	defer func() { spawner = previous }()
+
+	if err := checkShells(map[string]*ShellPreset{"missing": missingShell}, "missing"); err == nil {
+		t.Fatal("no installed shell accepted")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	// 默认 shell 未安装只记录警告
+	shells := map[string]*ShellPreset{"missing": missingShell, "sh": {Type: ShellBash, Path: "sh"}}
+	if err := checkShells(shells, "missing"); err != nil {
+		t.Fatalf("one installed shell = %v", err)
+	}
+}
+
+func TestShellUnavailable(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.Shells["missing"] = missingShell })
+	spawner = execSpawner{}
+	capabilities.Store(newCapabilities(ts.cfg))
+
+	resp, data := ts.post(aliceToken, "/start-session", map[string]any{"shell": "missing"})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellUnavailable {
+		t.Fatalf("missing shell = %d %s", resp.StatusCode, data)
+	}
+	// 可执行文件的路径不返回给客户端
+	if strings.Contains(string(data), missingShell.Path) {
+		t.Fatalf("path in error: %s", data)
+	}
+
+	_, data = ts.do(http.MethodGet, "", "/capabilities", nil)
+	var caps Capabilities
+	decodeJSON(t, data, &caps)
+	for _, shell := range caps.Shells {
+		if shell.Name == "missing" && shell.Installed {
+			t.Fatal("missing shell reported as installed")
+		}
+	}
+}
+
+func TestShellUninstalledAfterStart(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) { cfg.Shells["gone"] = &ShellPreset{Type: ShellBash, Path: "bash"} })
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "gone"})
+
+	// 会话创建后可执行文件被删除, 重启时同样返回 503
+	s, _ := sessionManager.GetSession(id)
+	s.shell = &ShellPreset{Type: ShellBash, Path: missingShell.Path}
+	status, _ := ts.restartSession(aliceToken, id)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("restart with missing shell = %d", status)
+	}
+}
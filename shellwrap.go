@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// shellOverrideEnv 在会话的 shell 中传递 cmd 命令的环境变量, 子 cmd 展开后执行, 命令不经过会话 shell 的引号处理
+const shellOverrideEnv = "__RCE_CMD"
+
+// errShellNotAllowed 请求指定的 shell 不在 shell_overrides 中
+var errShellNotAllowed = errors.New("shell override is not allowed")
+
+// validateShellOverrides 检查 shell_overrides 中的预设都已配置
+func validateShellOverrides(names []string, shells map[string]*ShellPreset) error {
+	for _, name := range names {
+		if _, ok := shells[name]; !ok {
+			return fmt.Errorf("shell_overrides: %q is not a configured shell", name)
+		}
+	}
+	return nil
+}
+
+// resolveShellOverride 查找请求指定的 shell 预设, 返回 nil 表示使用会话的 shell
+// 不在 shell_overrides 中的预设(包括未知的预设)返回 errShellNotAllowed
+func resolveShellOverride(session *Session, name string) (*ShellPreset, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if !currentSettings().shellOverrides[name] {
+		return nil, fmt.Errorf("%w: %s", errShellNotAllowed, name)
+	}
+	child, ok := sessionManager.Shells[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown shell %q", name)
+	}
+	if session.constrained {
+		return nil, fmt.Errorf("shell cannot be used in a constrained language session")
+	}
+	if session.options.Remote != nil {
+		return nil, fmt.Errorf("shell cannot be used in a remote session")
+	}
+	if name == session.ShellName {
+		return nil, fmt.Errorf("the session already uses shell %s, omit shell", name)
+	}
+	if child.Type == ShellCmd && session.shell.Type == ShellCmd {
+		return nil, fmt.Errorf("shell %s cannot be run from a cmd session", name)
+	}
+	if !child.installed() {
+		return nil, shellUnavailable(name, child)
+	}
+	return child, nil
+}
+
+// wrapInShell 生成在会话的 shell(parent)中用另一个 shell 执行命令的语句
+// 命令以 base64 或环境变量传入子 shell, 不依赖两层 shell 的引号规则; 子 shell 的 stdin 为空,
+// 不会读走会话之后的命令。输出经会话的 shell 返回, 子 shell 的退出码即为命令的退出码
+func wrapInShell(command string, parent ShellType, child *ShellPreset) (string, error) {
+	var args []string
+	switch child.Type {
+	case ShellBash:
+		// 进程替换读入解码后的脚本, 多行命令和 heredoc 保持原样
+		script := base64.StdEncoding.EncodeToString([]byte(command))
+		args = []string{"--noprofile", "--norc", "-c", ". <(base64 -d <<<" + script + ") </dev/null"}
+	case ShellPowerShell:
+		// -EncodedCommand 为 UTF-16LE 的 base64, 先设置输出编码避免非 ASCII 字符乱码
+		script := shellInitScript + "; " + command
+		units := utf16.Encode([]rune(script))
+		encoded := make([]byte, 0, len(units)*2)
+		for _, u := range units {
+			encoded = append(encoded, byte(u), byte(u>>8))
+		}
+		args = []string{"-NoProfile", "-NonInteractive", "-EncodedCommand", base64.StdEncoding.EncodeToString(encoded)}
+	case ShellCmd:
+		// cmd /c 只执行一行, 环境变量中的换行会截断命令
+		if strings.ContainsAny(command, "\r\n") {
+			return "", fmt.Errorf("commands run through cmd must be a single line, chain commands with &")
+		}
+		args = []string{"/d", "/v:on", "/c", "%" + shellOverrideEnv + "%"}
+	}
+
+	// cmd 在展开环境变量之后才解析 & | 等字符, 先切换到 UTF-8 代码页再执行命令
+	value := "chcp 65001 >nul & " + command
+	switch parent {
+	case ShellPowerShell:
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = psQuote(arg)
+		}
+		// 从空的管道输入启动, 子 shell 的 stdin 为空
+		invoke := "@() | & " + psQuote(child.Path) + " " + strings.Join(quoted, " ")
+		if child.Type != ShellCmd {
+			return invoke, nil
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(value))
+		return fmt.Sprintf("$env:%s = [System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String('%s')); try { %s } finally { Remove-Item Env:%s -ErrorAction SilentlyContinue }",
+			shellOverrideEnv, encoded, invoke, shellOverrideEnv), nil
+	case ShellCmd:
+		// 参数只包含 base64 字符和固定的文本, 双引号内的 < ( ) 不会被 cmd 解释
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			if strings.ContainsAny(arg, " <>()") {
+				arg = `"` + arg + `"`
+			}
+			quoted[i] = arg
+		}
+		return `"` + child.Path + `" ` + strings.Join(quoted, " ") + " <nul", nil
+	default:
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = bashQuote(arg)
+		}
+		invoke := bashQuote(child.Path) + " " + strings.Join(quoted, " ") + " </dev/null"
+		if child.Type != ShellCmd {
+			return invoke, nil
+		}
+		// MSYS_NO_PATHCONV 避免 Git Bash 把 /d、/c 转换为路径, WSLENV 让 WSL 把变量传给 Windows 进程
+		return fmt.Sprintf("MSYS_NO_PATHCONV=1 WSLENV=%s${WSLENV:+:$WSLENV} %s=%s %s", shellOverrideEnv, shellOverrideEnv, bashQuote(value), invoke), nil
+	}
+}
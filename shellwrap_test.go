@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellOverrideRejected(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Shells["cmd2"] = &ShellPreset{Type: ShellCmd, Path: "cmd.exe"}
+		cfg.ShellOverrides = []string{"pwsh", "bash", "cmd2"}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh"})
+	constrained := ts.startSession(aliceToken, map[string]any{"shell": "pwsh", "language_mode": "constrained"})
+	tests := []struct {
+		session string
+		extra   map[string]any
+	}{
+		// 与会话相同的 shell 不需要指定
+		{id, map[string]any{"shell": "pwsh"}},
+		{id, map[string]any{"shell": "bash", "output_format": "json"}},
+		{constrained, map[string]any{"shell": "bash"}},
+	}
+	for _, tt := range tests {
+		resp, data := ts.run(aliceToken, tt.session, "echo hi", tt.extra)
+		if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeInvalidRequest {
+			t.Errorf("run with %v = %d %s", tt.extra, resp.StatusCode, data)
+		}
+	}
+	// cmd 会话中无法再启动 cmd
+	cmd := ts.startSession(aliceToken, map[string]any{"shell": "cmd"})
+	if resp, data := ts.run(aliceToken, cmd, "echo hi", map[string]any{"shell": "cmd2"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("cmd from cmd = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestShellOverrideUnavailable(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Shells["missing"] = missingShell
+		cfg.ShellOverrides = []string{"missing"}
+	})
+	id := ts.startSession(aliceToken, nil)
+	spawner = execSpawner{}
+	resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"shell": "missing"})
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellUnavailable {
+		t.Fatalf("missing shell = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestWrapInShell(t *testing.T) {
+	bash := &ShellPreset{Type: ShellBash, Path: "bash"}
+	pwsh := &ShellPreset{Type: ShellPowerShell, Path: "pwsh"}
+	cmd := &ShellPreset{Type: ShellCmd, Path: "cmd.exe"}
+	tests := []struct {
+		parent ShellType
+		child  *ShellPreset
+		want   []string
+	}{
+		// 子 shell 的 stdin 为空, 不读走会话之后的命令
+		{ShellPowerShell, bash, []string{"@() | & 'bash' '--noprofile' '--norc' '-c'", "</dev/null'"}},
+		{ShellPowerShell, cmd, []string{"$env:__RCE_CMD = ", "'/c' '%__RCE_CMD%'", "Remove-Item Env:__RCE_CMD"}},
+		{ShellBash, pwsh, []string{"'pwsh' '-NoProfile' '-NonInteractive' '-EncodedCommand'", " </dev/null"}},
+		{ShellBash, cmd, []string{"MSYS_NO_PATHCONV=1 ", "__RCE_CMD='chcp 65001 >nul & dir C:\\'"}},
+		{ShellCmd, bash, []string{`"bash" --noprofile --norc -c ". <(base64 -d <<<`, " <nul"}},
+	}
+	for _, tt := range tests {
+		command := "echo hi"
+		if tt.child.Type == ShellCmd {
+			command = `dir C:\`
+		}
+		got, err := wrapInShell(command, tt.parent, tt.child)
+		if err != nil {
+			t.Fatalf("wrap %s in %s = %v", tt.child.Type, tt.parent, err)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("wrap %s in %s = %q, missing %q", tt.child.Type, tt.parent, got, s)
+			}
+		}
+	}
+	if _, err := wrapInShell("dir\r\ncd", ShellBash, cmd); err == nil {
+		t.Fatal("multi-line cmd command accepted")
+	}
+}
+
+func TestShellOverrideRunsInChildShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Shells["child"] = &ShellPreset{Type: ShellBash, Path: "bash"}
+		cfg.ShellOverrides = []string{"child"}
+	})
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	_, parentPID := ts.run(aliceToken, id, "echo $$", nil)
+
+	// 多行命令、引号和 heredoc 原样传入子 shell, 子 shell 的退出码即为命令的退出码
+	command := "echo \"it's $$\"\ncat <<'EOF'\n$HOME stays\nEOF\nread line; echo \"stdin [$line]\"\nexit 3"
+	resp, data := ts.run(aliceToken, id, command, map[string]any{"shell": "child"})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Exit-Code") != "3" {
+		t.Fatalf("child shell = %d exit %s %q", resp.StatusCode, resp.Header.Get("X-Exit-Code"), data)
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) != 3 || lines[0] == "it's "+string(parentPID) || lines[1] != "$HOME stays" || lines[2] != "stdin []" {
+		t.Fatalf("child output = %q", data)
+	}
+
+	// 会话的 shell 不受影响
+	if resp, data = ts.run(aliceToken, id, "echo $$", nil); string(data) != string(parentPID) {
+		t.Fatalf("session shell after override = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestValidateShellOverrides(t *testing.T) {
+	shells := defaultShellPresets()
+	if err := validateShellOverrides([]string{"pwsh", "bash"}, shells); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateShellOverrides([]string{"pwsh", "zsh9"}, shells); err == nil {
+		t.Fatal("unknown shell in shell_overrides accepted")
+	}
+}
+
+func TestShellOverrideNotAllowed(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.ShellOverrides = []string{"bash"}
+	})
+	id := ts.startSession(aliceToken, nil)
+	// 不在 shell_overrides 中的预设和未知的预设都返回 403
+	for _, shell := range []string{"cmd", "no-such-shell"} {
+		resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"shell": shell})
+		if resp.StatusCode != http.StatusForbidden || errorCodeOf(t, data) != codeShellNotAllowed {
+			t.Errorf("override %s = %d %s", shell, resp.StatusCode, data)
+		}
+	}
+	for _, shell := range newCapabilities(ts.cfg).Shells {
+		if shell.Override != (shell.Name == "bash") {
+			t.Errorf("capabilities override for %s = %t", shell.Name, shell.Override)
+		}
+	}
+}
+
+func TestShellOverridesDisabledByDefault(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"shell": "bash"})
+	if resp.StatusCode != http.StatusForbidden || errorCodeOf(t, data) != codeShellNotAllowed {
+		t.Fatalf("override without shell_overrides = %d %s", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 签名请求的请求头: 令牌名称、Unix 时间戳(秒)和十六进制的 HMAC-SHA256 签名
+	headerSignatureKey       = "X-RCE-Key"
+	headerSignatureTimestamp = "X-RCE-Timestamp"
+	headerSignature          = "X-RCE-Signature"
+
+	// defaultSignatureSkew 签名时间戳与服务端时间允许的默认偏差
+	defaultSignatureSkew = 5 * time.Minute
+	// maxSignedBodySize 签名请求的请求体上限, 需要读入内存计算摘要
+	maxSignedBodySize = 32 * 1024 * 1024
+)
+
+// signingPayload 参与签名的内容: 方法、路径(含查询参数)、时间戳和请求体的 SHA-256, 以换行分隔
+func signingPayload(method, uri, timestamp string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(sum[:]))
+}
+
+// signRequest 返回请求的签名, 客户端按相同方式计算
+func signRequest(secret, method, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signingPayload(method, uri, timestamp, body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureAuth 校验用令牌的 signing_secret 计算的 HMAC 请求签名, 请求带 Bearer Token 时不检查
+type signatureAuth struct {
+	tokens []TokenConfig
+	// skew 签名请求的时间戳与服务端时间允许的偏差
+	skew    time.Duration
+	replays *replayCache
+}
+
+func newSignatureAuth(tokens []TokenConfig, skew time.Duration) *signatureAuth {
+	return &signatureAuth{tokens: tokens, skew: skew, replays: newReplayCache()}
+}
+
+// Authenticate 校验请求的 HMAC 签名, 通过时请求体替换为已读取的内容
+func (a *signatureAuth) Authenticate(r *http.Request) (*Identity, bool) {
+	if bearerToken(r) != "" {
+		return nil, false
+	}
+	name := r.Header.Get(headerSignatureKey)
+	signature := r.Header.Get(headerSignature)
+	timestamp := r.Header.Get(headerSignatureTimestamp)
+	if name == "" || signature == "" {
+		return nil, false
+	}
+	for _, t := range a.tokens {
+		if t.Name != name || t.SigningSecret == "" {
+			continue
+		}
+		if err := a.verifySignature(r, t.SigningSecret, timestamp, signature); err != nil {
+			log.Printf("✗ Invalid request signature | Key: %s | Path: %s | Error: %v", name, r.URL.Path, err)
+			return nil, false
+		}
+		return &Identity{Name: t.Name, Admin: t.Admin, Method: authMethodSignature}, true
+	}
+	log.Printf("✗ Invalid request signature | Key: %s | Path: %s | Error: unknown key or key has no signing_secret", name, r.URL.Path)
+	return nil, false
+}
+
+// verifySignature 检查时间戳、签名和是否重放
+func (a *signatureAuth) verifySignature(r *http.Request, secret, timestamp, signature string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s", headerSignatureTimestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > a.skew || skew < -a.skew {
+		return fmt.Errorf("timestamp is %s away from server time, allowed %s", skew.Round(time.Second), a.skew)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read body: %v", err)
+	}
+	if len(body) > maxSignedBodySize {
+		return fmt.Errorf("body exceeds %d bytes", maxSignedBodySize)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	if !a.replays.add(signature, signedAt.Add(a.skew)) {
+		return fmt.Errorf("signature already used")
+	}
+	return nil
+}
+
+// replayCache 记录时间窗口内用过的签名, 同一签名只能使用一次
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// pruned 上次清理过期签名的时间
+	pruned time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// add 记录签名, 签名在 expires 之前已经用过时返回 false
+// 过期时间之后时间戳本身已被拒绝, 无需再记录
+func (c *replayCache) add(signature string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for sig, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, sig)
+			}
+		}
+		c.pruned = now
+	}
+	if exp, ok := c.seen[signature]; ok && now.Before(exp) {
+		return false
+	}
+	c.seen[signature] = expires
+	return true
+}
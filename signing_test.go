@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const carolSecret = "carol-signing-secret"
+
+// signedPost 发送签名的 POST 请求, timestamp 为签名中的时间
+func (ts *testServer) signedPost(key, secret, path string, body []byte, timestamp time.Time) (*http.Response, []byte) {
+	ts.t.Helper()
+	stamp := strconv.FormatInt(timestamp.Unix(), 10)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+	req.Header.Set(headerSignatureKey, key)
+	req.Header.Set(headerSignatureTimestamp, stamp)
+	req.Header.Set(headerSignature, signRequest(secret, http.MethodPost, path, stamp, body))
+	return ts.send(req)
+}
+
+// send 发送请求并读取完整的响应体
+func (ts *testServer) send(req *http.Request) (*http.Response, []byte) {
+	ts.t.Helper()
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func newSigningServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.SignatureSkew = Duration(time.Minute)
+		cfg.Tokens = append(cfg.Tokens, TokenConfig{Name: "carol", SigningSecret: carolSecret})
+	})
+}
+
+func TestSignedRequest(t *testing.T) {
+	ts := newSigningServer(t)
+	body := []byte(`{}`)
+	resp, data := ts.signedPost("carol", carolSecret, "/start-session", body, time.Now())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed start = %d %s", resp.StatusCode, data)
+	}
+	if n := sessionManager.Owned("carol"); n != 1 {
+		t.Fatalf("carol owns %d sessions", n)
+	}
+
+	// 请求体被重新读取, 处理函数看到完整的内容
+	var started struct {
+		SessionID string `json:"session_id"`
+	}
+	decodeJSON(t, data, &started)
+	run := []byte(`{"session_id":"` + started.SessionID + `","command":"echo signed"}`)
+	if resp, data = ts.signedPost("carol", carolSecret, "/run-command", run, time.Now()); resp.StatusCode != http.StatusOK || string(data) != "signed" {
+		t.Fatalf("signed run = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestSignedRequestRejected(t *testing.T) {
+	ts := newSigningServer(t)
+	body := []byte(`{}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		status int
+		send   func() (*http.Response, []byte)
+	}{
+		{"wrong secret", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			return ts.signedPost("carol", "other-secret", "/start-session", body, now)
+		}},
+		{"unknown key", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			return ts.signedPost("dave", carolSecret, "/start-session", body, now)
+		}},
+		// 没有 signing_secret 的令牌不能签名
+		{"token without secret", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			return ts.signedPost("alice", "", "/start-session", body, now)
+		}},
+		{"stale timestamp", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			return ts.signedPost("carol", carolSecret, "/start-session", body, now.Add(-2*time.Minute))
+		}},
+		{"future timestamp", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			return ts.signedPost("carol", carolSecret, "/start-session", body, now.Add(2*time.Minute))
+		}},
+		{"tampered body", http.StatusUnauthorized, func() (*http.Response, []byte) {
+			stamp := strconv.FormatInt(now.Unix(), 10)
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/start-session", bytes.NewReader([]byte(`{"shell":"bash"}`)))
+			req.Header.Set(headerSignatureKey, "carol")
+			req.Header.Set(headerSignatureTimestamp, stamp)
+			req.Header.Set(headerSignature, signRequest(carolSecret, http.MethodPost, "/start-session", stamp, body))
+			return ts.send(req)
+		}},
+	}
+	for _, tt := range tests {
+		if resp, data := tt.send(); resp.StatusCode != tt.status {
+			t.Errorf("%s = %d %s", tt.name, resp.StatusCode, data)
+		}
+	}
+	if n := sessionManager.Owned("carol"); n != 0 {
+		t.Fatalf("rejected requests created %d sessions", n)
+	}
+}
+
+func TestSignatureReplay(t *testing.T) {
+	ts := newSigningServer(t)
+	body := []byte(`{}`)
+	now := time.Now()
+	if resp, data := ts.signedPost("carol", carolSecret, "/start-session", body, now); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first = %d %s", resp.StatusCode, data)
+	}
+	// 同一签名只能使用一次
+	if resp, data := ts.signedPost("carol", carolSecret, "/start-session", body, now); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replay = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestReplayCacheExpires(t *testing.T) {
+	c := newReplayCache()
+	if !c.add("sig", time.Now().Add(time.Minute)) || c.add("sig", time.Now().Add(time.Minute)) {
+		t.Fatal("signature accepted twice")
+	}
+	// 过期后不再记录, 清理时删除
+	c.seen["old"] = time.Now().Add(-time.Second)
+	c.pruned = time.Time{}
+	if !c.add("other", time.Now().Add(time.Minute)) {
+		t.Fatal("new signature rejected")
+	}
+	if _, ok := c.seen["old"]; ok {
+		t.Fatal("expired signature not pruned")
+	}
+}
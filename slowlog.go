@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// logCommand 记录命令执行过程中的常规日志, 关闭 log_commands 时不记录
+func logCommand(format string, args ...interface{}) {
+	if currentSettings().logCommands {
+		log.Printf(format, args...)
+	}
+}
+
+// logCommand 记录命令执行过程中的常规日志, 探测命令不记录
+func (opts RunOptions) logCommand(format string, args ...interface{}) {
+	if !opts.probe {
+		logCommand(format, args...)
+	}
+}
+
+// logSlowCommand 命令执行时间达到 slow_command_threshold 时记录警告, 包括失败和超时的命令
+func logSlowCommand(sessionID, command string, elapsed time.Duration) {
+	live := currentSettings()
+	if live.slowCommandThreshold == 0 || elapsed < live.slowCommandThreshold {
+		return
+	}
+	log.Printf("⚠ Slow command | SessionID: %s | Duration: %s | Command: %s", sessionID, elapsed.Round(time.Millisecond), truncateCommand(command, live.slowCommandMaxLength))
+}
+
+// truncateCommand 把命令截断到 max 字节以内, 不拆开 UTF-8 字符, 截断时末尾加上 ...
+func truncateCommand(command string, max int) string {
+	if max <= 0 || len(command) <= max {
+		return command
+	}
+	cut := max
+	for cut > 0 && cut < len(command) && command[cut]&0xC0 == 0x80 {
+		cut--
+	}
+	return command[:cut] + "..."
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		max     int
+		want    string
+	}{
+		{"Get-Date", 0, "Get-Date"},
+		{"Get-Date", 8, "Get-Date"},
+		{"Get-ChildItem", 7, "Get-Chi..."},
+		// 不拆开多字节字符
+		{"echo 你好", 7, "echo ..."},
+		{"echo 你好", 8, "echo 你..."},
+	}
+	for _, tt := range tests {
+		if got := truncateCommand(tt.command, tt.max); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.command, tt.max, got, tt.want)
+		}
+	}
+}
+
+// captureLogs 在 fn 执行期间记录日志并返回
+func captureLogs(fn func()) string {
+	var logs bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&logs)
+	fn()
+	log.SetOutput(previous)
+	return logs.String()
+}
+
+func TestSlowCommandLog(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.LogCommands = false
+		cfg.SlowCommandThreshold = Duration(50 * time.Millisecond)
+		cfg.SlowCommandMaxLength = 10
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Slow-Command-With-Long-Name": {Output: "done", DelayMs: 100},
+			"Fast":                        {Output: "done"},
+		}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	logs := captureLogs(func() {
+		if resp, data := ts.run(aliceToken, id, "Fast", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("fast = %d %s", resp.StatusCode, data)
+		}
+	})
+	// 关闭 log_commands 后正常的命令不记录
+	if strings.Contains(logs, "Fast") {
+		t.Fatalf("command logged with log_commands off:\n%s", logs)
+	}
+
+	logs = captureLogs(func() { ts.run(aliceToken, id, "Slow-Command-With-Long-Name", nil) })
+	if !strings.Contains(logs, "⚠ Slow command | SessionID: "+id) || !strings.Contains(logs, "| Command: Slow-Comma...") {
+		t.Fatalf("slow command log:\n%s", logs)
+	}
+	if strings.Contains(logs, "Slow-Command-With-Long-Name") {
+		t.Fatalf("slow command not truncated:\n%s", logs)
+	}
+}
+
+func TestCommandLogging(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.LogCommands = true })
+	id := ts.startSession(aliceToken, nil)
+	logs := captureLogs(func() { ts.run(aliceToken, id, "echo logged", nil) })
+	if !strings.Contains(logs, "→ Executing command | SessionID: "+id+" | Command: echo logged") || strings.Contains(logs, "Slow command") {
+		t.Fatalf("command log:\n%s", logs)
+	}
+}
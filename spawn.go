@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+)
+
+// shellSpawner 启动会话的 shell, 默认启动真实进程, 配置 no_exec 时为不启动进程的模拟 shell
+type shellSpawner interface {
+	// available 预设的 shell 能否启动
+	available(p *ShellPreset) bool
+	// spawn 启动会话的 shell, 返回时 shell 已在读取 stdin
+	spawn(s *Session) (*shellProcess, error)
+}
+
+// processTree 会话 shell 的进程树, 真实进程为 processGroup
+type processTree interface {
+	// kill 结束整个进程树
+	kill() error
+	// killChildren 结束 shell 启动的子进程, shell 本身保留
+	killChildren() error
+	// remaining 仍在运行的进程 ID
+	remaining() ([]int, error)
+	// usage 进程树当前的资源使用
+	usage() (processUsage, error)
+	// release 释放进程树占用的句柄
+	release()
+}
+
+// shellProcess 启动的 shell 的管道和进程树
+type shellProcess struct {
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	tree   processTree
+	// wait 等待 shell 退出, 只能调用一次
+	wait func() error
+}
+
+// abort 启动后初始化失败时结束 shell 并等待其退出
+func (p *shellProcess) abort() {
+	p.tree.kill()
+	p.tree.release()
+	p.wait()
+}
+
+// execSpawner 启动真实的 shell 进程
+type execSpawner struct{}
+
+func (execSpawner) available(p *ShellPreset) bool {
+	_, err := exec.LookPath(p.Path)
+	return err == nil
+}
+
+func (execSpawner) spawn(s *Session) (*shellProcess, error) {
+	cmd := exec.Command(s.shell.Path, s.shell.Args...)
+	cmd.Env = append(sessionEnviron(inheritedEnviron(os.Environ()), s.options), s.options.Remote.environ()...)
+	cmd.Dir = s.workingDir
+	prepareProcess(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			// 创建会话后 shell 被卸载
+			return nil, shellUnavailable(s.ShellName, s.shell)
+		}
+		return nil, fmt.Errorf("failed to start %s: %v", s.ShellName, err)
+	}
+
+	group, err := newProcessGroup(cmd, s.limits)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	proc := &shellProcess{stdin: stdin, stdout: stdout, stderr: stderr, tree: group, wait: cmd.Wait}
+	if err := setPriority(cmd.Process.Pid, s.priority); err != nil {
+		proc.abort()
+		return nil, err
+	}
+	return proc, nil
+}
+
+// spawner 按 no_exec 选择的启动方式
+var spawner shellSpawner = execSpawner{}
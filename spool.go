@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// SpooledOutput 输出转存到临时文件后的下载信息, 文件下载一次后删除
+type SpooledOutput struct {
+	DownloadToken string    `json:"download_token"`
+	DownloadURL   string    `json:"download_url"`
+	Size          int       `json:"size"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// spoolWriter 先在内存中保留输出, 超过 threshold 后把已保留的内容和之后的输出写入临时文件
+// 内存中的内容作为预览返回, 完整输出通过下载接口获取
+type spoolWriter struct {
+	sessionID string
+	owner     string
+	threshold int
+	preview   bytes.Buffer
+	f         *os.File
+	file      *OutputFile
+	// failed 创建或写入文件失败, 之后的输出被丢弃
+	failed bool
+}
+
+func (w *spoolWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return len(b), nil
+	}
+	n := len(b)
+	if w.f == nil {
+		if w.preview.Len()+len(b) <= w.threshold {
+			return w.preview.Write(b)
+		}
+		// 预览补足到 threshold 字节, 其余内容写入文件
+		room := w.threshold - w.preview.Len()
+		w.preview.Write(b[:room])
+		b = b[room:]
+		if err := w.spill(); err != nil {
+			log.Printf("⚠ Failed to spool output, discarding the rest | SessionID: %s | Error: %v", w.sessionID, err)
+			w.failed = true
+			return n, nil
+		}
+	}
+	if _, err := w.f.Write(b); err != nil {
+		log.Printf("⚠ Failed to spool output, discarding the rest | SessionID: %s | Error: %v", w.sessionID, err)
+		w.failed = true
+	}
+	return n, nil
+}
+
+// spill 创建临时文件并写入内存中已保留的输出, 预览保留在内存中
+func (w *spoolWriter) spill() error {
+	f, file, err := outputFileStore.Create(w.owner)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(w.preview.Bytes()); err != nil {
+		f.Close()
+		os.Remove(file.Path)
+		return fmt.Errorf("failed to write output file: %v", err)
+	}
+	w.f, w.file = f, file
+	log.Printf("→ Output exceeds spool threshold, spooling to disk | SessionID: %s | Threshold: %d bytes | Token: %s", w.sessionID, w.threshold, file.Token)
+	return nil
+}
+
+// finish 关闭临时文件并登记下载, 输出未超过阈值时返回 nil
+func (w *spoolWriter) finish(size int) *OutputFile {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	if w.failed || err != nil {
+		os.Remove(w.file.Path)
+		return nil
+	}
+	w.file.once = true
+	outputFileStore.Commit(w.file, size)
+	return w.file
+}
+
+// runCommandSpooled 执行命令, 输出超过 spool_threshold 时转存到临时文件
+// 转存时 Output 为输出开头的预览, Spooled 为完整输出的下载信息
+func runCommandSpooled(session *Session, command, owner string, opts RunOptions) (*CommandResult, error) {
+	w := &spoolWriter{sessionID: session.ID, owner: owner, threshold: currentSettings().spoolThreshold}
+	// 完整输出不在内存中, 上限与 output_to_file 相同
+	opts.Limit = maxFileOutputSize
+	result, err := session.RunCommandTo(command, w, opts)
+	file := w.finish(sizeOf(result))
+	if result == nil {
+		return nil, err
+	}
+
+	preview := w.preview.Bytes()
+	if file != nil {
+		preview = trimPartialRune(preview)
+		result.Spooled = &SpooledOutput{
+			DownloadToken: file.Token,
+			DownloadURL:   "/download?token=" + file.Token,
+			Size:          file.Size,
+			ExpiresAt:     file.ExpiresAt,
+		}
+	} else if w.failed {
+		// 转存失败时只返回开头的预览
+		result.Truncated = true
+		result.Truncate = TruncateHead
+	}
+	result.Output = string(preview)
+	opts.logCommand("← Output | SessionID: %s | Content:\n%s", session.ID, result.Output)
+	return result, err
+}
+
+// trimPartialRune 去掉末尾不完整的 UTF-8 字符, 预览在阈值处截断时可能拆开多字节字符
+func trimPartialRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// sizeOf 返回已写出的输出字节数, 命令未发送时为 0
+func sizeOf(result *CommandResult) int {
+	if result == nil {
+		return 0
+	}
+	return result.Size
+}
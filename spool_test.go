@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrimPartialRune(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"abc", "abc"},
+		{"caf\xc3\xa9", "café"},
+		// 阈值拆开的多字节字符整个去掉
+		{"caf\xc3", "caf"},
+		{"x\xe4\xb8", "x"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := string(trimPartialRune([]byte(tt.in))); got != tt.want {
+			t.Errorf("trimPartialRune(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSpoolWriter(t *testing.T) {
+	newTestServer(t, nil)
+	w := &spoolWriter{sessionID: "s", owner: "alice", threshold: 8}
+	w.Write([]byte("0123"))
+	if w.f != nil || w.finish(4) != nil {
+		t.Fatal("output below the threshold spooled")
+	}
+
+	w = &spoolWriter{sessionID: "s", owner: "alice", threshold: 8}
+	for _, chunk := range []string{"0123", "4567", "89", "abcdef"} {
+		w.Write([]byte(chunk))
+	}
+	if w.preview.String() != "01234567" {
+		t.Fatalf("preview = %q", w.preview.String())
+	}
+	file := w.finish(16)
+	if file == nil || !file.once || file.Size != 16 {
+		t.Fatalf("spooled file = %+v", file)
+	}
+}
+
+func TestSpooledOutput(t *testing.T) {
+	full := strings.Repeat("line of output\n", 20) + "end"
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.SpoolThreshold = 32
+		cfg.FakeOutputs = map[string]FakeOutput{"Big-Output": {Output: full}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 未超过阈值时照常返回文本
+	resp, data := ts.run(aliceToken, id, "echo small", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != "small" {
+		t.Fatalf("small output = %d %q", resp.StatusCode, data)
+	}
+
+	resp, data = ts.run(aliceToken, id, "Big-Output", nil)
+	var result CommandResult
+	decodeJSON(t, data, &result)
+	if resp.StatusCode != http.StatusOK || result.Spooled == nil {
+		t.Fatalf("big output = %d %s", resp.StatusCode, data)
+	}
+	if result.Output != full[:32] || result.Spooled.Size != len(full) || result.Truncated {
+		t.Fatalf("spooled result = %q %+v truncated %t", result.Output, result.Spooled, result.Truncated)
+	}
+
+	// 其他租户无法下载
+	if resp, _ := ts.do(http.MethodGet, bobToken, result.Spooled.DownloadURL, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cross-tenant download = %d", resp.StatusCode)
+	}
+	resp, data = ts.do(http.MethodGet, aliceToken, result.Spooled.DownloadURL, nil)
+	if resp.StatusCode != http.StatusOK || string(data) != full {
+		t.Fatalf("download = %d %d bytes", resp.StatusCode, len(data))
+	}
+	// 下载一次后删除
+	if resp, _ = ts.do(http.MethodGet, aliceToken, result.Spooled.DownloadURL, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second download = %d", resp.StatusCode)
+	}
+
+	// JSON 等结构化输出不转存
+	if resp, data = ts.run(aliceToken, id, "Big-Output", map[string]any{"output_format": "json"}); resp.StatusCode != http.StatusOK || strings.Contains(string(data), "download_token") {
+		t.Fatalf("json output = %d %s", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// CommandStatus 正在执行的命令
+type CommandStatus struct {
+	ID        string    `json:"id"`
+	Command   string    `json:"command"`
+	StartedAt time.Time `json:"started_at"`
+
+	// internal 初始化和子 shell 轮询等内部命令, 执行时间很短, 不作为 session_busy 返回
+	internal bool
+}
+
+// SessionStatus 会话的即时状态, 读取时不等待正在执行的命令
+type SessionStatus struct {
+	SessionID string `json:"session_id"`
+	// State 生命周期状态: running、ending 或 ended
+	State   string `json:"state"`
+	Running bool   `json:"running"`
+	Suspect bool   `json:"suspect"`
+	// Busy 是否正在执行命令, Current 为该命令
+	Busy    bool           `json:"busy"`
+	Current *CommandStatus `json:"current_command,omitempty"`
+	// Queued 排队等待执行的命令数
+	Queued   int       `json:"queued"`
+	LastUsed time.Time `json:"last_used"`
+	// CommandsRemaining 达到 max_commands_per_session 之前还能执行的命令数, 未设置上限时为空
+	CommandsRemaining *int `json:"commands_remaining,omitempty"`
+	// OutputStats 客户端命令的输出大小统计, 与 /session-info 中的相同
+	OutputStats *OutputStats `json:"output_stats"`
+}
+
+// beginCommand 记录开始执行的命令, 调用方需持有 s.mu
+func (s *Session) beginCommand(id, command string, internal bool) {
+	s.current.Store(&CommandStatus{ID: id, Command: command, StartedAt: time.Now(), internal: internal})
+}
+
+// endCommand 清除正在执行的命令, touch 为 true 时更新最近使用时间, 调用方需持有 s.mu
+func (s *Session) endCommand(touch bool) {
+	if current := s.current.Swap(nil); current != nil && !current.internal {
+		s.lastCommand.Store(current)
+	}
+	if touch {
+		s.touch(time.Now())
+	}
+}
+
+// lastUsedResolution 最近使用时间的更新粒度
+// 子 shell 轮询等内部命令执行频繁, 粒度内的重复更新只读取不写入, 避免并发读取方所在的缓存行反复失效
+const lastUsedResolution = 100 * time.Millisecond
+
+// touch 把最近使用时间更新为 now, 不获取 s.mu
+// 只向前更新: 并发结束的命令(如子 shell 的内部命令与会话命令)不会用较早的时间覆盖较新的时间
+func (s *Session) touch(now time.Time) {
+	t := now.UnixNano()
+	for {
+		last := s.lastUsed.Load()
+		if t-last < int64(lastUsedResolution) {
+			return
+		}
+		if s.lastUsed.CompareAndSwap(last, t) {
+			return
+		}
+	}
+}
+
+// LastUsed 返回最近使用时间, 误差不超过 lastUsedResolution
+func (s *Session) LastUsed() time.Time {
+	return time.Unix(0, s.lastUsed.Load())
+}
+
+// Status 返回会话状态, 不获取 s.mu
+func (s *Session) Status() *SessionStatus {
+	current := s.current.Load()
+	return &SessionStatus{
+		SessionID: s.ID,
+		State:     s.State().String(),
+		Running:   s.running.Load(),
+		Suspect:   s.suspect.Load(),
+		Busy:      current != nil,
+		Current:   current,
+		Queued:    int(s.queued.Load()),
+		LastUsed:  s.LastUsed(),
+
+		CommandsRemaining: s.CommandsRemaining(),
+		OutputStats:       s.outputStats.snapshot(),
+	}
+}
+
+// API14: 查询会话状态, 命令执行期间也立即返回
+func handleSessionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "session_id is required"))
+		return
+	}
+	if err := validateSessionID(sessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	session, exists := sessionManager.GetSessionFor(sessionID, identityFrom(r))
+	if !exists {
+		writeError(w, sessionNotFound(sessionID, identityFrom(r)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session.Status())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sessionStatus 查询会话状态
+func (ts *testServer) sessionStatus(token, sessionID string) (*http.Response, *SessionStatus) {
+	ts.t.Helper()
+	resp, data := ts.do(http.MethodGet, token, "/session-status?session_id="+sessionID, nil)
+	var status SessionStatus
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &status)
+	}
+	return resp, &status
+}
+
+// waitBusy 等待会话开始执行命令
+func waitBusy(t *testing.T, s *Session) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.current.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("command did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionStatusDoesNotBlockOnRunningCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Long-Job": {Output: "working", DelayMs: 1000}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	_, idle := ts.sessionStatus(aliceToken, id)
+	if idle.Busy || idle.Current != nil || idle.State != "running" || !idle.Running {
+		t.Fatalf("idle status = %+v", idle)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.run(aliceToken, id, "Long-Job", nil)
+	}()
+	waitBusy(t, s)
+
+	start := time.Now()
+	resp, busy := ts.sessionStatus(aliceToken, id)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("session-status waited %s for the running command", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK || !busy.Busy || busy.Current == nil || busy.Current.Command != "Long-Job" {
+		t.Fatalf("busy status = %+v", busy)
+	}
+
+	<-done
+	_, after := ts.sessionStatus(aliceToken, id)
+	if after.Busy || !after.LastUsed.After(idle.LastUsed) {
+		t.Fatalf("status after command = %+v, last used before %s", after, idle.LastUsed)
+	}
+}
+
+func TestSessionStatusCountsQueuedCommands(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"Long-Job": {DelayMs: 500}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		ts.run(aliceToken, id, "Long-Job", nil)
+		done <- struct{}{}
+	}()
+	waitBusy(t, s)
+	go func() {
+		ts.run(aliceToken, id, "echo queued", map[string]any{"queue": true})
+		done <- struct{}{}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, status := ts.sessionStatus(aliceToken, id)
+		if status.Queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued = %d, want 1", status.Queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	<-done
+	<-done
+	if _, status := ts.sessionStatus(aliceToken, id); status.Queued != 0 || status.Busy {
+		t.Fatalf("status after both commands = %+v", status)
+	}
+}
+
+func TestSessionStatusOfOtherTenant(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	if resp, _ := ts.sessionStatus(bobToken, id); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("other tenant status = %d", resp.StatusCode)
+	}
+	if resp, _ := ts.sessionStatus(aliceToken, "not-a-uuid"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed id status = %d", resp.StatusCode)
+	}
+}
+
+// BenchmarkLastUsedContention 多个 goroutine 同时更新和读取同一会话的最近使用时间
+// 子 shell 的轮询、执行命令和状态查询都会访问 lastUsed, 不需要获取 s.mu
+func BenchmarkLastUsedContention(b *testing.B) {
+	base := time.Now()
+	// advance 每次调用都超过 lastUsedResolution, 每次 touch 都要写入, 是 CompareAndSwap 竞争最激烈的情况
+	var tick atomic.Int64
+	advance := func() time.Time {
+		return base.Add(time.Duration(tick.Add(1)) * lastUsedResolution)
+	}
+	for _, bench := range []struct {
+		name string
+		op   func(s *Session, i int)
+	}{
+		// 同一个 100ms 内的 touch 只读取不写入
+		{"touch/same-window", func(s *Session, i int) { s.touch(base) }},
+		{"touch/advancing", func(s *Session, i int) { s.touch(advance()) }},
+		{"last-used", func(s *Session, i int) { _ = s.LastUsed() }},
+		// 每 8 次操作中 1 次写入, 其余为读取, 接近会话列表和状态查询远多于命令的情况
+		{"mixed", func(s *Session, i int) {
+			if i%8 == 0 {
+				s.touch(advance())
+			} else {
+				_ = s.LastUsed()
+			}
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			s := &Session{ID: "bench"}
+			s.touch(base)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					bench.op(s, i)
+				}
+			})
+		})
+	}
+}
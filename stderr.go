@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// StderrHandling shell 进程 stderr 的处理方式
+// 命令的 stderr 大多已重定向到 stdout, 原生程序直接写入 shell stderr 的内容仍来自这里;
+// 无论哪种方式 stderr 都被持续读取, 管道写满不会阻塞 shell
+type StderrHandling string
+
+const (
+	// StderrDiscard 读取后丢弃(默认)
+	StderrDiscard StderrHandling = "discard"
+	// StderrLog 按行写入运行日志
+	StderrLog StderrHandling = "log"
+	// StderrTail 保留在会话的环形缓冲区中, 通过 /session-tail?stream=stderr 查看
+	StderrTail StderrHandling = "tail"
+)
+
+const (
+	// maxStderrLogLine 写入日志的一行 stderr 的最大字节数, 超过部分不记录
+	maxStderrLogLine = 4096
+	// maxStderrLogRate 每个会话每秒最多写入日志的 stderr 行数, 超过部分只记录行数
+	maxStderrLogRate = 100
+)
+
+// stderrHandling 配置的 stderr 处理方式
+var stderrHandling = StderrDiscard
+
+// parseStderrHandling 检查 stderr_handling, 为空时为 discard
+func parseStderrHandling(handling StderrHandling) (StderrHandling, error) {
+	switch handling {
+	case "", StderrDiscard:
+		return StderrDiscard, nil
+	case StderrLog, StderrTail:
+		return handling, nil
+	}
+	return "", fmt.Errorf("stderr_handling must be %s, %s or %s", StderrDiscard, StderrLog, StderrTail)
+}
+
+// drainStderr 持续读取 shell 的 stderr 直到管道关闭, 按 stderr_handling 丢弃、记录日志或写入 tail
+// 每次读取的缓冲区为 bufSize, 与读取 stdout 相同, 由 read_buffer_size 配置
+func drainStderr(sessionID string, stderr io.Reader, tail *ringBuffer, bufSize int) {
+	switch {
+	case stderrHandling == StderrLog:
+		logStderr(sessionID, stderr, bufSize)
+	case tail != nil:
+		copyStderr(tail, stderr, bufSize)
+	default:
+		copyStderr(io.Discard, stderr, bufSize)
+	}
+}
+
+// copyStderr 以 bufSize 的缓冲区把 stderr 写入 w
+// 不使用 io.Copy: io.Discard 实现了 ReadFrom, 会以固定的 8KB 读取
+func copyStderr(w io.Writer, stderr io.Reader, bufSize int) {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := stderr.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// logStderr 按行记录 stderr, 单行和每秒的行数有上限, 避免大量 stderr 占满日志
+func logStderr(sessionID string, stderr io.Reader, bufSize int) {
+	r := bufio.NewReaderSize(stderr, max(bufSize, maxStderrLogLine))
+	var windowStart time.Time
+	logged, suppressed := 0, 0
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			break
+		}
+		if len(chunk) > maxStderrLogLine {
+			chunk = chunk[:maxStderrLogLine]
+		}
+		line := string(chunk)
+		// 过长的行只记录开头, 其余部分读取后丢弃
+		for isPrefix {
+			_, isPrefix, err = r.ReadLine()
+			if err != nil {
+				break
+			}
+		}
+
+		now := time.Now()
+		if now.Sub(windowStart) >= time.Second {
+			if suppressed > 0 {
+				log.Printf("⚠ Shell stderr lines suppressed | SessionID: %s | Lines: %d", sessionID, suppressed)
+			}
+			windowStart, logged, suppressed = now, 0, 0
+		}
+		if logged >= maxStderrLogRate {
+			suppressed++
+			continue
+		}
+		logged++
+		log.Printf("⚠ Shell stderr | SessionID: %s | Line: %s", sessionID, line)
+	}
+	if suppressed > 0 {
+		log.Printf("⚠ Shell stderr lines suppressed | SessionID: %s | Lines: %d", sessionID, suppressed)
+	}
+}
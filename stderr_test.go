@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStderrHandling(t *testing.T) {
+	for in, want := range map[StderrHandling]StderrHandling{"": StderrDiscard, "discard": StderrDiscard, "log": StderrLog, "tail": StderrTail} {
+		if got, err := parseStderrHandling(in); err != nil || got != want {
+			t.Errorf("parse %q = %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseStderrHandling("stdout"); err == nil {
+		t.Error("unknown handling accepted")
+	}
+
+	// tail 需要 session_tail_size
+	cfg := DefaultConfig()
+	cfg.StderrHandling = StderrTail
+	cfg.SessionTailSize = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("stderr_handling tail without session_tail_size accepted")
+	}
+}
+
+func TestDrainStderrDoesNotBlock(t *testing.T) {
+	r, w := io.Pipe()
+	tail := newRingBuffer(16)
+	done := make(chan struct{})
+	go func() {
+		drainStderr("s", r, tail, defaultReadBufferSize)
+		close(done)
+	}()
+
+	// 写入远超管道和缓冲区大小的 stderr 不阻塞写入方
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(bytes.Repeat([]byte("e"), 1<<20))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stderr writer blocked")
+	}
+	w.Write([]byte("last line\n"))
+	w.Close()
+	<-done
+	if data, total := tail.Tail(16); string(data) != "eeeeeelast line\n" || total != 1<<20+10 {
+		t.Fatalf("tail = %q of %d bytes", data, total)
+	}
+}
+
+func TestLogStderr(t *testing.T) {
+	input := "first\n" + strings.Repeat("x", maxStderrLogLine+100) + "\nafter long\n" + strings.Repeat("flood\n", maxStderrLogRate+5)
+	logs := captureLogs(func() { logStderr("s1", strings.NewReader(input), defaultReadBufferSize) })
+	if !strings.Contains(logs, "Shell stderr | SessionID: s1 | Line: first\n") || !strings.Contains(logs, "Line: after long\n") {
+		t.Fatalf("lines not logged:\n%s", logs)
+	}
+	// 过长的行只记录开头, 超过速率的行只记录行数
+	if strings.Contains(logs, strings.Repeat("x", maxStderrLogLine+1)) {
+		t.Fatal("long line logged in full")
+	}
+	if n := strings.Count(logs, "Line: flood"); n != maxStderrLogRate-3 {
+		t.Fatalf("%d flood lines logged", n)
+	}
+	if !strings.Contains(logs, "Shell stderr lines suppressed | SessionID: s1 | Lines: 8") {
+		t.Fatalf("suppressed lines not reported:\n%s", logs)
+	}
+}
+
+func TestSessionStderrTail(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.SessionTailSize = 64
+		cfg.StderrHandling = StderrTail
+	})
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	if s.stderrTail == nil {
+		t.Fatal("stderr tail not created")
+	}
+	s.stderrTail.Write([]byte("native tool warning\n"))
+
+	resp, data := ts.do(http.MethodGet, aliceToken, "/session-tail?session_id="+id+"&stream=stderr", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(data), "native tool warning") {
+		t.Fatalf("stderr tail = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.do(http.MethodGet, aliceToken, "/session-tail?session_id="+id+"&stream=both", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown stream = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestSessionStderrTailDisabled(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.SessionTailSize = 64 })
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.do(http.MethodGet, aliceToken, "/session-tail?session_id="+id+"&stream=stderr", nil)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(data), "stderr_handling") {
+		t.Fatalf("stderr tail without tail handling = %d %s", resp.StatusCode, data)
+	}
+}
+
+// readSizeRecorder 记录每次 Read 得到的缓冲区大小
+type readSizeRecorder struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (rec *readSizeRecorder) Read(p []byte) (int, error) {
+	rec.sizes = append(rec.sizes, len(p))
+	return rec.r.Read(p)
+}
+
+func TestDrainStderrUsesReadBufferSize(t *testing.T) {
+	defer func(h StderrHandling) { stderrHandling = h }(stderrHandling)
+	for _, handling := range []StderrHandling{StderrDiscard, StderrTail, StderrLog} {
+		stderrHandling = handling
+		rec := &readSizeRecorder{r: strings.NewReader(strings.Repeat("e", 100<<10) + "\n")}
+		var tail *ringBuffer
+		if handling == StderrTail {
+			tail = newRingBuffer(16)
+		}
+		drainStderr("s", rec, tail, 64<<10)
+		// 与 stdout 一样以 read_buffer_size 读取, 而不是 io.Copy 的 32KB 或 io.Discard 的 8KB
+		if len(rec.sizes) == 0 || rec.sizes[0] != 64<<10 {
+			t.Errorf("%s: read sizes = %v", handling, rec.sizes)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionRecord 会话元数据, 不依赖 shell 进程, 可以保存在服务进程之外
+type SessionRecord struct {
+	ID        string    `json:"session_id"`
+	Owner     string    `json:"owner"`
+	Shell     string    `json:"shell"`
+	CreatedAt time.Time `json:"created_at"`
+	// Instance 会话所在的服务实例, 未配置 instance_id 时为空
+	Instance string `json:"instance,omitempty"`
+	// Labels 会话标签, 列出会话时按标签筛选
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// maxHistoryRecords 每个会话保留的客户端命令记录数, 初始化命令的记录不计入, 始终保留
+const maxHistoryRecords = 100
+
+// CommandRecord 会话中一条已执行的命令
+type CommandRecord struct {
+	// Index 命令在会话中的序号, 从 1 开始, 由 Store 分配, 较早的记录被删除后不变
+	Index     int64  `json:"index"`
+	CommandID string `json:"command_id"`
+	// Command 实际执行的命令文本(模板和脚本已展开), 原样保存, 返回给客户端时替换机密值
+	Command string `json:"command"`
+	// Template 和 Script 命令由该模板或脚本展开, Params 和 Args 为展开时的参数
+	// /replay-command 用这些参数按当前配置中的模板和脚本重新展开命令
+	Template string                     `json:"template,omitempty"`
+	Params   map[string]json.RawMessage `json:"params,omitempty"`
+	Script   string                     `json:"script,omitempty"`
+	Args     []string                   `json:"args,omitempty"`
+	// Shell 命令在该 shell 预设中执行(请求的 shell 参数), 为空时在会话的 shell 中执行
+	Shell string `json:"shell,omitempty"`
+	// Init 是否为初始化命令(启动时的 init 或带 record_init 执行成功的命令), 克隆和重启会话时重放
+	Init       bool      `json:"init,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	ExitCode   *int      `json:"exit_code"`
+	TimedOut   bool      `json:"timed_out,omitempty"`
+	// OutputBytes 返回给客户端的输出字节数, 与结果中的 size 相同, 截断时为保留部分的大小
+	OutputBytes int `json:"output_bytes"`
+	// Truncated 与结果中的 truncated 相同, 输出不完整
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// IdempotencyRecord 一个 Idempotency-Key 的处理状态
+type IdempotencyRecord struct {
+	// Fingerprint 首次请求的方法、路径和请求体的摘要, 重用同一个键的请求必须相同
+	Fingerprint string
+	// Pending 为 true 时首次请求仍在处理, Status 和 Body 尚未保存
+	Pending bool
+	Status  int
+	Body    []byte
+	Expires time.Time
+}
+
+// Store 会话元数据和事件历史的存储, 实现需要支持并发调用
+// 默认使用 MemoryStore, 可替换为外部存储; shell 进程、管道等运行时对象始终保存在内存中
+type Store interface {
+	// PutSession 保存会话元数据, 已存在时覆盖元数据并保留事件
+	PutSession(rec SessionRecord) error
+	// DeleteSession 删除会话元数据及其事件, 会话不存在时不返回错误
+	DeleteSession(id string) error
+	// ListSessions 返回所有会话元数据, 顺序不限
+	ListSessions() ([]SessionRecord, error)
+	// AppendEvent 追加会话事件, 会话不存在时返回 errSessionNotFound
+	AppendEvent(id string, event SessionEvent) error
+	// Events 按追加顺序返回会话事件的副本, 会话不存在时返回 errSessionNotFound
+	Events(id string) ([]SessionEvent, error)
+	// GetBaseline 返回租户的输出基线, 不存在时返回 nil, 基线与会话无关, 结束会话后保留
+	GetBaseline(owner, name string) (*Baseline, error)
+	// PutBaseline 保存输出基线, 已存在时覆盖
+	PutBaseline(b Baseline) error
+	// AppendHistory 追加命令记录并分配序号, 客户端命令的记录超过 maxHistoryRecords 时删除其中最早的一条
+	// 会话不存在时返回 errSessionNotFound
+	AppendHistory(id string, rec CommandRecord) error
+	// History 按执行顺序返回会话命令记录的副本, 会话不存在时返回 errSessionNotFound
+	History(id string) ([]CommandRecord, error)
+	// ClaimIdempotencyKey 为租户占用键, 键不存在或已过期时记为处理中并返回 nil, 否则返回已有记录
+	ClaimIdempotencyKey(owner, key, fingerprint string, expires time.Time) (*IdempotencyRecord, error)
+	// CompleteIdempotencyKey 保存首次请求的响应, 之后重用该键的请求直接返回此响应
+	CompleteIdempotencyKey(owner, key string, status int, body []byte) error
+	// ReleaseIdempotencyKey 删除处理中的键, 首次请求失败时调用, 客户端可以用同一个键重试
+	ReleaseIdempotencyKey(owner, key string) error
+}
+
+// MemoryStore 保存在内存中的 Store, 服务重启后丢失
+type MemoryStore struct {
+	sessions    map[string]*memoryEntry
+	baselines   map[baselineKey]Baseline
+	idempotency map[idempotencyKey]*IdempotencyRecord
+	mu          sync.RWMutex
+	// now 当前时间, 判断键是否过期时使用
+	now func() time.Time
+}
+
+type baselineKey struct {
+	owner, name string
+}
+
+type idempotencyKey struct {
+	owner, key string
+}
+
+type memoryEntry struct {
+	record  SessionRecord
+	events  []SessionEvent
+	history []CommandRecord
+	// commands 已分配的命令序号
+	commands int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:    make(map[string]*memoryEntry),
+		baselines:   make(map[baselineKey]Baseline),
+		idempotency: make(map[idempotencyKey]*IdempotencyRecord),
+		now:         time.Now,
+	}
+}
+
+func (ms *MemoryStore) PutSession(rec SessionRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if entry, exists := ms.sessions[rec.ID]; exists {
+		entry.record = rec
+		return nil
+	}
+	ms.sessions[rec.ID] = &memoryEntry{record: rec}
+	return nil
+}
+
+func (ms *MemoryStore) DeleteSession(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+func (ms *MemoryStore) ListSessions() ([]SessionRecord, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	records := make([]SessionRecord, 0, len(ms.sessions))
+	for _, entry := range ms.sessions {
+		records = append(records, entry.record)
+	}
+	return records, nil
+}
+
+func (ms *MemoryStore) AppendEvent(id string, event SessionEvent) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, exists := ms.sessions[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	entry.events = append(entry.events, event)
+	return nil
+}
+
+func (ms *MemoryStore) Events(id string) ([]SessionEvent, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	entry, exists := ms.sessions[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	return append([]SessionEvent(nil), entry.events...), nil
+}
+
+func (ms *MemoryStore) GetBaseline(owner, name string) (*Baseline, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	b, exists := ms.baselines[baselineKey{owner, name}]
+	if !exists {
+		return nil, nil
+	}
+	return &b, nil
+}
+
+func (ms *MemoryStore) PutBaseline(b Baseline) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.baselines[baselineKey{b.Owner, b.Name}] = b
+	return nil
+}
+
+func (ms *MemoryStore) AppendHistory(id string, rec CommandRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, exists := ms.sessions[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	entry.commands++
+	rec.Index = entry.commands
+	entry.history = append(entry.history, rec)
+
+	clients := 0
+	oldest := -1
+	for i, r := range entry.history {
+		if !r.Init {
+			if oldest < 0 {
+				oldest = i
+			}
+			clients++
+		}
+	}
+	if clients > maxHistoryRecords {
+		entry.history = append(entry.history[:oldest], entry.history[oldest+1:]...)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) History(id string) ([]CommandRecord, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	entry, exists := ms.sessions[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", errSessionNotFound, id)
+	}
+	return append([]CommandRecord(nil), entry.history...), nil
+}
+
+func (ms *MemoryStore) ClaimIdempotencyKey(owner, key, fingerprint string, expires time.Time) (*IdempotencyRecord, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := ms.now()
+	for k, rec := range ms.idempotency {
+		if !rec.Expires.After(now) {
+			delete(ms.idempotency, k)
+		}
+	}
+	k := idempotencyKey{owner, key}
+	if rec, exists := ms.idempotency[k]; exists {
+		existing := *rec
+		return &existing, nil
+	}
+	ms.idempotency[k] = &IdempotencyRecord{Fingerprint: fingerprint, Pending: true, Expires: expires}
+	return nil, nil
+}
+
+func (ms *MemoryStore) CompleteIdempotencyKey(owner, key string, status int, body []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	rec, exists := ms.idempotency[idempotencyKey{owner, key}]
+	if !exists {
+		return fmt.Errorf("idempotency key %q not claimed", key)
+	}
+	rec.Pending = false
+	rec.Status = status
+	rec.Body = append([]byte(nil), body...)
+	return nil
+}
+
+func (ms *MemoryStore) ReleaseIdempotencyKey(owner, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.idempotency, idempotencyKey{owner, key})
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStoreContract 检查 Store 实现的行为, 其他实现(如基于 Redis)可以用同一组测试验证
+func testStoreContract(t *testing.T, newStore func() Store) {
+	t.Run("Sessions", func(t *testing.T) {
+		st := newStore()
+		created := time.Now().UTC().Truncate(time.Second)
+		a := SessionRecord{ID: "a", Owner: "alice", Shell: "bash", CreatedAt: created, Labels: map[string]string{"env": "prod"}}
+		if err := st.PutSession(a); err != nil {
+			t.Fatal(err)
+		}
+		st.PutSession(SessionRecord{ID: "b", Owner: "bob"})
+		// 再次保存覆盖元数据, 不影响事件
+		st.AppendEvent("a", SessionEvent{Type: "started"})
+		a.Shell = "pwsh"
+		st.PutSession(a)
+
+		records, err := st.ListSessions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+		if len(records) != 2 || !reflect.DeepEqual(records[0], a) || records[1].Owner != "bob" {
+			t.Fatalf("sessions = %+v", records)
+		}
+		if events, _ := st.Events("a"); len(events) != 1 || events[0].Type != "started" {
+			t.Fatalf("events after overwrite = %+v", events)
+		}
+
+		if err := st.DeleteSession("a"); err != nil {
+			t.Fatal(err)
+		}
+		// 删除不存在的会话不是错误
+		if err := st.DeleteSession("a"); err != nil {
+			t.Fatalf("delete twice = %v", err)
+		}
+		if records, _ = st.ListSessions(); len(records) != 1 {
+			t.Fatalf("sessions after delete = %+v", records)
+		}
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		st := newStore()
+		if err := st.AppendEvent("missing", SessionEvent{Type: "started"}); !errors.Is(err, errSessionNotFound) {
+			t.Fatalf("append to missing session = %v", err)
+		}
+		if _, err := st.Events("missing"); !errors.Is(err, errSessionNotFound) {
+			t.Fatalf("events of missing session = %v", err)
+		}
+		st.PutSession(SessionRecord{ID: "a"})
+		for _, typ := range []string{"started", "respawned", "ended"} {
+			st.AppendEvent("a", SessionEvent{Type: typ})
+		}
+		events, _ := st.Events("a")
+		// 返回副本, 修改不影响存储
+		events[0].Type = "changed"
+		if events, _ = st.Events("a"); len(events) != 3 || events[0].Type != "started" || events[2].Type != "ended" {
+			t.Fatalf("events = %+v", events)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		st := newStore()
+		if err := st.AppendHistory("missing", CommandRecord{Command: "echo"}); !errors.Is(err, errSessionNotFound) {
+			t.Fatalf("append to missing session = %v", err)
+		}
+		if _, err := st.History("missing"); !errors.Is(err, errSessionNotFound) {
+			t.Fatalf("history of missing session = %v", err)
+		}
+		st.PutSession(SessionRecord{ID: "a"})
+		st.AppendHistory("a", CommandRecord{Command: "init", Init: true})
+		for i := 0; i < maxHistoryRecords+5; i++ {
+			st.AppendHistory("a", CommandRecord{Command: fmt.Sprintf("cmd %d", i)})
+		}
+		history, err := st.History("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 初始化命令始终保留, 客户端命令只保留最近的记录, 序号不变
+		if len(history) != maxHistoryRecords+1 || !history[0].Init || history[0].Index != 1 {
+			t.Fatalf("history has %d records, first %+v", len(history), history[0])
+		}
+		if first := history[1]; first.Command != "cmd 5" || first.Index != 7 {
+			t.Fatalf("oldest client record = %+v", first)
+		}
+		if last := history[len(history)-1]; last.Index != maxHistoryRecords+6 {
+			t.Fatalf("last record = %+v", last)
+		}
+
+		// 删除会话时一并删除历史, 同一个 ID 重新创建后从 1 开始
+		st.DeleteSession("a")
+		st.PutSession(SessionRecord{ID: "a"})
+		st.AppendHistory("a", CommandRecord{Command: "again"})
+		if history, _ = st.History("a"); len(history) != 1 || history[0].Index != 1 {
+			t.Fatalf("history after recreate = %+v", history)
+		}
+	})
+
+	t.Run("ConcurrentHistory", func(t *testing.T) {
+		st := newStore()
+		st.PutSession(SessionRecord{ID: "a"})
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st.AppendHistory("a", CommandRecord{Command: "echo"})
+			}()
+		}
+		wg.Wait()
+		history, _ := st.History("a")
+		seen := make(map[int64]bool)
+		for _, r := range history {
+			seen[r.Index] = true
+		}
+		if len(history) != 50 || len(seen) != 50 {
+			t.Fatalf("%d records with %d distinct indexes", len(history), len(seen))
+		}
+	})
+
+	t.Run("Baselines", func(t *testing.T) {
+		st := newStore()
+		if b, err := st.GetBaseline("alice", "disk"); err != nil || b != nil {
+			t.Fatalf("missing baseline = %+v, %v", b, err)
+		}
+		st.PutBaseline(Baseline{Owner: "alice", Name: "disk", Output: "v1"})
+		st.PutBaseline(Baseline{Owner: "alice", Name: "disk", Output: "v2"})
+		if b, _ := st.GetBaseline("alice", "disk"); b == nil || b.Output != "v2" {
+			t.Fatalf("baseline = %+v", b)
+		}
+		// 不同租户的同名基线互不影响
+		if b, _ := st.GetBaseline("bob", "disk"); b != nil {
+			t.Fatalf("bob sees alice's baseline: %+v", b)
+		}
+	})
+
+	t.Run("IdempotencyKeys", func(t *testing.T) {
+		st := newStore()
+		expires := time.Now().Add(time.Hour)
+		if rec, err := st.ClaimIdempotencyKey("alice", "k", "f1", expires); err != nil || rec != nil {
+			t.Fatalf("first claim = %+v, %v", rec, err)
+		}
+		if rec, _ := st.ClaimIdempotencyKey("alice", "k", "f1", expires); rec == nil || !rec.Pending || rec.Fingerprint != "f1" {
+			t.Fatalf("claim while pending = %+v", rec)
+		}
+		// 键按租户区分
+		if rec, _ := st.ClaimIdempotencyKey("bob", "k", "f2", expires); rec != nil {
+			t.Fatalf("bob's claim = %+v", rec)
+		}
+
+		if err := st.CompleteIdempotencyKey("alice", "k", 200, []byte(`{"ok":true}`)); err != nil {
+			t.Fatal(err)
+		}
+		rec, _ := st.ClaimIdempotencyKey("alice", "k", "f1", expires)
+		if rec == nil || rec.Pending || rec.Status != 200 || string(rec.Body) != `{"ok":true}` {
+			t.Fatalf("claim after complete = %+v", rec)
+		}
+		if err := st.CompleteIdempotencyKey("alice", "unclaimed", 200, nil); err == nil {
+			t.Fatal("completed an unclaimed key")
+		}
+
+		// 释放后可以重新占用
+		st.ReleaseIdempotencyKey("bob", "k")
+		if rec, _ := st.ClaimIdempotencyKey("bob", "k", "f3", expires); rec != nil {
+			t.Fatalf("claim after release = %+v", rec)
+		}
+		// 已过期的键按新键处理
+		st.ClaimIdempotencyKey("alice", "old", "f1", time.Now().Add(-time.Second))
+		if rec, _ := st.ClaimIdempotencyKey("alice", "old", "f2", expires); rec != nil {
+			t.Fatalf("claim of expired key = %+v", rec)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreContract(t, func() Store { return NewMemoryStore() })
+}
+
+func TestInitCommandsFromHistory(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo a"}})
+	ts.run(aliceToken, id, "echo b", nil)
+	ts.run(aliceToken, id, "echo c", map[string]any{"record_init": true})
+
+	s, _ := sessionManager.GetSession(id)
+	if want := []string{"echo a", "echo c"}; !reflect.DeepEqual(s.InitCommands(), want) {
+		t.Fatalf("init commands = %q, want %q", s.InitCommands(), want)
+	}
+	history, err := sessionManager.Store.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[1].Command != "echo b" || history[1].Init || !history[2].Init {
+		t.Fatalf("history = %+v", history)
+	}
+	// 命令结果中的 command_id 与历史记录对应
+	resp, _ := ts.run(aliceToken, id, "echo d", nil)
+	history, _ = sessionManager.Store.History(id)
+	if last := history[len(history)-1]; last.CommandID == "" || resp.Header.Get("X-Command-ID") != last.CommandID || last.ExitCode == nil {
+		t.Fatalf("last record %+v, X-Command-ID %q", last, resp.Header.Get("X-Command-ID"))
+	}
+
+	// 重启会话重放初始化命令, 但不重复记录
+	if resp, data := ts.post(aliceToken, "/restart-session", map[string]any{"session_id": id}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restart = %d %s", resp.StatusCode, data)
+	}
+	if n := len(s.InitCommands()); n != 2 {
+		t.Fatalf("%d init commands after restart", n)
+	}
+
+	ts.endSession(aliceToken, id)
+	if _, err := sessionManager.Store.History(id); !errors.Is(err, errSessionNotFound) {
+		t.Fatalf("history after end = %v", err)
+	}
+}
+
+func TestSessionInfoHistoryRedacted(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{sessionInfoCommand: {Output: `{"location":"C:\\","env":[]}`}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"secret_env": map[string]string{"API_KEY": "s3cr3t-value"}})
+	ts.run(aliceToken, id, "echo s3cr3t-value", nil)
+	// 探测命令不记录
+	ts.run(aliceToken, id, "echo probe", map[string]any{"probe": true})
+
+	resp, data := ts.do(http.MethodGet, aliceToken, "/session-info?session_id="+id, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("session-info = %d %s", resp.StatusCode, data)
+	}
+	var info SessionInfo
+	decodeJSON(t, data, &info)
+	if len(info.History) != 1 || info.History[0].Command != "echo "+redacted {
+		t.Fatalf("history = %+v", info.History)
+	}
+}
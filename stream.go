@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ndjsonContentType 流式输出的响应类型, 每行一个 JSON 帧
+const ndjsonContentType = "application/x-ndjson"
+
+// defaultStreamMaxFlushDelay 暂存的输出不足 stream_min_flush_bytes 时最多等待的时间
+const defaultStreamMaxFlushDelay = 20 * time.Millisecond
+
+var (
+	// streamHeartbeatInterval 流式输出在没有输出时发送 heartbeat 帧的间隔, 0 表示不发送
+	streamHeartbeatInterval time.Duration
+	// streamMinFlushBytes 暂存的输出达到该字节数才写出 stdout 帧, 0 表示读到即写出
+	streamMinFlushBytes int
+	// streamMaxFlushDelay 暂存的输出不足 streamMinFlushBytes 时最多等待的时间, 之后同样写出
+	streamMaxFlushDelay = defaultStreamMaxFlushDelay
+)
+
+// acceptsNDJSON 根据 Accept 判断客户端是否请求流式输出, 只有明确列出 application/x-ndjson 时才流式返回
+func acceptsNDJSON(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), ndjsonContentType) {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err != nil || q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// OutputFrame 一段命令输出, Offset 为这段输出在命令输出中的字节偏移
+type OutputFrame struct {
+	Type   string `json:"type"`
+	Data   string `json:"data"`
+	Offset int    `json:"offset"`
+}
+
+// HeartbeatFrame 一段时间没有输出时发送, 避免代理因连接空闲断开, 客户端忽略即可
+type HeartbeatFrame struct {
+	Type string `json:"type"`
+}
+
+// EndFrame 流式输出的最后一帧, 字段与 /run-command 的响应头和结果一致
+type EndFrame struct {
+	Type      string `json:"type"`
+	ExitCode  *int   `json:"exit_code"`
+	Size      int    `json:"size"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Aborted   bool   `json:"aborted,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Encoding 输出的编码和替换字符数
+	Encoding *OutputEncoding `json:"encoding,omitempty"`
+	// Recycled 会话连续出错被回收: restarted 或 ended
+	Recycled string `json:"recycled,omitempty"`
+	// Status 仅在请求 report_status 时返回
+	Status string `json:"status,omitempty"`
+	// CPUMs 和 PeakMemoryBytes 仅在请求 report_usage 时返回
+	CPUMs           *int64  `json:"cpu_ms,omitempty"`
+	PeakMemoryBytes *uint64 `json:"peak_memory_bytes,omitempty"`
+	// Error 开始输出后命令失败(如超时)时的错误, 与错误响应中的 error 相同
+	Error *ErrorBody `json:"error,omitempty"`
+	// Exception 命令抛出的终止错误, 仅在会话开启 structured_errors 时返回
+	Exception *CommandException `json:"exception,omitempty"`
+}
+
+// ndjsonWriter 把命令输出写为 stdout 帧, 每帧写出后立即 flush
+// 帧的边界不会切开 UTF-8 字符, 不完整的字符留到下一次写入; 配置 stream_min_flush_bytes 后小块输出合并写出
+type ndjsonWriter struct {
+	// mu 保护以下字段, 输出帧和 heartbeat 帧由不同的 goroutine 写出
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	enc     *json.Encoder
+	offset  int
+	pending []byte
+	// started 已写出响应头, 之后的错误只能在 end 帧中返回
+	started bool
+	// lastFrame 最近写出帧的时间, 没有写出时为创建时间
+	lastFrame time.Time
+	// minFlush 和 maxDelay 见 stream_min_flush_bytes 和 stream_max_flush_delay
+	// flushTimer 在暂存了不足 minFlush 的输出后启动, 到时写出暂存的输出
+	minFlush   int
+	maxDelay   time.Duration
+	flushTimer *time.Timer
+	// err 到时写出失败的错误, 之后的 Write 返回该错误
+	err error
+	// ended 已写出 end 帧, 之后到时的 flushTimer 不再写出
+	ended bool
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	return &ndjsonWriter{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		enc:       json.NewEncoder(w),
+		lastFrame: time.Now(),
+		minFlush:  streamMinFlushBytes,
+		maxDelay:  streamMaxFlushDelay,
+	}
+}
+
+// start 写出响应头, 输出经过代理时不缓冲
+func (n *ndjsonWriter) start() {
+	if n.started {
+		return
+	}
+	n.started = true
+	header := n.w.Header()
+	header.Set("Content-Type", ndjsonContentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	n.w.WriteHeader(http.StatusOK)
+}
+
+// Write 暂存输出, 暂存达到 minFlush 字节时立即写出, 否则最多等待 maxDelay 后写出
+// 频繁的小块输出合并为较少的帧, 输出停顿时已读到的内容不会等待更久
+func (n *ndjsonWriter) Write(b []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.err != nil {
+		return 0, n.err
+	}
+	n.pending = append(n.pending, b...)
+	if len(n.pending) < n.minFlush {
+		if n.flushTimer == nil {
+			n.flushTimer = time.AfterFunc(n.maxDelay, n.delayedFlush)
+		}
+		return len(b), nil
+	}
+	if err := n.flushPending(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flushPending 写出暂存输出中完整的字符, 调用方需持有 n.mu
+func (n *ndjsonWriter) flushPending() error {
+	if n.flushTimer != nil {
+		n.flushTimer.Stop()
+		n.flushTimer = nil
+	}
+	complete := len(n.pending) - incompleteRuneSuffix(n.pending)
+	if complete == 0 {
+		return nil
+	}
+	if err := n.frame(n.pending[:complete]); err != nil {
+		return err
+	}
+	n.pending = append(n.pending[:0], n.pending[complete:]...)
+	return nil
+}
+
+// delayedFlush 在 flushTimer 到时时写出暂存的输出
+func (n *ndjsonWriter) delayedFlush() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ended || n.err != nil {
+		return
+	}
+	// 已停止的 timer 可能仍会执行到这里, 此时提前写出同样无害
+	n.err = n.flushPending()
+}
+
+// frame 写出一个 stdout 帧, 无效的 UTF-8 字节按 U+FFFD 编码
+func (n *ndjsonWriter) frame(data []byte) error {
+	if err := n.encode(OutputFrame{Type: "stdout", Data: string(data), Offset: n.offset}); err != nil {
+		return err
+	}
+	n.offset += len(data)
+	return nil
+}
+
+// encode 写出一帧并立即 flush, 调用方需持有 n.mu
+func (n *ndjsonWriter) encode(frame interface{}) error {
+	n.start()
+	n.lastFrame = time.Now()
+	if err := n.enc.Encode(frame); err != nil {
+		return err
+	}
+	if err := n.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// startHeartbeat 在超过 interval 没有写出帧时写出 heartbeat 帧, 有输出时不发送
+// 返回的函数停止发送并等待正在写出的 heartbeat 完成, 之后不会再写出 heartbeat
+func (n *ndjsonWriter) startHeartbeat(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			n.mu.Lock()
+			idle := time.Since(n.lastFrame)
+			if idle >= interval {
+				// 写出失败说明客户端已断开, 命令的输出写入同样会失败
+				n.encode(HeartbeatFrame{Type: "heartbeat"})
+				idle = 0
+			}
+			n.mu.Unlock()
+			timer.Reset(interval - idle)
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// begun 停止 flushTimer 并返回是否已有输出(包括暂存未写出的), 没有时之后不再写出任何帧, 由调用方返回普通的错误响应
+func (n *ndjsonWriter) begun() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.flushTimer != nil {
+		n.flushTimer.Stop()
+		n.flushTimer = nil
+	}
+	if n.started || len(n.pending) > 0 {
+		return true
+	}
+	n.ended = true
+	return false
+}
+
+// end 写出剩余的输出和 end 帧
+func (n *ndjsonWriter) end(result *CommandResult, err error, requestID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ended = true
+	if n.flushTimer != nil {
+		n.flushTimer.Stop()
+		n.flushTimer = nil
+	}
+	if len(n.pending) > 0 {
+		if werr := n.frame(n.pending); werr != nil {
+			log.Printf("✗ Failed to write output frame | Error: %v", werr)
+			return
+		}
+		n.pending = nil
+	}
+	n.start()
+
+	frame := EndFrame{Type: "end"}
+	if result != nil {
+		frame.ExitCode = result.ExitCode
+		frame.Size = result.Size
+		frame.TimedOut = result.TimedOut
+		frame.Aborted = result.Aborted
+		frame.Cancelled = result.Cancelled
+		frame.Truncated = result.Truncated
+		frame.Encoding = result.Encoding
+		frame.Recycled = result.Recycled
+		frame.Status = result.Status
+		frame.CPUMs = result.CPUMs
+		frame.PeakMemoryBytes = result.PeakMemoryBytes
+		frame.Exception = result.Exception
+	}
+	if err != nil {
+		frame.Error = &ErrorBody{Code: errorCode(err), Message: err.Error(), RequestID: requestID}
+	}
+	if werr := n.encode(frame); werr != nil {
+		log.Printf("✗ Failed to write end frame | Error: %v", werr)
+	}
+}
+
+// incompleteRuneSuffix 返回末尾不完整的 UTF-8 字符的字节数, 无效的字节不会被保留
+func incompleteRuneSuffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if c < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// streamRunCommand 以 NDJSON 帧边执行边返回 /run-command 的输出
+// 开始输出前的错误以普通的 JSON 错误响应返回, 之后(包括发送过 heartbeat 后)的错误在 end 帧的 error 中返回
+func streamRunCommand(w http.ResponseWriter, r *http.Request, req RunCommandRequest) {
+	stream := newNDJSONWriter(w)
+	req.stream = stream
+	stopHeartbeat := stream.startHeartbeat(streamHeartbeatInterval)
+	result, _, err := runCommand(identityFrom(r), req)
+	stopHeartbeat()
+	if err != nil && !stream.begun() {
+		if result != nil && result.Recycled != "" {
+			w.Header().Set(recycledHeader, result.Recycled)
+		}
+		if result != nil && (result.TimedOut || result.Aborted || result.Cancelled) {
+			writeErrorResult(w, err, result)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	stream.end(result, err, w.Header().Get(requestIDHeader))
+	if !req.Probe {
+		logCommand("✓ Stream sent | SessionID: %s | Output length: %d bytes", req.SessionID, stream.offset)
+	}
+}
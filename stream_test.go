@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamFrame NDJSON 响应中的一帧, 包含所有帧类型的字段
+type streamFrame struct {
+	Type     string          `json:"type"`
+	Data     string          `json:"data"`
+	Offset   int             `json:"offset"`
+	ExitCode *int            `json:"exit_code"`
+	Size     int             `json:"size"`
+	TimedOut bool            `json:"timed_out"`
+	Error    *ErrorBody      `json:"error"`
+	Encoding *OutputEncoding `json:"encoding"`
+}
+
+// stream 以 Accept: application/x-ndjson 执行命令, 返回响应和解析后的帧
+func (ts *testServer) stream(token, sessionID, command string, extra map[string]any) (*http.Response, []streamFrame) {
+	ts.t.Helper()
+	body := map[string]any{"session_id": sessionID, "command": command}
+	for k, v := range extra {
+		body[k] = v
+	}
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/run-command", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", ndjsonContentType)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, out := ts.send(req)
+	if resp.Header.Get("Content-Type") != ndjsonContentType {
+		return resp, nil
+	}
+	var frames []streamFrame
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		var f streamFrame
+		decodeJSON(ts.t, []byte(line), &f)
+		frames = append(frames, f)
+	}
+	return resp, frames
+}
+
+// streamOutput 拼接 stdout 帧并检查偏移连续, 返回输出和 end 帧
+func streamOutput(t *testing.T, frames []streamFrame) (string, streamFrame) {
+	t.Helper()
+	var out strings.Builder
+	var end streamFrame
+	for _, f := range frames {
+		switch f.Type {
+		case "stdout":
+			if f.Offset != out.Len() {
+				t.Fatalf("frame offset %d, want %d", f.Offset, out.Len())
+			}
+			out.WriteString(f.Data)
+		case "end":
+			end = f
+		}
+	}
+	if len(frames) == 0 || frames[len(frames)-1].Type != "end" {
+		t.Fatalf("stream does not finish with an end frame: %+v", frames)
+	}
+	return out.String(), end
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	tests := map[string]bool{
+		"application/x-ndjson":                    true,
+		"text/plain, Application/X-NDJSON; q=0.5": true,
+		"application/x-ndjson;q=0":                false,
+		"application/json":                        false,
+		"*/*":                                     false,
+		"":                                        false,
+	}
+	for header, want := range tests {
+		if got := acceptsNDJSON(header); got != want {
+			t.Errorf("acceptsNDJSON(%q) = %t, want %t", header, got, want)
+		}
+	}
+}
+
+func TestIncompleteRuneSuffix(t *testing.T) {
+	tests := map[string]int{"abc": 0, "é": 0, "\xc3": 1, "a\xe4\xb8": 2, "\xf0\x9f\x98": 3, "\xff": 0}
+	for in, want := range tests {
+		if got := incompleteRuneSuffix([]byte(in)); got != want {
+			t.Errorf("incompleteRuneSuffix(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestNDJSONWriterKeepsRunesWhole(t *testing.T) {
+	rec := httptest.NewRecorder()
+	n := newNDJSONWriter(rec)
+	n.Write([]byte("caf\xc3"))
+	n.Write([]byte("\xa9 ok"))
+	n.end(&CommandResult{Size: 8}, nil, "req-1")
+
+	var frames []streamFrame
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var f streamFrame
+		decodeJSON(t, []byte(line), &f)
+		frames = append(frames, f)
+	}
+	// 拆开的 é 留到下一帧, 每帧都是完整的 UTF-8
+	if len(frames) != 3 || frames[0].Data != "caf" || frames[1].Data != "é ok" || frames[1].Offset != 3 || frames[2].Type != "end" {
+		t.Fatalf("frames = %+v", frames)
+	}
+	if rec.Header().Get("Content-Type") != ndjsonContentType || rec.Header().Get("X-Accel-Buffering") != "no" {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+}
+
+func TestStreamRunCommand(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Lines":    {Output: "one\ntwo\nthree", ExitCode: 2},
+			"Long-Job": {Output: "started", DelayMs: 2000},
+		}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, frames := ts.stream(aliceToken, id, "Lines", nil)
+	if resp.StatusCode != http.StatusOK || frames == nil {
+		t.Fatalf("stream = %d %v", resp.StatusCode, resp.Header)
+	}
+	// 流式输出不压缩
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("stream compressed with %s", resp.Header.Get("Content-Encoding"))
+	}
+	output, end := streamOutput(t, frames)
+	if !strings.HasPrefix(output, "one\ntwo\nthree") || end.ExitCode == nil || *end.ExitCode != 2 || end.Error != nil {
+		t.Fatalf("output %q, end %+v", output, end)
+	}
+
+	// 开始输出后的超时在 end 帧中返回
+	_, frames = ts.stream(aliceToken, id, "Long-Job", map[string]any{"timeout_ms": 200})
+	output, end = streamOutput(t, frames)
+	if !strings.HasPrefix(output, "started") || !end.TimedOut || end.Error == nil || end.Error.Code != codeCommandTimeout {
+		t.Fatalf("timed out stream: output %q, end %+v", output, end)
+	}
+}
+
+func TestStreamRunCommandErrors(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	// 开始输出前的错误仍是普通的错误响应
+	if resp, frames := ts.stream(bobToken, id, "echo hi", nil); resp.StatusCode != http.StatusNotFound || frames != nil {
+		t.Fatalf("cross-tenant stream = %d %+v", resp.StatusCode, frames)
+	}
+	for _, extra := range []map[string]any{
+		{"output_to_file": true},
+		{"coalesce": true},
+		{"output_format": "base64"},
+	} {
+		if resp, _ := ts.stream(aliceToken, id, "echo hi", extra); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("stream with %v = %d", extra, resp.StatusCode)
+		}
+	}
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamHeartbeatInterval = Duration(50 * time.Millisecond)
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Quiet-Job": {Output: "started", DelayMs: 300},
+			"Slow-Fail": {DelayMs: 300},
+		}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 没有输出时发送 heartbeat, 输出和 end 帧不受影响
+	_, frames := ts.stream(aliceToken, id, "Quiet-Job", nil)
+	heartbeats := 0
+	for _, f := range frames {
+		if f.Type == "heartbeat" {
+			heartbeats++
+		}
+	}
+	output, end := streamOutput(t, frames)
+	if heartbeats == 0 || !strings.HasPrefix(output, "started") || end.ExitCode == nil {
+		t.Fatalf("%d heartbeats, output %q, end %+v", heartbeats, output, end)
+	}
+
+	// 发送过 heartbeat 后响应头已写出, 超时在 end 帧中返回
+	resp, frames := ts.stream(aliceToken, id, "Slow-Fail", map[string]any{"timeout_ms": 200})
+	if resp.StatusCode != http.StatusOK || frames[0].Type != "heartbeat" {
+		t.Fatalf("timed out stream = %d %+v", resp.StatusCode, frames)
+	}
+	if _, end = streamOutput(t, frames); end.Error == nil || end.Error.Code != codeCommandTimeout {
+		t.Fatalf("end = %+v", end)
+	}
+}
+
+func TestHeartbeatSkippedWhileOutputFlows(t *testing.T) {
+	rec := httptest.NewRecorder()
+	n := newNDJSONWriter(rec)
+	stop := n.startHeartbeat(40 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		n.Write([]byte("x"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	// 停止后不再写出
+	body := rec.Body.String()
+	time.Sleep(60 * time.Millisecond)
+	if strings.Contains(body, "heartbeat") || rec.Body.String() != body {
+		t.Fatalf("heartbeat written while output flowed:\n%s", body)
+	}
+	// interval 为 0 时不发送, 返回的函数可以直接调用
+	n.startHeartbeat(0)()
+}
+
+// recordedFrames 在 n.mu 下解析 rec 中已写出的帧, 与 flushTimer 写出的帧不会并发
+func recordedFrames(t *testing.T, n *ndjsonWriter, rec *httptest.ResponseRecorder) []streamFrame {
+	t.Helper()
+	n.mu.Lock()
+	body := strings.TrimSpace(rec.Body.String())
+	n.mu.Unlock()
+	var frames []streamFrame
+	if body == "" {
+		return nil
+	}
+	for _, line := range strings.Split(body, "\n") {
+		var f streamFrame
+		decodeJSON(t, []byte(line), &f)
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestNDJSONWriterCoalesces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	n := newNDJSONWriter(rec)
+	n.minFlush, n.maxDelay = 10, time.Hour
+	n.Write([]byte("ab"))
+	n.Write([]byte("cd"))
+	if frames := recordedFrames(t, n, rec); len(frames) != 0 {
+		t.Fatalf("flushed below stream_min_flush_bytes: %+v", frames)
+	}
+	// 暂存达到 minFlush 时合并为一帧写出
+	n.Write([]byte("efghijk"))
+	n.Write([]byte("l"))
+	n.end(&CommandResult{Size: 12}, nil, "req-1")
+	frames := recordedFrames(t, n, rec)
+	if len(frames) != 3 || frames[0].Data != "abcdefghijk" || frames[1].Data != "l" || frames[1].Offset != 11 || frames[2].Type != "end" {
+		t.Fatalf("frames = %+v", frames)
+	}
+}
+
+func TestNDJSONWriterMaxFlushDelay(t *testing.T) {
+	rec := httptest.NewRecorder()
+	n := newNDJSONWriter(rec)
+	n.minFlush, n.maxDelay = 1000, 20*time.Millisecond
+	n.Write([]byte("slow"))
+	// 输出停顿时不超过 maxDelay 就写出
+	waitFor(t, func() bool { return len(recordedFrames(t, n, rec)) == 1 })
+	if frames := recordedFrames(t, n, rec); frames[0].Data != "slow" {
+		t.Fatalf("frames = %+v", frames)
+	}
+	n.end(&CommandResult{Size: 4}, nil, "req-1")
+	if frames := recordedFrames(t, n, rec); len(frames) != 2 || frames[1].Type != "end" {
+		t.Fatalf("frames after end = %+v", frames)
+	}
+}
+
+func TestNDJSONWriterBegun(t *testing.T) {
+	rec := httptest.NewRecorder()
+	n := newNDJSONWriter(rec)
+	n.minFlush, n.maxDelay = 1000, time.Hour
+	if n.begun() {
+		t.Fatal("begun without output")
+	}
+	// 暂存未写出的输出同样算作已开始
+	n = newNDJSONWriter(rec)
+	n.minFlush, n.maxDelay = 1000, time.Hour
+	n.Write([]byte("held"))
+	if !n.begun() {
+		t.Fatal("pending output not counted")
+	}
+}
+
+func TestStreamFlushConfig(t *testing.T) {
+	for _, tt := range []struct {
+		min   int
+		delay time.Duration
+		ok    bool
+	}{
+		{0, 0, true},
+		{4096, 50 * time.Millisecond, true},
+		{-1, time.Second, false},
+		{maxOutputSize + 1, time.Second, false},
+		{4096, 0, false},
+	} {
+		cfg := DefaultConfig()
+		cfg.StreamMinFlushBytes, cfg.StreamMaxFlushDelay = tt.min, Duration(tt.delay)
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%d, %s) = %v, want ok %t", tt.min, tt.delay, err, tt.ok)
+		}
+	}
+}
+
+func TestStreamCoalescedOutput(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.StreamMinFlushBytes = 4096
+		cfg.FakeOutputs = map[string]FakeOutput{"Lines": {Output: "one\ntwo\nthree"}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	resp, frames := ts.stream(aliceToken, id, "Lines", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream = %d", resp.StatusCode)
+	}
+	// 不足 stream_min_flush_bytes 的输出在 end 帧之前写出
+	if out, end := streamOutput(t, frames); out != "one\ntwo\nthree" || end.Size != len(out) {
+		t.Fatalf("output = %q, end = %+v", out, end)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxSubShells 单个会话中同时打开的子 shell 上限
+	maxSubShells = 16
+	// subShellPollInterval 查询子 shell 命令是否完成的间隔, 两次查询之间不占用会话
+	subShellPollInterval = 100 * time.Millisecond
+)
+
+// 子 shell 是会话 PowerShell 进程中的独立 runspace, 各自有变量和当前目录
+// 命令通过 BeginInvoke 在 runspace 中异步执行, 主管道只用于短暂的启动和查询, 多个子 shell 的命令可以并发执行
+const (
+	psOpenSubShell = "if (-not $global:__rceSubShells) { $global:__rceSubShells = @{} }; " +
+		"$__ps = [powershell]::Create(); $__ps.Runspace = [runspacefactory]::CreateRunspace(); $__ps.Runspace.Open(); " +
+		"$global:__rceSubShells['%s'] = @{ PS = $__ps; Handle = $null }; 'opened'"
+	// 命令在 runspace 中的输出为 [文本, 退出码]
+	psStartSubShell = "$__sub = $global:__rceSubShells['%s']; [void]$__sub.PS.Commands.Clear(); " +
+		"[void]$__sub.PS.AddScript('$global:LASTEXITCODE = 0; & ([scriptblock]::Create($args[0])) *>&1 | Out-String; $global:LASTEXITCODE')." +
+		"AddArgument([System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String('%s'))); " +
+		"$__sub.Handle = $__sub.PS.BeginInvoke(); 'started'"
+	// 第一行为状态: running、missing 或 done:<退出码>, 之后为命令输出
+	psPollSubShell = "$__sub = $global:__rceSubShells['%s']; " +
+		"if (-not $__sub) { 'missing' } elseif (-not $__sub.Handle.IsCompleted) { 'running' } " +
+		"else { try { $__r = @($__sub.PS.EndInvoke($__sub.Handle)); 'done:' + $__r[-1]; $__r[0..($__r.Count - 2)] } " +
+		"catch { 'done:'; $_ | Out-String } finally { $__sub.Handle = $null } }"
+	psStopSubShell  = "$__sub = $global:__rceSubShells['%s']; if ($__sub) { $__sub.PS.Stop(); $__sub.Handle = $null }; 'stopped'"
+	psCloseSubShell = "$__sub = $global:__rceSubShells['%s']; " +
+		"if ($__sub) { $__sub.PS.Stop(); $__sub.PS.Runspace.Dispose(); $__sub.PS.Dispose(); $global:__rceSubShells.Remove('%s') }; 'closed'"
+	// psCloseAllSubShells 会话正常退出前关闭所有 runspace
+	psCloseAllSubShells = "if ($global:__rceSubShells) { foreach ($__sub in @($global:__rceSubShells.Values)) " +
+		"{ $__sub.PS.Stop(); $__sub.PS.Runspace.Dispose(); $__sub.PS.Dispose() }; $global:__rceSubShells.Clear() }"
+)
+
+var (
+	errSubShellUnsupported = errors.New("sub-shells require a PowerShell session")
+	errSubShellNotFound    = errors.New("sub-shell not found")
+	errTooManySubShells    = fmt.Errorf("too many sub-shells, at most %d per session", maxSubShells)
+)
+
+// subShell 会话中的一个子 shell
+type subShell struct {
+	ID        string
+	CreatedAt time.Time
+	// mu 同一子 shell 同时只执行一条命令
+	mu sync.Mutex
+}
+
+// runInternal 在主管道中执行内部命令, 返回其输出
+func (s *Session) runInternal(command string, opts RunOptions) (string, error) {
+	var buf bytes.Buffer
+	if _, err := s.RunCommandTo(command, &buf, opts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// subShell 获取会话中的子 shell
+func (s *Session) subShell(subID string) (*subShell, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, exists := s.subShells[subID]
+	return sub, exists
+}
+
+// OpenSubShell 在会话中创建新的 runspace
+func (s *Session) OpenSubShell() (string, error) {
+	if s.shell.Type != ShellPowerShell {
+		return "", errSubShellUnsupported
+	}
+	if s.constrained {
+		return "", errSubShellConstrained
+	}
+	if s.options.Remote != nil {
+		return "", errSubShellRemote
+	}
+	s.mu.Lock()
+	count := len(s.subShells)
+	s.mu.Unlock()
+	if count >= maxSubShells {
+		return "", errTooManySubShells
+	}
+
+	subID := uuid.New().String()
+	out, err := s.runInternal(fmt.Sprintf(psOpenSubShell, subID), RunOptions{})
+	if err != nil {
+		return "", err
+	}
+	if out = strings.TrimSpace(out); out != "opened" {
+		return "", fmt.Errorf("failed to open sub-shell: %s", out)
+	}
+
+	s.mu.Lock()
+	s.subShells[subID] = &subShell{ID: subID, CreatedAt: time.Now()}
+	s.mu.Unlock()
+
+	log.Printf("✓ Sub-shell opened | SessionID: %s | SubShellID: %s", s.ID, subID)
+	return subID, nil
+}
+
+// RunInSubShell 在子 shell 中执行命令并等待完成, 等待期间会话可以执行其他命令
+func (s *Session) RunInSubShell(subID, command string, opts RunOptions) (*CommandResult, error) {
+	sub, exists := s.subShell(subID)
+	if !exists {
+		return nil, errSubShellNotFound
+	}
+	if err := memoryGuard.Check(); err != nil {
+		log.Printf("✗ Command refused: total session memory over limit | SessionID: %s | Memory: %d MB", s.ID, memoryGuard.Total()>>20)
+		return nil, err
+	}
+	// 命令在子 shell 中执行期间一直占用名额, 启动和轮询的内部命令不再单独获取
+	if err := commandLimiter.Acquire(s.interrupt); err != nil {
+		return nil, err
+	}
+	defer commandLimiter.Release()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	logCommand("→ Executing command in sub-shell | SessionID: %s | SubShellID: %s | Command: %s", s.ID, subID, command)
+	started := time.Now()
+	defer func() { logSlowCommand(s.ID, command, time.Since(started)) }()
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(wrapCommand(s.commandTemplate, command)))
+	out, err := s.runInternal(fmt.Sprintf(psStartSubShell, subID, encoded), RunOptions{holdsSlot: true})
+	if err != nil {
+		return nil, err
+	}
+	if out = strings.TrimSpace(out); out != "started" {
+		return nil, fmt.Errorf("failed to start command in sub-shell: %s", out)
+	}
+
+	timeout := s.timeoutFor(opts)
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(subShellPollInterval)
+
+		out, err := s.runInternal(fmt.Sprintf(psPollSubShell, subID), RunOptions{StripANSI: opts.StripANSI, NormalizeNewlines: opts.NormalizeNewlines, StripBOM: opts.StripBOM, holdsSlot: true})
+		if err != nil {
+			return nil, err
+		}
+		status, output, _ := strings.Cut(out, "\n")
+		status = strings.TrimSpace(status)
+
+		switch {
+		case status == "running":
+		case status == "missing":
+			return nil, errSubShellNotFound
+		case strings.HasPrefix(status, "done"):
+			output = strings.TrimRight(output, "\r\n")
+			logCommand("✓ Sub-shell command finished | SessionID: %s | SubShellID: %s | Output length: %d bytes", s.ID, subID, len(output))
+			return &CommandResult{
+				Output:   output,
+				Size:     len(output),
+				ExitCode: parseExitCode(strings.TrimPrefix(status, "done")),
+			}, nil
+		default:
+			return nil, fmt.Errorf("failed to poll sub-shell: %s", strings.TrimSpace(out))
+		}
+
+		if timeout > 0 && time.Now().After(deadline) {
+			log.Printf("✗ Sub-shell command timed out | SessionID: %s | SubShellID: %s | Timeout: %s", s.ID, subID, timeout)
+			if _, err := s.runInternal(fmt.Sprintf(psStopSubShell, subID), RunOptions{holdsSlot: true}); err != nil {
+				log.Printf("⚠ Failed to stop sub-shell command | SessionID: %s | SubShellID: %s | Error: %v", s.ID, subID, err)
+			}
+			return &CommandResult{TimedOut: true, Error: errCommandTimeout.Error()}, errCommandTimeout
+		}
+	}
+}
+
+// CloseSubShell 停止子 shell 中正在执行的命令并释放 runspace
+func (s *Session) CloseSubShell(subID string) error {
+	s.mu.Lock()
+	_, exists := s.subShells[subID]
+	delete(s.subShells, subID)
+	s.mu.Unlock()
+	if !exists {
+		return errSubShellNotFound
+	}
+
+	if _, err := s.runInternal(fmt.Sprintf(psCloseSubShell, subID, subID), RunOptions{}); err != nil {
+		return err
+	}
+	log.Printf("✓ Sub-shell closed | SessionID: %s | SubShellID: %s", s.ID, subID)
+	return nil
+}
+
+// SubShellRequest 子 shell 接口的参数
+type SubShellRequest struct {
+	SessionID  string `json:"session_id"`
+	SubShellID string `json:"subshell_id"`
+	// Command 和 TimeoutMs 仅用于在子 shell 中执行命令
+	Command   string `json:"command"`
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+// subShellError 将子 shell 的错误转换为带状态码的错误
+func subShellError(req SubShellRequest, err error) error {
+	switch {
+	case errors.Is(err, errSubShellUnsupported) || errors.Is(err, errSubShellConstrained) || errors.Is(err, errSubShellRemote):
+		log.Printf("✗ Sub-shells not supported | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusBadRequest, "%v", err)
+	case errors.Is(err, errSubShellNotFound):
+		log.Printf("✗ Sub-shell not found | SessionID: %s | SubShellID: %s", req.SessionID, req.SubShellID)
+		return newAPIErrorCode(http.StatusNotFound, codeSubShellNotFound, "Sub-shell not found")
+	case errors.Is(err, errTooManySubShells):
+		log.Printf("✗ Too many sub-shells | SessionID: %s", req.SessionID)
+		return newAPIError(http.StatusConflict, "%v", err)
+	case errors.Is(err, errCommandTimeout):
+		return newAPIErrorCode(http.StatusGatewayTimeout, codeCommandTimeout, "%v", err)
+	case errors.Is(err, errTooManyCommands):
+		return newAPIErrorCode(http.StatusTooManyRequests, codeServerBusy, "%v", err)
+	case errors.Is(err, errReadGuardSaturated):
+		return newAPIErrorCode(http.StatusServiceUnavailable, codeServerUnhealthy, "%v", err)
+	case errors.Is(err, errMemoryLimit):
+		return newAPIErrorCode(http.StatusServiceUnavailable, codeMemoryLimit, "%v", err)
+	default:
+		log.Printf("✗ Sub-shell operation failed | SessionID: %s | SubShellID: %s | Error: %v", req.SessionID, req.SubShellID, err)
+		return newAPIError(http.StatusInternalServerError, "Sub-shell operation failed: %v", err)
+	}
+}
+
+// subShellSession 校验参数并获取请求方的会话
+func subShellSession(identity *Identity, req SubShellRequest, needSubShell bool) (*Session, error) {
+	if req.SessionID == "" || (needSubShell && req.SubShellID == "") {
+		log.Printf("✗ Missing required parameters | SessionID: %s | SubShellID: %s", req.SessionID, req.SubShellID)
+		return nil, newAPIError(http.StatusBadRequest, "session_id and subshell_id are required")
+	}
+	if err := validateSessionID(req.SessionID); err != nil {
+		return nil, err
+	}
+	session, exists := sessionManager.GetSessionFor(req.SessionID, identity)
+	if !exists {
+		return nil, sessionNotFound(req.SessionID, identity)
+	}
+	return session, nil
+}
+
+// openSubShell 在请求方的会话中创建子 shell
+func openSubShell(identity *Identity, req SubShellRequest) (string, error) {
+	log.Printf("→ Request: Open sub-shell | SessionID: %s", req.SessionID)
+
+	session, err := subShellSession(identity, req, false)
+	if err != nil {
+		return "", err
+	}
+	subID, err := session.OpenSubShell()
+	if err != nil {
+		return "", subShellError(req, err)
+	}
+	return subID, nil
+}
+
+// runInSubShell 在请求方的子 shell 中执行命令, 超时时 result 与错误同时返回
+func runInSubShell(identity *Identity, req SubShellRequest) (*CommandResult, error) {
+	if req.Command == "" {
+		log.Printf("✗ Missing command parameter | SessionID: %s", req.SessionID)
+		return nil, newAPIError(http.StatusBadRequest, "command is required")
+	}
+	if req.TimeoutMs < 0 {
+		log.Printf("✗ Invalid timeout | SessionID: %s | TimeoutMs: %d", req.SessionID, req.TimeoutMs)
+		return nil, newAPIError(http.StatusBadRequest, "timeout_ms must not be negative")
+	}
+
+	logCommand("→ Request: Run command in sub-shell | SessionID: %s | SubShellID: %s | Command: %s", req.SessionID, req.SubShellID, req.Command)
+
+	session, err := subShellSession(identity, req, true)
+	if err != nil {
+		return nil, err
+	}
+	opts := RunOptions{Timeout: time.Duration(req.TimeoutMs) * time.Millisecond}
+	result, err := session.RunInSubShell(req.SubShellID, req.Command, opts)
+	auditCommand(identity, req.SessionID, req.Command, result, err)
+	notifyCommand(identity, req.SessionID, req.Command, result, err)
+	if err != nil {
+		return result, subShellError(req, err)
+	}
+	return result, nil
+}
+
+// closeSubShell 关闭请求方的子 shell
+func closeSubShell(identity *Identity, req SubShellRequest) error {
+	log.Printf("→ Request: Close sub-shell | SessionID: %s | SubShellID: %s", req.SessionID, req.SubShellID)
+
+	session, err := subShellSession(identity, req, true)
+	if err != nil {
+		return err
+	}
+	if err := session.CloseSubShell(req.SubShellID); err != nil {
+		return subShellError(req, err)
+	}
+	return nil
+}
+
+// decodeSubShellRequest 解析子 shell 接口的请求体
+func decodeSubShellRequest(w http.ResponseWriter, r *http.Request) (SubShellRequest, bool) {
+	var req SubShellRequest
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("✗ Invalid request body | Error: %v", err)
+		writeError(w, newAPIError(http.StatusBadRequest, "Invalid request body"))
+		return req, false
+	}
+	return req, true
+}
+
+// API10: 打开子 shell
+func handleOpenSubShell(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSubShellRequest(w, r)
+	if !ok {
+		return
+	}
+
+	subID, err := openSubShell(identityFrom(r), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"session_id":  req.SessionID,
+		"subshell_id": subID,
+	})
+}
+
+// API11: 在子 shell 中执行命令
+func handleRunInSubShell(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSubShellRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := runInSubShell(identityFrom(r), req)
+	if result != nil && result.TimedOut {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err))
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	logCommand("✓ Response sent | SessionID: %s | SubShellID: %s | Output length: %d bytes", req.SessionID, req.SubShellID, result.Size)
+	if result.ExitCode != nil {
+		w.Header().Set("X-Exit-Code", strconv.Itoa(*result.ExitCode))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(result.Output))
+}
+
+// API12: 关闭子 shell
+func handleCloseSubShell(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSubShellRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := closeSubShell(identityFrom(r), req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Sub-shell closed successfully",
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultSessionTailSize = 64 * 1024
+	// defaultTailBytes 未指定 bytes 时返回的字节数
+	defaultTailBytes = 4096
+)
+
+// ringBuffer 保存最近写入的 size 字节, 写满后覆盖最早的内容
+type ringBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+	// total 累计写入的字节数
+	total int64
+	mu    sync.Mutex
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+// Write 追加内容, 超过容量的部分覆盖最早的内容
+func (rb *ringBuffer) Write(b []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	n := len(b)
+	rb.total += int64(n)
+	if n >= len(rb.buf) {
+		copy(rb.buf, b[n-len(rb.buf):])
+		rb.pos = 0
+		rb.full = true
+		return n, nil
+	}
+	c := copy(rb.buf[rb.pos:], b)
+	if c < n {
+		copy(rb.buf, b[c:])
+		rb.full = true
+	}
+	rb.pos = (rb.pos + n) % len(rb.buf)
+	if rb.pos == 0 {
+		rb.full = true
+	}
+	return n, nil
+}
+
+// Tail 返回最近的 n 字节和累计写入的字节数
+func (rb *ringBuffer) Tail(n int) ([]byte, int64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	size := rb.pos
+	if rb.full {
+		size = len(rb.buf)
+	}
+	if n > size {
+		n = size
+	}
+	out := make([]byte, 0, n)
+	start := rb.pos - n
+	if start < 0 {
+		out = append(out, rb.buf[len(rb.buf)+start:]...)
+		start = 0
+	}
+	out = append(out, rb.buf[start:rb.pos]...)
+	return out, rb.total
+}
+
+// API19: 查看会话最近的 stdout(或 stream=stderr 时的 stderr)输出, 不等待正在执行的命令
+// 返回 shell 原始输出, 包括服务端用于分隔命令的标记行, 用于排查不结束的命令
+func handleSessionTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "session_id is required"))
+		return
+	}
+	if err := validateSessionID(sessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	n := defaultTailBytes
+	if v := r.URL.Query().Get("bytes"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Printf("✗ Invalid bytes parameter | SessionID: %s | Bytes: %q", sessionID, v)
+			writeError(w, newAPIError(http.StatusBadRequest, "bytes must be a positive integer"))
+			return
+		}
+	}
+
+	session, exists := sessionManager.GetSessionFor(sessionID, identityFrom(r))
+	if !exists {
+		writeError(w, sessionNotFound(sessionID, identityFrom(r)))
+		return
+	}
+	tail := session.tail
+	switch stream := r.URL.Query().Get("stream"); stream {
+	case "", "stdout":
+	case "stderr":
+		tail = session.stderrTail
+		if tail == nil {
+			log.Printf("✗ Session stderr tail disabled | SessionID: %s", sessionID)
+			writeError(w, newAPIError(http.StatusBadRequest, "stderr tail is disabled, set stderr_handling to %s to enable", StderrTail))
+			return
+		}
+	default:
+		writeError(w, newAPIError(http.StatusBadRequest, "stream must be stdout or stderr"))
+		return
+	}
+	if tail == nil {
+		log.Printf("✗ Session tail disabled | SessionID: %s", sessionID)
+		writeError(w, newAPIError(http.StatusBadRequest, "session tail is disabled, set session_tail_size to enable"))
+		return
+	}
+
+	data, total := tail.Tail(n)
+	if f := newRedactFilter(session.secrets); f != nil {
+		// 截取的开头可能是机密值的后半部分, 无法识别, 完整出现的值都会被替换
+		data = append(f.filter(data), f.flush()...)
+	}
+
+	log.Printf("✓ Session tail sent | SessionID: %s | Size: %d bytes", sessionID, len(data))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Total-Bytes", strconv.FormatInt(total, 10))
+	w.Write(data)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParamType 模板参数的类型
+type ParamType string
+
+const (
+	ParamString ParamType = "string"
+	ParamInt    ParamType = "int"
+	ParamEnum   ParamType = "enum"
+	ParamPath   ParamType = "path"
+)
+
+var (
+	errTemplateNotFound    = errors.New("template not found")
+	errInvalidParams       = errors.New("invalid template parameters")
+	errTemplatesOnly       = errors.New("only templated commands are allowed, use template or script instead of command")
+	errTemplateUnsupported = errors.New("templates are not supported by cmd sessions")
+)
+
+// templatePlaceholder 模板中的参数占位符 {{name}}
+var templatePlaceholder = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+
+// TemplateParam 模板参数的定义
+type TemplateParam struct {
+	Type ParamType `json:"type"`
+	// Values enum 类型允许的取值
+	Values []string `json:"values"`
+	// Default 未提供参数时使用的值, 为空时参数必填
+	Default json.RawMessage `json:"default"`
+}
+
+// CommandTemplate 服务端登记的命令模板, 客户端按名称调用并传入参数
+// 参数值替换占位符时按会话的 shell 转义为字符串字面量(int 为数字), 不会被当作代码执行
+type CommandTemplate struct {
+	// Command 带 {{name}} 占位符的命令, 占位符不能放在引号中
+	Command string                    `json:"command"`
+	Params  map[string]*TemplateParam `json:"params"`
+}
+
+// validate 检查模板中的占位符和参数定义一一对应
+func (t *CommandTemplate) validate() error {
+	if t.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+	used := make(map[string]bool)
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(t.Command, -1) {
+		if _, ok := t.Params[m[1]]; !ok {
+			return fmt.Errorf("placeholder {{%s}} has no parameter definition", m[1])
+		}
+		used[m[1]] = true
+	}
+	for name, p := range t.Params {
+		if p == nil {
+			return fmt.Errorf("parameter %s: definition is empty", name)
+		}
+		if !used[name] {
+			return fmt.Errorf("parameter %s is not used in command", name)
+		}
+		switch p.Type {
+		case ParamString, ParamInt, ParamPath:
+			if len(p.Values) > 0 {
+				return fmt.Errorf("parameter %s: values can only be used with enum", name)
+			}
+		case ParamEnum:
+			if len(p.Values) == 0 {
+				return fmt.Errorf("parameter %s: enum requires values", name)
+			}
+		default:
+			return fmt.Errorf("parameter %s: unknown type %q", name, p.Type)
+		}
+		if p.Default != nil {
+			if _, err := p.parse(p.Default); err != nil {
+				return fmt.Errorf("parameter %s: invalid default: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// templateValue 解析后的参数值, quoted 为 false 时直接放入命令(int)
+type templateValue struct {
+	text   string
+	quoted bool
+}
+
+// parse 按参数类型解析 JSON 值, 类型不符时返回错误
+func (p *TemplateParam) parse(raw json.RawMessage) (templateValue, error) {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return templateValue{}, fmt.Errorf("must not be null")
+	}
+	if p.Type == ParamInt {
+		// 只接受 JSON 数字形式的十进制整数, 不接受 "5"、1e3、1.0 等写法
+		i, err := strconv.ParseInt(string(bytes.TrimSpace(raw)), 10, 64)
+		if err != nil {
+			return templateValue{}, fmt.Errorf("must be an integer")
+		}
+		return templateValue{text: strconv.FormatInt(i, 10)}, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return templateValue{}, fmt.Errorf("must be a string")
+	}
+	if strings.ContainsRune(s, 0) {
+		return templateValue{}, fmt.Errorf("must not contain NUL")
+	}
+	switch p.Type {
+	case ParamEnum:
+		for _, v := range p.Values {
+			if s == v {
+				return templateValue{text: s, quoted: true}, nil
+			}
+		}
+		return templateValue{}, fmt.Errorf("must be one of %s", strings.Join(p.Values, ", "))
+	case ParamPath:
+		if s == "" || strings.ContainsAny(s, "\r\n") {
+			return templateValue{}, fmt.Errorf("must be a non-empty single-line path")
+		}
+	}
+	return templateValue{text: s, quoted: true}, nil
+}
+
+// expand 用参数替换占位符, 生成在 shellType 中执行的命令
+func (t *CommandTemplate) expand(shellType ShellType, params map[string]json.RawMessage) (string, error) {
+	var quote func(string) string
+	switch shellType {
+	case ShellPowerShell:
+		quote = psQuote
+	case ShellBash:
+		quote = bashQuote
+	default:
+		return "", errTemplateUnsupported
+	}
+
+	var unknown []string
+	for name := range params {
+		if _, ok := t.Params[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", fmt.Errorf("%w: unknown parameters: %s", errInvalidParams, strings.Join(unknown, ", "))
+	}
+
+	values := make(map[string]string, len(t.Params))
+	for name, p := range t.Params {
+		raw, ok := params[name]
+		if !ok {
+			if p.Default == nil {
+				return "", fmt.Errorf("%w: %s is required", errInvalidParams, name)
+			}
+			raw = p.Default
+		}
+		v, err := p.parse(raw)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s %v", errInvalidParams, name, err)
+		}
+		if v.quoted {
+			v.text = quote(v.text)
+		}
+		values[name] = v.text
+	}
+
+	return templatePlaceholder.ReplaceAllStringFunc(t.Command, func(m string) string {
+		return values[m[2:len(m)-2]]
+	}), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"testing"
+)
+
+func TestTemplateValidate(t *testing.T) {
+	tests := []struct {
+		tmpl CommandTemplate
+		ok   bool
+	}{
+		{CommandTemplate{Command: "Restart-Service -Name {{name}}", Params: map[string]*TemplateParam{"name": {Type: ParamString}}}, true},
+		{CommandTemplate{Command: "Get-Date"}, true},
+		{CommandTemplate{}, false},
+		// 占位符没有参数定义、参数没有使用
+		{CommandTemplate{Command: "Stop-Process -Id {{id}}"}, false},
+		{CommandTemplate{Command: "Get-Date", Params: map[string]*TemplateParam{"unused": {Type: ParamString}}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": nil}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": {Type: "bool"}}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": {Type: ParamEnum}}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": {Type: ParamString, Values: []string{"v"}}}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": {Type: ParamInt, Default: json.RawMessage(`"five"`)}}}, false},
+		{CommandTemplate{Command: "x {{a}}", Params: map[string]*TemplateParam{"a": {Type: ParamInt, Default: json.RawMessage(`5`)}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.tmpl.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%q) = %v, want ok %t", tt.tmpl.Command, err, tt.ok)
+		}
+	}
+}
+
+func TestTemplateParamTypes(t *testing.T) {
+	tests := []struct {
+		param TemplateParam
+		raw   string
+		text  string
+		ok    bool
+	}{
+		{TemplateParam{Type: ParamInt}, `42`, "42", true},
+		{TemplateParam{Type: ParamInt}, `-7`, "-7", true},
+		// 整数只接受 JSON 数字形式的十进制整数
+		{TemplateParam{Type: ParamInt}, `"42"`, "", false},
+		{TemplateParam{Type: ParamInt}, `1e3`, "", false},
+		{TemplateParam{Type: ParamInt}, `1.0`, "", false},
+		{TemplateParam{Type: ParamInt}, `null`, "", false},
+		{TemplateParam{Type: ParamString}, `"a b"`, "a b", true},
+		{TemplateParam{Type: ParamString}, `5`, "", false},
+		{TemplateParam{Type: ParamString}, `"a\u0000b"`, "", false},
+		{TemplateParam{Type: ParamEnum, Values: []string{"Running", "Stopped"}}, `"Stopped"`, "Stopped", true},
+		{TemplateParam{Type: ParamEnum, Values: []string{"Running", "Stopped"}}, `"stopped"`, "", false},
+		{TemplateParam{Type: ParamPath}, `"C:\\Temp\\log.txt"`, `C:\Temp\log.txt`, true},
+		{TemplateParam{Type: ParamPath}, `""`, "", false},
+		{TemplateParam{Type: ParamPath}, `"a\nb"`, "", false},
+	}
+	for _, tt := range tests {
+		v, err := tt.param.parse(json.RawMessage(tt.raw))
+		if (err == nil) != tt.ok || v.text != tt.text {
+			t.Errorf("%s parse(%s) = %q, %v, want %q ok %t", tt.param.Type, tt.raw, v.text, err, tt.text, tt.ok)
+		}
+	}
+}
+
+func TestTemplateExpandQuotesInjection(t *testing.T) {
+	tmpl := &CommandTemplate{
+		Command: "Restart-Service -Name {{name}} -Count {{count}}",
+		Params: map[string]*TemplateParam{
+			"name":  {Type: ParamString},
+			"count": {Type: ParamInt, Default: json.RawMessage(`1`)},
+		},
+	}
+	tests := []struct {
+		shell ShellType
+		name  string
+		want  string
+	}{
+		{ShellPowerShell, "spooler", "Restart-Service -Name 'spooler' -Count 1"},
+		{ShellPowerShell, "x'; Remove-Item C:\\ -Recurse; '", "Restart-Service -Name 'x''; Remove-Item C:\\ -Recurse; ''' -Count 1"},
+		// PowerShell 把弯引号也当作单引号
+		{ShellPowerShell, "x\u2019; whoami", "Restart-Service -Name 'x\u2019\u2019; whoami' -Count 1"},
+		{ShellPowerShell, "$(whoami)", "Restart-Service -Name '$(whoami)' -Count 1"},
+		{ShellBash, "x'; rm -rf /; '", `Restart-Service -Name 'x'\''; rm -rf /; '\''' -Count 1`},
+	}
+	for _, tt := range tests {
+		params := map[string]json.RawMessage{"name": mustJSON(t, tt.name)}
+		got, err := tmpl.expand(tt.shell, params)
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%s, %q) = %q, %v, want %q", tt.shell, tt.name, got, err, tt.want)
+		}
+	}
+
+	for _, params := range []map[string]json.RawMessage{
+		{},
+		{"name": json.RawMessage(`"a"`), "count": json.RawMessage(`"1; whoami"`)},
+		{"name": json.RawMessage(`"a"`), "extra": json.RawMessage(`"b"`)},
+	} {
+		if _, err := tmpl.expand(ShellPowerShell, params); !errors.Is(err, errInvalidParams) {
+			t.Errorf("expand(%s) = %v, want errInvalidParams", params, err)
+		}
+	}
+	if _, err := tmpl.expand(ShellCmd, map[string]json.RawMessage{"name": json.RawMessage(`"a"`)}); !errors.Is(err, errTemplateUnsupported) {
+		t.Errorf("expand for cmd = %v, want errTemplateUnsupported", err)
+	}
+}
+
+func mustJSON(t *testing.T, v any) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRunTemplate(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Templates = map[string]*CommandTemplate{
+			"greet": {Command: "echo {{name}}", Params: map[string]*TemplateParam{"name": {Type: ParamString}}},
+		}
+		cfg.TemplatesOnly = true
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "", map[string]any{"template": "greet", "params": map[string]any{"name": "world"}})
+	if resp.StatusCode != http.StatusOK || string(data) != "world" {
+		t.Fatalf("template run = %d %q", resp.StatusCode, data)
+	}
+	// templates_only 时拒绝自由格式的命令
+	if resp, data = ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("free-form command = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, id, "", map[string]any{"template": "missing"}); resp.StatusCode != http.StatusNotFound || errorCodeOf(t, data) != codeTemplateNotFound {
+		t.Fatalf("missing template = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, id, "", map[string]any{"template": "greet", "params": map[string]any{"name": 5}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong parameter type = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestTemplateInjectionNeutralized(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Templates = map[string]*CommandTemplate{
+			"greet": {Command: "printf '%s\\n' {{name}}", Params: map[string]*TemplateParam{"name": {Type: ParamString}}},
+		}
+	})
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "bash"})
+	for _, name := range []string{"$(echo pwned)", "`echo pwned`", "x'; echo pwned; '", "a; echo pwned", "$HOME"} {
+		resp, data := ts.run(aliceToken, id, "", map[string]any{"template": "greet", "params": map[string]any{"name": name}})
+		// 参数值原样输出, 没有被当作命令执行
+		if resp.StatusCode != http.StatusOK || string(data) != name {
+			t.Errorf("greet %q = %d %q", name, resp.StatusCode, data)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Terminator 判断命令输出结束的方式
+type Terminator string
+
+const (
+	// TerminatorMarker 命令结束后输出唯一标记, 读到标记即结束
+	TerminatorMarker Terminator = "marker"
+	// TerminatorQuiescence 一段时间内没有新输出即视为结束,
+	// 适用于标记行会被 shell 或编码破坏的场景
+	TerminatorQuiescence Terminator = "quiescence"
+)
+
+const (
+	// defaultCommandTimeout 默认的单条命令最长执行时间
+	defaultCommandTimeout = 10 * time.Minute
+	// defaultQuiescence 静默模式默认的无输出判定时长
+	defaultQuiescence = 2 * time.Second
+	// minQuiescence 静默判定时长下限, 避免命令短暂停顿时提前返回
+	minQuiescence = 100 * time.Millisecond
+	// stdinWriteTimeout 写入命令的最长等待时间, shell 不再读取 stdin 时管道写满会一直阻塞
+	stdinWriteTimeout = 10 * time.Second
+	// beginMarkerPrefix 开始标记前缀, 开始标记之前的输出属于之前的命令
+	beginMarkerPrefix = "begin:"
+	// exitCodeSeparator 结束标记与退出码之间的分隔符
+	exitCodeSeparator = ":"
+	// statusIncomplete 命令不完整(如缺少右括号), 未执行
+	statusIncomplete = "!incomplete"
+	// statusSyntaxError 命令有语法错误, 未执行
+	statusSyntaxError = "!syntax"
+	// statusThrew 附加在退出码之后, 表示命令抛出了终止错误
+	statusThrew = "!threw"
+)
+
+// markerPrefixBytes 会话标记前缀的随机字节数
+const markerPrefixBytes = 8
+
+// newMarkerPrefix 生成会话的标记前缀, 与每条命令的 UUID 拼接为结束标记
+// 前缀在会话内固定、不同会话各不相同, 某个会话的标记出现在其他会话的输出中(如输出归档、共享的管道)时不会被当作结束标记
+func newMarkerPrefix() string {
+	b := make([]byte, markerPrefixBytes)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "-"
+}
+
+// commandPlaceholder 命令模板中代表用户命令的占位符
+const commandPlaceholder = "{{command}}"
+
+// wrapCommand 用模板包装用户命令, 模板为空时原样返回
+// 结果会再被放入 & { ... } *>&1 中执行, 模板中的语句与用户命令共享同一作用域
+func wrapCommand(template, command string) string {
+	if template == "" {
+		return command
+	}
+	return strings.ReplaceAll(template, commandPlaceholder, command)
+}
+
+var (
+	errInvalidOptions = errors.New("invalid session options")
+	// errSessionQuota 租户持有的会话数已达上限
+	errSessionQuota   = errors.New("session quota exceeded")
+	errCommandTimeout = errors.New("command timed out")
+	// errIdleTimeout 命令超过 idle_timeout_ms 没有产生输出, 同时也是一种命令超时
+	errIdleTimeout  = fmt.Errorf("%w: no output within idle timeout", errCommandTimeout)
+	errOutputClosed = errors.New("session output closed")
+	// errIncompleteCommand 命令不完整, 发送给 shell 会一直等待后续输入
+	errIncompleteCommand = errors.New("incomplete command")
+	errSyntaxError       = errors.New("command has syntax errors")
+	// errSessionEnded 命令执行期间会话被强制结束
+	errSessionEnded = errors.New("session was ended")
+	// errSessionNotFound 会话不存在或已结束
+	errSessionNotFound = errors.New("session not found")
+	// errStdinTimeout 写入命令超时, shell 可能已挂起
+	errStdinTimeout = errors.New("timed out writing command to shell")
+)
+
+// terminator 解析并校验会话的结束判定方式
+func (opts SessionOptions) terminator() (Terminator, time.Duration, error) {
+	switch opts.Terminator {
+	case "", TerminatorMarker:
+		return TerminatorMarker, 0, nil
+	case TerminatorQuiescence:
+		quiescence := defaultQuiescence
+		if opts.QuiescenceMs != 0 {
+			quiescence = time.Duration(opts.QuiescenceMs) * time.Millisecond
+		}
+		if quiescence < minQuiescence {
+			return "", 0, fmt.Errorf("%w: quiescence_ms must be at least %d", errInvalidOptions, minQuiescence.Milliseconds())
+		}
+		return TerminatorQuiescence, quiescence, nil
+	default:
+		return "", 0, fmt.Errorf("%w: unknown terminator %q", errInvalidOptions, opts.Terminator)
+	}
+}
+
+// MarkerChannel PowerShell 会话输出开始和结束标记的方式
+type MarkerChannel string
+
+const (
+	// MarkerHost 经 Write-Host 输出(默认)
+	MarkerHost MarkerChannel = "host"
+	// MarkerConsole 直接写入 [Console]::Out, 不受命令对输出流的重定向和屏蔽影响
+	MarkerConsole MarkerChannel = "console"
+)
+
+// parseMarkerChannel 检查标记输出方式, console 仅 PowerShell 支持; 为空时返回空, 由调用方取默认值
+func parseMarkerChannel(channel MarkerChannel, shellType ShellType) (MarkerChannel, error) {
+	switch channel {
+	case "", MarkerHost:
+		return channel, nil
+	case MarkerConsole:
+		if shellType != ShellPowerShell {
+			return "", fmt.Errorf("marker_channel console requires a PowerShell session")
+		}
+		return channel, nil
+	}
+	return "", fmt.Errorf("marker_channel must be %s or %s", MarkerHost, MarkerConsole)
+}
+
+// readLoop 持续读取 shell 的 stdout 并送入 ch, 读取出错(进程退出)时关闭 ch
+// tail 不为空时同时写入一份, 不影响 ch 中的内容
+func readLoop(stdout io.Reader, ch chan<- []byte, bufferSize int, tail *ringBuffer) {
+	defer close(ch)
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := stdout.Read(buffer)
+		if n > 0 {
+			if tail != nil {
+				tail.Write(buffer[:n])
+			}
+			ch <- append([]byte(nil), buffer[:n]...)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeWithTimeout 在 timeout 内将 b 写入 w, 超时后写入仍在后台进行, 直到 w 被关闭
+func writeWithTimeout(w io.Writer, b []byte, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(b)
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errStdinTimeout
+	}
+}
+
+// outputWriter 向调用方写出命令输出并统计字节数
+type outputWriter struct {
+	out       io.Writer
+	written   int
+	sessionID string
+	// processors 写出前按顺序处理输出, 见 output_pipeline
+	processors []outputProcessor
+	// lines 不为空时只写出前若干行, 同时包含在 processors 中
+	lines *lineLimiter
+	// encoding 不为空时统计输出的编码信息, 同时包含在 processors 中
+	encoding *encodingFilter
+	// separator 不为空时为原始字节模式, 标记之前只去除 frame 输出的这一分隔符
+	separator []byte
+	// archive 不为空时归档完整输出, archiveAt 为 redact 之后第一个处理器的位置, 之后的截断不影响归档
+	archive   *archiveEntry
+	archiveAt int
+	// limited 输出超过字节上限, 保留开头时之后的输出没有读取, 保留末尾时开头被丢弃
+	limited bool
+	// tail 不为空时保留输出的末尾, 读取期间的输出暂存在其中
+	tail *tailWriter
+	// lastByte 最近写出的最后一个字节
+	lastByte byte
+	// debug 不为空时保存从 shell 读到的原始字节
+	debug *debugCapture
+	// truncationNotice 输出被截断时附加的提示, 为空时不附加
+	truncationNotice string
+}
+
+func (ow *outputWriter) write(b []byte) error {
+	for i, p := range ow.processors {
+		if i == ow.archiveAt {
+			ow.archive.write(b)
+		}
+		b = p.filter(b)
+	}
+	if ow.archiveAt == len(ow.processors) {
+		ow.archive.write(b)
+	}
+	return ow.emit(b)
+}
+
+// flush 写出处理器中暂存的内容, 输出结束时调用
+// 前一个处理器暂存的内容经过之后的处理器处理后再写出
+func (ow *outputWriter) flush() error {
+	var b []byte
+	for i, p := range ow.processors {
+		if i == ow.archiveAt {
+			ow.archive.write(b)
+		}
+		b = append(p.filter(b), p.flush()...)
+	}
+	if ow.archiveAt == len(ow.processors) {
+		ow.archive.write(b)
+	}
+	return ow.emit(b)
+}
+
+func (ow *outputWriter) emit(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	n, err := ow.out.Write(b)
+	ow.written += n
+	ow.lastByte = b[len(b)-1]
+	if err != nil {
+		log.Printf("✗ Failed to write output | SessionID: %s | Error: %v", ow.sessionID, err)
+		return fmt.Errorf("failed to write output: %v", err)
+	}
+	return nil
+}
+
+// collectUntilMarker 读取输出直到遇到结束标记, 标记之前的内容写出, 返回标记行中标记之后的状态
+// watch 不为空时输出速率超过上限立即返回 errRunawayOutput, idle 大于 0 时连续 idle 没有输出返回 errIdleTimeout
+func (s *Session) collectUntilMarker(ow *outputWriter, marker string, limit int, deadline <-chan time.Time, idle time.Duration, watch *rateWatchdog) (string, error) {
+	beginBytes := []byte(beginMarkerPrefix + marker)
+	markerBytes := []byte(marker)
+	// pending 保存尚未写出的尾部, 其中可能包含标记的前缀和标记前的换行符
+	// 标记检测基于累积的 pending, 与单次读取的长度无关
+	pending := make([]byte, 0, 4096)
+	begun := false
+	aborted := s.aborted()
+	var idleTimer *time.Timer
+	var idleC <-chan time.Time
+	if idle > 0 {
+		idleTimer = time.NewTimer(idle)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
+
+	for {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				log.Printf("✗ Output closed before marker | SessionID: %s", s.ID)
+				if begun {
+					ow.write(pending)
+				}
+				return "", errOutputClosed
+			}
+			ow.debug.add(chunk)
+			pending = append(pending, chunk...)
+			if err := watch.add(len(chunk)); err != nil {
+				if begun {
+					ow.write(pending)
+				}
+				return "", err
+			}
+			if idleTimer != nil {
+				// 有新输出, 重新开始计时
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(idle)
+			}
+		case <-deadline:
+			if begun {
+				ow.write(pending)
+			}
+			return "", errCommandTimeout
+		case <-idleC:
+			if begun {
+				ow.write(pending)
+			}
+			return "", errIdleTimeout
+		case <-s.interrupt:
+			if begun {
+				ow.write(pending)
+			}
+			return "", errSessionEnded
+		case <-aborted:
+			if begun {
+				ow.write(pending)
+			}
+			return "", errCommandAborted
+		}
+
+		if !begun {
+			// 丢弃开始标记所在行及之前的内容
+			i := bytes.Index(pending, beginBytes)
+			if i < 0 {
+				continue
+			}
+			nl := bytes.IndexByte(pending[i:], '\n')
+			if nl < 0 {
+				continue
+			}
+			pending = append(pending[:0], pending[i+nl+1:]...)
+			begun = true
+		}
+
+		// 检查是否包含标记, 标记行完整后再解析状态
+		if i := bytes.Index(pending, markerBytes); i >= 0 {
+			nl := bytes.IndexByte(pending[i:], '\n')
+			if nl < 0 {
+				continue
+			}
+			status := strings.TrimSpace(string(pending[i+len(markerBytes) : i+nl]))
+
+			// 找到标记,写出标记之前的内容, 去除标记行之前的换行
+			if ow.separator != nil {
+				return status, ow.write(bytes.TrimSuffix(pending[:i], ow.separator))
+			}
+			return status, ow.write(trimLineEnding(pending[:i]))
+		}
+
+		// 只保留可能是标记开头的尾部, 其余的输出立即写出, 流式输出时短行不会被延迟
+		if hold := markerHoldback(pending, markerBytes); hold < len(pending) {
+			if err := ow.write(pending[:len(pending)-hold]); err != nil {
+				return "", err
+			}
+			pending = append(pending[:0], pending[len(pending)-hold:]...)
+		}
+
+		// 避免无限等待
+		if ow.written+len(pending) > limit {
+			log.Printf("⚠ Output size limit exceeded | SessionID: %s | Size: %d bytes", s.ID, ow.written+len(pending))
+			ow.limited = true
+			return "", ow.write(pending)
+		}
+	}
+}
+
+// markerHoldback 返回 pending 末尾需要暂不写出的字节数: 与标记开头相同的部分, 以及其前的行尾
+func markerHoldback(pending, marker []byte) int {
+	hold := 0
+	for k := min(len(pending), len(marker)-1); k > 0; k-- {
+		if bytes.HasPrefix(marker, pending[len(pending)-k:]) {
+			hold = k
+			break
+		}
+	}
+	for i := 0; i < maxLineEndingSize && hold < len(pending); i++ {
+		if c := pending[len(pending)-hold-1]; c != '\n' && c != '\r' {
+			break
+		}
+		hold++
+	}
+	return hold
+}
+
+// parseExitCode 解析结束标记之后的退出码, 格式不符时返回 nil
+func parseExitCode(status string) *int {
+	text, ok := strings.CutPrefix(status, exitCodeSeparator)
+	if !ok {
+		return nil
+	}
+	text = strings.TrimSuffix(text, statusThrew)
+	code, err := strconv.Atoi(text)
+	if err != nil {
+		return nil
+	}
+	return &code
+}
+
+const (
+	// commandStatusSuccess 命令退出码为 0 且没有抛出终止错误
+	commandStatusSuccess = "success"
+	// commandStatusError 命令退出码不为 0 或抛出了终止错误
+	commandStatusError = "error"
+)
+
+// commandStatus 根据退出码和终止错误判断命令是否成功, 无法获取退出码时为空
+func commandStatus(status string) string {
+	code := parseExitCode(status)
+	if code == nil {
+		return ""
+	}
+	if *code != 0 || strings.HasSuffix(status, statusThrew) {
+		return commandStatusError
+	}
+	return commandStatusSuccess
+}
+
+// statusError 将结束标记中的特殊状态转换为错误
+func statusError(status string) error {
+	switch status {
+	case exitCodeSeparator + statusIncomplete:
+		return errIncompleteCommand
+	case exitCodeSeparator + statusSyntaxError:
+		return errSyntaxError
+	}
+	return nil
+}
+
+// collectQuiescent 读取输出直到超过静默时长没有新输出
+func (s *Session) collectQuiescent(ow *outputWriter, limit int, deadline <-chan time.Time, watch *rateWatchdog) error {
+	quiet := time.NewTimer(s.quiescence)
+	defer quiet.Stop()
+	aborted := s.aborted()
+
+	for {
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				log.Printf("✗ Output closed | SessionID: %s", s.ID)
+				return errOutputClosed
+			}
+			ow.debug.add(chunk)
+			if err := ow.write(chunk); err != nil {
+				return err
+			}
+			if err := watch.add(len(chunk)); err != nil {
+				return err
+			}
+			if ow.written > limit {
+				log.Printf("⚠ Output size limit exceeded | SessionID: %s | Size: %d bytes", s.ID, ow.written)
+				ow.limited = true
+				return nil
+			}
+			// 有新输出, 重新开始计时
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(s.quiescence)
+		case <-quiet.C:
+			return nil
+		case <-deadline:
+			return errCommandTimeout
+		case <-s.interrupt:
+			return errSessionEnded
+		case <-aborted:
+			return errCommandAborted
+		}
+	}
+}
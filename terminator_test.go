@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// BenchmarkReadThroughput 不同 read_buffer_size 下经 readLoop 和 collectUntilMarker 读取 8MB 命令输出的吞吐量
+func BenchmarkReadThroughput(b *testing.B) {
+	const marker = "0123456789abcdef-bench"
+	line := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcde\n")
+	payload := bytes.Repeat(line, 8<<20/len(line))
+	stream := append([]byte(beginMarkerPrefix+marker+"\n"), payload...)
+	stream = append(stream, "\n"+marker+exitCodeSeparator+"0\n"...)
+
+	// 1KB 为调整前固定的缓冲区大小, 作为比较的基准
+	for _, size := range []int{1 << 10, 4 << 10, defaultReadBufferSize, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				output := make(chan []byte, 64)
+				go readLoop(bytes.NewReader(stream), output, size, nil)
+				s := &Session{ID: "bench", output: output, interrupt: make(chan struct{})}
+				ow := &outputWriter{out: io.Discard}
+				status, err := s.collectUntilMarker(ow, marker, math.MaxInt, nil, 0, nil)
+				if err != nil || status != exitCodeSeparator+"0" {
+					b.Fatalf("collectUntilMarker = %q, %v", status, err)
+				}
+				if ow.written != len(payload) {
+					b.Fatalf("written %d bytes, want %d", ow.written, len(payload))
+				}
+				for range output {
+				}
+			}
+		})
+	}
+}
+
+// collectFrom 把 chunks 依次送入会话的输出, 读取到 marker 为止
+func collectFrom(chunks ...string) (string, string, error) {
+	output := make(chan []byte, len(chunks))
+	for _, c := range chunks {
+		output <- []byte(c)
+	}
+	close(output)
+	var buf bytes.Buffer
+	s := &Session{ID: "test", output: output, interrupt: make(chan struct{})}
+	status, err := s.collectUntilMarker(&outputWriter{out: &buf}, "m1", math.MaxInt, nil, 0, nil)
+	return buf.String(), status, err
+}
+
+func TestCollectUntilMarkerParserStatus(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		output string
+		err    error
+	}{
+		{[]string{"begin:m1\nok\nm1:0\n"}, "ok", nil},
+		{[]string{"begin:m1\nm1:" + statusIncomplete + "\n"}, "", errIncompleteCommand},
+		{[]string{"begin:m1\nUnexpected token '}'\n", "m1:" + statusSyntaxError + "\n"}, "Unexpected token '}'", errSyntaxError},
+		// 标记跨多个数据块、之前有上一条命令的残留输出
+		{[]string{"stale\nbeg", "in:m1\r\npart", "ial\r\nm", "1:", "7\r\n"}, "partial", nil},
+	}
+	for _, tt := range tests {
+		output, status, err := collectFrom(tt.chunks...)
+		if err != nil {
+			t.Fatalf("collect %q: %v", tt.chunks, err)
+		}
+		if output != tt.output {
+			t.Errorf("collect %q output = %q, want %q", tt.chunks, output, tt.output)
+		}
+		if got := statusError(status); !errors.Is(got, tt.err) || (tt.err == nil && got != nil) {
+			t.Errorf("collect %q status %q error = %v, want %v", tt.chunks, status, got, tt.err)
+		}
+	}
+}
+
+func TestCollectUntilMarkerOutputClosed(t *testing.T) {
+	// shell 在结束标记之前退出时写出已读到的输出
+	output, _, err := collectFrom("begin:m1\nlast words\n")
+	if !errors.Is(err, errOutputClosed) || output != "last words\n" {
+		t.Fatalf("collect = %q, %v", output, err)
+	}
+}
+
+func TestParseExitCode(t *testing.T) {
+	for status, want := range map[string]int{":0": 0, ":1": 1, ":-1": -1, ":3" + statusThrew: 3} {
+		if code := parseExitCode(status); code == nil || *code != want {
+			t.Errorf("parseExitCode(%q) = %v, want %d", status, code, want)
+		}
+	}
+	for _, status := range []string{"", "0", ":", ":" + statusIncomplete, ":abc"} {
+		if code := parseExitCode(status); code != nil {
+			t.Errorf("parseExitCode(%q) = %d, want nil", status, *code)
+		}
+	}
+}
+
+func TestWriteWithTimeout(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	// 没有读取方时写入一直阻塞, 超时后返回
+	start := time.Now()
+	if err := writeWithTimeout(w, []byte("blocked\n"), 50*time.Millisecond); !errors.Is(err, errStdinTimeout) {
+		t.Fatalf("blocked write = %v, want errStdinTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("blocked write returned after %s", elapsed)
+	}
+
+	// 超时的写入仍在后台进行, 读取方开始读取后完成
+	buf := make([]byte, 8)
+	if n, err := io.ReadFull(r, buf); err != nil || string(buf[:n]) != "blocked\n" {
+		t.Fatalf("read = %q, %v", buf[:n], err)
+	}
+	go io.Copy(io.Discard, r)
+	if err := writeWithTimeout(w, []byte("ok\n"), time.Second); err != nil {
+		t.Fatalf("write = %v", err)
+	}
+}
+
+func TestSuspectSessionRejectsCommands(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+	s, _ := sessionManager.GetSession(id)
+	// 写入命令超时后会话被标记为可疑
+	s.suspect.Store(true)
+
+	resp, data := ts.run(aliceToken, id, "echo hi", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || errorCodeOf(t, data) != codeShellUnresponsive {
+		t.Fatalf("run on suspect session = %d %s", resp.StatusCode, data)
+	}
+	var list struct {
+		Sessions []SessionSummary `json:"sessions"`
+	}
+	_, data = ts.do(http.MethodGet, aliceToken, "/sessions", nil)
+	decodeJSON(t, data, &list)
+	if len(list.Sessions) != 1 || !list.Sessions[0].Suspect {
+		t.Fatalf("sessions = %+v", list.Sessions)
+	}
+
+	// 重启 shell 后清除标记
+	resp, data = ts.post(aliceToken, "/restart-session", map[string]any{"session_id": id})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("restart = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.run(aliceToken, id, "echo hi", nil); resp.StatusCode != http.StatusOK || string(data) != "hi" {
+		t.Fatalf("run after restart = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestCommandStatus(t *testing.T) {
+	tests := map[string]string{
+		exitCodeSeparator + "0":               commandStatusSuccess,
+		exitCodeSeparator + "1":               commandStatusError,
+		exitCodeSeparator + "-1":              commandStatusError,
+		exitCodeSeparator + "0" + statusThrew: commandStatusError,
+		// 无法获取退出码时不返回
+		"":                                   "",
+		exitCodeSeparator + statusIncomplete: "",
+	}
+	for status, want := range tests {
+		if got := commandStatus(status); got != want {
+			t.Errorf("commandStatus(%q) = %q, want %q", status, got, want)
+		}
+	}
+	// 终止错误的标记跨数据块时同样识别, 错误记录保留在输出中
+	output, status, err := collectFrom("begin:m1\nboom\nm1:0!th", "rew\n")
+	if err != nil || output != "boom" || commandStatus(status) != commandStatusError {
+		t.Fatalf("collect = %q %q %v", output, status, err)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"native-fail": {Output: "not found", ExitCode: 2}}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 命令失败时 HTTP 状态码仍为 200
+	resp, data := ts.run(aliceToken, id, "native-fail", map[string]any{"report_status": true})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Command-Status") != commandStatusError || string(data) != "not found" {
+		t.Fatalf("failing command = %d %q status %q", resp.StatusCode, data, resp.Header.Get("X-Command-Status"))
+	}
+	if resp, _ = ts.run(aliceToken, id, "echo ok", map[string]any{"report_status": true}); resp.Header.Get("X-Command-Status") != commandStatusSuccess {
+		t.Fatalf("successful command status %q", resp.Header.Get("X-Command-Status"))
+	}
+	if resp, _ = ts.run(aliceToken, id, "native-fail", nil); resp.Header.Get("X-Command-Status") != "" {
+		t.Fatalf("status without report_status = %q", resp.Header.Get("X-Command-Status"))
+	}
+
+	// 以 JSON 返回结果时在 status 中
+	var result CommandResult
+	_, data = ts.run(aliceToken, id, "native-fail", map[string]any{"report_status": true, "output_format": "base64"})
+	decodeJSON(t, data, &result)
+	if result.Status != commandStatusError || result.ExitCode == nil || *result.ExitCode != 2 {
+		t.Fatalf("JSON result = %+v", result)
+	}
+}
+
+func TestReportStatusThrowingCmdlet(t *testing.T) {
+	if _, err := exec.LookPath("pwsh"); err != nil {
+		t.Skip("pwsh is not installed")
+	}
+	ts := newTestServer(t, nil)
+	spawner = execSpawner{}
+	id := ts.startSession(aliceToken, map[string]any{"shell": "pwsh"})
+	for command, want := range map[string]string{
+		"throw 'boom'":                            commandStatusError,
+		"Get-Item /missing -ErrorAction Stop":     commandStatusError,
+		"Get-Item /missing -ErrorAction Continue": commandStatusSuccess,
+		"Write-Output ok":                         commandStatusSuccess,
+		"& pwsh -NoProfile -Command 'exit 3'":     commandStatusError,
+	} {
+		resp, data := ts.run(aliceToken, id, command, map[string]any{"report_status": true})
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Command-Status") != want {
+			t.Errorf("%s = %d %q status %q, want %q", command, resp.StatusCode, data, resp.Header.Get("X-Command-Status"), want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ClientAuth 是否要求客户端证书
+type ClientAuth string
+
+const (
+	// ClientAuthNone 不请求客户端证书
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthOptional 客户端提供证书时验证, 不提供也可以建立连接
+	ClientAuthOptional ClientAuth = "optional"
+	// ClientAuthRequire 握手时要求并验证客户端证书, 没有有效证书的连接被拒绝
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// TLSConfig HTTPS 配置
+type TLSConfig struct {
+	// CertFile 和 KeyFile 服务端证书和私钥(PEM)
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile 验证客户端证书的 CA 证书(PEM), 设置 client_auth 时必填
+	ClientCAFile string `json:"client_ca_file"`
+	// ClientAuth 是否要求客户端证书: none(默认)、optional 或 require
+	ClientAuth ClientAuth `json:"client_auth"`
+}
+
+func (c *TLSConfig) validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("tls cert_file and key_file are required")
+	}
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if c.ClientCAFile == "" {
+			return fmt.Errorf("tls client_ca_file is required when client_auth is %s", c.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown tls client_auth %q", c.ClientAuth)
+	}
+	return nil
+}
+
+// verifiesClients 是否验证客户端证书
+func (c *TLSConfig) verifiesClients() bool {
+	return c.ClientAuth == ClientAuthOptional || c.ClientAuth == ClientAuthRequire
+}
+
+// serverConfig 生成 tls.Config, 服务端证书由 ServeTLS 加载
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if !c.verifiesClients() {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	if c.ClientAuth == ClientAuthRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// clientCertName 返回已验证的客户端证书中的身份: CN, 为空时依次使用 DNS、邮箱、URI 类型的 SAN
+func clientCertName(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName, true
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0], true
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0], true
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA 签发测试用客户端证书的 CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发 CN 为 cn 的客户端证书
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSServer 以 client_auth 启动要求客户端证书的测试服务器, 返回服务器和签发客户端证书的 CA
+func newTLSServer(t *testing.T, clientAuth ClientAuth, configure func(cfg *Config)) (*httptest.Server, *testCA) {
+	t.Helper()
+	ca := newTestCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.TLS = &TLSConfig{CertFile: "unused.pem", KeyFile: "unused.key", ClientCAFile: caFile, ClientAuth: clientAuth}
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	admins := make(map[string]bool)
+	for _, name := range ts.cfg.CertAdmins {
+		admins[name] = true
+	}
+	tokenAuth.Cert = &certAuth{admins: admins}
+
+	tlsConfig, err := ts.cfg.TLS.serverConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerRoutes(mux, ts.cfg)
+	srv := httptest.NewUnstartedServer(withRequestID(mux))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, ca
+}
+
+// certClient 返回使用客户端证书 cert 的客户端
+func certClient(srv *httptest.Server, cert *tls.Certificate) *http.Client {
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: transport}
+}
+
+// whoami 以 client 请求 /whoami, token 不为空时同时携带令牌
+func whoami(t *testing.T, client *http.Client, url, token string) (int, WhoamiResponse) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/whoami", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, WhoamiResponse{}
+	}
+	defer resp.Body.Close()
+	var out WhoamiResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	srv, ca := newTLSServer(t, ClientAuthRequire, func(cfg *Config) {
+		cfg.AuthMode = AuthCert
+		cfg.CertAdmins = []string{"ops"}
+	})
+	alice := ca.issue(t, "alice")
+	status, id := whoami(t, certClient(srv, &alice), srv.URL, "")
+	// 证书身份带有前缀, 与同名的令牌 alice 不属于同一租户
+	if status != http.StatusOK || id.Tenant != "cert:alice" || id.Method != authMethodCert || id.Admin {
+		t.Fatalf("whoami = %d %+v", status, id)
+	}
+	ops := ca.issue(t, "ops")
+	if status, id = whoami(t, certClient(srv, &ops), srv.URL, ""); status != http.StatusOK || id.Tenant != "cert:ops" || !id.Admin {
+		t.Fatalf("admin whoami = %d %+v", status, id)
+	}
+
+	// require 时没有证书或证书不是由 CA 签发的连接在握手时被拒绝
+	if status, _ = whoami(t, certClient(srv, nil), srv.URL, ""); status != 0 {
+		t.Fatalf("connection without certificate = %d", status)
+	}
+	other := newTestCA(t).issue(t, "alice")
+	if status, _ = whoami(t, certClient(srv, &other), srv.URL, ""); status != 0 {
+		t.Fatalf("connection with untrusted certificate = %d", status)
+	}
+}
+
+func TestClientCertDoesNotShareTokenTenant(t *testing.T) {
+	srv, ca := newTLSServer(t, ClientAuthOptional, func(cfg *Config) { cfg.AuthMode = AuthAny })
+	cert := ca.issue(t, "alice")
+	certOnly, tokenOnly := certClient(srv, &cert), certClient(srv, nil)
+
+	post := func(client *http.Client, token, path, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			SessionID string `json:"session_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.SessionID
+	}
+	status, id := post(tokenOnly, aliceToken, "/start-session", "{}")
+	if status != http.StatusOK {
+		t.Fatalf("start-session with token = %d", status)
+	}
+	// CN 与令牌名称相同的证书不能访问令牌的会话
+	if status, _ = post(certOnly, "", "/run-command", `{"session_id":"`+id+`","command":"echo hi"}`); status != http.StatusNotFound {
+		t.Fatalf("certificate running in the token's session = %d", status)
+	}
+	if n := sessionManager.Owned("cert:alice"); n != 0 {
+		t.Fatalf("certificate tenant owns %d sessions", n)
+	}
+
+	// any 时两者都有以令牌为准
+	if status, who := whoami(t, certOnly, srv.URL, aliceToken); status != http.StatusOK || who.Tenant != "alice" {
+		t.Fatalf("whoami with both = %d %+v", status, who)
+	}
+}
+
+func TestTokenNameReservedForCertificates(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Tokens = []TokenConfig{{Name: "cert:alice", Token: "secret"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("token name with the certificate prefix accepted")
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg TLSConfig
+		ok  bool
+	}{
+		{TLSConfig{CertFile: "c", KeyFile: "k"}, true},
+		{TLSConfig{CertFile: "c", KeyFile: "k", ClientAuth: ClientAuthRequire, ClientCAFile: "ca"}, true},
+		{TLSConfig{CertFile: "c"}, false},
+		{TLSConfig{CertFile: "c", KeyFile: "k", ClientAuth: ClientAuthOptional}, false},
+		{TLSConfig{CertFile: "c", KeyFile: "k", ClientAuth: "always"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok %t", tt.cfg, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// traceparentHeader W3C Trace Context 请求头
+	traceparentHeader = "traceparent"
+	// defaultServiceName 未设置 OTEL_SERVICE_NAME 时的服务名, 同时作为 instrumentation scope 的名称
+	defaultServiceName = "remote-command-executor"
+)
+
+// tracePropagator 按 W3C Trace Context 读取请求头和写入响应头中的 traceparent、tracestate
+var tracePropagator = propagation.TraceContext{}
+
+// Tracer 记录请求处理过程中的 span, 由 OpenTelemetry SDK 在后台按 OTLP/HTTP 批量发送
+// 为 nil 时不记录, 所有 span 方法都可以在 nil 上调用
+type Tracer struct {
+	endpoint string
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+var tracer *Tracer
+
+// newTracerFromEnv 按 OpenTelemetry 的标准环境变量创建 Tracer, 未配置 OTLP 地址时返回 nil
+// 请求头、超时、批量发送等其余设置由 SDK 从 OTEL_EXPORTER_OTLP_* 和 OTEL_BSP_* 读取
+func newTracerFromEnv() (*Tracer, error) {
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter == "none" {
+		return nil, nil
+	} else if exporter != "" && exporter != "otlp" {
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER %q is not supported, use otlp or none", exporter)
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTLP traces endpoint must be an http or https URL")
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/protobuf" {
+		log.Printf("⚠ OTLP protocol not supported, sending http/protobuf | Protocol: %s", protocol)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	res, err := traceResource()
+	if err != nil {
+		return nil, err
+	}
+
+	// 发送失败时 SDK 丢弃该批 span, 只记录日志, 不影响请求处理
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("✗ Failed to export spans | Error: %v", err)
+	}))
+	t := newTracer(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// 上游标记为不采样时同样不记录, 与上游的采样决定保持一致
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	))
+	t.endpoint = endpoint
+	return t, nil
+}
+
+// newTracer 以 provider 创建 Tracer
+func newTracer(provider *sdktrace.TracerProvider) *Tracer {
+	return &Tracer{provider: provider, tracer: provider.Tracer(defaultServiceName)}
+}
+
+// traceResource 资源属性 service.name, 配置了 instance_id 时同时设置 service.instance.id
+// OTEL_RESOURCE_ATTRIBUTES 中的其他属性由 SDK 读取
+func traceResource() (*resource.Resource, error) {
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = defaultServiceName
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", service)}
+	if instanceID != "" {
+		attrs = append(attrs, attribute.String("service.instance.id", instanceID))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attrs...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace resource: %v", err)
+	}
+	return res, nil
+}
+
+// shutdown 发送尚未发送的 span 后停止, t 为 nil 时不做任何事
+func (t *Tracer) shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("✗ Failed to flush spans | Error: %v", err)
+	}
+}
+
+// Span 一段操作的 OpenTelemetry span 及其所在的 context, 子 span 以该 context 为父
+type Span struct {
+	tracer *Tracer
+	ctx    context.Context
+	span   trace.Span
+}
+
+// startServerSpan 为收到的请求创建 span, 请求头带有合法的 traceparent 时作为其子 span
+// 上游标记为不采样时返回 nil
+func (t *Tracer) startServerSpan(r *http.Request) *Span {
+	parent := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := t.tracer.Start(parent, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+	if !span.IsRecording() {
+		span.End()
+		return nil
+	}
+	return &Span{tracer: t, ctx: ctx, span: span}
+}
+
+// child 创建子 span, sp 为 nil 时返回 nil
+func (sp *Span) child(name string) *Span {
+	if sp == nil {
+		return nil
+	}
+	ctx, span := sp.tracer.tracer.Start(sp.ctx, name, trace.WithSpanKind(trace.SpanKindInternal))
+	return &Span{tracer: sp.tracer, ctx: ctx, span: span}
+}
+
+// set 设置属性, 值为 string、bool、int 或 int64
+func (sp *Span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	var attr attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		attr = attribute.String(key, v)
+	case bool:
+		attr = attribute.Bool(key, v)
+	case int:
+		attr = attribute.Int(key, v)
+	case int64:
+		attr = attribute.Int64(key, v)
+	default:
+		attr = attribute.String(key, fmt.Sprint(v))
+	}
+	sp.span.SetAttributes(attr)
+}
+
+// fail 把 span 标记为错误, err 为 nil 时不做任何事
+func (sp *Span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.span.SetStatus(codes.Error, err.Error())
+}
+
+// finish 结束 span, SDK 在后台批量发送, 重复调用只有第一次生效
+func (sp *Span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.span.End()
+}
+
+// inject 把 span 的 traceparent 写入 header, 供客户端或下游查找
+func (sp *Span) inject(header http.Header) {
+	tracePropagator.Inject(sp.ctx, propagation.HeaderCarrier(header))
+}
+
+// traceCommandResult 在命令的 span 中记录退出码、截断和超时
+func traceCommandResult(sp *Span, result *CommandResult, err error) {
+	sp.fail(err)
+	if result == nil {
+		return
+	}
+	if result.ExitCode != nil {
+		sp.set("rce.exit_code", *result.ExitCode)
+	}
+	sp.set("rce.output_bytes", result.Size)
+	sp.set("rce.truncated", result.Truncated)
+	sp.set("rce.timed_out", result.TimedOut)
+}
+
+type spanKey struct{}
+
+// spanFrom 返回请求的 span, 未开启追踪或未采样时为 nil
+func spanFrom(r *http.Request) *Span {
+	sp, _ := r.Context().Value(spanKey{}).(*Span)
+	return sp
+}
+
+// withTracing 为每个请求创建 span 并记录响应状态码, 5xx 响应标记为错误
+// 响应头 traceparent 为本次请求的 span, 便于客户端在追踪后端中查找
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sp := tracer.startServerSpan(r)
+		if sp == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer sp.finish()
+		sp.set("http.request.method", r.Method)
+		sp.set("url.path", r.URL.Path)
+		if id := w.Header().Get(requestIDHeader); id != "" {
+			sp.set("rce.request_id", id)
+		}
+		sp.inject(w.Header())
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(sp.ctx, spanKey{}, sp)))
+		sp.set("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			sp.fail(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
+
+// statusRecorder 记录响应状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap 供 http.ResponseController 访问底层连接
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
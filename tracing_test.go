@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans 以内存中的 exporter 开启追踪, span 结束时立即导出
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	previous := tracer
+	tracer = newTracer(sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	))
+	t.Cleanup(func() { tracer = previous })
+	return exporter
+}
+
+// spanNamed 返回第一个名为 name 的 span
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no span named %s in %d spans", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+// attr 返回 span 的属性值, 不存在时为 nil
+func attr(s tracetest.SpanStub, key string) any {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+func TestWithTracingContinuesTrace(t *testing.T) {
+	exporter := recordSpans(t)
+	handler := withTracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		child := spanFrom(r).child("work")
+		child.set("rce.items", 3)
+		child.finish()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodPost, "/run-command", nil)
+	req.Header.Set(traceparentHeader, parent)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	spans := exporter.GetSpans()
+	server := spanNamed(t, spans, "POST /run-command")
+	work := spanNamed(t, spans, "work")
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" || !server.Parent.IsRemote() {
+		t.Fatalf("server span parent = %s %s", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+	if server.SpanKind != trace.SpanKindServer || work.Parent.SpanID() != server.SpanContext.SpanID() || attr(work, "rce.items") != int64(3) {
+		t.Fatalf("child span = %+v", work)
+	}
+	// 5xx 响应标记为错误, 响应头为本次请求的 span
+	if server.Status.Code != codes.Error || attr(server, "http.response.status_code") != int64(http.StatusServiceUnavailable) {
+		t.Fatalf("server span status = %+v", server.Status)
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + server.SpanContext.SpanID().String() + "-01"
+	if got := rec.Header().Get(traceparentHeader); got != want {
+		t.Fatalf("response traceparent = %q, want %q", got, want)
+	}
+}
+
+func TestWithTracingNewTraceAndUnsampled(t *testing.T) {
+	exporter := recordSpans(t)
+	called := 0
+	handler := withTracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		// 未采样时 span 为 nil, 其方法仍可调用
+		sp := spanFrom(r).child("work")
+		sp.set("k", "v")
+		sp.fail(errors.New("ignored"))
+		sp.finish()
+	}))
+
+	for _, header := range []string{"", "not-a-traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		if header != "" {
+			req.Header.Set(traceparentHeader, header)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	traces := map[trace.TraceID]bool{}
+	for _, s := range exporter.GetSpans() {
+		if s.Name == "GET /sessions" {
+			if s.Parent.IsValid() {
+				t.Fatalf("span continued invalid traceparent %s", s.Parent.TraceID())
+			}
+			traces[s.SpanContext.TraceID()] = true
+		}
+	}
+	// 没有或不合法的 traceparent 各自开始新的 trace
+	if len(traces) != 3 {
+		t.Fatalf("%d traces for 3 requests", len(traces))
+	}
+
+	// 上游标记为不采样时不记录, 也不设置响应头
+	exporter.Reset()
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if n := len(exporter.GetSpans()); n != 0 || rec.Header().Get(traceparentHeader) != "" || called != 4 {
+		t.Fatalf("unsampled request: %d spans, traceparent %q", n, rec.Header().Get(traceparentHeader))
+	}
+}
+
+func TestTraceCommand(t *testing.T) {
+	exporter := recordSpans(t)
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{"fail": {Output: "boom", ExitCode: 3}}
+	})
+	ts.Config.Handler = withTracing(ts.Config.Handler)
+
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "fail", nil)
+	spans := exporter.GetSpans()
+
+	create := spanNamed(t, spans, "session.create")
+	if attr(create, "rce.session_id") != id || create.Parent.SpanID() != spanNamed(t, spans, "POST /start-session").SpanContext.SpanID() {
+		t.Fatalf("session.create = %+v", create)
+	}
+	run := spanNamed(t, spans, "command.run")
+	if attr(run, "rce.exit_code") != int64(3) || attr(run, "rce.output_bytes") != int64(4) || attr(run, "rce.timed_out") != false {
+		t.Fatalf("command.run attributes = %v", run.Attributes)
+	}
+	for _, name := range []string{"stdin.write", "output.read"} {
+		if s := spanNamed(t, spans, name); s.Parent.SpanID() != run.SpanContext.SpanID() {
+			t.Errorf("%s is not a child of command.run", name)
+		}
+	}
+}
+
+func TestNewTracerFromEnv(t *testing.T) {
+	for _, env := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_SERVICE_NAME"} {
+		t.Setenv(env, "")
+	}
+	if tr, err := newTracerFromEnv(); tr != nil || err != nil {
+		t.Fatalf("without endpoint = %v, %v", tr, err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	tr, err := newTracerFromEnv()
+	if err != nil || tr.endpoint != "http://collector:4318/v1/traces" {
+		t.Fatalf("base endpoint = %v, %v", tr, err)
+	}
+	tr.provider.Shutdown(context.Background())
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if tr, err := newTracerFromEnv(); tr != nil || err != nil {
+		t.Fatalf("exporter none = %v, %v", tr, err)
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := newTracerFromEnv(); err == nil {
+		t.Fatal("unsupported exporter accepted")
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "collector:4318")
+	if _, err := newTracerFromEnv(); err == nil {
+		t.Fatal("endpoint without scheme accepted")
+	}
+}
+
+func TestTraceResource(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "")
+	setGlobal(&instanceID, "rce-a")
+	t.Cleanup(func() { instanceID = "" })
+	res, err := traceResource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, kv := range res.Attributes() {
+		got[string(kv.Key)] = kv.Value.Emit()
+	}
+	if got["service.name"] != defaultServiceName || got["service.instance.id"] != "rce-a" {
+		t.Fatalf("resource = %v", got)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// psStartTranscript 开始记录会话的完整记录, 追加写入以便 shell 重启后继续记录
+// Out-Null 丢弃 Start-Transcript 输出的提示, 不影响之后命令的输出
+const psStartTranscript = "Start-Transcript -LiteralPath %s -Append | Out-Null"
+
+// Transcript 已结束会话保留的记录文件
+type Transcript struct {
+	SessionID string
+	Path      string
+	// Owner 会话所属的租户, 只有同一租户可以获取
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// TranscriptStore 管理会话记录文件, 文件名由会话 ID 生成, 客户端无法指定路径
+type TranscriptStore struct {
+	dir string
+	// retention 会话结束后记录文件的保留时间, 0 表示立即删除
+	retention time.Duration
+	// ended 已结束但仍在保留期内的会话记录
+	ended map[string]*Transcript
+	mu    sync.Mutex
+}
+
+func NewTranscriptStore(dir string, retention time.Duration) (*TranscriptStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create transcript directory: %v", err)
+	}
+
+	store := &TranscriptStore{
+		dir:       dir,
+		retention: retention,
+		ended:     make(map[string]*Transcript),
+	}
+	go store.cleanupLoop()
+	return store, nil
+}
+
+// Create 为会话创建空的记录文件并返回路径
+// 以 O_EXCL 创建, 已存在的文件或链接不会被覆盖
+func (st *TranscriptStore) Create(sessionID string) (string, error) {
+	path := filepath.Join(st.dir, sessionID+".txt")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create transcript file: %v", err)
+	}
+	f.Close()
+	return path, nil
+}
+
+// Release 会话结束后删除记录文件, 配置了保留时间时保留到过期
+func (st *TranscriptStore) Release(sessionID, owner, path string) {
+	if st.retention == 0 {
+		removeTranscript(sessionID, path)
+		return
+	}
+
+	st.mu.Lock()
+	st.ended[sessionID] = &Transcript{
+		SessionID: sessionID,
+		Path:      path,
+		Owner:     owner,
+		ExpiresAt: time.Now().Add(st.retention),
+	}
+	st.mu.Unlock()
+	log.Printf("✓ Transcript retained | SessionID: %s | Retention: %s", sessionID, st.retention)
+}
+
+// Ended 获取已结束会话未过期的记录
+func (st *TranscriptStore) Ended(sessionID string) (*Transcript, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, exists := st.ended[sessionID]
+	if !exists || time.Now().After(t.ExpiresAt) {
+		return nil, false
+	}
+	return t, true
+}
+
+// cleanupLoop 定期删除超过保留时间的记录文件
+func (st *TranscriptStore) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		st.mu.Lock()
+		for id, t := range st.ended {
+			if now.After(t.ExpiresAt) {
+				removeTranscript(id, t.Path)
+				delete(st.ended, id)
+			}
+		}
+		st.mu.Unlock()
+	}
+}
+
+func removeTranscript(sessionID, path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠ Failed to remove transcript | SessionID: %s | Error: %v", sessionID, err)
+		return
+	}
+	log.Printf("✓ Transcript removed | SessionID: %s", sessionID)
+}
+
+var transcriptStore *TranscriptStore
+
+// startTranscriptCommand 生成开始记录的语句
+func startTranscriptCommand(path string) string {
+	return fmt.Sprintf(psStartTranscript, psQuote(path))
+}
+
+// TranscriptResponse 会话记录的下载信息
+type TranscriptResponse struct {
+	SessionID     string    `json:"session_id"`
+	DownloadToken string    `json:"download_token"`
+	DownloadURL   string    `json:"download_url"`
+	Size          int       `json:"size"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// fetchTranscript 将会话记录的当前内容复制为输出文件, 通过 /download 下载
+// 复制而不是直接提供记录文件, 下载不受会话结束和记录继续写入的影响
+func fetchTranscript(identity *Identity, sessionID string) (*TranscriptResponse, error) {
+	if sessionID == "" {
+		log.Printf("✗ Missing session_id parameter")
+		return nil, newAPIError(http.StatusBadRequest, "session_id is required")
+	}
+	if err := validateSessionID(sessionID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("→ Request: Transcript | SessionID: %s", sessionID)
+
+	var path, owner string
+	if session, exists := sessionManager.GetSessionFor(sessionID, identity); exists {
+		path, owner = session.transcript, session.Owner
+	} else if t, exists := transcriptStore.Ended(sessionID); exists && identity.CanAccess(t.Owner) {
+		path, owner = t.Path, t.Owner
+	}
+	if path == "" {
+		log.Printf("✗ Transcript not found | SessionID: %s", sessionID)
+		return nil, newAPIError(http.StatusNotFound, "Transcript not found")
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		log.Printf("✗ Failed to open transcript | SessionID: %s | Error: %v", sessionID, err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to read transcript: %v", err)
+	}
+	defer src.Close()
+
+	dst, file, err := outputFileStore.Create(owner)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "%v", err)
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		log.Printf("✗ Failed to copy transcript | SessionID: %s | Error: %v", sessionID, err)
+		return nil, newAPIError(http.StatusInternalServerError, "Failed to read transcript: %v", err)
+	}
+	outputFileStore.Commit(file, int(n))
+
+	log.Printf("✓ Transcript ready | SessionID: %s | Token: %s | Size: %d bytes", sessionID, file.Token, n)
+	return &TranscriptResponse{
+		SessionID:     sessionID,
+		DownloadToken: file.Token,
+		DownloadURL:   "/download?token=" + file.Token,
+		Size:          file.Size,
+		ExpiresAt:     file.ExpiresAt,
+	}, nil
+}
+
+// API15: 获取会话记录
+func handleTranscript(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	resp, err := fetchTranscript(identityFrom(r), r.URL.Query().Get("session_id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
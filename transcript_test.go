@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTranscriptOwnership(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.TranscriptDir = t.TempDir()
+		cfg.TranscriptRetention = Duration(time.Hour)
+	})
+	id := ts.startSession(aliceToken, map[string]any{"transcript": true})
+	s, _ := sessionManager.GetSession(id)
+	if err := os.WriteFile(s.transcript, []byte("PS> Get-Date\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch 以 token 的身份获取会话记录, 返回状态码和下载的内容
+	fetch := func(token string) (int, string) {
+		resp, data := ts.do(http.MethodGet, token, "/transcript?session_id="+id, nil)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, string(data)
+		}
+		var out TranscriptResponse
+		decodeJSON(t, data, &out)
+		_, content := ts.do(http.MethodGet, token, out.DownloadURL, nil)
+		return resp.StatusCode, string(content)
+	}
+
+	// 其他租户的会话记录与不存在的会话一样返回 404, 会话结束后的保留期内同样如此
+	for _, phase := range []string{"running", "ended"} {
+		if status, content := fetch(aliceToken); status != http.StatusOK || content != "PS> Get-Date\n" {
+			t.Fatalf("%s: owner transcript = %d %q", phase, status, content)
+		}
+		if status, data := fetch(bobToken); status != http.StatusNotFound {
+			t.Fatalf("%s: other tenant's transcript = %d %s", phase, status, data)
+		}
+		if status, _ := fetch(adminToken); status != http.StatusOK {
+			t.Fatalf("%s: admin transcript = %d", phase, status)
+		}
+		if phase == "running" {
+			if resp, data := ts.post(aliceToken, "/end-session", map[string]any{"session_id": id}); resp.StatusCode != http.StatusOK {
+				t.Fatalf("end session = %d %s", resp.StatusCode, data)
+			}
+		}
+	}
+}
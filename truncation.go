@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// reasonPlaceholder 截断提示中代表截断原因的占位符
+	reasonPlaceholder = "{{reason}}"
+	// defaultTruncationNotice 默认的截断提示, 以换行开头, 与输出的最后一行分开
+	defaultTruncationNotice = "\n...[output truncated: " + reasonPlaceholder + "]..."
+	// maxTruncationNoticeLength 截断提示的最大长度
+	maxTruncationNoticeLength = 1024
+)
+
+// TruncateMode 输出超过字节上限或 max_lines 时保留的部分
+type TruncateMode string
+
+const (
+	// TruncateHead 保留开头(默认), 超过上限后不再读取输出
+	TruncateHead TruncateMode = "head"
+	// TruncateTail 保留末尾, 继续读取到结束标记, 只在内存中保留最后的部分
+	TruncateTail TruncateMode = "tail"
+)
+
+// parseTruncateMode 检查 truncate 参数, 为空时为 head
+func parseTruncateMode(mode TruncateMode) (TruncateMode, error) {
+	switch mode {
+	case "", TruncateHead:
+		return TruncateHead, nil
+	case TruncateTail:
+		return TruncateTail, nil
+	}
+	return "", fmt.Errorf("truncate must be %s or %s", TruncateHead, TruncateTail)
+}
+
+// validateTruncationNotice 检查 truncation_notice 的长度
+func validateTruncationNotice(notice string) error {
+	if len(notice) > maxTruncationNoticeLength {
+		return fmt.Errorf("truncation_notice must be at most %d bytes", maxTruncationNoticeLength)
+	}
+	return nil
+}
+
+// truncationReason 返回输出被截断的原因, 没有截断时为空
+// 超过输出上限优先于 max_lines, 二者都没有发生时命令超时同样视为截断
+func truncationReason(ow *outputWriter, limit, maxLines int, timeout, idle time.Duration, err error) string {
+	switch {
+	case ow.limited:
+		return fmt.Sprintf("exceeded %d bytes", limit)
+	case ow.lines != nil && ow.lines.truncated, ow.tail != nil && ow.tail.linesDropped:
+		return fmt.Sprintf("exceeded %d lines", maxLines)
+	case errors.Is(err, errIdleTimeout):
+		return fmt.Sprintf("no output for %s", idle)
+	case errors.Is(err, errCommandTimeout):
+		return fmt.Sprintf("command timed out after %s", timeout)
+	}
+	return ""
+}
+
+// writeTruncationNotice 在输出末尾写出截断提示, 不经过输出处理器, 不计入输出的字节数
+func (ow *outputWriter) writeTruncationNotice(reason string) error {
+	if ow.truncationNotice == "" {
+		return nil
+	}
+	notice := strings.ReplaceAll(ow.truncationNotice, reasonPlaceholder, reason)
+	if ow.written == 0 || ow.lastByte == '\n' {
+		// 输出为空或已以换行结尾时不再另起一行
+		if rest, ok := strings.CutPrefix(notice, "\r\n"); ok {
+			notice = rest
+		} else {
+			notice = strings.TrimPrefix(notice, "\n")
+		}
+	}
+	written := ow.written
+	err := ow.emit([]byte(notice))
+	ow.written = written
+	return err
+}
+
+// tailWriter 保留末尾时暂存写出的输出, 只保留最后 limit 字节, 读取结束后再按 maxLines 截断
+type tailWriter struct {
+	out      io.Writer
+	limit    int
+	maxLines int
+	buf      []byte
+	// dropped 丢弃了超过 limit 的开头部分, linesDropped 丢弃了超过 maxLines 的行
+	dropped      bool
+	linesDropped bool
+	// written 和 lastByte 为开始暂存时 outputWriter 的状态, 之前写出的是命令回显
+	written  int
+	lastByte byte
+}
+
+// Write 追加输出, 超过 limit 的两倍时丢弃开头, 内存占用不超过 2*limit
+func (t *tailWriter) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > 2*t.limit {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.limit:]...)
+		t.dropped = true
+	}
+	return len(b), nil
+}
+
+// finish 截取最后 limit 字节中的最后 maxLines 行
+func (t *tailWriter) finish() {
+	if len(t.buf) > t.limit {
+		t.buf = t.buf[len(t.buf)-t.limit:]
+		t.dropped = true
+	}
+	if t.maxLines > 0 {
+		if i := lastLinesStart(t.buf, t.maxLines); i > 0 {
+			t.buf = t.buf[i:]
+			t.linesDropped = true
+		}
+	}
+}
+
+// lastLinesStart 返回最后 n 行的起始位置, 不超过 n 行时为 0, 末尾的换行不算作新的一行
+func lastLinesStart(b []byte, n int) int {
+	end := len(b)
+	if end > 0 && b[end-1] == '\n' {
+		end--
+	}
+	for count := 0; ; {
+		i := bytes.LastIndexByte(b[:end], '\n')
+		if i < 0 {
+			return 0
+		}
+		if count++; count == n {
+			return i + 1
+		}
+		end = i
+	}
+}
+
+// startTail 之后的输出暂存在 tailWriter 中, 由 emitTail 写出
+func (ow *outputWriter) startTail(limit, maxLines int) {
+	ow.tail = &tailWriter{out: ow.out, limit: limit, maxLines: maxLines, written: ow.written, lastByte: ow.lastByte}
+	ow.out = ow.tail
+}
+
+// finishTail 截取暂存的输出, 丢弃了开头时与超过字节上限相同, 设置 limited
+func (ow *outputWriter) finishTail() {
+	if ow.tail == nil {
+		return
+	}
+	ow.tail.finish()
+	ow.limited = ow.tail.dropped
+}
+
+// emitTail 写出保留的末尾, reason 不为空且 notice 为 true 时先写出截断提示, 提示不计入输出的字节数
+func (ow *outputWriter) emitTail(reason string, notice bool) error {
+	t := ow.tail
+	ow.out, ow.written, ow.lastByte = t.out, t.written, t.lastByte
+	if reason != "" && notice && ow.truncationNotice != "" {
+		// 提示在保留的输出之前, 开头的换行移到末尾
+		text := strings.ReplaceAll(ow.truncationNotice, reasonPlaceholder, reason)
+		if rest, ok := strings.CutPrefix(text, "\r\n"); ok {
+			text = rest + "\r\n"
+		} else if rest, ok := strings.CutPrefix(text, "\n"); ok {
+			text = rest + "\n"
+		}
+		if err := ow.emit([]byte(text)); err != nil {
+			return err
+		}
+		ow.written = t.written
+	}
+	return ow.emit(t.buf)
+}
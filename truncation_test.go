@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncationReason(t *testing.T) {
+	tests := []struct {
+		ow   *outputWriter
+		err  error
+		want string
+	}{
+		{&outputWriter{}, nil, ""},
+		{&outputWriter{limited: true}, errCommandTimeout, "exceeded 100 bytes"},
+		{&outputWriter{lines: &lineLimiter{truncated: true}}, nil, "exceeded 5 lines"},
+		{&outputWriter{}, errCommandTimeout, "command timed out after 2s"},
+	}
+	for _, tt := range tests {
+		if got := truncationReason(tt.ow, 100, 5, 2*time.Second, 0, tt.err); got != tt.want {
+			t.Errorf("reason(%+v, %v) = %q, want %q", tt.ow, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTruncationNotice(t *testing.T) {
+	tests := []struct {
+		notice, before, want string
+	}{
+		{defaultTruncationNotice, "partial", "partial\n...[output truncated: R]..."},
+		// 输出已以换行结尾或为空时不再另起一行
+		{defaultTruncationNotice, "line\n", "line\n...[output truncated: R]..."},
+		{defaultTruncationNotice, "", "...[output truncated: R]..."},
+		{"\r\n<cut {{reason}}>", "a\n", "a\n<cut R>"},
+		{"", "unchanged", "unchanged"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		ow := &outputWriter{out: &buf, truncationNotice: tt.notice}
+		ow.emit([]byte(tt.before))
+		if err := ow.writeTruncationNotice("R"); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("notice %q after %q = %q, want %q", tt.notice, tt.before, buf.String(), tt.want)
+		}
+		// 提示不计入输出的字节数
+		if ow.written != len(tt.before) {
+			t.Errorf("written = %d, want %d", ow.written, len(tt.before))
+		}
+	}
+	if err := validateTruncationNotice(strings.Repeat("x", maxTruncationNoticeLength+1)); err == nil {
+		t.Fatal("overlong truncation_notice accepted")
+	}
+}
+
+func TestCustomTruncationNotice(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.TruncationNotice = "\n<<{{reason}}>>"
+		cfg.FakeOutputs = map[string]FakeOutput{"Lines": {Output: "one\ntwo\nthree"}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.run(aliceToken, id, "Lines", map[string]any{"max_lines": 2})
+	if resp.StatusCode != http.StatusOK || string(data) != "one\ntwo\n<<exceeded 2 lines>>" {
+		t.Fatalf("truncated = %d %q", resp.StatusCode, data)
+	}
+	if resp.Header.Get("X-Output-Truncated") != "true" {
+		t.Fatalf("X-Output-Truncated = %q", resp.Header.Get("X-Output-Truncated"))
+	}
+
+	// 没有截断时不附加
+	if _, data = ts.run(aliceToken, id, "Lines", nil); string(data) != "one\ntwo\nthree" {
+		t.Fatalf("complete output = %q", data)
+	}
+}
+
+func TestTruncationNoticeDisabled(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.TruncationNotice = ""
+		cfg.FakeOutputs = map[string]FakeOutput{"Lines": {Output: "one\ntwo\nthree"}}
+	})
+	id := ts.startSession(aliceToken, nil)
+	resp, data := ts.run(aliceToken, id, "Lines", map[string]any{"max_lines": 1, "output_format": "text"})
+	if resp.StatusCode != http.StatusOK || strings.TrimSuffix(string(data), "\n") != "one" {
+		t.Fatalf("truncated without notice = %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestLastLinesStart(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"a\nb\nc", 2, "b\nc"},
+		// 末尾的换行不算作新的一行
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb", 5, "a\nb"},
+		{"", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.text[lastLinesStart([]byte(tt.text), tt.n):]; got != tt.want {
+			t.Errorf("last %d lines of %q = %q, want %q", tt.n, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	tw := &tailWriter{limit: 4}
+	for _, chunk := range []string{"abc", "defg", "hij", "k"} {
+		tw.Write([]byte(chunk))
+		// 内存中最多保留 2*limit 字节
+		if len(tw.buf) > 2*tw.limit {
+			t.Fatalf("buffered %d bytes", len(tw.buf))
+		}
+	}
+	tw.finish()
+	if string(tw.buf) != "hijk" || !tw.dropped || tw.linesDropped {
+		t.Fatalf("tail = %q dropped %t", tw.buf, tw.dropped)
+	}
+
+	tw = &tailWriter{limit: 100, maxLines: 2}
+	tw.Write([]byte("one\ntwo\nthree\n"))
+	tw.finish()
+	if string(tw.buf) != "two\nthree\n" || tw.dropped || !tw.linesDropped {
+		t.Fatalf("tail lines = %q", tw.buf)
+	}
+}
+
+func TestTruncateTail(t *testing.T) {
+	long := strings.Repeat("x", 3000) + "END"
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.FakeOutputs = map[string]FakeOutput{
+			"Lines": {Output: "one\ntwo\nthree"},
+			"Long":  {Output: long},
+		}
+	})
+	id := ts.startSession(aliceToken, nil)
+
+	// 截断提示在保留的末尾之前
+	resp, data := ts.run(aliceToken, id, "Lines", map[string]any{"max_lines": 2, "truncate": "tail"})
+	if resp.StatusCode != http.StatusOK || string(data) != "...[output truncated: exceeded 2 lines]...\ntwo\nthree" {
+		t.Fatalf("tail lines = %d %q", resp.StatusCode, data)
+	}
+	if resp.Header.Get("X-Output-Truncated") != "true" || resp.Header.Get("X-Output-Truncate") != "tail" {
+		t.Fatalf("headers = %v", resp.Header)
+	}
+
+	if status, _ := ts.sessionConfig(aliceToken, id, map[string]any{"max_output_bytes": 1024}); status != http.StatusOK {
+		t.Fatalf("session config = %d", status)
+	}
+	resp, data = ts.run(aliceToken, id, "Long", map[string]any{"truncate": "tail"})
+	kept, ok := strings.CutPrefix(string(data), "...[output truncated: exceeded 1024 bytes]...\n")
+	if !ok || !strings.HasSuffix(kept, "END") || len(kept) > 1024 || resp.Header.Get("X-Output-Truncate") != "tail" {
+		t.Fatalf("tail bytes = %d %q", resp.StatusCode, data)
+	}
+	// 默认保留开头
+	resp, data = ts.run(aliceToken, id, "Long", nil)
+	if resp.Header.Get("X-Output-Truncate") != "head" || !strings.HasSuffix(string(data), "exceeded 1024 bytes]...") {
+		t.Fatalf("head bytes = %d %q", resp.StatusCode, data)
+	}
+	// 读取到结束标记, 下一条命令不受影响
+	if _, data = ts.run(aliceToken, id, "echo next", nil); string(data) != "next" {
+		t.Fatalf("next command = %q", data)
+	}
+
+	for _, body := range []map[string]any{{"truncate": "middle"}, {"truncate": "tail", "checkpoints": true}} {
+		if resp, data = ts.run(aliceToken, id, "Lines", body); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%v = %d %s", body, resp.StatusCode, data)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// 会话调试页面: 用管理员令牌创建会话, 以流式输出执行命令
+'use strict';
+
+const $ = (id) => document.getElementById(id);
+let sessionID = '';
+
+function headers(extra) {
+  const h = Object.assign({ 'Content-Type': 'application/json' }, extra);
+  const token = $('token').value.trim();
+  if (token) {
+    h['Authorization'] = 'Bearer ' + token;
+  }
+  return h;
+}
+
+// 输出只以文本追加, 不解析为 HTML
+function append(text, cls) {
+  const span = document.createElement('span');
+  if (cls) {
+    span.className = cls;
+  }
+  span.textContent = text;
+  $('output').appendChild(span);
+  $('output').scrollTop = $('output').scrollHeight;
+}
+
+async function errorMessage(resp) {
+  try {
+    const body = await resp.json();
+    return resp.status + ' ' + body.error.code + ': ' + body.error.message;
+  } catch (e) {
+    return resp.status + ' ' + resp.statusText;
+  }
+}
+
+function setSession(id) {
+  sessionID = id;
+  $('session').textContent = id ? 'Session: ' + id : '';
+  $('start').disabled = !!id;
+  $('end').disabled = !id;
+  $('run').disabled = !id;
+  $('command').disabled = !id;
+}
+
+async function loadShells() {
+  const resp = await fetch('/capabilities');
+  const caps = await resp.json();
+  for (const shell of caps.shells.filter((s) => s.installed)) {
+    const option = document.createElement('option');
+    option.value = shell.name;
+    option.textContent = shell.name;
+    option.selected = shell.name === caps.default_shell;
+    $('shell').appendChild(option);
+  }
+}
+
+async function startSession() {
+  // 页面只供管理员使用, 先确认令牌是管理员令牌
+  const check = await fetch('/ui/check', { headers: headers() });
+  if (!check.ok) {
+    append('✗ ' + await errorMessage(check) + '\n', 'error');
+    return;
+  }
+  const resp = await fetch('/start-session', { method: 'POST', headers: headers(), body: JSON.stringify({ shell: $('shell').value }) });
+  if (!resp.ok) {
+    append('✗ ' + await errorMessage(resp) + '\n', 'error');
+    return;
+  }
+  const body = await resp.json();
+  setSession(body.session_id);
+  append('✓ Session started: ' + body.session_id + '\n', 'info');
+}
+
+async function endSession() {
+  const resp = await fetch('/end-session', { method: 'POST', headers: headers(), body: JSON.stringify({ session_id: sessionID }) });
+  if (!resp.ok && resp.status !== 404) {
+    append('✗ ' + await errorMessage(resp) + '\n', 'error');
+    return;
+  }
+  append('✓ Session ended\n', 'info');
+  setSession('');
+}
+
+function handleFrame(frame) {
+  switch (frame.type) {
+    case 'stdout':
+      append(frame.data);
+      break;
+    case 'end':
+      if (frame.error) {
+        append('\n✗ ' + frame.error.code + ': ' + frame.error.message + '\n', 'error');
+      }
+      $('status').textContent = 'Exit code: ' + (frame.exit_code === null ? 'unknown' : frame.exit_code);
+      break;
+  }
+}
+
+async function runCommand() {
+  const command = $('command').value;
+  if (!command.trim()) {
+    return;
+  }
+  $('run').disabled = true;
+  $('status').textContent = 'Running...';
+  append('$ ' + command + '\n', 'info');
+  try {
+    const resp = await fetch('/run-command', {
+      method: 'POST',
+      headers: headers({ 'Accept': 'application/x-ndjson' }),
+      body: JSON.stringify({ session_id: sessionID, command: command, queue: true }),
+    });
+    if (!resp.ok || !(resp.headers.get('Content-Type') || '').startsWith('application/x-ndjson')) {
+      append('✗ ' + await errorMessage(resp) + '\n', 'error');
+      $('status').textContent = '';
+      return;
+    }
+    // 每行一个 JSON 帧, 最后一行可能不完整, 留到下一次读取
+    const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+    let pending = '';
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) {
+        break;
+      }
+      pending += value;
+      const lines = pending.split('\n');
+      pending = lines.pop();
+      for (const line of lines) {
+        if (line) {
+          handleFrame(JSON.parse(line));
+        }
+      }
+    }
+    append('\n');
+  } catch (e) {
+    append('✗ ' + e + '\n', 'error');
+  } finally {
+    $('run').disabled = !sessionID;
+  }
+}
+
+$('start').addEventListener('click', startSession);
+$('end').addEventListener('click', endSession);
+$('run').addEventListener('click', runCommand);
+$('clear').addEventListener('click', () => { $('output').textContent = ''; });
+$('command').addEventListener('keydown', (e) => {
+  if (e.key === 'Enter' && e.ctrlKey) {
+    e.preventDefault();
+    runCommand();
+  }
+});
+loadShells();
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// partialSuffix 未完成的上传写入目标路径加该后缀的文件, 完成并校验通过后重命名为目标文件
+	partialSuffix = ".partial"
+	// uploadOffsetHeader 已接收的字节数, 续传时从该偏移继续
+	uploadOffsetHeader = "Upload-Offset"
+	// uploadChecksumHeader 完整文件的 SHA-256(十六进制), 完成上传的请求必须提供
+	uploadChecksumHeader = "X-Checksum-SHA256"
+)
+
+var (
+	errUploadOutside     = errors.New("path must be a relative path inside the upload directory")
+	errUploadNotFound    = errors.New("no partial upload for this path")
+	errUploadBusy        = errors.New("another upload to this path is in progress")
+	errUploadOffset      = errors.New("upload must continue from the received offset")
+	errUploadTooLarge    = errors.New("upload exceeds max_upload_size")
+	errUploadIncomplete  = errors.New("upload interrupted before the range was complete")
+	errUploadOverrun     = errors.New("request body is longer than the Content-Range")
+	errChecksumRequired  = errors.New(uploadChecksumHeader + " is required for the request that completes the upload")
+	errChecksumMismatch  = errors.New("checksum does not match the uploaded content")
+	errInvalidRange      = errors.New("invalid Content-Range, expected bytes start-end/total")
+	errInvalidChecksum   = errors.New(uploadChecksumHeader + " must be a hex-encoded SHA-256 digest")
+	errUploadPathIsDir   = errors.New("path refers to a directory")
+	errUploadNotRegular  = errors.New("partial upload is not a regular file")
+	errUploadUnsupported = errors.New("uploads of paths ending in " + partialSuffix + " are not allowed")
+)
+
+// uploadTenantName 可以直接用作租户子目录名的租户名
+// 只允许小写, 避免不区分大小写的文件系统上不同租户落到同一个目录, 不能以 . 结尾(Windows 会去掉)
+var uploadTenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+// uploadTenantDir 租户在上传目录中的子目录名
+// 符合 uploadTenantName 的租户名加 t- 前缀, 其余(如含 / 或大写字母的 JWT subject)为租户名 SHA-256 的前 16 位十六进制加 h- 前缀
+func uploadTenantDir(tenant string) string {
+	if uploadTenantName.MatchString(tenant) {
+		return "t-" + tenant
+	}
+	sum := sha256.Sum256([]byte(tenant))
+	return "h-" + hex.EncodeToString(sum[:8])
+}
+
+// UploadStore 接收上传文件的目录, 每个租户的文件在各自的子目录中, 文件边接收边写入磁盘, 不在内存中缓冲
+type UploadStore struct {
+	// dir 解析过符号链接的绝对路径
+	dir string
+	// maxSize 单个文件的大小上限, 0 表示不限制
+	maxSize int64
+	// readTimeout 每次读取请求体的超时, 代替 read_timeout 对整个请求的限制
+	readTimeout time.Duration
+	// active 正在上传的目标路径, 同一路径同时只接受一个请求
+	active   map[string]bool
+	mu       sync.Mutex
+	received atomic.Int64
+}
+
+func NewUploadStore(dir string, maxSize int64, readTimeout time.Duration) (*UploadStore, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload_dir: %v", err)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload_dir: %v", err)
+	}
+	return &UploadStore{dir: real, maxSize: maxSize, readTimeout: readTimeout, active: make(map[string]bool)}, nil
+}
+
+var uploadStore *UploadStore
+
+// Received 累计写入磁盘的上传字节数
+func (st *UploadStore) Received() int64 {
+	return st.received.Load()
+}
+
+// within 判断 path 是否位于目录 dir 中
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve 返回租户上传目标的实际路径, create 为 true 时创建所在目录
+// 与脚本目录相同, 拒绝绝对路径和越出租户目录的引用, 解析所在目录的符号链接后再检查一次
+func (st *UploadStore) resolve(tenant, name string, create bool) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errUploadOutside
+	}
+	base := filepath.Join(st.dir, uploadTenantDir(tenant))
+	path := filepath.Join(base, name)
+	if !within(base, path) {
+		return "", errUploadOutside
+	}
+	if strings.HasSuffix(path, partialSuffix) {
+		return "", errUploadUnsupported
+	}
+
+	parent := filepath.Dir(path)
+	if create {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	real, err := filepath.EvalSymlinks(parent)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errUploadNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path: %v", err)
+	}
+	dest := filepath.Join(real, filepath.Base(path))
+	// 租户目录本身被替换为符号链接时同样越出了目录
+	if real != base && !within(base, real) {
+		return "", errUploadOutside
+	}
+	if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		return "", errUploadPathIsDir
+	}
+	return dest, nil
+}
+
+// acquire 标记目标路径正在上传
+func (st *UploadStore) acquire(dest string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.active[dest] {
+		return false
+	}
+	st.active[dest] = true
+	return true
+}
+
+func (st *UploadStore) release(dest string) {
+	st.mu.Lock()
+	delete(st.active, dest)
+	st.mu.Unlock()
+}
+
+// partialSize 返回未完成上传已接收的字节数, 没有未完成的上传时返回 errUploadNotFound
+func partialSize(dest string) (int64, error) {
+	fi, err := os.Lstat(dest + partialSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errUploadNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat partial upload: %v", err)
+	}
+	if !fi.Mode().IsRegular() {
+		// 可能是会话中的命令放置的符号链接, 不跟随写入
+		return 0, errUploadNotRegular
+	}
+	return fi.Size(), nil
+}
+
+// openPartial 打开未完成的上传用于读写, 不存在时创建
+// resolve 之后路径可能被替换为符号链接, 打开时不跟随(openNoFollow), 打开后再确认打开的是该路径上的普通文件
+// 打开时不截断, 确认之后 truncate 才截断, 避免截断符号链接指向的文件
+func openPartial(part string, truncate bool) (*os.File, error) {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE|os.O_APPEND|openNoFollow, 0644)
+	if err != nil {
+		if fi, lerr := os.Lstat(part); lerr == nil && !fi.Mode().IsRegular() {
+			return nil, errUploadNotRegular
+		}
+		return nil, fmt.Errorf("failed to open partial upload: %v", err)
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat partial upload: %v", err)
+	}
+	linked, err := os.Lstat(part)
+	if err != nil || !linked.Mode().IsRegular() || !os.SameFile(opened, linked) {
+		f.Close()
+		return nil, errUploadNotRegular
+	}
+	if truncate {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate partial upload: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// contentRange 请求头 Content-Range 描述的字节范围
+type contentRange struct {
+	start, end int64
+	// total 完整文件的大小, 为 -1 时未知(bytes start-end/*)
+	total int64
+}
+
+// parseContentRange 解析 bytes start-end/total, total 可以为 *
+func parseContentRange(header string) (*contentRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return nil, errInvalidRange
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return nil, errInvalidRange
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return nil, errInvalidRange
+	}
+	rng := &contentRange{total: -1}
+	var err error
+	if rng.start, err = strconv.ParseInt(first, 10, 64); err != nil || rng.start < 0 {
+		return nil, errInvalidRange
+	}
+	if rng.end, err = strconv.ParseInt(last, 10, 64); err != nil || rng.end < rng.start {
+		return nil, errInvalidRange
+	}
+	if total != "*" {
+		if rng.total, err = strconv.ParseInt(total, 10, 64); err != nil || rng.total <= rng.end {
+			return nil, errInvalidRange
+		}
+	}
+	return rng, nil
+}
+
+// final 该范围是否是文件的最后一部分
+func (r *contentRange) final() bool {
+	return r.total >= 0 && r.end+1 == r.total
+}
+
+// UploadResult 上传请求的结果
+type UploadResult struct {
+	Path string `json:"path"`
+	// File 目标文件在服务端的绝对路径(位于租户的子目录中), 会话中的命令用它引用上传的文件
+	File string `json:"file"`
+	// Offset 已接收的字节数, 续传时从该偏移继续
+	Offset int64 `json:"offset"`
+	// Complete 文件已完整接收并通过校验, 已写入目标路径
+	Complete bool `json:"complete"`
+	// SHA256 完成时为文件的 SHA-256
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Write 把 body 追加到 dest 的未完成上传中, rng 为空时 body 是完整文件
+// 完成上传的请求按 checksum 校验整个文件, 通过后重命名为目标文件, 不通过时删除已接收的内容
+// 读取 body 出错时保留已写入的部分, 客户端可以查询偏移后续传
+func (st *UploadStore) Write(dest string, body io.Reader, rng *contentRange, checksum string) (int64, string, error) {
+	part := dest + partialSuffix
+	offset, err := partialSize(dest)
+	if errors.Is(err, errUploadNotFound) {
+		offset = 0
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	start, final := int64(0), true
+	if rng != nil {
+		start, final = rng.start, rng.final()
+		if start != offset && start != 0 {
+			return offset, "", errUploadOffset
+		}
+	}
+	if final && checksum == "" {
+		return offset, "", errChecksumRequired
+	}
+	// limit 本次请求最多写入的字节数, -1 表示不限制
+	limit := int64(-1)
+	if rng != nil {
+		limit = rng.end - rng.start + 1
+	}
+	if st.maxSize > 0 {
+		if rng != nil && (rng.end >= st.maxSize || rng.total > st.maxSize) {
+			return offset, "", errUploadTooLarge
+		}
+		if limit < 0 {
+			limit = st.maxSize - start
+		}
+	}
+
+	// 不带 Content-Range 的请求或从头开始的范围放弃之前未完成的上传
+	f, err := openPartial(part, start == 0)
+	if err != nil {
+		return offset, "", err
+	}
+
+	var w io.Writer = f
+	hash := sha256.New()
+	if final {
+		// 只在最后一个请求中计算校验和, 之前接收的内容从磁盘读取一次
+		if start > 0 {
+			if err := hashPrefix(hash, f, start); err != nil {
+				f.Close()
+				return offset, "", err
+			}
+		}
+		w = io.MultiWriter(f, hash)
+	}
+
+	src := body
+	if limit >= 0 {
+		// 多读一个字节以发现超出范围或大小上限的请求体
+		src = io.LimitReader(body, limit+1)
+	}
+	n, copyErr := io.Copy(w, src)
+	st.received.Add(n)
+	if limit >= 0 && n > limit {
+		// 超出的内容不保留, 文件恢复到本次请求之前的大小
+		f.Truncate(start)
+		f.Close()
+		if rng != nil {
+			return start, "", errUploadOverrun
+		}
+		os.Remove(part)
+		return 0, "", errUploadTooLarge
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset = start + n
+	if copyErr != nil {
+		return offset, "", fmt.Errorf("%w: %v", errUploadIncomplete, copyErr)
+	}
+	if rng != nil && offset != rng.end+1 {
+		return offset, "", errUploadIncomplete
+	}
+	if !final {
+		return offset, "", nil
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, checksum) {
+		os.Remove(part)
+		return 0, sum, errChecksumMismatch
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return offset, sum, fmt.Errorf("failed to move upload into place: %v", err)
+	}
+	return offset, sum, nil
+}
+
+// hashPrefix 把已打开的未完成上传的前 n 个字节写入 hash
+func hashPrefix(hash io.Writer, f *os.File, n int64) error {
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, n)); err != nil {
+		return fmt.Errorf("failed to read partial upload: %v", err)
+	}
+	return nil
+}
+
+// validChecksum 检查是否为十六进制的 SHA-256
+func validChecksum(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// deadlineReader 每次读取请求体前延长连接的读超时
+// 上传耗时取决于文件大小, 只要持续有数据到达就不会因 read_timeout 断开
+type deadlineReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.rc.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+// uploadError 将上传的错误转换为带状态码的错误
+func uploadError(name string, err error) error {
+	switch {
+	case errors.Is(err, errUploadOutside), errors.Is(err, errUploadUnsupported), errors.Is(err, errUploadPathIsDir),
+		errors.Is(err, errInvalidRange), errors.Is(err, errChecksumRequired), errors.Is(err, errUploadOverrun),
+		errors.Is(err, errUploadIncomplete), errors.Is(err, errInvalidChecksum):
+		log.Printf("✗ Invalid upload | Path: %s | Error: %v", name, err)
+		return newAPIError(http.StatusBadRequest, "%v", err)
+	case errors.Is(err, errChecksumMismatch):
+		log.Printf("✗ Upload checksum mismatch | Path: %s", name)
+		return newAPIErrorCode(http.StatusBadRequest, codeChecksumMismatch, "%v", err)
+	case errors.Is(err, errUploadNotFound):
+		return newAPIError(http.StatusNotFound, "%v", err)
+	case errors.Is(err, errUploadBusy), errors.Is(err, errUploadOffset), errors.Is(err, errUploadNotRegular):
+		log.Printf("✗ Upload conflict | Path: %s | Error: %v", name, err)
+		return newAPIError(http.StatusConflict, "%v", err)
+	case errors.Is(err, errUploadTooLarge):
+		log.Printf("✗ Upload too large | Path: %s | Max size: %d bytes", name, uploadStore.maxSize)
+		return newAPIErrorCode(http.StatusRequestEntityTooLarge, codeUploadTooLarge, "%v", err)
+	}
+	log.Printf("✗ Upload failed | Path: %s | Error: %v", name, err)
+	return newAPIError(http.StatusInternalServerError, "Upload failed: %v", err)
+}
+
+// API21: 上传文件, PUT 写入内容, GET 查询未完成上传的偏移
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		log.Printf("✗ Missing path parameter")
+		writeError(w, newAPIError(http.StatusBadRequest, "path is required"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		uploadStatus(w, identityFrom(r), name)
+	case http.MethodPut:
+		uploadContent(w, r, identityFrom(r), name)
+	default:
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+// uploadStatus 返回未完成上传已接收的字节数
+func uploadStatus(w http.ResponseWriter, identity *Identity, name string) {
+	dest, err := uploadStore.resolve(identity.Name, name, false)
+	if err != nil {
+		writeError(w, uploadError(name, err))
+		return
+	}
+	offset, err := partialSize(dest)
+	if err != nil {
+		writeError(w, uploadError(name, err))
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResult{Path: name, File: dest, Offset: offset})
+}
+
+// uploadContent 接收请求体并写入目标文件
+func uploadContent(w http.ResponseWriter, r *http.Request, identity *Identity, name string) {
+	var rng *contentRange
+	if header := r.Header.Get("Content-Range"); header != "" {
+		var err error
+		if rng, err = parseContentRange(header); err != nil {
+			writeError(w, uploadError(name, err))
+			return
+		}
+	}
+	checksum := r.Header.Get(uploadChecksumHeader)
+	if checksum != "" && !validChecksum(checksum) {
+		writeError(w, uploadError(name, errInvalidChecksum))
+		return
+	}
+
+	log.Printf("→ Request: Upload | Path: %s | Range: %s | Owner: %s", name, r.Header.Get("Content-Range"), identity.Name)
+
+	dest, err := uploadStore.resolve(identity.Name, name, true)
+	if err != nil {
+		writeError(w, uploadError(name, err))
+		return
+	}
+	if !uploadStore.acquire(dest) {
+		writeError(w, uploadError(name, errUploadBusy))
+		return
+	}
+	defer uploadStore.release(dest)
+
+	var body io.Reader = r.Body
+	if uploadStore.readTimeout > 0 {
+		body = &deadlineReader{r: r.Body, rc: http.NewResponseController(w), timeout: uploadStore.readTimeout}
+	}
+	offset, sum, err := uploadStore.Write(dest, body, rng, checksum)
+	// 出错时同样告知已接收的字节数, 客户端据此续传
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	if err != nil {
+		writeError(w, uploadError(name, err))
+		return
+	}
+
+	result := UploadResult{Path: name, File: dest, Offset: offset}
+	if rng == nil || rng.final() {
+		result.Complete = true
+		result.SHA256 = sum
+		log.Printf("✓ Upload complete | Path: %s | Size: %d bytes", name, offset)
+	} else {
+		log.Printf("✓ Upload chunk stored | Path: %s | Offset: %d", name, offset)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
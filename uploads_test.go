@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   contentRange
+		final  bool
+		ok     bool
+	}{
+		{"bytes 0-4/10", contentRange{0, 4, 10}, false, true},
+		{"bytes 5-9/10", contentRange{5, 9, 10}, true, true},
+		{"bytes 0-4/*", contentRange{0, 4, -1}, false, true},
+		{"bytes 5-4/10", contentRange{}, false, false},
+		{"bytes 0-9/9", contentRange{}, false, false},
+		{"bytes -1-4/10", contentRange{}, false, false},
+		{"bytes 0-4", contentRange{}, false, false},
+		{"items 0-4/10", contentRange{}, false, false},
+	}
+	for _, tt := range tests {
+		rng, err := parseContentRange(tt.header)
+		if !tt.ok {
+			if !errors.Is(err, errInvalidRange) {
+				t.Errorf("parse %q = %+v, %v, want errInvalidRange", tt.header, rng, err)
+			}
+			continue
+		}
+		if err != nil || *rng != tt.want || rng.final() != tt.final {
+			t.Errorf("parse %q = %+v, %v, want %+v final %t", tt.header, rng, err, tt.want, tt.final)
+		}
+	}
+}
+
+func TestUploadResolve(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	st, err := NewUploadStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(st.dir, "t-alice")
+	os.Mkdir(base, 0755)
+	os.Symlink(outside, filepath.Join(base, "escape"))
+	os.Mkdir(filepath.Join(base, "sub"), 0755)
+
+	if dest, err := st.resolve("alice", "nested/a.bin", true); err != nil || dest != filepath.Join(base, "nested", "a.bin") {
+		t.Fatalf("resolve nested = %q, %v", dest, err)
+	}
+	for name, want := range map[string]error{
+		"":              errUploadOutside,
+		"../x":          errUploadOutside,
+		"/etc/passwd":   errUploadOutside,
+		"a\x00b":        errUploadOutside,
+		"escape/x":      errUploadOutside,
+		"../t-bob/x":    errUploadOutside,
+		"a.bin.partial": errUploadUnsupported,
+		"sub":           errUploadPathIsDir,
+	} {
+		if _, err := st.resolve("alice", name, false); !errors.Is(err, want) {
+			t.Errorf("resolve %q = %v, want %v", name, err, want)
+		}
+	}
+	if _, err := st.resolve("alice", "missing/a.bin", false); !errors.Is(err, errUploadNotFound) {
+		t.Errorf("resolve in missing directory = %v", err)
+	}
+
+	// 租户目录被替换为符号链接时不跟随
+	os.Symlink(outside, filepath.Join(st.dir, "t-mallory"))
+	if _, err := st.resolve("mallory", "a.bin", true); !errors.Is(err, errUploadOutside) {
+		t.Errorf("resolve through linked tenant directory = %v", err)
+	}
+}
+
+func TestUploadTenantDir(t *testing.T) {
+	for tenant, want := range map[string]string{
+		"alice":    "t-alice",
+		"ci-bot.2": "t-ci-bot.2",
+	} {
+		if got := uploadTenantDir(tenant); got != want {
+			t.Errorf("uploadTenantDir(%q) = %q, want %q", tenant, got, want)
+		}
+	}
+	// 可能越出目录、与其他租户冲突或在 Windows 上不合法的名称使用哈希
+	seen := map[string]bool{}
+	for _, tenant := range []string{"Alice", "cert:web", "a/b", "..", "x.", ""} {
+		dir := uploadTenantDir(tenant)
+		if !strings.HasPrefix(dir, "h-") || len(dir) != 18 || seen[dir] {
+			t.Errorf("uploadTenantDir(%q) = %q", tenant, dir)
+		}
+		seen[dir] = true
+	}
+}
+
+func TestOpenPartialRejectsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(t.TempDir(), "victim")
+	os.WriteFile(target, []byte("keep"), 0644)
+	part := filepath.Join(dir, "a.bin"+partialSuffix)
+	if err := os.Symlink(target, part); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	// partialSize 检查之后才替换为符号链接的路径同样不跟随, 也不截断指向的文件
+	if f, err := openPartial(part, true); !errors.Is(err, errUploadNotRegular) {
+		if f != nil {
+			f.Close()
+		}
+		t.Fatalf("openPartial through symlink = %v", err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "keep" {
+		t.Fatalf("symlink target = %q", got)
+	}
+}
+
+// failingReader 读取 n 个字节后返回错误, 模拟中断的连接
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadWriteInterrupted(t *testing.T) {
+	st, _ := NewUploadStore(t.TempDir(), 0, 0)
+	dest := filepath.Join(st.dir, "a.bin")
+	content := []byte("0123456789")
+
+	// 中断时保留已写入的部分, 从返回的偏移续传
+	offset, _, err := st.Write(dest, &failingReader{r: bytes.NewReader(content), n: 4}, &contentRange{0, 9, 10}, sha256Hex(content))
+	if !errors.Is(err, errUploadIncomplete) || offset != 4 {
+		t.Fatalf("interrupted write = %d, %v", offset, err)
+	}
+	if size, err := partialSize(dest); err != nil || size != 4 {
+		t.Fatalf("partial size = %d, %v", size, err)
+	}
+	offset, sum, err := st.Write(dest, bytes.NewReader(content[4:]), &contentRange{4, 9, 10}, sha256Hex(content))
+	if err != nil || offset != 10 || sum != sha256Hex(content) {
+		t.Fatalf("resumed write = %d %s, %v", offset, sum, err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Fatalf("uploaded file = %q", got)
+	}
+	if st.Received() != 10 {
+		t.Fatalf("received %d bytes", st.Received())
+	}
+}
+
+// upload 以 token 的身份 PUT 上传 body, rng 不为空时作为 Content-Range
+func (ts *testServer) upload(token, name, rng, checksum string, body []byte) (*http.Response, []byte) {
+	ts.t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/upload?path="+name, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if rng != "" {
+		req.Header.Set("Content-Range", rng)
+	}
+	if checksum != "" {
+		req.Header.Set(uploadChecksumHeader, checksum)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func TestResumableUpload(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, func(cfg *Config) { cfg.UploadDir = dir })
+	content := []byte("hello, resumable world")
+	checksum := sha256Hex(content)
+	total := "/" + strconv.Itoa(len(content))
+
+	resp, data := ts.upload(aliceToken, "logs/app.txt", "bytes 0-9"+total, "", content[:10])
+	var result UploadResult
+	decodeJSON(t, data, &result)
+	if resp.StatusCode != http.StatusOK || result.Offset != 10 || result.Complete {
+		t.Fatalf("first chunk = %d %s", resp.StatusCode, data)
+	}
+	resp, data = ts.do(http.MethodGet, aliceToken, "/upload?path=logs/app.txt", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(uploadOffsetHeader) != "10" {
+		t.Fatalf("upload status = %d %s", resp.StatusCode, data)
+	}
+
+	// 跳过已接收的偏移、缺少校验和的最后一块都被拒绝
+	if resp, data = ts.upload(aliceToken, "logs/app.txt", "bytes 12-21"+total, checksum, content[12:]); resp.StatusCode != http.StatusConflict || resp.Header.Get(uploadOffsetHeader) != "10" {
+		t.Fatalf("gap in range = %d %s", resp.StatusCode, data)
+	}
+	if resp, data = ts.upload(aliceToken, "logs/app.txt", "bytes 10-21"+total, "", content[10:]); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("final chunk without checksum = %d %s", resp.StatusCode, data)
+	}
+
+	resp, data = ts.upload(aliceToken, "logs/app.txt", "bytes 10-21"+total, checksum, content[10:])
+	decodeJSON(t, data, &result)
+	if resp.StatusCode != http.StatusOK || !result.Complete || result.SHA256 != checksum {
+		t.Fatalf("final chunk = %d %s", resp.StatusCode, data)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "t-alice", "logs", "app.txt")); !bytes.Equal(got, content) {
+		t.Fatalf("uploaded file = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "t-alice", "logs", "app.txt"+partialSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+	if resp, _ = ts.do(http.MethodGet, aliceToken, "/upload?path=logs/app.txt", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status after completion = %d", resp.StatusCode)
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, func(cfg *Config) { cfg.UploadDir = dir })
+
+	resp, data := ts.upload(aliceToken, "a.bin", "", strings.Repeat("0", 64), []byte("content"))
+	if resp.StatusCode != http.StatusBadRequest || errorCodeOf(t, data) != codeChecksumMismatch {
+		t.Fatalf("mismatch = %d %s", resp.StatusCode, data)
+	}
+	// 校验失败时已接收的内容删除, 目标文件不写入
+	for _, name := range []string{"a.bin", "a.bin" + partialSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, "t-alice", name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after mismatch: %v", name, err)
+		}
+	}
+	if resp, data = ts.upload(aliceToken, "a.bin", "", "not-hex", []byte("content")); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid checksum = %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.UploadDir = dir
+		cfg.MaxUploadSize = 8
+	})
+	content := []byte("more than eight bytes")
+	if resp, data := ts.upload(aliceToken, "big.bin", "", sha256Hex(content), content); resp.StatusCode != http.StatusRequestEntityTooLarge || errorCodeOf(t, data) != codeUploadTooLarge {
+		t.Fatalf("too large = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.upload(aliceToken, "big.bin", "bytes 0-3/20", "", content[:4]); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("range with large total = %d %s", resp.StatusCode, data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "t-alice", "big.bin"+partialSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind: %v", err)
+	}
+}
+
+func TestUploadsAreScopedByTenant(t *testing.T) {
+	dir := t.TempDir()
+	ts := newTestServer(t, func(cfg *Config) { cfg.UploadDir = dir })
+	content := []byte("0123456789")
+
+	if resp, data := ts.upload(aliceToken, "shared.bin", "bytes 0-4/10", "", content[:5]); resp.StatusCode != http.StatusOK {
+		t.Fatalf("alice chunk = %d %s", resp.StatusCode, data)
+	}
+	// 其他租户看不到也不能续传未完成的上传, 同名上传写入各自的目录
+	if resp, data := ts.do(http.MethodGet, bobToken, "/upload?path=shared.bin", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bob status of alice's upload = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.upload(bobToken, "shared.bin", "bytes 5-9/10", sha256Hex(content), content[5:]); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("bob resuming alice's upload = %d %s", resp.StatusCode, data)
+	}
+	resp, data := ts.upload(bobToken, "shared.bin", "", sha256Hex([]byte("bob")), []byte("bob"))
+	var result UploadResult
+	decodeJSON(t, data, &result)
+	if resp.StatusCode != http.StatusOK || result.File != filepath.Join(uploadStore.dir, "t-bob", "shared.bin") {
+		t.Fatalf("bob upload = %d %s", resp.StatusCode, data)
+	}
+	if resp, data := ts.upload(aliceToken, "shared.bin", "bytes 5-9/10", sha256Hex(content), content[5:]); resp.StatusCode != http.StatusOK {
+		t.Fatalf("alice final chunk = %d %s", resp.StatusCode, data)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "t-alice", "shared.bin")); !bytes.Equal(got, content) {
+		t.Fatalf("alice's file = %q", got)
+	}
+}
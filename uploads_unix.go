@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// openNoFollow 打开未完成的上传时不跟随符号链接, 路径是符号链接时打开失败
+const openNoFollow = syscall.O_NOFOLLOW
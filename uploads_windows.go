@@ -0,0 +1,6 @@
+//go:build windows
+
+package main
+
+// openNoFollow Windows 上没有对应的标志, 打开后由 openPartial 比较文件确认没有经过符号链接
+const openNoFollow = 0
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// usageSampleInterval 执行命令期间采样进程树内存占用的间隔
+const usageSampleInterval = 100 * time.Millisecond
+
+// usageMonitor 统计一条命令执行期间会话进程树的 CPU 时间和内存峰值
+// 统计的是整个进程树, 包括 shell 本身和后台进程, 同一时间会话只执行一条命令
+type usageMonitor struct {
+	sessionID string
+	group     processTree
+	start     processUsage
+	// peak 采样到的最大内存占用, 只由 sample 修改, finish 等待 sample 结束后读取
+	peak uint64
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startUsageMonitor 记录命令开始时的资源使用并开始采样, 平台不支持时返回 nil
+func startUsageMonitor(sessionID string, group processTree) *usageMonitor {
+	start, err := group.usage()
+	if err != nil {
+		log.Printf("⚠ Resource usage unavailable | SessionID: %s | Error: %v", sessionID, err)
+		return nil
+	}
+
+	m := &usageMonitor{
+		sessionID: sessionID,
+		group:     group,
+		start:     start,
+		peak:      start.memory,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go m.sample()
+	return m
+}
+
+func (m *usageMonitor) sample() {
+	defer close(m.done)
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if u, err := m.group.usage(); err == nil && u.memory > m.peak {
+				m.peak = u.memory
+			}
+		}
+	}
+}
+
+// finish 停止采样, 将命令使用的 CPU 时间和内存峰值写入 result
+func (m *usageMonitor) finish(result *CommandResult) {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+
+	end, err := m.group.usage()
+	if err != nil {
+		log.Printf("⚠ Resource usage unavailable | SessionID: %s | Error: %v", m.sessionID, err)
+		return
+	}
+	peak := m.peak
+	if end.memory > peak {
+		peak = end.memory
+	}
+	// 开始时存在的后台进程退出且未被 shell 回收时, 其 CPU 时间不再计入, 差值可能为负
+	cpu := end.cpu - m.start.cpu
+	if cpu < 0 {
+		cpu = 0
+	}
+	cpuMs := cpu.Milliseconds()
+	result.CPUMs = &cpuMs
+	result.PeakMemoryBytes = &peak
+}
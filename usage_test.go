@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubTree 按顺序返回预设资源使用的进程树
+type stubTree struct {
+	fakeShell
+	mu     sync.Mutex
+	usages []processUsage
+	err    error
+}
+
+func (st *stubTree) usage() (processUsage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return processUsage{}, st.err
+	}
+	u := st.usages[0]
+	if len(st.usages) > 1 {
+		st.usages = st.usages[1:]
+	}
+	return u, nil
+}
+
+func TestUsageMonitor(t *testing.T) {
+	tree := &stubTree{usages: []processUsage{
+		{cpu: 100 * time.Millisecond, memory: 10 << 20},
+		// 采样到的峰值高于结束时的占用
+		{cpu: 200 * time.Millisecond, memory: 50 << 20},
+		{cpu: 350 * time.Millisecond, memory: 20 << 20},
+	}}
+	m := startUsageMonitor("test", tree)
+	// 等待至少一次采样
+	waitFor(t, func() bool {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
+		return len(tree.usages) == 1
+	})
+	var result CommandResult
+	m.finish(&result)
+	if result.CPUMs == nil || *result.CPUMs != 250 {
+		t.Fatalf("cpu_ms = %v, want 250", result.CPUMs)
+	}
+	if result.PeakMemoryBytes == nil || *result.PeakMemoryBytes != 50<<20 {
+		t.Fatalf("peak_memory_bytes = %v", result.PeakMemoryBytes)
+	}
+}
+
+func TestUsageMonitorClampsNegativeCPU(t *testing.T) {
+	// 后台进程退出后累计 CPU 时间可能比开始时少
+	tree := &stubTree{usages: []processUsage{{cpu: time.Second}, {cpu: 400 * time.Millisecond}}}
+	m := startUsageMonitor("test", tree)
+	var result CommandResult
+	m.finish(&result)
+	if result.CPUMs == nil || *result.CPUMs != 0 {
+		t.Fatalf("cpu_ms = %v, want 0", result.CPUMs)
+	}
+}
+
+func TestUsageMonitorUnavailable(t *testing.T) {
+	if m := startUsageMonitor("test", &stubTree{err: errors.New("unsupported")}); m != nil {
+		t.Fatal("monitor started without usage")
+	}
+	// 平台不支持时不返回统计
+	var m *usageMonitor
+	var result CommandResult
+	m.finish(&result)
+	if result.CPUMs != nil || result.PeakMemoryBytes != nil {
+		t.Fatalf("usage reported: %+v", result)
+	}
+}
+
+func TestReportUsage(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.startSession(aliceToken, nil)
+
+	resp, data := ts.run(aliceToken, id, "echo hi", map[string]any{"report_usage": true})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-CPU-Ms") == "" || resp.Header.Get("X-Peak-Memory-Bytes") == "" {
+		t.Fatalf("report_usage = %d %q %v", resp.StatusCode, data, resp.Header)
+	}
+	// 没有请求时不返回
+	if resp, _ = ts.run(aliceToken, id, "echo hi", nil); resp.Header.Get("X-CPU-Ms") != "" {
+		t.Fatalf("X-CPU-Ms without report_usage = %q", resp.Header.Get("X-CPU-Ms"))
+	}
+}
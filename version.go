@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// 构建信息, 构建时通过 -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=..." 设置
+var (
+	// version 服务版本
+	version = "dev"
+	// gitCommit 构建所用的提交, 未设置时使用 go build 记录的 vcs.revision
+	gitCommit = ""
+	// buildDate 构建时间, 建议使用 RFC 3339 格式
+	buildDate = ""
+)
+
+// VersionInfo 服务的版本和构建信息
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo 返回构建信息, 未通过 ldflags 设置的提交和时间从 go build 嵌入的 VCS 信息中补全, 都没有时为 unknown
+func buildInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" {
+					info.GitCommit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if gitCommit == "" && info.GitCommit != "" && modified {
+			info.GitCommit += "-dirty"
+		}
+	}
+	if info.GitCommit == "" {
+		info.GitCommit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// logBuildInfo 启动时记录构建信息
+func logBuildInfo() {
+	info := buildInfo()
+	log.Printf("✓ Build info | Version: %s | Commit: %s | Built: %s | Go: %s", info.Version, info.GitCommit, info.BuildDate, info.GoVersion)
+}
+
+// API23: 服务版本和构建信息, 不需要认证
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	previous := [3]string{version, gitCommit, buildDate}
+	t.Cleanup(func() { version, gitCommit, buildDate = previous[0], previous[1], previous[2] })
+
+	version, gitCommit, buildDate = "1.2.3", "abc123", "2024-05-01T00:00:00Z"
+	// ldflags 设置的值优先于 go build 记录的 VCS 信息
+	info := buildInfo()
+	if info != (VersionInfo{Version: "1.2.3", GitCommit: "abc123", BuildDate: "2024-05-01T00:00:00Z", GoVersion: runtime.Version()}) {
+		t.Fatalf("build info = %+v", info)
+	}
+
+	gitCommit, buildDate = "", ""
+	if info = buildInfo(); info.GitCommit == "" || info.BuildDate == "" {
+		t.Fatalf("build info without ldflags = %+v", info)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	ts := newTestServer(t, nil)
+	// 不需要认证
+	resp, data := ts.do(http.MethodGet, "", "/version", nil)
+	var info VersionInfo
+	decodeJSON(t, data, &info)
+	if resp.StatusCode != http.StatusOK || info.Version != version || info.GoVersion != runtime.Version() {
+		t.Fatalf("version = %d %s", resp.StatusCode, data)
+	}
+	if resp, _ = ts.do(http.MethodPost, "", "/version", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /version = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errRunawayOutput 命令持续高速输出, 被输出看门狗中止
+var errRunawayOutput = errors.New("command aborted: output rate limit exceeded")
+
+// defaultOutputRateWindow 输出速率的默认统计窗口
+const defaultOutputRateWindow = 5 * time.Second
+
+// rateWatchdog 按固定窗口统计命令的输出字节数, 一个窗口内超过 limit*window 即判定为失控
+// 窗口从第一次输出开始, 不等窗口结束, 超出预算时立即中止
+type rateWatchdog struct {
+	limit  int
+	budget int
+	window time.Duration
+	start  time.Time
+	bytes  int
+}
+
+// newRateWatchdog 按配置创建看门狗, 未配置 output_rate_limit 时返回 nil
+func newRateWatchdog(live *serverSettings) *rateWatchdog {
+	if live.outputRateLimit == 0 {
+		return nil
+	}
+	return &rateWatchdog{
+		limit:  live.outputRateLimit,
+		budget: int(int64(live.outputRateLimit) * int64(live.outputRateWindow) / int64(time.Second)),
+		window: live.outputRateWindow,
+	}
+}
+
+// add 记录读到的 n 个字节, 超过窗口预算时返回 errRunawayOutput
+func (w *rateWatchdog) add(n int) error {
+	if w == nil {
+		return nil
+	}
+	now := time.Now()
+	if w.start.IsZero() || now.Sub(w.start) >= w.window {
+		w.start = now
+		w.bytes = 0
+	}
+	w.bytes += n
+	if w.bytes > w.budget {
+		return fmt.Errorf("%w: more than %d bytes within %s (output_rate_limit %d bytes/s)", errRunawayOutput, w.budget, w.window, w.limit)
+	}
+	return nil
+}
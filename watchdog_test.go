@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateWatchdog(t *testing.T) {
+	if newRateWatchdog(&serverSettings{}) != nil {
+		t.Fatal("watchdog created without output_rate_limit")
+	}
+	var nilWatch *rateWatchdog
+	if err := nilWatch.add(1 << 30); err != nil {
+		t.Fatalf("nil watchdog = %v", err)
+	}
+
+	w := newRateWatchdog(&serverSettings{outputRateLimit: 100, outputRateWindow: 2 * time.Second})
+	if w.budget != 200 {
+		t.Fatalf("budget = %d, want 200", w.budget)
+	}
+	if err := w.add(150); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.add(50); err != nil {
+		t.Fatalf("exactly the budget = %v", err)
+	}
+	if err := w.add(1); !errors.Is(err, errRunawayOutput) {
+		t.Fatalf("over budget = %v, want errRunawayOutput", err)
+	}
+
+	// 窗口结束后重新计数
+	w = newRateWatchdog(&serverSettings{outputRateLimit: 100, outputRateWindow: 20 * time.Millisecond})
+	w.add(2)
+	time.Sleep(30 * time.Millisecond)
+	if err := w.add(2); err != nil || w.bytes != 2 {
+		t.Fatalf("new window = %v, %d bytes", err, w.bytes)
+	}
+}
+
+func TestRunawayOutputRestartsShell(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.OutputRateLimit = 500
+		cfg.OutputRateWindow = Duration(time.Second)
+		cfg.FakeOutputs = map[string]FakeOutput{"Flood": {Output: strings.Repeat("y\n", 2000)}}
+	})
+	id := ts.startSession(aliceToken, map[string]any{"init": []string{"echo init"}})
+	s, _ := sessionManager.GetSession(id)
+	oldProc := s.proc
+
+	resp, data := ts.run(aliceToken, id, "Flood", nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity || errorCodeOf(t, data) != codeOutputRunaway {
+		t.Fatalf("flood = %d %s", resp.StatusCode, data)
+	}
+	if s.proc == oldProc {
+		t.Fatal("shell not restarted")
+	}
+	events, _ := sessionManager.Store.Events(id)
+	if last := events[len(events)-1]; last.Type != "restarted" || !strings.Contains(last.Message, "output watchdog") {
+		t.Fatalf("last event = %+v", last)
+	}
+
+	// 低于上限的命令照常执行
+	if resp, data = ts.run(aliceToken, id, "echo ok", nil); resp.StatusCode != http.StatusOK || string(data) != "ok" {
+		t.Fatalf("run after restart = %d %q", resp.StatusCode, data)
+	}
+}
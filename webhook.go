@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 可以发送的 webhook 事件
+const (
+	EventSessionCreated   = "session_created"
+	EventSessionEnded     = "session_ended"
+	EventCommandCompleted = "command_completed"
+	EventCommandFailed    = "command_failed"
+	// EventSessionIdleWarning 会话即将因空闲被结束
+	EventSessionIdleWarning = "session_idle_warning"
+)
+
+const (
+	defaultWebhookTimeout   = 5 * time.Second
+	defaultWebhookRetries   = 3
+	defaultWebhookQueueSize = 100
+	webhookRetryBaseDelay   = time.Second
+	webhookSignatureHeader  = "X-Webhook-Signature"
+	webhookEventHeader      = "X-Webhook-Event"
+	webhookSignaturePrefix  = "sha256="
+)
+
+// WebhookConfig 事件通知配置
+type WebhookConfig struct {
+	// URL 接收事件的地址
+	URL string `json:"url"`
+	// Secret 不为空时用 HMAC-SHA256 对请求体签名, 放在 X-Webhook-Signature 中
+	Secret string `json:"secret"`
+	// Events 发送的事件, 为空时发送所有事件
+	Events []string `json:"events"`
+	// Timeout 单次请求的超时
+	Timeout Duration `json:"timeout"`
+	// MaxRetries 请求失败后的重试次数
+	MaxRetries int `json:"max_retries"`
+	// QueueSize 待发送事件队列的长度, 队列满时丢弃新事件
+	QueueSize int `json:"queue_size"`
+}
+
+// UnmarshalJSON 未设置的字段使用默认值
+func (c *WebhookConfig) UnmarshalJSON(data []byte) error {
+	type plain WebhookConfig
+	v := plain{
+		Timeout:    Duration(defaultWebhookTimeout),
+		MaxRetries: defaultWebhookRetries,
+		QueueSize:  defaultWebhookQueueSize,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = WebhookConfig(v)
+	return nil
+}
+
+func (c *WebhookConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url must be an http or https URL")
+	}
+	for _, event := range c.Events {
+		switch event {
+		case EventSessionCreated, EventSessionEnded, EventCommandCompleted, EventCommandFailed, EventSessionIdleWarning:
+		default:
+			return fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("webhook timeout must be positive")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("webhook max_retries must not be negative")
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("webhook queue_size must be positive")
+	}
+	return nil
+}
+
+// WebhookEvent 发送给接收方的事件内容
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant"`
+	SessionID string    `json:"session_id"`
+	Command   string    `json:"command,omitempty"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// RemainingMs 空闲警告时距离会话被结束的时间(毫秒)
+	RemainingMs *int64 `json:"remaining_ms,omitempty"`
+}
+
+// Webhook 在后台按顺序发送事件, 不阻塞命令执行
+type Webhook struct {
+	cfg    *WebhookConfig
+	events map[string]bool
+	queue  chan WebhookEvent
+	client *http.Client
+}
+
+func NewWebhook(cfg *WebhookConfig) *Webhook {
+	wh := &Webhook{
+		cfg:    cfg,
+		queue:  make(chan WebhookEvent, cfg.QueueSize),
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+	}
+	if len(cfg.Events) > 0 {
+		wh.events = make(map[string]bool, len(cfg.Events))
+		for _, event := range cfg.Events {
+			wh.events[event] = true
+		}
+	}
+	go wh.sendLoop()
+	return wh
+}
+
+// Notify 将事件放入发送队列, 队列已满时丢弃
+func (wh *Webhook) Notify(event WebhookEvent) {
+	if wh.events != nil && !wh.events[event.Event] {
+		return
+	}
+	select {
+	case wh.queue <- event:
+	default:
+		log.Printf("⚠ Webhook queue full, event dropped | Event: %s | SessionID: %s", event.Event, event.SessionID)
+	}
+}
+
+func (wh *Webhook) sendLoop() {
+	for event := range wh.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("✗ Failed to encode webhook event | Event: %s | Error: %v", event.Event, err)
+			continue
+		}
+
+		delay := webhookRetryBaseDelay
+		for attempt := 0; ; attempt++ {
+			err = wh.send(event.Event, body)
+			if err == nil {
+				break
+			}
+			if attempt >= wh.cfg.MaxRetries {
+				log.Printf("✗ Webhook delivery failed | Event: %s | SessionID: %s | Attempts: %d | Error: %v", event.Event, event.SessionID, attempt+1, err)
+				break
+			}
+			log.Printf("⚠ Webhook delivery failed, retrying | Event: %s | Attempt: %d | Error: %v", event.Event, attempt+1, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// send 发送一次事件, 非 2xx 响应视为失败
+func (wh *Webhook) send(eventType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	if wh.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, webhookSignaturePrefix+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+var webhook *Webhook
+
+// notifySession 发送会话事件, 未配置 webhook 时不做任何事
+func notifySession(event, tenant, sessionID string) {
+	if webhook == nil {
+		return
+	}
+	webhook.Notify(WebhookEvent{
+		Event:     event,
+		Time:      time.Now(),
+		Tenant:    tenant,
+		SessionID: sessionID,
+	})
+}
+
+// notifyIdleWarning 发送空闲警告事件, 未配置 webhook 时不做任何事
+func notifyIdleWarning(tenant, sessionID string, remaining time.Duration) {
+	if webhook == nil {
+		return
+	}
+	ms := remaining.Milliseconds()
+	webhook.Notify(WebhookEvent{
+		Event:       EventSessionIdleWarning,
+		Time:        time.Now(),
+		Tenant:      tenant,
+		SessionID:   sessionID,
+		RemainingMs: &ms,
+	})
+}
+
+// notifyCommand 发送命令执行结果事件, 未配置 webhook 时不做任何事
+func notifyCommand(identity *Identity, sessionID, command string, result *CommandResult, err error) {
+	if webhook == nil {
+		return
+	}
+	event := WebhookEvent{
+		Event:     EventCommandCompleted,
+		Time:      time.Now(),
+		Tenant:    identity.Name,
+		SessionID: sessionID,
+		Command:   secretRegistry.Redact(command),
+	}
+	if result != nil {
+		event.ExitCode = result.ExitCode
+	}
+	if err != nil {
+		event.Event = EventCommandFailed
+		event.Error = secretRegistry.Redact(err.Error())
+	}
+	webhook.Notify(event)
+}
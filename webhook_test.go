@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// webhookDelivery 接收方收到的一次请求
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// startWebhookReceiver 启动接收 webhook 的服务, 并让服务端向它发送 events 中的事件
+func startWebhookReceiver(t *testing.T, secret string, events ...string) <-chan webhookDelivery {
+	t.Helper()
+	deliveries := make(chan webhookDelivery, 16)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- webhookDelivery{header: r.Header.Clone(), body: body}
+	}))
+	t.Cleanup(receiver.Close)
+
+	var cfg WebhookConfig
+	if err := json.Unmarshal([]byte(`{"url": "`+receiver.URL+`"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Secret, cfg.Events = secret, events
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	webhook = NewWebhook(&cfg)
+	t.Cleanup(func() { webhook = nil })
+	return deliveries
+}
+
+// nextDelivery 等待下一次 webhook 请求
+func nextDelivery(t *testing.T, deliveries <-chan webhookDelivery) webhookDelivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+		return webhookDelivery{}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ts := newTestServer(t, nil)
+	deliveries := startWebhookReceiver(t, "webhook-secret", EventCommandCompleted)
+	id := ts.startSession(aliceToken, nil)
+	ts.run(aliceToken, id, "echo hi", nil)
+
+	// 只发送配置的事件, session_created 不发送
+	d := nextDelivery(t, deliveries)
+	var event WebhookEvent
+	decodeJSON(t, d.body, &event)
+	if event.Event != EventCommandCompleted || event.SessionID != id || event.Tenant != "alice" || event.Command != "echo hi" {
+		t.Fatalf("event = %s", d.body)
+	}
+	if d.header.Get(webhookEventHeader) != EventCommandCompleted {
+		t.Fatalf("event header = %q", d.header.Get(webhookEventHeader))
+	}
+
+	// 签名为请求体原文的 HMAC-SHA256, 接收方用同一个密钥验证
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(d.body)
+	if want := webhookSignaturePrefix + hex.EncodeToString(mac.Sum(nil)); d.header.Get(webhookSignatureHeader) != want {
+		t.Fatalf("signature = %q, want %q", d.header.Get(webhookSignatureHeader), want)
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	ts := newTestServer(t, nil)
+	deliveries := startWebhookReceiver(t, "")
+	ts.startSession(aliceToken, nil)
+
+	// 没有配置密钥时不签名
+	d := nextDelivery(t, deliveries)
+	if d.header.Get(webhookEventHeader) != EventSessionCreated || d.header.Get(webhookSignatureHeader) != "" {
+		t.Fatalf("headers = %v", d.header)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles 调试页面的静态文件, 编译进二进制
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// webUIHandler 提供 /ui/ 下的静态文件
+// 浏览器打开页面时无法带上 Bearer Token, 页面本身不需要认证, 其中的请求都由用户输入的管理员令牌认证
+func webUIHandler() http.HandlerFunc {
+	// ui 目录一定存在于嵌入的文件中, fs.Sub 不会出错
+	root, _ := fs.Sub(uiFiles, "ui")
+	files := http.StripPrefix("/ui/", http.FileServer(http.FS(root)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		header := w.Header()
+		// 只加载同源的脚本, 页面不能被其他站点嵌入
+		header.Set("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline'; frame-ancestors 'none'")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Cache-Control", "no-store")
+		files.ServeHTTP(w, r)
+	}
+}
+
+// API25: 确认调试页面使用的是管理员令牌
+func handleWebUICheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebUIDisabled(t *testing.T) {
+	ts := newTestServer(t, nil)
+	for _, path := range []string{"/ui/", "/ui/check"} {
+		if resp, _ := ts.do(http.MethodGet, adminToken, path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s without web_ui = %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) { cfg.WebUI = true })
+	if !newCapabilities(ts.cfg).Features.WebUI {
+		t.Fatal("capabilities web_ui = false")
+	}
+
+	// 页面本身不需要认证
+	resp, data := ts.do(http.MethodGet, "", "/ui/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(data), "app.js") {
+		t.Fatalf("GET /ui/ = %d %s", resp.StatusCode, data)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") || !strings.Contains(csp, "frame-ancestors 'none'") {
+		t.Fatalf("Content-Security-Policy = %q", csp)
+	}
+	if resp, _ = ts.do(http.MethodGet, "", "/ui/app.js", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /ui/app.js = %d", resp.StatusCode)
+	}
+	if resp, _ = ts.do(http.MethodPost, "", "/ui/", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /ui/ = %d", resp.StatusCode)
+	}
+
+	// 页面中的请求需要管理员令牌
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{adminToken, http.StatusNoContent},
+		{aliceToken, http.StatusForbidden},
+		{"", http.StatusUnauthorized},
+	} {
+		if resp, _ := ts.do(http.MethodGet, tt.token, "/ui/check", nil); resp.StatusCode != tt.want {
+			t.Errorf("GET /ui/check with %q = %d, want %d", tt.token, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// WhoamiResponse 请求方通过认证后的身份, 用于排查凭据问题
+type WhoamiResponse struct {
+	// Tenant 租户名称, 未启用认证时为空
+	Tenant string `json:"tenant"`
+	Admin  bool   `json:"admin"`
+	// Method 通过认证的方式: none、token、signature、jwt、cert, auth_mode 为 both 时为 cert+ 加令牌的方式
+	Method string `json:"method"`
+	// Scopes 身份可以使用的接口范围: sessions 为会话相关接口, admin 为管理员接口和 debug
+	Scopes []string `json:"scopes"`
+	// Sessions 租户当前持有的会话数, MaxSessions 为会话数上限, 0 表示不限制
+	Sessions    int `json:"sessions"`
+	MaxSessions int `json:"max_sessions"`
+}
+
+// API32: 返回请求方的身份, 不创建会话也不修改任何状态, 认证失败时由 requireAuth 返回 401
+func handleWhoami(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	identity := identityFrom(r)
+	resp := WhoamiResponse{
+		Tenant:      identity.Name,
+		Admin:       identity.Admin,
+		Method:      identity.Method,
+		Scopes:      []string{"sessions"},
+		Sessions:    sessionManager.Owned(identity.Name),
+		MaxSessions: sessionManager.quotaFor(identity.Name),
+	}
+	if identity.Admin {
+		resp.Scopes = append(resp.Scopes, "admin")
+	}
+	log.Printf("✓ Identity checked | Tenant: %s | Method: %s | Admin: %t", identity.Name, identity.Method, identity.Admin)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// whoami 以 token 查询身份, 返回状态码和响应
+func (ts *testServer) whoami(token string) (int, WhoamiResponse) {
+	ts.t.Helper()
+	resp, data := ts.do(http.MethodGet, token, "/whoami", nil)
+	var out WhoamiResponse
+	if resp.StatusCode == http.StatusOK {
+		decodeJSON(ts.t, data, &out)
+	}
+	return resp.StatusCode, out
+}
+
+func TestWhoami(t *testing.T) {
+	limit := 5
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.MaxSessionsPerToken = 3
+		cfg.Tokens[0].MaxSessions = &limit
+	})
+	ts.startSession(aliceToken, nil)
+
+	status, out := ts.whoami(aliceToken)
+	want := WhoamiResponse{Tenant: "alice", Method: authMethodToken, Scopes: []string{"sessions"}, Sessions: 1, MaxSessions: 5}
+	if status != http.StatusOK || !reflect.DeepEqual(out, want) {
+		t.Fatalf("alice = %d %+v", status, out)
+	}
+	status, out = ts.whoami(adminToken)
+	want = WhoamiResponse{Tenant: "admin", Admin: true, Method: authMethodToken, Scopes: []string{"sessions", "admin"}, MaxSessions: 3}
+	if status != http.StatusOK || !reflect.DeepEqual(out, want) {
+		t.Fatalf("admin = %d %+v", status, out)
+	}
+
+	// 不创建会话也不修改状态, 凭据无效时返回 401
+	if status, _ = ts.whoami("wrong-token"); status != http.StatusUnauthorized {
+		t.Fatalf("invalid token = %d", status)
+	}
+	if resp, _ := ts.post(bobToken, "/whoami", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST = %d", resp.StatusCode)
+	}
+	if resp, _ := ts.do(http.MethodDelete, bobToken, "/whoami", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE = %d", resp.StatusCode)
+	}
+	if n := sessionManager.Owned("bob"); n != 0 {
+		t.Fatalf("whoami created %d sessions", n)
+	}
+}
+
+func TestWhoamiAuthDisabled(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Tokens = nil
+	})
+	// 未启用认证时为管理员, 租户为空
+	status, out := ts.whoami("")
+	if status != http.StatusOK || out.Tenant != "" || !out.Admin || out.Method != authMethodNone {
+		t.Fatalf("whoami without auth = %d %+v", status, out)
+	}
+}